@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mau.fi/mautrix-meta/pkg/pseudonym"
+)
+
+// Corpus is an anonymized archive in the import-sample JSON format
+type Corpus struct {
+	Contacts []Contact `json:"contacts"`
+	Threads  []Thread  `json:"threads"`
+	// CurrentUser is the archive owner's contact, 0 if unknown
+	CurrentUser int64 `json:"current_user,omitempty"`
+}
+
+type Contact struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type Thread struct {
+	ID           int64     `json:"id"`
+	Name         string    `json:"name"`
+	Type         int       `json:"type"`
+	Participants []int64   `json:"participants"`
+	Messages     []Message `json:"messages"`
+}
+
+type Message struct {
+	Sender int64  `json:"sender"`
+	Text   string `json:"text"`
+	TS     string `json:"ts"` // RFC3339 with milliseconds, UTC
+}
+
+// Options selects what goes into the corpus
+type Options struct {
+	ThreadIDs map[int64]bool // Empty = all threads
+	SinceMs   int64
+	UntilMs   int64
+	// Key seeds digit and word replacements; the same key gives the same
+	// corpus, so keep it private
+	Key []byte
+	// ScrambleWords replaces every word with a made-up one of the same
+	// length, the same for every occurrence
+	ScrambleWords bool
+}
+
+// New IDs start here, as in sample_data/conversations.json
+const (
+	contactIDBase = 1000
+	threadIDBase  = 9000
+)
+
+var (
+	emailRe = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	linkRe  = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+	digitRe = regexp.MustCompile(`\d+`)
+	wordRe  = regexp.MustCompile(`\p{L}+`)
+	// placeholderRe finds what protect set aside: a private-use rune per
+	// replacement
+	placeholderRe = regexp.MustCompile("[\uE000-\uF8FF]")
+)
+
+// archiveMessage is a message as read from the archive
+type archiveMessage struct {
+	threadID, senderID, timestampMs int64
+	text                            string
+}
+
+// buildCorpus reads the selected threads and anonymizes them. Contacts and
+// threads get new IDs in the order of their original ones; names become
+// "Participant N", also where they are mentioned in text, and thread names
+// "Thread N". Messages keep their sender, order and timestamp. Links and
+// e-mail addresses are masked, digits replaced. Unsent and text-less
+// messages are left out.
+func buildCorpus(db *sql.DB, opts Options) (*Corpus, error) {
+	messages, err := loadMessages(db, opts)
+	if err != nil {
+		return nil, fmt.Errorf("loading messages: %w", err)
+	}
+	threads := make(map[int64]bool)
+	senders := make(map[int64]bool)
+	for _, m := range messages {
+		threads[m.threadID] = true
+		senders[m.senderID] = true
+	}
+
+	participants, err := loadParticipants(db, threads)
+	if err != nil {
+		return nil, fmt.Errorf("loading participants: %w", err)
+	}
+	for _, ids := range participants {
+		for _, id := range ids {
+			senders[id] = true
+		}
+	}
+	names, err := loadContactNames(db)
+	if err != nil {
+		return nil, fmt.Errorf("loading contacts: %w", err)
+	}
+
+	// Contacts in the corpus are numbered first; everyone else in the
+	// archive still gets a pseudonym for mentions
+	contactIDs := make(map[int64]int64)
+	corpus := &Corpus{Contacts: []Contact{}, Threads: []Thread{}}
+	for _, id := range slices.Sorted(maps.Keys(senders)) {
+		n := int64(len(contactIDs) + 1)
+		contactIDs[id] = contactIDBase + n
+		corpus.Contacts = append(corpus.Contacts, Contact{ID: contactIDBase + n, Name: pseudonym.Participant(n)})
+	}
+	aliases := make(pseudonym.Names)
+	next := int64(len(contactIDs))
+	for _, id := range slices.Sorted(maps.Keys(names)) {
+		n := next + 1
+		if newID, ok := contactIDs[id]; ok {
+			n = newID - contactIDBase
+		} else {
+			next++
+		}
+		aliases.Add(names[id], pseudonym.Participant(n))
+	}
+	anon := newAnonymizer(opts.Key, aliases, opts.ScrambleWords)
+
+	if owner, err := currentUserID(db); err != nil {
+		return nil, fmt.Errorf("loading current user: %w", err)
+	} else if id, ok := contactIDs[owner]; ok {
+		corpus.CurrentUser = id
+	}
+
+	types, err := loadThreadTypes(db, threads)
+	if err != nil {
+		return nil, fmt.Errorf("loading threads: %w", err)
+	}
+	threadIDs := make(map[int64]int)
+	for _, id := range slices.Sorted(maps.Keys(threads)) {
+		threadIDs[id] = len(corpus.Threads)
+		t := Thread{
+			ID:           threadIDBase + int64(len(corpus.Threads)+1),
+			Type:         types[id],
+			Participants: []int64{},
+			Messages:     []Message{},
+		}
+		t.Name = "Thread " + strconv.Itoa(len(corpus.Threads)+1)
+		for _, p := range participants[id] {
+			t.Participants = append(t.Participants, contactIDs[p])
+		}
+		corpus.Threads = append(corpus.Threads, t)
+	}
+	for _, m := range messages {
+		t := &corpus.Threads[threadIDs[m.threadID]]
+		if !slices.Contains(t.Participants, contactIDs[m.senderID]) {
+			t.Participants = append(t.Participants, contactIDs[m.senderID])
+		}
+		t.Messages = append(t.Messages, Message{
+			Sender: contactIDs[m.senderID],
+			Text:   anon.text(m.text),
+			TS:     time.UnixMilli(m.timestampMs).UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		})
+	}
+	for i := range corpus.Threads {
+		slices.Sort(corpus.Threads[i].Participants)
+	}
+	return corpus, nil
+}
+
+func loadMessages(db *sql.DB, opts Options) ([]archiveMessage, error) {
+	query := `
+		SELECT thread_id, sender_id, text, timestamp_ms
+		FROM messages
+		WHERE is_unsent = 0 AND text IS NOT NULL AND TRIM(text) != ''`
+	var args []any
+	if opts.SinceMs > 0 {
+		query += ` AND timestamp_ms >= ?`
+		args = append(args, opts.SinceMs)
+	}
+	if opts.UntilMs > 0 {
+		query += ` AND timestamp_ms < ?`
+		args = append(args, opts.UntilMs)
+	}
+	if len(opts.ThreadIDs) > 0 {
+		ids := slices.Sorted(maps.Keys(opts.ThreadIDs))
+		query += ` AND thread_id IN (?` + strings.Repeat(", ?", len(ids)-1) + `)`
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	query += ` ORDER BY thread_id, timestamp_ms, id`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []archiveMessage
+	for rows.Next() {
+		var m archiveMessage
+		if err := rows.Scan(&m.threadID, &m.senderID, &m.text, &m.timestampMs); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// loadParticipants returns the members of the given threads, by thread
+func loadParticipants(db *sql.DB, threads map[int64]bool) (map[int64][]int64, error) {
+	rows, err := db.Query(`SELECT thread_id, contact_id FROM thread_participants ORDER BY thread_id, contact_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int64][]int64)
+	for rows.Next() {
+		var threadID, contactID int64
+		if err := rows.Scan(&threadID, &contactID); err != nil {
+			return nil, err
+		}
+		if threads[threadID] {
+			out[threadID] = append(out[threadID], contactID)
+		}
+	}
+	return out, rows.Err()
+}
+
+func loadContactNames(db *sql.DB) (map[int64]string, error) {
+	rows, err := db.Query(`SELECT id, name FROM contacts WHERE name IS NOT NULL AND name != ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		out[id] = name
+	}
+	return out, rows.Err()
+}
+
+func loadThreadTypes(db *sql.DB, threads map[int64]bool) (map[int64]int, error) {
+	rows, err := db.Query(`SELECT id, thread_type FROM threads`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int64]int)
+	for rows.Next() {
+		var id int64
+		var kind int
+		if err := rows.Scan(&id, &kind); err != nil {
+			return nil, err
+		}
+		if threads[id] {
+			out[id] = kind
+		}
+	}
+	for id := range threads {
+		if _, ok := out[id]; !ok {
+			out[id] = 1 // Messages of a thread the threads table doesn't have
+		}
+	}
+	return out, rows.Err()
+}
+
+func currentUserID(db *sql.DB) (int64, error) {
+	var value string
+	err := db.QueryRow(`SELECT value FROM sync_metadata WHERE key = 'current_user_id'`).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	id, _ := strconv.ParseInt(value, 10, 64)
+	return id, nil
+}
+
+// anonymizer rewrites message text. Replacements are keyed, so the same
+// number or word maps to the same stand-in throughout the corpus (keeping
+// lexical matches reproducible) without being reversible without the key.
+type anonymizer struct {
+	key           []byte
+	names         *pseudonym.Replacer
+	scrambleWords bool
+}
+
+func newAnonymizer(key []byte, aliases pseudonym.Names, scrambleWords bool) *anonymizer {
+	return &anonymizer{key: key, names: pseudonym.NewReplacer(aliases), scrambleWords: scrambleWords}
+}
+
+// text anonymizes one message. Masks and pseudonyms are set aside behind
+// placeholders first, so digits and words inside them are left alone.
+func (a *anonymizer) text(s string) string {
+	// Private-use runes in the message itself would be mistaken for
+	// placeholders
+	s = placeholderRe.ReplaceAllString(s, "")
+
+	var kept []string
+	protect := func(replacement string) string {
+		if len(kept) > 0xF8FF-0xE000 {
+			return replacement
+		}
+		kept = append(kept, replacement)
+		return string(rune(0xE000 + len(kept) - 1))
+	}
+	s = linkRe.ReplaceAllStringFunc(s, func(string) string { return protect("[link]") })
+	s = emailRe.ReplaceAllStringFunc(s, func(string) string { return protect("[email]") })
+	s = a.names.ReplaceFunc(s, protect)
+
+	s = digitRe.ReplaceAllStringFunc(s, a.digits)
+	if a.scrambleWords {
+		s = wordRe.ReplaceAllStringFunc(s, a.word)
+	}
+	return placeholderRe.ReplaceAllStringFunc(s, func(p string) string {
+		r, _ := utf8.DecodeRuneInString(p)
+		if i := int(r - 0xE000); i < len(kept) {
+			return kept[i]
+		}
+		return ""
+	})
+}
+
+// digits replaces a run of digits with another of the same length
+func (a *anonymizer) digits(run string) string {
+	stream := a.stream("d:" + run)
+	out := make([]byte, len(run))
+	for i := range out {
+		out[i] = '0' + stream(10)
+	}
+	return string(out)
+}
+
+// word replaces a word with made-up letters of the same length, keeping
+// whether it was capitalized or all caps
+func (a *anonymizer) word(w string) string {
+	runes := []rune(w)
+	stream := a.stream("w:" + strings.ToLower(w))
+	out := make([]rune, len(runes))
+	for i := range out {
+		out[i] = rune('a' + stream(26))
+	}
+	switch {
+	case len(runes) > 1 && strings.ToUpper(w) == w:
+		return strings.ToUpper(string(out))
+	case unicode.IsUpper(runes[0]):
+		out[0] = unicode.ToUpper(out[0])
+	}
+	return string(out)
+}
+
+// stream returns a generator of keyed pseudo-random values below n for
+// input: HMAC-SHA256 blocks of the key over input and a counter
+func (a *anonymizer) stream(input string) func(n byte) byte {
+	var block []byte
+	var counter uint32
+	return func(n byte) byte {
+		for {
+			if len(block) == 0 {
+				mac := hmac.New(sha256.New, a.key)
+				mac.Write([]byte(input))
+				binary.Write(mac, binary.BigEndian, counter)
+				counter++
+				block = mac.Sum(nil)
+			}
+			b := block[0]
+			block = block[1:]
+			// Rejecting the top of the range keeps values uniform
+			if int(b) < 256-256%int(n) {
+				return b % n
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// anon-corpus derives a shareable benchmark corpus from the archive, for
+// reproducing retrieval experiments and bug reports without private data.
+// The output is import-sample JSON, so anyone can load it into a fresh
+// database:
+//
+//	import-sample -json corpus.json -db bench.db
+//
+// Contacts become "Participant N" (also where they are named in text) and
+// threads "Thread N", both with new IDs; thread types, participants, senders,
+// message order and timestamps are kept. Links and e-mail addresses are
+// masked and every run of digits is replaced with a keyed one of the same
+// length. The text itself stays readable unless -scramble-words is given.
+// Names are only caught as written in the contacts table (not nicknames or
+// inflected forms); check the output before sending it anywhere.
+//
+// Usage:
+//
+//	anon-corpus -out corpus.json
+//	anon-corpus -out corpus.json -thread 123456,234567 -since 2023 -until 2024
+//	anon-corpus -out corpus.json -scramble-words -seed "$(cat corpus.key)"
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/rag"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	dbPath        = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile     = storage.KeyFileFlag()
+	cfgPath       = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	outPath       = flag.String("out", "", "Output file, or - for stdout (required)")
+	threads       = flag.String("thread", "", "Comma-separated thread IDs to include (default: all)")
+	since         = flag.String("since", "", "Only messages at or after this time (2006, 2006-01, 2006-01-02 or RFC3339)")
+	until         = flag.String("until", "", "Only messages before this time")
+	seed          = flag.String("seed", "", "Secret for digit and word replacements; the same seed gives the same corpus (default: random)")
+	scrambleWords = flag.Bool("scramble-words", false, "Replace every word with a made-up one of the same length (same word, same stand-in)")
+	debug         = flag.Bool("debug", false, "Enable debug logging")
+)
+
+func main() {
+	flag.Parse()
+
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	if *outPath == "" {
+		log.Fatal().Msg("-out is required")
+	}
+
+	opts := Options{ScrambleWords: *scrambleWords}
+	var err error
+	if opts.SinceMs, err = parseBound(*since); err != nil {
+		log.Fatal().Err(err).Msg("Invalid -since")
+	}
+	if opts.UntilMs, err = parseBound(*until); err != nil {
+		log.Fatal().Err(err).Msg("Invalid -until")
+	}
+	if opts.ThreadIDs, err = parseIDList(*threads); err != nil {
+		log.Fatal().Err(err).Msg("Invalid -thread")
+	}
+	if *seed != "" {
+		opts.Key = []byte(*seed)
+	} else {
+		opts.Key = make([]byte, 32)
+		if _, err := rand.Read(opts.Key); err != nil {
+			log.Fatal().Err(err).Msg("Failed to generate a key")
+		}
+	}
+
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	db, err := sql.Open(storage.Driver("sqlite3"), sqlitePath+"?mode=ro")
+	if err != nil {
+		log.Fatal().Err(err).Str("path", sqlitePath).Msg("Failed to open database")
+	}
+	defer db.Close()
+
+	corpus, err := buildCorpus(db, opts)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to build corpus")
+	}
+	if err := writeCorpus(*outPath, corpus); err != nil {
+		log.Fatal().Err(err).Str("out", *outPath).Msg("Failed to write corpus")
+	}
+
+	messages := 0
+	for _, t := range corpus.Threads {
+		messages += len(t.Messages)
+	}
+	log.Info().
+		Int("contacts", len(corpus.Contacts)).
+		Int("threads", len(corpus.Threads)).
+		Int("messages", messages).
+		Str("out", *outPath).
+		Msg("Wrote anonymized corpus")
+}
+
+func writeCorpus(path string, c *Corpus) error {
+	if path == "-" {
+		return encodeCorpus(os.Stdout, c)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := encodeCorpus(f, c); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func encodeCorpus(w io.Writer, c *Corpus) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func parseBound(s string) (int64, error) {
+	t, err := rag.ParseSearchTime(s)
+	if err != nil || t.IsZero() {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
+
+func parseIDList(s string) (map[int64]bool, error) {
+	ids := make(map[int64]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid thread ID %q", part)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
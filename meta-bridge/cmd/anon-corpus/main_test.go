@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/storage/storagetest"
+)
+
+func newTestArchive(t *testing.T) *sql.DB {
+	t.Helper()
+	return storagetest.NewArchive(t,
+		`INSERT INTO contacts (id, name, created_at, updated_at) VALUES
+			(11, 'Anna Nowak', 0, 0), (12, 'Bartek Kowalski', 0, 0), (13, 'Celina', 0, 0)`,
+		`INSERT INTO threads (id, thread_type, name, created_at, updated_at) VALUES (5, 2, 'Chorwacja 2019', 0, 0), (6, 1, NULL, 0, 0)`,
+		`INSERT INTO thread_participants (thread_id, contact_id) VALUES (5, 11), (5, 12)`,
+		`INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms, created_at) VALUES
+			('m1', 5, 11, 'Bartek, call me at +48 600 123 456 or anna@example.com', 1561977600123, 0),
+			('m2', 5, 12, 'ok Anna, ask Celina, see https://maps.example.com/x', 1561977660000, 0),
+			('m3', 5, 11, 'unsent', 1561977720000, 0),
+			('m4', 6, 11, 'Ferry at 7:40, Ferry!', 1561977780000, 0),
+			('m5', 6, 11, '', 1561977840000, 0)`,
+		`UPDATE messages SET is_unsent = 1 WHERE id = 'm3'`,
+		`INSERT INTO sync_metadata (key, value, updated_at) VALUES ('current_user_id', '11', 0)`,
+	)
+}
+
+func TestBuildCorpus(t *testing.T) {
+	db := newTestArchive(t)
+
+	c, err := buildCorpus(db, Options{Key: []byte("k")})
+	if err != nil {
+		t.Fatalf("buildCorpus: %v", err)
+	}
+	if len(c.Contacts) != 2 || c.Contacts[0] != (Contact{ID: 1001, Name: "Participant 1"}) || c.CurrentUser != 1001 {
+		t.Fatalf("unexpected contacts: %+v (current %d)", c.Contacts, c.CurrentUser)
+	}
+	if len(c.Threads) != 2 {
+		t.Fatalf("expected 2 threads, got %+v", c.Threads)
+	}
+	group, dm := c.Threads[0], c.Threads[1]
+	if group.ID != 9001 || group.Name != "Thread 1" || group.Type != 2 || len(group.Participants) != 2 {
+		t.Errorf("unexpected group: %+v", group)
+	}
+	if len(group.Messages) != 2 || len(dm.Messages) != 1 {
+		t.Fatalf("expected unsent and empty messages left out, got %+v / %+v", group.Messages, dm.Messages)
+	}
+
+	m1 := group.Messages[0]
+	if m1.Sender != 1001 || m1.TS != "2019-07-01T10:40:00.123Z" {
+		t.Errorf("m1 sender/time = %d %s", m1.Sender, m1.TS)
+	}
+	if !regexp.MustCompile(`^Participant 2, call me at \+\d\d \d{3} \d{3} \d{3} or \[email\]$`).MatchString(m1.Text) ||
+		strings.Contains(m1.Text, "600 123 456") {
+		t.Errorf("m1 text = %q", m1.Text)
+	}
+	// Contacts outside the corpus still get a pseudonym
+	if m2 := group.Messages[1].Text; m2 != "ok Participant 1, ask Participant 3, see [link]" {
+		t.Errorf("m2 text = %q", m2)
+	}
+	for _, s := range []string{"Anna", "Bartek", "Celina", "Chorwacja", "example"} {
+		for _, th := range c.Threads {
+			for _, m := range th.Messages {
+				if strings.Contains(m.Text, s) {
+					t.Errorf("%q leaked into %q", s, m.Text)
+				}
+			}
+		}
+	}
+
+	// Same key, same corpus
+	again, _ := buildCorpus(db, Options{Key: []byte("k")})
+	if again.Threads[0].Messages[0].Text != m1.Text {
+		t.Errorf("replacements not stable: %q vs %q", again.Threads[0].Messages[0].Text, m1.Text)
+	}
+}
+
+func TestBuildCorpus_Filters(t *testing.T) {
+	db := newTestArchive(t)
+
+	c, err := buildCorpus(db, Options{Key: []byte("k"), ThreadIDs: map[int64]bool{6: true}})
+	if err != nil {
+		t.Fatalf("buildCorpus: %v", err)
+	}
+	if len(c.Threads) != 1 || len(c.Contacts) != 1 || c.Threads[0].Participants[0] != 1001 {
+		t.Fatalf("expected only thread 6 and its sender, got %+v", c)
+	}
+
+	c, err = buildCorpus(db, Options{Key: []byte("k"), SinceMs: 1561977700000})
+	if err != nil {
+		t.Fatalf("buildCorpus: %v", err)
+	}
+	if len(c.Threads) != 1 || c.Threads[0].Messages[0].TS != "2019-07-01T10:43:00.000Z" {
+		t.Fatalf("expected only the later message, got %+v", c.Threads)
+	}
+}
+
+func TestAnonymizer_ScrambleWords(t *testing.T) {
+	a := newAnonymizer([]byte("k"), map[string]string{"anna": "Participant 1"}, true)
+
+	got := a.text("Ferry at 7:40, FERRY ferry! Anna 2x")
+	words := strings.FieldsFunc(got, func(r rune) bool { return strings.ContainsRune(" ,:!", r) })
+	if len(words) != 9 {
+		t.Fatalf("expected the same shape, got %q", got)
+	}
+	if strings.Contains(strings.ToLower(got), "ferry") || !strings.Contains(got, " Participant 1 ") {
+		t.Errorf("scrambled text = %q", got)
+	}
+	// Case is kept, the word maps to the same stand-in
+	ferry, upper, lower := words[0], words[4], words[5]
+	if len(ferry) != 5 || ferry[0] < 'A' || ferry[0] > 'Z' || upper != strings.ToUpper(lower) || ferry[1:] != lower[1:] {
+		t.Errorf("inconsistent stand-ins %q %q %q", ferry, upper, lower)
+	}
+	if a.text("\uE000 hi") != a.text(" hi") {
+		t.Error("private-use runes in the text should be dropped, not expanded")
+	}
+}
@@ -0,0 +1,350 @@
+// audit checks the archive database for referential integrity problems.
+//
+// Checks:
+//   - messages whose thread or sender row is missing
+//   - attachments and reactions orphaned from their message
+//   - chunks referencing message IDs that no longer exist
+//   - FTS indexes out of sync with their content tables
+//
+// Reparable categories are fixed with --fix; the rest are reported with a hint.
+//
+// Usage:
+//
+//	audit --db messenger.db
+//	audit --db messenger.db --fix
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	dbPath    = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile = storage.KeyFileFlag()
+	cfgPath   = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	fix       = flag.Bool("fix", false, "Repair the reparable categories")
+	debug     = flag.Bool("debug", false, "Enable debug logging")
+)
+
+var validIdentRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// check is a single audit category
+type check struct {
+	name string
+	// tables that must exist for the check to apply
+	requires []string
+	count    func(ctx context.Context, db *sql.DB) (int64, error)
+	// repair returns the number of affected rows; nil = report only
+	repair func(ctx context.Context, db *sql.DB) (int64, error)
+	hint   string
+}
+
+type result struct {
+	check   *check
+	found   int64
+	fixed   int64
+	skipped bool
+	err     error
+}
+
+func main() {
+	flag.Parse()
+
+	// Setup logging
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	// Load configuration
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	ftsTable := cfg.Hybrid.BM25.Table
+	if !validIdentRe.MatchString(ftsTable) {
+		log.Warn().Str("table", ftsTable).Msg("Invalid FTS table name, falling back to 'chunks_fts'")
+		ftsTable = "chunks_fts"
+	}
+
+	driver, _, err := ragindex.LoadTokenizer(cfg)
+	if err != nil {
+		log.Warn().Err(err).Msg("Keyword index tokenizer not loaded")
+	}
+
+	// Read-write even in report mode: the FTS integrity-check is issued as an INSERT
+	db, err := sql.Open(storage.Driver(driver), sqlitePath+"?_busy_timeout=30000&_journal_mode=WAL")
+	if err != nil {
+		log.Fatal().Err(err).Str("path", sqlitePath).Msg("Failed to open database")
+	}
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		log.Fatal().Err(err).Msg("Database not accessible")
+	}
+
+	fmt.Printf("Auditing: %s\n", sqlitePath)
+	if *fix {
+		fmt.Println("Mode: fix")
+	} else {
+		fmt.Println("Mode: report only (use --fix to repair)")
+	}
+	fmt.Println()
+
+	ctx := context.Background()
+	results := runChecks(ctx, db, buildChecks(ftsTable), *fix)
+
+	printReport(results)
+
+	for _, r := range results {
+		if r.err != nil || (r.found > 0 && r.fixed < r.found) {
+			os.Exit(1)
+		}
+	}
+}
+
+func buildChecks(ftsTable string) []*check {
+	return []*check{
+		{
+			name:     "messages with missing thread",
+			requires: []string{"messages", "threads"},
+			count: countQuery(`
+				SELECT COUNT(*) FROM messages m
+				LEFT JOIN threads t ON t.id = m.thread_id
+				WHERE t.id IS NULL`),
+			repair: execQuery(`
+				INSERT OR IGNORE INTO threads (id, thread_type, created_at, updated_at)
+				SELECT DISTINCT m.thread_id, 1, :now, :now FROM messages m
+				LEFT JOIN threads t ON t.id = m.thread_id
+				WHERE t.id IS NULL`),
+			hint: "placeholder threads are created; names fill in on next sync",
+		},
+		{
+			name:     "messages with missing sender contact",
+			requires: []string{"messages", "contacts"},
+			count: countQuery(`
+				SELECT COUNT(*) FROM messages m
+				LEFT JOIN contacts c ON c.id = m.sender_id
+				WHERE c.id IS NULL`),
+			repair: execQuery(`
+				INSERT OR IGNORE INTO contacts (id, created_at, updated_at)
+				SELECT DISTINCT m.sender_id, :now, :now FROM messages m
+				LEFT JOIN contacts c ON c.id = m.sender_id
+				WHERE c.id IS NULL`),
+			hint: "placeholder contacts are created; names fill in on next sync",
+		},
+		{
+			name:     "attachments orphaned from messages",
+			requires: []string{"attachments", "messages"},
+			count: countQuery(`
+				SELECT COUNT(*) FROM attachments a
+				LEFT JOIN messages m ON m.id = a.message_id
+				WHERE m.id IS NULL`),
+			repair: execQuery(`
+				DELETE FROM attachments
+				WHERE message_id NOT IN (SELECT id FROM messages)`),
+		},
+		{
+			name:     "reactions orphaned from messages",
+			requires: []string{"reactions", "messages"},
+			count: countQuery(`
+				SELECT COUNT(*) FROM reactions r
+				LEFT JOIN messages m ON m.id = r.message_id
+				WHERE m.id IS NULL`),
+			repair: execQuery(`
+				DELETE FROM reactions
+				WHERE message_id NOT IN (SELECT id FROM messages)`),
+		},
+		{
+			name:     "chunks referencing missing messages",
+			requires: []string{"chunks", "messages"},
+			count: countQuery(`
+				SELECT COUNT(DISTINCT c.chunk_id) FROM chunks c, json_each(c.message_ids) j
+				LEFT JOIN messages m ON m.id = j.value
+				WHERE m.id IS NULL`),
+			hint: "re-chunk with: fts5-setup --from-db, then milvus-index",
+		},
+		{
+			name:     "message FTS rows without messages",
+			requires: []string{"messages_fts", "messages"},
+			count: countQuery(`
+				SELECT COUNT(*) FROM messages_fts
+				WHERE docid NOT IN (SELECT rowid FROM messages)`),
+			repair: execQuery(`
+				DELETE FROM messages_fts
+				WHERE docid NOT IN (SELECT rowid FROM messages)`),
+		},
+		{
+			name:     ftsTable + " out of sync with chunks",
+			requires: []string{ftsTable, "chunks"},
+			count:    ftsIntegrityCount(ftsTable),
+			repair:   ftsRebuild(ftsTable),
+			hint:     "the FTS index is rebuilt from the chunks table",
+		},
+	}
+}
+
+func runChecks(ctx context.Context, db *sql.DB, checks []*check, doFix bool) []result {
+	results := make([]result, 0, len(checks))
+	for _, c := range checks {
+		r := result{check: c}
+
+		if ok, err := tablesExist(ctx, db, c.requires); err != nil {
+			r.err = err
+			results = append(results, r)
+			continue
+		} else if !ok {
+			r.skipped = true
+			results = append(results, r)
+			continue
+		}
+
+		r.found, r.err = c.count(ctx, db)
+		if r.err == nil && doFix && r.found > 0 && c.repair != nil {
+			log.Debug().Str("check", c.name).Msg("Repairing")
+			if _, err := c.repair(ctx, db); err != nil {
+				r.err = fmt.Errorf("repair: %w", err)
+			} else if remaining, err := c.count(ctx, db); err != nil {
+				r.err = err
+			} else {
+				r.fixed = r.found - remaining
+			}
+		}
+
+		results = append(results, r)
+	}
+	return results
+}
+
+func printReport(results []result) {
+	fmt.Println("============================================================")
+	fmt.Println("AUDIT REPORT")
+	fmt.Println("============================================================")
+
+	var problems int64
+	for _, r := range results {
+		status := "ok"
+		switch {
+		case r.err != nil:
+			status = "ERROR: " + r.err.Error()
+		case r.skipped:
+			status = "skipped (table missing)"
+		case r.found > 0 && r.fixed > 0:
+			status = fmt.Sprintf("%d found, %d fixed", r.found, r.fixed)
+		case r.found > 0:
+			status = fmt.Sprintf("%d found", r.found)
+		}
+		fmt.Printf("  %-42s %s\n", r.check.name+":", status)
+
+		if r.found > r.fixed && r.err == nil {
+			problems += r.found - r.fixed
+			if r.check.repair == nil && r.check.hint != "" {
+				fmt.Printf("  %-42s -> %s\n", "", r.check.hint)
+			} else if r.check.repair != nil && !*fix {
+				msg := "reparable with --fix"
+				if r.check.hint != "" {
+					msg += " (" + r.check.hint + ")"
+				}
+				fmt.Printf("  %-42s -> %s\n", "", msg)
+			}
+		}
+	}
+
+	fmt.Println()
+	if problems == 0 {
+		fmt.Println("No outstanding problems")
+	} else {
+		fmt.Printf("Outstanding problems: %d\n", problems)
+	}
+}
+
+func countQuery(query string) func(ctx context.Context, db *sql.DB) (int64, error) {
+	return func(ctx context.Context, db *sql.DB) (int64, error) {
+		var n int64
+		err := db.QueryRowContext(ctx, query).Scan(&n)
+		return n, err
+	}
+}
+
+func execQuery(query string) func(ctx context.Context, db *sql.DB) (int64, error) {
+	return func(ctx context.Context, db *sql.DB) (int64, error) {
+		var args []any
+		if strings.Contains(query, ":now") {
+			args = append(args, sql.Named("now", time.Now().UnixMilli()))
+		}
+		res, err := db.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+}
+
+// ftsIntegrityCount runs the FTS integrity-check against the content table.
+// It reports 1 when the index is inconsistent (FTS doesn't say how many rows).
+func ftsIntegrityCount(ftsTable string) func(ctx context.Context, db *sql.DB) (int64, error) {
+	return func(ctx context.Context, db *sql.DB) (int64, error) {
+		err := ragindex.CheckFTSIntegrity(ctx, db, ftsTable)
+		if err == nil {
+			return 0, nil
+		}
+		if strings.Contains(err.Error(), "malformed") || strings.Contains(err.Error(), "corrupt") {
+			log.Debug().Err(err).Str("table", ftsTable).Msg("FTS integrity check failed")
+			return 1, nil
+		}
+		return 0, err
+	}
+}
+
+func ftsRebuild(ftsTable string) func(ctx context.Context, db *sql.DB) (int64, error) {
+	return func(ctx context.Context, db *sql.DB) (int64, error) {
+		_, err := db.ExecContext(ctx, fmt.Sprintf(
+			`INSERT INTO %s(%s) VALUES('rebuild')`, ftsTable, ftsTable))
+		return 0, err
+	}
+}
+
+func tablesExist(ctx context.Context, db *sql.DB, tables []string) (bool, error) {
+	for _, t := range tables {
+		var n int
+		if err := db.QueryRowContext(ctx,
+			"SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?", t,
+		).Scan(&n); err != nil {
+			return false, fmt.Errorf("checking table %s: %w", t, err)
+		}
+		if n == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -12,13 +13,17 @@ import (
 	"sync"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"go.mau.fi/mautrix-meta/pkg/media"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
 )
 
 var (
 	dbPath     = flag.String("db", "messenger.db", "Path to SQLite database")
+	dbKeyFile  = storage.KeyFileFlag()
 	outputDir  = flag.String("output", "../web/static/avatars", "Output directory for avatars")
-	concurrent = flag.Int("concurrent", 10, "Number of concurrent downloads")
+	cfgPath    = flag.String("config", "", "Path to rag.yaml for media.downloads limits (defaults are used if not found)")
+	concurrent = flag.Int("concurrent", 0, "Number of concurrent downloads (overrides media.downloads.concurrency)")
 	forceAll   = flag.Bool("force", false, "Re-download all avatars even if they exist")
 )
 
@@ -31,19 +36,39 @@ type Contact struct {
 func main() {
 	flag.Parse()
 
+	// Download limits are shared with media-sync via media.downloads
+	cfg := ragconfig.LoadOrDefault(".")
+	if *cfgPath != "" {
+		var err error
+		if cfg, err = ragconfig.Load(*cfgPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	downloads := cfg.Media.Downloads
+	if *concurrent > 0 {
+		downloads.Concurrency = *concurrent
+	}
+	throttle := media.NewThrottle(downloads)
+
 	// Create output directory
 	if err := os.MkdirAll(*outputDir, 0755); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to create output directory: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Open database
-	db, err := sql.Open("sqlite3", *dbPath)
+	// Open database through storage so the avatar refresh queue exists
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load the database key: %v\n", err)
+		os.Exit(1)
+	}
+	store, err := storage.New(*dbPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
 		os.Exit(1)
 	}
-	defer db.Close()
+	defer store.Close()
+	db := store.GetDB()
 
 	// Get all contacts with profile picture URLs
 	rows, err := db.Query("SELECT id, name, profile_picture_url FROM contacts WHERE id > 0 AND profile_picture_url IS NOT NULL AND profile_picture_url != ''")
@@ -64,13 +89,13 @@ func main() {
 
 	fmt.Printf("Found %d contacts with profile picture URLs\n", len(contacts))
 
-	// Download avatars concurrently
+	// Download avatars concurrently, within the throttle's limits
 	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, *concurrent)
 
 	downloaded := 0
 	skipped := 0
 	failed := 0
+	expired := 0
 	var mu sync.Mutex
 
 	client := &http.Client{
@@ -84,8 +109,6 @@ func main() {
 		wg.Add(1)
 		go func(c Contact) {
 			defer wg.Done()
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
 
 			// Determine file extension from URL
 			ext := ".jpg"
@@ -114,7 +137,16 @@ func main() {
 			}
 
 			// Download from the CDN URL in the database
-			resp, err := client.Get(c.PictureURL.String)
+			req, err := http.NewRequest(http.MethodGet, c.PictureURL.String, nil)
+			if err != nil {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			release, _ := throttle.Wait(context.Background(), req.URL.Host)
+			defer release()
+			resp, err := client.Do(req)
 			if err != nil {
 				mu.Lock()
 				failed++
@@ -122,8 +154,19 @@ func main() {
 				return
 			}
 			defer resp.Body.Close()
+			throttle.Observe(req.URL.Host, resp)
 
 			if resp.StatusCode != http.StatusOK {
+				// Expired CDN URLs return 403/404/410; queue them so messenger-cli
+				// can fetch fresh contact info before the next pass.
+				if media.IsExpiredURLStatus(resp.StatusCode) {
+					if err := store.RecordAvatarFailure(c.ID, resp.StatusCode, c.PictureURL.String); err != nil {
+						fmt.Fprintf(os.Stderr, "Failed to record avatar failure for %d: %v\n", c.ID, err)
+					}
+					mu.Lock()
+					expired++
+					mu.Unlock()
+				}
 				mu.Lock()
 				failed++
 				mu.Unlock()
@@ -175,4 +218,7 @@ func main() {
 	wg.Wait()
 
 	fmt.Printf("\nDone! Downloaded: %d, Skipped: %d, Failed: %d\n", downloaded, skipped, failed)
+	if expired > 0 {
+		fmt.Printf("Queued %d expired avatar URLs for refresh (run messenger-cli to fetch fresh URLs)\n", expired)
+	}
 }
@@ -0,0 +1,332 @@
+// chunk-export dumps the chunk corpus with its metadata to JSONL or Parquet,
+// for experimenting with alternative retrieval stacks offline.
+//
+// Only indexable chunks are exported unless -all is given. With -embeddings,
+// each chunk's vector is fetched from Milvus (chunks missing there get an
+// empty embedding).
+//
+// IDs are written as plain integers (unlike the rag-server JSON API), since
+// the consumers are Python/ML tools rather than JavaScript.
+//
+// Usage:
+//
+//	chunk-export -out chunks.jsonl
+//	chunk-export -out chunks.parquet -embeddings
+//	chunk-export -out - -thread 123456 | jq .text
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/milvus-io/milvus-sdk-go/v2/client"
+	"github.com/milvus-io/milvus-sdk-go/v2/entity"
+	"github.com/parquet-go/parquet-go"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/rag"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+var (
+	dbPath     = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile  = storage.KeyFileFlag()
+	cfgPath    = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	outPath    = flag.String("out", "", "Output file, or - for stdout (JSONL only)")
+	format     = flag.String("format", "", "jsonl or parquet (default: from the -out extension, else jsonl)")
+	embeddings = flag.Bool("embeddings", false, "Include embeddings fetched from Milvus")
+	all        = flag.Bool("all", false, "Include non-indexable chunks")
+	threadID   = flag.Int64("thread", 0, "Only export this thread")
+	batchSize  = flag.Int("batch-size", 500, "Chunks read (and embeddings fetched) per batch")
+	debug      = flag.Bool("debug", false, "Enable debug logging")
+)
+
+// record is one exported chunk
+type record struct {
+	ChunkID          string    `json:"chunk_id" parquet:"chunk_id"`
+	ThreadID         int64     `json:"thread_id" parquet:"thread_id"`
+	ThreadName       string    `json:"thread_name" parquet:"thread_name"`
+	SessionIdx       int       `json:"session_idx" parquet:"session_idx"`
+	ChunkIdx         int       `json:"chunk_idx" parquet:"chunk_idx"`
+	ParticipantIDs   []int64   `json:"participant_ids" parquet:"participant_ids,list"`
+	ParticipantNames []string  `json:"participant_names" parquet:"participant_names,list"`
+	MessageIDs       []string  `json:"message_ids" parquet:"message_ids,list"`
+	Text             string    `json:"text" parquet:"text,zstd"`
+	StartTimestampMs int64     `json:"start_timestamp_ms" parquet:"start_timestamp_ms"`
+	EndTimestampMs   int64     `json:"end_timestamp_ms" parquet:"end_timestamp_ms"`
+	MessageCount     int       `json:"message_count" parquet:"message_count"`
+	CharCount        int       `json:"char_count" parquet:"char_count"`
+	AlnumCount       int       `json:"alnum_count" parquet:"alnum_count"`
+	UniqueWordCount  int       `json:"unique_word_count" parquet:"unique_word_count"`
+	IsIndexable      bool      `json:"is_indexable" parquet:"is_indexable"`
+	Embedding        []float32 `json:"embedding,omitempty" parquet:"embedding,list"`
+}
+
+func newRecord(c rag.Chunk) record {
+	return record{
+		ChunkID:          c.ChunkID,
+		ThreadID:         c.ThreadID,
+		ThreadName:       c.ThreadName,
+		SessionIdx:       c.SessionIdx,
+		ChunkIdx:         c.ChunkIdx,
+		ParticipantIDs:   c.ParticipantIDs,
+		ParticipantNames: c.ParticipantNames,
+		MessageIDs:       c.MessageIDs,
+		Text:             c.Text,
+		StartTimestampMs: c.StartTimestampMs,
+		EndTimestampMs:   c.EndTimestampMs,
+		MessageCount:     c.MessageCount,
+		CharCount:        c.CharCount,
+		AlnumCount:       c.AlnumCount,
+		UniqueWordCount:  c.UniqueWordCount,
+		IsIndexable:      c.IsIndexable,
+	}
+}
+
+// recordWriter writes records in one output format
+type recordWriter interface {
+	Write(records []record) error
+	Close() error
+}
+
+type jsonlWriter struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func newJSONLWriter(w io.Writer) *jsonlWriter {
+	buf := bufio.NewWriterSize(w, 1<<20)
+	return &jsonlWriter{buf: buf, enc: json.NewEncoder(buf)}
+}
+
+func (w *jsonlWriter) Write(records []record) error {
+	for i := range records {
+		if err := w.enc.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *jsonlWriter) Close() error {
+	return w.buf.Flush()
+}
+
+type parquetWriter struct {
+	w *parquet.GenericWriter[record]
+}
+
+func newParquetWriter(w io.Writer) *parquetWriter {
+	return &parquetWriter{w: parquet.NewGenericWriter[record](w, parquet.Compression(&parquet.Zstd))}
+}
+
+func (w *parquetWriter) Write(records []record) error {
+	_, err := w.w.Write(records)
+	return err
+}
+
+func (w *parquetWriter) Close() error {
+	return w.w.Close()
+}
+
+func main() {
+	flag.Parse()
+
+	// Setup logging (stderr, so -out - stays clean)
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	if *outPath == "" {
+		log.Fatal().Msg("-out is required (use - for stdout)")
+	}
+	outFormat := *format
+	if outFormat == "" {
+		outFormat = "jsonl"
+		if strings.EqualFold(filepath.Ext(*outPath), ".parquet") {
+			outFormat = "parquet"
+		}
+	}
+	if outFormat != "jsonl" && outFormat != "parquet" {
+		log.Fatal().Str("format", outFormat).Msg("Invalid -format (use jsonl or parquet)")
+	}
+	if outFormat == "parquet" && *outPath == "-" {
+		log.Fatal().Msg("Parquet can't be written to stdout, give a file path")
+	}
+	if *batchSize <= 0 {
+		log.Fatal().Int("batch_size", *batchSize).Msg("-batch-size must be positive")
+	}
+
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	db, err := sql.Open(storage.Driver("sqlite3"), sqlitePath+"?mode=ro")
+	if err != nil {
+		log.Fatal().Err(err).Str("path", sqlitePath).Msg("Failed to open database")
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		log.Fatal().Err(err).Msg("Database not accessible")
+	}
+
+	ctx := context.Background()
+
+	var milvus client.Client
+	if *embeddings {
+		milvus, err = vectordb.NewMilvusClient(ctx, cfg.Milvus)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to connect to Milvus")
+		}
+		defer milvus.Close()
+	}
+
+	var out io.Writer = os.Stdout
+	var file *os.File
+	if *outPath != "-" {
+		file, err = os.Create(*outPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create output file")
+		}
+		out = file
+	}
+
+	var w recordWriter
+	if outFormat == "parquet" {
+		w = newParquetWriter(out)
+	} else {
+		w = newJSONLWriter(out)
+	}
+
+	filter := rag.ChunkListFilter{ThreadID: *threadID}
+	if !*all {
+		indexable := true
+		filter.Indexable = &indexable
+	}
+
+	exported, missing, err := export(ctx, rag.NewSQLiteChunkStore(db), milvus, cfg.Milvus.ChunkCollection, filter, w)
+	if err == nil {
+		err = w.Close()
+	}
+	if file != nil {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Export failed")
+	}
+
+	evt := log.Info().Int("chunks", exported).Str("format", outFormat).Str("out", *outPath)
+	if *embeddings {
+		evt = evt.Int("missing_embeddings", missing)
+	}
+	evt.Msg("Export complete")
+}
+
+// export pages through the chunks matching filter and writes them, returning
+// the number exported and how many had no embedding in Milvus
+func export(ctx context.Context, store *rag.SQLiteChunkStore, milvus client.Client, collection string, filter rag.ChunkListFilter, w recordWriter) (int, int, error) {
+	exported, missing := 0, 0
+	for offset := 0; ; offset += *batchSize {
+		chunks, total, err := store.ListChunks(ctx, filter, *batchSize, offset)
+		if err != nil {
+			return exported, missing, err
+		}
+		if len(chunks) == 0 {
+			return exported, missing, nil
+		}
+
+		records := make([]record, len(chunks))
+		for i, c := range chunks {
+			records[i] = newRecord(c)
+		}
+
+		if milvus != nil {
+			vectors, err := fetchEmbeddings(ctx, milvus, collection, records)
+			if err != nil {
+				return exported, missing, err
+			}
+			for i := range records {
+				if v, ok := vectors[records[i].ChunkID]; ok {
+					records[i].Embedding = v
+				} else {
+					missing++
+				}
+			}
+		}
+
+		if err := w.Write(records); err != nil {
+			return exported, missing, fmt.Errorf("writing records: %w", err)
+		}
+		exported += len(records)
+		log.Debug().Int("exported", exported).Int64("total", total).Msg("Export progress")
+	}
+}
+
+// fetchEmbeddings returns the Milvus vectors of the given chunks by chunk ID
+func fetchEmbeddings(ctx context.Context, milvus client.Client, collection string, records []record) (map[string][]float32, error) {
+	ids := make([]string, len(records))
+	for i, r := range records {
+		ids[i] = r.ChunkID
+	}
+	expr := fmt.Sprintf("chunk_id in [\"%s\"]", strings.Join(ids, "\",\""))
+	cols, err := milvus.Query(ctx, collection, nil, expr, []string{"chunk_id", "embedding"})
+	if err != nil {
+		return nil, fmt.Errorf("querying Milvus embeddings: %w", err)
+	}
+
+	var idCol *entity.ColumnVarChar
+	var vecCol *entity.ColumnFloatVector
+	for _, col := range cols {
+		switch c := col.(type) {
+		case *entity.ColumnVarChar:
+			if c.Name() == "chunk_id" {
+				idCol = c
+			}
+		case *entity.ColumnFloatVector:
+			vecCol = c
+		}
+	}
+	out := make(map[string][]float32, len(records))
+	if idCol == nil || vecCol == nil {
+		return out, nil
+	}
+	vectors := vecCol.Data()
+	for i := 0; i < idCol.Len() && i < len(vectors); i++ {
+		id, err := idCol.ValueByIdx(i)
+		if err != nil {
+			continue
+		}
+		out[id] = vectors[i]
+	}
+	return out, nil
+}
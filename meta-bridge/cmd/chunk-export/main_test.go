@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func testRecords() []record {
+	return []record{
+		{ChunkID: "a", ThreadID: 1 << 60, ParticipantIDs: []int64{1, 2}, ParticipantNames: []string{"Alice", "Bob"},
+			MessageIDs: []string{"m1"}, Text: "hello", IsIndexable: true, Embedding: []float32{0.5, -0.25}},
+		{ChunkID: "b", ThreadID: 2, Text: "no embedding"},
+	}
+}
+
+func TestParquetWriter_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := newParquetWriter(&buf)
+	if err := w.Write(testRecords()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	got, err := parquet.Read[record](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("parquet.Read: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(got))
+	}
+	if got[0].ThreadID != 1<<60 || len(got[0].Embedding) != 2 || got[0].Embedding[1] != -0.25 || got[0].ParticipantNames[1] != "Bob" {
+		t.Fatalf("unexpected first record: %+v", got[0])
+	}
+	if got[1].Text != "no embedding" || len(got[1].Embedding) != 0 {
+		t.Fatalf("unexpected second record: %+v", got[1])
+	}
+}
+
+func TestJSONLWriter_OmitsMissingEmbedding(t *testing.T) {
+	var buf bytes.Buffer
+	w := newJSONLWriter(&buf)
+	if err := w.Write(testRecords()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	var second map[string]any
+	if err := json.Unmarshal(lines[1], &second); err != nil {
+		t.Fatalf("decoding line: %v", err)
+	}
+	if _, ok := second["embedding"]; ok {
+		t.Fatalf("embedding should be omitted when missing: %s", lines[1])
+	}
+}
@@ -7,6 +7,7 @@
 //
 //	chunk-generator --db messenger.db --output chunks.jsonl
 //	chunk-generator --db messenger.db --stats  # Print statistics only
+//	chunk-generator --db messenger.db --progress json  # Machine-readable progress on stderr
 package main
 
 import (
@@ -22,15 +23,20 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"go.mau.fi/mautrix-meta/pkg/chunking"
+	"go.mau.fi/mautrix-meta/pkg/progress"
 	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
 )
 
 var (
 	dbPath     = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile  = storage.KeyFileFlag()
 	outputPath = flag.String("output", "chunks.jsonl", "Output JSONL file")
 	cfgPath    = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
 	statsOnly  = flag.Bool("stats", false, "Print statistics only (don't write output)")
 	debug      = flag.Bool("debug", false, "Enable debug logging")
+
+	progressFormat = progress.Flag()
 )
 
 func main() {
@@ -45,6 +51,11 @@ func main() {
 	}
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
+	progressFmt, err := progress.ParseFormat(*progressFormat)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid -progress")
+	}
+
 	// Load configuration
 	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
 	if err != nil {
@@ -58,6 +69,9 @@ func main() {
 	if sqlitePath == "" {
 		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
 	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
 
 	// Print configuration
 	fmt.Printf("Processing database: %s\n", sqlitePath)
@@ -75,7 +89,7 @@ func main() {
 	fmt.Println()
 
 	// Open database
-	db, err := sql.Open("sqlite3", sqlitePath+"?mode=ro")
+	db, err := sql.Open(storage.Driver("sqlite3"), sqlitePath+"?mode=ro")
 	if err != nil {
 		log.Fatal().Err(err).Str("path", sqlitePath).Msg("Failed to open database")
 	}
@@ -112,17 +126,17 @@ func main() {
 		return nil
 	}
 
-	progressFn := func(threadsProcessed, totalChunks int) {
-		log.Info().
-			Int("threads", threadsProcessed).
-			Int("chunks", totalChunks).
-			Msg("Progress")
+	prog := progress.New(os.Stderr, progressFmt, "chunk", "threads", 0)
+	progressFn := func(threadsProcessed, totalThreads, totalChunks int) {
+		prog.SetTotal(int64(totalThreads))
+		prog.Set(int64(threadsProcessed))
 	}
 
 	stats, err := chunking.ProcessAllThreads(ctx, db, cfg, callback, progressFn)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Processing failed")
 	}
+	prog.Finish()
 
 	// Print statistics
 	fmt.Println()
@@ -0,0 +1,153 @@
+// compare-sources reports, per thread, how much history came from live sync
+// and how much from imported exports, so you can tell whether another import
+// is needed.
+//
+// For each thread it shows message counts and date spans per source, the
+// months only one source has, and any gap between the end of the imported
+// history and the start of live sync.
+//
+// Usage:
+//
+//	compare-sources -db messenger.db
+//	compare-sources -db messenger.db -attention     # only threads with gaps or no import
+//	compare-sources -db messenger.db -thread 123456 -json
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	dbPath      = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile   = storage.KeyFileFlag()
+	cfgPath     = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	threadID    = flag.Int64("thread", 0, "Only report this thread")
+	attention   = flag.Bool("attention", false, "Only threads that may need another import")
+	minMessages = flag.Int64("min-messages", 20, "Skip threads with fewer messages in total")
+	jsonOut     = flag.Bool("json", false, "Print the report as JSON")
+)
+
+func main() {
+	flag.Parse()
+
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	db, err := sql.Open(storage.Driver("sqlite3"), sqlitePath+"?mode=ro")
+	if err != nil {
+		log.Fatal().Err(err).Str("path", sqlitePath).Msg("Failed to open database")
+	}
+	defer db.Close()
+
+	months, err := storage.ListSourceMonths(db, *threadID)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to read message coverage")
+	}
+
+	var reports []threadReport
+	for _, r := range buildReports(months) {
+		if r.Sync.Messages+r.Export.Messages < *minMessages && *threadID == 0 {
+			continue
+		}
+		if *attention && !r.NeedsAttention() {
+			continue
+		}
+		reports = append(reports, r)
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			log.Fatal().Err(err).Msg("Failed to write JSON")
+		}
+		return
+	}
+	printReports(reports)
+}
+
+func printReports(reports []threadReport) {
+	if len(reports) == 0 {
+		fmt.Println("No threads to report")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "THREAD\tSYNC\tEXPORT\tSTATUS")
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", threadLabel(r), r.Sync, r.Export, r.Status)
+	}
+	w.Flush()
+
+	fmt.Println()
+	for _, r := range reports {
+		var notes []string
+		if len(r.ExportOnly) > 0 {
+			notes = append(notes, "only in export: "+joinRanges(r.ExportOnly))
+		}
+		if r.Gap != nil {
+			notes = append(notes, "no messages from either source: "+r.Gap.String())
+		}
+		if r.Hint != "" {
+			notes = append(notes, r.Hint)
+		}
+		if len(notes) == 0 {
+			continue
+		}
+		fmt.Printf("%s\n", threadLabel(r))
+		for _, n := range notes {
+			fmt.Printf("  - %s\n", n)
+		}
+	}
+}
+
+func threadLabel(r threadReport) string {
+	name := r.Name
+	if name == "" {
+		name = "(unnamed)"
+	}
+	if len([]rune(name)) > 40 {
+		name = string([]rune(name)[:39]) + "…"
+	}
+	return fmt.Sprintf("%s [%d]", name, r.ThreadID)
+}
+
+func joinRanges(ranges []monthRange) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatMonth(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format("2006-01")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// Thread statuses
+const (
+	statusSyncOnly   = "sync only"
+	statusExportOnly = "export only"
+	statusCovered    = "covered"
+	statusGap        = "gap"
+)
+
+// coverage is what one source holds for a thread
+type coverage struct {
+	Messages int64    `json:"messages"`
+	FirstMs  int64    `json:"first_ms,omitempty"`
+	LastMs   int64    `json:"last_ms,omitempty"`
+	Months   []string `json:"-"`
+}
+
+func (c coverage) String() string {
+	if c.Messages == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d (%s – %s)", c.Messages, formatMonth(c.FirstMs), formatMonth(c.LastMs))
+}
+
+// monthRange is an inclusive span of YYYY-MM months
+type monthRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (r monthRange) String() string {
+	if r.From == r.To {
+		return r.From
+	}
+	return r.From + " – " + r.To
+}
+
+type threadReport struct {
+	ThreadID int64    `json:"thread_id,string"`
+	Name     string   `json:"name"`
+	Sync     coverage `json:"sync"`
+	Export   coverage `json:"export"`
+	Status   string   `json:"status"`
+	// ExportOnly are months with imported messages but none from sync
+	ExportOnly []monthRange `json:"export_only,omitempty"`
+	// SyncOnly are months with synced messages but none imported
+	SyncOnly []monthRange `json:"sync_only,omitempty"`
+	// Gap is the span between the end of the export and the start of sync
+	// with no messages at all
+	Gap  *monthRange `json:"gap,omitempty"`
+	Hint string      `json:"hint,omitempty"`
+}
+
+// NeedsAttention is true when another import could add history
+func (r threadReport) NeedsAttention() bool {
+	return r.Status == statusSyncOnly || r.Status == statusGap
+}
+
+// buildReports folds per-month source counts (ordered by thread) into one
+// report per thread
+func buildReports(months []storage.SourceMonth) []threadReport {
+	var reports []threadReport
+	for i := 0; i < len(months); {
+		j := i
+		for j < len(months) && months[j].ThreadID == months[i].ThreadID {
+			j++
+		}
+		reports = append(reports, buildReport(months[i:j]))
+		i = j
+	}
+	return reports
+}
+
+func buildReport(months []storage.SourceMonth) threadReport {
+	r := threadReport{ThreadID: months[0].ThreadID, Name: months[0].ThreadName}
+	for _, m := range months {
+		var c *coverage
+		switch m.Source {
+		case storage.ProvenanceLive:
+			c = &r.Sync
+		case storage.ProvenanceExport:
+			c = &r.Export
+		default:
+			// Sample data is neither history nor sync
+			continue
+		}
+		if c.Messages == 0 || m.FirstMs < c.FirstMs {
+			c.FirstMs = m.FirstMs
+		}
+		c.LastMs = max(c.LastMs, m.LastMs)
+		c.Messages += m.Messages
+		c.Months = append(c.Months, m.Month)
+	}
+
+	r.ExportOnly = monthRanges(difference(r.Export.Months, r.Sync.Months))
+	r.SyncOnly = monthRanges(difference(r.Sync.Months, r.Export.Months))
+
+	switch {
+	case r.Export.Messages == 0:
+		r.Status = statusSyncOnly
+		r.Hint = fmt.Sprintf("no imported history; an export may have messages before %s", formatMonth(r.Sync.FirstMs))
+	case r.Sync.Messages == 0:
+		r.Status = statusExportOnly
+	default:
+		exportEnd, syncStart := formatMonth(r.Export.LastMs), formatMonth(r.Sync.FirstMs)
+		if gapFrom, gapTo := addMonths(exportEnd, 1), addMonths(syncStart, -1); gapFrom <= gapTo {
+			r.Status = statusGap
+			r.Gap = &monthRange{From: gapFrom, To: gapTo}
+			r.Hint = fmt.Sprintf("export ends %s, sync starts %s; a newer export would fill the gap", exportEnd, syncStart)
+		} else {
+			r.Status = statusCovered
+		}
+	}
+	return r
+}
+
+// difference returns the sorted months in a but not in b
+func difference(a, b []string) []string {
+	var out []string
+	for _, m := range a {
+		if !slices.Contains(b, m) {
+			out = append(out, m)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// monthRanges collapses sorted months into runs of consecutive months
+func monthRanges(months []string) []monthRange {
+	var out []monthRange
+	for _, m := range months {
+		if n := len(out); n > 0 && addMonths(out[n-1].To, 1) == m {
+			out[n-1].To = m
+			continue
+		}
+		out = append(out, monthRange{From: m, To: m})
+	}
+	return out
+}
+
+// addMonths shifts a YYYY-MM month by n months
+func addMonths(month string, n int) string {
+	t, err := time.Parse("2006-01", month)
+	if err != nil {
+		return month
+	}
+	return t.AddDate(0, n, 0).Format("2006-01")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+func month(t *testing.T, thread int64, source, m string, n int64) storage.SourceMonth {
+	t.Helper()
+	start, err := time.Parse("2006-01", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := start.UnixMilli()
+	return storage.SourceMonth{ThreadID: thread, Source: source, Month: m, Messages: n, FirstMs: ms, LastMs: ms + 1000}
+}
+
+func TestBuildReports(t *testing.T) {
+	months := []storage.SourceMonth{
+		// Thread 1: export 2009-01..2009-03, sync from 2015-06
+		month(t, 1, storage.ProvenanceExport, "2009-01", 10),
+		month(t, 1, storage.ProvenanceExport, "2009-02", 5),
+		month(t, 1, storage.ProvenanceExport, "2009-03", 5),
+		month(t, 1, storage.ProvenanceLive, "2015-06", 3),
+		// Thread 2: overlapping
+		month(t, 2, storage.ProvenanceExport, "2020-01", 1),
+		month(t, 2, storage.ProvenanceLive, "2020-01", 1),
+		month(t, 2, storage.ProvenanceLive, "2020-02", 1),
+		// Thread 3: sync only; sample data counts as neither
+		month(t, 3, storage.ProvenanceImportSample, "2019-01", 7),
+		month(t, 3, storage.ProvenanceLive, "2021-05", 4),
+	}
+
+	reports := buildReports(months)
+	if len(reports) != 3 {
+		t.Fatalf("expected 3 reports, got %d", len(reports))
+	}
+
+	r := reports[0]
+	if r.Status != statusGap || r.Gap == nil || r.Gap.From != "2009-04" || r.Gap.To != "2015-05" {
+		t.Errorf("thread 1: unexpected status/gap: %s %+v", r.Status, r.Gap)
+	}
+	if len(r.ExportOnly) != 1 || r.ExportOnly[0].String() != "2009-01 – 2009-03" || r.Export.Messages != 20 {
+		t.Errorf("thread 1: unexpected export coverage: %+v %+v", r.ExportOnly, r.Export)
+	}
+
+	if r := reports[1]; r.Status != statusCovered || r.NeedsAttention() || len(r.SyncOnly) != 1 {
+		t.Errorf("thread 2: unexpected report: %+v", r)
+	}
+	if r := reports[2]; r.Status != statusSyncOnly || !r.NeedsAttention() || r.Sync.Messages != 4 || r.Export.Messages != 0 {
+		t.Errorf("thread 3: unexpected report: %+v", r)
+	}
+}
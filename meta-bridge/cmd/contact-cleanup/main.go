@@ -0,0 +1,173 @@
+// contact-cleanup reports contacts that have never sent a message and can
+// delete or merge them.
+//
+// Receipts, reactions and participant lists create placeholder contacts
+// (EnsureContactExists) for people who never write in any synced thread.
+// Over time they outnumber real contacts and clutter contact lists and name
+// lookups. Only contacts older than --min-age are considered, since a new
+// placeholder usually gets its profile on the next sync.
+//
+// --delete removes the listed contacts together with their thread
+// participation rows (read/delivery watermarks). Contacts with reactions are
+// kept; merge them into the right contact instead.
+//
+// Usage:
+//
+//	contact-cleanup --db messenger.db                    # report only
+//	contact-cleanup --db messenger.db --delete
+//	contact-cleanup --db messenger.db --merge 123:456    # move 123's rows onto 456
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+	"go.mau.fi/mautrix-meta/pkg/util"
+)
+
+var (
+	dbPath    = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile = storage.KeyFileFlag()
+	cfgPath   = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	minAge    = flag.Duration("min-age", 30*24*time.Hour, "Only consider contacts created at least this long ago")
+	del       = flag.Bool("delete", false, "Delete the reported contacts that have no reactions")
+	merge     = flag.String("merge", "", "Merge contacts, as from:into pairs separated by commas")
+	show      = flag.Int("show", 50, "Number of contacts to list in the report (0 = all)")
+	debug     = flag.Bool("debug", false, "Enable debug logging")
+)
+
+func main() {
+	flag.Parse()
+
+	// Setup logging
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	// Load configuration
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	pairs, err := parseMerges(*merge)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid --merge")
+	}
+
+	store, err := storage.New(sqlitePath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open database")
+	}
+	defer store.Close()
+
+	for _, p := range pairs {
+		if err := store.MergeContact(p[0], p[1]); err != nil {
+			log.Fatal().Err(err).Int64("from", p[0]).Int64("into", p[1]).Msg("Failed to merge contacts")
+		}
+		fmt.Printf("Merged contact %d into %d\n", p[0], p[1])
+	}
+	if len(pairs) > 0 {
+		fmt.Println()
+	}
+
+	stale, err := store.ListStaleContacts(time.Now().Add(-*minAge).UnixMilli())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to list contacts")
+	}
+	printReport(stale, *show)
+
+	if !*del {
+		if len(stale) > 0 {
+			fmt.Println("\nReport only (use --delete to remove deletable contacts)")
+		}
+		return
+	}
+
+	var ids []int64
+	for _, c := range stale {
+		if c.Deletable() {
+			ids = append(ids, c.ID)
+		}
+	}
+	deleted, err := store.DeleteStaleContacts(ids)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to delete contacts")
+	}
+	fmt.Printf("\nDeleted %d contacts\n", deleted)
+}
+
+// printReport lists up to limit stale contacts (0 = all) and a summary
+func printReport(stale []storage.StaleContact, limit int) {
+	deletable, unnamed := 0, 0
+	for _, c := range stale {
+		if c.Deletable() {
+			deletable++
+		}
+		if c.Name == "" {
+			unnamed++
+		}
+	}
+	fmt.Printf("Contacts without messages: %d (%d unnamed, %d deletable)\n", len(stale), unnamed, deletable)
+	if len(stale) == 0 {
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf("  %-20s %-30s %8s %10s  %s\n", "ID", "NAME", "THREADS", "REACTIONS", "CREATED")
+	for i, c := range stale {
+		if limit > 0 && i == limit {
+			fmt.Printf("  ... %d more (use --show 0 to list all)\n", len(stale)-limit)
+			break
+		}
+		name := c.Name
+		if name == "" {
+			name = "(no name)"
+		}
+		fmt.Printf("  %-20d %-30s %8d %10d  %s\n", c.ID, util.Truncate(name, 27), c.Threads, c.Reactions,
+			time.UnixMilli(c.CreatedAt).Format("2006-01-02"))
+	}
+}
+
+// parseMerges parses "from:into,from:into"
+func parseMerges(s string) ([][2]int64, error) {
+	var pairs [][2]int64
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fromStr, intoStr, ok := strings.Cut(part, ":")
+		from, err1 := strconv.ParseInt(strings.TrimSpace(fromStr), 10, 64)
+		into, err2 := strconv.ParseInt(strings.TrimSpace(intoStr), 10, 64)
+		if !ok || err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("expected from:into contact IDs, got %q", part)
+		}
+		pairs = append(pairs, [2]int64{from, into})
+	}
+	return pairs, nil
+}
@@ -0,0 +1,181 @@
+// contacts-merge merges contacts that are the same person under different
+// IDs into one canonical contact.
+//
+// Exports without stable user IDs (Facebook, Instagram, WhatsApp, Signal)
+// import people under an ID derived from their display name, while live sync
+// uses their real Messenger ID, so one person can show up as several
+// contacts with split message histories. Merging moves messages, reactions,
+// links and thread participation onto the canonical contact and records the
+// merged IDs as aliases, so a later import of the same export lands on the
+// canonical contact instead of recreating the duplicate. Moved messages are
+// marked unindexed and get re-chunked on the next pipeline run, since their
+// chunks name the sender.
+//
+// Without -into or -all it lists contacts with matching names, canonical
+// one first: the one with the most synced messages, since live sync keeps
+// using its ID.
+//
+// Usage:
+//
+//	contacts-merge                        # list likely duplicates
+//	contacts-merge -into 456 123 789      # merge 123 and 789 into 456
+//	contacts-merge -all -dry-run          # show what merging every group would do
+//	contacts-merge -aliases               # list merged IDs
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+	"go.mau.fi/mautrix-meta/pkg/util"
+)
+
+var (
+	dbPath    = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile = storage.KeyFileFlag()
+	cfgPath   = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	into      = flag.Int64("into", 0, "Canonical contact ID to merge the contact IDs given as arguments into")
+	all       = flag.Bool("all", false, "Merge every listed duplicate group into its first contact")
+	aliases   = flag.Bool("aliases", false, "List contact IDs merged by earlier runs")
+	dryRun    = flag.Bool("dry-run", false, "Print the merges without changing the database")
+	debug     = flag.Bool("debug", false, "Enable debug logging")
+)
+
+func main() {
+	flag.Parse()
+
+	// Setup logging
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	from, err := parseIDs(flag.Args())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid contact ID")
+	}
+	if (*into != 0) != (len(from) > 0) {
+		log.Fatal().Msg("-into needs the contact IDs to merge as arguments, and the other way round")
+	}
+	if *into != 0 && *all {
+		log.Fatal().Msg("-into and -all are mutually exclusive")
+	}
+
+	// Load configuration
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	store, err := storage.New(sqlitePath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open database")
+	}
+	defer store.Close()
+
+	switch {
+	case *aliases:
+		list, err := store.ListContactAliases()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to list aliases")
+		}
+		printAliases(list)
+
+	case *into != 0:
+		mergeInto(store, *into, from)
+
+	default:
+		groups, err := store.ListDuplicateContacts()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to list duplicate contacts")
+		}
+		if !*all {
+			printGroups(groups)
+			return
+		}
+		for _, group := range groups {
+			ids := make([]int64, 0, len(group)-1)
+			for _, c := range group[1:] {
+				ids = append(ids, c.ID)
+			}
+			mergeInto(store, group[0].ID, ids)
+		}
+	}
+}
+
+func mergeInto(store *storage.Storage, into int64, from []int64) {
+	if *dryRun {
+		fmt.Printf("Would merge %v into %d\n", from, into)
+		return
+	}
+	if err := store.MergeContacts(into, from...); err != nil {
+		log.Fatal().Err(err).Int64("into", into).Ints64("from", from).Msg("Failed to merge contacts")
+	}
+	fmt.Printf("Merged %v into %d\n", from, into)
+}
+
+func printGroups(groups [][]storage.DuplicateContact) {
+	fmt.Printf("Contacts sharing a name: %d groups\n", len(groups))
+	for _, group := range groups {
+		fmt.Println()
+		fmt.Printf("  %-20s %-30s %8s %8s\n", "ID", "NAME", "SYNCED", "EXPORTED")
+		args := ""
+		for _, c := range group {
+			fmt.Printf("  %-20d %-30s %8d %8d\n", c.ID, util.Truncate(c.Name, 27), c.SyncMessages, c.ExportMessages)
+			if c.ID != group[0].ID {
+				args += " " + strconv.FormatInt(c.ID, 10)
+			}
+		}
+		fmt.Printf("  contacts-merge -into %d%s\n", group[0].ID, args)
+	}
+	if len(groups) > 0 {
+		fmt.Println("\nSame name is not always same person; check before merging (-all merges every group)")
+	}
+}
+
+func printAliases(list []storage.ContactAlias) {
+	fmt.Printf("Merged contact IDs: %d\n", len(list))
+	if len(list) == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Printf("  %-20s %-20s %-30s  %s\n", "ALIAS", "CONTACT", "NAME", "MERGED")
+	for _, a := range list {
+		fmt.Printf("  %-20d %-20d %-30s  %s\n", a.AliasID, a.ContactID, util.Truncate(a.Name, 27),
+			time.UnixMilli(a.MergedAt).Format("2006-01-02"))
+	}
+}
+
+func parseIDs(args []string) ([]int64, error) {
+	ids := make([]int64, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a numeric contact ID, got %q", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
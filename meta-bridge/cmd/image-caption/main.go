@@ -0,0 +1,237 @@
+// image-caption makes screenshots, memes and photos searchable.
+//
+// It sends image attachments to the vision model configured in the vision
+// section of rag.yaml, which transcribes the text in the image and describes
+// it in a sentence, and stores the answer in attachment_captions. Chunking
+// appends it to its message after an "[Image]" marker, and the message is
+// marked unindexed so rag-indexerd (or the next rag-pipeline run) re-chunks
+// its thread.
+//
+// Live sync images are read from the attachment store once media-sync has
+// downloaded them. Images imported from a Facebook/Instagram export are read
+// from the extracted export when --export-dir points at it.
+//
+// Failed images are recorded and skipped until --retry-failed is given.
+//
+// Usage:
+//
+//	image-caption --db messenger.db
+//	image-caption --db messenger.db --export-dir ~/facebook-export
+//	image-caption --db messenger.db --interval 10m  # keep running
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/media"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	dbPath      = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile   = storage.KeyFileFlag()
+	cfgPath     = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	inputDir    = flag.String("dir", "", "Attachment store directory (defaults to media.attachments_dir from config)")
+	exportDir   = flag.String("export-dir", "", "Extracted Facebook/Instagram export, for images imported by import-export")
+	limit       = flag.Int("limit", 100, "Maximum images processed per pass")
+	interval    = flag.Duration("interval", 0, "Run a pass every interval instead of once")
+	retryFailed = flag.Bool("retry-failed", false, "Retry images whose last attempt failed")
+	debug       = flag.Bool("debug", false, "Enable debug logging")
+)
+
+// captioner is the state shared by all passes
+type captioner struct {
+	store     *storage.Storage
+	client    *media.Captioner
+	dir       string
+	exportDir string
+	maxBytes  int64
+}
+
+func main() {
+	flag.Parse()
+
+	// Setup logging
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	// Load configuration
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+	if !cfg.Vision.Enabled {
+		log.Fatal().Msg("Image text extraction is disabled (set vision.enabled in rag.yaml)")
+	}
+	if cfg.Vision.Model == "" {
+		log.Fatal().Msg("Vision model is empty (set vision.model in rag.yaml)")
+	}
+
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+	dir := *inputDir
+	if dir == "" {
+		dir = cfg.Media.AttachmentsDir
+	}
+
+	store, err := storage.New(sqlitePath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open database")
+	}
+	defer store.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	c := &captioner{
+		store:     store,
+		client:    media.NewCaptioner(cfg.Vision),
+		dir:       dir,
+		exportDir: *exportDir,
+		maxBytes:  int64(cfg.Vision.MaxFileMB) << 20,
+	}
+	log.Info().Str("endpoint", cfg.Vision.BaseURL).Str("model", cfg.Vision.Model).Msg("Extracting text from images")
+
+	for {
+		c.pass(ctx)
+		if *interval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("Shutting down")
+			return
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// pass processes one batch of pending images and logs the outcome
+func (c *captioner) pass(ctx context.Context) {
+	start := time.Now()
+	pending, err := c.store.GetPendingCaptions(*limit, c.exportDir != "", *retryFailed)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list pending images")
+		return
+	}
+
+	captioned, failed := 0, 0
+	for _, p := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := c.caption(ctx, p); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			failed++
+			log.Warn().Err(err).Str("attachment", p.AttachmentID).Msg("Image text extraction failed")
+			if recErr := c.store.SetCaptionError(p.AttachmentID, p.MessageID, err.Error()); recErr != nil {
+				log.Warn().Err(recErr).Str("attachment", p.AttachmentID).Msg("Failed to record extraction error")
+			}
+			continue
+		}
+		captioned++
+	}
+
+	ready, notDownloaded, err := c.store.CountPendingCaptions()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to count pending images")
+	}
+	log.Info().
+		Int("captioned", captioned).
+		Int("failed", failed).
+		Int64("remaining", ready).
+		Dur("took", time.Since(start)).
+		Msg("Pass done")
+	if notDownloaded > 0 && c.exportDir == "" {
+		log.Info().Int64("count", notDownloaded).Msg("Images without a local file (run media-sync, or pass --export-dir for imported ones)")
+	}
+}
+
+// caption sends one image to the vision model and stores the answer
+func (c *captioner) caption(ctx context.Context, p storage.PendingCaption) error {
+	path, err := c.resolve(p)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if c.maxBytes > 0 && info.Size() > c.maxBytes {
+		return fmt.Errorf("image is %d MB, above vision.max_file_mb", info.Size()>>20)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	text, err := c.client.Caption(ctx, imageMimeType(p, path, data), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	log.Debug().Str("attachment", p.AttachmentID).Int("chars", len(text)).Msg("Captioned")
+	return c.store.SaveCaption(p.AttachmentID, p.MessageID, text, c.client.Model())
+}
+
+// resolve finds the image file: the downloaded copy in the attachment store,
+// or the file inside the export for imported images
+func (c *captioner) resolve(p storage.PendingCaption) (string, error) {
+	if p.LocalPath != "" {
+		path, ok := media.Resolve(c.dir, p.LocalPath)
+		if !ok {
+			return "", fmt.Errorf("downloaded file %q is missing from %s", p.LocalPath, c.dir)
+		}
+		return path, nil
+	}
+	path, ok := media.Resolve(c.exportDir, p.URL)
+	if !ok {
+		return "", fmt.Errorf("export file %q is missing from %s", p.URL, c.exportDir)
+	}
+	return path, nil
+}
+
+// imageMimeType is the stored MIME type, else the one implied by the file
+// extension, else sniffed from the content
+func imageMimeType(p storage.PendingCaption, path string, data []byte) string {
+	if strings.HasPrefix(p.MimeType, "image/") {
+		return p.MimeType
+	}
+	if t := mime.TypeByExtension(filepath.Ext(path)); strings.HasPrefix(t, "image/") {
+		return t
+	}
+	return http.DetectContentType(data)
+}
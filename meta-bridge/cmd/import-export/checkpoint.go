@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	// importKey identifies the export being imported in import_checkpoints;
+	// empty disables checkpoints
+	importKey string
+	// resumedConversations counts the conversations of the current import
+	// skipped because an interrupted run already stored them
+	resumedConversations int
+)
+
+// exportImportKey identifies an export by its path, size and modification
+// time, so a newer export saved under the same name starts over
+func exportImportKey(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return abs
+	}
+	return fmt.Sprintf("%s|%d|%d", abs, info.Size(), info.ModTime().UnixNano())
+}
+
+// conversationCheckpointKey identifies a conversation within an export; its
+// message count guards against a changed export under the same key
+func conversationCheckpointKey(export UnifiedExport) string {
+	where := export.ThreadPath
+	if where == "" {
+		where = conversationKey(export.ThreadName, export.Participants)
+	}
+	return fmt.Sprintf("%s|%s|%d|%d", export.Source, where, export.ThreadIDHint, len(export.Messages))
+}
+
+// startCheckpoints sets up checkpoints for importing path, reporting a
+// resumed import
+func startCheckpoints(log zerolog.Logger, store *storage.Storage, path string) {
+	importKey = exportImportKey(path)
+	resumedConversations = 0
+	n, err := store.CountImportCheckpoints(importKey)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read import checkpoints")
+	} else if n > 0 {
+		log.Info().Int("conversations", n).Msg("Resuming interrupted import")
+	}
+}
+
+// finishCheckpoints drops the checkpoints of a completed import; the next
+// import of the same export checks every conversation again
+func finishCheckpoints(log zerolog.Logger, store *storage.Storage) {
+	if !*dryRun {
+		if err := store.ClearImportCheckpoints(importKey); err != nil {
+			log.Warn().Err(err).Msg("Failed to clear import checkpoints")
+		}
+	}
+	importKey = ""
+}
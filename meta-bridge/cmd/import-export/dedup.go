@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/text/unicode/norm"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+	"go.mau.fi/mautrix-meta/pkg/util"
+)
+
+// syncDedupWindow is how far apart an exported message and its live-sync
+// copy may be timestamped; exports round or shift times slightly
+const syncDedupWindow = 2 * time.Second
+
+// syncDuplicates counts the messages of the current import skipped by
+// -dedup-sync
+var syncDuplicates int
+
+// isSyncDuplicate reports whether live sync already stored msg in threadID
+// under its own message ID: a synced message within syncDedupWindow with
+// nearly the same text (see similarText). Media-only messages match synced
+// messages without text.
+func isSyncDuplicate(log zerolog.Logger, store *storage.Storage, threadID int64, msg UnifiedMessage) bool {
+	texts, err := store.SyncMessagesNear(threadID, msg.TimestampMs, syncDedupWindow.Milliseconds())
+	if err != nil {
+		log.Warn().Err(err).Int64("thread", threadID).Msg("Failed to look for synced copies")
+		return false
+	}
+	for _, text := range texts {
+		if similarText(text, msg.Text) {
+			return true
+		}
+	}
+	return false
+}
+
+// similarText compares texts ignoring case, Unicode form and whitespace, and
+// allows an edit per ten characters for the odd re-encoded character
+func similarText(a, b string) bool {
+	a, b = dedupKey(a), dedupKey(b)
+	if a == b {
+		return true
+	}
+	if a == "" || b == "" {
+		return false
+	}
+	longest := max(len([]rune(a)), len([]rune(b)))
+	return util.EditDistance(a, b)*10 <= longest
+}
+
+func dedupKey(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(norm.NFC.String(text))), " ")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	metatable "go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// ============================================================================
+// Instagram Export Format (from Instagram "Download Your Data")
+// ============================================================================
+
+// igMessageDirs are the conversation folders of an Instagram export, relative
+// to your_instagram_activity/messages (or messages/ in older exports)
+var igMessageDirs = []string{"inbox", "message_requests"}
+
+// IGExport is one message_N.json of an Instagram export. It mirrors FBExport
+// (same mojibake encoding, same participants/title), but messages carry
+// Instagram-specific share fields.
+type IGExport struct {
+	Participants []FBParticipant `json:"participants"`
+	Messages     []IGMessage     `json:"messages"`
+	Title        string          `json:"title"`
+	ThreadPath   string          `json:"thread_path"`
+}
+
+// IGShare is a shared post, reel, story or profile. Unlike FBShare it names
+// the account the content belongs to.
+type IGShare struct {
+	Link                 string `json:"link"`
+	ShareText            string `json:"share_text"`
+	OriginalContentOwner string `json:"original_content_owner"`
+	ProfileShareUsername string `json:"profile_share_username"`
+	ProfileShareName     string `json:"profile_share_name"`
+}
+
+type IGMessage struct {
+	SenderName  string `json:"sender_name"`
+	Content     string `json:"content"`
+	TimestampMs int64  `json:"timestamp_ms"`
+	IsUnsent    bool   `json:"is_unsent"`
+
+	Photos     []FBMedia `json:"photos"`
+	Videos     []FBMedia `json:"videos"`
+	AudioFiles []FBMedia `json:"audio_files"`
+	Share      *IGShare  `json:"share"`
+
+	Reactions []FBReaction `json:"reactions"`
+}
+
+// igMessageText builds the message text like fbMessageText, then credits the
+// owner of shared content ("via @owner") or names a shared profile
+func igMessageText(msg IGMessage) string {
+	fb := FBMessage{Content: msg.Content}
+	if msg.Share != nil {
+		fb.Share = &FBShare{Link: msg.Share.Link, ShareText: msg.Share.ShareText}
+	}
+	text := fbMessageText(fb)
+	if msg.Share == nil {
+		return text
+	}
+
+	var credit string
+	if owner := strings.TrimSpace(fixFBEncoding(msg.Share.OriginalContentOwner)); owner != "" {
+		credit = "via @" + strings.TrimPrefix(owner, "@")
+	} else if username := strings.TrimSpace(msg.Share.ProfileShareUsername); username != "" {
+		credit = "@" + strings.TrimPrefix(username, "@")
+		if name := strings.TrimSpace(fixFBEncoding(msg.Share.ProfileShareName)); name != "" {
+			credit = name + " (" + credit + ")"
+		}
+	}
+	if credit == "" || strings.Contains(text, credit) {
+		return text
+	}
+	if text == "" {
+		return credit
+	}
+	return text + "\n" + credit
+}
+
+// igShareKind classifies an Instagram link as "reel", "post", "story" or
+// "profile" by its path. Returns "" for anything that isn't instagram.com.
+func igShareKind(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	if host != "instagram.com" {
+		return ""
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch segments[0] {
+	case "reel", "reels":
+		return "reel"
+	case "p", "tv":
+		return "post"
+	case "stories":
+		return "story"
+	case "":
+		return ""
+	default:
+		return "profile"
+	}
+}
+
+func extractIGAttachments(m IGMessage) []UnifiedAttachment {
+	out := extractFBAttachments(FBMessage{Photos: m.Photos, Videos: m.Videos, AudioFiles: m.AudioFiles})
+
+	// Shared reels/posts/stories have no local media in the export; keep the
+	// link as an XMA attachment so they can be told apart from plain links
+	if m.Share != nil {
+		link := strings.TrimSpace(m.Share.Link)
+		if kind := igShareKind(link); kind != "" {
+			filename := kind
+			if owner := strings.TrimSpace(m.Share.OriginalContentOwner); owner != "" {
+				filename = kind + " by @" + strings.TrimPrefix(fixFBEncoding(owner), "@")
+			}
+			out = append(out, UnifiedAttachment{Type: metatable.AttachmentTypeXMA, URI: link, Filename: filename})
+		}
+	}
+
+	return out
+}
+
+// igConversationExport converts the message_N.json files of one Instagram
+// conversation to a UnifiedExport. Files that fail to parse are logged and
+// skipped.
+func igConversationExport(log zerolog.Logger, convPath string, files map[string][]byte) UnifiedExport {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	export := UnifiedExport{
+		Source:     ExportSourceInstagram,
+		ThreadPath: convPath,
+	}
+
+	// Instagram thread IDs share no namespace with Messenger thread keys, so
+	// derive our own instead of using the folder suffix directly
+	if id, ok := threadIDFromConversationPath(convPath); ok {
+		export.ThreadIDHint = generateThreadID(fmt.Sprintf("instagram:%d", id))
+	} else {
+		export.ThreadIDHint = generateThreadID("instagram:" + filepath.Base(convPath))
+	}
+
+	for _, name := range names {
+		var igExport IGExport
+		if err := json.Unmarshal(files[name], &igExport); err != nil {
+			log.Warn().Err(err).Str("file", name).Msg("Failed to parse JSON")
+			continue
+		}
+
+		// Get thread info from first file
+		if export.ThreadName == "" {
+			export.ThreadName = fixFBEncoding(igExport.Title)
+			if export.ThreadName == "" {
+				export.ThreadName = filepath.Base(convPath)
+			}
+			for _, p := range igExport.Participants {
+				export.Participants = append(export.Participants, fixFBEncoding(p.Name))
+			}
+		}
+
+		for _, msg := range igExport.Messages {
+			text := igMessageText(msg)
+			attachments := extractIGAttachments(msg)
+			if text == "" && len(attachments) == 0 && !msg.IsUnsent {
+				continue
+			}
+			export.Messages = append(export.Messages, UnifiedMessage{
+				SenderName:  fixFBEncoding(msg.SenderName),
+				Text:        text,
+				TimestampMs: msg.TimestampMs,
+				IsUnsent:    msg.IsUnsent,
+				Attachments: attachments,
+				Reactions:   convertFBReactions(msg.Reactions),
+			})
+		}
+	}
+
+	return export
+}
+
+// isInstagramMessagePath reports whether a (slash-separated, lowercased) path
+// is a message_N.json inside an Instagram conversation folder
+func isInstagramMessagePath(name string) bool {
+	if !strings.HasSuffix(name, ".json") || !strings.HasPrefix(filepath.Base(name), "message_") {
+		return false
+	}
+	return strings.Contains(name, "your_instagram_activity/messages/")
+}
+
+// isInstagramExportZip checks for the your_instagram_activity folder. Older
+// Instagram exports without it are indistinguishable from Facebook ones by
+// path alone and are imported as Facebook exports.
+func isInstagramExportZip(zipPath string) bool {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if isInstagramMessagePath(strings.ToLower(f.Name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isInstagramExportDir(basePath string) bool {
+	info, err := os.Stat(filepath.Join(basePath, "your_instagram_activity", "messages"))
+	return err == nil && info.IsDir()
+}
+
+func processInstagramZip(log zerolog.Logger, store *storage.Storage, zipPath string) (imported, skipped int, err error) {
+	log.Info().Str("zip", filepath.Base(zipPath)).Msg("Processing Instagram export ZIP")
+	exportMedia.addZip(log, zipPath)
+
+	zipReader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("opening %s: %w", filepath.Base(zipPath), err)
+	}
+	defer zipReader.Close()
+
+	// Group message files by conversation directory
+	convFiles := make(map[string][]*zip.File)
+	for _, file := range zipReader.File {
+		if !isInstagramMessagePath(strings.ToLower(file.Name)) {
+			continue
+		}
+		dir := filepath.Dir(file.Name)
+		convFiles[dir] = append(convFiles[dir], file)
+	}
+
+	convPaths := make([]string, 0, len(convFiles))
+	for convPath := range convFiles {
+		convPaths = append(convPaths, convPath)
+	}
+	imported, skipped = importConversations(log, store, convPaths, func(convPath string) UnifiedExport {
+		files := convFiles[convPath]
+		data := make(map[string][]byte, len(files))
+		for _, file := range files {
+			rc, err := file.Open()
+			if err != nil {
+				log.Warn().Err(err).Str("file", file.Name).Msg("Failed to open file in ZIP")
+				continue
+			}
+			content, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				log.Warn().Err(err).Str("file", file.Name).Msg("Failed to read file")
+				continue
+			}
+			data[file.Name] = content
+		}
+		return igConversationExport(log, convPath, data)
+	})
+	return imported, skipped, nil
+}
+
+func processInstagramExtracted(log zerolog.Logger, store *storage.Storage, basePath string) (imported, skipped int, err error) {
+	exportMedia.addDir(basePath)
+	for _, sub := range igMessageDirs {
+		dir := filepath.Join(basePath, "your_instagram_activity", "messages", sub)
+		entries, dirErr := os.ReadDir(dir)
+		if dirErr != nil {
+			if !os.IsNotExist(dirErr) {
+				err = errors.Join(err, fmt.Errorf("reading %s: %w", dir, dirErr))
+			}
+			continue
+		}
+
+		log.Info().Str("dir", dir).Msg("Scanning directory")
+
+		// Each subdirectory is a conversation
+		imp, skip := importConversations(log, store, conversationDirs(dir, entries), func(convPath string) UnifiedExport {
+			files, err := filepath.Glob(filepath.Join(convPath, "message_*.json"))
+			if err != nil || len(files) == 0 {
+				return UnifiedExport{}
+			}
+
+			data := make(map[string][]byte, len(files))
+			for _, file := range files {
+				content, err := os.ReadFile(file)
+				if err != nil {
+					log.Warn().Err(err).Str("file", file).Msg("Failed to read file")
+					continue
+				}
+				data[file] = content
+			}
+			return igConversationExport(log, convPath, data)
+		})
+		imported += imp
+		skipped += skip
+	}
+
+	return
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -18,15 +19,38 @@ import (
 	"github.com/rs/zerolog"
 
 	metatable "go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/progress"
 	"go.mau.fi/mautrix-meta/pkg/storage"
 )
 
 var (
-	dbPath    = flag.String("db", "messenger.db", "Path to SQLite database")
-	inputPath = flag.String("input", "", "Path to export (ZIP file for Messenger app export, or directory for Facebook export)")
-	verbose   = flag.Bool("v", false, "Verbose output")
-	dryRun    = flag.Bool("dry-run", false, "Don't actually import, just show what would be imported")
-	dropDB    = flag.Bool("drop-db", false, "Drop and recreate SQLite database before import")
+	dbPath     = flag.String("db", "messenger.db", "Path to SQLite database")
+	dbKeyFile  = storage.KeyFileFlag()
+	inputPath  = flag.String("input", "", "Path to export (ZIP file for Messenger app export, Facebook/Instagram export ZIP or directory, WhatsApp chat .txt or ZIP, or Signal plaintext backup main.jsonl, directory or ZIP)")
+	verbose    = flag.Bool("v", false, "Verbose output")
+	dryRun     = flag.Bool("dry-run", false, "Don't actually import, just show what would be imported")
+	dropDB     = flag.Bool("drop-db", false, "Drop and recreate SQLite database before import")
+	ownerName  = flag.String("owner", "", "Name of the export owner (auto-detected if not specified)")
+	reportPath = flag.String("report", "", "Write a report of what the import does (with -dry-run: would do) to this file: per-thread counts, new contacts, duplicates, unmatched participants and time ranges; CSV if it ends in .csv, JSON otherwise, - for stdout")
+	mediaDir   = flag.String("media-dir", "", "Copy the photos, videos and files the export includes into this attachment store (media.attachments_dir in rag.yaml; empty = only record their paths in the export)")
+	workers    = flag.Int("workers", 1, "Number of conversations to read and parse concurrently; one writer stores them")
+	dedupSync  = flag.Bool("dedup-sync", false, "Skip exported messages live sync already stored: same thread, within 2s, nearly the same text")
+
+	whatsappDates = flag.String("whatsapp-dates", waDatesAuto, "Date order of WhatsApp exports: auto, dmy, mdy or ymd")
+
+	watchDir      = flag.String("watch", "", "Watch a directory for new export ZIPs and import them as they appear")
+	watchInterval = flag.Duration("watch-interval", time.Minute, "How often to scan the watch directory")
+	onImport      = flag.String("on-import", "", "Shell command to run after a watched ZIP imported new messages (e.g. chunk/index jobs)")
+
+	mapThreads = flag.String("map-threads", "", "Merge duplicate threads instead of importing: - to pick from threads sharing a name, or a CSV of from,into thread IDs")
+
+	progressFormat = progress.Flag()
+)
+
+var (
+	progressFmt progress.Format
+	// importProgress counts the conversations of the current import
+	importProgress *progress.Reporter
 )
 
 // UnifiedMessage is our internal representation after parsing either format
@@ -36,6 +60,7 @@ type UnifiedMessage struct {
 	TimestampMs  int64
 	IsUnsent     bool
 	Attachments  []UnifiedAttachment
+	Reactions    []UnifiedReaction
 	SourceType   string // export-native message type (best-effort)
 	SourceIDHint string // export-native message id (rare; best-effort)
 }
@@ -46,11 +71,20 @@ type UnifiedAttachment struct {
 	Filename string
 }
 
+type UnifiedReaction struct {
+	ActorName   string
+	Reaction    string
+	TimestampMs int64 // 0 if the export has none
+}
+
 type ExportSource string
 
 const (
 	ExportSourceFacebook  ExportSource = "facebook"
 	ExportSourceMessenger ExportSource = "messenger"
+	ExportSourceInstagram ExportSource = "instagram"
+	ExportSourceWhatsApp  ExportSource = "whatsapp"
+	ExportSourceSignal    ExportSource = "signal"
 )
 
 // UnifiedExport is our internal representation after parsing either format
@@ -61,7 +95,10 @@ type UnifiedExport struct {
 	ThreadIDHint int64  // best-effort thread key extracted from path
 
 	Participants []string
-	Messages     []UnifiedMessage
+	// Phones are the participants' phone numbers, by name, when the export
+	// has them; contacts are matched by number before name
+	Phones   map[string]string
+	Messages []UnifiedMessage
 }
 
 func main() {
@@ -74,14 +111,47 @@ func main() {
 	log := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.Kitchen}).
 		With().Timestamp().Logger().Level(logLevel)
 
-	if *inputPath == "" {
-		log.Fatal().Msg("Usage: import-export -input <path> [-db messenger.db]\n  <path> can be a ZIP file (Messenger app export) or directory (Facebook export)")
+	var err error
+	if progressFmt, err = progress.ParseFormat(*progressFormat); err != nil {
+		log.Fatal().Err(err).Msg("Invalid -progress")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	if *mapThreads != "" {
+		if *inputPath != "" || *watchDir != "" {
+			log.Fatal().Msg("-map-threads can't be combined with -input or -watch")
+		}
+		store, err := storage.New(*dbPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open database")
+		}
+		defer store.Close()
+		merged := runMapThreads(log, store, *mapThreads)
+		log.Info().Int("merged", merged).Msg("Thread mapping complete")
+		return
+	}
+
+	if (*inputPath == "") == (*watchDir == "") {
+		log.Fatal().Msg("Usage: import-export -input <path> [-db messenger.db]\n       import-export -watch <dir> [-on-import <cmd>] [-db messenger.db]\n       import-export -map-threads <- | mapping.csv> [-db messenger.db]\n  <path> can be a ZIP file (Messenger app, Facebook, Instagram, WhatsApp or Signal export), a directory (Facebook, Instagram or Signal export), a WhatsApp chat .txt or a Signal main.jsonl")
+	}
+
+	path := *inputPath
+	if *watchDir != "" {
+		path = *watchDir
 	}
 
 	// Check if input is a file or directory
-	info, err := os.Stat(*inputPath)
+	info, err := os.Stat(path)
 	if err != nil {
-		log.Fatal().Err(err).Str("path", *inputPath).Msg("Failed to access input path")
+		log.Fatal().Err(err).Str("path", path).Msg("Failed to access input path")
+	}
+	if *watchDir != "" && *reportPath != "" {
+		log.Fatal().Msg("-report can't be combined with -watch")
+	}
+	if *watchDir != "" && !info.IsDir() {
+		log.Fatal().Str("path", path).Msg("Watch path is not a directory")
 	}
 
 	// Handle drop-db flag
@@ -97,27 +167,111 @@ func main() {
 	}
 	defer store.Close()
 
-	var totalImported, totalSkipped int
+	if *watchDir != "" {
+		runWatch(log, store, *watchDir, *watchInterval, *onImport)
+		return
+	}
 
-	if info.IsDir() {
-		// Facebook export format (directory)
-		log.Info().Str("path", *inputPath).Msg("Processing Facebook export directory")
-		totalImported, totalSkipped = processFacebookExport(log, store, *inputPath)
-	} else {
-		// ZIP file: detect format (Facebook export ZIP vs Messenger app export ZIP)
-		if strings.HasSuffix(strings.ToLower(*inputPath), ".zip") && isFacebookExportZip(*inputPath) {
-			log.Info().Str("path", *inputPath).Msg("Processing Facebook export ZIP")
-			totalImported, totalSkipped = processFacebookZip(log, store, *inputPath)
-		} else {
-			log.Info().Str("path", *inputPath).Msg("Processing Messenger app export ZIP")
-			totalImported, totalSkipped = processMessengerZip(log, store, *inputPath)
+	if *reportPath != "" {
+		importReport = newReport(*inputPath, *dryRun)
+	}
+	totalImported, totalSkipped, err := importPath(log, store, *inputPath, info.IsDir())
+	if err != nil {
+		log.Fatal().Err(err).Str("path", *inputPath).Msg("Import failed")
+	}
+	if importReport != nil {
+		if err := writeReport(*reportPath, importReport); err != nil {
+			log.Fatal().Err(err).Str("path", *reportPath).Msg("Failed to write report")
 		}
+		log.Info().Str("path", *reportPath).Msg("Wrote import report")
 	}
 
-	log.Info().
+	done := log.Info().
 		Int("imported", totalImported).
-		Int("skipped", totalSkipped).
-		Msg("Import complete")
+		Int("skipped", totalSkipped)
+	if *dedupSync {
+		done = done.Int("sync_duplicates", syncDuplicates)
+	}
+	if resumedConversations > 0 {
+		done = done.Int("resumed_conversations", resumedConversations)
+	}
+	if *mediaDir != "" {
+		done = done.Int("copied_media", copiedMedia).Int("missing_media", missingMedia)
+	}
+	done.Msg("Import complete")
+}
+
+// importPath imports a single export, detecting its format. Conversations
+// are checkpointed as they are stored, so an import interrupted before it
+// returns, or failed to read part of the export, resumes after them.
+func importPath(log zerolog.Logger, store *storage.Storage, path string, isDir bool) (imported, skipped int, err error) {
+	importProgress = progress.New(os.Stderr, progressFmt, "import", "conversations", 0)
+	defer importProgress.Finish()
+	syncDuplicates = 0
+	// Owner evidence only counts within one export; in -watch mode earlier
+	// ZIPs may belong to someone else
+	exportOwner = newOwnerDetector()
+
+	copiedMedia, missingMedia = 0, 0
+	if *mediaDir != "" && !*dryRun {
+		exportMedia = newExportFiles()
+		defer func() {
+			exportMedia.close()
+			exportMedia = nil
+		}()
+	}
+
+	startCheckpoints(log, store, path)
+	imported, skipped, err = importFormat(log, store, path, isDir)
+	if err != nil {
+		// Keep the checkpoints so a retry resumes
+		importKey = ""
+		return imported, skipped, err
+	}
+	recordExportOwner(log, store)
+	finishCheckpoints(log, store)
+	return
+}
+
+// importFormat imports path with the importer for its format. An error
+// means the export (or part of it) couldn't be opened or read, e.g. a
+// truncated ZIP, so the import is incomplete.
+func importFormat(log zerolog.Logger, store *storage.Storage, path string, isDir bool) (imported, skipped int, err error) {
+	if isDir {
+		if isSignalBackupDir(path) {
+			return processSignalFile(log, store, filepath.Join(path, signalBackupName))
+		}
+		if isInstagramExportDir(path) {
+			log.Info().Str("path", path).Msg("Processing Instagram export directory")
+			return processInstagramExtracted(log, store, path)
+		}
+		// Facebook export format (directory)
+		log.Info().Str("path", path).Msg("Processing Facebook export directory")
+		return processFacebookExport(log, store, path)
+	}
+
+	if strings.HasSuffix(strings.ToLower(path), ".txt") {
+		return processWhatsAppTxt(log, store, path)
+	}
+	if strings.HasSuffix(strings.ToLower(path), ".jsonl") {
+		return processSignalFile(log, store, path)
+	}
+
+	// ZIP file: detect format (Signal, WhatsApp, Instagram or Facebook export ZIP vs Messenger app export ZIP).
+	// Instagram is checked before Facebook since its archives also match isFacebookExportZip.
+	isZip := strings.HasSuffix(strings.ToLower(path), ".zip")
+	if isZip && isSignalBackupZip(path) {
+		return processSignalZip(log, store, path)
+	} else if isZip && isWhatsAppExportZip(path) {
+		return processWhatsAppZip(log, store, path)
+	} else if isZip && isInstagramExportZip(path) {
+		return processInstagramZip(log, store, path)
+	} else if isZip && isFacebookExportZip(path) {
+		log.Info().Str("path", path).Msg("Processing Facebook export ZIP")
+		return processFacebookZip(log, store, path)
+	}
+	log.Info().Str("path", path).Msg("Processing Messenger app export ZIP")
+	return processMessengerZip(log, store, path)
 }
 
 // ============================================================================
@@ -154,6 +308,14 @@ type FBShare struct {
 	ShareText string `json:"share_text"`
 }
 
+// FBReaction is one entry of a message's reactions array. Instagram exports
+// add a timestamp (seconds); Facebook ones usually don't.
+type FBReaction struct {
+	Reaction  string `json:"reaction"`
+	Actor     string `json:"actor"`
+	Timestamp int64  `json:"timestamp"`
+}
+
 type FBMessage struct {
 	SenderName  string `json:"sender_name"`
 	Content     string `json:"content"`
@@ -168,6 +330,8 @@ type FBMessage struct {
 	GIFs       []FBMedia  `json:"gifs"`
 	Sticker    *FBSticker `json:"sticker"`
 	Share      *FBShare   `json:"share"`
+
+	Reactions []FBReaction `json:"reactions"`
 }
 
 // fbMessageText combines content, share.share_text, and share.link into a single
@@ -215,7 +379,8 @@ func fbMessageText(msg FBMessage) string {
 }
 
 // isSharePlaceholder returns true if content appears to be a Facebook-generated
-// placeholder for shared links (e.g., "You sent a link.", "Ty wysłałeś link.").
+// placeholder for shared links (e.g., "You sent a link.", "Ty wysłałeś link.", or
+// Instagram's "You sent an attachment." for shared reels and posts).
 // Only matches short, specific patterns to avoid false positives on real user content.
 func isSharePlaceholder(content string) bool {
 	if content == "" {
@@ -233,7 +398,9 @@ func isSharePlaceholder(content string) bool {
 	if strings.HasSuffix(lower, "sent a link.") ||
 		strings.HasSuffix(lower, "shared a link.") ||
 		strings.HasSuffix(lower, "sent a link") ||
-		strings.HasSuffix(lower, "shared a link") {
+		strings.HasSuffix(lower, "shared a link") ||
+		strings.HasSuffix(lower, "sent an attachment.") ||
+		strings.HasSuffix(lower, "sent an attachment") {
 		return true
 	}
 
@@ -249,30 +416,39 @@ func isSharePlaceholder(content string) bool {
 	return false
 }
 
-func processFacebookExport(log zerolog.Logger, store *storage.Storage, basePath string) (imported, skipped int) {
+func processFacebookExport(log zerolog.Logger, store *storage.Storage, basePath string) (imported, skipped int, err error) {
 	// Check if basePath contains ZIP files - if so, process them directly
 	zipFiles, _ := filepath.Glob(filepath.Join(basePath, "*.zip"))
 	if len(zipFiles) > 0 {
 		log.Info().Int("count", len(zipFiles)).Msg("Found ZIP files, processing directly")
 		for _, zipFile := range zipFiles {
-			imp, skip := processFacebookZip(log, store, zipFile)
+			exportMedia.addZip(log, zipFile)
+		}
+		for _, zipFile := range zipFiles {
+			process := processFacebookZip
+			if isInstagramExportZip(zipFile) {
+				process = processInstagramZip
+			}
+			imp, skip, zipErr := process(log, store, zipFile)
 			imported += imp
 			skipped += skip
+			err = errors.Join(err, zipErr)
 		}
 		return
 	}
 
 	// Otherwise, process as extracted directory
+	exportMedia.addDir(basePath)
 	return processFacebookExtracted(log, store, basePath)
 }
 
-func processFacebookZip(log zerolog.Logger, store *storage.Storage, zipPath string) (imported, skipped int) {
+func processFacebookZip(log zerolog.Logger, store *storage.Storage, zipPath string) (imported, skipped int, err error) {
 	log.Info().Str("zip", filepath.Base(zipPath)).Msg("Processing Facebook export ZIP")
+	exportMedia.addZip(log, zipPath)
 
 	zipReader, err := zip.OpenReader(zipPath)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to open ZIP file")
-		return 0, 0
+		return 0, 0, fmt.Errorf("opening %s: %w", filepath.Base(zipPath), err)
 	}
 	defer zipReader.Close()
 
@@ -282,6 +458,10 @@ func processFacebookZip(log zerolog.Logger, store *storage.Storage, zipPath stri
 		if !strings.HasSuffix(file.Name, ".json") {
 			continue
 		}
+		if filepath.Base(file.Name) == "autofill_information.json" {
+			readAutofillFromZip(log, file)
+			continue
+		}
 		// Extract conversation path (parent directory of the JSON file)
 		dir := filepath.Dir(file.Name)
 		// Only process message JSON files (message_1.json, message_2.json, etc.)
@@ -292,16 +472,17 @@ func processFacebookZip(log zerolog.Logger, store *storage.Storage, zipPath stri
 		convFiles[dir] = append(convFiles[dir], file)
 	}
 
-	for convPath, files := range convFiles {
-		imp, skip := processFBConversationFromZip(log, store, convPath, files)
-		imported += imp
-		skipped += skip
+	convPaths := make([]string, 0, len(convFiles))
+	for convPath := range convFiles {
+		convPaths = append(convPaths, convPath)
 	}
-
-	return
+	imported, skipped = importConversations(log, store, convPaths, func(convPath string) UnifiedExport {
+		return parseFBConversationFromZip(log, convPath, convFiles[convPath])
+	})
+	return imported, skipped, nil
 }
 
-func processFBConversationFromZip(log zerolog.Logger, store *storage.Storage, convPath string, files []*zip.File) (imported, skipped int) {
+func parseFBConversationFromZip(log zerolog.Logger, convPath string, files []*zip.File) UnifiedExport {
 	var allMessages []UnifiedMessage
 	var threadName string
 	var participants []string
@@ -351,13 +532,14 @@ func processFBConversationFromZip(log zerolog.Logger, store *storage.Storage, co
 				TimestampMs: msg.TimestampMs,
 				IsUnsent:    msg.IsUnsent,
 				Attachments: attachments,
+				Reactions:   convertFBReactions(msg.Reactions),
 				SourceType:  msg.Type,
 			})
 		}
 	}
 
 	if len(allMessages) == 0 {
-		return 0, 0
+		return UnifiedExport{}
 	}
 
 	export := UnifiedExport{
@@ -369,10 +551,10 @@ func processFBConversationFromZip(log zerolog.Logger, store *storage.Storage, co
 		Messages:     allMessages,
 	}
 
-	return processUnifiedExport(log, store, export)
+	return export
 }
 
-func processFacebookExtracted(log zerolog.Logger, store *storage.Storage, basePath string) (imported, skipped int) {
+func processFacebookExtracted(log zerolog.Logger, store *storage.Storage, basePath string) (imported, skipped int, err error) {
 	// Scan for message directories
 	messageDirs := []string{
 		filepath.Join(basePath, "your_facebook_activity", "messages", "inbox"),
@@ -386,6 +568,15 @@ func processFacebookExtracted(log zerolog.Logger, store *storage.Storage, basePa
 		filepath.Join(basePath, "messages", "archived_threads"),
 	}
 
+	for _, path := range []string{
+		filepath.Join(basePath, "your_facebook_activity", "messages", "autofill_information.json"),
+		filepath.Join(basePath, "messages", "autofill_information.json"),
+	} {
+		if data, err := os.ReadFile(path); err == nil {
+			exportOwner.addAutofill(data)
+		}
+	}
+
 	for _, dir := range messageDirs {
 		if _, err := os.Stat(dir); os.IsNotExist(err) {
 			continue
@@ -394,32 +585,39 @@ func processFacebookExtracted(log zerolog.Logger, store *storage.Storage, basePa
 		log.Info().Str("dir", dir).Msg("Scanning directory")
 
 		// Each subdirectory is a conversation
-		entries, err := os.ReadDir(dir)
-		if err != nil {
-			log.Warn().Err(err).Str("dir", dir).Msg("Failed to read directory")
+		entries, dirErr := os.ReadDir(dir)
+		if dirErr != nil {
+			err = errors.Join(err, fmt.Errorf("reading %s: %w", dir, dirErr))
 			continue
 		}
 
-		for _, entry := range entries {
-			if !entry.IsDir() {
-				continue
-			}
-
-			convPath := filepath.Join(dir, entry.Name())
-			imp, skip := processFBConversation(log, store, convPath)
-			imported += imp
-			skipped += skip
-		}
+		imp, skip := importConversations(log, store, conversationDirs(dir, entries), func(convPath string) UnifiedExport {
+			return parseFBConversation(log, convPath)
+		})
+		imported += imp
+		skipped += skip
 	}
 
 	return
 }
 
-func processFBConversation(log zerolog.Logger, store *storage.Storage, convPath string) (imported, skipped int) {
+// conversationDirs returns the paths of the conversation directories among
+// the entries of dir
+func conversationDirs(dir string, entries []os.DirEntry) []string {
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			paths = append(paths, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return paths
+}
+
+func parseFBConversation(log zerolog.Logger, convPath string) UnifiedExport {
 	// Find all message_N.json files
 	files, err := filepath.Glob(filepath.Join(convPath, "message_*.json"))
 	if err != nil || len(files) == 0 {
-		return 0, 0
+		return UnifiedExport{}
 	}
 
 	// We need to aggregate all messages and get participants from the first file
@@ -466,13 +664,14 @@ func processFBConversation(log zerolog.Logger, store *storage.Storage, convPath
 				TimestampMs: msg.TimestampMs,
 				IsUnsent:    msg.IsUnsent,
 				Attachments: attachments,
+				Reactions:   convertFBReactions(msg.Reactions),
 				SourceType:  msg.Type,
 			})
 		}
 	}
 
 	if len(allMessages) == 0 {
-		return 0, 0
+		return UnifiedExport{}
 	}
 
 	export := UnifiedExport{
@@ -484,7 +683,24 @@ func processFBConversation(log zerolog.Logger, store *storage.Storage, convPath
 		Messages:     allMessages,
 	}
 
-	return processUnifiedExport(log, store, export)
+	return export
+}
+
+// convertFBReactions converts an export's reactions array, fixing the
+// encoding of emoji and actor names
+func convertFBReactions(reactions []FBReaction) []UnifiedReaction {
+	if len(reactions) == 0 {
+		return nil
+	}
+	out := make([]UnifiedReaction, 0, len(reactions))
+	for _, r := range reactions {
+		out = append(out, UnifiedReaction{
+			ActorName:   fixFBEncoding(r.Actor),
+			Reaction:    fixFBEncoding(r.Reaction),
+			TimestampMs: r.Timestamp * 1000,
+		})
+	}
+	return out
 }
 
 // fixFBEncoding fixes the UTF-8 mojibake in Facebook exports
@@ -523,49 +739,47 @@ type MessengerMessage struct {
 	Type       string `json:"type"`
 }
 
-func processMessengerZip(log zerolog.Logger, store *storage.Storage, zipPath string) (imported, skipped int) {
+func processMessengerZip(log zerolog.Logger, store *storage.Storage, zipPath string) (imported, skipped int, err error) {
 	zipReader, err := zip.OpenReader(zipPath)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to open ZIP file")
-		return 0, 0
+		return 0, 0, fmt.Errorf("opening %s: %w", filepath.Base(zipPath), err)
 	}
 	defer zipReader.Close()
 
+	var files []*zip.File
 	for _, file := range zipReader.File {
-		if !strings.HasSuffix(file.Name, ".json") {
-			continue
+		if strings.HasSuffix(file.Name, ".json") {
+			files = append(files, file)
 		}
-
-		imp, skip := processMessengerZipFile(log, store, file)
-		imported += imp
-		skipped += skip
 	}
-
-	return
+	imported, skipped = importConversations(log, store, files, func(file *zip.File) UnifiedExport {
+		return parseMessengerZipFile(log, file)
+	})
+	return imported, skipped, nil
 }
 
-func processMessengerZipFile(log zerolog.Logger, store *storage.Storage, file *zip.File) (imported, skipped int) {
+func parseMessengerZipFile(log zerolog.Logger, file *zip.File) UnifiedExport {
 	rc, err := file.Open()
 	if err != nil {
 		log.Warn().Err(err).Str("file", file.Name).Msg("Failed to open file in ZIP")
-		return 0, 0
+		return UnifiedExport{}
 	}
 	defer rc.Close()
 
 	data, err := io.ReadAll(rc)
 	if err != nil {
 		log.Warn().Err(err).Str("file", file.Name).Msg("Failed to read file")
-		return 0, 0
+		return UnifiedExport{}
 	}
 
 	var export MessengerExport
 	if err := json.Unmarshal(data, &export); err != nil {
 		log.Warn().Err(err).Str("file", file.Name).Msg("Failed to parse JSON")
-		return 0, 0
+		return UnifiedExport{}
 	}
 
 	if len(export.Messages) == 0 {
-		return 0, 0
+		return UnifiedExport{}
 	}
 
 	// Convert to unified format
@@ -587,7 +801,7 @@ func processMessengerZipFile(log zerolog.Logger, store *storage.Storage, file *z
 	}
 
 	if len(messages) == 0 {
-		return 0, 0
+		return UnifiedExport{}
 	}
 
 	unified := UnifiedExport{
@@ -597,17 +811,65 @@ func processMessengerZipFile(log zerolog.Logger, store *storage.Storage, file *z
 		Messages:     messages,
 	}
 
-	return processUnifiedExport(log, store, unified)
+	return unified
 }
 
 // ============================================================================
 // Unified Processing (works with either format after conversion)
 // ============================================================================
 
+// processUnifiedExport stores a conversation in one transaction, together
+// with its import checkpoint. A conversation an interrupted run of the same
+// import already stored is skipped.
 func processUnifiedExport(log zerolog.Logger, store *storage.Storage, export UnifiedExport) (imported, skipped int) {
+	checkpoint := conversationCheckpointKey(export)
+	if importKey != "" {
+		if _, ok, err := store.GetImportCheckpoint(importKey, checkpoint); err != nil {
+			log.Warn().Err(err).Msg("Failed to read import checkpoint")
+		} else if ok {
+			exportOwner.addThread(export.Participants)
+			resumedConversations++
+			log.Debug().Str("thread", export.ThreadName).Msg("Conversation stored by an earlier run, skipping")
+			return 0, 0
+		}
+	}
+	if *dryRun {
+		return importConversation(log, store, export)
+	}
+
+	tx, err := store.Begin()
+	if err != nil {
+		log.Error().Err(err).Str("thread", export.ThreadName).Msg("Failed to start transaction")
+		return 0, len(export.Messages)
+	}
+	defer tx.Rollback()
+	imported, skipped = importConversation(log, tx, export)
+	if importKey != "" {
+		cp := storage.ImportCheckpoint{Imported: imported, Skipped: skipped}
+		if err := tx.SetImportCheckpoint(importKey, checkpoint, cp); err != nil {
+			log.Warn().Err(err).Msg("Failed to record import checkpoint")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error().Err(err).Str("thread", export.ThreadName).Msg("Failed to commit conversation")
+		return 0, len(export.Messages)
+	}
+	return imported, skipped
+}
+
+// importConversation stores the thread, participants and messages of a
+// conversation
+func importConversation(log zerolog.Logger, store *storage.Storage, export UnifiedExport) (imported, skipped int) {
 	threadName := cleanThreadName(export.ThreadName)
 
 	threadID := export.ThreadIDHint
+	if threadID == 0 {
+		// A thread merged away (-map-threads) no longer has the name, which
+		// now finds the thread it was merged into; its generated ID still does
+		if generated := generateThreadID(conversationKey(threadName, export.Participants)); resolveThreadID(store, generated) != generated {
+			threadID = generated
+		}
+	}
 	if threadID == 0 && threadName != "" {
 		if id, ok, err := store.FindUniqueThreadIDByName(threadName); err != nil {
 			log.Warn().Err(err).Str("thread", threadName).Msg("Failed to look up thread by name")
@@ -618,6 +880,13 @@ func processUnifiedExport(log zerolog.Logger, store *storage.Storage, export Uni
 	if threadID == 0 {
 		threadID = generateThreadID(conversationKey(threadName, export.Participants))
 	}
+	// Message IDs stay derived from the ID the thread was first imported
+	// under, so a re-import after a merge finds the messages already there
+	importThreadID := threadID
+	threadID = resolveThreadID(store, threadID)
+
+	exportOwner.addThread(export.Participants)
+	tr := importReport.thread(store, threadID, threadName, export)
 
 	log.Info().
 		Str("source", string(export.Source)).
@@ -632,24 +901,39 @@ func processUnifiedExport(log zerolog.Logger, store *storage.Storage, export Uni
 		if name == "" {
 			continue
 		}
-		contactID := resolveContactID(store, name)
+		contactID := resolveExportContactID(store, name, export.Phones[name])
 		participantIDs[name] = contactID
+		tr.contact(store, contactID, name)
 
 		if !*dryRun {
 			if err := store.EnsureContactExistsWithName(contactID, name); err != nil {
 				log.Warn().Err(err).Str("name", name).Msg("Failed to ensure contact exists")
 			}
+			if phone := export.Phones[name]; phone != "" {
+				if err := store.SetContactHandleIfEmpty(contactID, phone); err != nil {
+					log.Warn().Err(err).Str("name", name).Msg("Failed to store contact phone")
+				}
+			}
 		}
 	}
 
-	// Ensure thread exists with name
+	// Ensure thread exists with name, along with its participant list
 	if !*dryRun {
 		if err := store.EnsureThreadExistsWithName(threadID, threadName); err != nil {
 			log.Warn().Err(err).Int64("thread", threadID).Msg("Failed to ensure thread exists")
 		}
+		contactIDs := make([]int64, 0, len(participantIDs))
+		for _, id := range participantIDs {
+			contactIDs = append(contactIDs, id)
+		}
+		if err := store.SetExportedThreadParticipants(threadID, contactIDs); err != nil {
+			log.Warn().Err(err).Int64("thread", threadID).Msg("Failed to store thread participants")
+		}
 	}
 
-	// Process messages
+	// Process messages; a dry run tells duplicates within the export apart
+	// by their IDs, as the database never sees them
+	dryRunSeen := make(map[string]bool)
 	for _, msg := range export.Messages {
 		if msg.IsUnsent {
 			skipped++
@@ -666,13 +950,25 @@ func processUnifiedExport(log zerolog.Logger, store *storage.Storage, export Uni
 			skipped++
 			continue
 		}
-		messageID := generateMessageID(threadID, senderName, msg.TimestampMs, msg.Text, msg.Attachments)
+		messageID := generateMessageID(importThreadID, senderName, msg.TimestampMs, msg.Text, msg.Attachments)
+
+		// Messages imported before are skipped below anyway; only new ones
+		// can be live-sync copies
+		if *dedupSync {
+			if exists, _ := store.HasMessage(messageID); !exists && isSyncDuplicate(log, store, threadID, msg) {
+				syncDuplicates++
+				tr.syncDuplicate()
+				skipped++
+				continue
+			}
+		}
 
 		// Get sender ID
 		senderID, ok := participantIDs[senderName]
 		if !ok {
 			senderID = resolveContactID(store, senderName)
 			participantIDs[senderName] = senderID
+			tr.unmatched(store, senderID, senderName)
 			// Also ensure this sender exists as contact
 			if !*dryRun {
 				store.EnsureContactExistsWithName(senderID, senderName)
@@ -680,23 +976,53 @@ func processUnifiedExport(log zerolog.Logger, store *storage.Storage, export Uni
 		}
 
 		if *dryRun {
-			imported++
+			exists, _ := store.HasMessage(messageID)
+			isNew := !exists && !dryRunSeen[messageID]
+			dryRunSeen[messageID] = true
+			tr.message(messageID, isNew)
+			if isNew {
+				imported++
+			} else {
+				skipped++
+			}
 			continue
 		}
 
 		// Insert message (ON CONFLICT DO NOTHING handles duplicates)
-		inserted, err := store.InsertExportedMessage(messageID, threadID, senderID, msg.Text, msg.TimestampMs)
+		inserted, err := store.InsertExportedMessage(messageID, threadID, senderID, msg.Text, msg.TimestampMs, storage.ExportProvenance(string(export.Source)))
 		if err != nil {
 			log.Warn().Err(err).Str("id", messageID).Msg("Failed to insert message")
 			skipped++
 			continue
 		}
+		tr.message(messageID, inserted)
 		if inserted {
 			imported++
 		} else {
 			skipped++
 		}
 
+		// Store reactions, which may have changed since an earlier import
+		for _, r := range msg.Reactions {
+			actorName := strings.TrimSpace(r.ActorName)
+			if actorName == "" || r.Reaction == "" {
+				continue
+			}
+			actorID, ok := participantIDs[actorName]
+			if !ok {
+				actorID = resolveContactID(store, actorName)
+				participantIDs[actorName] = actorID
+				store.EnsureContactExistsWithName(actorID, actorName)
+			}
+			ts := r.TimestampMs
+			if ts == 0 {
+				ts = msg.TimestampMs
+			}
+			if err := store.UpsertExportedReaction(threadID, messageID, actorID, r.Reaction, ts); err != nil {
+				log.Warn().Err(err).Str("msg", messageID).Str("actor", actorName).Msg("Failed to insert reaction")
+			}
+		}
+
 		// Store attachments (if any)
 		for _, a := range msg.Attachments {
 			if a.URI == "" {
@@ -709,6 +1035,15 @@ func processUnifiedExport(log zerolog.Logger, store *storage.Storage, export Uni
 			}
 			if err := store.UpsertExportedAttachment(attID, messageID, int64(a.Type), a.URI, filename); err != nil {
 				log.Warn().Err(err).Str("msg", messageID).Str("uri", a.URI).Msg("Failed to insert attachment")
+				continue
+			}
+			if exportMedia != nil && isExportFile(a.URI) {
+				if err := copyExportMedia(store, attID, a, filename); err != nil {
+					missingMedia++
+					log.Debug().Err(err).Str("uri", a.URI).Msg("Failed to copy attachment from export")
+				} else {
+					copiedMedia++
+				}
 			}
 		}
 	}
@@ -813,7 +1148,24 @@ func resolveContactID(store *storage.Storage, name string) int64 {
 	if id, ok, err := store.FindUniqueContactIDByName(name); err == nil && ok {
 		return id
 	}
-	return generateContactID(name)
+	// A contact merged away (contacts-merge) keeps its generated ID as an
+	// alias, so re-importing the same export lands on the merged contact
+	id := generateContactID(name)
+	if into, err := store.ResolveContactAlias(id); err == nil {
+		return into
+	}
+	return id
+}
+
+// resolveExportContactID resolves a participant by phone number when the
+// export has one, then by name
+func resolveExportContactID(store *storage.Storage, name, phone string) int64 {
+	if phone != "" {
+		if id, ok, err := store.FindUniqueContactIDByPhone(phone); err == nil && ok {
+			return id
+		}
+	}
+	return resolveContactID(store, name)
 }
 
 func threadIDFromConversationPath(convPath string) (int64, bool) {
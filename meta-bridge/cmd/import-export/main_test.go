@@ -2,9 +2,20 @@ package main
 
 import (
 	"archive/zip"
+	"database/sql"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-meta/pkg/media"
+	metatable "go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/storage"
 )
 
 func TestCleanThreadName_RemovesNumericSuffix(t *testing.T) {
@@ -69,3 +80,745 @@ func TestIsFacebookExportZip_DetectsMessageFiles(t *testing.T) {
 		t.Fatalf("expected Messenger app export ZIP to not be detected as Facebook export")
 	}
 }
+
+func TestWatcherScan_WaitsForStableFiles(t *testing.T) {
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "export.zip")
+	if err := os.WriteFile(zipPath, []byte("part"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	w := newWatcher(dir)
+	if ready, err := w.scan(); err != nil || len(ready) != 0 {
+		t.Fatalf("first scan: expected nothing ready, got %v (err=%v)", ready, err)
+	}
+
+	// Still growing
+	if err := os.WriteFile(zipPath, []byte("partial"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if ready, _ := w.scan(); len(ready) != 0 {
+		t.Fatalf("expected growing file to be skipped, got %v", ready)
+	}
+
+	ready, _ := w.scan()
+	if len(ready) != 1 || ready[0] != zipPath {
+		t.Fatalf("expected stable ZIP to be ready, got %v", ready)
+	}
+
+	w.markDone(zipPath)
+	if ready, _ := w.scan(); len(ready) != 0 {
+		t.Fatalf("expected imported ZIP to be skipped, got %v", ready)
+	}
+}
+
+func TestImportWatchedZip_RetriesUnreadableZip(t *testing.T) {
+	store, err := storage.New(":memory:")
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	defer store.Close()
+
+	// A half-copied ZIP has no central directory yet
+	zipPath := filepath.Join(t.TempDir(), "export.zip")
+	if err := os.WriteFile(zipPath, []byte("PK\x03\x04 truncated"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := importWatchedZip(zerolog.Nop(), store, zipPath); err == nil {
+		t.Fatal("expected an error for an unreadable ZIP")
+	}
+	hash, _ := fileSHA256(zipPath)
+	if prev, _ := store.GetSyncMetadata(watchImportKeyPrefix + hash); prev != "" {
+		t.Fatalf("unreadable ZIP recorded as imported at %s", prev)
+	}
+}
+
+func TestOwnerDetector(t *testing.T) {
+	d := newOwnerDetector()
+	d.addThread([]string{"Me", "Alice"})
+	if _, ok := d.owner(); ok {
+		t.Fatalf("expected no owner from a single thread")
+	}
+	d.addThread([]string{"Bob", "Me", "Carol"})
+	if got, ok := d.owner(); !ok || got != "Me" {
+		t.Fatalf("expected owner %q, got %q (ok=%v)", "Me", got, ok)
+	}
+
+	d.addAutofill([]byte(`{"autofill_information_v2": {"FULL_NAME": ["Me Myself"]}}`))
+	if got, ok := d.owner(); !ok || got != "Me Myself" {
+		t.Fatalf("expected autofill owner %q, got %q (ok=%v)", "Me Myself", got, ok)
+	}
+}
+
+func TestImportPath_OwnerEvidencePerExport(t *testing.T) {
+	store, err := storage.New(":memory:")
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	defer store.Close()
+
+	writeExport := func(threads ...[2]string) string {
+		base := t.TempDir()
+		for i, names := range threads {
+			dir := filepath.Join(base, "messages", "inbox", "chat_"+strconv.Itoa(100+i))
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			data := `{"title": "Chat", "participants": [{"name": "` + names[0] + `"}, {"name": "` + names[1] + `"}],
+				"messages": [{"sender_name": "` + names[0] + `", "timestamp_ms": ` + strconv.Itoa(1000+i) + `, "content": "hi"}]}`
+			if err := os.WriteFile(filepath.Join(dir, "message_1.json"), []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return base
+	}
+
+	if _, _, err := importPath(zerolog.Nop(), store, writeExport([2]string{"Anna", "Bob"}, [2]string{"Anna", "Carl"}), true); err != nil {
+		t.Fatalf("first import: %v", err)
+	}
+	if _, _, err := importPath(zerolog.Nop(), store, writeExport([2]string{"Dana", "Ed"}), true); err != nil {
+		t.Fatalf("second import: %v", err)
+	}
+	if exportOwner.threads != 1 {
+		t.Errorf("second export saw %d threads of owner evidence, want 1", exportOwner.threads)
+	}
+	if name, ok := exportOwner.owner(); ok {
+		t.Errorf("second export inferred owner %q from the first one", name)
+	}
+}
+
+func TestIGConversationExport(t *testing.T) {
+	data := []byte(`{
+		"participants": [{"name": "Alice"}, {"name": "Me"}],
+		"title": "Alice",
+		"messages": [
+			{"sender_name": "Alice", "timestamp_ms": 3000, "content": "Alice sent an attachment.",
+			 "share": {"link": "https://www.instagram.com/reel/abc123/", "share_text": "so funny", "original_content_owner": "comedian"}},
+			{"sender_name": "Me", "timestamp_ms": 2000, "photos": [{"uri": "your_instagram_activity/messages/inbox/alice_42/photos/1.jpg"}]},
+			{"sender_name": "Me", "timestamp_ms": 1000, "content": "cafÃ©?"}
+		]
+	}`)
+	export := igConversationExport(zerolog.Nop(), "your_instagram_activity/messages/inbox/alice_42",
+		map[string][]byte{"message_1.json": data})
+
+	if export.Source != ExportSourceInstagram || export.ThreadName != "Alice" || len(export.Messages) != 3 {
+		t.Fatalf("unexpected export: %+v", export)
+	}
+	if export.ThreadIDHint == 0 || export.ThreadIDHint == 42 {
+		t.Fatalf("expected an Instagram-namespaced thread ID, got %d", export.ThreadIDHint)
+	}
+
+	reel := export.Messages[0]
+	if want := "so funny\nhttps://www.instagram.com/reel/abc123/\nvia @comedian"; reel.Text != want {
+		t.Fatalf("expected reel text %q, got %q", want, reel.Text)
+	}
+	if len(reel.Attachments) != 1 || reel.Attachments[0].Type != metatable.AttachmentTypeXMA || reel.Attachments[0].Filename != "reel by @comedian" {
+		t.Fatalf("unexpected reel attachments: %+v", reel.Attachments)
+	}
+	if photo := export.Messages[1]; len(photo.Attachments) != 1 || photo.Attachments[0].Type != metatable.AttachmentTypeImage {
+		t.Fatalf("unexpected photo attachments: %+v", photo.Attachments)
+	}
+	if got := export.Messages[2].Text; got != "café?" {
+		t.Fatalf("expected mojibake to be fixed, got %q", got)
+	}
+}
+
+func TestIsInstagramExportZip(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "ig.zip")
+	f, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("your_instagram_activity/messages/inbox/alice_42/message_1.json")
+	if err != nil {
+		t.Fatalf("create entry: %v", err)
+	}
+	_, _ = w.Write([]byte(`{}`))
+	_ = zw.Close()
+	_ = f.Close()
+
+	if !isInstagramExportZip(zipPath) {
+		t.Fatalf("expected Instagram export ZIP to be detected")
+	}
+}
+
+func TestConvertFBReactions_FixesEncoding(t *testing.T) {
+	got := convertFBReactions([]FBReaction{
+		{Reaction: "â\u009d¤", Actor: "ZoÅº", Timestamp: 1700000000},
+		{Reaction: "ð\u009f\u0098\u0086", Actor: "Anna"},
+	})
+	want := []UnifiedReaction{
+		{ActorName: "Zoź", Reaction: "❤", TimestampMs: 1700000000000},
+		{ActorName: "Anna", Reaction: "😆"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d reactions, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("reaction %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWhatsAppExport_iOS(t *testing.T) {
+	chat := "\ufeff[12/31/22, 10:15:42\u202fPM] Trip: \u200eMessages and calls are end-to-end encrypted.\r\n" +
+		"[12/31/22, 10:16:05\u202fPM] Anna Nowak: Ferry at 7:40\r\n" +
+		"from pier 3\r\n" +
+		"\u200e[12/31/22, 10:17:00\u202fPM] Me: \u200e<attached: 00000012-PHOTO-2022-12-31-22-17-00.jpg>\r\n" +
+		"[12/31/22, 10:17:30\u202fPM] Anna Nowak: \u200eimage omitted\r\n" +
+		"[1/2/23, 9:00:00\u202fAM] Me: \u200eThis message was deleted.\r\n" +
+		"[1/2/23, 9:01:00\u202fAM] Trip: \u200eAnna Nowak changed the group name to \"Trip\"\r\n"
+	export, err := whatsappExport("WhatsApp Chat - Trip.zip", strings.NewReader(chat), waDatesAuto, time.UTC)
+	if err != nil {
+		t.Fatalf("whatsappExport: %v", err)
+	}
+	if export.Source != ExportSourceWhatsApp || export.ThreadName != "Trip" || export.ThreadIDHint == 0 {
+		t.Fatalf("unexpected export: %+v", export)
+	}
+	if want := []string{"Anna Nowak", "Me"}; !reflect.DeepEqual(export.Participants, want) {
+		t.Errorf("participants = %v, want %v", export.Participants, want)
+	}
+	if len(export.Messages) != 3 {
+		t.Fatalf("got %d messages, want 3: %+v", len(export.Messages), export.Messages)
+	}
+
+	ferry := export.Messages[0]
+	if ferry.Text != "Ferry at 7:40\nfrom pier 3" || ferry.TimestampMs != time.Date(2022, 12, 31, 22, 16, 5, 0, time.UTC).UnixMilli() {
+		t.Errorf("multi-line message = %q at %d", ferry.Text, ferry.TimestampMs)
+	}
+	photo := export.Messages[1]
+	if photo.Text != "" || len(photo.Attachments) != 1 || photo.Attachments[0].Type != metatable.AttachmentTypeImage ||
+		photo.Attachments[0].URI != "00000012-PHOTO-2022-12-31-22-17-00.jpg" {
+		t.Errorf("attached photo = %+v", photo)
+	}
+	if deleted := export.Messages[2]; !deleted.IsUnsent || deleted.SenderName != "Me" {
+		t.Errorf("deleted message = %+v", deleted)
+	}
+}
+
+func TestWhatsAppExport_Android(t *testing.T) {
+	chat := "13/01/2023, 08:05 - Messages and calls are end-to-end encrypted. Tap to learn more.\n" +
+		"13/01/2023, 08:05 - Anna added Bartek\n" +
+		"13/01/2023, 08:05 - Anna: Kto ma klucze?\n" +
+		"13/01/2023, 08:05 - Bartek: Ja <This message was edited>\n" +
+		"13/01/2023, 08:06 - Bartek: IMG-20230113-WA0001.jpg (file attached)\n" +
+		"13/01/2023, 08:07 - Anna: <Media omitted>\n"
+	export, err := whatsappExport("WhatsApp Chat with Anna.txt", strings.NewReader(chat), waDatesAuto, time.UTC)
+	if err != nil {
+		t.Fatalf("whatsappExport: %v", err)
+	}
+	if export.ThreadName != "Anna" || len(export.Messages) != 3 {
+		t.Fatalf("unexpected export: %+v", export)
+	}
+
+	// Same minute: spread 1 ms apart in order
+	base := time.Date(2023, 1, 13, 8, 5, 0, 0, time.UTC).UnixMilli()
+	if a, b := export.Messages[0], export.Messages[1]; a.TimestampMs != base || b.TimestampMs != base+1 || b.Text != "Ja" {
+		t.Errorf("same-minute messages = %+v, %+v", a, b)
+	}
+	if att := export.Messages[2].Attachments; len(att) != 1 || att[0].URI != "IMG-20230113-WA0001.jpg" {
+		t.Errorf("attached file = %+v", att)
+	}
+}
+
+func TestWhatsAppDateOrder(t *testing.T) {
+	for _, tc := range []struct {
+		dates []string
+		want  string
+	}{
+		{[]string{"1/2/23", "12/31/22"}, waDatesMDY},
+		{[]string{"01.02.2023", "31.12.2022"}, waDatesDMY},
+		{[]string{"2023-01-02"}, waDatesYMD},
+		{[]string{"1/2/23"}, waDatesDMY}, // Undecided
+	} {
+		var msgs []waMessage
+		for _, d := range tc.dates {
+			msgs = append(msgs, waMessage{date: d})
+		}
+		if got, err := whatsappDateOrder(msgs, waDatesAuto); err != nil || got != tc.want {
+			t.Errorf("whatsappDateOrder(%v) = %q, %v; want %q", tc.dates, got, err, tc.want)
+		}
+	}
+	if _, err := whatsappDateOrder(nil, "dym"); err == nil {
+		t.Error("expected an error for an unknown date order")
+	}
+}
+
+func TestSignalBackupExports(t *testing.T) {
+	backup := strings.Join([]string{
+		`{"version":"1","backupTimeMs":"1700000000000"}`,
+		`{"account":{"givenName":"Tomasz","familyName":"K"}}`,
+		`{"recipient":{"id":"1","self":{}}}`,
+		`{"recipient":{"id":"2","contact":{"aci":"YW5uYQ==","e164":"48600100200","profileGivenName":"Ania","systemGivenName":"Anna","systemFamilyName":"Nowak"}}}`,
+		`{"recipient":{"id":"3","contact":{"aci":"YmFydGVr","e164":"48700200300"}}}`,
+		`{"recipient":{"id":"4","group":{"masterKey":"a2V5","snapshot":{"title":{"title":"Trip"},"members":[{"userId":"YW5uYQ=="},{"userId":"YmFydGVr"}]}}}}`,
+		`{"recipient":{"id":"5","releaseNotes":{}}}`,
+		`{"chat":{"id":"10","recipientId":"2"}}`,
+		`{"chat":{"id":"11","recipientId":"4"}}`,
+		`{"chat":{"id":"12","recipientId":"5"}}`,
+		`{"chatItem":{"chatId":"10","authorId":"2","dateSent":"1700000001000","incoming":{},"standardMessage":{"text":{"body":"Ferry at 7:40"},"reactions":[{"emoji":"👍","authorId":"1","sentTimestamp":"1700000002000"}]}}}`,
+		`{"chatItem":{"chatId":"10","authorId":"1","dateSent":"1700000003000","outgoing":{},"standardMessage":{"attachments":[{"pointer":{"contentType":"audio/aac"},"flag":"VOICE_MESSAGE"},{"pointer":{"contentType":"image/jpeg","fileName":"pier.jpg"}}]}}}`,
+		`{"chatItem":{"chatId":"10","authorId":"2","dateSent":"1700000004000","remoteDeletedMessage":{}}}`,
+		`{"chatItem":{"chatId":"11","authorId":"4","dateSent":"1700000005000","directionless":{},"updateMessage":{"groupChange":{}}}}`,
+		`{"chatItem":{"chatId":"11","authorId":"3","dateSent":"1700000006000","incoming":{},"stickerMessage":{"sticker":{"packId":"cGFjaw==","stickerId":7,"emoji":"🚢"}}}}`,
+		`{"chatItem":{"chatId":"12","authorId":"5","dateSent":"1700000007000","standardMessage":{"text":{"body":"What's new"}}}}`,
+	}, "\n")
+	parsed, err := parseSignalBackup(strings.NewReader(backup))
+	if err != nil {
+		t.Fatalf("parseSignalBackup: %v", err)
+	}
+	exports := parsed.exports()
+	if len(exports) != 2 {
+		t.Fatalf("got %d exports, want 2 (release notes skipped): %+v", len(exports), exports)
+	}
+
+	dm := exports[0]
+	if dm.Source != ExportSourceSignal || dm.ThreadName != "Anna Nowak" || dm.ThreadIDHint != generateThreadID("signal:YW5uYQ==") {
+		t.Fatalf("unexpected 1:1 export: %+v", dm)
+	}
+	if want := []string{"Anna Nowak", "Tomasz K"}; !reflect.DeepEqual(dm.Participants, want) {
+		t.Errorf("participants = %v, want %v", dm.Participants, want)
+	}
+	if want := map[string]string{"Anna Nowak": "+48600100200"}; !reflect.DeepEqual(dm.Phones, want) {
+		t.Errorf("phones = %v, want %v", dm.Phones, want)
+	}
+	if len(dm.Messages) != 3 {
+		t.Fatalf("got %d messages, want 3: %+v", len(dm.Messages), dm.Messages)
+	}
+	if m := dm.Messages[0]; m.Text != "Ferry at 7:40" || m.TimestampMs != 1700000001000 ||
+		len(m.Reactions) != 1 || m.Reactions[0] != (UnifiedReaction{ActorName: "Tomasz K", Reaction: "👍", TimestampMs: 1700000002000}) {
+		t.Errorf("text message = %+v", m)
+	}
+	want := []UnifiedAttachment{
+		{Type: metatable.AttachmentTypeAudio, URI: "attachment-1", Filename: "attachment-1"},
+		{Type: metatable.AttachmentTypeImage, URI: "pier.jpg", Filename: "pier.jpg"},
+	}
+	if m := dm.Messages[1]; m.SenderName != "Tomasz K" || !reflect.DeepEqual(m.Attachments, want) {
+		t.Errorf("attachments message = %+v", m)
+	}
+	if m := dm.Messages[2]; !m.IsUnsent {
+		t.Errorf("deleted message = %+v", m)
+	}
+
+	group := exports[1]
+	if group.ThreadName != "Trip" || group.ThreadIDHint != generateThreadID("signal:group:a2V5") {
+		t.Fatalf("unexpected group export: %+v", group)
+	}
+	// Members without a message are participants too; a number stands in for a missing name
+	if want := []string{"Anna Nowak", "+48700200300", "Tomasz K"}; !reflect.DeepEqual(group.Participants, want) {
+		t.Errorf("group participants = %v, want %v", group.Participants, want)
+	}
+	if len(group.Messages) != 1 || group.Messages[0].SenderName != "+48700200300" ||
+		group.Messages[0].Attachments[0].Type != metatable.AttachmentTypeSticker {
+		t.Errorf("group messages = %+v", group.Messages)
+	}
+}
+
+func TestResolveExportContactID_MatchesPhone(t *testing.T) {
+	store, err := storage.New(":memory:")
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureContactExistsWithName(42, "Anna N."); err != nil {
+		t.Fatalf("EnsureContactExistsWithName: %v", err)
+	}
+	if err := store.SetContactHandleIfEmpty(42, "+48 600 100 200"); err != nil {
+		t.Fatalf("SetContactHandleIfEmpty: %v", err)
+	}
+
+	if id := resolveExportContactID(store, "Anna Nowak", "+48600100200"); id != 42 {
+		t.Errorf("matched by phone = %d, want 42", id)
+	}
+	if id := resolveExportContactID(store, "Anna N.", "+48999999999"); id != 42 {
+		t.Errorf("matched by name = %d, want 42", id)
+	}
+	if id := resolveExportContactID(store, "Anna Nowak", ""); id != generateContactID("Anna Nowak") {
+		t.Errorf("unmatched = %d, want a generated ID", id)
+	}
+}
+
+func TestResolveContactID_FollowsMergedAlias(t *testing.T) {
+	store, err := storage.New(":memory:")
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	defer store.Close()
+
+	generated := generateContactID("Ania")
+	for id, name := range map[int64]string{42: "Anna Nowak", generated: "Ania"} {
+		if err := store.EnsureContactExistsWithName(id, name); err != nil {
+			t.Fatalf("EnsureContactExistsWithName: %v", err)
+		}
+	}
+	if err := store.MergeContacts(42, generated); err != nil {
+		t.Fatalf("MergeContacts: %v", err)
+	}
+	if id := resolveContactID(store, "Ania"); id != 42 {
+		t.Errorf("resolveContactID after merge = %d, want 42", id)
+	}
+}
+
+func TestReadThreadMap(t *testing.T) {
+	merges, err := readThreadMap(strings.NewReader("from,into\n# comment\n20, 10\n\n30,40\n21,10\n"))
+	if err != nil {
+		t.Fatalf("readThreadMap: %v", err)
+	}
+	want := []threadMerge{{into: 10, from: []int64{20, 21}}, {into: 40, from: []int64{30}}}
+	if !reflect.DeepEqual(merges, want) {
+		t.Errorf("readThreadMap = %+v, want %+v", merges, want)
+	}
+	if _, err := readThreadMap(strings.NewReader("20,10\nx,10\n")); err == nil {
+		t.Error("expected an error for a non-numeric ID after the first line")
+	}
+}
+
+func TestMapThreads_ReimportFollowsAlias(t *testing.T) {
+	store, err := storage.New(":memory:")
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	defer store.Close()
+
+	export := UnifiedExport{
+		Source:       ExportSourceMessenger,
+		ThreadName:   "Trip",
+		Participants: []string{"Anna", "Bartek"},
+		Messages: []UnifiedMessage{
+			{SenderName: "Anna", Text: "ferry at 7?", TimestampMs: 1000},
+			{SenderName: "Bartek", Text: "yes", TimestampMs: 2000},
+		},
+	}
+	if imported, _ := processUnifiedExport(zerolog.Nop(), store, export); imported != 2 {
+		t.Fatalf("first import: %d messages", imported)
+	}
+	// Live sync knows the conversation under its real thread key
+	if err := store.EnsureThreadExistsWithName(10, "Trip"); err != nil {
+		t.Fatalf("EnsureThreadExistsWithName: %v", err)
+	}
+
+	var out strings.Builder
+	merges, err := promptThreadMerges(store, strings.NewReader("nope\n10\n"), &out)
+	if err != nil {
+		t.Fatalf("promptThreadMerges: %v", err)
+	}
+	generated := generateThreadID(conversationKey("Trip", export.Participants))
+	if len(merges) != 1 || merges[0].into != 10 || !reflect.DeepEqual(merges[0].from, []int64{generated}) {
+		t.Fatalf("merges = %+v\n%s", merges, out.String())
+	}
+	if !strings.Contains(out.String(), "Not one of the threads above") {
+		t.Errorf("invalid answer not rejected:\n%s", out.String())
+	}
+	if err := store.MergeThreads(10, generated); err != nil {
+		t.Fatalf("MergeThreads: %v", err)
+	}
+
+	imported, skipped := processUnifiedExport(zerolog.Nop(), store, export)
+	if imported != 0 || skipped != 2 {
+		t.Errorf("re-import after merge: %d imported, %d skipped; want 0, 2", imported, skipped)
+	}
+	if stats, _ := store.GetStats(); stats.MessageCount != 2 || stats.ThreadCount != 1 {
+		t.Errorf("after re-import: %+v", stats)
+	}
+}
+
+func TestSimilarText(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want bool
+	}{
+		{"Ferry at  7?", "ferry at 7?", true},
+		{"Jedziemy w piątek do Zakopanego", "Jedziemy w piatek do Zakopanego", true},
+		{"", "", true},
+		{"ok", "ko", false},
+		{"photo", "", false},
+		{"see you tomorrow", "see you on monday", false},
+	} {
+		if got := similarText(tc.a, tc.b); got != tc.want {
+			t.Errorf("similarText(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestDedupSync_SkipsLiveCopies(t *testing.T) {
+	store, err := storage.New(":memory:")
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	defer store.Close()
+	*dedupSync = true
+	defer func() { *dedupSync = false }()
+	syncDuplicates = 0
+
+	if err := store.EnsureThreadExistsWithName(42, "Trip"); err != nil {
+		t.Fatalf("EnsureThreadExistsWithName: %v", err)
+	}
+	if err := store.EnsureContactExists(7); err != nil {
+		t.Fatalf("EnsureContactExists: %v", err)
+	}
+	if err := store.InsertMessage(&metatable.LSInsertMessage{MessageId: "mid.$abc", ThreadKey: 42, SenderId: 7, Text: "Ferry at 7?", TimestampMs: 10_000}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+
+	export := UnifiedExport{
+		Source:       ExportSourceFacebook,
+		ThreadName:   "Trip",
+		ThreadIDHint: 42,
+		Participants: []string{"Anna"},
+		Messages: []UnifiedMessage{
+			{SenderName: "Anna", Text: "ferry at 7?", TimestampMs: 11_500},   // the synced message
+			{SenderName: "Anna", Text: "ferry at 7?", TimestampMs: 15_000},   // too late to be it
+			{SenderName: "Anna", Text: "and back at 9", TimestampMs: 10_000}, // different text
+		},
+	}
+	imported, skipped := processUnifiedExport(zerolog.Nop(), store, export)
+	if imported != 2 || skipped != 1 || syncDuplicates != 1 {
+		t.Errorf("imported %d, skipped %d, sync duplicates %d; want 2, 1, 1", imported, skipped, syncDuplicates)
+	}
+
+	// The skipped copy was never stored, so a re-import skips it again
+	syncDuplicates = 0
+	if imported, _ := processUnifiedExport(zerolog.Nop(), store, export); imported != 0 || syncDuplicates != 1 {
+		t.Errorf("re-import: imported %d, sync duplicates %d; want 0, 1", imported, syncDuplicates)
+	}
+}
+
+func TestDryRunReport(t *testing.T) {
+	store, err := storage.New(":memory:")
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	defer store.Close()
+
+	export := UnifiedExport{
+		Source:       ExportSourceMessenger,
+		ThreadName:   "Trip",
+		Participants: []string{"Anna", "Bartek"},
+		Messages: []UnifiedMessage{
+			{SenderName: "Anna", Text: "ferry at 7?", TimestampMs: 1_000_000},
+			{SenderName: "Bartek", Text: "yes", TimestampMs: 2_000_000},
+		},
+	}
+	if imported, _ := processUnifiedExport(zerolog.Nop(), store, export); imported != 2 {
+		t.Fatalf("first import: %d messages", imported)
+	}
+
+	*dryRun = true
+	defer func() { *dryRun = false }()
+	importReport = newReport("export.zip", true)
+	defer func() { importReport = nil }()
+
+	export.Messages = append(export.Messages,
+		UnifiedMessage{SenderName: "Celina", Text: "can I join?", TimestampMs: 3_000_000},
+		UnifiedMessage{SenderName: "Celina", Text: "can I join?", TimestampMs: 3_000_000},
+		UnifiedMessage{SenderName: "Anna", IsUnsent: true, TimestampMs: 500_000},
+	)
+	imported, skipped := processUnifiedExport(zerolog.Nop(), store, export)
+	if imported != 1 || skipped != 4 {
+		t.Errorf("dry run: %d imported, %d skipped; want 1, 4", imported, skipped)
+	}
+	if stats, _ := store.GetStats(); stats.MessageCount != 2 || stats.ContactCount != 2 {
+		t.Errorf("dry run wrote to the database: %+v", stats)
+	}
+
+	r := importReport
+	r.finish()
+	var out strings.Builder
+	if err := writeReportJSON(&out, r); err != nil {
+		t.Fatalf("writeReportJSON: %v", err)
+	}
+	if len(r.Threads) != 1 {
+		t.Fatalf("threads = %+v", r.Threads)
+	}
+	tr := r.Threads[0]
+	got := [...]int{tr.Messages, tr.New, tr.AlreadyImported, tr.DuplicatesInExport, tr.Skipped}
+	if got != [...]int{5, 1, 2, 1, 1} || tr.NewThread {
+		t.Errorf("thread report = %+v", tr)
+	}
+	if tr.First != "1970-01-01T00:08:20Z" || tr.Last != "1970-01-01T00:50:00Z" {
+		t.Errorf("time range = %s..%s", tr.First, tr.Last)
+	}
+	if !reflect.DeepEqual(tr.Unmatched, []string{"Celina"}) || !reflect.DeepEqual(tr.NewContacts, []string{"Celina"}) {
+		t.Errorf("unmatched %v, new contacts %v", tr.Unmatched, tr.NewContacts)
+	}
+	if len(r.NewContacts) != 1 || r.Totals.New != 1 || r.Totals.NewContacts != 1 {
+		t.Errorf("report = %+v", r)
+	}
+	if !strings.Contains(out.String(), `"unmatched_participants": [`) {
+		t.Errorf("JSON report:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := writeReportCSV(&out, r); err != nil {
+		t.Fatalf("writeReportCSV: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], ",5,1,2,1,0,1,1970-01-01T00:08:20Z,1970-01-01T00:50:00Z,Celina,Celina") {
+		t.Errorf("CSV report:\n%s", out.String())
+	}
+}
+
+func TestImportCheckpoints_ResumeSkipsStoredConversations(t *testing.T) {
+	store, err := storage.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	defer store.Close()
+
+	path := filepath.Join(t.TempDir(), "chat.txt")
+	if err := os.WriteFile(path, []byte("export"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	trip := UnifiedExport{
+		Source:       ExportSourceWhatsApp,
+		ThreadName:   "Trip",
+		ThreadPath:   "Trip.txt",
+		Participants: []string{"Anna", "Bartek"},
+		Messages: []UnifiedMessage{
+			{SenderName: "Anna", Text: "ferry at 7?", TimestampMs: 1000},
+			{SenderName: "Bartek", Text: "yes", TimestampMs: 2000},
+		},
+	}
+	family := trip
+	family.ThreadName, family.ThreadPath = "Family", "Family.txt"
+
+	// The first run stores Trip and is interrupted
+	startCheckpoints(zerolog.Nop(), store, path)
+	if imported, _ := processUnifiedExport(zerolog.Nop(), store, trip); imported != 2 {
+		t.Fatalf("first run: %d imported", imported)
+	}
+
+	startCheckpoints(zerolog.Nop(), store, path)
+	if imported, skipped := processUnifiedExport(zerolog.Nop(), store, trip); imported != 0 || skipped != 0 || resumedConversations != 1 {
+		t.Errorf("resumed Trip: %d imported, %d skipped, %d resumed", imported, skipped, resumedConversations)
+	}
+	if imported, _ := processUnifiedExport(zerolog.Nop(), store, family); imported != 2 {
+		t.Errorf("resumed run: Family %d imported", imported)
+	}
+	finishCheckpoints(zerolog.Nop(), store)
+	if n, _ := store.CountImportCheckpoints(exportImportKey(path)); n != 0 {
+		t.Errorf("%d checkpoints left after the import completed", n)
+	}
+
+	// A completed import is checked again in full
+	startCheckpoints(zerolog.Nop(), store, path)
+	defer finishCheckpoints(zerolog.Nop(), store)
+	if imported, skipped := processUnifiedExport(zerolog.Nop(), store, trip); imported != 0 || skipped != 2 {
+		t.Errorf("re-import: %d imported, %d skipped; want 0, 2", imported, skipped)
+	}
+}
+
+func TestImportConversations_Workers(t *testing.T) {
+	store, err := storage.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	defer store.Close()
+	*workers = 4
+	defer func() { *workers = 1 }()
+
+	base := t.TempDir()
+	inbox := filepath.Join(base, "messages", "inbox")
+	for i := range 10 {
+		dir := filepath.Join(inbox, "friend"+strconv.Itoa(i)+"_"+strconv.Itoa(1000+i))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		data := `{"title": "Friend ` + strconv.Itoa(i) + `", "participants": [{"name": "Anna"}, {"name": "Friend ` + strconv.Itoa(i) + `"}],
+			"messages": [{"sender_name": "Anna", "timestamp_ms": 1000, "content": "hi"}, {"sender_name": "Friend ` + strconv.Itoa(i) + `", "timestamp_ms": 2000, "content": "hello"}]}`
+		if err := os.WriteFile(filepath.Join(dir, "message_1.json"), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A conversation without message files is skipped
+	if err := os.MkdirAll(filepath.Join(inbox, "empty_2000"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, skipped, err := processFacebookExtracted(zerolog.Nop(), store, base)
+	if err != nil || imported != 20 || skipped != 0 {
+		t.Errorf("%d imported, %d skipped; want 20, 0", imported, skipped)
+	}
+	if stats, _ := store.GetStats(); stats.ThreadCount != 10 || stats.MessageCount != 20 || stats.ContactCount != 11 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestMediaDir_CopiesMediaFromAnotherZipPart(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "test.db")
+	store, err := storage.New(dbFile)
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	defer store.Close()
+	*mediaDir = t.TempDir()
+	defer func() { *mediaDir = "" }()
+
+	// Facebook splits large exports: the photo is in the second part
+	conv := "your_facebook_activity/messages/inbox/anna_123/"
+	writeZip := func(path string, files map[string]string) {
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw := zip.NewWriter(f)
+		for name, data := range files {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(data))
+		}
+		zw.Close()
+		f.Close()
+	}
+	dir := t.TempDir()
+	writeZip(filepath.Join(dir, "facebook-1.zip"), map[string]string{
+		conv + "message_1.json": `{"title": "Anna", "participants": [{"name": "Anna"}, {"name": "Me"}], "messages": [
+			{"sender_name": "Anna", "timestamp_ms": 2000, "photos": [{"uri": "` + conv + `photos/beach.jpg"}]},
+			{"sender_name": "Anna", "timestamp_ms": 1000, "photos": [{"uri": "` + conv + `photos/lost.jpg"}]}]}`,
+	})
+	writeZip(filepath.Join(dir, "facebook-2.zip"), map[string]string{
+		conv + "photos/beach.jpg": "jpeg bytes",
+	})
+
+	if imported, _, err := importPath(zerolog.Nop(), store, dir, true); err != nil || imported != 2 {
+		t.Fatalf("imported %d messages (err=%v)", imported, err)
+	}
+	if copiedMedia != 1 || missingMedia != 1 {
+		t.Errorf("copied %d, missing %d; want 1, 1", copiedMedia, missingMedia)
+	}
+	if exportMedia != nil {
+		t.Error("export media left open")
+	}
+
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	local := make(map[string]string)
+	rows, err := db.Query(`SELECT filename, COALESCE(local_path, '') FROM attachments`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name, path string
+		rows.Scan(&name, &path)
+		local[name] = path
+	}
+	rows.Close()
+	if len(local) != 2 || local["lost.jpg"] != "" {
+		t.Errorf("local paths = %v", local)
+	}
+	path, ok := media.Resolve(*mediaDir, local["beach.jpg"])
+	if data, _ := os.ReadFile(path); !ok || string(data) != "jpeg bytes" || filepath.Ext(path) != ".jpg" {
+		t.Errorf("beach.jpg stored at %q (%q)", local["beach.jpg"], data)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-meta/pkg/media"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	// exportMedia finds the files of the current import's attachments for
+	// -media-dir; nil when media isn't copied
+	exportMedia *exportFiles
+	// copiedMedia and missingMedia count the attachments of the current
+	// import copied to -media-dir, and those whose file the export lacks
+	copiedMedia, missingMedia int
+)
+
+// exportFiles finds the file an attachment URI points at: a path relative to
+// the root of the export, in an extracted export directory or in one of the
+// export's ZIPs. Facebook splits large exports over several ZIPs, and a
+// conversation's photos need not be in the ZIP holding its messages.
+type exportFiles struct {
+	dirs   []string
+	zips   map[string]*zip.ReadCloser
+	zipped map[string]*zip.File
+}
+
+func newExportFiles() *exportFiles {
+	return &exportFiles{zips: make(map[string]*zip.ReadCloser), zipped: make(map[string]*zip.File)}
+}
+
+// addDir looks for files under an extracted export
+func (f *exportFiles) addDir(dir string) {
+	if f != nil {
+		f.dirs = append(f.dirs, dir)
+	}
+}
+
+// addZip looks for files in a ZIP, which stays open until close
+func (f *exportFiles) addZip(log zerolog.Logger, zipPath string) {
+	if f == nil || f.zips[zipPath] != nil {
+		return
+	}
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		log.Warn().Err(err).Str("zip", zipPath).Msg("Failed to open ZIP for media")
+		return
+	}
+	f.zips[zipPath] = r
+	for _, file := range r.File {
+		if !file.FileInfo().IsDir() {
+			f.zipped[file.Name] = file
+		}
+	}
+}
+
+func (f *exportFiles) close() {
+	for _, r := range f.zips {
+		r.Close()
+	}
+}
+
+// open opens the file uri points at
+func (f *exportFiles) open(uri string) (io.ReadCloser, error) {
+	if file, ok := f.zipped[strings.TrimPrefix(path.Clean(uri), "/")]; ok {
+		return file.Open()
+	}
+	for _, dir := range f.dirs {
+		if p, ok := media.Resolve(dir, uri); ok {
+			return os.Open(p)
+		}
+	}
+	return nil, fmt.Errorf("%s is not in the export", uri)
+}
+
+// isExportFile reports whether an attachment URI is a file in the export
+// rather than a link or a Signal sticker
+func isExportFile(uri string) bool {
+	return !strings.Contains(uri, ":")
+}
+
+// copyExportMedia copies an attachment's file from the export into the
+// attachment store and records its local path, unless it has one already
+func copyExportMedia(store *storage.Storage, attachmentID string, a UnifiedAttachment, filename string) error {
+	if local, err := store.AttachmentLocalPath(attachmentID); err != nil || local != "" {
+		return err
+	}
+	r, err := exportMedia.open(a.URI)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	relPath, sum, size, err := media.Put(*mediaDir, r, media.Extension(filename, ""))
+	if err != nil {
+		return err
+	}
+	return store.SetAttachmentDownloaded(attachmentID, relPath, sum, size)
+}
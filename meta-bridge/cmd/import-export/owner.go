@@ -0,0 +1,143 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// exportOwner collects owner evidence across all conversations of an
+// import; importPath starts a new one for every export
+var exportOwner = newOwnerDetector()
+
+// ownerDetector infers which participant an export belongs to. The owner is
+// named in autofill_information.json (or a Signal backup's account) when
+// present; otherwise it is the only participant present in every thread.
+type ownerDetector struct {
+	threads      int
+	counts       map[string]int
+	autofillName string
+}
+
+func newOwnerDetector() *ownerDetector {
+	return &ownerDetector{counts: make(map[string]int)}
+}
+
+func (d *ownerDetector) addThread(participants []string) {
+	names := normalizeNames(participants)
+	if len(names) == 0 {
+		return
+	}
+	d.threads++
+	for _, name := range names {
+		d.counts[name]++
+	}
+}
+
+// addAutofill records the FULL_NAME from a Facebook autofill_information.json
+func (d *ownerDetector) addAutofill(data []byte) {
+	var info struct {
+		AutofillInformation struct {
+			FullName []string `json:"FULL_NAME"`
+		} `json:"autofill_information_v2"`
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return
+	}
+	for _, name := range info.AutofillInformation.FullName {
+		if name = strings.TrimSpace(fixFBEncoding(name)); name != "" {
+			d.autofillName = name
+			return
+		}
+	}
+}
+
+// addAccountName records the account name of a Signal backup
+func (d *ownerDetector) addAccountName(name string) {
+	if name = strings.TrimSpace(name); name != "" && d.autofillName == "" {
+		d.autofillName = name
+	}
+}
+
+// owner returns the inferred owner name. Participant intersection needs at
+// least two threads, since both sides of a single 1:1 are in every thread.
+func (d *ownerDetector) owner() (string, bool) {
+	if d.autofillName != "" {
+		return d.autofillName, true
+	}
+	if d.threads < 2 {
+		return "", false
+	}
+	var found string
+	for name, n := range d.counts {
+		if n != d.threads {
+			continue
+		}
+		if found != "" {
+			return "", false
+		}
+		found = name
+	}
+	return found, found != ""
+}
+
+// recordExportOwner stores the export owner as current_user_id. An inferred
+// owner never overrides one set by live sync or a previous import; -owner does.
+func recordExportOwner(log zerolog.Logger, store *storage.Storage) {
+	name := strings.TrimSpace(*ownerName)
+	if name == "" {
+		existing, err := store.GetSyncMetadata("current_user_id")
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to read current user")
+			return
+		}
+		if existing != "" {
+			log.Debug().Str("current_user_id", existing).Msg("Current user already set, keeping it")
+			return
+		}
+		var ok bool
+		if name, ok = exportOwner.owner(); !ok {
+			log.Warn().Msg("Could not determine export owner, current_user_id not set (use -owner)")
+			return
+		}
+	}
+
+	contactID := resolveContactID(store, name)
+	log.Info().Str("name", name).Int64("contact_id", contactID).Msg("Export owner")
+	if *dryRun {
+		return
+	}
+	if err := store.EnsureContactExistsWithName(contactID, name); err != nil {
+		log.Warn().Err(err).Str("name", name).Msg("Failed to ensure owner contact exists")
+		return
+	}
+	if err := store.SetSyncMetadata("current_user_id", strconv.FormatInt(contactID, 10)); err != nil {
+		log.Warn().Err(err).Msg("Failed to store current user")
+		return
+	}
+	if err := store.SetSyncMetadata("current_user_name", name); err != nil {
+		log.Warn().Err(err).Msg("Failed to store current user name")
+	}
+}
+
+func readAutofillFromZip(log zerolog.Logger, file *zip.File) {
+	rc, err := file.Open()
+	if err != nil {
+		log.Warn().Err(err).Str("file", file.Name).Msg("Failed to open file in ZIP")
+		return
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		log.Warn().Err(err).Str("file", file.Name).Msg("Failed to read file")
+		return
+	}
+	exportOwner.addAutofill(data)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// importReport collects what the current import does, or with -dry-run
+// would do, for -report; nil when no report was asked for
+var importReport *report
+
+// report is the -report file: per-thread counts plus the contacts the import
+// creates
+type report struct {
+	Input       string          `json:"input"`
+	DryRun      bool            `json:"dry_run"`
+	Totals      reportTotals    `json:"totals"`
+	Threads     []*threadReport `json:"threads"`
+	NewContacts []reportContact `json:"new_contacts"`
+
+	threads  map[int64]*threadReport
+	contacts map[int64]bool
+}
+
+type reportTotals struct {
+	Threads            int `json:"threads"`
+	NewThreads         int `json:"new_threads"`
+	Messages           int `json:"messages"`
+	New                int `json:"new"`
+	AlreadyImported    int `json:"already_imported"`
+	DuplicatesInExport int `json:"duplicates_in_export"`
+	SyncDuplicates     int `json:"sync_duplicates"`
+	Skipped            int `json:"skipped"`
+	NewContacts        int `json:"new_contacts"`
+}
+
+type reportContact struct {
+	ID   int64  `json:"id,string"`
+	Name string `json:"name"`
+}
+
+// threadReport covers one thread. A thread split over several export files
+// (Facebook's message_1.json, message_2.json, ...) is reported once.
+type threadReport struct {
+	ThreadID  int64        `json:"thread_id,string"`
+	Name      string       `json:"name"`
+	Source    ExportSource `json:"source"`
+	NewThread bool         `json:"new_thread"`
+	// Messages counts every message of the export, New the ones imported;
+	// AlreadyImported are in the database already, DuplicatesInExport occur
+	// twice in the export, SyncDuplicates were skipped by -dedup-sync and
+	// Skipped are unsent, empty, unattributed or failed to insert
+	Messages           int    `json:"messages"`
+	New                int    `json:"new"`
+	AlreadyImported    int    `json:"already_imported"`
+	DuplicatesInExport int    `json:"duplicates_in_export"`
+	SyncDuplicates     int    `json:"sync_duplicates"`
+	Skipped            int    `json:"skipped"`
+	FirstMs            int64  `json:"first_ms,omitempty"`
+	LastMs             int64  `json:"last_ms,omitempty"`
+	First              string `json:"first,omitempty"`
+	Last               string `json:"last,omitempty"`
+	// NewContacts are participants without a contact yet; Unmatched are
+	// senders missing from the export's participant list
+	NewContacts []string `json:"new_contacts,omitempty"`
+	Unmatched   []string `json:"unmatched_participants,omitempty"`
+
+	report *report
+	seen   map[string]bool
+}
+
+func newReport(input string, dryRun bool) *report {
+	return &report{
+		Input:    input,
+		DryRun:   dryRun,
+		threads:  make(map[int64]*threadReport),
+		contacts: make(map[int64]bool),
+	}
+}
+
+// thread starts (or continues) the report of a conversation; it must be
+// called before the import creates the thread. The returned report, like
+// r, may be nil.
+func (r *report) thread(store *storage.Storage, threadID int64, name string, export UnifiedExport) *threadReport {
+	if r == nil {
+		return nil
+	}
+	t, ok := r.threads[threadID]
+	if !ok {
+		exists, _ := store.HasThread(threadID)
+		t = &threadReport{
+			ThreadID:  threadID,
+			Name:      name,
+			Source:    export.Source,
+			NewThread: !exists,
+			report:    r,
+			seen:      make(map[string]bool),
+		}
+		r.threads[threadID] = t
+		r.Threads = append(r.Threads, t)
+	}
+	t.Messages += len(export.Messages)
+	for _, msg := range export.Messages {
+		t.span(msg.TimestampMs)
+	}
+	return t
+}
+
+func (t *threadReport) span(ts int64) {
+	if ts <= 0 {
+		return
+	}
+	if t.FirstMs == 0 || ts < t.FirstMs {
+		t.FirstMs = ts
+	}
+	if ts > t.LastMs {
+		t.LastMs = ts
+	}
+}
+
+// contact records a participant the import is about to create, if it does
+// not exist yet; call it before the contact is created
+func (t *threadReport) contact(store *storage.Storage, id int64, name string) {
+	if t == nil {
+		return
+	}
+	if exists, _ := store.HasContact(id); exists {
+		return
+	}
+	t.NewContacts = appendUnique(t.NewContacts, name)
+	if !t.report.contacts[id] {
+		t.report.contacts[id] = true
+		t.report.NewContacts = append(t.report.NewContacts, reportContact{ID: id, Name: name})
+	}
+}
+
+// unmatched records a sender missing from the participant list
+func (t *threadReport) unmatched(store *storage.Storage, id int64, name string) {
+	if t == nil {
+		return
+	}
+	t.Unmatched = appendUnique(t.Unmatched, name)
+	t.contact(store, id, name)
+}
+
+// message records the outcome of a message: isNew when it was (or would
+// be) inserted
+func (t *threadReport) message(id string, isNew bool) {
+	if t == nil {
+		return
+	}
+	switch {
+	case t.seen[id]:
+		t.DuplicatesInExport++
+	case isNew:
+		t.New++
+	default:
+		t.AlreadyImported++
+	}
+	t.seen[id] = true
+}
+
+func (t *threadReport) syncDuplicate() {
+	if t != nil {
+		t.SyncDuplicates++
+	}
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// finish fills in the derived fields: skipped counts, readable timestamps and
+// totals
+func (r *report) finish() {
+	r.Totals = reportTotals{Threads: len(r.Threads), NewContacts: len(r.NewContacts)}
+	for _, t := range r.Threads {
+		t.Skipped = t.Messages - t.New - t.AlreadyImported - t.DuplicatesInExport - t.SyncDuplicates
+		if t.FirstMs > 0 {
+			t.First = time.UnixMilli(t.FirstMs).UTC().Format(time.RFC3339)
+			t.Last = time.UnixMilli(t.LastMs).UTC().Format(time.RFC3339)
+		}
+		if t.NewThread {
+			r.Totals.NewThreads++
+		}
+		r.Totals.Messages += t.Messages
+		r.Totals.New += t.New
+		r.Totals.AlreadyImported += t.AlreadyImported
+		r.Totals.DuplicatesInExport += t.DuplicatesInExport
+		r.Totals.SyncDuplicates += t.SyncDuplicates
+		r.Totals.Skipped += t.Skipped
+	}
+	sort.SliceStable(r.Threads, func(i, j int) bool {
+		return r.Threads[i].Messages > r.Threads[j].Messages
+	})
+}
+
+// writeReport writes r to path: CSV with a row per thread when path ends in
+// .csv, JSON otherwise; - writes JSON to stdout
+func writeReport(path string, r *report) error {
+	r.finish()
+	if path == "-" {
+		return writeReportJSON(os.Stdout, r)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		err = writeReportCSV(f, r)
+	} else {
+		err = writeReportJSON(f, r)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func writeReportJSON(w io.Writer, r *report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+var reportCSVHeader = []string{
+	"thread_id", "name", "source", "new_thread", "messages", "new", "already_imported",
+	"duplicates_in_export", "sync_duplicates", "skipped", "first", "last",
+	"new_contacts", "unmatched_participants",
+}
+
+func writeReportCSV(w io.Writer, r *report) error {
+	cw := csv.NewWriter(w)
+	cw.Write(reportCSVHeader)
+	for _, t := range r.Threads {
+		cw.Write([]string{
+			strconv.FormatInt(t.ThreadID, 10),
+			t.Name,
+			string(t.Source),
+			strconv.FormatBool(t.NewThread),
+			strconv.Itoa(t.Messages),
+			strconv.Itoa(t.New),
+			strconv.Itoa(t.AlreadyImported),
+			strconv.Itoa(t.DuplicatesInExport),
+			strconv.Itoa(t.SyncDuplicates),
+			strconv.Itoa(t.Skipped),
+			t.First,
+			t.Last,
+			strings.Join(t.NewContacts, "; "),
+			strings.Join(t.Unmatched, "; "),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	metatable "go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// ============================================================================
+// Signal Backup Format (plaintext backup, main.jsonl)
+// ============================================================================
+
+// Signal's plaintext backups write the frames of its backup format
+// (backup.proto) as JSON, one per line: the account, then recipients
+// (contacts, groups, the account itself), chats pointing at a recipient, and
+// the chat items of all chats. IDs are only meaningful within one backup, and
+// proto3 JSON writes 64-bit numbers as strings and bytes as base64.
+
+// signalBackupName is the frames file of a plaintext backup
+const signalBackupName = "main.jsonl"
+
+// signalNoteToSelf names the chat with the account itself
+const signalNoteToSelf = "Note to Self"
+
+// signalInt is a backup ID or timestamp, written as a string or a number
+type signalInt int64
+
+func (n *signalInt) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*n = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", data)
+	}
+	*n = signalInt(v)
+	return nil
+}
+
+type signalFrame struct {
+	Account   *signalAccount   `json:"account"`
+	Recipient *signalRecipient `json:"recipient"`
+	Chat      *signalChat      `json:"chat"`
+	ChatItem  *signalChatItem  `json:"chatItem"`
+}
+
+type signalAccount struct {
+	GivenName  string `json:"givenName"`
+	FamilyName string `json:"familyName"`
+	Username   string `json:"username"`
+}
+
+type signalRecipient struct {
+	ID      signalInt      `json:"id"`
+	Contact *signalContact `json:"contact"`
+	Group   *signalGroup   `json:"group"`
+	Self    *struct{}      `json:"self"`
+}
+
+type signalContact struct {
+	ACI               string    `json:"aci"`
+	E164              signalInt `json:"e164"`
+	Username          string    `json:"username"`
+	ProfileGivenName  string    `json:"profileGivenName"`
+	ProfileFamilyName string    `json:"profileFamilyName"`
+	SystemGivenName   string    `json:"systemGivenName"`
+	SystemFamilyName  string    `json:"systemFamilyName"`
+	SystemNickname    string    `json:"systemNickname"`
+	Nickname          *struct {
+		Given  string `json:"given"`
+		Family string `json:"family"`
+	} `json:"nickname"`
+}
+
+type signalGroup struct {
+	MasterKey string `json:"masterKey"`
+	Snapshot  *struct {
+		Title *struct {
+			Title string `json:"title"`
+		} `json:"title"`
+		Members []struct {
+			UserID string `json:"userId"`
+		} `json:"members"`
+	} `json:"snapshot"`
+}
+
+type signalChat struct {
+	ID          signalInt `json:"id"`
+	RecipientID signalInt `json:"recipientId"`
+}
+
+type signalChatItem struct {
+	ChatID   signalInt `json:"chatId"`
+	AuthorID signalInt `json:"authorId"`
+	DateSent signalInt `json:"dateSent"`
+
+	StandardMessage *struct {
+		Text *struct {
+			Body string `json:"body"`
+		} `json:"text"`
+		Attachments []signalAttachment `json:"attachments"`
+		Reactions   []signalReaction   `json:"reactions"`
+	} `json:"standardMessage"`
+	StickerMessage *struct {
+		Sticker struct {
+			PackID    string    `json:"packId"`
+			StickerID signalInt `json:"stickerId"`
+			Emoji     string    `json:"emoji"`
+		} `json:"sticker"`
+		Reactions []signalReaction `json:"reactions"`
+	} `json:"stickerMessage"`
+	RemoteDeletedMessage *struct{} `json:"remoteDeletedMessage"`
+}
+
+type signalAttachment struct {
+	Pointer struct {
+		ContentType string `json:"contentType"`
+		FileName    string `json:"fileName"`
+	} `json:"pointer"`
+	// Flag is the attachment's role, by enum name or number
+	Flag json.RawMessage `json:"flag"`
+}
+
+type signalReaction struct {
+	Emoji         string    `json:"emoji"`
+	AuthorID      signalInt `json:"authorId"`
+	SentTimestamp signalInt `json:"sentTimestamp"`
+}
+
+// signalContactName picks how a contact is shown: the nickname given in
+// Signal, the address book name, the profile name, the username, then the
+// phone number
+func signalContactName(c *signalContact) string {
+	join := func(given, family string) string {
+		return strings.TrimSpace(strings.TrimSpace(given) + " " + strings.TrimSpace(family))
+	}
+	if c.Nickname != nil {
+		if name := join(c.Nickname.Given, c.Nickname.Family); name != "" {
+			return name
+		}
+	}
+	for _, name := range []string{
+		strings.TrimSpace(c.SystemNickname),
+		join(c.SystemGivenName, c.SystemFamilyName),
+		join(c.ProfileGivenName, c.ProfileFamilyName),
+		strings.TrimSpace(c.Username),
+		signalPhone(c),
+	} {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// signalPhone returns a contact's number in E.164 form, or ""
+func signalPhone(c *signalContact) string {
+	if c.E164 <= 0 {
+		return ""
+	}
+	return "+" + strconv.FormatInt(int64(c.E164), 10)
+}
+
+// signalAttachmentType maps an attachment's content type and flag
+func signalAttachmentType(a signalAttachment) metatable.AttachmentType {
+	switch strings.Trim(string(a.Flag), `"`) {
+	case "VOICE_MESSAGE", "1":
+		return metatable.AttachmentTypeAudio
+	case "GIF", "3":
+		return metatable.AttachmentTypeAnimatedImage
+	}
+	contentType := strings.ToLower(a.Pointer.ContentType)
+	switch {
+	case contentType == "image/gif":
+		return metatable.AttachmentTypeAnimatedImage
+	case strings.HasPrefix(contentType, "image/"):
+		return metatable.AttachmentTypeImage
+	case strings.HasPrefix(contentType, "video/"):
+		return metatable.AttachmentTypeVideo
+	case strings.HasPrefix(contentType, "audio/"):
+		return metatable.AttachmentTypeAudio
+	default:
+		return metatable.AttachmentTypeFile
+	}
+}
+
+// signalBackup is a parsed plaintext backup
+type signalBackup struct {
+	selfName   string
+	recipients map[signalInt]*signalRecipient
+	chats      []signalChat
+	items      map[signalInt][]*signalChatItem // By chat ID, in backup order
+}
+
+// parseSignalBackup reads the frames of a plaintext backup. Frames of kinds
+// the importer has no use for (sticker packs, calls, settings) are skipped.
+func parseSignalBackup(r io.Reader) (*signalBackup, error) {
+	b := &signalBackup{
+		recipients: make(map[signalInt]*signalRecipient),
+		items:      make(map[signalInt][]*signalChatItem),
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if data == "" {
+			continue
+		}
+		var frame signalFrame
+		if err := json.Unmarshal([]byte(data), &frame); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		switch {
+		case frame.Account != nil:
+			b.selfName = strings.TrimSpace(strings.TrimSpace(frame.Account.GivenName) + " " + strings.TrimSpace(frame.Account.FamilyName))
+			if b.selfName == "" {
+				b.selfName = strings.TrimSpace(frame.Account.Username)
+			}
+		case frame.Recipient != nil:
+			b.recipients[frame.Recipient.ID] = frame.Recipient
+		case frame.Chat != nil:
+			b.chats = append(b.chats, *frame.Chat)
+		case frame.ChatItem != nil:
+			b.items[frame.ChatItem.ChatID] = append(b.items[frame.ChatItem.ChatID], frame.ChatItem)
+		}
+	}
+	return b, scanner.Err()
+}
+
+// name returns the display name of a recipient, and its phone number
+func (b *signalBackup) name(id signalInt) (name, phone string) {
+	r := b.recipients[id]
+	switch {
+	case r == nil:
+		return "", ""
+	case r.Self != nil:
+		return b.selfName, ""
+	case r.Contact != nil:
+		return signalContactName(r.Contact), signalPhone(r.Contact)
+	}
+	return "", ""
+}
+
+// exports converts the backup's chats with contacts, groups and the account
+// itself to UnifiedExports. Thread IDs come from the ACI, number or group
+// key, which stay the same across backups. The account is named after -owner,
+// or "Me", when the backup has no account name.
+func (b *signalBackup) exports() []UnifiedExport {
+	if b.selfName == "" {
+		b.selfName = strings.TrimSpace(*ownerName)
+	}
+	if b.selfName == "" {
+		b.selfName = "Me"
+	}
+	byACI := make(map[string]signalInt)
+	for id, r := range b.recipients {
+		if r.Contact != nil && r.Contact.ACI != "" {
+			byACI[r.Contact.ACI] = id
+		}
+	}
+
+	var out []UnifiedExport
+	for _, chat := range b.chats {
+		r := b.recipients[chat.RecipientID]
+		if r == nil {
+			continue
+		}
+		export := UnifiedExport{Source: ExportSourceSignal, Phones: make(map[string]string)}
+		addParticipant := func(id signalInt) string {
+			name, phone := b.name(id)
+			if name == "" {
+				return ""
+			}
+			if !slices.Contains(export.Participants, name) {
+				export.Participants = append(export.Participants, name)
+			}
+			if phone != "" {
+				export.Phones[name] = phone
+			}
+			return name
+		}
+
+		var key string
+		addParticipant(chat.RecipientID)
+		switch {
+		case r.Self != nil:
+			export.ThreadName, key = signalNoteToSelf, "self"
+		case r.Contact != nil:
+			export.ThreadName = signalContactName(r.Contact)
+			key = cmp.Or(r.Contact.ACI, signalPhone(r.Contact), export.ThreadName)
+			addParticipant(b.selfID())
+		case r.Group != nil:
+			if s := r.Group.Snapshot; s != nil {
+				if s.Title != nil {
+					export.ThreadName = strings.TrimSpace(s.Title.Title)
+				}
+				for _, m := range s.Members {
+					if id, ok := byACI[m.UserID]; ok {
+						addParticipant(id)
+					}
+				}
+			}
+			key = "group:" + cmp.Or(r.Group.MasterKey, export.ThreadName)
+			addParticipant(b.selfID())
+		default:
+			// Distribution lists, call links, release notes
+			continue
+		}
+		if key == "" || key == "group:" {
+			continue
+		}
+		export.ThreadPath = key
+		export.ThreadIDHint = generateThreadID("signal:" + key)
+
+		for _, item := range b.items[chat.ID] {
+			sender := addParticipant(item.AuthorID)
+			if sender == "" {
+				continue
+			}
+			msg := UnifiedMessage{SenderName: sender, TimestampMs: int64(item.DateSent)}
+			var reactions []signalReaction
+			switch {
+			case item.StandardMessage != nil:
+				msg.SourceType = "standard"
+				if item.StandardMessage.Text != nil {
+					msg.Text = strings.TrimSpace(item.StandardMessage.Text.Body)
+				}
+				for i, a := range item.StandardMessage.Attachments {
+					name := a.Pointer.FileName
+					if name == "" {
+						// Unnamed media (photos, voice notes): unique within the message
+						name = fmt.Sprintf("attachment-%d", i+1)
+					}
+					msg.Attachments = append(msg.Attachments, UnifiedAttachment{Type: signalAttachmentType(a), URI: name, Filename: filepath.Base(name)})
+				}
+				reactions = item.StandardMessage.Reactions
+			case item.StickerMessage != nil:
+				msg.SourceType = "sticker"
+				s := item.StickerMessage.Sticker
+				uri := fmt.Sprintf("signal-sticker:%s/%d", s.PackID, s.StickerID)
+				msg.Attachments = []UnifiedAttachment{{Type: metatable.AttachmentTypeSticker, URI: uri, Filename: s.Emoji}}
+				reactions = item.StickerMessage.Reactions
+			case item.RemoteDeletedMessage != nil:
+				msg.SourceType = "deleted"
+				msg.IsUnsent = true
+			default:
+				// Group and chat updates, calls, payments
+				continue
+			}
+			for _, rc := range reactions {
+				if actor := addParticipant(rc.AuthorID); actor != "" && rc.Emoji != "" {
+					msg.Reactions = append(msg.Reactions, UnifiedReaction{ActorName: actor, Reaction: rc.Emoji, TimestampMs: int64(rc.SentTimestamp)})
+				}
+			}
+			export.Messages = append(export.Messages, msg)
+		}
+
+		if export.ThreadName == "" {
+			export.ThreadName = strings.Join(normalizeNames(export.Participants), ", ")
+		}
+		if len(export.Messages) > 0 {
+			out = append(out, export)
+		}
+	}
+	return out
+}
+
+// selfID returns the recipient ID of the account itself, or 0
+func (b *signalBackup) selfID() signalInt {
+	for id, r := range b.recipients {
+		if r.Self != nil {
+			return id
+		}
+	}
+	return 0
+}
+
+// isSignalBackupDir checks for the frames file of an extracted plaintext backup
+func isSignalBackupDir(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, signalBackupName))
+	return err == nil && !info.IsDir()
+}
+
+// isSignalBackupZip checks for the frames file of a zipped plaintext backup
+func isSignalBackupZip(zipPath string) bool {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if filepath.Base(f.Name) == signalBackupName {
+			return true
+		}
+	}
+	return false
+}
+
+func processSignalFile(log zerolog.Logger, store *storage.Storage, path string) (imported, skipped int, err error) {
+	log.Info().Str("path", path).Msg("Processing Signal backup")
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	return importSignalBackup(log, store, path, f)
+}
+
+func processSignalZip(log zerolog.Logger, store *storage.Storage, zipPath string) (imported, skipped int, err error) {
+	log.Info().Str("zip", filepath.Base(zipPath)).Msg("Processing Signal backup ZIP")
+
+	zipReader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("opening %s: %w", filepath.Base(zipPath), err)
+	}
+	defer zipReader.Close()
+
+	for _, file := range zipReader.File {
+		if filepath.Base(file.Name) != signalBackupName {
+			continue
+		}
+		rc, openErr := file.Open()
+		if openErr != nil {
+			err = errors.Join(err, fmt.Errorf("opening %s: %w", file.Name, openErr))
+			continue
+		}
+		imp, skip, backupErr := importSignalBackup(log, store, file.Name, rc)
+		rc.Close()
+		imported += imp
+		skipped += skip
+		err = errors.Join(err, backupErr)
+	}
+	return
+}
+
+// importSignalBackup imports one main.jsonl. A backup that can't be parsed,
+// e.g. a truncated one, is an error.
+func importSignalBackup(log zerolog.Logger, store *storage.Storage, name string, r io.Reader) (imported, skipped int, err error) {
+	backup, err := parseSignalBackup(r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	exportOwner.addAccountName(backup.selfName)
+	exports := backup.exports()
+
+	importProgress.AddTotal(int64(len(exports)))
+	for _, export := range exports {
+		importProgress.Add(1)
+		imp, skip := processUnifiedExport(log, store, export)
+		imported += imp
+		skipped += skip
+	}
+	return imported, skipped, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// threadMerge merges the threads in from into into
+type threadMerge struct {
+	into int64
+	from []int64
+}
+
+// runMapThreads merges duplicate threads, as listed in a CSV file of
+// from,into thread IDs or, with source "-", picked interactively from the
+// threads sharing a display name. Merged IDs become aliases, so later imports
+// of the same export go into the thread they were merged into.
+func runMapThreads(log zerolog.Logger, store *storage.Storage, source string) (merged int) {
+	var merges []threadMerge
+	var err error
+	if source == "-" {
+		merges, err = promptThreadMerges(store, os.Stdin, os.Stdout)
+	} else {
+		var f *os.File
+		if f, err = os.Open(source); err == nil {
+			merges, err = readThreadMap(f)
+			f.Close()
+		}
+	}
+	if err != nil {
+		log.Fatal().Err(err).Str("map", source).Msg("Failed to read thread mapping")
+	}
+
+	for _, m := range merges {
+		if *dryRun {
+			fmt.Printf("Would merge %v into %d\n", m.from, m.into)
+			continue
+		}
+		if err := store.MergeThreads(m.into, m.from...); err != nil {
+			log.Fatal().Err(err).Int64("into", m.into).Ints64("from", m.from).Msg("Failed to merge threads")
+		}
+		fmt.Printf("Merged %v into %d\n", m.from, m.into)
+		merged += len(m.from)
+	}
+	return merged
+}
+
+// readThreadMap reads from,into thread ID pairs, one per line. Blank lines,
+// # comments and a header line are skipped. Pairs with the same into are
+// merged together, in the order the file first names into.
+func readThreadMap(r io.Reader) ([]threadMerge, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	var merges []threadMerge
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return merges, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(record) != 2 {
+			return nil, fmt.Errorf("line %d: expected from,into thread IDs, got %d fields", line, len(record))
+		}
+		from, err1 := strconv.ParseInt(strings.TrimSpace(record[0]), 10, 64)
+		into, err2 := strconv.ParseInt(strings.TrimSpace(record[1]), 10, 64)
+		if err1 != nil || err2 != nil {
+			if line == 1 {
+				continue // Header
+			}
+			return nil, fmt.Errorf("line %d: expected from,into thread IDs, got %q", line, strings.Join(record, ","))
+		}
+		i := slices.IndexFunc(merges, func(m threadMerge) bool { return m.into == into })
+		if i == -1 {
+			merges = append(merges, threadMerge{into: into})
+			i = len(merges) - 1
+		}
+		merges[i].from = append(merges[i].from, from)
+	}
+}
+
+// errQuit ends the interactive mapping, keeping the merges confirmed so far
+var errQuit = errors.New("quit")
+
+// promptThreadMerges offers every group of threads sharing a display name,
+// proposing to merge them into the one live sync uses
+func promptThreadMerges(store *storage.Storage, in io.Reader, out io.Writer) ([]threadMerge, error) {
+	groups, err := store.ListDuplicateThreads()
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		fmt.Fprintln(out, "No threads share a name")
+		return nil, nil
+	}
+
+	scanner := bufio.NewScanner(in)
+	var merges []threadMerge
+	for i, group := range groups {
+		m, err := promptThreadGroup(scanner, out, group, i+1, len(groups))
+		if errors.Is(err, errQuit) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			merges = append(merges, *m)
+		}
+	}
+	return merges, nil
+}
+
+func promptThreadGroup(scanner *bufio.Scanner, out io.Writer, group []storage.DuplicateThread, n, total int) (*threadMerge, error) {
+	fmt.Fprintf(out, "\n[%d/%d] %s\n", n, total, group[0].Name)
+	fmt.Fprintf(out, "  %-20s %8s %8s\n", "THREAD", "SYNCED", "EXPORTED")
+	for _, t := range group {
+		fmt.Fprintf(out, "  %-20d %8d %8d\n", t.ID, t.SyncMessages, t.ExportMessages)
+	}
+
+	for {
+		fmt.Fprintf(out, "Merge into %d? [Y/n/q, or the thread ID to merge into] ", group[0].ID)
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errQuit
+		}
+
+		into := group[0].ID
+		switch answer := strings.ToLower(strings.TrimSpace(scanner.Text())); answer {
+		case "", "y", "yes":
+		case "n", "no":
+			return nil, nil
+		case "q", "quit":
+			return nil, errQuit
+		default:
+			id, err := strconv.ParseInt(answer, 10, 64)
+			if err != nil || !slices.ContainsFunc(group, func(t storage.DuplicateThread) bool { return t.ID == id }) {
+				fmt.Fprintln(out, "  Not one of the threads above")
+				continue
+			}
+			into = id
+		}
+
+		m := &threadMerge{into: into}
+		for _, t := range group {
+			if t.ID != into {
+				m.from = append(m.from, t.ID)
+			}
+		}
+		return m, nil
+	}
+}
+
+// resolveThreadID returns the thread a previously imported thread ID was
+// merged into, or id itself
+func resolveThreadID(store *storage.Storage, id int64) int64 {
+	if into, err := store.ResolveThreadAlias(id); err == nil {
+		return into
+	}
+	return id
+}
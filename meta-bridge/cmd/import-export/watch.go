@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// watchImportKeyPrefix marks fully imported ZIPs in sync_metadata, keyed by content hash
+const watchImportKeyPrefix = "import_export:zip:"
+
+// watchFile is the last observed state of a ZIP in the watch directory
+type watchFile struct {
+	size    int64
+	modTime time.Time
+	// done is set once the file was imported (or found already imported)
+	done bool
+}
+
+// watcher tracks ZIPs in a directory until they stop growing
+type watcher struct {
+	dir   string
+	files map[string]*watchFile
+}
+
+func newWatcher(dir string) *watcher {
+	return &watcher{dir: dir, files: make(map[string]*watchFile)}
+}
+
+// scan returns ZIPs whose size and mtime didn't change since the previous scan.
+// Files still being downloaded or copied are picked up on a later scan.
+func (w *watcher) scan() ([]string, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(entries))
+	var ready []string
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(strings.ToLower(e.Name()), ".zip") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // Removed between ReadDir and Info
+		}
+
+		path := filepath.Join(w.dir, e.Name())
+		seen[path] = true
+
+		prev, ok := w.files[path]
+		if !ok || prev.size != info.Size() || !prev.modTime.Equal(info.ModTime()) {
+			w.files[path] = &watchFile{size: info.Size(), modTime: info.ModTime()}
+			continue
+		}
+		if !prev.done {
+			ready = append(ready, path)
+		}
+	}
+
+	for path := range w.files {
+		if !seen[path] {
+			delete(w.files, path)
+		}
+	}
+
+	sort.Strings(ready)
+	return ready, nil
+}
+
+func (w *watcher) markDone(path string) {
+	if f, ok := w.files[path]; ok {
+		f.done = true
+	}
+}
+
+// runWatch polls dir for export ZIPs and imports each new one once.
+// A ZIP is recorded as imported only after it completes, so an interrupted
+// import is retried on the next run; message IDs make the retry idempotent.
+func runWatch(log zerolog.Logger, store *storage.Storage, dir string, interval time.Duration, onImport string) {
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	log.Info().
+		Str("dir", dir).
+		Dur("interval", interval).
+		Bool("on_import", onImport != "").
+		Msg("Watching for export ZIPs")
+
+	w := newWatcher(dir)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ready, err := w.scan()
+		if err != nil {
+			log.Warn().Err(err).Str("dir", dir).Msg("Failed to scan watch directory")
+		}
+
+		newMessages := 0
+		for _, path := range ready {
+			select {
+			case <-sigCh:
+				log.Info().Msg("Stopping watch")
+				return
+			default:
+			}
+
+			imported, err := importWatchedZip(log, store, path)
+			if err != nil {
+				log.Error().Err(err).Str("path", path).Msg("Failed to import watched ZIP")
+				continue
+			}
+			w.markDone(path)
+			newMessages += imported
+		}
+
+		if newMessages > 0 && onImport != "" {
+			runOnImport(log, onImport)
+		}
+
+		select {
+		case <-sigCh:
+			log.Info().Msg("Stopping watch")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// importWatchedZip imports a ZIP unless its content was already imported.
+// Returns the number of newly imported messages. A ZIP that can't be read,
+// e.g. one still being copied, is only recorded once an import succeeds.
+func importWatchedZip(log zerolog.Logger, store *storage.Storage, path string) (int, error) {
+	hash, err := fileSHA256(path)
+	if err != nil {
+		return 0, fmt.Errorf("hashing: %w", err)
+	}
+	key := watchImportKeyPrefix + hash
+
+	prev, err := store.GetSyncMetadata(key)
+	if err != nil {
+		return 0, err
+	}
+	if prev != "" {
+		log.Debug().Str("path", path).Str("imported_at", prev).Msg("ZIP already imported, skipping")
+		return 0, nil
+	}
+
+	start := time.Now()
+	imported, skipped, err := importPath(log, store, path, false)
+	if err != nil {
+		// Not recorded, so the next scan retries it
+		return 0, fmt.Errorf("importing: %w", err)
+	}
+	done := log.Info().
+		Str("path", path).
+		Int("imported", imported).
+		Int("skipped", skipped)
+	if *dedupSync {
+		done = done.Int("sync_duplicates", syncDuplicates)
+	}
+	done.Dur("took", time.Since(start)).Msg("Watched ZIP imported")
+
+	if *dryRun {
+		return 0, nil
+	}
+	if err := store.SetSyncMetadata(key, time.Now().Format(time.RFC3339)); err != nil {
+		return imported, fmt.Errorf("recording import: %w", err)
+	}
+	return imported, nil
+}
+
+// runOnImport runs the post-import shell command (e.g. chunking and indexing)
+func runOnImport(log zerolog.Logger, command string) {
+	log.Info().Str("command", command).Msg("Running post-import command")
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		log.Error().Err(err).Str("command", command).Msg("Post-import command failed")
+		return
+	}
+	log.Info().Dur("took", time.Since(start)).Msg("Post-import command finished")
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
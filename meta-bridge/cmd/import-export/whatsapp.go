@@ -0,0 +1,402 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	metatable "go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// ============================================================================
+// WhatsApp Export Format (from a chat's "Export chat" in the WhatsApp app)
+// ============================================================================
+
+// WhatsApp exports are plain text, one conversation per file, in the phone's
+// locale: "[31.12.2022, 22:15:42] Anna: text" on iOS, "31/12/2022, 22:15 -
+// Anna: text" on Android. Lines without a timestamp continue the previous
+// message. With media included, the .txt (_chat.txt on iOS) comes zipped
+// together with the files it names.
+
+// Date orders of -whatsapp-dates
+const (
+	waDatesAuto = "auto"
+	waDatesDMY  = "dmy"
+	waDatesMDY  = "mdy"
+	waDatesYMD  = "ymd"
+)
+
+var (
+	// waLineRe matches the start of a message, in the iOS (bracketed) or
+	// Android (dash) layout: date, time, optional AM/PM, the rest
+	waLineRe = regexp.MustCompile(`^(?:\[(\d{1,4}[./-]\d{1,2}[./-]\d{1,4}),? (\d{1,2}[:.]\d{2}(?:[:.]\d{2})?)(?: ?([AaPp]\.? ?[Mm]\.?))?\] |` +
+		`(\d{1,4}[./-]\d{1,2}[./-]\d{1,4}),? (\d{1,2}[:.]\d{2}(?:[:.]\d{2})?)(?: ?([AaPp]\.? ?[Mm]\.?))? - )(.*)$`)
+	waDateSepRe = regexp.MustCompile(`[./-]`)
+
+	// waAttachedRe finds media included in the export: "<attached: 00000012-PHOTO-2022-12-31-22-15-42.jpg>"
+	// on iOS, "IMG-20221231-WA0001.jpg (file attached)" on Android
+	waAttachedRe = regexp.MustCompile(`<attached: ([^>]+)>|(\S+\.\w{2,5}) \(file attached\)`)
+)
+
+// waOmitted are the placeholders of media left out of the export
+var waOmitted = map[string]bool{
+	"<media omitted>": true, "image omitted": true, "video omitted": true, "audio omitted": true,
+	"sticker omitted": true, "gif omitted": true, "document omitted": true, "contact card omitted": true,
+}
+
+// waDeleted are the texts of deleted messages
+var waDeleted = map[string]bool{
+	"this message was deleted": true, "you deleted this message": true,
+	"this message was deleted.": true, "you deleted this message.": true,
+}
+
+// waEditedSuffix marks edited messages on Android
+const waEditedSuffix = "<This message was edited>"
+
+// waMessage is a message as written in the export, before its date is read
+type waMessage struct {
+	date, clock, ampm string
+	sender            string
+	text              string
+	system            bool // No sender, or a notice like "Messages are end-to-end encrypted"
+}
+
+var (
+	// waSpaces are the no-break spaces some locales put in times and numbers
+	waSpaces = strings.NewReplacer("\u00a0", " ", "\u202f", " ")
+	// waMarks are the direction marks WhatsApp puts around names and notices
+	waMarks = strings.NewReplacer("\u200e", "", "\u200f", "", "\u202a", "", "\u202c", "")
+)
+
+// parseWhatsAppChat splits an exported chat into messages
+func parseWhatsAppChat(r io.Reader) ([]waMessage, error) {
+	var msgs []waMessage
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(strings.TrimPrefix(scanner.Text(), "\ufeff"), "\r")
+		line = waSpaces.Replace(strings.TrimLeft(line, "\u200e"))
+		m := waLineRe.FindStringSubmatch(line)
+		if m == nil {
+			if len(msgs) > 0 {
+				msgs[len(msgs)-1].text += "\n" + waMarks.Replace(line)
+			}
+			continue
+		}
+
+		msg := waMessage{date: m[1] + m[4], clock: m[2] + m[5], ampm: m[3] + m[6]}
+		sender, text, ok := strings.Cut(m[7], ": ")
+		if !ok {
+			// "Anna added Bob", "Messages and calls are end-to-end encrypted"
+			msg.system = true
+			msg.text = waMarks.Replace(m[7])
+			msgs = append(msgs, msg)
+			continue
+		}
+		// iOS writes notices as the chat's own messages behind a mark
+		// ("Trip: \u200eAnna changed the group name"), as it does media and
+		// deleted messages
+		marked := strings.HasPrefix(text, "\u200e")
+		msg.sender = strings.TrimSpace(waMarks.Replace(sender))
+		msg.text = waMarks.Replace(text)
+		if marked {
+			lower := strings.ToLower(strings.TrimSpace(msg.text))
+			msg.system = !waOmitted[lower] && !waDeleted[lower] && !waAttachedRe.MatchString(msg.text)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, scanner.Err()
+}
+
+// whatsappDateOrder picks the date order of an export: the first field is
+// the day if it ever exceeds 12, the second if that does; a 4-digit first
+// field is a year. Undecided exports are read day first, like most locales.
+func whatsappDateOrder(msgs []waMessage, setting string) (string, error) {
+	switch setting {
+	case waDatesDMY, waDatesMDY, waDatesYMD:
+		return setting, nil
+	case "", waDatesAuto:
+	default:
+		return "", fmt.Errorf("invalid -whatsapp-dates %q (must be auto, dmy, mdy or ymd)", setting)
+	}
+	for _, msg := range msgs {
+		parts := waDateSepRe.Split(msg.date, 3)
+		if len(parts[0]) == 4 {
+			return waDatesYMD, nil
+		}
+		if a, _ := strconv.Atoi(parts[0]); a > 12 {
+			return waDatesDMY, nil
+		}
+		if b, _ := strconv.Atoi(parts[1]); b > 12 {
+			return waDatesMDY, nil
+		}
+	}
+	return waDatesDMY, nil
+}
+
+// whatsappTime reads a message's date and time, in loc (exports have no zone)
+func whatsappTime(msg waMessage, order string, loc *time.Location) (time.Time, error) {
+	parts := waDateSepRe.Split(msg.date, 3)
+	nums := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date %q", msg.date)
+		}
+		nums[i] = n
+	}
+	var year, month, day int
+	switch order {
+	case waDatesYMD:
+		year, month, day = nums[0], nums[1], nums[2]
+	case waDatesMDY:
+		month, day, year = nums[0], nums[1], nums[2]
+	default:
+		day, month, year = nums[0], nums[1], nums[2]
+	}
+	if year < 100 {
+		year += 2000
+	}
+
+	clock := strings.Split(strings.ReplaceAll(msg.clock, ".", ":"), ":")
+	hour, _ := strconv.Atoi(clock[0])
+	minute, _ := strconv.Atoi(clock[1])
+	var second int
+	if len(clock) == 3 {
+		second, _ = strconv.Atoi(clock[2])
+	}
+	if ampm := strings.ToLower(strings.NewReplacer(".", "", " ", "").Replace(msg.ampm)); ampm != "" {
+		hour %= 12
+		if ampm == "pm" {
+			hour += 12
+		}
+	}
+
+	t := time.Date(year, time.Month(month), day, hour, minute, second, 0, loc)
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || minute > 59 || second > 59 || t.Day() != day {
+		return time.Time{}, fmt.Errorf("invalid date %q %q", msg.date, msg.clock)
+	}
+	return t, nil
+}
+
+// whatsappAttachmentType guesses the type of an included media file from its
+// name (STK-/STICKER for stickers) and extension
+func whatsappAttachmentType(name string) metatable.AttachmentType {
+	upper := strings.ToUpper(filepath.Base(name))
+	if strings.HasPrefix(upper, "STK-") || strings.Contains(upper, "-STICKER-") {
+		return metatable.AttachmentTypeSticker
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".heic", ".webp":
+		return metatable.AttachmentTypeImage
+	case ".gif":
+		return metatable.AttachmentTypeAnimatedImage
+	case ".mp4", ".mov", ".3gp", ".mkv":
+		return metatable.AttachmentTypeVideo
+	case ".opus", ".m4a", ".mp3", ".aac", ".ogg", ".amr":
+		return metatable.AttachmentTypeAudio
+	default:
+		return metatable.AttachmentTypeFile
+	}
+}
+
+// whatsappMessageText splits the media included in the export out of a
+// message's text and drops the edit marker. It reports deleted messages,
+// and returns no text for media left out of the export.
+func whatsappMessageText(text string) (string, []UnifiedAttachment, bool) {
+	text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), waEditedSuffix))
+	lower := strings.ToLower(text)
+	if waDeleted[lower] {
+		return "", nil, true
+	}
+	if waOmitted[lower] {
+		return "", nil, false
+	}
+
+	var attachments []UnifiedAttachment
+	for _, m := range waAttachedRe.FindAllStringSubmatch(text, -1) {
+		name := strings.TrimSpace(m[1] + m[2])
+		attachments = append(attachments, UnifiedAttachment{Type: whatsappAttachmentType(name), URI: name, Filename: filepath.Base(name)})
+	}
+	text = strings.TrimSpace(waAttachedRe.ReplaceAllString(text, ""))
+	return text, attachments, false
+}
+
+// whatsappThreadName derives the chat name from the export's file name
+// ("WhatsApp Chat with Anna.txt", "WhatsApp Chat - Anna.zip")
+func whatsappThreadName(fileName string) string {
+	name := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	for _, prefix := range []string{"WhatsApp Chat with ", "WhatsApp Chat - ", "WhatsApp Chat "} {
+		if strings.HasPrefix(name, prefix) {
+			return strings.TrimSpace(name[len(prefix):])
+		}
+	}
+	if name == "_chat" {
+		return ""
+	}
+	return name
+}
+
+// whatsappExport converts an exported chat to a UnifiedExport. Messages
+// sent within the same minute (Android exports have no seconds) are spread
+// 1 ms apart to keep their order; re-imports of a longer export of the same
+// chat keep the same timestamps and so the same message IDs.
+func whatsappExport(name string, r io.Reader, dateOrder string, loc *time.Location) (UnifiedExport, error) {
+	msgs, err := parseWhatsAppChat(r)
+	if err != nil {
+		return UnifiedExport{}, fmt.Errorf("reading chat: %w", err)
+	}
+	order, err := whatsappDateOrder(msgs, dateOrder)
+	if err != nil {
+		return UnifiedExport{}, err
+	}
+
+	export := UnifiedExport{
+		Source:     ExportSourceWhatsApp,
+		ThreadName: whatsappThreadName(name),
+		ThreadPath: name,
+	}
+	seen := make(map[string]bool)
+	var lastMs int64
+	var sameMs int64
+	for _, msg := range msgs {
+		if msg.system || msg.sender == "" {
+			continue
+		}
+		t, err := whatsappTime(msg, order, loc)
+		if err != nil {
+			return UnifiedExport{}, fmt.Errorf("%w (try -whatsapp-dates)", err)
+		}
+		text, attachments, deleted := whatsappMessageText(msg.text)
+		if text == "" && len(attachments) == 0 && !deleted {
+			continue
+		}
+
+		ts := t.UnixMilli()
+		if ts == lastMs {
+			sameMs++
+		} else {
+			lastMs, sameMs = ts, 0
+		}
+		if !seen[msg.sender] {
+			seen[msg.sender] = true
+			export.Participants = append(export.Participants, msg.sender)
+		}
+		export.Messages = append(export.Messages, UnifiedMessage{
+			SenderName:  msg.sender,
+			Text:        text,
+			TimestampMs: ts + sameMs,
+			IsUnsent:    deleted,
+			Attachments: attachments,
+		})
+	}
+
+	if export.ThreadName == "" {
+		export.ThreadName = strings.Join(normalizeNames(export.Participants), ", ")
+	}
+	// WhatsApp chats share no IDs with Messenger threads
+	export.ThreadIDHint = generateThreadID("whatsapp:" + export.ThreadName)
+	return export, nil
+}
+
+// isWhatsAppChatName reports whether a file in a ZIP is an exported chat
+func isWhatsAppChatName(name string) bool {
+	base := filepath.Base(name)
+	return strings.EqualFold(filepath.Ext(base), ".txt") && (base == "_chat.txt" || strings.HasPrefix(base, "WhatsApp Chat"))
+}
+
+// isWhatsAppExportZip checks for an exported chat among a ZIP's files
+func isWhatsAppExportZip(zipPath string) bool {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if isWhatsAppChatName(f.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func processWhatsAppZip(log zerolog.Logger, store *storage.Storage, zipPath string) (imported, skipped int, err error) {
+	log.Info().Str("zip", filepath.Base(zipPath)).Msg("Processing WhatsApp export ZIP")
+	exportMedia.addZip(log, zipPath)
+
+	zipReader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("opening %s: %w", filepath.Base(zipPath), err)
+	}
+	defer zipReader.Close()
+
+	var chats []*zip.File
+	for _, file := range zipReader.File {
+		if isWhatsAppChatName(file.Name) {
+			chats = append(chats, file)
+		}
+	}
+
+	importProgress.AddTotal(int64(len(chats)))
+	for _, file := range chats {
+		importProgress.Add(1)
+		rc, openErr := file.Open()
+		if openErr != nil {
+			err = errors.Join(err, fmt.Errorf("opening %s: %w", file.Name, openErr))
+			continue
+		}
+		data, readErr := io.ReadAll(rc)
+		rc.Close()
+		if readErr != nil {
+			err = errors.Join(err, fmt.Errorf("reading %s: %w", file.Name, readErr))
+			continue
+		}
+
+		// iOS names the chat _chat.txt and the ZIP after it
+		name := file.Name
+		if whatsappThreadName(name) == "" {
+			name = zipPath
+		}
+		imp, skip := importWhatsAppChat(log, store, name, data)
+		imported += imp
+		skipped += skip
+	}
+	return
+}
+
+func processWhatsAppTxt(log zerolog.Logger, store *storage.Storage, path string) (imported, skipped int, err error) {
+	log.Info().Str("path", path).Msg("Processing WhatsApp export")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	importProgress.AddTotal(1)
+	importProgress.Add(1)
+	imported, skipped = importWhatsAppChat(log, store, path, data)
+	return imported, skipped, nil
+}
+
+func importWhatsAppChat(log zerolog.Logger, store *storage.Storage, name string, data []byte) (imported, skipped int) {
+	export, err := whatsappExport(name, bytes.NewReader(data), *whatsappDates, time.Local)
+	if err != nil {
+		log.Warn().Err(err).Str("file", name).Msg("Failed to parse WhatsApp chat")
+		return 0, 0
+	}
+	if len(export.Messages) == 0 {
+		return 0, 0
+	}
+	return processUnifiedExport(log, store, export)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// importConversations parses each item into a conversation and stores it.
+// With -workers above 1, that many goroutines read and parse conversations
+// while the calling goroutine stays the only writer, storing them in the
+// order they finish; SQLite allows one writer at a time anyway, and the
+// import state (owner, report, progress) is never shared. Conversations
+// without messages are skipped.
+func importConversations[T any](log zerolog.Logger, store *storage.Storage, items []T, parse func(T) UnifiedExport) (imported, skipped int) {
+	importProgress.AddTotal(int64(len(items)))
+	write := func(export UnifiedExport) {
+		importProgress.Add(1)
+		if len(export.Messages) == 0 {
+			return
+		}
+		imp, skip := processUnifiedExport(log, store, export)
+		imported += imp
+		skipped += skip
+	}
+
+	n := min(*workers, len(items))
+	if n <= 1 {
+		for _, item := range items {
+			write(parse(item))
+		}
+		return
+	}
+
+	jobs := make(chan T)
+	// The buffer lets workers parse ahead of the writer, which bounds how
+	// many parsed conversations are held in memory
+	parsed := make(chan UnifiedExport, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				parsed <- parse(item)
+			}
+		}()
+	}
+	go func() {
+		for _, item := range items {
+			jobs <- item
+		}
+		close(jobs)
+		wg.Wait()
+		close(parsed)
+	}()
+
+	for export := range parsed {
+		write(export)
+	}
+	return
+}
@@ -12,19 +12,26 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
 )
 
 var (
-	jsonPath = flag.String("json", "", "Path to sample conversations JSON")
-	dbPath   = flag.String("db", "demo.db", "Path to output SQLite database")
+	jsonPath  = flag.String("json", "", "Path to sample conversations JSON")
+	dbPath    = flag.String("db", "demo.db", "Path to output SQLite database")
+	dbKeyFile = storage.KeyFileFlag()
 )
 
 type SampleData struct {
 	Contacts []Contact `json:"contacts"`
 	Threads  []Thread  `json:"threads"`
+	// CurrentUser is the archive owner (default: 1006, "Demo User" in the
+	// sample data); set by anon-corpus
+	CurrentUser int64 `json:"current_user,omitempty"`
 }
 
 type Contact struct {
@@ -67,11 +74,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		fmt.Printf("Error loading the database key: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Remove existing DB
 	os.Remove(*dbPath)
 
 	// Create database
-	db, err := sql.Open("sqlite3", *dbPath)
+	db, err := sql.Open(storage.Driver("sqlite3"), *dbPath)
 	if err != nil {
 		fmt.Printf("Error creating database: %v\n", err)
 		os.Exit(1)
@@ -149,6 +161,7 @@ func createSchema(ctx context.Context, db *sql.DB) error {
 		offline_threading_id TEXT,
 		created_at INTEGER NOT NULL,
 		indexed_at INTEGER,
+		source TEXT NOT NULL DEFAULT 'live',
 		FOREIGN KEY (thread_id) REFERENCES threads(id),
 		FOREIGN KEY (sender_id) REFERENCES contacts(id)
 	);
@@ -223,8 +236,8 @@ func importData(ctx context.Context, db *sql.DB, sample *SampleData) error {
 	defer participantStmt.Close()
 
 	messageStmt, err := db.PrepareContext(ctx, `
-		INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms, created_at)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms, created_at, source)
+		VALUES (?, ?, ?, ?, ?, ?, 'import-sample')
 	`)
 	if err != nil {
 		return err
@@ -264,11 +277,20 @@ func importData(ctx context.Context, db *sql.DB, sample *SampleData) error {
 	fmt.Printf("Imported %d messages across %d threads\n", msgCount, len(sample.Threads))
 
 	// Set demo user as current user (ID 1006 = "Demo User" in sample data)
+	currentUser, currentName := int64(1006), "Demo User"
+	if sample.CurrentUser != 0 {
+		currentUser, currentName = sample.CurrentUser, ""
+		for _, c := range sample.Contacts {
+			if c.ID == currentUser {
+				currentName = c.Name
+			}
+		}
+	}
 	_, err = db.ExecContext(ctx, `
 		INSERT INTO sync_metadata (key, value) VALUES
-			('current_user_id', '1006'),
-			('current_user_name', 'Demo User')
-	`)
+			('current_user_id', ?),
+			('current_user_name', ?)
+	`, strconv.FormatInt(currentUser, 10), currentName)
 	if err != nil {
 		return fmt.Errorf("inserting sync_metadata: %w", err)
 	}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// stateSaveEvery is how many sent messages go by between cursor saves, so an
+// interrupted export resumes close to where it stopped
+const stateSaveEvery = 100
+
+// Options configures an export
+type Options struct {
+	// ServerName is the homeserver domain ghost user IDs are made with
+	ServerName string
+	// GhostPrefix is prepended to contact IDs to make ghost localparts; it
+	// must fall in the appservice's user namespace
+	GhostPrefix string
+	// Invite lists Matrix users invited to every new room
+	Invite  []string
+	SinceMs int64 // inclusive; 0 = no bound
+	UntilMs int64 // exclusive; 0 = no bound
+	DryRun  bool
+}
+
+// threadState is what has been exported of a thread, stored in
+// sync_metadata under stateKey
+type threadState struct {
+	RoomID          string   `json:"room_id"`
+	LastTimestampMs int64    `json:"last_timestamp_ms"`
+	LastMessageID   string   `json:"last_message_id"`
+	Members         []string `json:"members"` // Ghosts that have joined the room
+}
+
+func stateKey(threadID int64) string {
+	return "matrix_export:" + strconv.FormatInt(threadID, 10)
+}
+
+type exportMessage struct {
+	id          string
+	sender      int64
+	text        string
+	timestampMs int64
+	replyTo     string
+}
+
+type exporter struct {
+	client *matrixClient
+	store  *storage.Storage
+	db     *sql.DB
+	opts   Options
+	// ghosts are the ghost user IDs registered this run, by contact ID
+	ghosts map[int64]string
+}
+
+func newExporter(client *matrixClient, store *storage.Storage, opts Options) *exporter {
+	return &exporter{client: client, store: store, db: store.GetDB(), opts: opts, ghosts: make(map[int64]string)}
+}
+
+// exportThread sends the messages of a thread that haven't been exported yet
+// to its room, creating the room on first export. It returns how many
+// messages were sent (or would be, with DryRun).
+func (e *exporter) exportThread(ctx context.Context, threadID int64) (int, error) {
+	state, err := e.loadState(threadID)
+	if err != nil {
+		return 0, err
+	}
+
+	var threadName sql.NullString
+	err = e.db.QueryRow(`SELECT name FROM thread_names WHERE thread_id = ?`, threadID).Scan(&threadName)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("thread %d not found", threadID)
+	} else if err != nil {
+		return 0, fmt.Errorf("reading thread: %w", err)
+	}
+
+	messages, err := e.loadMessages(threadID, state)
+	if err != nil {
+		return 0, err
+	}
+	if len(messages) == 0 || e.opts.DryRun {
+		return len(messages), nil
+	}
+
+	names, err := storage.ThreadMemberNames(e.db, threadID, false)
+	if err != nil {
+		return 0, err
+	}
+	var senders []string
+	for _, m := range messages {
+		ghost, err := e.ensureGhost(ctx, m.sender, names[m.sender])
+		if err != nil {
+			return 0, fmt.Errorf("registering ghost for %d: %w", m.sender, err)
+		}
+		if !slices.Contains(senders, ghost) {
+			senders = append(senders, ghost)
+		}
+	}
+
+	created := false
+	if state.RoomID == "" {
+		title := threadName.String
+		if title == "" {
+			title = "Messenger thread " + strconv.FormatInt(threadID, 10)
+		}
+		invite := append(slices.Clone(e.opts.Invite), senders...)
+		if state.RoomID, err = e.client.createRoom(ctx, title, "Archived Messenger conversation", invite); err != nil {
+			return 0, fmt.Errorf("creating room: %w", err)
+		}
+		created = true
+		if err := e.saveState(threadID, state); err != nil {
+			return 0, err
+		}
+	}
+	for _, ghost := range senders {
+		if slices.Contains(state.Members, ghost) {
+			continue
+		}
+		if !created {
+			if err := e.client.invite(ctx, state.RoomID, ghost); err != nil {
+				return 0, fmt.Errorf("inviting %s: %w", ghost, err)
+			}
+		}
+		if err := e.client.join(ctx, state.RoomID, ghost); err != nil {
+			return 0, fmt.Errorf("joining %s: %w", ghost, err)
+		}
+		state.Members = append(state.Members, ghost)
+	}
+
+	// Replies are linked to messages sent in the same run; older targets
+	// aren't looked up
+	eventIDs := make(map[string]string)
+	sent := 0
+	for _, m := range messages {
+		content := map[string]any{"msgtype": "m.text", "body": m.text}
+		if eventID := eventIDs[m.replyTo]; eventID != "" {
+			content["m.relates_to"] = map[string]any{"m.in_reply_to": map[string]string{"event_id": eventID}}
+		}
+		eventID, err := e.client.sendMessage(ctx, state.RoomID, e.ghosts[m.sender], "mre."+m.id, m.timestampMs, content)
+		if err != nil {
+			if saveErr := e.saveState(threadID, state); saveErr != nil {
+				return sent, saveErr
+			}
+			return sent, fmt.Errorf("sending %s: %w", m.id, err)
+		}
+		eventIDs[m.id] = eventID
+		state.LastTimestampMs, state.LastMessageID = m.timestampMs, m.id
+		sent++
+		if sent%stateSaveEvery == 0 {
+			if err := e.saveState(threadID, state); err != nil {
+				return sent, err
+			}
+		}
+	}
+	return sent, e.saveState(threadID, state)
+}
+
+// ensureGhost registers the ghost user of a contact once per run and sets
+// its display name
+func (e *exporter) ensureGhost(ctx context.Context, contactID int64, name string) (string, error) {
+	if ghost, ok := e.ghosts[contactID]; ok {
+		return ghost, nil
+	}
+	localpart := e.opts.GhostPrefix + strconv.FormatInt(contactID, 10)
+	ghost := "@" + localpart + ":" + e.opts.ServerName
+	if err := e.client.registerGhost(ctx, localpart); err != nil {
+		return "", err
+	}
+	if name == "" {
+		name = "Messenger user " + strconv.FormatInt(contactID, 10)
+	}
+	if err := e.client.setDisplayName(ctx, ghost, name); err != nil {
+		return "", err
+	}
+	e.ghosts[contactID] = ghost
+	return ghost, nil
+}
+
+// loadMessages returns the text messages of a thread after the export
+// cursor, oldest first
+func (e *exporter) loadMessages(threadID int64, state threadState) ([]exportMessage, error) {
+	query := `
+		SELECT id, sender_id, text, timestamp_ms, COALESCE(reply_to_message_id, '')
+		FROM messages
+		WHERE thread_id = ? AND is_unsent = 0 AND text IS NOT NULL AND text != ''
+		  AND (timestamp_ms, id) > (?, ?)`
+	args := []any{threadID, state.LastTimestampMs, state.LastMessageID}
+	if e.opts.SinceMs > 0 {
+		query += ` AND timestamp_ms >= ?`
+		args = append(args, e.opts.SinceMs)
+	}
+	if e.opts.UntilMs > 0 {
+		query += ` AND timestamp_ms < ?`
+		args = append(args, e.opts.UntilMs)
+	}
+	rows, err := e.db.Query(query+` ORDER BY timestamp_ms, id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("reading messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []exportMessage
+	for rows.Next() {
+		var m exportMessage
+		if err := rows.Scan(&m.id, &m.sender, &m.text, &m.timestampMs, &m.replyTo); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+func (e *exporter) loadState(threadID int64) (threadState, error) {
+	var state threadState
+	value, err := e.store.GetSyncMetadata(stateKey(threadID))
+	if err != nil || value == "" {
+		return state, err
+	}
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return state, fmt.Errorf("reading export state of thread %d: %w", threadID, err)
+	}
+	return state, nil
+}
+
+func (e *exporter) saveState(threadID int64, state threadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return e.store.SetSyncMetadata(stateKey(threadID), string(data))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// fakeHomeserver records what an export does to the client-server API
+type fakeHomeserver struct {
+	mu       sync.Mutex
+	rooms    int
+	joins    []string
+	names    map[string]string
+	sent     []sentEvent
+	limited  bool // Answer the next send with 429 once
+	failFrom int  // Fail sends after this many (0 = never)
+}
+
+type sentEvent struct {
+	user, ts, body, replyTo string
+}
+
+func (f *fakeHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer as-secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/_matrix/client/v3")
+	var body map[string]any
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	switch {
+	case path == "/register":
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"errcode":"M_USER_IN_USE","error":"taken"}`))
+	case strings.HasPrefix(path, "/profile/"):
+		f.names[r.URL.Query().Get("user_id")] = body["displayname"].(string)
+		w.Write([]byte(`{}`))
+	case path == "/createRoom":
+		f.rooms++
+		w.Write([]byte(`{"room_id":"!room:example.org"}`))
+	case strings.HasPrefix(path, "/join/"):
+		f.joins = append(f.joins, r.URL.Query().Get("user_id"))
+		w.Write([]byte(`{"room_id":"!room:example.org"}`))
+	case strings.Contains(path, "/send/m.room.message/"):
+		if f.limited {
+			f.limited = false
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":1}`))
+			return
+		}
+		if f.failFrom > 0 && len(f.sent) >= f.failFrom {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ev := sentEvent{user: r.URL.Query().Get("user_id"), ts: r.URL.Query().Get("ts"), body: body["body"].(string)}
+		if rel, ok := body["m.relates_to"].(map[string]any); ok {
+			ev.replyTo = rel["m.in_reply_to"].(map[string]any)["event_id"].(string)
+		}
+		f.sent = append(f.sent, ev)
+		json.NewEncoder(w).Encode(map[string]string{"event_id": "$" + ev.ts})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestExportThread_ResumesFromCursor(t *testing.T) {
+	store, err := storage.New(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	defer store.Close()
+	db := store.GetDB()
+	for _, stmt := range []string{
+		`INSERT INTO contacts (id, name, created_at, updated_at) VALUES (11, 'Anna Nowak', 0, 0), (12, 'Bartek Kowalski', 0, 0)`,
+		`INSERT INTO threads (id, thread_type, name, created_at, updated_at) VALUES (5, 2, 'Chorwacja 2019', 0, 0)`,
+		`INSERT INTO thread_participants (thread_id, contact_id, nickname) VALUES (5, 11, 'Ania'), (5, 12, NULL)`,
+		`INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms, created_at) VALUES
+			('m1', 5, 11, 'who has the tickets?', 1000, 0),
+			('m2', 5, 12, 'me', 2000, 0),
+			('m3', 5, 11, 'unsent', 3000, 0),
+			('m4', 5, 12, '', 4000, 0)`,
+		`UPDATE messages SET is_unsent = 1 WHERE id = 'm3'`,
+		`UPDATE messages SET reply_to_message_id = 'm1' WHERE id = 'm2'`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	hs := &fakeHomeserver{names: make(map[string]string), limited: true}
+	srv := httptest.NewServer(hs)
+	defer srv.Close()
+	e := newExporter(newMatrixClient(srv.URL, "as-secret"), store, Options{ServerName: "example.org", GhostPrefix: "meta_"})
+	ctx := context.Background()
+
+	sent, err := e.exportThread(ctx, 5)
+	if err != nil || sent != 2 {
+		t.Fatalf("first export = %d, %v; want 2", sent, err)
+	}
+	if hs.rooms != 1 || len(hs.joins) != 2 || hs.names["@meta_11:example.org"] != "Ania" || hs.names["@meta_12:example.org"] != "Bartek Kowalski" {
+		t.Fatalf("rooms=%d joins=%v names=%v", hs.rooms, hs.joins, hs.names)
+	}
+	want := []sentEvent{
+		{user: "@meta_11:example.org", ts: "1000", body: "who has the tickets?"},
+		{user: "@meta_12:example.org", ts: "2000", body: "me", replyTo: "$1000"},
+	}
+	if len(hs.sent) != 2 || hs.sent[0] != want[0] || hs.sent[1] != want[1] {
+		t.Fatalf("sent %+v, want %+v", hs.sent, want)
+	}
+
+	// Nothing new: nothing sent, no new room
+	if sent, err := e.exportThread(ctx, 5); err != nil || sent != 0 || hs.rooms != 1 {
+		t.Fatalf("rerun = %d, %v (rooms %d); want 0", sent, err, hs.rooms)
+	}
+
+	// A failed send keeps the messages before it, and the next run resumes
+	if _, err := db.Exec(`INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms, created_at) VALUES
+		('m5', 5, 11, 'five', 5000, 0), ('m6', 5, 11, 'six', 6000, 0)`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	hs.failFrom = 3
+	if sent, err := e.exportThread(ctx, 5); err == nil || sent != 1 {
+		t.Fatalf("failing export = %d, %v; want 1 and an error", sent, err)
+	}
+	hs.failFrom = 0
+	if sent, err := e.exportThread(ctx, 5); err != nil || sent != 1 || hs.sent[3].body != "six" {
+		t.Fatalf("resumed export = %d, %v, sent %+v", sent, err, hs.sent)
+	}
+	if hs.rooms != 1 || len(hs.joins) != 2 {
+		t.Fatalf("resume recreated the room or rejoined: rooms=%d joins=%v", hs.rooms, hs.joins)
+	}
+}
@@ -0,0 +1,199 @@
+// matrix-export republishes archived threads into Matrix rooms, so they can
+// be read in any Matrix client.
+//
+// It works the way the bridge backfills history: as an application service,
+// with one ghost user per participant and each message sent with its
+// original timestamp. Register an appservice on the homeserver (a bridge
+// registration works) whose user namespace covers -ghost-prefix, and pass
+// its as_token. Each thread gets its own private room, created by the
+// appservice bot, with the -invite users invited.
+//
+// The room and the last exported message of each thread are kept in
+// sync_metadata, so rerunning sends only what's new since. Text messages
+// are exported; attachments, reactions and unsent messages are not.
+//
+// Usage:
+//
+//	MATRIX_AS_TOKEN=... matrix-export -homeserver https://matrix.example.org -server-name example.org -thread 123456 -invite @me:example.org
+//	matrix-export -homeserver https://matrix.example.org -server-name example.org -tag family -since 2019
+//	matrix-export -tag family -dry-run  # count what would be sent
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/rag"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	dbPath      = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile   = storage.KeyFileFlag()
+	cfgPath     = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	threads     = flag.String("thread", "", "Comma-separated thread IDs to export")
+	tags        = flag.String("tag", "", "Comma-separated tags; threads with any of them are exported")
+	homeserver  = flag.String("homeserver", "", "Homeserver URL (required unless -dry-run)")
+	serverName  = flag.String("server-name", "", "Homeserver domain for ghost user IDs (required unless -dry-run)")
+	asToken     = flag.String("as-token", "", "Appservice as_token (default: $MATRIX_AS_TOKEN)")
+	ghostPrefix = flag.String("ghost-prefix", "messenger_", "Localpart prefix of ghost users, inside the appservice namespace")
+	invite      = flag.String("invite", "", "Comma-separated Matrix user IDs to invite to new rooms")
+	since       = flag.String("since", "", "Only messages at or after this time (2006, 2006-01, 2006-01-02 or RFC3339)")
+	until       = flag.String("until", "", "Only messages before this time")
+	dryRun      = flag.Bool("dry-run", false, "Count the messages that would be sent without contacting the homeserver")
+	debug       = flag.Bool("debug", false, "Enable debug logging")
+)
+
+func main() {
+	flag.Parse()
+
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	if *threads == "" && *tags == "" {
+		log.Fatal().Msg("-thread or -tag is required")
+	}
+	token := *asToken
+	if token == "" {
+		token = os.Getenv("MATRIX_AS_TOKEN")
+	}
+	if !*dryRun && (*homeserver == "" || *serverName == "" || token == "") {
+		log.Fatal().Msg("-homeserver, -server-name and an as_token (-as-token or MATRIX_AS_TOKEN) are required")
+	}
+
+	opts := Options{ServerName: *serverName, GhostPrefix: *ghostPrefix, Invite: splitList(*invite), DryRun: *dryRun}
+	var err error
+	if opts.SinceMs, err = parseBound(*since); err != nil {
+		log.Fatal().Err(err).Msg("Invalid -since")
+	}
+	if opts.UntilMs, err = parseBound(*until); err != nil {
+		log.Fatal().Err(err).Msg("Invalid -until")
+	}
+
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+	store, err := storage.New(sqlitePath)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", sqlitePath).Msg("Failed to open database")
+	}
+	defer store.Close()
+
+	threadIDs, err := selectThreads(store, *threads, *tags)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to select threads")
+	}
+	if len(threadIDs) == 0 {
+		log.Fatal().Msg("No threads selected")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	client := newMatrixClient(*homeserver, token)
+	if !*dryRun {
+		bot, err := client.whoami(ctx)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Homeserver rejected the as_token")
+		}
+		log.Info().Str("bot", bot).Int("threads", len(threadIDs)).Msg("Exporting")
+	}
+
+	e := newExporter(client, store, opts)
+	total, failed := 0, 0
+	for _, id := range threadIDs {
+		if ctx.Err() != nil {
+			break
+		}
+		sent, err := e.exportThread(ctx, id)
+		total += sent
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			failed++
+			log.Warn().Err(err).Int64("thread", id).Int("sent", sent).Msg("Exporting thread failed")
+			continue
+		}
+		log.Info().Int64("thread", id).Int("messages", sent).Msg("Thread exported")
+	}
+
+	verb := "Sent"
+	if *dryRun {
+		verb = "Would send"
+	}
+	fmt.Printf("%s %d messages from %d threads (%d failed)\n", verb, total, len(threadIDs), failed)
+	if failed > 0 || ctx.Err() != nil {
+		os.Exit(1)
+	}
+}
+
+// selectThreads resolves -thread and -tag into thread IDs
+func selectThreads(store *storage.Storage, threadList, tagList string) ([]int64, error) {
+	var ids []int64
+	for _, part := range splitList(threadList) {
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid thread ID %q", part)
+		}
+		ids = append(ids, id)
+	}
+	if tagList != "" {
+		tagged, err := storage.ThreadIDsWithTags(store.GetDB(), splitList(tagList))
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range tagged {
+			if !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func parseBound(s string) (int64, error) {
+	t, err := rag.ParseSearchTime(s)
+	if err != nil || t.IsZero() {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
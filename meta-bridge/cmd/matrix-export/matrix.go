@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRateLimitWait caps how long a single M_LIMIT_EXCEEDED makes us wait
+const maxRateLimitWait = time.Minute
+
+// matrixClient talks to the client-server API as an application service:
+// the as_token authenticates the bridge bot, and ?user_id= acts as one of
+// its ghost users. Timestamps of sent events can be set with ?ts=, which is
+// what bridges use to backfill history.
+type matrixClient struct {
+	homeserver string
+	token      string
+	http       *http.Client
+}
+
+// matrixError is an error response from the homeserver
+type matrixError struct {
+	Status  int
+	ErrCode string `json:"errcode"`
+	Message string `json:"error"`
+	RetryMs int64  `json:"retry_after_ms"`
+}
+
+func (e *matrixError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.ErrCode, e.Message)
+}
+
+func newMatrixClient(homeserver, token string) *matrixClient {
+	return &matrixClient{
+		homeserver: strings.TrimSuffix(homeserver, "/"),
+		token:      token,
+		http:       &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do sends a request to /_matrix/client/v3 + path and decodes the response
+// into out (if not nil). Rate-limited requests are retried after the wait
+// the server asks for.
+func (c *matrixClient) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	u := c.homeserver + "/_matrix/client/v3" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	for {
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode >= 300 {
+			merr := &matrixError{Status: resp.StatusCode}
+			_ = json.Unmarshal(data, merr)
+			if resp.StatusCode == http.StatusTooManyRequests {
+				wait := min(max(time.Duration(merr.RetryMs)*time.Millisecond, time.Second), maxRateLimitWait)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(wait):
+				}
+				continue
+			}
+			return fmt.Errorf("%s %s: %w", method, path, merr)
+		}
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(data, out)
+	}
+}
+
+// asUser is the query that makes a request act as a ghost user
+func asUser(userID string) url.Values {
+	return url.Values{"user_id": {userID}}
+}
+
+// whoami returns the user ID of the bridge bot
+func (c *matrixClient) whoami(ctx context.Context) (string, error) {
+	var resp struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/account/whoami", nil, nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.UserID, nil
+}
+
+// registerGhost creates a ghost user in the appservice namespace; an
+// existing one is fine
+func (c *matrixClient) registerGhost(ctx context.Context, localpart string) error {
+	err := c.do(ctx, http.MethodPost, "/register", nil, map[string]any{
+		"type":     "m.login.application_service",
+		"username": localpart,
+	}, nil)
+	if merr, ok := asMatrixError(err); ok && merr.ErrCode == "M_USER_IN_USE" {
+		return nil
+	}
+	return err
+}
+
+func (c *matrixClient) setDisplayName(ctx context.Context, userID, name string) error {
+	return c.do(ctx, http.MethodPut, "/profile/"+url.PathEscape(userID)+"/displayname", asUser(userID),
+		map[string]string{"displayname": name}, nil)
+}
+
+// createRoom creates a private room as the bridge bot
+func (c *matrixClient) createRoom(ctx context.Context, name, topic string, invite []string) (string, error) {
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	err := c.do(ctx, http.MethodPost, "/createRoom", nil, map[string]any{
+		"name":   name,
+		"topic":  topic,
+		"preset": "private_chat",
+		"invite": invite,
+	}, &resp)
+	return resp.RoomID, err
+}
+
+func (c *matrixClient) invite(ctx context.Context, roomID, userID string) error {
+	err := c.do(ctx, http.MethodPost, "/rooms/"+url.PathEscape(roomID)+"/invite", nil,
+		map[string]string{"user_id": userID}, nil)
+	// Already invited or joined
+	if merr, ok := asMatrixError(err); ok && merr.Status == http.StatusForbidden && strings.Contains(merr.Message, "already") {
+		return nil
+	}
+	return err
+}
+
+func (c *matrixClient) join(ctx context.Context, roomID, userID string) error {
+	return c.do(ctx, http.MethodPost, "/join/"+url.PathEscape(roomID), asUser(userID), map[string]any{}, nil)
+}
+
+// sendMessage sends an m.room.message as userID with the origin timestamp
+// tsMs. txnID makes retries of the same message idempotent.
+func (c *matrixClient) sendMessage(ctx context.Context, roomID, userID, txnID string, tsMs int64, content map[string]any) (string, error) {
+	query := asUser(userID)
+	query.Set("ts", strconv.FormatInt(tsMs, 10))
+	var resp struct {
+		EventID string `json:"event_id"`
+	}
+	err := c.do(ctx, http.MethodPut,
+		"/rooms/"+url.PathEscape(roomID)+"/send/m.room.message/"+url.PathEscape(txnID), query, content, &resp)
+	return resp.EventID, err
+}
+
+func asMatrixError(err error) (*matrixError, bool) {
+	var merr *matrixError
+	ok := errors.As(err, &merr)
+	return merr, ok
+}
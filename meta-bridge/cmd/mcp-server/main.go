@@ -0,0 +1,128 @@
+// mcp-server exposes RAG search over the archive to LLM clients through the
+// Model Context Protocol.
+//
+// It uses the same pkg/rag Service as rag-server, so results match the web UI.
+//
+// Transports:
+//   - stdio (default): newline-delimited JSON-RPC on stdin/stdout, for clients
+//     that launch the server themselves (Claude Desktop, editors)
+//   - sse: HTTP server with GET /sse (event stream) and POST /message. It
+//     only answers requests addressed to loopback or the listen host and
+//     rejects browser requests from other origins; with keys or users in
+//     the auth section of rag.yaml it requires them like rag-server does.
+//
+// Tools:
+//   - search_messages  - Semantic/BM25/hybrid search over message chunks
+//   - get_conversation - Messages of a thread, optionally before a timestamp
+//   - get_thread_stats - Participants, message counts and activity of a thread
+//   - list_threads     - Most recently active threads
+//
+// Logs always go to stderr so they can't corrupt the stdio protocol stream.
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/httpauth"
+	"go.mau.fi/mautrix-meta/pkg/rag"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	transport = flag.String("transport", "stdio", "Transport: stdio or sse")
+	addr      = flag.String("addr", "127.0.0.1:8091", "HTTP listen address for the sse transport")
+	dbPath    = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile = storage.KeyFileFlag()
+	cfgPath   = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	debug     = flag.Bool("debug", false, "Enable debug logging")
+)
+
+func main() {
+	flag.Parse()
+
+	// Setup logging (stderr only: stdout carries the protocol in stdio mode)
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+
+	if *transport != "stdio" && *transport != "sse" {
+		log.Fatal().Str("transport", *transport).Msg("Invalid -transport (use stdio or sse)")
+	}
+
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	cfg.Database.SQLite = sqlitePath
+	archive, err := rag.OpenConfig(ctx, cfg)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", sqlitePath).Msg("Failed to open the archive")
+	}
+	defer archive.Close()
+
+	srv := newServer(archive.Service, archive.DB())
+
+	switch *transport {
+	case "stdio":
+		log.Info().Str("db", sqlitePath).Msg("Serving MCP over stdio")
+		if err := srv.serveStdio(ctx, os.Stdin, os.Stdout); err != nil {
+			log.Fatal().Err(err).Msg("stdio transport failed")
+		}
+	case "sse":
+		auth, err := httpauth.New(cfg.Auth, "mcp-server", nil)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid auth config")
+		}
+		if auth != nil {
+			log.Info().Int("keys", auth.Keys()).Int("users", auth.Users()).Msg("Authentication enabled")
+		} else if host, _, _ := net.SplitHostPort(*addr); !httpauth.IsLoopback(host) {
+			log.Warn().Str("addr", *addr).Msg("SECURITY WARNING: listening beyond loopback without authentication; add keys or users to the auth section of rag.yaml")
+		}
+		httpServer := &http.Server{
+			Addr:              *addr,
+			Handler:           newSSETransport(srv, *addr, auth).handler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = httpServer.Shutdown(shutdownCtx)
+		}()
+		log.Info().Str("addr", *addr).Msg("Serving MCP over SSE")
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("SSE transport failed")
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/rag"
+)
+
+const (
+	serverName    = "messenger-rag"
+	serverVersion = "0.1.0"
+
+	// latestProtocolVersion is answered when the client asks for a version
+	// we don't know
+	latestProtocolVersion = "2025-03-26"
+)
+
+// supportedProtocolVersions are echoed back when a client requests them
+var supportedProtocolVersions = []string{"2024-11-05", "2025-03-26", "2025-06-18"}
+
+// JSON-RPC error codes
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeInternalError  = -32603
+)
+
+// rpcRequest is a JSON-RPC 2.0 request or notification (no ID)
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+func (r *rpcRequest) isNotification() bool {
+	return len(r.ID) == 0
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+// server implements the MCP methods on top of the RAG service and the
+// read-only archive database. It is shared by all transports and sessions.
+type server struct {
+	svc   *rag.Service
+	db    *sql.DB
+	tools []tool
+}
+
+func newServer(svc *rag.Service, db *sql.DB) *server {
+	s := &server{svc: svc, db: db}
+	s.tools = s.registerTools()
+	return s
+}
+
+// handleMessage processes one raw JSON-RPC message and returns the encoded
+// response, or nil for notifications
+func (s *server) handleMessage(ctx context.Context, raw []byte) []byte {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return encodeResponse(rpcResponse{ID: json.RawMessage("null"), Error: &rpcError{codeParseError, "parse error"}})
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		if req.isNotification() {
+			return nil
+		}
+		return encodeResponse(rpcResponse{ID: req.ID, Error: &rpcError{codeInvalidRequest, "invalid request"}})
+	}
+
+	result, err := s.dispatch(ctx, &req)
+	if req.isNotification() {
+		return nil
+	}
+
+	resp := rpcResponse{ID: req.ID, Result: result}
+	if err != nil {
+		rerr, ok := err.(*rpcError)
+		if !ok {
+			log.Error().Err(err).Str("method", req.Method).Msg("MCP request failed")
+			rerr = &rpcError{codeInternalError, "internal error"}
+		}
+		resp.Result = nil
+		resp.Error = rerr
+	}
+	return encodeResponse(resp)
+}
+
+func (s *server) dispatch(ctx context.Context, req *rpcRequest) (any, error) {
+	switch req.Method {
+	case "initialize":
+		return s.initialize(req.Params)
+	case "notifications/initialized", "notifications/cancelled":
+		return nil, nil
+	case "ping":
+		return struct{}{}, nil
+	case "tools/list":
+		return map[string]any{"tools": s.tools}, nil
+	case "tools/call":
+		return s.callTool(ctx, req.Params)
+	default:
+		return nil, &rpcError{codeMethodNotFound, "method not found: " + req.Method}
+	}
+}
+
+func (s *server) initialize(params json.RawMessage) (any, error) {
+	var p struct {
+		ProtocolVersion string `json:"protocolVersion"`
+		ClientInfo      struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"clientInfo"`
+	}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{codeInvalidParams, "invalid initialize params"}
+		}
+	}
+
+	version := latestProtocolVersion
+	if slices.Contains(supportedProtocolVersions, p.ProtocolVersion) {
+		version = p.ProtocolVersion
+	}
+	log.Info().
+		Str("client", p.ClientInfo.Name).
+		Str("client_version", p.ClientInfo.Version).
+		Str("protocol", version).
+		Msg("MCP client initialized")
+
+	return map[string]any{
+		"protocolVersion": version,
+		"capabilities": map[string]any{
+			"tools": map[string]any{},
+		},
+		"serverInfo": map[string]string{
+			"name":    serverName,
+			"version": serverVersion,
+		},
+		"instructions": "Search and read a personal Messenger archive. Use search_messages to find " +
+			"relevant conversations, then get_conversation with the returned thread_id to read more.",
+	}, nil
+}
+
+func encodeResponse(resp rpcResponse) []byte {
+	resp.JSONRPC = "2.0"
+	out, err := json.Marshal(resp)
+	if err != nil {
+		out, _ = json.Marshal(rpcResponse{JSONRPC: "2.0", ID: resp.ID, Error: &rpcError{codeInternalError, "encoding response failed"}})
+	}
+	return out
+}
+
+// serveStdio reads newline-delimited messages from r and writes responses to w
+// until r is exhausted or ctx is done. Requests are handled concurrently so a
+// slow search doesn't block pings.
+func (s *server) serveStdio(ctx context.Context, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	lines := make(chan []byte)
+	scanErr := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		for scanner.Scan() {
+			line := append([]byte(nil), scanner.Bytes()...)
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+				return
+			}
+		}
+		scanErr <- scanner.Err()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case line, ok := <-lines:
+			if !ok {
+				select {
+				case err := <-scanErr:
+					return err
+				default:
+					return nil
+				}
+			}
+			if len(line) == 0 {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp := s.handleMessage(ctx, line)
+				if resp == nil {
+					return
+				}
+				writeMu.Lock()
+				defer writeMu.Unlock()
+				_, _ = w.Write(append(resp, '\n'))
+			}()
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/storage/storagetest"
+)
+
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	db := storagetest.NewArchive(t,
+		`INSERT INTO contacts (id, name, created_at, updated_at) VALUES (1, 'Alice', 0, 0), (2, 'Bob', 0, 0)`,
+		`INSERT INTO threads (id, thread_type, name, member_count, created_at, updated_at) VALUES (10, 1, 'Trip planning', 2, 0, 0)`,
+		`INSERT INTO thread_participants (thread_id, contact_id) VALUES (10, 1), (10, 2)`,
+		`INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms, created_at, source) VALUES
+			('ma', 10, 1, 'hello', 1000, 0, 'facebook-export'),
+			('mb', 10, 2, 'hello', 2000, 0, 'facebook-export'),
+			('mc', 10, 1, 'hello', 3000, 0, 'facebook-export')`,
+	)
+	return newServer(nil, db)
+}
+
+func TestServeStdio_Session(t *testing.T) {
+	srv := newTestServer(t)
+
+	in := strings.Join([]string{
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2024-11-05","clientInfo":{"name":"test"}}}`,
+		`{"jsonrpc":"2.0","method":"notifications/initialized"}`,
+		`{"jsonrpc":"2.0","id":2,"method":"tools/list"}`,
+		`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"get_thread_stats","arguments":{"thread_id":"10"}}}`,
+		`{"jsonrpc":"2.0","id":4,"method":"tools/call","params":{"name":"get_conversation","arguments":{"thread_id":"999"}}}`,
+		`{"jsonrpc":"2.0","id":5,"method":"nope"}`,
+	}, "\n") + "\n"
+
+	var out bytes.Buffer
+	if err := srv.serveStdio(context.Background(), strings.NewReader(in), &out); err != nil {
+		t.Fatalf("serveStdio: %v", err)
+	}
+
+	responses := map[string]map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var resp map[string]any
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			t.Fatalf("bad response line %q: %v", line, err)
+		}
+		id, _ := json.Marshal(resp["id"])
+		responses[string(id)] = resp
+	}
+	if len(responses) != 5 {
+		t.Fatalf("expected 5 responses (notification gets none), got %d: %s", len(responses), out.String())
+	}
+
+	init := responses["1"]["result"].(map[string]any)
+	if init["protocolVersion"] != "2024-11-05" {
+		t.Fatalf("protocol version not echoed: %v", init["protocolVersion"])
+	}
+
+	tools := responses["2"]["result"].(map[string]any)["tools"].([]any)
+	if len(tools) != 4 {
+		t.Fatalf("expected 4 tools, got %d", len(tools))
+	}
+
+	stats := responses["3"]["result"].(map[string]any)
+	if stats["isError"] == true {
+		t.Fatalf("get_thread_stats failed: %v", stats)
+	}
+	text := stats["content"].([]any)[0].(map[string]any)["text"].(string)
+	if !strings.Contains(text, `"message_count": 3`) || !strings.Contains(text, "Alice") {
+		t.Fatalf("unexpected stats: %s", text)
+	}
+
+	missing := responses["4"]["result"].(map[string]any)
+	if missing["isError"] != true {
+		t.Fatalf("expected isError for unknown thread, got %v", missing)
+	}
+
+	if code := responses["5"]["error"].(map[string]any)["code"].(float64); code != codeMethodNotFound {
+		t.Fatalf("expected method not found, got %v", code)
+	}
+}
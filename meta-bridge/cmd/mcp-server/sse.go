@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/httpauth"
+)
+
+const (
+	sseKeepAlive      = 30 * time.Second
+	sseMaxMessageSize = 4 << 20
+	sseSessionBuffer  = 32
+)
+
+// sseTransport implements the MCP HTTP+SSE transport: clients open GET /sse,
+// receive an "endpoint" event with a per-session POST URL, and get responses
+// to their POSTed requests as "message" events on the stream
+type sseTransport struct {
+	srv *server
+	// listenHost is the host the server listens on; requests must be
+	// addressed to it or to loopback
+	listenHost string
+	auth       *httpauth.Authenticator // nil = no credentials required
+
+	mu       sync.Mutex
+	sessions map[string]chan []byte
+}
+
+func newSSETransport(srv *server, addr string, auth *httpauth.Authenticator) *sseTransport {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return &sseTransport{srv: srv, listenHost: host, auth: auth, sessions: make(map[string]chan []byte)}
+}
+
+func (t *sseTransport) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sse", t.handleStream)
+	mux.HandleFunc("POST /message", t.handleMessage)
+	var h http.Handler = mux
+	if t.auth != nil {
+		h = t.auth.Middleware(h)
+	}
+	return t.checkOrigin(h)
+}
+
+// checkOrigin rejects requests addressed to a foreign host or sent from a
+// foreign web page. MCP clients send no Origin, so one that isn't local is
+// a browser, and a foreign Host is a DNS rebinding attempt against a
+// loopback listener.
+func (t *sseTransport) checkOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !t.allowedHost(r.Host, true) {
+			log.Warn().Str("host", r.Host).Msg("Rejected SSE request for a foreign host")
+			http.Error(w, "forbidden host", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || !t.allowedHost(u.Host, false) {
+				log.Warn().Str("origin", origin).Msg("Rejected SSE request from a foreign origin")
+				http.Error(w, "forbidden origin", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost reports whether hostport names this server: a loopback host
+// or the listen host. With a wildcard listen address any Host is accepted,
+// but origins must still be local or the listen host.
+func (t *sseTransport) allowedHost(hostport string, isHostHeader bool) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	host = strings.Trim(host, "[]")
+	if httpauth.IsLoopback(host) || (t.listenHost != "" && strings.EqualFold(host, t.listenHost)) {
+		return true
+	}
+	if !isHostHeader {
+		return false
+	}
+	ip := net.ParseIP(t.listenHost)
+	return t.listenHost == "" || (ip != nil && ip.IsUnspecified())
+}
+
+// handleStream serves one session's event stream until the client disconnects
+func (t *sseTransport) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	id := newSessionID()
+	out := make(chan []byte, sseSessionBuffer)
+	t.mu.Lock()
+	t.sessions[id] = out
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.sessions, id)
+		t.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "event: endpoint\ndata: /message?sessionId=%s\n\n", id)
+	flusher.Flush()
+	log.Debug().Str("session", id).Msg("SSE session opened")
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Debug().Str("session", id).Msg("SSE session closed")
+			return
+		case msg := <-out:
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", msg)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// handleMessage accepts a JSON-RPC message for a session. The response is
+// delivered on the session's stream, so the POST itself returns 202.
+func (t *sseTransport) handleMessage(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("sessionId")
+	t.mu.Lock()
+	out, ok := t.sessions[id]
+	t.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, sseMaxMessageSize))
+	if err != nil {
+		http.Error(w, "reading body failed", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	// Handle in the background with a context that outlives this POST; the
+	// buffered session channel absorbs responses while the stream catches up
+	go func() {
+		resp := t.srv.handleMessage(context.WithoutCancel(r.Context()), body)
+		if resp == nil {
+			return
+		}
+		select {
+		case out <- resp:
+		case <-time.After(sseKeepAlive):
+			log.Warn().Str("session", id).Msg("Dropping MCP response for stalled SSE session")
+		}
+	}()
+}
+
+func newSessionID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/httpauth"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestSSEOriginCheck(t *testing.T) {
+	h := newSSETransport(nil, "127.0.0.1:8091", nil).handler()
+	// A request that passes the checks reaches the mux and fails there on
+	// the unknown session
+	do := func(host, origin string) int {
+		req := httptest.NewRequest(http.MethodPost, "/message?sessionId=none", nil)
+		req.Host = host
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, tc := range []struct {
+		host, origin string
+		want         int
+	}{
+		{"127.0.0.1:8091", "", http.StatusNotFound},
+		{"localhost:8091", "http://localhost:3000", http.StatusNotFound},
+		{"[::1]:8091", "", http.StatusNotFound},
+		{"attacker.example:8091", "", http.StatusForbidden},
+		{"127.0.0.1:8091", "http://attacker.example", http.StatusForbidden},
+		{"127.0.0.1:8091", "null", http.StatusForbidden},
+	} {
+		if got := do(tc.host, tc.origin); got != tc.want {
+			t.Errorf("Host %q, Origin %q: status %d, want %d", tc.host, tc.origin, got, tc.want)
+		}
+	}
+
+	// A wildcard listener accepts any Host, but still no foreign origins
+	h = newSSETransport(nil, "0.0.0.0:8091", nil).handler()
+	if got := do("192.168.1.5:8091", ""); got != http.StatusNotFound {
+		t.Errorf("wildcard listener, LAN host: status %d", got)
+	}
+	if got := do("192.168.1.5:8091", "http://attacker.example"); got != http.StatusForbidden {
+		t.Errorf("wildcard listener, foreign origin: status %d", got)
+	}
+}
+
+func TestSSEAuth(t *testing.T) {
+	auth, err := httpauth.New(ragconfig.AuthConfig{
+		Keys: []ragconfig.APIKeyConfig{{Name: "desktop", Key: "k1"}},
+	}, "mcp-server", nil)
+	if err != nil {
+		t.Fatalf("httpauth.New: %v", err)
+	}
+	h := newSSETransport(nil, "127.0.0.1:8091", auth).handler()
+	do := func(key string) int {
+		req := httptest.NewRequest(http.MethodPost, "http://127.0.0.1:8091/message?sessionId=none", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if got := do(""); got != http.StatusUnauthorized {
+		t.Errorf("no key: status %d, want 401", got)
+	}
+	if got := do("nope"); got != http.StatusUnauthorized {
+		t.Errorf("wrong key: status %d, want 401", got)
+	}
+	if got := do("k1"); got != http.StatusNotFound {
+		t.Errorf("valid key: status %d, want 404 for the unknown session", got)
+	}
+}
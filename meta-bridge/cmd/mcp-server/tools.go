@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/rag"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+const (
+	defaultSearchLimit       = 10
+	maxSearchLimit           = 50
+	defaultConversationLimit = 50
+	maxConversationLimit     = 200
+	defaultThreadsLimit      = 20
+	maxThreadsLimit          = 200
+	threadStatsTopSenders    = 10
+)
+
+// tool is an MCP tool definition plus its handler
+type tool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+
+	call func(ctx context.Context, args json.RawMessage) (any, error) `json:"-"`
+}
+
+// toolResult is the tools/call result: a single text block
+type toolResult struct {
+	Content []toolContent `json:"content"`
+	IsError bool          `json:"isError,omitempty"`
+}
+
+type toolContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// toolInputError is returned by handlers for bad arguments; the message is
+// shown to the model so it can correct the call
+type toolInputError struct{ msg string }
+
+func (e *toolInputError) Error() string { return e.msg }
+
+func inputErrorf(format string, args ...any) error {
+	return &toolInputError{fmt.Sprintf(format, args...)}
+}
+
+// threadIDArg accepts thread IDs as strings (precision-safe) or numbers
+type threadIDArg int64
+
+func (t *threadIDArg) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("thread_id must be a numeric string")
+	}
+	*t = threadIDArg(id)
+	return nil
+}
+
+var threadIDSchema = map[string]any{
+	"type":        "string",
+	"description": "Thread ID as returned by search_messages or list_threads",
+	"pattern":     "^[0-9]+$",
+}
+
+func (s *server) registerTools() []tool {
+	return []tool{
+		{
+			Name: "search_messages",
+			Description: "Search the Messenger archive. Returns matching conversation chunks " +
+				"(several consecutive messages) with thread, participants and time range.",
+			InputSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"query": map[string]any{"type": "string", "description": "What to look for, in natural language or keywords"},
+					"mode": map[string]any{
+						"type": "string",
+						"enum": []string{"hybrid", "vector", "bm25", "hyde"},
+						"description": "hybrid (default) combines semantic and keyword search; bm25 is keyword only; " +
+							"hyde searches near an answer the model imagines, slower but better for vague questions",
+					},
+					"limit":       map[string]any{"type": "integer", "minimum": 1, "maximum": maxSearchLimit, "default": defaultSearchLimit},
+					"tags":        map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "description": "Only search threads with any of these tags"},
+					"lang":        map[string]any{"type": "string", "description": "Query language code (e.g. pl, en); detected when omitted"},
+					"context":     map[string]any{"type": "integer", "minimum": 0, "maximum": 3, "description": "Neighbouring chunks to include around each hit"},
+					"thread_id":   threadIDSchema,
+					"thread_name": map[string]any{"type": "string", "description": "Only the chat with this name, or part of it; an ambiguous name is an error listing the chats it matches"},
+					"sender":      map[string]any{"type": "string", "description": "Only chunks with a message from a sender whose name contains this (case-sensitive)"},
+					"after":       map[string]any{"type": "string", "description": "Only chunks at or after this time (RFC3339 or YYYY, YYYY-MM, YYYY-MM-DD)"},
+					"before":      map[string]any{"type": "string", "description": "Only chunks before this time (exclusive; same formats as after)"},
+					"source":      map[string]any{"type": "string", "description": "Only chunks with messages from this source: live (synced by the bridge), export (any imported export), facebook-export, messenger-export, import-sample, ..."},
+					"match_mode": map[string]any{
+						"type":        "string",
+						"enum":        []string{"terms", "verbatim"},
+						"description": "terms (default) matches any analyzed word; verbatim matches the whole query as an exact phrase including digits, for codes, account numbers and addresses",
+					},
+					"include_low_quality": map[string]any{
+						"type":        "boolean",
+						"description": "Also keyword-search short or noisy chunks that are normally skipped; use for exact strings like codes, numbers or addresses",
+					},
+					"sort": map[string]any{
+						"type":        "string",
+						"enum":        []string{"relevance", "recent"},
+						"description": "relevance (default) or recent: the best matches, newest first; use when the latest state of a topic matters, like what was finally decided",
+					},
+				},
+				"required": []string{"query"},
+			},
+			call: s.searchMessages,
+		},
+		{
+			Name:        "get_conversation",
+			Description: "Read messages of a thread in chronological order, optionally ending before a point in time.",
+			InputSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"thread_id": threadIDSchema,
+					"before":    map[string]any{"type": "string", "description": "Only messages before this time (RFC3339 or unix ms)"},
+					"limit":     map[string]any{"type": "integer", "minimum": 1, "maximum": maxConversationLimit, "default": defaultConversationLimit},
+				},
+				"required": []string{"thread_id"},
+			},
+			call: s.getConversation,
+		},
+		{
+			Name:        "get_thread_stats",
+			Description: "Summarize a thread: name, participants, message count, first/last activity and most active senders.",
+			InputSchema: map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"thread_id": threadIDSchema},
+				"required":   []string{"thread_id"},
+			},
+			call: s.getThreadStats,
+		},
+		{
+			Name:        "list_threads",
+			Description: "List the most recently active threads with their IDs.",
+			InputSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"limit": map[string]any{"type": "integer", "minimum": 1, "maximum": maxThreadsLimit, "default": defaultThreadsLimit},
+				},
+			},
+			call: s.listThreads,
+		},
+	}
+}
+
+// callTool runs a tools/call request. Tool failures are reported in the
+// result (isError) so the model sees them; protocol errors are JSON-RPC errors.
+func (s *server) callTool(ctx context.Context, params json.RawMessage) (any, error) {
+	var p struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, &rpcError{codeInvalidParams, "invalid tools/call params"}
+	}
+	idx := slices.IndexFunc(s.tools, func(t tool) bool { return t.Name == p.Name })
+	if idx < 0 {
+		return nil, &rpcError{codeInvalidParams, "unknown tool: " + p.Name}
+	}
+	if len(p.Arguments) == 0 || string(p.Arguments) == "null" {
+		p.Arguments = json.RawMessage("{}")
+	}
+
+	out, err := s.tools[idx].call(ctx, p.Arguments)
+	if err != nil {
+		msg := toolErrorMessage(err)
+		return toolResult{Content: []toolContent{{Type: "text", Text: msg}}, IsError: true}, nil
+	}
+	text, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return toolResult{Content: []toolContent{{Type: "text", Text: string(text)}}}, nil
+}
+
+// toolErrorMessage keeps internal details out of model-visible errors
+func toolErrorMessage(err error) string {
+	var inputErr *toolInputError
+	switch {
+	case errors.As(err, &inputErr), errors.Is(err, rag.ErrBadRequest):
+		return err.Error()
+	case errors.Is(err, rag.ErrNotFound):
+		return "not found"
+	case errors.Is(err, rag.ErrUnavailable):
+		return "search backend unavailable, try mode bm25"
+	default:
+		return "tool failed: internal error"
+	}
+}
+
+func decodeArgs(args json.RawMessage, v any) error {
+	if err := json.Unmarshal(args, v); err != nil {
+		return inputErrorf("invalid arguments: %v", err)
+	}
+	return nil
+}
+
+// searchHit is a compact search result for models
+type searchHit struct {
+	ThreadID     int64    `json:"thread_id,string"`
+	ThreadName   string   `json:"thread_name,omitempty"`
+	Participants []string `json:"participants"`
+	Start        string   `json:"start"`
+	End          string   `json:"end"`
+	Score        float64  `json:"score"`
+	Text         string   `json:"text"`
+	Before       []string `json:"context_before,omitempty"`
+	After        []string `json:"context_after,omitempty"`
+}
+
+func (s *server) searchMessages(ctx context.Context, args json.RawMessage) (any, error) {
+	var a struct {
+		Query   string   `json:"query"`
+		Mode    string   `json:"mode"`
+		Limit   int      `json:"limit"`
+		Tags    []string `json:"tags"`
+		Lang    string   `json:"lang"`
+		Context int      `json:"context"`
+
+		ThreadID   threadIDArg `json:"thread_id"`
+		ThreadName string      `json:"thread_name"`
+		Sender     string      `json:"sender"`
+		After      string      `json:"after"`
+		Before     string      `json:"before"`
+		Source     string      `json:"source"`
+
+		MatchMode         string `json:"match_mode"`
+		IncludeLowQuality bool   `json:"include_low_quality"`
+		Sort              string `json:"sort"`
+	}
+	if err := decodeArgs(args, &a); err != nil {
+		return nil, err
+	}
+	tags, err := storage.NormalizeTags(a.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	req := rag.SearchRequest{
+		Query:   rag.SanitizeQuery(a.Query),
+		Mode:    rag.SearchMode(a.Mode),
+		Limit:   clampInt(a.Limit, defaultSearchLimit, 1, maxSearchLimit),
+		Context: clampInt(a.Context, 0, 0, 3),
+		Tags:    tags,
+		Lang:    a.Lang,
+
+		ThreadID:   int64(a.ThreadID),
+		ThreadName: strings.TrimSpace(a.ThreadName),
+		Sender:     strings.TrimSpace(a.Sender),
+		After:      a.After,
+		Before:     a.Before,
+		Source:     strings.ToLower(strings.TrimSpace(a.Source)),
+
+		MatchMode:         rag.MatchMode(a.MatchMode),
+		IncludeLowQuality: a.IncludeLowQuality,
+		Sort:              rag.SortOrder(a.Sort),
+	}
+	if req.Mode == "" {
+		req.Mode = rag.ModeHybrid
+	}
+	if err := rag.ValidateSearchRequest(&req); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.svc.Search(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]any{"query": resp.Query, "mode": resp.Mode, "results": toSearchHits(resp.Results)}
+	if len(resp.LowQualityResults) > 0 {
+		out["low_quality_results"] = toSearchHits(resp.LowQualityResults)
+	}
+	return out, nil
+}
+
+func toSearchHits(results []rag.Hit) []searchHit {
+	hits := make([]searchHit, 0, len(results))
+	for _, h := range results {
+		hit := searchHit{
+			ThreadID:     h.ThreadID,
+			ThreadName:   h.ThreadName,
+			Participants: h.ParticipantNames,
+			Start:        formatMs(h.StartTimestampMs),
+			End:          formatMs(h.EndTimestampMs),
+			Text:         h.Text,
+		}
+		switch {
+		case h.RrfScore != nil:
+			hit.Score = *h.RrfScore
+		case h.VectorScore != nil:
+			hit.Score = *h.VectorScore
+		case h.BM25Score != nil:
+			hit.Score = *h.BM25Score
+		}
+		for _, c := range h.ContextBefore {
+			hit.Before = append(hit.Before, c.Text)
+		}
+		for _, c := range h.ContextAfter {
+			hit.After = append(hit.After, c.Text)
+		}
+		hits = append(hits, hit)
+	}
+	return hits
+}
+
+// conversationMessage is one message of a get_conversation result
+type conversationMessage struct {
+	ID     string `json:"id"`
+	Sender string `json:"sender"`
+	Time   string `json:"time"`
+	Text   string `json:"text"`
+}
+
+func (s *server) getConversation(ctx context.Context, args json.RawMessage) (any, error) {
+	var a struct {
+		ThreadID threadIDArg `json:"thread_id"`
+		Before   string      `json:"before"`
+		Limit    int         `json:"limit"`
+	}
+	if err := decodeArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if a.ThreadID == 0 {
+		return nil, inputErrorf("thread_id is required")
+	}
+	var before int64
+	if a.Before != "" {
+		var err error
+		if before, err = parseTime(a.Before); err != nil {
+			return nil, inputErrorf("invalid before (RFC3339 or unix ms)")
+		}
+	}
+	limit := clampInt(a.Limit, defaultConversationLimit, 1, maxConversationLimit)
+
+	msgs, err := storage.GetConversation(s.db, int64(a.ThreadID), limit, before)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		if _, err := storage.GetThreadStats(s.db, int64(a.ThreadID), 0); err != nil {
+			return nil, err
+		}
+	}
+
+	// Queried newest first; models read chronologically
+	out := make([]conversationMessage, 0, len(msgs))
+	threadName := ""
+	for i := len(msgs) - 1; i >= 0; i-- {
+		m := msgs[i]
+		threadName = m.ThreadName
+		sender := m.SenderName
+		if sender == "" {
+			sender = strconv.FormatInt(m.SenderID, 10)
+		}
+		out = append(out, conversationMessage{ID: m.ID, Sender: sender, Time: formatMs(m.TimestampMs), Text: m.Text})
+	}
+	return map[string]any{
+		"thread_id":   strconv.FormatInt(int64(a.ThreadID), 10),
+		"thread_name": threadName,
+		"messages":    out,
+		"has_more":    len(msgs) == limit,
+	}, nil
+}
+
+func (s *server) getThreadStats(ctx context.Context, args json.RawMessage) (any, error) {
+	var a struct {
+		ThreadID threadIDArg `json:"thread_id"`
+	}
+	if err := decodeArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if a.ThreadID == 0 {
+		return nil, inputErrorf("thread_id is required")
+	}
+
+	st, err := storage.GetThreadStats(s.db, int64(a.ThreadID), threadStatsTopSenders)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"stats":         st,
+		"first_message": formatMs(st.FirstMessageMs),
+		"last_message":  formatMs(st.LastMessageMs),
+	}, nil
+}
+
+// threadSummary is one entry of a list_threads result
+type threadSummary struct {
+	ThreadID     int64  `json:"thread_id,string"`
+	Name         string `json:"name"`
+	MemberCount  int64  `json:"member_count"`
+	LastActivity string `json:"last_activity"`
+}
+
+func (s *server) listThreads(ctx context.Context, args json.RawMessage) (any, error) {
+	var a struct {
+		Limit int `json:"limit"`
+	}
+	if err := decodeArgs(args, &a); err != nil {
+		return nil, err
+	}
+
+	threads, err := storage.ListThreads(s.db, clampInt(a.Limit, defaultThreadsLimit, 1, maxThreadsLimit))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]threadSummary, 0, len(threads))
+	for _, t := range threads {
+		out = append(out, threadSummary{
+			ThreadID:     t.ID,
+			Name:         t.Name,
+			MemberCount:  t.MemberCount,
+			LastActivity: formatMs(t.LastActivityMs),
+		})
+	}
+	return map[string]any{"threads": out}, nil
+}
+
+// clampInt returns def for unset (zero) values, otherwise v limited to [lo, hi]
+func clampInt(v, def, lo, hi int) int {
+	if v == 0 {
+		v = def
+	}
+	return max(lo, min(v, hi))
+}
+
+// parseTime accepts unix milliseconds or RFC3339
+func parseTime(s string) (int64, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
+
+func formatMs(ms int64) string {
+	if ms <= 0 {
+		return ""
+	}
+	return time.UnixMilli(ms).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,263 @@
+// media-sync downloads attachment files before their CDN URLs expire.
+//
+// messenger-cli only stores attachment URLs, which stop working after a
+// while. media-sync fetches attachments without a local file into the
+// content-addressed store under media.attachments_dir (see pkg/media) and
+// records the path in attachments.local_path, where rag-server's /media
+// endpoint finds it. Newest attachments are fetched first.
+//
+// Expired URLs (403/404/410) are recorded in attachments.download_error and
+// skipped until messenger-cli stores a fresh URL or --retry-failed is given.
+//
+// Downloads are throttled by media.downloads in rag.yaml (total and per-host
+// concurrency and request rate, backoff on 429/503), shared with avatar-sync.
+//
+// E2EE attachments have no URL: they are downloaded and decrypted through
+// whatsmeow by messenger-cli when run with -media-dir, which needs the E2EE
+// connection. media-sync only reports how many are pending.
+//
+// Usage:
+//
+//	media-sync --db messenger.db
+//	media-sync --db messenger.db --interval 10m  # keep running
+//	media-sync --db messenger.db --retry-failed
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/media"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	dbPath      = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile   = storage.KeyFileFlag()
+	cfgPath     = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	outputDir   = flag.String("dir", "", "Attachment store directory (defaults to media.attachments_dir from config)")
+	concurrent  = flag.Int("concurrent", 0, "Number of concurrent downloads (overrides media.downloads.concurrency)")
+	limit       = flag.Int("limit", 1000, "Maximum attachments downloaded per pass")
+	interval    = flag.Duration("interval", 0, "Run a pass every interval instead of once")
+	retryFailed = flag.Bool("retry-failed", false, "Retry attachments whose last download failed")
+	debug       = flag.Bool("debug", false, "Enable debug logging")
+)
+
+// errExpired marks downloads refused by the CDN because the signed URL expired
+var errExpired = errors.New("URL expired")
+
+type result struct {
+	downloaded, failed, expired int
+}
+
+func main() {
+	flag.Parse()
+
+	// Setup logging
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	// Load configuration
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+	dir := *outputDir
+	if dir == "" {
+		dir = cfg.Media.AttachmentsDir
+	}
+	if dir == "" {
+		log.Fatal().Msg("Attachment directory is empty (set -dir or media.attachments_dir in rag.yaml)")
+	}
+
+	store, err := storage.New(sqlitePath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open database")
+	}
+	defer store.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	downloads := cfg.Media.Downloads
+	if *concurrent > 0 {
+		downloads.Concurrency = *concurrent
+	}
+	d := &downloader{
+		store:    store,
+		client:   &http.Client{Timeout: 2 * time.Minute},
+		throttle: media.NewThrottle(downloads),
+		dir:      dir,
+	}
+
+	for {
+		d.pass(ctx)
+		if *interval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("Shutting down")
+			return
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// downloader is the state shared by all passes
+type downloader struct {
+	store    *storage.Storage
+	client   *http.Client
+	throttle *media.Throttle
+	dir      string
+}
+
+// pass downloads one batch of pending attachments and logs the outcome
+func (d *downloader) pass(ctx context.Context) {
+	start := time.Now()
+	pending, err := d.store.GetPendingAttachments(*limit, false, *retryFailed)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list pending attachments")
+		return
+	}
+
+	var res result
+	if len(pending) > 0 {
+		log.Info().Int("attachments", len(pending)).Str("dir", d.dir).Msg("Downloading attachments")
+		res = d.downloadAll(ctx, pending)
+	}
+
+	plain, e2ee, err := d.store.CountPendingAttachments()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to count pending attachments")
+	}
+	log.Info().
+		Int("downloaded", res.downloaded).
+		Int("failed", res.failed).
+		Int("expired", res.expired).
+		Int64("remaining", plain).
+		Dur("took", time.Since(start)).
+		Msg("Pass done")
+	if e2ee > 0 {
+		log.Info().Int64("count", e2ee).Msg("E2EE attachments pending (downloaded by messenger-cli -media-dir)")
+	}
+}
+
+// downloadAll fetches pending with as many workers as the throttle allows
+// downloads at once
+func (d *downloader) downloadAll(ctx context.Context, pending []storage.PendingAttachment) result {
+	var (
+		res result
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+	)
+	jobs := make(chan storage.PendingAttachment)
+	for range d.throttle.Concurrency() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range jobs {
+				err := d.download(ctx, a)
+				mu.Lock()
+				switch {
+				case err == nil:
+					res.downloaded++
+				case errors.Is(err, errExpired):
+					res.expired++
+				default:
+					res.failed++
+				}
+				mu.Unlock()
+				if err != nil && ctx.Err() == nil {
+					log.Debug().Err(err).Str("attachment", a.ID).Msg("Download failed")
+				}
+			}
+		}()
+	}
+
+	for _, a := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- a
+	}
+	close(jobs)
+	wg.Wait()
+	return res
+}
+
+// download stores one attachment and records the result. Failures other than
+// cancellation are recorded so the next pass moves on to other attachments.
+func (d *downloader) download(ctx context.Context, a storage.PendingAttachment) error {
+	err := d.fetch(ctx, a)
+	if err != nil && ctx.Err() == nil {
+		if recErr := d.store.SetAttachmentDownloadError(a.ID, err.Error()); recErr != nil {
+			log.Warn().Err(recErr).Str("attachment", a.ID).Msg("Failed to record download error")
+		}
+	}
+	return err
+}
+
+func (d *downloader) fetch(ctx context.Context, a storage.PendingAttachment) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.URL, nil)
+	if err != nil {
+		return err
+	}
+	release, err := d.throttle.Wait(ctx, req.URL.Host)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	d.throttle.Observe(req.URL.Host, resp)
+
+	if resp.StatusCode != http.StatusOK {
+		if media.IsExpiredURLStatus(resp.StatusCode) {
+			return fmt.Errorf("%w (HTTP %d)", errExpired, resp.StatusCode)
+		}
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	mimeType := a.MimeType
+	if mimeType == "" {
+		mimeType = resp.Header.Get("Content-Type")
+	}
+	relPath, sum, size, err := media.Put(d.dir, resp.Body, media.Extension(a.Filename, mimeType))
+	if err != nil {
+		return err
+	}
+	return d.store.SetAttachmentDownloaded(a.ID, relPath, sum, size)
+}
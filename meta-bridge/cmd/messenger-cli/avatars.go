@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/socket"
+)
+
+const (
+	// avatarRefreshBatchSize caps how many contacts are requested per tick.
+	avatarRefreshBatchSize = 20
+	// avatarRefreshRetryAfter is how long to wait before re-requesting a contact
+	// whose URL is still failing.
+	avatarRefreshRetryAfter = 6 * time.Hour
+)
+
+// runAvatarRefresh periodically requests fresh contact info for contacts whose
+// avatar download failed (see avatar-sync). The resulting LSDeleteThenInsertContact
+// rows update profile_picture_url and clear the queue entry.
+func (app *App) runAvatarRefresh(ctx context.Context, interval time.Duration) {
+	log := app.log.With().Str("component", "avatar-refresh").Logger()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		app.refreshExpiredAvatars(ctx)
+
+		select {
+		case <-ctx.Done():
+			log.Debug().Msg("Avatar refresh stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *App) refreshExpiredAvatars(ctx context.Context) {
+	log := app.log.With().Str("component", "avatar-refresh").Logger()
+
+	if !app.client.IsConnected() {
+		return
+	}
+
+	cutoff := time.Now().Add(-avatarRefreshRetryAfter).UnixMilli()
+	pending, err := app.store.GetPendingAvatarRefreshes(cutoff, avatarRefreshBatchSize)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load pending avatar refreshes")
+		return
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	tasks := make([]socket.Task, 0, len(pending))
+	ids := make([]int64, 0, len(pending))
+	for _, p := range pending {
+		tasks = append(tasks, &socket.GetContactsFullTask{ContactID: p.ContactID})
+		ids = append(ids, p.ContactID)
+	}
+
+	// Mark first so a failing request doesn't get retried every tick
+	if err := app.store.MarkAvatarRefreshRequested(ids); err != nil {
+		log.Warn().Err(err).Msg("Failed to mark avatar refreshes as requested")
+	}
+
+	tbl, err := app.client.ExecuteTasks(ctx, tasks...)
+	if err != nil {
+		log.Warn().Err(err).Int("count", len(tasks)).Msg("Failed to request fresh contact info")
+		return
+	}
+
+	app.handleTable(tbl)
+	log.Info().Int("count", len(tasks)).Msg("Requested fresh contact info for expired avatars")
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/socket"
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+)
+
+const (
+	// gapSlackMs tolerates small differences between the thread's last activity
+	// and its newest message (activity is bumped slightly after the message).
+	gapSlackMs = 2000
+	// gapQueueSize bounds pending backfills; further gaps are picked up on the
+	// next thread update for that thread.
+	gapQueueSize = 256
+)
+
+// syncGap is a thread whose server-side last activity is newer than the newest
+// stored message, e.g. after downtime
+type syncGap struct {
+	threadID       int64
+	lastActivityMs int64
+	storedMaxMs    int64
+}
+
+// gapBackfiller fetches the missing message range of threads with sync gaps,
+// one thread at a time
+type gapBackfiller struct {
+	queue chan syncGap
+
+	mu       sync.Mutex
+	inFlight map[int64]struct{}
+}
+
+func newGapBackfiller() *gapBackfiller {
+	return &gapBackfiller{
+		queue:    make(chan syncGap, gapQueueSize),
+		inFlight: make(map[int64]struct{}),
+	}
+}
+
+// detectSyncGaps queues threads from tbl whose last activity is ahead of the
+// stored messages. Called after the table's messages have been stored.
+func (app *App) detectSyncGaps(tbl *table.LSTable) {
+	if app.backfill == nil {
+		return
+	}
+
+	activity := make(map[int64]int64)
+	for _, t := range tbl.LSDeleteThenInsertThread {
+		activity[t.ThreadKey] = max(activity[t.ThreadKey], t.LastActivityTimestampMs)
+	}
+	for _, t := range tbl.LSUpdateOrInsertThread {
+		activity[t.ThreadKey] = max(activity[t.ThreadKey], t.LastActivityTimestampMs)
+	}
+
+	for threadID, lastActivity := range activity {
+		storedMax, err := app.store.LastMessageTimestamp(threadID)
+		if err != nil {
+			app.log.Warn().Err(err).Int64("thread", threadID).Msg("Failed to check thread for sync gap")
+			continue
+		}
+		// Threads without stored messages are new to us, not gaps
+		if storedMax == 0 || lastActivity <= storedMax+gapSlackMs {
+			continue
+		}
+		app.backfill.enqueue(app, syncGap{threadID: threadID, lastActivityMs: lastActivity, storedMaxMs: storedMax})
+	}
+}
+
+func (b *gapBackfiller) enqueue(app *App, gap syncGap) {
+	b.mu.Lock()
+	if _, ok := b.inFlight[gap.threadID]; ok {
+		b.mu.Unlock()
+		return
+	}
+	b.inFlight[gap.threadID] = struct{}{}
+	b.mu.Unlock()
+
+	select {
+	case b.queue <- gap:
+		app.log.Debug().
+			Int64("thread", gap.threadID).
+			Time("stored_until", time.UnixMilli(gap.storedMaxMs)).
+			Time("last_activity", time.UnixMilli(gap.lastActivityMs)).
+			Msg("Sync gap detected")
+	default:
+		b.done(gap.threadID)
+		app.log.Debug().Int64("thread", gap.threadID).Msg("Backfill queue full, skipping sync gap")
+	}
+}
+
+func (b *gapBackfiller) done(threadID int64) {
+	b.mu.Lock()
+	delete(b.inFlight, threadID)
+	b.mu.Unlock()
+}
+
+// runGapBackfill processes queued sync gaps until ctx is done
+func (app *App) runGapBackfill(ctx context.Context, delay time.Duration, maxPages int) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case gap := <-app.backfill.queue:
+			app.backfillGap(ctx, gap, maxPages)
+			app.backfill.done(gap.threadID)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
+// backfillGap pages backwards from the thread's last activity until it reaches
+// the newest message stored before the gap
+func (app *App) backfillGap(ctx context.Context, gap syncGap, maxPages int) {
+	log := app.log.With().Str("component", "backfill").Int64("thread", gap.threadID).Logger()
+
+	refTimestamp := gap.lastActivityMs + 1
+	refMessageID := ""
+	pages := 0
+	for ; pages < maxPages; pages++ {
+		if !app.client.IsConnected() {
+			log.Debug().Msg("Not connected, postponing backfill")
+			return
+		}
+
+		tbl, err := app.client.ExecuteTasks(ctx, &socket.FetchMessagesTask{
+			ThreadKey:            gap.threadID,
+			Direction:            0,
+			ReferenceTimestampMs: refTimestamp,
+			ReferenceMessageId:   refMessageID,
+			SyncGroup:            1,
+			Cursor:               app.client.GetCursor(1),
+		})
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to fetch messages for sync gap")
+			break
+		}
+		app.handleTable(tbl)
+
+		oldestTs, oldestID := oldestFetchedMessage(tbl, gap.threadID)
+		if oldestID == "" || oldestTs >= refTimestamp {
+			break // Nothing (new) returned
+		}
+		if oldestTs <= gap.storedMaxMs || !hasMoreBefore(tbl, gap.threadID) {
+			pages++
+			break
+		}
+		refTimestamp, refMessageID = oldestTs, oldestID
+	}
+
+	recovered, err := app.store.CountMessagesAfter(gap.threadID, gap.storedMaxMs)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to count backfilled messages")
+		return
+	}
+	log.Info().
+		Int64("recovered", recovered).
+		Int("pages", pages).
+		Time("from", time.UnixMilli(gap.storedMaxMs)).
+		Time("to", time.UnixMilli(gap.lastActivityMs)).
+		Msg("Backfilled sync gap")
+}
+
+func oldestFetchedMessage(tbl *table.LSTable, threadID int64) (int64, string) {
+	oldestTs := int64(math.MaxInt64)
+	oldestID := ""
+	for _, m := range tbl.LSUpsertMessage {
+		if m.ThreadKey == threadID && m.TimestampMs < oldestTs {
+			oldestTs, oldestID = m.TimestampMs, m.MessageId
+		}
+	}
+	for _, m := range tbl.LSInsertMessage {
+		if m.ThreadKey == threadID && m.TimestampMs < oldestTs {
+			oldestTs, oldestID = m.TimestampMs, m.MessageId
+		}
+	}
+	return oldestTs, oldestID
+}
+
+// hasMoreBefore reports whether the server said older messages exist; when
+// the response carries no range info, assume it does
+func hasMoreBefore(tbl *table.LSTable, threadID int64) bool {
+	for _, r := range tbl.LSInsertNewMessageRange {
+		if r.ThreadKey == threadID {
+			return r.HasMoreBefore
+		}
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waConsumerApplication"
+	"go.mau.fi/whatsmeow/proto/waMediaTransport"
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-meta/pkg/media"
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+const (
+	// e2eeMediaBatchSize caps how many pending E2EE attachments are fetched per pass
+	e2eeMediaBatchSize = 100
+	// e2eeMediaTimeout bounds a single download and decrypt
+	e2eeMediaTimeout = 2 * time.Minute
+)
+
+// e2eeAttachment extracts the attachment of an E2EE message, if any, along
+// with its caption. The media keys are kept so the file can be downloaded
+// later; they are the only way to decrypt it.
+func e2eeAttachment(messageID string, content *waConsumerApplication.ConsumerApplication_Content) (*storage.E2EEAttachment, string, error) {
+	att := &storage.E2EEAttachment{ID: messageID, MessageID: messageID}
+	var transport *waMediaTransport.WAMediaTransport
+	var caption string
+
+	switch inner := content.GetContent().(type) {
+	case *waConsumerApplication.ConsumerApplication_Content_ImageMessage:
+		dec, err := inner.ImageMessage.Decode()
+		if err != nil {
+			return nil, "", err
+		}
+		transport = dec.GetIntegral().GetTransport()
+		att.AttachmentType = int64(table.AttachmentTypeImage)
+		att.MediaType = string(whatsmeow.MediaImage)
+		att.Width = int64(dec.GetAncillary().GetWidth())
+		att.Height = int64(dec.GetAncillary().GetHeight())
+		caption = inner.ImageMessage.GetCaption().GetText()
+	case *waConsumerApplication.ConsumerApplication_Content_VideoMessage:
+		dec, err := inner.VideoMessage.Decode()
+		if err != nil {
+			return nil, "", err
+		}
+		transport = dec.GetIntegral().GetTransport()
+		att.AttachmentType = int64(table.AttachmentTypeVideo)
+		att.MediaType = string(whatsmeow.MediaVideo)
+		att.Width = int64(dec.GetAncillary().GetWidth())
+		att.Height = int64(dec.GetAncillary().GetHeight())
+		att.DurationMs = int64(dec.GetAncillary().GetSeconds()) * 1000
+		caption = inner.VideoMessage.GetCaption().GetText()
+	case *waConsumerApplication.ConsumerApplication_Content_AudioMessage:
+		dec, err := inner.AudioMessage.Decode()
+		if err != nil {
+			return nil, "", err
+		}
+		transport = dec.GetIntegral().GetTransport()
+		att.AttachmentType = int64(table.AttachmentTypeAudio)
+		att.MediaType = string(whatsmeow.MediaAudio)
+		att.DurationMs = int64(dec.GetAncillary().GetSeconds()) * 1000
+	case *waConsumerApplication.ConsumerApplication_Content_DocumentMessage:
+		dec, err := inner.DocumentMessage.Decode()
+		if err != nil {
+			return nil, "", err
+		}
+		transport = dec.GetIntegral().GetTransport()
+		att.AttachmentType = int64(table.AttachmentTypeFile)
+		att.MediaType = string(whatsmeow.MediaDocument)
+		att.Filename = inner.DocumentMessage.GetFileName()
+	case *waConsumerApplication.ConsumerApplication_Content_StickerMessage:
+		dec, err := inner.StickerMessage.Decode()
+		if err != nil {
+			return nil, "", err
+		}
+		transport = dec.GetIntegral().GetTransport()
+		att.AttachmentType = int64(table.AttachmentTypeSticker)
+		att.MediaType = string(whatsmeow.MediaImage)
+	default:
+		return nil, "", nil
+	}
+
+	if transport.GetIntegral().GetDirectPath() == "" {
+		return nil, caption, fmt.Errorf("no direct path in media transport")
+	}
+	att.MimeType = transport.GetAncillary().GetMimetype()
+	att.FileSize = int64(transport.GetAncillary().GetFileLength())
+	raw, err := proto.Marshal(transport)
+	if err != nil {
+		return nil, caption, err
+	}
+	att.Media = raw
+	return att, caption, nil
+}
+
+// downloadPendingE2EEMedia fetches stored E2EE attachments without a local
+// file, e.g. ones received while running without -media-dir
+func (app *App) downloadPendingE2EEMedia(ctx context.Context) {
+	log := app.log.With().Str("component", "e2ee-media").Logger()
+
+	pending, err := app.store.GetPendingAttachments(e2eeMediaBatchSize, true, false)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load pending E2EE attachments")
+		return
+	}
+	downloaded := 0
+	for _, a := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+		if app.downloadE2EEAttachment(ctx, a) {
+			downloaded++
+		}
+	}
+	if len(pending) > 0 {
+		log.Info().Int("downloaded", downloaded).Int("pending", len(pending)).Msg("Downloaded pending E2EE attachments")
+	}
+}
+
+// downloadE2EEAttachment downloads, decrypts and stores one attachment in the
+// media store. Failures are recorded on the attachment and not retried.
+func (app *App) downloadE2EEAttachment(ctx context.Context, a storage.PendingAttachment) bool {
+	log := app.log.With().Str("component", "e2ee-media").Str("attachment", a.ID).Logger()
+
+	err := app.fetchE2EEAttachment(ctx, a)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		log.Warn().Err(err).Msg("Failed to download E2EE attachment")
+		if err := app.store.SetAttachmentDownloadError(a.ID, err.Error()); err != nil {
+			log.Warn().Err(err).Msg("Failed to record download error")
+		}
+		return false
+	}
+	log.Debug().Msg("Downloaded E2EE attachment")
+	return true
+}
+
+func (app *App) fetchE2EEAttachment(ctx context.Context, a storage.PendingAttachment) error {
+	if app.e2eeClient == nil {
+		return fmt.Errorf("E2EE client not connected")
+	}
+	var transport waMediaTransport.WAMediaTransport
+	if err := proto.Unmarshal(a.E2EEMedia, &transport); err != nil {
+		return fmt.Errorf("decoding media transport: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e2eeMediaTimeout)
+	defer cancel()
+	data, err := app.e2eeClient.DownloadFB(ctx, transport.GetIntegral(), whatsmeow.MediaType(a.E2EEMediaType))
+	if err != nil {
+		return err
+	}
+
+	relPath, sum, size, err := media.Put(*mediaDir, bytes.NewReader(data), media.Extension(a.Filename, a.MimeType))
+	if err != nil {
+		return err
+	}
+	return app.store.SetAttachmentDownloaded(a.ID, relPath, sum, size)
+}
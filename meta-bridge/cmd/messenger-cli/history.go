@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	armadillo "go.mau.fi/whatsmeow/proto"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waMsgApplication"
+	"go.mau.fi/whatsmeow/proto/waMsgTransport"
+	"go.mau.fi/whatsmeow/proto/waWeb"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// handleHistorySync persists the message batches of a history sync payload.
+// These are offered when a new E2EE device registers and contain encrypted
+// history that pre-dates the device, which live FBMessage events never cover.
+func (app *App) handleHistorySync(evt *events.HistorySync) {
+	log := app.log.With().Str("component", "e2ee-history").Logger()
+
+	data := evt.Data
+	if data == nil {
+		return
+	}
+
+	log.Info().
+		Str("sync_type", data.GetSyncType().String()).
+		Uint32("chunk", data.GetChunkOrder()).
+		Uint32("progress", data.GetProgress()).
+		Int("conversations", len(data.GetConversations())).
+		Msg("E2EE history sync received")
+
+	var saved, skipped, failed int
+	for _, conv := range data.GetConversations() {
+		chatJID, err := types.ParseJID(conv.GetID())
+		if err != nil {
+			log.Warn().Err(err).Str("chat", conv.GetID()).Msg("Failed to parse history sync chat JID")
+			continue
+		}
+		threadID, err := strconv.ParseInt(chatJID.User, 10, 64)
+		if err != nil {
+			log.Debug().Str("chat", conv.GetID()).Msg("Skipping history sync chat with non-numeric ID")
+			continue
+		}
+
+		for _, histMsg := range conv.GetMessages() {
+			webMsg := histMsg.GetMessage()
+			if webMsg == nil {
+				continue
+			}
+
+			parsed, err := app.e2eeClient.ParseWebMessage(chatJID, webMsg)
+			if err != nil {
+				log.Debug().Err(err).Str("id", webMsg.GetKey().GetID()).Msg("Failed to parse history sync message")
+				failed++
+				continue
+			}
+
+			text, attachment, err := historyMessageContent(parsed.Info.ID, parsed.SourceWebMsg)
+			if err != nil {
+				log.Debug().Err(err).Str("id", parsed.Info.ID).Msg("Failed to decode history sync message content")
+			}
+			if text == "" && attachment == nil {
+				skipped++
+				continue
+			}
+
+			senderID, _ := strconv.ParseInt(parsed.Info.Sender.User, 10, 64)
+			msg := &table.LSInsertMessage{
+				MessageId:   parsed.Info.ID,
+				ThreadKey:   threadID,
+				SenderId:    senderID,
+				Text:        text,
+				TimestampMs: parsed.Info.Timestamp.UnixMilli(),
+			}
+			if err := app.saveE2EEMessage(msg, attachment); err != nil {
+				log.Warn().Err(err).Str("id", parsed.Info.ID).Msg("Failed to save history sync message")
+				failed++
+				continue
+			}
+			saved++
+		}
+	}
+
+	log.Info().
+		Int("saved", saved).
+		Int("skipped", skipped).
+		Int("failed", failed).
+		Msg("E2EE history sync stored")
+}
+
+// historyMessageContent extracts the text and attachment of a history sync
+// message. Messenger history carries the same MessageTransport as live E2EE
+// messages, in the futureproof data of the web message, so it goes through
+// e2eeMessageContent; WhatsApp-style entries fall back to their plain text.
+func historyMessageContent(messageID string, webMsg *waWeb.WebMessageInfo) (string, *storage.E2EEAttachment, error) {
+	if data := webMsg.GetFutureproofData(); len(data) > 0 {
+		message, err := decodeHistoryTransport(data)
+		if err != nil {
+			return "", nil, err
+		}
+		return e2eeMessageContent(messageID, message)
+	}
+	return historyMessageText(webMsg.GetMessage()), nil, nil
+}
+
+// decodeHistoryTransport unwraps a serialized MessageTransport down to its
+// consumer application message
+func decodeHistoryTransport(data []byte) (armadillo.MessageApplicationSub, error) {
+	var transport waMsgTransport.MessageTransport
+	if err := proto.Unmarshal(data, &transport); err != nil {
+		return nil, fmt.Errorf("decoding message transport: %w", err)
+	}
+	application, err := transport.GetPayload().DecodeFB()
+	if err != nil {
+		return nil, fmt.Errorf("decoding message application: %w", err)
+	}
+	consumer, ok := application.GetPayload().GetSubProtocol().GetSubProtocol().(*waMsgApplication.MessageApplication_SubProtocolPayload_ConsumerMessage)
+	if !ok {
+		return nil, nil
+	}
+	return consumer.Decode()
+}
+
+// historyMessageText extracts the plain text of a history sync message
+func historyMessageText(msg *waE2E.Message) string {
+	if msg == nil {
+		return ""
+	}
+	if text := msg.GetConversation(); text != "" {
+		return text
+	}
+	return msg.GetExtendedTextMessage().GetText()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+
+	"go.mau.fi/whatsmeow/proto/armadilloutil"
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waConsumerApplication"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waMediaTransport"
+	"go.mau.fi/whatsmeow/proto/waMsgApplication"
+	"go.mau.fi/whatsmeow/proto/waMsgTransport"
+	"go.mau.fi/whatsmeow/proto/waWeb"
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+)
+
+// historyWebMessage wraps a consumer application message the way Messenger
+// history sync delivers it
+func historyWebMessage(t *testing.T, content *waConsumerApplication.ConsumerApplication_Content) *waWeb.WebMessageInfo {
+	t.Helper()
+	consumer := &waMsgApplication.MessageApplication_SubProtocolPayload_ConsumerMessage{}
+	if err := consumer.Set(&waConsumerApplication.ConsumerApplication{
+		Payload: &waConsumerApplication.ConsumerApplication_Payload{
+			Payload: &waConsumerApplication.ConsumerApplication_Payload_Content{Content: content},
+		},
+	}); err != nil {
+		t.Fatalf("marshal consumer message: %v", err)
+	}
+	application, err := armadilloutil.Marshal(&waMsgApplication.MessageApplication{
+		Payload: &waMsgApplication.MessageApplication_Payload{
+			Content: &waMsgApplication.MessageApplication_Payload_SubProtocol{
+				SubProtocol: &waMsgApplication.MessageApplication_SubProtocolPayload{SubProtocol: consumer},
+			},
+		},
+	}, waMsgTransport.FBMessageApplicationVersion)
+	if err != nil {
+		t.Fatalf("marshal message application: %v", err)
+	}
+	data, err := proto.Marshal(&waMsgTransport.MessageTransport{
+		Payload: &waMsgTransport.MessageTransport_Payload{ApplicationPayload: application},
+	})
+	if err != nil {
+		t.Fatalf("marshal transport: %v", err)
+	}
+	return &waWeb.WebMessageInfo{FutureproofData: data}
+}
+
+func TestHistoryMessageContent_ConsumerApplication(t *testing.T) {
+	webMsg := historyWebMessage(t, &waConsumerApplication.ConsumerApplication_Content{
+		Content: &waConsumerApplication.ConsumerApplication_Content_MessageText{
+			MessageText: &waCommon.MessageText{Text: proto.String("see you at 6")},
+		},
+	})
+	text, att, err := historyMessageContent("m1", webMsg)
+	if err != nil {
+		t.Fatalf("historyMessageContent: %v", err)
+	}
+	if text != "see you at 6" || att != nil {
+		t.Fatalf("got text %q, attachment %v", text, att)
+	}
+
+	image := &waConsumerApplication.ConsumerApplication_ImageMessage{
+		Caption: &waCommon.MessageText{Text: proto.String("beach")},
+	}
+	if err := image.Set(&waMediaTransport.ImageTransport{
+		Integral: &waMediaTransport.ImageTransport_Integral{
+			Transport: &waMediaTransport.WAMediaTransport{
+				Integral: &waMediaTransport.WAMediaTransport_Integral{DirectPath: proto.String("/v/t62/abc")},
+				Ancillary: &waMediaTransport.WAMediaTransport_Ancillary{
+					Mimetype:   proto.String("image/jpeg"),
+					FileLength: proto.Uint64(1234),
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatalf("marshal image: %v", err)
+	}
+	webMsg = historyWebMessage(t, &waConsumerApplication.ConsumerApplication_Content{
+		Content: &waConsumerApplication.ConsumerApplication_Content_ImageMessage{ImageMessage: image},
+	})
+	text, att, err = historyMessageContent("m2", webMsg)
+	if err != nil {
+		t.Fatalf("historyMessageContent: %v", err)
+	}
+	if text != "beach" {
+		t.Fatalf("caption = %q", text)
+	}
+	if att == nil || att.MessageID != "m2" || att.MimeType != "image/jpeg" || att.FileSize != 1234 ||
+		att.AttachmentType != int64(table.AttachmentTypeImage) || len(att.Media) == 0 {
+		t.Fatalf("unexpected attachment %+v", att)
+	}
+}
+
+func TestHistoryMessageContent_PlainText(t *testing.T) {
+	webMsg := &waWeb.WebMessageInfo{Message: &waE2E.Message{Conversation: proto.String("hi")}}
+	text, att, err := historyMessageContent("m1", webMsg)
+	if err != nil || text != "hi" || att != nil {
+		t.Fatalf("got %q, %v, %v", text, att, err)
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/rs/zerolog"
 	"go.mau.fi/whatsmeow"
+	armadillo "go.mau.fi/whatsmeow/proto"
 	"go.mau.fi/whatsmeow/proto/waConsumerApplication"
 	"go.mau.fi/whatsmeow/store"
 	"go.mau.fi/whatsmeow/store/sqlstore"
@@ -25,33 +26,70 @@ import (
 	"go.mau.fi/mautrix-meta/pkg/messagix/cookies"
 	"go.mau.fi/mautrix-meta/pkg/messagix/table"
 	metatypes "go.mau.fi/mautrix-meta/pkg/messagix/types"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
 	"go.mau.fi/mautrix-meta/pkg/storage"
 	"go.mau.fi/mautrix-meta/pkg/util"
 )
 
 var (
 	dbPath       = flag.String("db", "messenger.db", "Path to SQLite database")
+	dbKeyFile    = storage.KeyFileFlag()
+	cfgPath      = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
 	verbose      = flag.Bool("v", false, "Enable verbose logging")
 	showStats    = flag.Bool("stats", false, "Show database stats and exit")
 	searchTerm   = flag.String("search", "", "Search messages (FTS) and exit")
 	fromPerson   = flag.String("from", "", "Get messages from a person (by name) and exit")
 	listContacts = flag.Bool("contacts", false, "List all contacts and exit")
 	enableE2EE   = flag.Bool("e2ee", true, "Enable E2EE (encrypted messages)")
+	e2eeDBPath   = flag.String("e2ee-db", "", "Separate SQLite database for the E2EE key store (overrides database.e2ee in rag.yaml; empty = share -db; existing keys are moved on first use)")
+	mediaDir     = flag.String("media-dir", "", "Download and decrypt E2EE attachments into this store (media.attachments_dir in rag.yaml; empty = only keep their keys)")
+
+	avatarRefreshInterval = flag.Duration("avatar-refresh-interval", 10*time.Minute, "How often to request fresh contact info for expired avatar URLs (0 = disabled)")
+	changesRetention      = flag.Duration("changes-retention", 30*24*time.Hour, "Prune change feed entries older than this on startup (0 = keep forever)")
+
+	backfillGaps     = flag.Bool("backfill-gaps", true, "Detect threads with messages missed while offline and fetch them")
+	backfillDelay    = flag.Duration("backfill-delay", 3*time.Second, "Delay between per-thread gap backfills")
+	backfillMaxPages = flag.Int("backfill-max-pages", 10, "Maximum message pages fetched per thread gap")
+
+	threadScan         = flag.String("thread-scan", "auto", "Enumerate the full thread list: auto (until completed once), always, off")
+	threadScanDelay    = flag.Duration("thread-scan-delay", 5*time.Second, "Base delay between thread list pages (jittered, backs off on errors)")
+	threadScanMaxPages = flag.Int("thread-scan-max-pages", 200, "Maximum thread list pages per run")
+
+	sendThread       = flag.Int64("send-thread", 0, "Thread ID for -send")
+	sendText         = flag.String("send", "", "Queue a text message to -send-thread; it is sent once connected (exits unless a cookies file is given)")
+	outboundInterval = flag.Duration("outbound-interval", 15*time.Second, "How often to check the outbound queue for messages to send")
+
+	tailMode    = flag.Bool("tail", false, "Print incoming messages to stdout (logging drops to warnings unless -v)")
+	tailThread  = flag.String("tail-thread", "", "Only tail this thread (ID or part of its name)")
+	tailContact = flag.String("tail-contact", "", "Only tail messages from this contact (ID or part of their name)")
+	tailMatch   = flag.String("tail-match", "", "Only tail messages whose text matches this regex")
+	tailJSON    = flag.Bool("tail-json", false, "Print tailed messages as JSON lines")
 )
 
 type App struct {
-	log        zerolog.Logger
-	store      *storage.Storage
-	client     *messagix.Client
-	e2eeClient *whatsmeow.Client
-	e2eeStore  *sqlstore.Container
-	waDevice   *store.Device
-	verbose    bool
+	log         zerolog.Logger
+	store       *storage.Storage
+	client      *messagix.Client
+	e2eeClient  *whatsmeow.Client
+	e2eeStore   *sqlstore.Container
+	waDevice    *store.Device
+	verbose     bool
 	currentUser int64
+	tail        *tailer // Set once the initial sync is stored, so only live messages are tailed
+	backfill    *gapBackfiller
+
+	outboundWake chan struct{}
+	threadRange  threadRangeTracker
+
+	backfillOnce sync.Once
+	outboundOnce sync.Once
+	scanOnce     sync.Once
 
 	namesMu      sync.RWMutex
 	contactNames map[int64]string
 	threadNames  map[int64]string
+
+	avatarRefreshOnce sync.Once
 }
 
 func main() {
@@ -61,17 +99,30 @@ func main() {
 	logLevel := zerolog.InfoLevel
 	if *verbose {
 		logLevel = zerolog.DebugLevel
+	} else if *tailMode {
+		logLevel = zerolog.WarnLevel
 	}
 	log := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.Kitchen}).
 		With().Timestamp().Logger().Level(logLevel)
 
 	// Open database
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
 	store, err := storage.New(*dbPath)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to open database")
 	}
 	defer store.Close()
 
+	if *changesRetention > 0 {
+		if pruned, err := store.PruneChanges(*changesRetention); err != nil {
+			log.Warn().Err(err).Msg("Failed to prune change feed")
+		} else if pruned > 0 {
+			log.Debug().Int64("count", pruned).Msg("Pruned old change feed entries")
+		}
+	}
+
 	// Handle stats mode
 	if *showStats {
 		stats, err := store.GetStats()
@@ -82,6 +133,15 @@ func main() {
 		fmt.Printf("  Messages: %d\n", stats.MessageCount)
 		fmt.Printf("  Threads:  %d\n", stats.ThreadCount)
 		fmt.Printf("  Contacts: %d\n", stats.ContactCount)
+		upserts, err := store.GetUpsertStats()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to get upsert stats")
+		}
+		fmt.Printf("Message Upserts:\n")
+		fmt.Printf("  Inserted:      %d\n", upserts.Inserted)
+		fmt.Printf("  Dedup skipped: %d\n", upserts.DedupSkipped)
+		fmt.Printf("  Text changed:  %d\n", upserts.TextChanged)
+		fmt.Printf("  FTS rewritten: %d\n", upserts.FTSRewritten)
 		return
 	}
 
@@ -134,12 +194,33 @@ func main() {
 		return
 	}
 
+	// Queue an outbound message; a running (or this) connected instance sends it
+	if *sendText != "" {
+		if *sendThread == 0 {
+			log.Fatal().Msg("-send requires -send-thread")
+		}
+		otid, err := queueOutbound(store, *sendThread, *sendText)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to queue message")
+		}
+		fmt.Printf("Queued message %s for thread %d\n", otid, *sendThread)
+		if len(flag.Args()) == 0 {
+			return
+		}
+	}
+
 	// Normal mode: connect and sync
 	args := flag.Args()
 	if len(args) < 1 {
 		log.Fatal().Msg("Usage: messenger-cli [options] <cookies.json>")
 	}
 
+	switch *threadScan {
+	case "auto", "always", "off":
+	default:
+		log.Fatal().Str("value", *threadScan).Msg("-thread-scan must be auto, always or off")
+	}
+
 	// Load cookies from file
 	cookieFile, err := os.ReadFile(args[0])
 	if err != nil {
@@ -160,15 +241,43 @@ func main() {
 		verbose:      *verbose,
 		contactNames: make(map[int64]string),
 		threadNames:  make(map[int64]string),
+		outboundWake: make(chan struct{}, 1),
+	}
+	if *backfillGaps {
+		app.backfill = newGapBackfiller()
 	}
 
 	// Initialize E2EE store if enabled
 	if *enableE2EE {
+		cfg := ragconfig.LoadOrDefault(".")
+		if *cfgPath != "" {
+			if cfg, err = ragconfig.Load(*cfgPath); err != nil {
+				log.Fatal().Err(err).Msg("Failed to load configuration")
+			}
+		}
+		e2eePath := *e2eeDBPath
+		if e2eePath == "" {
+			e2eePath = cfg.Database.E2EE
+		}
+
 		waLogger := waLog.Zerolog(log.With().Str("component", "whatsmeow").Logger())
-		app.e2eeStore = sqlstore.NewWithDB(store.GetDB(), "sqlite3", waLogger)
+		e2eeDB := store.GetDB()
+		if e2eePath != "" {
+			e2eeDB, err = storage.OpenE2EEDB(e2eePath)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to open E2EE database")
+			}
+			defer e2eeDB.Close()
+		}
+		app.e2eeStore = sqlstore.NewWithDB(e2eeDB, "sqlite3", waLogger)
 		if err := app.e2eeStore.Upgrade(context.Background()); err != nil {
 			log.Fatal().Err(err).Msg("Failed to initialize E2EE store")
 		}
+		if e2eePath != "" {
+			if err := moveE2EEStore(store, e2eePath, waLogger); err != nil {
+				log.Fatal().Err(err).Msg("Failed to move E2EE store to separate database")
+			}
+		}
 	}
 
 	// Create the client
@@ -183,9 +292,28 @@ func main() {
 			if *enableE2EE {
 				go app.connectE2EE(ctx)
 			}
+			if app.backfill != nil {
+				app.backfillOnce.Do(func() {
+					go app.runGapBackfill(ctx, *backfillDelay, *backfillMaxPages)
+				})
+			}
+			if app.shouldScanThreads(*threadScan) {
+				app.scanOnce.Do(func() {
+					go app.runThreadScan(ctx, *threadScanDelay, *threadScanMaxPages)
+				})
+			}
+			app.outboundOnce.Do(func() {
+				go app.runOutbound(ctx, *outboundInterval)
+			})
+			if *avatarRefreshInterval > 0 {
+				app.avatarRefreshOnce.Do(func() {
+					go app.runAvatarRefresh(ctx, *avatarRefreshInterval)
+				})
+			}
 
 		case *messagix.Event_Reconnected:
 			log.Info().Msg("Reconnected to Messenger")
+			app.wakeOutbound()
 
 		case *messagix.Event_SocketError:
 			log.Warn().Err(e.Err).Int("attempts", e.ConnectionAttempts).Msg("Socket error")
@@ -226,6 +354,14 @@ func main() {
 		app.handleTable(initialTable)
 	}
 
+	if *tailMode {
+		filter, err := newTailFilter(*tailThread, *tailContact, *tailMatch)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid tail filter")
+		}
+		app.tail = &tailer{out: os.Stdout, filter: filter, json: *tailJSON}
+	}
+
 	// Show stats after initial sync
 	stats, _ := store.GetStats()
 	log.Info().
@@ -342,12 +478,37 @@ func (app *App) connectE2EE(ctx context.Context) {
 	}
 }
 
+// moveE2EEStore moves whatsmeow tables left in the main database (from before
+// a separate E2EE database was configured) into it
+func moveE2EEStore(store *storage.Storage, e2eeDBPath string, waLogger waLog.Logger) error {
+	hasTables, err := store.HasE2EETables()
+	if err != nil || !hasTables {
+		return err
+	}
+
+	// Bring the legacy tables to the current schema so columns line up
+	ctx := context.Background()
+	if err := sqlstore.NewWithDB(store.GetDB(), "sqlite3", waLogger).Upgrade(ctx); err != nil {
+		return fmt.Errorf("upgrading legacy E2EE tables: %w", err)
+	}
+
+	moved, err := store.MoveE2EETables(ctx, e2eeDBPath)
+	if err != nil {
+		return err
+	}
+	waLogger.Infof("Moved %d E2EE tables to %s", moved, e2eeDBPath)
+	return nil
+}
+
 func (app *App) handleE2EEEvent(rawEvt any) {
 	log := app.log.With().Str("component", "e2ee").Logger()
 
 	switch evt := rawEvt.(type) {
 	case *events.Connected:
 		log.Info().Msg("Connected to E2EE socket!")
+		if *mediaDir != "" {
+			go app.downloadPendingE2EEMedia(context.Background())
+		}
 
 	case *events.Disconnected:
 		log.Warn().Msg("Disconnected from E2EE socket")
@@ -364,6 +525,9 @@ func (app *App) handleE2EEEvent(rawEvt any) {
 				Msg("E2EE receipt")
 		}
 
+	case *events.HistorySync:
+		app.handleHistorySync(evt)
+
 	case *events.OfflineSyncPreview:
 		log.Info().Int("messages", evt.Messages).Msg("E2EE offline sync starting")
 
@@ -387,25 +551,13 @@ func (app *App) handleE2EEMessage(evt *events.FBMessage) {
 	threadID, _ := strconv.ParseInt(evt.Info.Chat.User, 10, 64)
 	senderID, _ := strconv.ParseInt(evt.Info.Sender.User, 10, 64)
 
-	// Get message text from the typed message
-	var text string
-	switch typedMsg := evt.Message.(type) {
-	case *waConsumerApplication.ConsumerApplication:
-		// Consumer application messages (regular Messenger E2EE)
-		content := typedMsg.GetPayload().GetContent()
-		if content != nil {
-			switch inner := content.GetContent().(type) {
-			case *waConsumerApplication.ConsumerApplication_Content_MessageText:
-				text = inner.MessageText.GetText()
-			case *waConsumerApplication.ConsumerApplication_Content_EditMessage:
-				text = inner.EditMessage.GetMessage().GetText()
-			}
-		}
-	default:
+	text, attachment, err := e2eeMessageContent(evt.Info.ID, evt.Message)
+	if err != nil {
+		log.Warn().Err(err).Str("id", evt.Info.ID).Msg("Failed to decode E2EE attachment")
+	}
+	if _, ok := evt.Message.(*waConsumerApplication.ConsumerApplication); !ok && evt.Message != nil {
 		// Other message types (Armadillo, etc.) - just log them for now
-		if evt.Message != nil {
-			log.Debug().Type("type", evt.Message).Msg("E2EE message type")
-		}
+		log.Debug().Type("type", evt.Message).Msg("E2EE message type")
 	}
 
 	timestamp := evt.Info.Timestamp
@@ -418,27 +570,82 @@ func (app *App) handleE2EEMessage(evt *events.FBMessage) {
 		Str("text", util.Truncate(text, 80)).
 		Msg("E2EE MESSAGE")
 
-	// Store in database
+	msg := &table.LSInsertMessage{
+		MessageId:   evt.Info.ID,
+		ThreadKey:   threadID,
+		SenderId:    senderID,
+		Text:        text,
+		TimestampMs: timestamp.UnixMilli(),
+	}
+	if err := app.saveE2EEMessage(msg, attachment); err != nil {
+		log.Warn().Err(err).Str("id", evt.Info.ID).Msg("Failed to save E2EE message")
+		return
+	}
 	if text != "" {
-		// Create a message record
-		msg := &table.LSInsertMessage{
-			MessageId:   evt.Info.ID,
-			ThreadKey:   threadID,
-			SenderId:    senderID,
-			Text:        text,
-			TimestampMs: timestamp.UnixMilli(),
-		}
-		if err := app.store.InsertMessage(msg); err != nil {
-			log.Warn().Err(err).Str("id", evt.Info.ID).Msg("Failed to save E2EE message")
-		}
+		app.emitTail("e2ee", msg.MessageId, msg.ThreadKey, msg.SenderId, msg.TimestampMs, msg.Text)
 	}
 }
 
+// e2eeMessageContent extracts the text and attachment of a decoded E2EE
+// message. Only consumer application messages (regular Messenger E2EE) carry
+// chat content; other types yield nothing. A failure to decode the attachment
+// still returns its caption.
+func e2eeMessageContent(messageID string, message armadillo.MessageApplicationSub) (string, *storage.E2EEAttachment, error) {
+	typedMsg, ok := message.(*waConsumerApplication.ConsumerApplication)
+	if !ok {
+		return "", nil, nil
+	}
+	content := typedMsg.GetPayload().GetContent()
+	if content == nil {
+		return "", nil, nil
+	}
+	switch inner := content.GetContent().(type) {
+	case *waConsumerApplication.ConsumerApplication_Content_MessageText:
+		return inner.MessageText.GetText(), nil, nil
+	case *waConsumerApplication.ConsumerApplication_Content_EditMessage:
+		return inner.EditMessage.GetMessage().GetText(), nil, nil
+	default:
+		attachment, caption, err := e2eeAttachment(messageID, content)
+		return caption, attachment, err
+	}
+}
+
+// saveE2EEMessage stores an E2EE message and its attachment, if any, and
+// queues the attachment for download when a media directory is set. Messages
+// with neither text nor an attachment are skipped.
+func (app *App) saveE2EEMessage(msg *table.LSInsertMessage, attachment *storage.E2EEAttachment) error {
+	if msg.Text == "" && attachment == nil {
+		return nil
+	}
+	if err := app.store.InsertMessage(msg); err != nil {
+		return err
+	}
+	if attachment == nil {
+		return nil
+	}
+	if err := app.store.UpsertE2EEAttachment(attachment); err != nil {
+		return fmt.Errorf("saving attachment: %w", err)
+	}
+	if *mediaDir != "" {
+		go app.downloadE2EEAttachment(context.Background(), storage.PendingAttachment{
+			ID:            attachment.ID,
+			MessageID:     attachment.MessageID,
+			Filename:      attachment.Filename,
+			MimeType:      attachment.MimeType,
+			E2EEMedia:     attachment.Media,
+			E2EEMediaType: attachment.MediaType,
+		})
+	}
+	return nil
+}
+
 func (app *App) handleTable(tbl *table.LSTable) {
 	if tbl == nil {
 		return
 	}
 
+	app.threadRange.update(tbl)
+
 	// Process contacts first (so we have sender info)
 	for _, contact := range tbl.LSDeleteThenInsertContact {
 		if err := app.store.UpsertContact(contact); err != nil {
@@ -518,6 +725,7 @@ func (app *App) handleTable(tbl *table.LSTable) {
 				Time("time", time.UnixMilli(msg.TimestampMs)).
 				Str("text", util.Truncate(msg.Text, 80)).
 				Msg("NEW MESSAGE")
+			app.emitTail("socket", msg.MessageId, msg.ThreadKey, msg.SenderId, msg.TimestampMs, msg.Text)
 		}
 	}
 
@@ -619,6 +827,9 @@ func (app *App) handleTable(tbl *table.LSTable) {
 		}
 	}
 
+	app.confirmOutbound(tbl)
+	app.detectSyncGaps(tbl)
+
 	// Log typing indicators (not stored, just for real-time awareness)
 	if app.verbose {
 		for _, typing := range tbl.LSUpdateTypingIndicator {
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/methods"
+	"go.mau.fi/mautrix-meta/pkg/messagix/socket"
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+const (
+	// outboundBatchSize caps how many queued messages are sent per drain.
+	outboundBatchSize = 10
+	// outboundMaxAttempts is how often a failed send is retried before the
+	// message is marked failed. Retries reuse the otid, so a send that went
+	// through despite the error is deduplicated by the server. A send that
+	// succeeded waits for its acknowledgement and isn't retried.
+	outboundMaxAttempts = 5
+)
+
+// queueOutbound stores a message for sending by a connected messenger-cli
+func queueOutbound(store *storage.Storage, threadID int64, text string) (string, error) {
+	otid := strconv.FormatInt(methods.GenerateEpochID(), 10)
+	return otid, store.EnqueueOutbound(otid, threadID, text)
+}
+
+// runOutbound sends queued messages while connected. Other processes can
+// queue messages at any time, so the queue is also polled.
+func (app *App) runOutbound(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		app.drainOutbound(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-app.outboundWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// wakeOutbound triggers a drain, e.g. right after reconnecting
+func (app *App) wakeOutbound() {
+	select {
+	case app.outboundWake <- struct{}{}:
+	default:
+	}
+}
+
+func (app *App) drainOutbound(ctx context.Context) {
+	log := app.log.With().Str("component", "outbound").Logger()
+
+	if !app.client.IsConnected() {
+		return
+	}
+
+	pending, err := app.store.GetPendingOutbound(outboundBatchSize)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load outbound queue")
+		return
+	}
+
+	for _, msg := range pending {
+		otid, err := strconv.ParseInt(msg.OTID, 10, 64)
+		if err != nil {
+			log.Warn().Str("otid", msg.OTID).Msg("Invalid otid in outbound queue")
+			_ = app.store.MarkOutboundFailed(msg.OTID, "invalid otid")
+			continue
+		}
+
+		tbl, sendErr := app.client.ExecuteTasks(ctx, &socket.SendMessageTask{
+			ThreadId:         msg.ThreadID,
+			Otid:             otid,
+			Source:           table.MESSENGER_INBOX_IN_THREAD,
+			SendType:         table.TEXT,
+			SyncGroup:        1,
+			Text:             msg.Text,
+			InitiatingSource: table.FACEBOOK_INBOX,
+		})
+		if err := app.store.RecordOutboundAttempt(msg.OTID, sendErr, outboundMaxAttempts); err != nil {
+			log.Warn().Err(err).Str("otid", msg.OTID).Msg("Failed to record send attempt")
+		}
+		if sendErr != nil {
+			log.Warn().Err(sendErr).
+				Str("otid", msg.OTID).
+				Int64("thread", msg.ThreadID).
+				Int("attempt", msg.Attempts+1).
+				Msg("Failed to send queued message")
+			// Likely disconnected; keep the order and retry the rest later
+			return
+		}
+
+		log.Info().
+			Str("otid", msg.OTID).
+			Int64("thread", msg.ThreadID).
+			Dur("queued_for", time.Since(time.UnixMilli(msg.CreatedAtMs))).
+			Msg("Sent queued message")
+		app.handleTable(tbl)
+	}
+}
+
+// confirmOutbound matches server acknowledgements (optimistic message
+// replacement, or the message echoed back with its otid) to queued messages
+func (app *App) confirmOutbound(tbl *table.LSTable) {
+	for _, r := range tbl.LSReplaceOptimsiticMessage {
+		app.markOutboundSent(r.OfflineThreadingId, r.MessageId)
+	}
+	for _, m := range tbl.LSInsertMessage {
+		if m.OfflineThreadingId != "" && m.SenderId == app.currentUser {
+			app.markOutboundSent(m.OfflineThreadingId, m.MessageId)
+		}
+	}
+	for _, f := range tbl.LSMarkOptimisticMessageFailed {
+		if err := app.store.MarkOutboundFailed(f.OTID, f.Message); err != nil {
+			app.log.Warn().Err(err).Str("otid", f.OTID).Msg("Failed to mark queued message failed")
+		}
+	}
+}
+
+func (app *App) markOutboundSent(otid, messageID string) {
+	confirmed, err := app.store.MarkOutboundSent(otid, messageID)
+	if err != nil {
+		app.log.Warn().Err(err).Str("otid", otid).Msg("Failed to mark queued message sent")
+	} else if confirmed {
+		app.log.Debug().Str("otid", otid).Str("id", messageID).Msg("Queued message confirmed")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tailFilter selects which live messages -tail prints. Thread and contact
+// match either the exact ID or a case-insensitive substring of the name.
+type tailFilter struct {
+	thread  string
+	contact string
+	text    *regexp.Regexp
+}
+
+func newTailFilter(thread, contact, pattern string) (*tailFilter, error) {
+	f := &tailFilter{
+		thread:  strings.ToLower(strings.TrimSpace(thread)),
+		contact: strings.ToLower(strings.TrimSpace(contact)),
+	}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -tail-match: %w", err)
+		}
+		f.text = re
+	}
+	return f, nil
+}
+
+func matchIDOrName(want string, id int64, name string) bool {
+	if want == "" {
+		return true
+	}
+	if strconv.FormatInt(id, 10) == want {
+		return true
+	}
+	return name != "" && strings.Contains(strings.ToLower(name), want)
+}
+
+func (f *tailFilter) match(m tailMessage) bool {
+	return matchIDOrName(f.thread, m.ThreadID, m.ThreadName) &&
+		matchIDOrName(f.contact, m.SenderID, m.SenderName) &&
+		(f.text == nil || f.text.MatchString(m.Text))
+}
+
+// tailMessage is one printed -tail line (or JSON object with -tail-json)
+type tailMessage struct {
+	ID          string `json:"id"`
+	Source      string `json:"source"` // "socket" or "e2ee"
+	ThreadID    int64  `json:"thread_id,string"`
+	ThreadName  string `json:"thread_name,omitempty"`
+	SenderID    int64  `json:"sender_id,string"`
+	SenderName  string `json:"sender_name,omitempty"`
+	TimestampMs int64  `json:"timestamp_ms"`
+	Text        string `json:"text"`
+}
+
+// tailer prints incoming messages to stdout, separate from the stderr log
+type tailer struct {
+	mu     sync.Mutex
+	out    io.Writer
+	filter *tailFilter
+	json   bool
+}
+
+func (t *tailer) print(m tailMessage) {
+	if !t.filter.match(m) {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.json {
+		_ = json.NewEncoder(t.out).Encode(m)
+		return
+	}
+
+	thread := m.ThreadName
+	if thread == "" {
+		thread = strconv.FormatInt(m.ThreadID, 10)
+	}
+	sender := m.SenderName
+	if sender == "" {
+		sender = fmt.Sprintf("User %d", m.SenderID)
+	}
+	fmt.Fprintf(t.out, "[%s] [%s] %s: %s\n",
+		time.UnixMilli(m.TimestampMs).Format("2006-01-02 15:04:05"), thread, sender, m.Text)
+}
+
+// emitTail passes a stored message to the tailer, if -tail is active
+func (app *App) emitTail(source, id string, threadID, senderID, timestampMs int64, text string) {
+	if app.tail == nil || text == "" {
+		return
+	}
+
+	app.namesMu.RLock()
+	threadName := app.threadNames[threadID]
+	senderName := app.contactNames[senderID]
+	app.namesMu.RUnlock()
+
+	app.tail.print(tailMessage{
+		ID:          id,
+		Source:      source,
+		ThreadID:    threadID,
+		ThreadName:  threadName,
+		SenderID:    senderID,
+		SenderName:  senderName,
+		TimestampMs: timestampMs,
+		Text:        text,
+	})
+}
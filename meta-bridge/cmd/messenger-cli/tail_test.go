@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTailFilter(t *testing.T) {
+	f, err := newTailFilter("family", "42", "(?i)dinner")
+	if err != nil {
+		t.Fatalf("newTailFilter: %v", err)
+	}
+
+	msg := tailMessage{ThreadID: 7, ThreadName: "Family Chat", SenderID: 42, SenderName: "Mom", Text: "Dinner at 6"}
+	if !f.match(msg) {
+		t.Fatalf("expected match")
+	}
+
+	other := msg
+	other.SenderID = 43
+	if f.match(other) {
+		t.Fatalf("expected sender mismatch")
+	}
+
+	other = msg
+	other.Text = "lunch"
+	if f.match(other) {
+		t.Fatalf("expected text mismatch")
+	}
+
+	if _, err := newTailFilter("", "", "("); err == nil {
+		t.Fatalf("expected invalid regex error")
+	}
+}
+
+func TestTailer_JSONOutput(t *testing.T) {
+	var buf bytes.Buffer
+	f, _ := newTailFilter("", "", "")
+	tl := &tailer{out: &buf, filter: f, json: true}
+
+	tl.print(tailMessage{ID: "mid.1", Source: "socket", ThreadID: 7, SenderID: 42, TimestampMs: 1000, Text: "hi"})
+
+	got := buf.String()
+	if !strings.Contains(got, `"thread_id":"7"`) || !strings.HasSuffix(got, "\n") {
+		t.Fatalf("unexpected JSON line: %q", got)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/socket"
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+)
+
+const (
+	// threadScanDoneKey marks (in sync_metadata) that the full thread list was enumerated
+	threadScanDoneKey = "thread_scan_completed_at"
+	// threadScanCursorKey stores the oldest reached position so an interrupted
+	// scan resumes instead of starting over
+	threadScanCursorKey = "thread_scan_cursor"
+	// threadScanMaxFailures is how many consecutive failed pages end a scan
+	threadScanMaxFailures = 5
+	// threadScanMaxBackoff caps the delay after failed (likely rate limited) pages
+	threadScanMaxBackoff = 5 * time.Minute
+)
+
+// threadRange is the oldest position of the inbox thread list known so far
+type threadRange struct {
+	known         bool
+	minActivityMs int64
+	minThreadKey  int64
+	hasMoreBefore bool
+}
+
+// threadRangeTracker follows the inbox (sync group 1) thread range reported by the server
+type threadRangeTracker struct {
+	mu sync.Mutex
+	r  threadRange
+}
+
+func (t *threadRangeTracker) update(tbl *table.LSTable) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, r := range tbl.LSUpsertSyncGroupThreadsRange {
+		if r.SyncGroup == 1 {
+			t.r = threadRange{known: true, minActivityMs: r.MinLastActivityTimestampMS, minThreadKey: r.MinThreadKey, hasMoreBefore: r.HasMoreBefore}
+		}
+	}
+	for _, r := range tbl.LSUpsertInboxThreadsRange {
+		if r.SyncGroup == 1 {
+			t.r = threadRange{known: true, minActivityMs: r.MinLastActivityTimestampMs, minThreadKey: r.MinThreadKey, hasMoreBefore: r.HasMoreBefore}
+		}
+	}
+}
+
+func (t *threadRangeTracker) get() threadRange {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.r
+}
+
+// seed moves the range back to a previously reached position
+func (t *threadRangeTracker) seed(minActivityMs, minThreadKey int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.r.known && t.r.hasMoreBefore && minActivityMs < t.r.minActivityMs {
+		t.r.minActivityMs, t.r.minThreadKey = minActivityMs, minThreadKey
+	}
+}
+
+// shouldScanThreads decides whether to enumerate the thread list for mode
+// ("auto" = until one scan has completed, "always", "off")
+func (app *App) shouldScanThreads(mode string) bool {
+	switch mode {
+	case "always":
+		return true
+	case "off":
+		return false
+	}
+	done, err := app.store.GetSyncMetadata(threadScanDoneKey)
+	if err != nil {
+		app.log.Warn().Err(err).Msg("Failed to read thread scan state")
+		return false
+	}
+	return done == ""
+}
+
+// runThreadScan pages through the older thread list with jittered delays so
+// the archive knows about all conversations, not just the recent ones the
+// messages page includes. Failed pages back off exponentially.
+func (app *App) runThreadScan(ctx context.Context, delay time.Duration, maxPages int) {
+	log := app.log.With().Str("component", "thread-scan").Logger()
+
+	if cursor, err := app.store.GetSyncMetadata(threadScanCursorKey); err == nil && cursor != "" {
+		if ts, key, ok := parseThreadScanCursor(cursor); ok {
+			app.threadRange.seed(ts, key)
+		}
+	}
+
+	backoff := delay
+	failures := 0
+	for pages := 0; pages < maxPages; {
+		r := app.threadRange.get()
+		if !r.known {
+			log.Debug().Msg("Thread range unknown, skipping thread scan")
+			return
+		}
+		if !r.hasMoreBefore {
+			app.finishThreadScan(pages)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jitter(backoff)):
+		}
+		if !app.client.IsConnected() {
+			continue
+		}
+
+		tbl, err := app.client.ExecuteTasks(ctx, &socket.FetchThreadsTask{
+			IsAfter:                    0,
+			ParentThreadKey:            -1,
+			ReferenceThreadKey:         r.minThreadKey,
+			ReferenceActivityTimestamp: r.minActivityMs,
+			AdditionalPagesToFetch:     0,
+			Cursor:                     app.client.GetCursor(1),
+			SyncGroup:                  1,
+		})
+		if err != nil {
+			failures++
+			backoff = min(backoff*2, threadScanMaxBackoff)
+			log.Warn().Err(err).Int("failures", failures).Dur("backoff", backoff).Msg("Thread list page failed")
+			if failures >= threadScanMaxFailures {
+				log.Warn().Msg("Giving up on thread scan for now, it resumes on next start")
+				return
+			}
+			continue
+		}
+		failures = 0
+		backoff = delay
+		pages++
+
+		app.handleTable(tbl)
+
+		next := app.threadRange.get()
+		if next.minActivityMs == r.minActivityMs && next.minThreadKey == r.minThreadKey && next.hasMoreBefore {
+			log.Warn().Int("pages", pages).Msg("Thread list didn't advance, stopping scan")
+			return
+		}
+		if err := app.store.SetSyncMetadata(threadScanCursorKey, formatThreadScanCursor(next.minActivityMs, next.minThreadKey)); err != nil {
+			log.Warn().Err(err).Msg("Failed to save thread scan position")
+		}
+
+		stats, _ := app.store.GetStats()
+		log.Info().
+			Int("page", pages).
+			Int("threads_in_page", len(tbl.LSDeleteThenInsertThread)).
+			Int64("threads_total", stats.ThreadCount).
+			Time("reached", time.UnixMilli(next.minActivityMs)).
+			Msg("Fetched thread list page")
+	}
+	log.Info().Int("max_pages", maxPages).Msg("Thread scan page limit reached, it resumes on next start")
+}
+
+func (app *App) finishThreadScan(pages int) {
+	stats, _ := app.store.GetStats()
+	app.log.Info().
+		Str("component", "thread-scan").
+		Int("pages", pages).
+		Int64("threads", stats.ThreadCount).
+		Msg("Thread list fully enumerated")
+	if err := app.store.SetSyncMetadata(threadScanDoneKey, time.Now().Format(time.RFC3339)); err != nil {
+		app.log.Warn().Err(err).Msg("Failed to record thread scan completion")
+	}
+}
+
+// jitter spreads d randomly over [0.5d, 1.5d)
+func jitter(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (0.5 + rand.Float64()))
+}
+
+func formatThreadScanCursor(minActivityMs, minThreadKey int64) string {
+	return fmt.Sprintf("%d:%d", minActivityMs, minThreadKey)
+}
+
+func parseThreadScanCursor(s string) (int64, int64, bool) {
+	tsStr, keyStr, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, false
+	}
+	ts, err1 := strconv.ParseInt(tsStr, 10, 64)
+	key, err2 := strconv.ParseInt(keyStr, 10, 64)
+	return ts, key, err1 == nil && err2 == nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+)
+
+func TestThreadScanCursor_RoundTrip(t *testing.T) {
+	ts, key, ok := parseThreadScanCursor(formatThreadScanCursor(1700000000000, 42))
+	if !ok || ts != 1700000000000 || key != 42 {
+		t.Fatalf("unexpected cursor: ts=%d key=%d ok=%v", ts, key, ok)
+	}
+	if _, _, ok := parseThreadScanCursor("garbage"); ok {
+		t.Fatalf("expected invalid cursor")
+	}
+}
+
+func TestThreadRangeTracker_SeedOnlyMovesBack(t *testing.T) {
+	var tr threadRangeTracker
+	tr.update(&table.LSTable{LSUpsertSyncGroupThreadsRange: []*table.LSUpsertSyncGroupThreadsRange{
+		{SyncGroup: 1, MinLastActivityTimestampMS: 5000, MinThreadKey: 7, HasMoreBefore: true},
+		{SyncGroup: 95, MinLastActivityTimestampMS: 1, MinThreadKey: 1, HasMoreBefore: true},
+	}})
+
+	tr.seed(9000, 8)
+	if r := tr.get(); r.minActivityMs != 5000 {
+		t.Fatalf("seed moved range forward: %+v", r)
+	}
+	tr.seed(1000, 3)
+	if r := tr.get(); r.minActivityMs != 1000 || r.minThreadKey != 3 || !r.hasMoreBefore {
+		t.Fatalf("seed didn't resume from older position: %+v", r)
+	}
+}
+
+func TestJitter_Bounds(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second); d < 500*time.Millisecond || d >= 1500*time.Millisecond {
+			t.Fatalf("jitter out of range: %v", d)
+		}
+	}
+}
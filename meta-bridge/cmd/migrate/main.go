@@ -0,0 +1,157 @@
+// migrate inspects and changes the archive database's schema version.
+//
+// Every tool that writes the archive through pkg/storage applies pending
+// migrations itself, so "up" is only needed to upgrade step by step or
+// before starting rag-server, which never migrates; "down"
+// is for going back to an older binary. A downgraded database is upgraded
+// again the next time a current binary opens it.
+//
+// Usage:
+//
+//	migrate --db messenger.db status
+//	migrate --db messenger.db up [--to N]
+//	migrate --db messenger.db down [--to N]   (default: revert one migration)
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	dbPath    = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile = storage.KeyFileFlag()
+	cfgPath   = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	to        = flag.Int("to", -1, "Target schema version (up: default latest; down: default one below current)")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] status|up|down\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	command := flag.Arg(0)
+
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	db, err := sql.Open(storage.Driver("sqlite3"), sqlitePath+"?_foreign_keys=on&_busy_timeout=30000&_journal_mode=WAL")
+	if err != nil {
+		log.Fatal().Err(err).Str("path", sqlitePath).Msg("Failed to open database")
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		log.Fatal().Err(err).Msg("Database not accessible")
+	}
+
+	switch command {
+	case "status":
+		err = printStatus(db)
+	case "up":
+		target := *to
+		if target < 0 {
+			target = 0
+		}
+		var applied []int
+		applied, err = storage.MigrateUp(db, target)
+		for _, v := range applied {
+			fmt.Printf("applied  %d\n", v)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("Nothing to apply")
+		}
+	case "down":
+		target := *to
+		if target < 0 {
+			target, err = oneBelowCurrent(db)
+			if err != nil {
+				break
+			}
+		}
+		var reverted []int
+		reverted, err = storage.MigrateDown(db, target)
+		for _, v := range reverted {
+			fmt.Printf("reverted %d\n", v)
+		}
+		if err == nil && len(reverted) == 0 {
+			fmt.Println("Nothing to revert")
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Str("command", command).Msg("Migration failed")
+	}
+}
+
+func printStatus(db *sql.DB) error {
+	statuses, err := storage.GetMigrationStatus(db)
+	if err != nil {
+		return err
+	}
+	for _, st := range statuses {
+		state := "pending"
+		if st.Applied {
+			state = "applied " + time.UnixMilli(st.AppliedAt).Format("2006-01-02 15:04")
+		}
+		var notes string
+		if !st.Reversible {
+			notes += " [irreversible]"
+		}
+		if st.Modified {
+			notes += " [MODIFIED since applied]"
+		}
+		fmt.Printf("%4d  %-24s %s%s\n", st.Version, state, st.Description, notes)
+	}
+	return nil
+}
+
+// oneBelowCurrent is the default down target: the newest applied version
+// minus one
+func oneBelowCurrent(db *sql.DB) (int, error) {
+	statuses, err := storage.GetMigrationStatus(db)
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	for _, st := range statuses {
+		if st.Applied {
+			current = st.Version
+		}
+	}
+	return max(current-1, 0), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// embeddingRecord is one chunk_id → embedding mapping. The field names match
+// chunk-export output, so its files can be loaded as-is (other columns are
+// ignored).
+type embeddingRecord struct {
+	ChunkID   string    `json:"chunk_id" parquet:"chunk_id"`
+	Embedding []float32 `json:"embedding" parquet:"embedding,list"`
+}
+
+// loadEmbeddingsFile reads pre-computed embeddings from a JSONL or Parquet
+// file (by extension). Records without an embedding are skipped; any other
+// dimension than dim is an error, since Milvus would reject the insert.
+func loadEmbeddingsFile(path string, dim int) (map[string][]float32, error) {
+	var records []embeddingRecord
+	var err error
+	if strings.EqualFold(filepath.Ext(path), ".parquet") {
+		records, err = parquet.ReadFile[embeddingRecord](path)
+	} else {
+		records, err = readEmbeddingsJSONL(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string][]float32, len(records))
+	for _, r := range records {
+		if r.ChunkID == "" || len(r.Embedding) == 0 {
+			continue
+		}
+		if len(r.Embedding) != dim {
+			return nil, fmt.Errorf("chunk %s: embedding has %d dimensions, expected %d", r.ChunkID, len(r.Embedding), dim)
+		}
+		out[r.ChunkID] = r.Embedding
+	}
+	return out, nil
+}
+
+func readEmbeddingsJSONL(path string) ([]embeddingRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1<<20), 64<<20)
+
+	var records []embeddingRecord
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var r embeddingRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
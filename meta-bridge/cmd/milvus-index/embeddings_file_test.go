@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestLoadEmbeddingsFile_JSONL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "emb.jsonl")
+	data := `{"chunk_id":"a","text":"ignored","embedding":[1,2,3]}
+
+{"chunk_id":"b"}
+`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	got, err := loadEmbeddingsFile(path, 3)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(got) != 1 || len(got["a"]) != 3 || got["a"][2] != 3 {
+		t.Fatalf("unexpected embeddings: %v", got)
+	}
+
+	if _, err := loadEmbeddingsFile(path, 4); err == nil || !strings.Contains(err.Error(), "dimensions") {
+		t.Fatalf("expected dimension error, got %v", err)
+	}
+}
+
+func TestLoadEmbeddingsFile_Parquet(t *testing.T) {
+	// Same shape as chunk-export's record, with extra columns
+	type exported struct {
+		ChunkID   string    `parquet:"chunk_id"`
+		ThreadID  int64     `parquet:"thread_id"`
+		Text      string    `parquet:"text,zstd"`
+		Embedding []float32 `parquet:"embedding,list"`
+	}
+	path := filepath.Join(t.TempDir(), "emb.parquet")
+	rows := []exported{
+		{ChunkID: "a", ThreadID: 1, Text: "hi", Embedding: []float32{0.5, 0.25}},
+		{ChunkID: "b", ThreadID: 1, Text: "no vector"},
+	}
+	if err := parquet.WriteFile(path, rows); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	got, err := loadEmbeddingsFile(path, 2)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(got) != 1 || got["a"][0] != 0.5 || got["a"][1] != 0.25 {
+		t.Fatalf("unexpected embeddings: %v", got)
+	}
+}
@@ -0,0 +1,388 @@
+// rag-indexerd keeps the search indexes current while messenger-cli syncs.
+//
+// Every interval it looks for messages added, edited or unsent since they
+// were last indexed (messages.indexed_at is NULL), regenerates the chunks of
+// just those threads, embeds the new and changed chunks into the vector store
+// and marks the messages indexed. The FTS table follows the chunks table via
+// its triggers. Chunks that a thread no longer produces are deleted from both
+// stores.
+//
+// The first pass indexes every thread, like rag-pipeline. To change the
+// embedding model, use reembed, then restart the daemon with the new model
+// in rag.yaml. Chunking config changes can be left to the rolling re-chunk
+// (rechunk in rag.yaml): once a night it regenerates the chunks of the
+// threads chunked longest ago, a bounded number at a time.
+//
+// Usage:
+//
+//	rag-indexerd --db messenger.db
+//	rag-indexerd --db messenger.db --interval 30s
+//	rag-indexerd --db messenger.db --once            # one pass, then exit
+//	rag-indexerd --db messenger.db --once --rechunk  # also a rolling re-chunk, e.g. from cron
+//	rag-indexerd --db messenger.db --metrics-addr 127.0.0.1:9101
+//
+// With embedding.server.command in rag.yaml, the daemon starts the embedding
+// server itself and restarts it whenever it exits.
+//
+// With --metrics-addr, GET /metrics serves Prometheus metrics: passes by
+// outcome, pass durations, the time of the last successful pass, embedding
+// request durations and the backlog of unindexed messages and unsynced
+// chunks, to alert on when indexing falls behind.
+//
+// Build with -tags fts5 (see README); without it the FTS index is FTS4.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+var (
+	dbPath      = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile   = storage.KeyFileFlag()
+	cfgPath     = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	interval    = flag.Duration("interval", time.Minute, "How often to look for unindexed messages")
+	once        = flag.Bool("once", false, "Run a single pass and exit")
+	batchSize   = flag.Int("batch-size", 50, "Number of chunks to embed and insert per batch")
+	rechunkNow  = flag.Bool("rechunk", false, "Run the rolling re-chunk now instead of waiting for rechunk.hour")
+	metricsAddr = flag.String("metrics-addr", "", "Serve Prometheus metrics on this address (e.g. 127.0.0.1:9101); off if empty")
+	debug       = flag.Bool("debug", false, "Enable debug logging")
+)
+
+// indexer is the state shared by all passes
+type indexer struct {
+	cfg       *ragconfig.Config
+	db        *sql.DB
+	store     *storage.Storage
+	sink      ragindex.Sink
+	embClient *vectordb.EmbeddingClient
+	meta      *ragindex.Metadata
+	// rechunkNow runs the rolling re-chunk on the next check (--rechunk)
+	rechunkNow bool
+	// recorded is the embedding usage already written to usage_runs
+	recorded vectordb.EmbeddingUsage
+}
+
+// lastRechunkKey is the metadata key holding the date (YYYY-MM-DD, local
+// time) of the last rolling re-chunk
+const lastRechunkKey = "rechunk_last_run"
+
+func main() {
+	flag.Parse()
+
+	// Setup logging
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	// Load configuration
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	driver, tokenize, err := ragindex.LoadTokenizer(cfg)
+	if err != nil {
+		log.Warn().Err(err).Msg("Indexing with the unicode61 tokenizer instead")
+	}
+
+	db, err := sql.Open(storage.Driver(driver), sqlitePath+"?_busy_timeout=30000&_journal_mode=WAL")
+	if err != nil {
+		log.Fatal().Err(err).Str("path", sqlitePath).Msg("Failed to open database")
+	}
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		log.Fatal().Err(err).Msg("Database not accessible")
+	}
+
+	// indexed_at bookkeeping goes through storage, which also applies migrations
+	store, err := storage.New(sqlitePath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open storage")
+	}
+	defer store.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := ragindex.EnsureTables(ctx, db, ragindex.FTSTable(cfg), cfg.Hybrid.BM25.Engine, tokenize, io.Discard); err != nil {
+		log.Fatal().Err(err).Msg("Failed to create tables")
+	}
+
+	sink, err := ragindex.NewSink(ctx, cfg, db, io.Discard)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open vector store")
+	}
+	defer sink.Close()
+	created, err := sink.Prepare(ctx, false)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to prepare vector store")
+	}
+	if created {
+		log.Info().Msg("Vector store created, every chunk will be indexed")
+		if err := ragindex.ResetSynced(ctx, db); err != nil {
+			log.Fatal().Err(err).Msg("Failed to reset sync status")
+		}
+	}
+
+	embCfg, err := vectordb.EmbeddingConfigFrom(cfg.Embedding)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid embedding config")
+	}
+
+	meta, err := ragindex.OpenMetadata(ctx, db, cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open metadata table")
+	}
+
+	ix := &indexer{
+		cfg:        cfg,
+		db:         db,
+		store:      store,
+		sink:       sink,
+		embClient:  vectordb.NewEmbeddingClient(embCfg),
+		meta:       meta,
+		rechunkNow: *rechunkNow,
+	}
+
+	// Supervised for the daemon's lifetime, restarted if it crashes
+	embServer, err := vectordb.StartEmbeddingServer(ctx, cfg.Embedding.Server, ix.embClient.IsAvailable)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to start embedding server")
+	}
+	defer embServer.Stop()
+
+	if *interval < time.Second {
+		*interval = time.Second
+	}
+	log.Info().
+		Str("db", sqlitePath).
+		Str("vectors", cfg.Vector.Backend).
+		Dur("interval", *interval).
+		Msg("Indexing unindexed messages")
+
+	if *metricsAddr != "" {
+		go serveMetrics(ctx, *metricsAddr, db)
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		if err := observePass("index", func() error { return ix.pass(ctx) }); err != nil && ctx.Err() == nil {
+			log.Warn().Err(err).Msg("Indexing pass failed, retrying next interval")
+		}
+		if ix.rechunkDue(ctx, time.Now()) {
+			if err := observePass("rechunk", func() error { return ix.rechunk(ctx) }); err != nil && ctx.Err() == nil {
+				log.Warn().Err(err).Msg("Rolling re-chunk failed, retrying next interval")
+			}
+		}
+		if *once {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("Shutting down")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pass re-chunks the threads with unindexed messages and syncs their chunks.
+// Messages are marked indexed only once their chunks are in both stores, so
+// a failed pass is retried in full.
+func (ix *indexer) pass(ctx context.Context) error {
+	start := time.Now()
+	pending, err := ix.store.GetUnindexedByThread()
+	if err != nil {
+		return err
+	}
+
+	// Chunks left unsynced by an earlier failed pass are picked up too
+	unsynced, _, err := ragindex.CountPending(ctx, ix.db)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 && unsynced == 0 {
+		log.Debug().Msg("Nothing to index")
+		return nil
+	}
+
+	threadIDs := slices.Sorted(maps.Keys(pending))
+	chunks, inserted, removed, err := ix.reindex(ctx, threadIDs, start)
+	if err != nil {
+		return err
+	}
+
+	var messageIDs []string
+	for _, threadID := range threadIDs {
+		messageIDs = append(messageIDs, pending[threadID]...)
+	}
+	if err := ix.store.MarkMessagesIndexed(messageIDs); err != nil {
+		return err
+	}
+	messagesIndexed.Add(float64(len(messageIDs)))
+
+	log.Info().
+		Int("messages", len(messageIDs)).
+		Int("threads", len(threadIDs)).
+		Int("chunks", chunks).
+		Int("embedded", inserted).
+		Int("removed", len(removed)).
+		Dur("took", time.Since(start)).
+		Msg("Indexed")
+	return nil
+}
+
+// reindex regenerates the chunks of threadIDs, removes the vectors of chunks
+// no longer produced and embeds the new and changed ones, along with any left
+// unsynced by an earlier failed pass
+func (ix *indexer) reindex(ctx context.Context, threadIDs []int64, start time.Time) (chunks, inserted int, removed []string, err error) {
+	chunks, removed, err = ragindex.LoadThreads(ctx, ix.db, ix.cfg, threadIDs)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(removed) > 0 {
+		if _, err := ix.sink.Delete(ctx, removed); err != nil {
+			// Harmless for search (chunks without a row are skipped); --cleanup
+			// in rag-pipeline or milvus-index removes them later
+			log.Warn().Err(err).Int("chunks", len(removed)).Msg("Failed to delete stale vectors")
+		}
+	}
+
+	unsynced, _, err := ragindex.CountPending(ctx, ix.db)
+	if err != nil {
+		return chunks, 0, removed, err
+	}
+	if unsynced > 0 {
+		if !ix.embClient.IsAvailable(ctx) {
+			return chunks, 0, removed, fmt.Errorf("embedding service not available at %s", ix.cfg.Embedding.BaseURL)
+		}
+		inserted, _, err = ragindex.IndexChunks(ctx, ix.db, ix.sink, ix.embClient, nil, *batchSize, nil)
+		chunksEmbedded.Add(float64(inserted))
+		ix.recordUsage(start)
+		if err != nil {
+			return chunks, inserted, removed, err
+		}
+		if err := ix.sink.Flush(ctx); err != nil {
+			log.Warn().Err(err).Msg("Failed to flush")
+		}
+	}
+	return chunks, inserted, removed, nil
+}
+
+// rechunkDue reports whether the rolling re-chunk should run: with --rechunk
+// on the first call, else once a day from rechunk.hour on
+func (ix *indexer) rechunkDue(ctx context.Context, now time.Time) bool {
+	if ix.rechunkNow {
+		ix.rechunkNow = false
+		return true
+	}
+	rc := ix.cfg.Rechunk
+	if !rc.Enabled || rc.Threads <= 0 || now.Hour() < rc.Hour {
+		return false
+	}
+	last, err := ix.meta.Get(ctx, lastRechunkKey)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read last re-chunk date")
+		return false
+	}
+	return last != now.Format(time.DateOnly)
+}
+
+// rechunk regenerates the chunks of up to rechunk.threads threads, those
+// chunked longest ago, so config drift and edits the change tracking missed
+// are picked up gradually. Only chunks whose content changed are embedded.
+func (ix *indexer) rechunk(ctx context.Context) error {
+	start := time.Now()
+	rc := ix.cfg.Rechunk
+	threads := rc.Threads
+	if threads <= 0 {
+		threads = ragconfig.Default().Rechunk.Threads
+	}
+	before := start.AddDate(0, 0, -rc.MinAgeDays).UnixMilli()
+	threadIDs, err := ragindex.OldestChunkedThreads(ctx, ix.db, threads, before)
+	if err != nil {
+		return err
+	}
+
+	var chunks, inserted int
+	var removed []string
+	if len(threadIDs) > 0 {
+		chunks, inserted, removed, err = ix.reindex(ctx, threadIDs, start)
+		if err != nil {
+			return err
+		}
+	}
+	if err := ix.meta.Set(ctx, map[string]string{lastRechunkKey: start.Format(time.DateOnly)}); err != nil {
+		return err
+	}
+
+	log.Info().
+		Int("threads", len(threadIDs)).
+		Int("chunks", chunks).
+		Int("embedded", inserted).
+		Int("removed", len(removed)).
+		Dur("took", time.Since(start)).
+		Msg("Rolling re-chunk done")
+	return nil
+}
+
+// recordUsage writes the embedding usage since the previous call as one run
+func (ix *indexer) recordUsage(start time.Time) {
+	usage := ix.embClient.Usage()
+	if usage.Requests == ix.recorded.Requests {
+		return
+	}
+	run := storage.UsageRun{
+		Kind:         "index",
+		Component:    "embedding",
+		Model:        ix.embClient.Model(),
+		Requests:     usage.Requests - ix.recorded.Requests,
+		PromptTokens: usage.PromptTokens - ix.recorded.PromptTokens,
+		TotalTokens:  usage.TotalTokens - ix.recorded.TotalTokens,
+		StartedAt:    start.UnixMilli(),
+		FinishedAt:   time.Now().UnixMilli(),
+	}
+	run.CostUSD = ix.cfg.EstimateCost(run.Model, run.PromptTokens, 0)
+	if err := storage.RecordUsage(ix.db, run); err != nil {
+		log.Warn().Err(err).Msg("Failed to record embedding usage")
+		return
+	}
+	ix.recorded = usage
+}
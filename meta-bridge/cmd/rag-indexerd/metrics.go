@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/metrics"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+)
+
+var (
+	passesTotal = metrics.Default.NewCounter("rag_indexer_passes_total",
+		"Indexing passes by kind (index or rechunk) and outcome (ok or error).", "kind", "outcome")
+	passDuration = metrics.Default.NewHistogram("rag_indexer_pass_duration_seconds",
+		"Indexing pass duration by kind.", []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}, "kind")
+	lastSuccess = metrics.Default.NewGauge("rag_indexer_last_success_timestamp_seconds",
+		"Unix time the last pass of each kind succeeded.", "kind")
+	messagesIndexed = metrics.Default.NewCounter("rag_indexer_messages_indexed_total", "Messages marked indexed.")
+	chunksEmbedded  = metrics.Default.NewCounter("rag_indexer_chunks_embedded_total", "Chunks embedded into the vector store.")
+)
+
+// observePass runs one pass of kind and records its outcome and duration
+func observePass(kind string, pass func() error) error {
+	start := time.Now()
+	err := pass()
+	passDuration.ObserveSince(start, kind)
+	if err != nil {
+		passesTotal.Inc(kind, "error")
+		return err
+	}
+	passesTotal.Inc(kind, "ok")
+	lastSuccess.SetToCurrentTime(kind)
+	return nil
+}
+
+// serveMetrics serves GET /metrics on addr until ctx is done: the pass and
+// embedding metrics of this process and the indexing backlog
+func serveMetrics(ctx context.Context, addr string, db *sql.DB) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		backlog, err := ragindex.CountBacklog(r.Context(), db)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to count indexing backlog")
+			http.Error(w, "counting backlog failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", metrics.ContentType)
+		backlog.WriteMetrics(w)
+		metrics.Default.WriteText(w)
+	})
+	server := &http.Server{Addr: addr, Handler: mux, ReadTimeout: 10 * time.Second, WriteTimeout: 30 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	log.Info().Str("addr", addr).Msg("Serving metrics")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error().Err(err).Str("addr", addr).Msg("Metrics server failed")
+	}
+}
@@ -0,0 +1,291 @@
+// rag-pipeline rebuilds the search indexes in one run: it generates chunks
+// from the messages table into the chunks/FTS5 tables (fts5-setup --from-db),
+// embeds new and changed chunks into the vector store (milvus-index), and
+// finishes with a consistency report.
+//
+// Runs are incremental. Chunk generation is skipped when neither the messages
+// nor the chunking config changed since the last run, and only unsynced
+// chunks are embedded. A change of embedding model, dimension or vector
+// backend since the last run triggers a full reindex, as --drop would.
+// What the index was built from is recorded in the metadata table
+// (metadata.table in rag.yaml).
+//
+// Usage:
+//
+//	rag-pipeline --db messenger.db
+//	rag-pipeline --db messenger.db --force     # Regenerate chunks even if messages are unchanged
+//	rag-pipeline --db messenger.db --drop      # Drop and rebuild the vector store
+//	rag-pipeline --db messenger.db --skip-index  # Chunks and FTS only, no embedding service needed
+//	rag-pipeline --db messenger.db --progress json  # Machine-readable progress on stderr
+//
+// Build with -tags fts5 (see README), like fts5-setup. Exits 1 if the report
+// finds problems.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/progress"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+var (
+	dbPath    = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile = storage.KeyFileFlag()
+	cfgPath   = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	force     = flag.Bool("force", false, "Regenerate chunks even if the messages and chunking config are unchanged")
+	dropFirst = flag.Bool("drop", false, "Drop the vector store (collection or table) and reindex every chunk")
+	skipIndex = flag.Bool("skip-index", false, "Only generate chunks and the FTS index, skip embedding")
+	cleanup   = flag.Bool("cleanup", false, "Delete stale chunks from the vector store (non-indexable or deleted from SQLite)")
+	batchSize = flag.Int("batch-size", 50, "Number of chunks to embed and insert per batch")
+	debug     = flag.Bool("debug", false, "Enable debug logging")
+
+	progressFormat = progress.Flag()
+)
+
+func main() {
+	flag.Parse()
+
+	// Setup logging
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	progressFmt, err := progress.ParseFormat(*progressFormat)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid -progress")
+	}
+
+	// Load configuration
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	ftsTable := ragindex.FTSTable(cfg)
+
+	fmt.Printf("Configuration:\n")
+	fmt.Printf("  SQLite: %s\n", sqlitePath)
+	fmt.Printf("  FTS table: %s\n", ftsTable)
+	fmt.Printf("  Vectors: %s\n", cfg.Vector.Backend)
+	fmt.Printf("  Embedding: %s (%d dim)\n", cfg.Embedding.Model, cfg.Embedding.Dimension)
+	fmt.Println()
+
+	driver, tokenize, err := ragindex.LoadTokenizer(cfg)
+	if err != nil {
+		log.Warn().Err(err).Msg("Indexing with the unicode61 tokenizer instead")
+	}
+
+	db, err := sql.Open(storage.Driver(driver), sqlitePath+"?_busy_timeout=30000&_journal_mode=WAL")
+	if err != nil {
+		log.Fatal().Err(err).Str("path", sqlitePath).Msg("Failed to open database")
+	}
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		log.Fatal().Err(err).Msg("Database not accessible")
+	}
+
+	ctx := context.Background()
+	start := time.Now()
+	keys := cfg.Metadata.Keys
+
+	meta, err := ragindex.OpenMetadata(ctx, db, cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open metadata table")
+	}
+
+	// Step 1: chunks and FTS
+	fmt.Println("=== [1/3] Chunks ===")
+	if err := ragindex.EnsureTables(ctx, db, ftsTable, cfg.Hybrid.BM25.Engine, tokenize, os.Stdout); err != nil {
+		log.Fatal().Err(err).Msg("Failed to create tables")
+	}
+	fingerprint, err := ragindex.SourceFingerprint(ctx, db, cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to fingerprint messages")
+	}
+	lastFingerprint, err := meta.Get(ctx, keys.SourceFingerprint)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to read metadata")
+	}
+	if fingerprint == lastFingerprint && !*force {
+		fmt.Println("Messages and chunking config unchanged since the last run, skipping (use --force to regenerate)")
+	} else {
+		prog := progress.New(os.Stderr, progressFmt, "chunk", "threads", 0)
+		if _, _, err := ragindex.LoadFromMessages(ctx, db, cfg, os.Stdout, prog); err != nil {
+			log.Fatal().Err(err).Msg("Failed to generate chunks")
+		}
+		// Recorded right away: chunks changed here stay unsynced until indexed,
+		// so a failed indexing step is picked up by the next run regardless
+		err := meta.Set(ctx, map[string]string{
+			keys.SourceFingerprint: fingerprint,
+			keys.ChunkingVersion:   strconv.Itoa(cfg.Chunking.Version),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to record metadata")
+		}
+	}
+	fmt.Println()
+
+	// Step 2: vectors
+	fmt.Println("=== [2/3] Vectors ===")
+	var sink ragindex.Sink
+	if *skipIndex {
+		fmt.Println("Skipped (--skip-index)")
+	} else {
+		sink = indexVectors(ctx, db, cfg, meta, start, progressFmt)
+		defer sink.Close()
+	}
+	fmt.Println()
+
+	// Step 3: consistency report
+	fmt.Println("=== [3/3] Consistency ===")
+	lines := buildReport(ctx, db, ftsTable, sink, !*skipIndex)
+	problems := printReport(lines)
+	fmt.Printf("Duration: %s\n", time.Since(start).Round(time.Second))
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
+
+// embedPending indexes the unsynced chunks, starting embedding.server.command
+// first if needed. The server is stopped before it returns, so a failure the
+// caller exits on doesn't leave it running.
+func embedPending(ctx context.Context, db *sql.DB, cfg *ragconfig.Config, sink ragindex.Sink, embClient *vectordb.EmbeddingClient, prog *progress.Reporter) (int, error) {
+	embServer, err := vectordb.StartEmbeddingServer(ctx, cfg.Embedding.Server, embClient.IsAvailable)
+	if err != nil {
+		return 0, err
+	}
+	defer embServer.Stop()
+	if !embClient.IsAvailable(ctx) {
+		return 0, fmt.Errorf("embedding service not available at %s", cfg.Embedding.BaseURL)
+	}
+	inserted, _, err := ragindex.IndexChunks(ctx, db, sink, embClient, nil, *batchSize, prog)
+	return inserted, err
+}
+
+// indexVectors embeds unsynced chunks into the vector store, reindexing
+// everything first if the embedding model or backend changed since the last
+// run, and returns the open store for the report
+func indexVectors(ctx context.Context, db *sql.DB, cfg *ragconfig.Config, meta *ragindex.Metadata, start time.Time, progressFmt progress.Format) ragindex.Sink {
+	keys := cfg.Metadata.Keys
+	current := map[string]string{
+		keys.EmbeddingModel: cfg.Embedding.Model,
+		keys.EmbeddingDim:   strconv.Itoa(cfg.Embedding.Dimension),
+		keys.VectorBackend:  cfg.Vector.Backend,
+	}
+	drop := *dropFirst
+	for _, key := range []string{keys.EmbeddingModel, keys.EmbeddingDim, keys.VectorBackend} {
+		last, err := meta.Get(ctx, key)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to read metadata")
+		}
+		// No recorded value means the index predates rag-pipeline; trust it
+		if last != "" && last != current[key] && !drop {
+			fmt.Printf("%s changed (%s -> %s), reindexing everything\n", key, last, current[key])
+			drop = true
+		}
+	}
+
+	sink, err := ragindex.NewSink(ctx, cfg, db, os.Stdout)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open vector store")
+	}
+	embCfg, err := vectordb.EmbeddingConfigFrom(cfg.Embedding)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid embedding config")
+	}
+	embClient := vectordb.NewEmbeddingClient(embCfg)
+
+	needsFullReindex, err := sink.Prepare(ctx, drop)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to prepare vector store")
+	}
+	if needsFullReindex {
+		fmt.Println("Resetting sync status for full reindex...")
+		if err := ragindex.ResetSynced(ctx, db); err != nil {
+			log.Fatal().Err(err).Msg("Failed to reset sync status")
+		}
+	}
+
+	unsynced, total, err := ragindex.CountPending(ctx, db)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to count chunks")
+	}
+	fmt.Printf("Unsynced chunks: %d (of %d total indexable)\n", unsynced, total)
+
+	if unsynced > 0 {
+		prog := progress.New(os.Stderr, progressFmt, "index", "chunks", int64(unsynced))
+		inserted, err := embedPending(ctx, db, cfg, sink, embClient, prog)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to index chunks")
+		}
+		fmt.Printf("Inserted %d chunks\n", inserted)
+		if err := sink.Flush(ctx); err != nil {
+			log.Warn().Err(err).Msg("Failed to flush")
+		}
+	} else {
+		fmt.Println("All chunks already synced to the vector store.")
+	}
+
+	if usage := embClient.Usage(); usage.Requests > 0 {
+		fmt.Printf("Embedding tokens: %d (%d requests)\n", usage.TotalTokens, usage.Requests)
+		if err := storage.RecordUsage(db, storage.UsageRun{
+			Kind:         "index",
+			Component:    "embedding",
+			Model:        embClient.Model(),
+			Requests:     usage.Requests,
+			PromptTokens: usage.PromptTokens,
+			TotalTokens:  usage.TotalTokens,
+			CostUSD:      cfg.EstimateCost(embClient.Model(), usage.PromptTokens, 0),
+			StartedAt:    start.UnixMilli(),
+			FinishedAt:   time.Now().UnixMilli(),
+		}); err != nil {
+			log.Warn().Err(err).Msg("Failed to record embedding usage")
+		}
+	}
+
+	if *cleanup {
+		deleted, err := ragindex.CleanupStale(ctx, db, sink, os.Stdout)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to cleanup stale chunks")
+		} else if deleted > 0 {
+			fmt.Printf("Cleaned up %d stale chunks from the vector store\n", deleted)
+		}
+	}
+
+	current[keys.ConfigHash] = cfg.Hash()
+	current[keys.IndexedAt] = strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if err := meta.Set(ctx, current); err != nil {
+		log.Warn().Err(err).Msg("Failed to record metadata")
+	}
+	return sink
+}
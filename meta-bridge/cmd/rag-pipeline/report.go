@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+)
+
+// reportLine is one row of the consistency report
+type reportLine struct {
+	name    string
+	value   string
+	problem bool
+	hint    string
+}
+
+// buildReport checks that the chunks, FTS and vector tables agree. sink is
+// nil when indexing was skipped; indexed says whether unsynced chunks count
+// as a problem.
+func buildReport(ctx context.Context, db *sql.DB, ftsTable string, sink ragindex.Sink, indexed bool) []reportLine {
+	var lines []reportLine
+	queryErr := func(name string, err error) {
+		lines = append(lines, reportLine{name: name, value: "ERROR: " + err.Error(), problem: true})
+	}
+
+	var total, indexable int64
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(is_indexable), 0) FROM chunks").Scan(&total, &indexable)
+	if err != nil {
+		queryErr("chunks", err)
+		return lines
+	}
+	lines = append(lines, reportLine{name: "chunks", value: fmt.Sprintf("%d (%d indexable)", total, indexable)})
+
+	unsynced, _, err := ragindex.CountPending(ctx, db)
+	if err != nil {
+		queryErr("unsynced chunks", err)
+	} else {
+		line := reportLine{name: "unsynced chunks", value: fmt.Sprint(unsynced)}
+		if unsynced > 0 && indexed {
+			line.problem = true
+			line.hint = "run rag-pipeline again (embedding failures leave chunks unsynced)"
+		}
+		lines = append(lines, line)
+	}
+
+	if sink != nil {
+		stored, err := sink.Count(ctx)
+		if err != nil {
+			queryErr("stored vectors", err)
+		} else {
+			line := reportLine{name: "stored vectors", value: fmt.Sprintf("%d (want %d)", stored, indexable)}
+			synced := indexable - int64(unsynced)
+			switch {
+			case stored < synced:
+				line.problem = true
+				line.hint = "chunks are marked synced without a vector; rebuild with --drop"
+			case stored > indexable:
+				// Not a problem on its own: Milvus counts deleted rows until compaction
+				line.hint = "stale vectors can be removed with --cleanup"
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	var orphaned int64
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(DISTINCT c.chunk_id) FROM chunks c, json_each(c.message_ids) j
+		LEFT JOIN messages m ON m.id = j.value
+		WHERE m.id IS NULL`).Scan(&orphaned)
+	if err != nil {
+		queryErr("chunks referencing missing messages", err)
+	} else {
+		line := reportLine{name: "chunks referencing missing messages", value: fmt.Sprint(orphaned)}
+		if orphaned > 0 {
+			line.problem = true
+			line.hint = "messages were deleted after chunking; search can still return their text"
+		}
+		lines = append(lines, line)
+	}
+
+	var hasFTS int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE name = ?", ftsTable).Scan(&hasFTS)
+	if err != nil {
+		queryErr(ftsTable, err)
+	} else if hasFTS == 0 {
+		lines = append(lines, reportLine{name: ftsTable, value: "missing", problem: true})
+	} else {
+		line := reportLine{name: ftsTable + " integrity", value: "ok"}
+		if err := ragindex.CheckFTSIntegrity(ctx, db, ftsTable); err != nil {
+			line.value, line.problem = "ERROR: "+err.Error(), true
+			if strings.Contains(err.Error(), "malformed") || strings.Contains(err.Error(), "corrupt") {
+				line.value = "out of sync with chunks"
+				line.hint = "rebuild with: audit --fix"
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// printReport prints lines and returns how many are problems
+func printReport(lines []reportLine) int {
+	problems := 0
+	for _, l := range lines {
+		mark := " "
+		if l.problem {
+			mark = "!"
+			problems++
+		}
+		fmt.Printf("%s %-40s %s\n", mark, l.name+":", l.value)
+		if l.hint != "" {
+			fmt.Printf("  %-40s -> %s\n", "", l.hint)
+		}
+	}
+	fmt.Println()
+	if problems == 0 {
+		fmt.Println("Index is consistent")
+	} else {
+		fmt.Printf("Problems: %d\n", problems)
+	}
+	return problems
+}
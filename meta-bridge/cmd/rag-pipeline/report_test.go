@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+)
+
+// countSink is a vector store that only reports a row count
+type countSink struct {
+	ragindex.Sink
+	count int64
+}
+
+func (s countSink) Count(ctx context.Context) (int64, error) { return s.count, nil }
+
+func TestBuildReport(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	for _, q := range []string{
+		`CREATE TABLE messages (id TEXT PRIMARY KEY)`,
+		`CREATE TABLE chunks (chunk_id TEXT PRIMARY KEY, message_ids TEXT NOT NULL, is_indexable INTEGER NOT NULL, milvus_synced INTEGER DEFAULT 0)`,
+		`INSERT INTO messages VALUES ('m1'), ('m2')`,
+		`INSERT INTO chunks VALUES ('a', '["m1"]', 1, 1), ('b', '["m2"]', 1, 1), ('c', '["m2"]', 0, 0)`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+
+	// Consistent apart from the FTS table this test can't create without fts5
+	lines := buildReport(ctx, db, "chunks_fts", countSink{count: 2}, true)
+	if got := problems(lines); got != "chunks_fts" {
+		t.Fatalf("problems = %q, want only the missing FTS table", got)
+	}
+
+	// A deleted message, a pending chunk and a vector missing for a synced chunk
+	for _, q := range []string{
+		`DELETE FROM messages WHERE id = 'm1'`,
+		`INSERT INTO chunks VALUES ('d', '["m2"]', 1, 0)`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	lines = buildReport(ctx, db, "chunks_fts", countSink{count: 1}, true)
+	want := "unsynced chunks,stored vectors,chunks referencing missing messages,chunks_fts"
+	if got := problems(lines); got != want {
+		t.Fatalf("problems = %q, want %q", got, want)
+	}
+
+	// Pending chunks are expected when indexing was skipped
+	lines = buildReport(ctx, db, "chunks_fts", nil, false)
+	if got := problems(lines); strings.Contains(got, "unsynced") || strings.Contains(got, "stored") {
+		t.Fatalf("problems = %q with indexing skipped", got)
+	}
+}
+
+func problems(lines []reportLine) string {
+	var names []string
+	for _, l := range lines {
+		if l.problem {
+			names = append(names, l.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
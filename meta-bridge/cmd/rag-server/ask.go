@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-meta/pkg/rag"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// askWriteTimeout is how long an /ask response may take: every LLM attempt
+// can run for the full llm.timeout_seconds, which is past the server's
+// WriteTimeout
+func askWriteTimeout(cfg ragconfig.LLMConfig) time.Duration {
+	perAttempt := time.Duration(cfg.TimeoutSeconds) * time.Second
+	if perAttempt <= 0 {
+		perAttempt = 120 * time.Second
+	}
+	return perAttempt*time.Duration(max(cfg.MaxRetries, 0)+1) + 30*time.Second
+}
+
+// askHandler handles POST /ask requests: a JSON rag.AskRequest, answered
+// from the chunks a hybrid search returns for the question. Clients that
+// accept text/event-stream (or pass ?stream=true) get the answer as it is
+// generated; see streamAsk.
+func askHandler(svc *rag.Service, writeTimeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+			zerolog.Ctx(r.Context()).Debug().Err(err).Msg("Failed to extend write deadline for /ask")
+		}
+
+		var req rag.AskRequest
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+
+		tags, err := storage.NormalizeTags(req.Tags)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.Tags = tags
+
+		if wantsEventStream(r) {
+			streamAsk(w, r, svc, req)
+			return
+		}
+
+		resp, err := svc.Ask(r.Context(), req)
+		if err != nil {
+			writeServiceError(w, r, err, "ask failed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// wantsEventStream reports whether an /ask client asked for streaming
+func wantsEventStream(r *http.Request) bool {
+	if r.URL.Query().Get("stream") == "true" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// streamAsk answers an /ask request as server-sent events:
+//
+//	event: token   data: {"text": "..."}      for each piece of the answer
+//	event: done    data: rag.AskResponse      the whole answer and its sources, citations marked
+//	event: error   data: {"error": "..."}     if answering failed after the stream began
+//
+// The stream begins with the first token, so failures before it (bad
+// filters, no LLM, search errors) are ordinary JSON errors with a status.
+func streamAsk(w http.ResponseWriter, r *http.Request, svc *rag.Service, req rag.AskRequest) {
+	rc := http.NewResponseController(w)
+	started := false
+	send := func(event string, v any) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("X-Accel-Buffering", "no")
+			w.WriteHeader(http.StatusOK)
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	resp, err := svc.AskStream(r.Context(), req, func(text string) error {
+		return send("token", map[string]string{"text": text})
+	})
+	if err != nil {
+		if !started {
+			writeServiceError(w, r, err, "ask failed")
+			return
+		}
+		zerolog.Ctx(r.Context()).Warn().Err(err).Msg("/ask stream failed")
+		send("error", map[string]string{"error": "ask failed"})
+		return
+	}
+	send("done", resp)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+const (
+	defaultChangesLimit = 500
+	maxChangesLimit     = 5000
+)
+
+// ChangesResponse is the response for GET /changes
+type ChangesResponse struct {
+	Changes []storage.Change `json:"changes"`
+	// Cursor to pass as ?cursor= on the next request
+	NextCursor int64 `json:"next_cursor"`
+	HasMore    bool  `json:"has_more"`
+}
+
+// changesHandler handles GET /changes?cursor=N&limit=M requests
+func changesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		var cursor int64
+		if c := query.Get("cursor"); c != "" {
+			v, err := strconv.ParseInt(c, 10, 64)
+			if err != nil || v < 0 {
+				writeError(w, http.StatusBadRequest, "invalid cursor")
+				return
+			}
+			cursor = v
+		}
+
+		limit := parseIntDefault(query.Get("limit"), defaultChangesLimit)
+		if limit <= 0 || limit > maxChangesLimit {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxChangesLimit))
+			return
+		}
+
+		// Fetch one extra row to know whether there's more
+		changes, err := storage.ListChanges(db, cursor, limit+1)
+		if err != nil && !strings.Contains(err.Error(), "no such table") {
+			writeServiceError(w, r, err, "changes failed")
+			return
+		}
+
+		resp := ChangesResponse{Changes: changes, NextCursor: cursor}
+		if len(changes) > limit {
+			resp.Changes = changes[:limit]
+			resp.HasMore = true
+		}
+		if resp.Changes == nil {
+			resp.Changes = []storage.Change{}
+		}
+		if n := len(resp.Changes); n > 0 {
+			resp.NextCursor = resp.Changes[n-1].Seq
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.mau.fi/mautrix-meta/pkg/rag"
+)
+
+const (
+	defaultChunksPageSize = 50
+	maxChunksPageSize     = 500
+)
+
+// ChunksResponse is the response for GET /chunks
+type ChunksResponse struct {
+	Page     int         `json:"page"`
+	PageSize int         `json:"page_size"`
+	Total    int64       `json:"total"`
+	HasMore  bool        `json:"has_more"`
+	Chunks   []rag.Chunk `json:"chunks"`
+}
+
+// chunksHandler handles GET /chunks?thread_id=&indexable=&min_chars=&page=&page_size=
+// requests. It browses raw chunks without searching, to debug why something
+// isn't retrievable (not indexable, too short, split oddly, ...).
+func chunksHandler(chunks *rag.SQLiteChunkStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		var filter rag.ChunkListFilter
+		if s := query.Get("thread_id"); s != "" {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid thread_id")
+				return
+			}
+			filter.ThreadID = id
+		}
+		if s := query.Get("indexable"); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid indexable (use true or false)")
+				return
+			}
+			filter.Indexable = &b
+		}
+		filter.MinChars = max(parseIntDefault(query.Get("min_chars"), 0), 0)
+
+		page := max(parseIntDefault(query.Get("page"), 1), 1)
+		pageSize := clampInt(parseIntDefault(query.Get("page_size"), defaultChunksPageSize), 1, maxChunksPageSize)
+
+		list, total, err := chunks.ListChunks(r.Context(), filter, pageSize, (page-1)*pageSize)
+		if err != nil {
+			writeServiceError(w, r, err, "listing chunks failed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, ChunksResponse{
+			Page:     page,
+			PageSize: pageSize,
+			Total:    total,
+			HasMore:  int64(page*pageSize) < total,
+			Chunks:   list,
+		})
+	}
+}
+
+// chunkHandler handles GET /chunks/{id} requests
+func chunkHandler(chunks *rag.SQLiteChunkStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chunk, err := chunks.GetByID(r.Context(), r.PathValue("id"))
+		if errors.Is(err, rag.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "chunk not found")
+			return
+		}
+		if err != nil {
+			writeServiceError(w, r, err, "chunk lookup failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, chunk)
+	}
+}
+
+// chunkContextHandler handles GET /chunks/{id}/context?radius=&before=&after=
+// requests: the chunk and its neighbours in the session, for clients that
+// expand a hit's context on demand instead of searching with context=N.
+// before and after default to radius, which defaults to 2.
+func chunkContextHandler(chunks *rag.SQLiteChunkStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		radius, err := intParam(query, "radius", 2)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		before, err := intParam(query, "before", radius)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		after, err := intParam(query, "after", radius)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for _, n := range []int{radius, before, after} {
+			if n < 0 || n > rag.MaxChunkContext {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("radius, before and after must be 0 to %d", rag.MaxChunkContext))
+				return
+			}
+		}
+
+		cc, err := chunks.ChunkContext(r.Context(), r.PathValue("id"), before, after)
+		if errors.Is(err, rag.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "chunk not found")
+			return
+		}
+		if err != nil {
+			writeServiceError(w, r, err, "chunk context lookup failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, cc)
+	}
+}
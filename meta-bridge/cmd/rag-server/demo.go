@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"go.mau.fi/mautrix-meta/pkg/pseudonym"
+)
+
+// demoBlockedPaths are read endpoints that are still off in --readonly-demo:
+// operational data (usage, metrics, slow queries with query text, retrieval
+// coverage, pipeline state), the raw change feed, and avatars and attachments, which identify
+// people no matter what their names are replaced with
+var demoBlockedPaths = []string{"/usage", "/metrics", "/slow-queries", "/cold-segments", "/pipeline", "/changes", "/static/avatars/", "/media/"}
+
+// demoAllowed reports whether a request may reach the mux in --readonly-demo.
+// Mutations are refused by method so endpoints added later are covered too;
+// POST /search is the one read that uses POST. POST /ask is refused as well,
+// since every request spends LLM tokens.
+func demoAllowed(r *http.Request) bool {
+	path := unversionedPath(r.URL.Path)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	case http.MethodPost:
+		if path != "/search" {
+			return false
+		}
+	default:
+		return false
+	}
+	for _, p := range demoBlockedPaths {
+		if path == strings.TrimSuffix(p, "/") || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return false
+		}
+	}
+	// Attachments in message payloads are off like the files themselves
+	if inc, err := parseInclude(r.URL.Query().Get("include")); err == nil && inc.attachments {
+		return false
+	}
+	return true
+}
+
+// readonlyDemoMiddleware enforces --readonly-demo: disabled endpoints get 403,
+// and every other response has participant names replaced by pseudonyms
+func readonlyDemoMiddleware(p *pseudonym.Replacer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !demoAllowed(r) {
+			writeError(w, http.StatusForbidden, "disabled in read-only demo mode")
+			return
+		}
+
+		buf := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		next.ServeHTTP(buf, r)
+
+		body := p.Replace(buf.body.String())
+		for k, v := range buf.header {
+			w.Header()[k] = v
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(buf.status)
+		io.WriteString(w, body)
+	})
+}
+
+// bufferedResponse holds a response until it has been pseudonymized
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) WriteHeader(code int)        { b.status = code }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+// loadPseudonyms maps every contact's name, and its first word, to
+// "Participant <n>" as share-bundle does, numbered by contact ID so pseudonyms
+// stay the same across restarts. Entries in the YAML file at path (real name:
+// pseudonym) take precedence.
+func loadPseudonyms(db *sql.DB, path string) (*pseudonym.Replacer, error) {
+	names := make(pseudonym.Names)
+
+	rows, err := db.Query(`
+		SELECT name FROM contacts
+		WHERE name IS NOT NULL AND name != ''
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("loading contact names: %w", err)
+	}
+	defer rows.Close()
+	var n int64
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("loading contact names: %w", err)
+		}
+		n++
+		names.Add(name, pseudonym.Participant(n))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("loading contact names: %w", err)
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading pseudonym map: %w", err)
+		}
+		var overrides map[string]string
+		if err := yaml.Unmarshal(data, &overrides); err != nil {
+			return nil, fmt.Errorf("parsing pseudonym map: %w", err)
+		}
+		for real, alias := range overrides {
+			if real = strings.TrimSpace(real); real != "" {
+				names[strings.ToLower(real)] = alias
+			}
+		}
+	}
+	return pseudonym.NewReplacer(names), nil
+}
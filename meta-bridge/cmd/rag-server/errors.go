@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-meta/pkg/rag"
+)
+
+// errorStatus maps the sentinel errors of rag (shared with storage and
+// vectordb) to an HTTP status
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, rag.ErrBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, rag.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, rag.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, rag.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeServiceError writes err with the status errorStatus picks. Validation
+// errors carry their own message; anything else is reported as the generic
+// action message plus the status text so internals don't leak.
+func writeServiceError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	status := errorStatus(err)
+	switch {
+	case status == http.StatusBadRequest:
+		writeError(w, status, err.Error())
+		return
+	case status >= http.StatusInternalServerError:
+		zerolog.Ctx(r.Context()).Error().Err(err).Int("status", status).Msg(action)
+	default:
+		zerolog.Ctx(r.Context()).Debug().Err(err).Int("status", status).Msg(action)
+	}
+	if status != http.StatusInternalServerError {
+		action += ": " + strings.ToLower(http.StatusText(status))
+	}
+	writeError(w, status, action)
+}
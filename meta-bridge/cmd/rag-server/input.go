@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"unicode/utf8"
+)
+
+// maxJSONBodyBytes caps POST bodies. The largest legitimate one, a search
+// with a 2000-character query and 20 tags, is a few KiB.
+const maxJSONBodyBytes = 64 << 10
+
+// decodeJSONBody reads a JSON request body of at most maxJSONBodyBytes into
+// v. On failure it writes the error response (413 for an oversized body, 400
+// for invalid UTF-8 or JSON) and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body too large (max %d KiB)", maxJSONBodyBytes>>10))
+		return false
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read request body")
+		return false
+	}
+	// encoding/json would silently turn invalid bytes into U+FFFD
+	if !utf8.Valid(body) {
+		writeError(w, http.StatusBadRequest, "request body is not valid UTF-8")
+		return false
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return false
+	}
+	return true
+}
+
+// validInputMiddleware rejects requests whose path or query string isn't
+// valid UTF-8, or whose query string is malformed, which url.Values would
+// otherwise mangle or silently drop
+func validInputMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !utf8.ValidString(r.URL.Path) {
+			writeError(w, http.StatusBadRequest, "path is not valid UTF-8")
+			return
+		}
+		query, err := url.ParseQuery(r.URL.RawQuery)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "malformed query string")
+			return
+		}
+		for key, values := range query {
+			if !utf8.ValidString(key) {
+				writeError(w, http.StatusBadRequest, "query string is not valid UTF-8")
+				return
+			}
+			for _, v := range values {
+				if !utf8.ValidString(v) {
+					writeError(w, http.StatusBadRequest, fmt.Sprintf("query parameter %s is not valid UTF-8", key))
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// intParam parses the query parameter name as an integer, or returns def
+// if it is absent. Unlike parseIntDefault, garbage is an error.
+func intParam(query url.Values, name string, def int) (int, error) {
+	s := query.Get(name)
+	if s == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q is not an integer", name, s)
+	}
+	return i, nil
+}
+
+// floatParam is intParam for floats; NaN and infinities are errors
+func floatParam(query url.Values, name string) (float64, error) {
+	s := query.Get(name)
+	if s == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid %s: %q is not a number", name, s)
+	}
+	return f, nil
+}
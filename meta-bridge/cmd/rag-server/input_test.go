@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSONBody(t *testing.T) {
+	decode := func(body string) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		var v map[string]any
+		if decodeJSONBody(rec, httptest.NewRequest(http.MethodPost, "/search", strings.NewReader(body)), &v) {
+			return http.StatusOK
+		}
+		return rec.Code
+	}
+
+	if got := decode(`{"q": "łódź"}`); got != http.StatusOK {
+		t.Errorf("valid body: status %d", got)
+	}
+	if got := decode(`{"q": "` + strings.Repeat("a", maxJSONBodyBytes) + `"}`); got != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: status %d, want 413", got)
+	}
+	if got := decode("{\"q\": \"caf\xe9\"}"); got != http.StatusBadRequest {
+		t.Errorf("invalid UTF-8: status %d, want 400", got)
+	}
+	if got := decode(`{"q": `); got != http.StatusBadRequest {
+		t.Errorf("truncated JSON: status %d, want 400", got)
+	}
+}
+
+func TestValidInputMiddleware(t *testing.T) {
+	h := validInputMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for target, want := range map[string]int{
+		"/search?q=%C5%82%C3%B3d%C5%BA": http.StatusOK,
+		"/search?q=caf%E9":              http.StatusBadRequest,
+		"/search?q=%zz":                 http.StatusBadRequest,
+		"/chunks/%FF":                   http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", target, rec.Code, want)
+		}
+	}
+}
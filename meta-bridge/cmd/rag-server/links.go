@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mau.fi/mautrix-meta/pkg/rag"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+const (
+	defaultLinksLimit = 50
+	maxLinksLimit     = 500
+	linkDomainFacets  = 20
+	maxLinksQueryLen  = 200
+)
+
+// LinksResponse is the response for GET /links
+type LinksResponse struct {
+	Links   []storage.Link        `json:"links"`
+	Total   int64                 `json:"total"`
+	Domains []storage.DomainCount `json:"domains"` // Most linked domains, ignoring ?domain=
+	Limit   int                   `json:"limit"`
+	Offset  int                   `json:"offset"`
+}
+
+// linksHandler handles GET /links?domain=&q=&thread_id=&after=&before=&limit=&offset=
+// requests: links shared in messages, newest first, with per-domain counts
+// for the same filters so a UI can offer them as facets.
+func linksHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		filter := storage.LinkFilter{
+			Domain: query.Get("domain"),
+			Query:  query.Get("q"),
+		}
+		if len(filter.Query) > maxLinksQueryLen {
+			writeError(w, http.StatusBadRequest, "q too long")
+			return
+		}
+		if s := query.Get("thread_id"); s != "" {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid thread_id")
+				return
+			}
+			filter.ThreadID = id
+		}
+		after, err := rag.ParseSearchTime(query.Get("after"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid after (use RFC3339 or YYYY[-MM[-DD]])")
+			return
+		}
+		before, err := rag.ParseSearchTime(query.Get("before"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid before (use RFC3339 or YYYY[-MM[-DD]])")
+			return
+		}
+		if !after.IsZero() {
+			filter.AfterMs = after.UnixMilli()
+		}
+		if !before.IsZero() {
+			filter.BeforeMs = before.UnixMilli()
+		}
+
+		limit := clampInt(parseIntDefault(query.Get("limit"), defaultLinksLimit), 1, maxLinksLimit)
+		offset := max(parseIntDefault(query.Get("offset"), 0), 0)
+
+		resp := LinksResponse{Links: []storage.Link{}, Domains: []storage.DomainCount{}, Limit: limit, Offset: offset}
+		links, total, err := storage.ListLinks(db, filter, limit, offset)
+		if err == nil {
+			resp.Links, resp.Total = links, total
+			resp.Domains, err = storage.LinkDomains(db, filter, linkDomainFacets)
+		}
+		if err != nil && !strings.Contains(err.Error(), "no such table") {
+			writeServiceError(w, r, err, "listing links failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -1,19 +1,64 @@
 // rag-server is the HTTP API server for RAG search operations.
 //
 // This is the authoritative backend for all search operations. Web UI,
-// CLI, and future MCP server should all use this API.
+// CLI and mcp-server should all use the same pkg/rag Service.
 //
-// Endpoints:
+// Endpoints (each also under /v1, e.g. /v1/search; see version.go for the
+// compatibility policy):
 //   - GET  /search   - Semantic/BM25/hybrid search
+//   - POST /ask      - Answer a question with the LLM from retrieved chunks, with citations (SSE with Accept: text/event-stream)
 //   - GET  /stats    - Collection statistics
 //   - GET  /health   - Health check
+//   - GET  /changes  - Change feed (cursor-based)
+//   - GET  /suggest  - Keyword auto-complete from the FTS vocabulary
+//   - GET  /recent   - Messages/chunks ingested since a timestamp, by thread (?include=attachments,reactions)
+//   - GET  /chunks   - Raw chunks, filtered by ?thread_id=&indexable=&min_chars=&page=
+//   - GET  /chunks/{id}         - A single chunk
+//   - GET  /chunks/{id}/context - A chunk with its neighbours in the session, by ?radius= or ?before=&after=
+//   - GET  /messages/{id}/seen  - Participants who have/haven't seen a message
+//   - GET  /links    - Links shared in messages by ?domain=&q=, with domain facet counts
+//   - GET  /tags     - Thread tags with thread counts
+//   - GET  /threads  - Threads with their archive completeness, optionally filtered by ?tags=a,b
+//   - GET  /threads/{id}/messages - A thread's messages, newest first, by ?before=&limit=&include=attachments,reactions
+//   - POST/DELETE /threads/tags - Add/remove tags on threads
+//   - DELETE /tags/{tag}        - Remove a tag from all threads
+//   - GET  /usage    - Token usage and estimated cost per run kind/model
+//   - GET  /metrics  - Prometheus metrics: requests, embedding and Milvus timings, indexing backlog
+//   - GET  /slow-queries - Searches over slow_query.threshold_ms, with stage timings
+//   - GET  /cold-segments - Sessions whose chunks searches never (or not lately) return
+//   - GET  /pipeline - Indexing backlog and the threads an export import would likely fill in
+//   - GET  /static/avatars/{id}      - Downloaded contact avatars
+//   - GET  /media/{attachment_id}    - Locally stored attachments
+//
+// With --readonly-demo (for public demos) every mutating request is refused,
+// as are /ask, /usage, /metrics, /slow-queries, /cold-segments, /pipeline,
+// /changes, avatars and attachments (include=attachments too), and
+// participant names in all responses are replaced with pseudonyms
+// ("Participant 12", or the ones given in --demo-names). The
+// database is only opened read-only, so tag edits and usage and retrieval
+// recording are off too.
+//
+// rag-server never migrates the archive: with a schema older than the build
+// it refuses to start until "migrate up" (or any writing tool) upgrades it.
+//
+// With keys or users in the auth section of rag.yaml, every request except
+// CORS preflights and auth.public paths needs an API key ("Authorization:
+// Bearer" or X-API-Key) or basic auth, and is held to its credential's
+// requests-per-minute limit (429 with Retry-After past it).
+//
+// Every response carries an X-Request-ID header (a client-supplied one is
+// reused); handler panics return 500 with that ID instead of dropping the
+// connection.
 package main
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -25,16 +70,26 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"go.mau.fi/mautrix-meta/pkg/httpauth"
+	"go.mau.fi/mautrix-meta/pkg/llm"
 	"go.mau.fi/mautrix-meta/pkg/rag"
 	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+	"go.mau.fi/mautrix-meta/pkg/storage"
 )
 
 var (
-	addr    = flag.String("addr", "127.0.0.1:8090", "HTTP listen address (default: loopback only)")
-	dbPath  = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
-	cfgPath = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
-	debug   = flag.Bool("debug", false, "Enable debug logging")
-	corsAny = flag.Bool("cors-any", false, "Allow CORS from any origin (for development)")
+	addr      = flag.String("addr", "127.0.0.1:8090", "HTTP listen address (default: loopback only)")
+	dbPath    = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile = storage.KeyFileFlag()
+	cfgPath   = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	debug     = flag.Bool("debug", false, "Enable debug logging")
+	corsAny   = flag.Bool("cors-any", false, "Allow CORS from any origin (for development)")
+
+	mediaToken = flag.String("media-token", "", "Require this bearer token for /static/avatars and /media (empty = no auth)")
+
+	readonlyDemo = flag.Bool("readonly-demo", false, "Public demo mode: refuse writes and admin endpoints, pseudonymize names")
+	demoNames    = flag.String("demo-names", "", "YAML map of real name to pseudonym for --readonly-demo (others become \"Participant N\")")
 )
 
 func main() {
@@ -48,6 +103,8 @@ func main() {
 	} else {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	}
+	// Request handlers log through zerolog.Ctx, which falls back to this
+	zerolog.DefaultContextLogger = &log.Logger
 
 	if *corsAny {
 		log.Warn().Msg("SECURITY WARNING: -cors-any is enabled; Access-Control-Allow-Origin will be '*'. Use only for local development.")
@@ -67,9 +124,17 @@ func main() {
 	if sqlitePath == "" {
 		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
 	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	driver, _, err := ragindex.LoadTokenizer(cfg)
+	if err != nil {
+		log.Warn().Err(err).Msg("Keyword index tokenizer not loaded")
+	}
 
 	// Open SQLite database
-	db, err := sql.Open("sqlite3", sqlitePath+"?mode=ro")
+	db, err := sql.Open(storage.Driver(driver), sqlitePath+"?mode=ro")
 	if err != nil {
 		log.Fatal().Err(err).Str("path", sqlitePath).Msg("Failed to open SQLite database")
 	}
@@ -81,53 +146,173 @@ func main() {
 	}
 	log.Info().Str("path", sqlitePath).Msg("Connected to SQLite")
 
+	// Separate read-write handle for tag edits; search stays on the read-only
+	// one. It never migrates the schema of the live archive.
+	var store *storage.Storage
+	if !*readonlyDemo {
+		store, err = storage.OpenExisting(sqlitePath)
+		if errors.Is(err, storage.ErrSchemaBehind) {
+			log.Fatal().Err(err).Str("path", sqlitePath).Msg("Database schema is older than this build; run migrate up")
+		} else if err != nil {
+			log.Warn().Err(err).Msg("Failed to open database for writing, tag editing disabled")
+		} else {
+			defer store.Close()
+		}
+	}
+
 	// Create service components
 	ctx := context.Background()
 
-	vectors, err := rag.NewMilvusVectorSearcher(ctx, cfg)
+	vectors, err := rag.NewVectorSearcher(ctx, cfg, db)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to connect to Milvus")
+		log.Fatal().Err(err).Str("backend", cfg.Vector.Backend).Msg("Failed to open vector store")
 	}
 	// Note: vectors.Close() is called by service.Close(), don't defer here
-	log.Info().Str("address", cfg.Milvus.Address).Msg("Connected to Milvus")
+	if cfg.Vector.Backend == ragconfig.VectorBackendSQLite {
+		log.Info().Msg("Using SQLite vector store")
+	} else {
+		log.Info().Str("address", cfg.Milvus.Address).Str("database", cfg.Milvus.Database).Msg("Connected to Milvus")
+	}
 
 	bm25, err := rag.NewSQLiteBM25Searcher(db, cfg)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create BM25 searcher")
 	}
+	bm25.LogFTSStatus(ctx)
 
 	chunks := rag.NewSQLiteChunkStore(db)
-	embedder := rag.NewEmbeddingClientAdapter(cfg)
+	embedder, err := rag.NewEmbeddingClientAdapter(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid embedding config")
+	}
 
 	service := rag.NewService(cfg, vectors, bm25, chunks, embedder)
 	defer service.Close()
+	if cfg.Rerank.Enabled {
+		service.SetReranker(rag.NewHTTPReranker(cfg.Rerank))
+		log.Info().Str("url", cfg.Rerank.BaseURL).Str("model", cfg.Rerank.Model).Int("top_n", cfg.Rerank.TopN).Msg("Reranking enabled")
+	}
+
+	// /ask needs a chat model
+	var llmClient *llm.Client
+	if askModel := cmp.Or(cfg.Ask.Model, cfg.LLM.Model); askModel == "" {
+		log.Info().Msg("No LLM model configured (ask.model or llm.model), /ask disabled")
+	} else if llmClient, err = llm.New(cfg.LLM); err != nil {
+		log.Fatal().Err(err).Msg("Invalid LLM config")
+	} else {
+		service.SetLLM(llmClient)
+		log.Info().Str("endpoint", cfg.LLM.BaseURL).Str("model", askModel).Msg("Question answering enabled")
+	}
+
+	// Record query embedding and /ask usage and chunk retrievals (needs the
+	// writable handle)
+	var usageRecorder *searchUsageRecorder
+	var retrievals *retrievalRecorder
+	usageCtx, stopUsage := context.WithCancel(ctx)
+	defer stopUsage()
+	if store != nil {
+		usageRecorder = newSearchUsageRecorder(store, cfg, embedder, llmClient)
+		go usageRecorder.run(usageCtx, usageFlushInterval)
+		service.SetSlowQueryRecorder(slowQueryStore{store})
+		retrievals = newRetrievalRecorder(store)
+		go retrievals.run(usageCtx, retrievalFlushInterval)
+		service.SetRetrievalRecorder(retrievals)
+	}
+	if cfg.SlowQuery.ThresholdMs > 0 {
+		log.Info().
+			Int("threshold_ms", cfg.SlowQuery.ThresholdMs).
+			Bool("persist", cfg.SlowQuery.Persist && store != nil).
+			Msg("Slow query logging enabled")
+	}
 
 	// Create HTTP server
 	mux := http.NewServeMux()
 
-	// Wrap handlers with CORS if enabled
+	// Wrap handlers with metrics, and CORS if enabled
 	wrap := func(h http.HandlerFunc) http.HandlerFunc {
+		h = instrumentHandler(h)
 		if *corsAny {
 			return corsMiddleware(h)
 		}
 		return h
 	}
-
-	mux.HandleFunc("GET /search", wrap(searchHandler(service)))
-	mux.HandleFunc("GET /stats", wrap(statsHandler(service)))
-	mux.HandleFunc("GET /health", wrap(healthHandler(service)))
+	// Every route is served under /v1 (see version.go) and unversioned
+	routes := versionedMux{mux: mux, wrap: wrap}
+
+	routes.HandleFunc("GET /search", searchHandler(service))
+	routes.HandleFunc("GET /stats", statsHandler(service))
+	routes.HandleFunc("GET /health", healthHandler(service))
+	routes.HandleFunc("GET /changes", changesHandler(db))
+	routes.HandleFunc("GET /suggest", suggestHandler(service))
+	routes.HandleFunc("GET /recent", recentHandler(db))
+	routes.HandleFunc("GET /chunks", chunksHandler(chunks))
+	routes.HandleFunc("GET /chunks/{id}", chunkHandler(chunks))
+	routes.HandleFunc("GET /chunks/{id}/context", chunkContextHandler(chunks))
+	routes.HandleFunc("GET /messages/{id}/seen", receiptsHandler(db))
+	routes.HandleFunc("GET /usage", usageHandler(db))
+	routes.HandleFunc("GET /metrics", metricsHandler(db))
+	routes.HandleFunc("GET /slow-queries", slowQueriesHandler(db))
+	routes.HandleFunc("GET /cold-segments", coldSegmentsHandler(db))
+	routes.HandleFunc("GET /pipeline", pipelineHandler(db))
+	routes.HandleFunc("GET /links", linksHandler(db))
+	routes.HandleFunc("GET /tags", tagsHandler(db))
+	routes.HandleFunc("DELETE /tags/{tag}", deleteTagHandler(store))
+	routes.HandleFunc("GET /threads", threadsHandler(db))
+	routes.HandleFunc("GET /threads/{id}/messages", conversationHandler(db))
+	routes.HandleFunc("POST /threads/tags", threadTagsHandler(store, true))
+	routes.HandleFunc("DELETE /threads/tags", threadTagsHandler(store, false))
 
 	// Also support POST for search (for larger queries)
-	mux.HandleFunc("POST /search", wrap(searchPostHandler(service)))
+	routes.HandleFunc("POST /search", searchPostHandler(service))
+	routes.HandleFunc("POST /ask", askHandler(service, askWriteTimeout(cfg.LLM)))
+
+	// Static files (avatars, attachments) so the web UI only needs this origin
+	routes.HandleFunc("GET /static/avatars/{id}", staticAuthMiddleware(*mediaToken, avatarHandler(cfg.Media.AvatarsDir)))
+	routes.HandleFunc("GET /media/{attachment_id}", staticAuthMiddleware(*mediaToken, mediaHandler(db, cfg.Media.AttachmentsDir)))
+	log.Info().
+		Str("avatars_dir", cfg.Media.AvatarsDir).
+		Str("attachments_dir", cfg.Media.AttachmentsDir).
+		Bool("auth", *mediaToken != "").
+		Msg("Serving static media")
 
 	// Handle OPTIONS for CORS preflight (needed for browser POST requests)
 	if *corsAny {
-		mux.HandleFunc("OPTIONS /search", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {}))
+		preflight := versionedMux{mux: mux, wrap: corsMiddleware}
+		preflight.HandleFunc("OPTIONS /search", func(w http.ResponseWriter, r *http.Request) {})
+		preflight.HandleFunc("OPTIONS /ask", func(w http.ResponseWriter, r *http.Request) {})
+		preflight.HandleFunc("OPTIONS /threads/tags", func(w http.ResponseWriter, r *http.Request) {})
+		preflight.HandleFunc("OPTIONS /tags/{tag}", func(w http.ResponseWriter, r *http.Request) {})
+	}
+
+	var handler http.Handler = mux
+	if *readonlyDemo {
+		pseudonyms, err := loadPseudonyms(db, *demoNames)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load pseudonyms for read-only demo")
+		}
+		handler = readonlyDemoMiddleware(pseudonyms, mux)
+		log.Warn().Int("names", pseudonyms.Len()).Msg("Read-only demo mode: writes and admin endpoints disabled, names pseudonymized")
+	}
+
+	auth, err := httpauth.New(cfg.Auth, "rag-server", unversionedPath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid auth config")
+	}
+	handler = validInputMiddleware(handler)
+	if auth != nil {
+		handler = auth.Middleware(handler)
+		log.Info().
+			Int("keys", auth.Keys()).
+			Int("users", auth.Users()).
+			Strs("public", cfg.Auth.Public).
+			Msg("Authentication enabled")
+	} else if host, _, _ := net.SplitHostPort(*addr); !httpauth.IsLoopback(host) {
+		log.Warn().Str("addr", *addr).Msg("SECURITY WARNING: listening beyond loopback without authentication; add keys or users to the auth section of rag.yaml")
 	}
 
 	server := &http.Server{
 		Addr:         *addr,
-		Handler:      loggingMiddleware(mux),
+		Handler:      requestIDMiddleware(loggingMiddleware(recoverMiddleware(handler))),
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 60 * time.Second,
 		IdleTimeout:  120 * time.Second,
@@ -153,6 +338,14 @@ func main() {
 		log.Fatal().Err(err).Msg("Server error")
 	}
 
+	stopUsage()
+	if usageRecorder != nil {
+		usageRecorder.flush()
+	}
+	if retrievals != nil {
+		retrievals.flush()
+	}
+
 	log.Info().Msg("Server stopped")
 }
 
@@ -162,26 +355,96 @@ func searchHandler(svc *rag.Service) http.HandlerFunc {
 		query := r.URL.Query()
 
 		req := rag.SearchRequest{
-			Query:    query.Get("q"),
-			Mode:     rag.SearchMode(query.Get("mode")),
-			Limit:    parseIntDefault(query.Get("limit"), 20),
-			Context:  parseIntDefault(query.Get("context"), 0),
-			RrfK:     parseIntDefault(query.Get("rrf_k"), 0),
-			CandMult: parseIntDefault(query.Get("candidate_mult"), 0),
+			Query:  query.Get("q"),
+			Mode:   rag.SearchMode(query.Get("mode")),
+			Lang:   query.Get("lang"),
+			Sender: query.Get("sender"),
+			After:  query.Get("after"),
+			Before: query.Get("before"),
+			Source: query.Get("source"),
+
+			ThreadName: query.Get("thread_name"),
+			MatchMode:  rag.MatchMode(query.Get("match_mode")),
+			Sort:       rag.SortOrder(query.Get("sort")),
+		}
+
+		var err error
+		for _, p := range []struct {
+			name string
+			def  int
+			dst  *int
+		}{
+			{"limit", 20, &req.Limit},
+			{"context", 0, &req.Context},
+			{"rrf_k", 0, &req.RrfK},
+			{"candidate_mult", 0, &req.CandMult},
+		} {
+			if *p.dst, err = intParam(query, p.name, p.def); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if req.WeightVec, err = floatParam(query, "w_vector"); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.WeightBM25, err = floatParam(query, "w_bm25"); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if tid := query.Get("thread_id"); tid != "" {
+			id, err := strconv.ParseInt(tid, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid thread_id")
+				return
+			}
+			req.ThreadID = id
+		}
+
+		if s := query.Get("include_low_quality"); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid include_low_quality (use true or false)")
+				return
+			}
+			req.IncludeLowQuality = b
+		}
+
+		if s := query.Get("expand"); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid expand (use true or false)")
+				return
+			}
+			req.Expand = &b
 		}
 
-		// Parse weights
-		if wv := query.Get("w_vector"); wv != "" {
-			if f, err := strconv.ParseFloat(wv, 64); err == nil {
-				req.WeightVec = f
+		if s := query.Get("dedup"); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid dedup (use true or false)")
+				return
 			}
+			req.Dedup = &b
 		}
-		if wb := query.Get("w_bm25"); wb != "" {
-			if f, err := strconv.ParseFloat(wb, 64); err == nil {
-				req.WeightBM25 = f
+
+		if query.Get("recency") != "" {
+			recency, err := floatParam(query, "recency")
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
 			}
+			req.Recency = &recency
 		}
 
+		tags, err := parseTagsParam(query.Get("tags"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.Tags = tags
+
 		// Sanitize and validate
 		req.Query = rag.SanitizeQuery(req.Query)
 		if err := rag.ValidateSearchRequest(&req); err != nil {
@@ -191,8 +454,7 @@ func searchHandler(svc *rag.Service) http.HandlerFunc {
 
 		resp, err := svc.Search(r.Context(), req)
 		if err != nil {
-			log.Error().Err(err).Msg("Search failed")
-			writeError(w, http.StatusInternalServerError, "search failed")
+			writeServiceError(w, r, err, "search failed")
 			return
 		}
 
@@ -204,11 +466,17 @@ func searchHandler(svc *rag.Service) http.HandlerFunc {
 func searchPostHandler(svc *rag.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req rag.SearchRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			writeError(w, http.StatusBadRequest, "invalid JSON body")
+		if !decodeJSONBody(w, r, &req) {
 			return
 		}
 
+		tags, err := storage.NormalizeTags(req.Tags)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.Tags = tags
+
 		// Sanitize and validate
 		req.Query = rag.SanitizeQuery(req.Query)
 		if err := rag.ValidateSearchRequest(&req); err != nil {
@@ -218,8 +486,30 @@ func searchPostHandler(svc *rag.Service) http.HandlerFunc {
 
 		resp, err := svc.Search(r.Context(), req)
 		if err != nil {
-			log.Error().Err(err).Msg("Search failed")
-			writeError(w, http.StatusInternalServerError, "search failed")
+			writeServiceError(w, r, err, "search failed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// suggestHandler handles GET /suggest?q=pre requests
+func suggestHandler(svc *rag.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		q := rag.SanitizeQuery(query.Get("q"))
+		if len(q) > 200 {
+			writeError(w, http.StatusBadRequest, "query too long")
+			return
+		}
+
+		resp, err := svc.Suggest(r.Context(), q,
+			parseIntDefault(query.Get("min_docs"), 2),
+			parseIntDefault(query.Get("limit"), 10))
+		if err != nil {
+			writeServiceError(w, r, err, "suggest failed")
 			return
 		}
 
@@ -232,8 +522,7 @@ func statsHandler(svc *rag.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		stats, err := svc.Stats(r.Context())
 		if err != nil {
-			log.Error().Err(err).Msg("Stats failed")
-			writeError(w, http.StatusInternalServerError, "stats failed")
+			writeServiceError(w, r, err, "stats failed")
 			return
 		}
 
@@ -266,7 +555,7 @@ func loggingMiddleware(next http.Handler) http.Handler {
 		wrapped := &responseWriter{ResponseWriter: w, status: http.StatusOK}
 		next.ServeHTTP(wrapped, r)
 
-		log.Info().
+		zerolog.Ctx(r.Context()).Info().
 			Str("method", r.Method).
 			Str("path", r.URL.Path).
 			Int("status", wrapped.status).
@@ -279,8 +568,9 @@ func loggingMiddleware(next http.Handler) http.Handler {
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, "+requestIDHeader)
+		w.Header().Set("Access-Control-Expose-Headers", requestIDHeader+", "+apiVersionHeader)
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -293,14 +583,26 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 type responseWriter struct {
 	http.ResponseWriter
-	status int
+	status      int
+	wroteHeader bool
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
 	rw.status = code
+	rw.wroteHeader = true
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	return rw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+const (
+	defaultConversationLimit = 50
+	maxConversationLimit     = 500
+)
+
+// Message is a message in /recent and /threads/{id}/messages responses
+type Message struct {
+	ID          string `json:"id"`
+	SenderID    int64  `json:"sender_id,string"`
+	SenderName  string `json:"sender_name"`
+	Text        string `json:"text"`
+	TimestampMs int64  `json:"timestamp_ms"`
+
+	// Added by ?include=attachments,reactions; omitted when there are none
+	Attachments []MessageAttachment       `json:"attachments,omitempty"`
+	Reactions   []storage.MessageReaction `json:"reactions,omitempty"`
+}
+
+// MessageAttachment is an attachment of a Message
+type MessageAttachment struct {
+	storage.MessageAttachment
+	// MediaURL serves the downloaded file (see GET /media/{attachment_id});
+	// empty until media-sync fetched it
+	MediaURL string `json:"media_url,omitempty"`
+}
+
+// messageIncludes are what ?include= adds to each message
+type messageIncludes struct {
+	attachments bool
+	reactions   bool
+}
+
+// parseInclude parses a comma-separated include= query value
+func parseInclude(s string) (messageIncludes, error) {
+	var inc messageIncludes
+	for _, part := range strings.Split(s, ",") {
+		switch strings.ToLower(strings.TrimSpace(part)) {
+		case "":
+		case "attachments":
+			inc.attachments = true
+		case "reactions":
+			inc.reactions = true
+		default:
+			return inc, fmt.Errorf("invalid include %q (use attachments, reactions)", strings.TrimSpace(part))
+		}
+	}
+	return inc, nil
+}
+
+// addIncludes loads the attachments and reactions inc asks for into messages,
+// in one query each for all of them. version is the API version media URLs
+// point at.
+func addIncludes(db *sql.DB, messages []Message, inc messageIncludes, version int) error {
+	if len(messages) == 0 || !inc.attachments && !inc.reactions {
+		return nil
+	}
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+
+	if inc.attachments {
+		byMessage, err := storage.ListMessageAttachments(db, ids)
+		if err != nil {
+			return fmt.Errorf("loading attachments: %w", err)
+		}
+		for i := range messages {
+			for _, a := range byMessage[messages[i].ID] {
+				att := MessageAttachment{MessageAttachment: a}
+				if a.LocalPath != "" {
+					att.MediaURL = fmt.Sprintf("/v%d/media/%s", version, url.PathEscape(a.ID))
+				}
+				messages[i].Attachments = append(messages[i].Attachments, att)
+			}
+		}
+	}
+	if inc.reactions {
+		byMessage, err := storage.ListMessageReactions(db, ids)
+		if err != nil {
+			return fmt.Errorf("loading reactions: %w", err)
+		}
+		for i := range messages {
+			messages[i].Reactions = byMessage[messages[i].ID]
+		}
+	}
+	return nil
+}
+
+// ConversationResponse is the response for GET /threads/{id}/messages
+type ConversationResponse struct {
+	ThreadID   int64     `json:"thread_id,string"`
+	ThreadName string    `json:"thread_name"`
+	Messages   []Message `json:"messages"` // Newest first
+	// HasMore is true when older messages may remain; page with
+	// before=<timestamp_ms of the last message>
+	HasMore bool `json:"has_more"`
+}
+
+// conversationHandler handles GET /threads/{id}/messages?before=&limit=&include=
+// requests: a thread's messages, newest first, optionally sent before a
+// time (unix ms or RFC3339)
+func conversationHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		threadID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid thread id")
+			return
+		}
+		var before int64
+		if s := query.Get("before"); s != "" {
+			if before, err = parseSince(s); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid before (unix ms or RFC3339)")
+				return
+			}
+		}
+		limit := clampInt(parseIntDefault(query.Get("limit"), defaultConversationLimit), 1, maxConversationLimit)
+		inc, err := parseInclude(query.Get("include"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		stats, err := storage.GetThreadStats(db, threadID, 0)
+		if errors.Is(err, storage.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "thread not found")
+			return
+		} else if err != nil {
+			writeServiceError(w, r, err, "loading thread failed")
+			return
+		}
+		msgs, err := storage.GetConversation(db, threadID, limit, before)
+		if err != nil {
+			writeServiceError(w, r, err, "loading messages failed")
+			return
+		}
+
+		resp := ConversationResponse{
+			ThreadID:   threadID,
+			ThreadName: stats.Name,
+			Messages:   make([]Message, 0, len(msgs)),
+			HasMore:    len(msgs) == limit,
+		}
+		for _, m := range msgs {
+			resp.Messages = append(resp.Messages, Message{
+				ID:          m.ID,
+				SenderID:    m.SenderID,
+				SenderName:  m.SenderName,
+				Text:        m.Text,
+				TimestampMs: m.TimestampMs,
+			})
+		}
+		if err := addIncludes(db, resp.Messages, inc, apiVersion(r)); err != nil {
+			writeServiceError(w, r, err, "loading messages failed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
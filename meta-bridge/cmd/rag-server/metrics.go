@@ -0,0 +1,67 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/metrics"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	httpRequests = metrics.Default.NewCounter("rag_http_requests_total",
+		"HTTP requests by route (method and pattern) and status.", "route", "status")
+	httpDuration = metrics.Default.NewHistogram("rag_http_request_duration_seconds",
+		"HTTP request latency by route; /ask streams count until the last token.", metrics.DurationBuckets, "route")
+)
+
+// instrumentHandler counts and times the requests of a mux route. Requests
+// matching no route (or rejected before the mux) are only logged.
+func instrumentHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		next(rw, r)
+		httpRequests.Inc(r.Pattern, strconv.Itoa(rw.status))
+		httpDuration.ObserveSince(start, r.Pattern)
+	}
+}
+
+// metricsHandler handles GET /metrics in the Prometheus text format: the
+// storage upsert path counters, the indexing backlog, and the request,
+// embedding and Milvus timings of this process
+func metricsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// A database created before the counters or chunks existed reports zeros
+		stats, err := storage.GetUpsertStats(db)
+		if err != nil && !strings.Contains(err.Error(), "no such table") {
+			writeServiceError(w, r, err, "metrics failed")
+			return
+		}
+		backlog, err := ragindex.CountBacklog(r.Context(), db)
+		if err != nil && !strings.Contains(err.Error(), "no such table") {
+			writeServiceError(w, r, err, "metrics failed")
+			return
+		}
+
+		w.Header().Set("Content-Type", metrics.ContentType)
+		for _, m := range []struct {
+			name  string
+			help  string
+			value int64
+		}{
+			{"messenger_messages_inserted_total", "New message rows.", stats.Inserted},
+			{"messenger_messages_dedup_skipped_total", "Message inserts whose id already existed.", stats.DedupSkipped},
+			{"messenger_messages_text_changed_total", "Message updates that changed the text.", stats.TextChanged},
+			{"messenger_messages_fts_rewritten_total", "Full-text index rows rewritten by message updates.", stats.FTSRewritten},
+		} {
+			metrics.WriteValue(w, metrics.TypeCounter, m.name, m.help, float64(m.value))
+		}
+		backlog.WriteMetrics(w)
+		metrics.Default.WriteText(w)
+	}
+}
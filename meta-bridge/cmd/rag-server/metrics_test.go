@@ -0,0 +1,49 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /teapot/{id}", instrumentHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	mux.HandleFunc("GET /metrics", instrumentHandler(metricsHandler(db)))
+	for range 2 {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/teapot/1", nil))
+	}
+
+	// A database without messages or chunks tables reports zeros
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"messenger_messages_inserted_total 0\n",
+		"rag_chunks_unsynced 0\n",
+		"rag_messages_unindexed 0\n",
+		`rag_http_requests_total{route="GET /teapot/{id}",status="418"} 2` + "\n",
+		`rag_http_request_duration_seconds_count{route="GET /teapot/{id}"} 2` + "\n",
+		"# TYPE rag_embedding_request_duration_seconds histogram\n",
+		"# TYPE rag_milvus_search_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"runtime"
+
+	"github.com/rs/zerolog"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID requestIDMiddleware assigned, or ""
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDMiddleware assigns every request an ID (reusing a well-formed
+// X-Request-ID from the client), echoes it in the response headers and puts
+// a logger tagged with it into the request context for zerolog.Ctx
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		logger := zerolog.Ctx(ctx).With().Str("request_id", id).Logger()
+		next.ServeHTTP(w, r.WithContext(logger.WithContext(ctx)))
+	})
+}
+
+// recoverMiddleware turns handler panics into a logged 500 response carrying
+// the request ID, instead of letting net/http drop the connection
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// Deliberate abort, let net/http handle it quietly
+				panic(p)
+			}
+			stack := make([]byte, 64<<10)
+			stack = stack[:runtime.Stack(stack, false)]
+			zerolog.Ctx(r.Context()).Error().
+				Interface("panic", p).
+				Bytes("stack", stack).
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Msg("Handler panicked")
+			if rw.wroteHeader {
+				// Too late for an error response; abort so the client sees a broken reply
+				panic(http.ErrAbortHandler)
+			}
+			writeJSON(rw, http.StatusInternalServerError, map[string]string{
+				"error":      "internal server error",
+				"request_id": w.Header().Get(requestIDHeader),
+			})
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// validRequestID accepts short IDs made of URL-safe characters so client
+// values can't inject anything odd into logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/pseudonym"
+)
+
+func TestRecoverMiddleware_ReturnsRequestID(t *testing.T) {
+	var seenID string
+	h := requestIDMiddleware(recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenID = w.Header().Get(requestIDHeader)
+		panic("boom")
+	})))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/search", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", rec.Code)
+	}
+	id := rec.Header().Get(requestIDHeader)
+	if id == "" || id != seenID {
+		t.Fatalf("request ID header %q, handler saw %q", id, seenID)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+	if body["request_id"] != id {
+		t.Fatalf("body request_id = %q, want %q", body["request_id"], id)
+	}
+}
+
+func TestRequestIDMiddleware_ReusesValidClientID(t *testing.T) {
+	h := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set(requestIDHeader, "client-123")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get(requestIDHeader); got != "client-123" {
+		t.Fatalf("expected client ID to be reused, got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set(requestIDHeader, "bad id\nwith newline")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get(requestIDHeader); got == "" || got == "bad id\nwith newline" {
+		t.Fatalf("expected a fresh ID for an invalid client value, got %q", got)
+	}
+}
+
+func TestReadonlyDemoMiddleware_BlocksWritesAndPseudonymizes(t *testing.T) {
+	p := pseudonym.NewReplacer(pseudonym.Names{"anna nowak": "Participant 1", "anna": "Participant 1", "łukasz": "Participant 2"})
+	h := readonlyDemoMiddleware(p, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"text": "Anna Nowak: hi ŁUKASZ, Annabelle says hi to anna"})
+	}))
+
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/search", http.StatusOK},
+		{http.MethodPost, "/search", http.StatusOK},
+		{http.MethodPost, "/threads/tags", http.StatusForbidden},
+		{http.MethodDelete, "/tags/work", http.StatusForbidden},
+		{http.MethodGet, "/usage", http.StatusForbidden},
+		{http.MethodGet, "/media/att.1", http.StatusForbidden},
+		{http.MethodGet, "/recent?include=reactions", http.StatusOK},
+		{http.MethodGet, "/v1/threads/1/messages?include=reactions,attachments", http.StatusForbidden},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.path, rec.Code, tc.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/search", nil))
+	var body map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+	if want := "Participant 1: hi Participant 2, Annabelle says hi to Participant 1"; body["text"] != want {
+		t.Fatalf("text = %q, want %q", body["text"], want)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+const (
+	defaultIncompleteThreads = 20
+	maxIncompleteThreads     = 500
+)
+
+// PipelineResponse is the response for GET /pipeline
+type PipelineResponse struct {
+	Backlog PipelineBacklog `json:"backlog"`
+	Threads PipelineThreads `json:"threads"`
+}
+
+// PipelineBacklog is how far the indexes are behind the messages table
+type PipelineBacklog struct {
+	UnindexedMessages int `json:"unindexed_messages"`
+	UnsyncedChunks    int `json:"unsynced_chunks"`
+	IndexableChunks   int `json:"indexable_chunks"`
+}
+
+// PipelineThreads summarizes how complete the archived threads are
+type PipelineThreads struct {
+	Total       int     `json:"total"`
+	NeedsImport int     `json:"needs_import"`
+	MeanScore   float64 `json:"mean_score"`
+	// Incomplete are the threads needing an import, least complete (then
+	// most messages) first
+	Incomplete []storage.ThreadCompleteness `json:"incomplete"`
+}
+
+// pipelineHandler handles GET /pipeline?limit=N requests: the indexing
+// backlog, and the threads whose archived history looks incomplete, to know
+// which conversations an export import would fill in
+func pipelineHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := clampInt(parseIntDefault(r.URL.Query().Get("limit"), defaultIncompleteThreads), 1, maxIncompleteThreads)
+
+		// A database not chunked yet has no backlog to report
+		backlog, err := ragindex.CountBacklog(r.Context(), db)
+		if err != nil && !strings.Contains(err.Error(), "no such table") {
+			writeServiceError(w, r, err, "counting backlog failed")
+			return
+		}
+		threads, err := storage.ListThreadCompleteness(db, nil)
+		if err != nil {
+			writeServiceError(w, r, err, "thread completeness failed")
+			return
+		}
+
+		resp := PipelineResponse{
+			Backlog: PipelineBacklog{
+				UnindexedMessages: backlog.UnindexedMessages,
+				UnsyncedChunks:    backlog.UnsyncedChunks,
+				IndexableChunks:   backlog.IndexableChunks,
+			},
+			Threads: PipelineThreads{Total: len(threads), Incomplete: []storage.ThreadCompleteness{}},
+		}
+		var scoreSum float64
+		for _, t := range threads {
+			scoreSum += t.Score
+			if t.NeedsImport {
+				resp.Threads.NeedsImport++
+				resp.Threads.Incomplete = append(resp.Threads.Incomplete, t)
+			}
+		}
+		if len(threads) > 0 {
+			resp.Threads.MeanScore = math.Round(100*scoreSum/float64(len(threads))) / 100
+		}
+		slices.SortStableFunc(resp.Threads.Incomplete, func(a, b storage.ThreadCompleteness) int {
+			return cmp.Or(cmp.Compare(a.Score, b.Score), cmp.Compare(b.Messages, a.Messages))
+		})
+		resp.Threads.Incomplete = resp.Threads.Incomplete[:min(len(resp.Threads.Incomplete), limit)]
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
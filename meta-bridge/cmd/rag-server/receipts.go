@@ -0,0 +1,32 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// receiptsHandler handles GET /messages/{id}/seen requests
+func receiptsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		messageID := r.PathValue("id")
+		if messageID == "" {
+			writeError(w, http.StatusBadRequest, "missing message id")
+			return
+		}
+
+		receipts, err := storage.GetMessageReceipts(db, messageID)
+		if errors.Is(err, storage.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "message not found")
+			return
+		}
+		if err != nil {
+			writeServiceError(w, r, err, "receipts lookup failed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, receipts)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRecentThreads   = 20
+	maxRecentThreads       = 100
+	defaultRecentPerThread = 5
+	maxRecentPerThread     = 50
+)
+
+// RecentThread groups messages ingested since the requested time by thread
+type RecentThread struct {
+	ThreadID         int64     `json:"thread_id,string"`
+	ThreadName       string    `json:"thread_name"`
+	NewMessages      int       `json:"new_messages"`
+	FirstTimestampMs int64     `json:"first_timestamp_ms"`
+	LastTimestampMs  int64     `json:"last_timestamp_ms"`
+	LastIngestedMs   int64     `json:"last_ingested_ms"`
+	Messages         []Message `json:"messages"`  // Latest new messages, newest first
+	ChunkIDs         []string  `json:"chunk_ids"` // Chunks covering the new messages
+}
+
+// RecentResponse is the response for GET /recent
+type RecentResponse struct {
+	SinceMs int64          `json:"since_ms"`
+	Threads []RecentThread `json:"threads"`
+}
+
+// recentHandler handles GET /recent?since=<unix ms|RFC3339>&include= requests.
+// "New" means ingested (messages.created_at) after since, not sent after since,
+// so imported history shows up too.
+func recentHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		since, err := parseSince(query.Get("since"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid since (unix ms or RFC3339)")
+			return
+		}
+
+		threadLimit := clampInt(parseIntDefault(query.Get("limit"), defaultRecentThreads), 1, maxRecentThreads)
+		perThread := clampInt(parseIntDefault(query.Get("per_thread"), defaultRecentPerThread), 0, maxRecentPerThread)
+		inc, err := parseInclude(query.Get("include"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		threads, err := fetchRecentThreads(r.Context(), db, since, threadLimit, perThread)
+		if err != nil {
+			writeServiceError(w, r, err, "recent failed")
+			return
+		}
+		// Includes for every thread's messages at once, then split back
+		var messages []Message
+		for _, t := range threads {
+			messages = append(messages, t.Messages...)
+		}
+		if err := addIncludes(db, messages, inc, apiVersion(r)); err != nil {
+			writeServiceError(w, r, err, "recent failed")
+			return
+		}
+		for i := range threads {
+			threads[i].Messages, messages = messages[:len(threads[i].Messages)], messages[len(threads[i].Messages):]
+		}
+
+		writeJSON(w, http.StatusOK, RecentResponse{SinceMs: since, Threads: threads})
+	}
+}
+
+// parseSince accepts unix milliseconds or RFC3339; empty means the last 24 hours
+func parseSince(s string) (int64, error) {
+	if s == "" {
+		return time.Now().Add(-24 * time.Hour).UnixMilli(), nil
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func fetchRecentThreads(ctx context.Context, db *sql.DB, sinceMs int64, threadLimit, perThread int) ([]RecentThread, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT m.thread_id, COALESCE(t.name, ''), COUNT(*),
+			MIN(m.timestamp_ms), MAX(m.timestamp_ms), MAX(m.created_at)
+		FROM messages m
+		LEFT JOIN thread_names t ON t.thread_id = m.thread_id
+		WHERE m.created_at >= ? AND m.text IS NOT NULL AND m.text != ''
+		GROUP BY m.thread_id
+		ORDER BY MAX(m.created_at) DESC
+		LIMIT ?
+	`, sinceMs, threadLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	threads := []RecentThread{}
+	for rows.Next() {
+		var t RecentThread
+		if err := rows.Scan(&t.ThreadID, &t.ThreadName, &t.NewMessages,
+			&t.FirstTimestampMs, &t.LastTimestampMs, &t.LastIngestedMs); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		threads = append(threads, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range threads {
+		t := &threads[i]
+		if t.Messages, err = fetchRecentMessages(ctx, db, t.ThreadID, sinceMs, perThread); err != nil {
+			return nil, err
+		}
+		if t.ChunkIDs, err = fetchCoveringChunks(ctx, db, t.ThreadID, t.FirstTimestampMs, t.LastTimestampMs); err != nil {
+			return nil, err
+		}
+	}
+
+	return threads, nil
+}
+
+func fetchRecentMessages(ctx context.Context, db *sql.DB, threadID, sinceMs int64, limit int) ([]Message, error) {
+	messages := []Message{}
+	if limit == 0 {
+		return messages, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT m.id, m.sender_id, COALESCE(c.name, ''), m.text, m.timestamp_ms
+		FROM messages m
+		LEFT JOIN contacts c ON c.id = m.sender_id
+		WHERE m.thread_id = ? AND m.created_at >= ? AND m.text IS NOT NULL AND m.text != ''
+		ORDER BY m.timestamp_ms DESC
+		LIMIT ?
+	`, threadID, sinceMs, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.SenderID, &m.SenderName, &m.Text, &m.TimestampMs); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// fetchCoveringChunks returns chunks of the thread overlapping the time range.
+// Returns no chunks if the chunks table hasn't been created yet.
+func fetchCoveringChunks(ctx context.Context, db *sql.DB, threadID, fromMs, toMs int64) ([]string, error) {
+	ids := []string{}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT chunk_id FROM chunks
+		WHERE thread_id = ? AND end_timestamp_ms >= ? AND start_timestamp_ms <= ?
+		ORDER BY session_idx, chunk_idx
+	`, threadID, fromMs, toMs)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return ids, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
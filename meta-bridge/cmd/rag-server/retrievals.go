@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+const (
+	retrievalFlushInterval = time.Minute
+	defaultColdSegments    = 50
+	maxColdSegments        = 1000
+)
+
+// retrievalRecorder batches the chunk IDs search hits return and writes them
+// to chunk_retrievals periodically, keeping writes off the request path
+type retrievalRecorder struct {
+	store *storage.Storage
+
+	mu      sync.Mutex
+	pending map[string]int
+}
+
+func newRetrievalRecorder(store *storage.Storage) *retrievalRecorder {
+	return &retrievalRecorder{store: store, pending: make(map[string]int)}
+}
+
+// RecordRetrievals queues chunk IDs for the next flush
+func (r *retrievalRecorder) RecordRetrievals(chunkIDs []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range chunkIDs {
+		r.pending[id]++
+	}
+}
+
+// run flushes periodically until ctx is done
+func (r *retrievalRecorder) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+}
+
+// flush writes the hits queued since the previous flush. They are dropped if
+// the write fails; access times are a hint, not a record worth retrying for.
+func (r *retrievalRecorder) flush() {
+	r.mu.Lock()
+	hits := r.pending
+	r.pending = make(map[string]int)
+	r.mu.Unlock()
+
+	if err := r.store.RecordChunkRetrievals(hits, time.Now().UnixMilli()); err != nil {
+		log.Warn().Err(err).Int("chunks", len(hits)).Msg("Failed to record chunk retrievals")
+	}
+}
+
+// ColdSegmentsResponse is the response for GET /cold-segments
+type ColdSegmentsResponse struct {
+	SinceMs  int64                     `json:"since_ms"` // 0 = segments never retrieved
+	Coverage storage.RetrievalCoverage `json:"coverage"`
+	Segments []storage.ColdSegment     `json:"segments"`
+}
+
+// coldSegmentsHandler handles GET /cold-segments?since=<unix ms|RFC3339>&limit=N
+// requests: sessions none of whose chunks was a search hit since then, largest
+// first. Without since, sessions that were never a hit.
+func coldSegmentsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		var since int64
+		if s := query.Get("since"); s != "" {
+			var err error
+			if since, err = parseSince(s); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid since (unix ms or RFC3339)")
+				return
+			}
+		}
+		limit := clampInt(parseIntDefault(query.Get("limit"), defaultColdSegments), 1, maxColdSegments)
+
+		resp := ColdSegmentsResponse{SinceMs: since, Segments: []storage.ColdSegment{}}
+		coverage, err := storage.GetRetrievalCoverage(db, since)
+		if err != nil {
+			// Database created before retrieval tracking existed
+			if strings.Contains(err.Error(), "no such table") {
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+			writeServiceError(w, r, err, "retrieval coverage failed")
+			return
+		}
+		resp.Coverage = coverage
+
+		segments, err := storage.ListColdSegments(db, since, limit)
+		if err != nil {
+			writeServiceError(w, r, err, "listing cold segments failed")
+			return
+		}
+		if segments != nil {
+			resp.Segments = segments
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/rag"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+const (
+	defaultSlowQueries = 50
+	maxSlowQueries     = 500
+)
+
+// SlowQueriesResponse is the response for GET /slow-queries
+type SlowQueriesResponse struct {
+	SinceMs int64               `json:"since_ms"`
+	Queries []storage.SlowQuery `json:"queries"`
+}
+
+// slowQueryStore persists the rag service's slow queries with the request ID
+type slowQueryStore struct {
+	store *storage.Storage
+}
+
+func (s slowQueryStore) RecordSlowQuery(ctx context.Context, q rag.SlowQuery) error {
+	return s.store.RecordSlowQuery(storage.SlowQuery{
+		RequestID: requestIDFrom(ctx),
+		Query:     q.Query,
+		Mode:      string(q.Mode),
+		Tags:      q.Tags,
+		Results:   q.Results,
+		TookMs:    q.TookMs,
+		Stages:    q.Stages,
+		Plan:      q.Plan,
+	})
+}
+
+// slowQueriesHandler handles GET /slow-queries?since=<unix ms|RFC3339>&limit=N
+// requests. Defaults to the last 7 days.
+func slowQueriesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		since := time.Now().AddDate(0, 0, -7).UnixMilli()
+		if s := query.Get("since"); s != "" {
+			var err error
+			if since, err = parseSince(s); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid since (unix ms or RFC3339)")
+				return
+			}
+		}
+		limit := clampInt(parseIntDefault(query.Get("limit"), defaultSlowQueries), 1, maxSlowQueries)
+
+		resp := SlowQueriesResponse{SinceMs: since, Queries: []storage.SlowQuery{}}
+		queries, err := storage.ListSlowQueries(db, since, limit)
+		if err != nil && !strings.Contains(err.Error(), "no such table") {
+			writeServiceError(w, r, err, "listing slow queries failed")
+			return
+		}
+		if queries != nil {
+			resp.Queries = queries
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
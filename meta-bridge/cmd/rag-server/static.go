@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-meta/pkg/media"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+const (
+	// Avatars are re-downloaded when CDN URLs rotate, so keep the cache short-ish
+	avatarCacheControl = "private, max-age=86400"
+	// Attachment files never change once stored under their ID
+	mediaCacheControl = "private, max-age=31536000, immutable"
+)
+
+// avatarHandler handles GET /static/avatars/{id} requests.
+// {id} is the contact ID, optionally with the .jpg/.png extension the web UI uses.
+func avatarHandler(dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw := r.PathValue("id")
+		raw = strings.TrimSuffix(strings.TrimSuffix(raw, ".jpg"), ".png")
+
+		contactID, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid contact id")
+			return
+		}
+
+		path, ok := media.FindAvatar(dir, contactID)
+		if !ok {
+			writeError(w, http.StatusNotFound, "avatar not found")
+			return
+		}
+
+		serveStaticFile(w, r, path, avatarCacheControl)
+	}
+}
+
+// mediaHandler handles GET /media/{attachment_id} requests. Files downloaded
+// by media-sync are found through attachments.local_path, older ones by ID.
+func mediaHandler(db *sql.DB, dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		attachmentID := r.PathValue("attachment_id")
+		if attachmentID == "" || len(attachmentID) > 256 {
+			writeError(w, http.StatusBadRequest, "invalid attachment id")
+			return
+		}
+
+		path, ok := "", false
+		if localPath, err := storage.GetAttachmentLocalPath(db, attachmentID); err != nil {
+			zerolog.Ctx(r.Context()).Debug().Err(err).Msg("Attachment lookup failed")
+		} else if localPath != "" {
+			path, ok = media.Resolve(dir, localPath)
+		}
+		if !ok {
+			path, ok = media.FindAttachment(dir, attachmentID)
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, "attachment not found")
+			return
+		}
+
+		serveStaticFile(w, r, path, mediaCacheControl)
+	}
+}
+
+// serveStaticFile serves a file with caching headers.
+// http.ServeContent handles Range/If-Modified-Since and uses sendfile for *os.File.
+func serveStaticFile(w http.ResponseWriter, r *http.Request, path, cacheControl string) {
+	f, err := os.Open(path)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "file not found")
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		writeError(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// staticAuthMiddleware requires a bearer token (or ?token=) when token is non-empty
+func staticAuthMiddleware(token string, next http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			got = strings.TrimPrefix(auth, "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			zerolog.Ctx(r.Context()).Debug().Str("path", r.URL.Path).Msg("Rejected unauthenticated media request")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
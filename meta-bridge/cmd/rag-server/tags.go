@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"go.mau.fi/mautrix-meta/pkg/rag"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+const (
+	defaultThreadsLimit = 50
+	maxThreadsLimit     = 500
+	maxTagsPerRequest   = 20
+	maxTagThreadIDs     = 1000
+)
+
+// ThreadInfo is a thread in the /threads listing
+type ThreadInfo struct {
+	ThreadID       int64    `json:"thread_id,string"`
+	Name           string   `json:"name"`
+	LastActivityMs int64    `json:"last_activity_ms"`
+	MessageCount   int64    `json:"message_count"`
+	Tags           []string `json:"tags"`
+	// Completeness estimates how much of the thread's history is archived
+	Completeness *storage.ThreadCompleteness `json:"completeness,omitempty"`
+}
+
+// ThreadsResponse is the response for GET /threads
+type ThreadsResponse struct {
+	Tags    []string     `json:"tags,omitempty"`
+	Threads []ThreadInfo `json:"threads"`
+	Limit   int          `json:"limit"`
+	Offset  int          `json:"offset"`
+}
+
+// TagsResponse is the response for GET /tags
+type TagsResponse struct {
+	Tags []storage.TagCount `json:"tags"`
+}
+
+// TagThreadsRequest is the body of POST/DELETE /threads/tags
+type TagThreadsRequest struct {
+	ThreadIDs rag.Int64Strings `json:"thread_ids"`
+	Tags      []string         `json:"tags"`
+}
+
+// parseTagsParam parses a comma-separated tags= query value
+func parseTagsParam(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	return storage.NormalizeTags(strings.Split(s, ","))
+}
+
+// tagsHandler handles GET /tags requests
+func tagsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tags, err := storage.ListTags(db)
+		if err != nil && !strings.Contains(err.Error(), "no such table") {
+			writeServiceError(w, r, err, "listing tags failed")
+			return
+		}
+		if tags == nil {
+			tags = []storage.TagCount{}
+		}
+		writeJSON(w, http.StatusOK, TagsResponse{Tags: tags})
+	}
+}
+
+// threadsHandler handles GET /threads?tags=a,b requests.
+// Threads carrying any of the tags are returned, most recently active first.
+func threadsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		tags, err := parseTagsParam(query.Get("tags"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(tags) > maxTagsPerRequest {
+			writeError(w, http.StatusBadRequest, "too many tags")
+			return
+		}
+
+		limit := clampInt(parseIntDefault(query.Get("limit"), defaultThreadsLimit), 1, maxThreadsLimit)
+		offset := max(parseIntDefault(query.Get("offset"), 0), 0)
+
+		threads, err := fetchThreads(r.Context(), db, tags, limit, offset)
+		if err != nil {
+			writeServiceError(w, r, err, "listing threads failed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, ThreadsResponse{Tags: tags, Threads: threads, Limit: limit, Offset: offset})
+	}
+}
+
+func fetchThreads(ctx context.Context, db *sql.DB, tags []string, limit, offset int) ([]ThreadInfo, error) {
+	var args []any
+	where := ""
+	if len(tags) > 0 {
+		where = "WHERE t.id IN (SELECT thread_id FROM thread_tags WHERE tag IN (?" + strings.Repeat(", ?", len(tags)-1) + "))"
+		for _, tag := range tags {
+			args = append(args, tag)
+		}
+	}
+	args = append(args, limit, offset)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.id, COALESCE(n.name, ''), COALESCE(t.last_activity_ms, 0),
+			(SELECT COUNT(*) FROM messages m WHERE m.thread_id = t.id)
+		FROM threads t
+		LEFT JOIN thread_names n ON n.thread_id = t.id
+		`+where+`
+		ORDER BY t.last_activity_ms DESC
+		LIMIT ? OFFSET ?
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	threads := []ThreadInfo{}
+	ids := []int64{}
+	for rows.Next() {
+		var t ThreadInfo
+		if err := rows.Scan(&t.ThreadID, &t.Name, &t.LastActivityMs, &t.MessageCount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		threads = append(threads, t)
+		ids = append(ids, t.ThreadID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tagsByThread, err := storage.TagsForThreads(db, ids)
+	if err != nil {
+		return nil, err
+	}
+	completeness, err := storage.ListThreadCompleteness(db, ids)
+	if err != nil {
+		return nil, err
+	}
+	byThread := make(map[int64]*storage.ThreadCompleteness, len(completeness))
+	for i := range completeness {
+		byThread[completeness[i].ThreadID] = &completeness[i]
+	}
+	for i := range threads {
+		threads[i].Tags = tagsByThread[threads[i].ThreadID]
+		if threads[i].Tags == nil {
+			threads[i].Tags = []string{}
+		}
+		threads[i].Completeness = byThread[threads[i].ThreadID]
+	}
+
+	return threads, nil
+}
+
+// threadTagsHandler handles POST (add) and DELETE (remove) /threads/tags requests
+func threadTagsHandler(store *storage.Storage, add bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store == nil {
+			writeError(w, http.StatusServiceUnavailable, "tag editing unavailable (database is read-only)")
+			return
+		}
+
+		var req TagThreadsRequest
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		if len(req.ThreadIDs) == 0 || len(req.Tags) == 0 {
+			writeError(w, http.StatusBadRequest, "thread_ids and tags are required")
+			return
+		}
+		if len(req.ThreadIDs) > maxTagThreadIDs || len(req.Tags) > maxTagsPerRequest {
+			writeError(w, http.StatusBadRequest, "too many thread_ids or tags")
+			return
+		}
+
+		tags, err := storage.NormalizeTags(req.Tags)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if add {
+			err = store.TagThreads(req.ThreadIDs, tags)
+		} else {
+			err = store.UntagThreads(req.ThreadIDs, tags)
+		}
+		if errors.Is(err, storage.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "unknown thread")
+			return
+		}
+		if err != nil {
+			writeServiceError(w, r, err, "updating thread tags failed")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deleteTagHandler handles DELETE /tags/{tag} requests
+func deleteTagHandler(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store == nil {
+			writeError(w, http.StatusServiceUnavailable, "tag editing unavailable (database is read-only)")
+			return
+		}
+
+		tag, err := storage.NormalizeTag(r.PathValue("tag"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		removed, err := store.DeleteTag(tag)
+		if err != nil {
+			writeServiceError(w, r, err, "deleting tag failed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{"tag": tag, "removed": removed})
+	}
+}
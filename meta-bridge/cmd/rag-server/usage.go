@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/llm"
+	"go.mau.fi/mautrix-meta/pkg/rag"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+const (
+	usageFlushInterval = 5 * time.Minute
+	defaultUsageRuns   = 20
+	maxUsageRuns       = 500
+)
+
+// UsageTotals sums all summaries of a /usage response
+type UsageTotals struct {
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// UsageResponse is the response for GET /usage
+type UsageResponse struct {
+	SinceMs   int64                  `json:"since_ms"`
+	Totals    UsageTotals            `json:"totals"`
+	Summaries []storage.UsageSummary `json:"summaries"`
+	Runs      []storage.UsageRun     `json:"runs"`
+}
+
+// searchUsageRecorder records query embedding usage as one "search" run per
+// flush window, instead of a row per request, and /ask completions as one
+// "ask" run
+type searchUsageRecorder struct {
+	store    *storage.Storage
+	cfg      *ragconfig.Config
+	embedder *rag.EmbeddingClientAdapter
+	llm      *llm.Client // nil while /ask is off
+
+	mu          sync.Mutex
+	flushed     vectordb.EmbeddingUsage
+	flushedLLM  llm.Usage
+	windowStart time.Time
+}
+
+func newSearchUsageRecorder(store *storage.Storage, cfg *ragconfig.Config, embedder *rag.EmbeddingClientAdapter, llmClient *llm.Client) *searchUsageRecorder {
+	return &searchUsageRecorder{
+		store:       store,
+		cfg:         cfg,
+		embedder:    embedder,
+		llm:         llmClient,
+		windowStart: time.Now(),
+	}
+}
+
+// run flushes periodically until ctx is done
+func (u *searchUsageRecorder) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.flush()
+		}
+	}
+}
+
+// flush records usage accumulated since the previous flush
+func (u *searchUsageRecorder) flush() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	recorded := false
+	total := u.embedder.Usage()
+	delta := vectordb.EmbeddingUsage{
+		Requests:     total.Requests - u.flushed.Requests,
+		PromptTokens: total.PromptTokens - u.flushed.PromptTokens,
+		TotalTokens:  total.TotalTokens - u.flushed.TotalTokens,
+	}
+	if delta.Requests > 0 {
+		model := u.embedder.Model()
+		if err := u.store.RecordUsage(storage.UsageRun{
+			Kind:         "search",
+			Component:    "embedding",
+			Model:        model,
+			Requests:     delta.Requests,
+			PromptTokens: delta.PromptTokens,
+			TotalTokens:  delta.TotalTokens,
+			CostUSD:      u.cfg.EstimateCost(model, delta.PromptTokens, 0),
+			StartedAt:    u.windowStart.UnixMilli(),
+			FinishedAt:   now.UnixMilli(),
+		}); err != nil {
+			log.Warn().Err(err).Msg("Failed to record search usage")
+			return
+		}
+		u.flushed = total
+		recorded = true
+	}
+
+	if u.llm != nil {
+		totalLLM := u.llm.Usage()
+		deltaLLM := llm.Usage{
+			Requests:         totalLLM.Requests - u.flushedLLM.Requests,
+			PromptTokens:     totalLLM.PromptTokens - u.flushedLLM.PromptTokens,
+			CompletionTokens: totalLLM.CompletionTokens - u.flushedLLM.CompletionTokens,
+			TotalTokens:      totalLLM.TotalTokens - u.flushedLLM.TotalTokens,
+		}
+		if deltaLLM.Requests > 0 {
+			model := u.cfg.Ask.Model
+			if model == "" {
+				model = u.cfg.LLM.Model
+			}
+			if err := u.store.RecordUsage(storage.UsageRun{
+				Kind:             "ask",
+				Component:        "llm",
+				Model:            model,
+				Requests:         deltaLLM.Requests,
+				PromptTokens:     deltaLLM.PromptTokens,
+				CompletionTokens: deltaLLM.CompletionTokens,
+				TotalTokens:      deltaLLM.TotalTokens,
+				CostUSD:          u.cfg.EstimateCost(model, deltaLLM.PromptTokens, deltaLLM.CompletionTokens),
+				StartedAt:        u.windowStart.UnixMilli(),
+				FinishedAt:       now.UnixMilli(),
+			}); err != nil {
+				log.Warn().Err(err).Msg("Failed to record ask usage")
+				return
+			}
+			u.flushedLLM = totalLLM
+			recorded = true
+		}
+	}
+
+	if recorded {
+		u.windowStart = now
+	}
+}
+
+// usageHandler handles GET /usage?since=<unix ms|RFC3339>&runs=N requests.
+// Defaults to the last 30 days.
+func usageHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		since := time.Now().AddDate(0, 0, -30).UnixMilli()
+		if s := query.Get("since"); s != "" {
+			var err error
+			if since, err = parseSince(s); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid since (unix ms or RFC3339)")
+				return
+			}
+		}
+		runLimit := clampInt(parseIntDefault(query.Get("runs"), defaultUsageRuns), 0, maxUsageRuns)
+
+		resp := UsageResponse{
+			SinceMs:   since,
+			Summaries: []storage.UsageSummary{},
+			Runs:      []storage.UsageRun{},
+		}
+
+		summaries, err := storage.SummarizeUsage(db, since)
+		if err != nil {
+			// Database created before usage accounting existed
+			if strings.Contains(err.Error(), "no such table") {
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+			writeServiceError(w, r, err, "usage summary failed")
+			return
+		}
+		if summaries != nil {
+			resp.Summaries = summaries
+		}
+		for _, s := range resp.Summaries {
+			resp.Totals.Requests += s.Requests
+			resp.Totals.PromptTokens += s.PromptTokens
+			resp.Totals.CompletionTokens += s.CompletionTokens
+			resp.Totals.TotalTokens += s.TotalTokens
+			resp.Totals.CostUSD += s.CostUSD
+		}
+
+		if runLimit > 0 {
+			runs, err := storage.ListUsageRuns(db, since, runLimit)
+			if err != nil {
+				writeServiceError(w, r, err, "usage summary failed")
+				return
+			}
+			if runs != nil {
+				resp.Runs = runs
+			}
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// API versions. Within a version, responses only gain fields and parameters:
+// renaming, removing or retyping a field, or changing what a parameter
+// means, takes a new version. Every route is served under every version's
+// prefix (/v1/search, /v2/search), and a handler whose contract changed
+// checks apiVersion to answer older versions as before. Unversioned paths
+// are the routes from before versioning and stay on v1, so the web UI and
+// existing scripts keep working as the API moves on.
+const (
+	apiV1 = 1
+
+	// latestAPIVersion is the newest version; only its prefix reaches it
+	latestAPIVersion = apiV1
+)
+
+// apiVersionHeader tells clients which contract a response follows
+const apiVersionHeader = "API-Version"
+
+type apiVersionKey struct{}
+
+// apiVersion returns the API version a request was routed under
+func apiVersion(r *http.Request) int {
+	if v, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return v
+	}
+	return apiV1
+}
+
+// withAPIVersion records the version a route was registered under for
+// apiVersion, and reports it in the response headers
+func withAPIVersion(version int, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(apiVersionHeader, strconv.Itoa(version))
+		next(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)))
+	}
+}
+
+// versionedMux registers routes under every API version's prefix, and
+// unversioned for v1
+type versionedMux struct {
+	mux  *http.ServeMux
+	wrap func(http.HandlerFunc) http.HandlerFunc
+}
+
+// HandleFunc registers h for a "METHOD /path" pattern
+func (m versionedMux) HandleFunc(pattern string, h http.HandlerFunc) {
+	method, path, _ := strings.Cut(pattern, " ")
+	for v := apiV1; v <= latestAPIVersion; v++ {
+		m.mux.HandleFunc(fmt.Sprintf("%s /v%d%s", method, v, path), m.wrap(withAPIVersion(v, h)))
+	}
+	m.mux.HandleFunc(pattern, m.wrap(withAPIVersion(apiV1, h)))
+}
+
+var versionPrefixRe = regexp.MustCompile(`^/v[0-9]+(?:/|$)`)
+
+// unversionedPath strips the API version prefix from a path, so checks by
+// path (read-only demo, auth.public) cover a route under every version
+func unversionedPath(path string) string {
+	if loc := versionPrefixRe.FindStringIndex(path); loc != nil {
+		return "/" + path[loc[1]:]
+	}
+	return path
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestVersionedMux(t *testing.T) {
+	mux := http.NewServeMux()
+	routes := versionedMux{mux: mux, wrap: func(h http.HandlerFunc) http.HandlerFunc { return h }}
+	routes.HandleFunc("GET /chunks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.PathValue("id") + " v" + strconv.Itoa(apiVersion(r))))
+	})
+
+	for path, want := range map[string]string{
+		"/chunks/c1":    "c1 v1",
+		"/v1/chunks/c1": "c1 v1",
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != want || rec.Header().Get(apiVersionHeader) != "1" {
+			t.Errorf("%s: %d %q, %s %q", path, rec.Code, rec.Body.String(), apiVersionHeader, rec.Header().Get(apiVersionHeader))
+		}
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v9/chunks/c1", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown version: status %d, want 404", rec.Code)
+	}
+}
+
+func TestUnversionedPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"/v1/search":        "/search",
+		"/v1":               "/",
+		"/v12/media/a1":     "/media/a1",
+		"/search":           "/search",
+		"/videos/v1":        "/videos/v1",
+		"/v1beta/search":    "/v1beta/search",
+		"/static/avatars/1": "/static/avatars/1",
+	} {
+		if got := unversionedPath(path); got != want {
+			t.Errorf("unversionedPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+
+	// The read-only demo blocks a route under every version
+	for _, path := range []string{"/usage", "/v1/usage", "/v1/media/a1"} {
+		if demoAllowed(httptest.NewRequest(http.MethodGet, path, nil)) {
+			t.Errorf("demo allows GET %s", path)
+		}
+	}
+	if !demoAllowed(httptest.NewRequest(http.MethodPost, "/v1/search", nil)) {
+		t.Error("demo refuses POST /v1/search")
+	}
+}
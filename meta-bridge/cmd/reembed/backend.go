@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/milvus-io/milvus-sdk-go/v2/client"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+// backend switches which collection (or vector table) searches use. Searches
+// go through a fixed name, the store: milvus.chunk_collection, which becomes
+// an alias on the first flip, or the chunk_vectors table, which is renamed.
+type backend interface {
+	// flip makes target the one searches use and returns the name the one
+	// it replaces goes by afterwards. If that one has to be renamed out of
+	// the way, it's renamed to aside.
+	flip(ctx context.Context, target, aside string) (previous string, err error)
+	// exists reports whether a collection (or table) named name exists
+	exists(ctx context.Context, name string) (bool, error)
+	drop(ctx context.Context, name string) error
+	close() error
+}
+
+func newBackend(ctx context.Context, cfg *ragconfig.Config, db *sql.DB) (backend, error) {
+	store := ragindex.DefaultVectorStore(cfg)
+	switch cfg.Vector.Backend {
+	case ragconfig.VectorBackendMilvus, "":
+		c, err := vectordb.NewMilvusClient(ctx, cfg.Milvus)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to Milvus: %w", err)
+		}
+		return &milvusBackend{client: c, alias: store}, nil
+	case ragconfig.VectorBackendSQLite:
+		return &sqliteBackend{db: db, table: store}, nil
+	default:
+		return nil, fmt.Errorf("unknown vector backend %q (want %q or %q)", cfg.Vector.Backend, ragconfig.VectorBackendMilvus, ragconfig.VectorBackendSQLite)
+	}
+}
+
+// storeName makes the collection (or table) name for vectors of model
+func storeName(store, model string) string {
+	slug := strings.Trim(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(model)), "_")
+	return store + "_" + slug
+}
+
+// milvusBackend points the alias at the new collection. Searches through the
+// alias switch over at once, and the old collection stays as it was.
+type milvusBackend struct {
+	client client.Client
+	alias  string
+}
+
+func (m *milvusBackend) flip(ctx context.Context, target, aside string) (string, error) {
+	// Describing an alias returns the collection behind it
+	current, err := m.client.DescribeCollection(ctx, m.alias)
+	if err != nil {
+		return "", fmt.Errorf("describing %s: %w", m.alias, err)
+	}
+	if current.Name == target {
+		return "", fmt.Errorf("%s already points at %s", m.alias, target)
+	}
+	if current.Name != m.alias {
+		if err := m.client.AlterAlias(ctx, target, m.alias); err != nil {
+			return "", fmt.Errorf("pointing %s at %s: %w", m.alias, target, err)
+		}
+		return current.Name, nil
+	}
+
+	// Still a plain collection: it moves aside so its name can become the
+	// alias. Searches fail between the two calls.
+	if err := m.client.RenameCollection(ctx, m.alias, aside); err != nil {
+		return "", fmt.Errorf("renaming %s to %s: %w", m.alias, aside, err)
+	}
+	if err := m.client.CreateAlias(ctx, target, m.alias); err != nil {
+		return aside, fmt.Errorf("creating alias %s for %s (the old collection is now %s): %w", m.alias, target, aside, err)
+	}
+	return aside, nil
+}
+
+func (m *milvusBackend) exists(ctx context.Context, name string) (bool, error) {
+	return m.client.HasCollection(ctx, name)
+}
+
+func (m *milvusBackend) drop(ctx context.Context, name string) error {
+	return m.client.DropCollection(ctx, name)
+}
+
+func (m *milvusBackend) close() error {
+	return m.client.Close()
+}
+
+// sqliteBackend swaps the tables in one transaction: the live table is
+// renamed to aside and target takes its name
+type sqliteBackend struct {
+	db    *sql.DB
+	table string
+}
+
+func (s *sqliteBackend) flip(ctx context.Context, target, aside string) (string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `ALTER TABLE `+s.table+` RENAME TO `+aside); err != nil {
+		return "", fmt.Errorf("renaming %s to %s: %w", s.table, aside, err)
+	}
+	if _, err := tx.ExecContext(ctx, `ALTER TABLE `+target+` RENAME TO `+s.table); err != nil {
+		return "", fmt.Errorf("renaming %s to %s: %w", target, s.table, err)
+	}
+	return aside, tx.Commit()
+}
+
+func (s *sqliteBackend) exists(ctx context.Context, name string) (bool, error) {
+	return vectordb.SQLiteVectorTableExists(ctx, s.db, name)
+}
+
+func (s *sqliteBackend) drop(ctx context.Context, name string) error {
+	return vectordb.DropSQLiteVectorTable(ctx, s.db, name)
+}
+
+// close is a no-op: the database handle belongs to the caller
+func (s *sqliteBackend) close() error {
+	return nil
+}
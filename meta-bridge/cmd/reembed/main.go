@@ -0,0 +1,260 @@
+// reembed moves the vector index to another embedding model without taking
+// search down.
+//
+// It embeds every indexable chunk with the new model into a new collection
+// (or, with vector.backend: sqlite, a new table) next to the one in use,
+// compares searches over both, and only if the new vectors hold up makes
+// searches use them. The old vectors are kept until -drop-previous, so
+// -rollback can switch back.
+//
+// Usage:
+//
+//	reembed --db messenger.db --model bge-m3 --dimension 1024
+//	reembed --db messenger.db --model bge-m3 --dimension 1024 --no-flip  # build and validate only
+//	reembed --db messenger.db --model bge-m3 --dimension 1024 --queries queries.txt
+//	reembed --db messenger.db --rollback        # back to the previous vectors
+//	reembed --db messenger.db --drop-previous   # delete them once happy
+//
+// The current model is the one in rag.yaml. An interrupted build resumes
+// where it stopped when rerun with the same flags. Validation searches with
+// both models: queries taken from random chunks (or from --queries, one per
+// line) should mostly find the same chunks, and the chunks sampled queries
+// come from as often.
+//
+// With Milvus, milvus.chunk_collection becomes an alias on the first flip
+// and the old collection is renamed to <collection>_<old model>. With
+// SQLite the tables are renamed. Either way, set embedding.model and
+// embedding.dimension in rag.yaml to the new model and restart rag-server
+// (and rag-indexerd) afterwards, so queries and new chunks are embedded with
+// it. The model recorded in the database follows the flip, so rag-pipeline
+// doesn't rebuild the index.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/progress"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	dbPath        = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile     = storage.KeyFileFlag()
+	cfgPath       = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	model         = flag.String("model", "", "Embedding model to move to (required unless -rollback or -drop-previous)")
+	dimension     = flag.Int("dimension", 0, "Vector dimension of the new model (defaults to embedding.dimension)")
+	provider      = flag.String("provider", "", "Embedding provider of the new model (defaults to embedding.provider)")
+	baseURL       = flag.String("base-url", "", "Embedding service of the new model (defaults to embedding.base_url)")
+	collection    = flag.String("collection", "", "Collection (or table) for the new vectors (defaults to <collection>_<model>)")
+	workers       = flag.Int("workers", 4, "Embedding requests in flight at once")
+	batchSize     = flag.Int("batch-size", 50, "Number of chunks to embed and insert per batch")
+	sample        = flag.Int("sample", 50, "Number of chunks to take validation queries from")
+	queriesPath   = flag.String("queries", "", "File of validation queries, one per line, instead of sampled ones")
+	topK          = flag.Int("top-k", 10, "Results compared per validation query")
+	minOverlap    = flag.Float64("min-overlap", 0.1, "Least mean share of the old top k the new one must contain")
+	maxRecallDrop = flag.Float64("max-recall-drop", 0.1, "Most the share of sampled chunks found may drop by")
+	force         = flag.Bool("force", false, "Flip even if validation fails")
+	noFlip        = flag.Bool("no-flip", false, "Build and validate, but keep searching the old vectors")
+	doRollback    = flag.Bool("rollback", false, "Switch searches back to the vectors the last flip replaced")
+	dropPrev      = flag.Bool("drop-previous", false, "Delete the vectors the last flip replaced")
+	debug         = flag.Bool("debug", false, "Enable debug logging")
+
+	progressFormat = progress.Flag()
+)
+
+func main() {
+	flag.Parse()
+
+	// Setup logging
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	if *doRollback && *dropPrev {
+		log.Fatal().Msg("-rollback and -drop-previous can't be combined")
+	}
+	progressFmt, err := progress.ParseFormat(*progressFormat)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid -progress")
+	}
+
+	// Load configuration
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	db, err := sql.Open(storage.Driver("sqlite3"), sqlitePath+"?_busy_timeout=30000&_journal_mode=WAL")
+	if err != nil {
+		log.Fatal().Err(err).Str("path", sqlitePath).Msg("Failed to open database")
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		log.Fatal().Err(err).Msg("Database not accessible")
+	}
+
+	meta, err := ragindex.OpenMetadata(ctx, db, cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open index metadata")
+	}
+	b, err := newBackend(ctx, cfg, db)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open vector store")
+	}
+	defer b.close()
+
+	switch {
+	case *doRollback:
+		state, err := rollback(ctx, cfg, meta, b)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Rollback failed")
+		}
+		fmt.Printf("Searches use %s again (%s, %d dim); %s is kept as the previous vectors.\n", state.Active, state.Model, state.Dimension, state.Previous)
+		printNextSteps(state)
+		return
+	case *dropPrev:
+		dropped, err := dropPrevious(ctx, cfg, meta, b)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to drop the previous vectors")
+		}
+		fmt.Printf("Dropped %s\n", dropped)
+		return
+	case *model == "":
+		log.Fatal().Msg("-model is required")
+	}
+
+	newCfg := *cfg
+	newCfg.Embedding.Model = *model
+	if *dimension > 0 {
+		newCfg.Embedding.Dimension = *dimension
+	}
+	if *provider != "" {
+		newCfg.Embedding.Provider = *provider
+	}
+	if *baseURL != "" {
+		newCfg.Embedding.BaseURL = *baseURL
+	}
+	if newCfg.Embedding.Model == cfg.Embedding.Model && newCfg.Embedding.Dimension == cfg.Embedding.Dimension {
+		log.Fatal().Str("model", *model).Msg("Searches already use this model")
+	}
+	target := *collection
+	if target == "" {
+		target = storeName(ragindex.DefaultVectorStore(cfg), newCfg.Embedding.Model)
+	}
+
+	fmt.Printf("Configuration:\n")
+	fmt.Printf("  SQLite: %s\n", sqlitePath)
+	fmt.Printf("  Vectors: %s (%s)\n", cfg.Vector.Backend, ragindex.DefaultVectorStore(cfg))
+	fmt.Printf("  From: %s (%d dim)\n", cfg.Embedding.Model, cfg.Embedding.Dimension)
+	fmt.Printf("  To: %s (%d dim) in %s\n", newCfg.Embedding.Model, newCfg.Embedding.Dimension, target)
+	fmt.Printf("  Workers: %d, batch size: %d\n", *workers, *batchSize)
+	fmt.Println()
+
+	m := &migration{db: db, cfg: cfg, newCfg: &newCfg, meta: meta, backend: b, target: target, out: os.Stdout}
+
+	fmt.Println("=== [1/3] Re-embed ===")
+	start := time.Now()
+	embedded, deleted, err := m.build(ctx, *batchSize, *workers, progressFmt)
+	recordUsage(db, &newCfg, m, start)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Re-embedding failed; rerun to resume")
+	}
+	fmt.Printf("Embedded %d chunks, deleted %d stale ones in %s\n\n", embedded, deleted, time.Since(start).Round(time.Second))
+
+	fmt.Println("=== [2/3] Validate ===")
+	var queries []sampleQuery
+	if *queriesPath != "" {
+		queries, err = readQueries(*queriesPath)
+	} else {
+		queries, err = sampleQueries(ctx, db, *sample)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to get validation queries")
+	}
+	p, err := m.validate(ctx, queries, *topK)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Validation failed")
+	}
+	fmt.Printf("Queries: %d\n", p.Queries)
+	fmt.Printf("Overlap@%d: %.2f (min %.2f)\n", *topK, p.Overlap, *minOverlap)
+	if p.Sampled > 0 {
+		fmt.Printf("Sampled chunks found: %.2f before, %.2f after (max drop %.2f)\n", p.OldRecall, p.NewRecall, *maxRecallDrop)
+	}
+	if !p.ok(*minOverlap, *maxRecallDrop) {
+		if !*force {
+			log.Fatal().Msgf("The new vectors failed validation; searches still use %s. Rerun with -force to flip anyway.", cfg.Embedding.Model)
+		}
+		fmt.Println("Failed validation, flipping anyway (-force)")
+	}
+	fmt.Println()
+
+	fmt.Println("=== [3/3] Flip ===")
+	if *noFlip {
+		fmt.Printf("Skipped (-no-flip); the new vectors stay in %s\n", target)
+		return
+	}
+	state, err := m.flip(ctx)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Flip failed")
+	}
+	fmt.Printf("Searches now use %s; the old vectors are kept as %s.\n", state.Active, state.Previous)
+	printNextSteps(state)
+}
+
+func printNextSteps(state flipState) {
+	fmt.Println()
+	fmt.Println("Next, in rag.yaml:")
+	fmt.Printf("  embedding.model: %s\n", state.Model)
+	fmt.Printf("  embedding.dimension: %d\n", state.Dimension)
+	fmt.Println("then restart rag-server and rag-indexerd. reembed -rollback switches back.")
+}
+
+func recordUsage(db *sql.DB, cfg *ragconfig.Config, m *migration, start time.Time) {
+	if m.usage.Requests == 0 {
+		return
+	}
+	fmt.Printf("Embedding tokens: %d (%d requests)\n", m.usage.TotalTokens, m.usage.Requests)
+	if err := storage.RecordUsage(db, storage.UsageRun{
+		Kind:         "reembed",
+		Component:    "embedding",
+		Model:        cfg.Embedding.Model,
+		Requests:     m.usage.Requests,
+		PromptTokens: m.usage.PromptTokens,
+		TotalTokens:  m.usage.TotalTokens,
+		CostUSD:      cfg.EstimateCost(cfg.Embedding.Model, m.usage.PromptTokens, 0),
+		StartedAt:    start.UnixMilli(),
+		FinishedAt:   time.Now().UnixMilli(),
+	}); err != nil {
+		log.Warn().Err(err).Msg("Failed to record embedding usage")
+	}
+}
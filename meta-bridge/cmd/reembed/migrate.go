@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"go.mau.fi/mautrix-meta/pkg/progress"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+// stateKey is the metadata key the last flip is recorded under
+const stateKey = "reembed_state"
+
+// flipState is the last flip, recorded so it can be rolled back
+type flipState struct {
+	Active            string `json:"active"`   // Collection (or set-aside table name) of the vectors in use
+	Previous          string `json:"previous"` // The one they replaced; empty once dropped
+	Model             string `json:"model"`
+	Dimension         int    `json:"dimension"`
+	PreviousModel     string `json:"previous_model"`
+	PreviousDimension int    `json:"previous_dimension"`
+}
+
+// migration moves the vector store from cfg's embedding model to newCfg's
+type migration struct {
+	db      *sql.DB
+	cfg     *ragconfig.Config // The model searches use now
+	newCfg  *ragconfig.Config // cfg with the new embedding section
+	meta    *ragindex.Metadata
+	backend backend
+	target  string // Collection (or table) the new vectors go in
+	out     io.Writer
+	usage   vectordb.EmbeddingUsage // Of the new model, once build has run
+}
+
+// build embeds the indexable chunks the target lacks and deletes those
+// that are no longer indexable, so rerunning it resumes an interrupted
+// build or catches up with chunks added since. It returns how many chunks
+// were embedded and deleted.
+func (m *migration) build(ctx context.Context, batchSize, workers int, progressFmt progress.Format) (embedded, deleted int, err error) {
+	sink, err := ragindex.NewSinkAt(ctx, m.newCfg, m.db, m.target, m.out)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer sink.Close()
+	if _, err := sink.Prepare(ctx, false); err != nil {
+		return 0, 0, err
+	}
+
+	stored, err := sink.IDs(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("listing stored chunks: %w", err)
+	}
+	indexable, err := indexableIDs(ctx, m.db)
+	if err != nil {
+		return 0, 0, err
+	}
+	done := make(map[string]bool, len(stored))
+	var stale []string
+	for _, id := range stored {
+		if indexable[id] {
+			done[id] = true
+		} else {
+			stale = append(stale, id)
+		}
+	}
+	if len(stale) > 0 {
+		if deleted, err = sink.Delete(ctx, stale); err != nil {
+			return 0, 0, fmt.Errorf("deleting stale chunks: %w", err)
+		}
+	}
+
+	pending := len(indexable) - len(done)
+	fmt.Fprintf(m.out, "Chunks to embed: %d (of %d indexable, %d already in %s)\n", pending, len(indexable), len(done), m.target)
+	if pending > 0 {
+		embCfg, err := vectordb.EmbeddingConfigFrom(m.newCfg.Embedding)
+		if err != nil {
+			return 0, deleted, fmt.Errorf("invalid embedding config: %w", err)
+		}
+		embClient := vectordb.NewEmbeddingClient(embCfg)
+		if !embClient.IsAvailable(ctx) {
+			return 0, deleted, fmt.Errorf("embedding service not available at %s", m.newCfg.Embedding.BaseURL)
+		}
+		prog := progress.New(os.Stderr, progressFmt, "reembed", "chunks", int64(pending))
+		embedded, err = ragindex.EmbedAll(ctx, m.db, sink, embClient, done, batchSize, workers, prog)
+		m.usage = embClient.Usage()
+		if err != nil {
+			return embedded, deleted, err
+		}
+	}
+	if err := sink.Flush(ctx); err != nil {
+		return embedded, deleted, fmt.Errorf("flushing: %w", err)
+	}
+
+	count, err := sink.Count(ctx)
+	if err != nil {
+		return embedded, deleted, fmt.Errorf("counting vectors: %w", err)
+	}
+	// Milvus keeps counting deleted rows until compaction, so only a
+	// shortfall means chunks are missing
+	if count < int64(len(indexable)) {
+		return embedded, deleted, fmt.Errorf("%s holds %d vectors for %d indexable chunks", m.target, count, len(indexable))
+	}
+	return embedded, deleted, nil
+}
+
+// flip makes searches use the target and records the flip. The model
+// metadata follows, so rag-pipeline doesn't take the change of
+// embedding.model in rag.yaml for a reason to rebuild the index.
+func (m *migration) flip(ctx context.Context) (flipState, error) {
+	aside := storeName(ragindex.DefaultVectorStore(m.cfg), m.cfg.Embedding.Model)
+	if aside == m.target {
+		return flipState{}, fmt.Errorf("the new vectors go in %s, the name the old ones would be moved to; pick another with -collection", m.target)
+	}
+	previous, err := m.backend.flip(ctx, m.target, aside)
+	if err != nil {
+		return flipState{}, err
+	}
+	state := flipState{
+		Active:            m.target,
+		Previous:          previous,
+		Model:             m.newCfg.Embedding.Model,
+		Dimension:         m.newCfg.Embedding.Dimension,
+		PreviousModel:     m.cfg.Embedding.Model,
+		PreviousDimension: m.cfg.Embedding.Dimension,
+	}
+	return state, recordState(ctx, m.meta, m.cfg.Metadata.Keys, state)
+}
+
+// rollback flips back to the vectors the last flip replaced. The flip is
+// recorded reversed, so running it again undoes the rollback.
+func rollback(ctx context.Context, cfg *ragconfig.Config, meta *ragindex.Metadata, b backend) (flipState, error) {
+	state, err := loadState(ctx, meta)
+	if err != nil {
+		return state, err
+	}
+	if state.Previous == "" {
+		return state, fmt.Errorf("nothing to roll back to (no flip recorded, or the previous vectors were dropped)")
+	}
+	if ok, err := b.exists(ctx, state.Previous); err != nil {
+		return state, err
+	} else if !ok {
+		return state, fmt.Errorf("%s no longer exists", state.Previous)
+	}
+	previous, err := b.flip(ctx, state.Previous, state.Active)
+	if err != nil {
+		return state, err
+	}
+	reversed := flipState{
+		Active:            state.Previous,
+		Previous:          previous,
+		Model:             state.PreviousModel,
+		Dimension:         state.PreviousDimension,
+		PreviousModel:     state.Model,
+		PreviousDimension: state.Dimension,
+	}
+	return reversed, recordState(ctx, meta, cfg.Metadata.Keys, reversed)
+}
+
+// dropPrevious deletes the vectors the last flip replaced, after which it
+// can't be rolled back
+func dropPrevious(ctx context.Context, cfg *ragconfig.Config, meta *ragindex.Metadata, b backend) (string, error) {
+	state, err := loadState(ctx, meta)
+	if err != nil {
+		return "", err
+	}
+	if state.Previous == "" {
+		return "", fmt.Errorf("no previous vectors recorded")
+	}
+	if err := b.drop(ctx, state.Previous); err != nil {
+		return "", fmt.Errorf("dropping %s: %w", state.Previous, err)
+	}
+	dropped := state.Previous
+	state.Previous = ""
+	return dropped, recordState(ctx, meta, cfg.Metadata.Keys, state)
+}
+
+func recordState(ctx context.Context, meta *ragindex.Metadata, keys ragconfig.MetadataKeysConfig, state flipState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return meta.Set(ctx, map[string]string{
+		stateKey:            string(data),
+		keys.EmbeddingModel: state.Model,
+		keys.EmbeddingDim:   strconv.Itoa(state.Dimension),
+	})
+}
+
+func loadState(ctx context.Context, meta *ragindex.Metadata) (flipState, error) {
+	var state flipState
+	value, err := meta.Get(ctx, stateKey)
+	if err != nil || value == "" {
+		return state, err
+	}
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return state, fmt.Errorf("reading %s: %w", stateKey, err)
+	}
+	return state, nil
+}
+
+func indexableIDs(ctx context.Context, db *sql.DB) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, `SELECT chunk_id FROM chunks WHERE is_indexable = 1`)
+	if err != nil {
+		return nil, fmt.Errorf("listing indexable chunks: %w", err)
+	}
+	defer rows.Close()
+	ids := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/progress"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+	"go.mau.fi/mautrix-meta/pkg/storage/storagetest"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+// fakeEmbeddings embeds a text as counts of its words hashed into as many
+// buckets as the model has dimensions, so texts sharing words end up close
+func fakeEmbeddings(dims map[string]int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/models" {
+			io.WriteString(w, `{"data": []}`)
+			return
+		}
+		var req struct {
+			Model string          `json:"model"`
+			Input json.RawMessage `json:"input"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		var inputs []string
+		if json.Unmarshal(req.Input, &inputs) != nil {
+			var single string
+			_ = json.Unmarshal(req.Input, &single)
+			inputs = []string{single}
+		}
+		type item struct {
+			Embedding []float64 `json:"embedding"`
+			Index     int       `json:"index"`
+		}
+		var data []item
+		for i, text := range inputs {
+			v := make([]float64, dims[req.Model])
+			for _, word := range strings.Fields(text) {
+				h := fnv.New32a()
+				io.WriteString(h, req.Model+word)
+				v[h.Sum32()%uint32(len(v))]++
+			}
+			data = append(data, item{Embedding: v, Index: i})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data})
+	})
+}
+
+func newTestArchive(t *testing.T) *sql.DB {
+	t.Helper()
+	db := storagetest.NewArchive(t)
+	if err := ragindex.EnsureTables(context.Background(), db, "chunks_fts", "", "", io.Discard); err != nil {
+		t.Fatalf("EnsureTables: %v", err)
+	}
+	topics := []string{
+		"sailing boat harbour wind anchor deck mast rope waves coast island ferry",
+		"birthday cake candles party balloons presents guests music dancing friends family",
+		"invoice payment bank transfer account deadline receipt accountant taxes salary budget",
+		"mountain hike trail summit snow boots backpack tent camping forest river",
+		"kitchen recipe soup onions garlic pepper oven dinner lunch bread butter",
+	}
+	for i, text := range topics {
+		if _, err := db.Exec(`INSERT INTO chunks (chunk_id, thread_id, thread_name, session_idx, chunk_idx, message_ids,
+			participant_ids, participant_names, text, start_timestamp_ms, end_timestamp_ms, message_count,
+			is_indexable, char_count, alnum_count, unique_word_count)
+			VALUES (?, 1, 'Test', ?, 0, '[]', '[]', '[]', ?, 0, 0, 1, 1, 0, 0, 0)`,
+			fmt.Sprintf("c%d", i), i, text+" "+text); err != nil {
+			t.Fatalf("inserting chunk: %v", err)
+		}
+	}
+	return db
+}
+
+func TestMigration_SQLite(t *testing.T) {
+	srv := httptest.NewServer(fakeEmbeddings(map[string]int{"old": 8, "new": 32}))
+	defer srv.Close()
+	db := newTestArchive(t)
+	ctx := context.Background()
+
+	cfg := ragconfig.Default()
+	cfg.Vector.Backend = ragconfig.VectorBackendSQLite
+	cfg.Embedding.Provider = ragconfig.EmbeddingProviderOpenAI
+	cfg.Embedding.BaseURL = srv.URL
+	cfg.Embedding.Model = "old"
+	cfg.Embedding.Dimension = 8
+	newCfg := *cfg
+	newCfg.Embedding.Model = "new"
+	newCfg.Embedding.Dimension = 32
+
+	// The vectors in use, as milvus-index would have stored them
+	sink, err := ragindex.NewSink(ctx, cfg, db, io.Discard)
+	if err != nil {
+		t.Fatalf("NewSink: %v", err)
+	}
+	if _, err := sink.Prepare(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	embCfg, _ := vectordb.EmbeddingConfigFrom(cfg.Embedding)
+	prog := progress.New(io.Discard, progress.FormatNone, "index", "chunks", 5)
+	if _, err := ragindex.EmbedAll(ctx, db, sink, vectordb.NewEmbeddingClient(embCfg), nil, 2, 2, prog); err != nil {
+		t.Fatalf("EmbedAll: %v", err)
+	}
+	sink.Close()
+
+	meta, err := ragindex.OpenMetadata(ctx, db, cfg)
+	if err != nil {
+		t.Fatalf("OpenMetadata: %v", err)
+	}
+	b, _ := newBackend(ctx, cfg, db)
+	m := &migration{db: db, cfg: cfg, newCfg: &newCfg, meta: meta, backend: b, target: "chunk_vectors_new", out: io.Discard}
+
+	embedded, _, err := m.build(ctx, 2, 2, progress.FormatNone)
+	if err != nil || embedded != 5 {
+		t.Fatalf("build = %d, %v; want 5 embedded", embedded, err)
+	}
+	// A rerun only catches up: one chunk gone, nothing to embed
+	if _, err := db.Exec(`UPDATE chunks SET is_indexable = 0 WHERE chunk_id = 'c4'`); err != nil {
+		t.Fatal(err)
+	}
+	embedded, deleted, err := m.build(ctx, 2, 2, progress.FormatNone)
+	if err != nil || embedded != 0 || deleted != 1 {
+		t.Fatalf("rerun build = %d embedded, %d deleted, %v", embedded, deleted, err)
+	}
+
+	queries, err := sampleQueries(ctx, db, 10)
+	if err != nil || len(queries) != 4 {
+		t.Fatalf("sampleQueries = %d, %v", len(queries), err)
+	}
+	p, err := m.validate(ctx, queries, 2)
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if p.OldRecall != 1 || p.NewRecall != 1 || !p.ok(0.1, 0.1) {
+		t.Errorf("validation %+v should pass", p)
+	}
+
+	state, err := m.flip(ctx)
+	if err != nil || state.Previous != "chunk_vectors_old" {
+		t.Fatalf("flip = %+v, %v", state, err)
+	}
+	assertLive := func(model string, dim int) {
+		t.Helper()
+		var size int
+		if err := db.QueryRow(`SELECT length(embedding) FROM chunk_vectors LIMIT 1`).Scan(&size); err != nil || size != 4*dim {
+			t.Errorf("chunk_vectors holds %d-byte vectors (%v), want %d dim", size, err, dim)
+		}
+		if got, _ := meta.Get(ctx, cfg.Metadata.Keys.EmbeddingModel); got != model {
+			t.Errorf("recorded model = %q, want %q", got, model)
+		}
+	}
+	assertLive("new", 32)
+
+	state, err = rollback(ctx, cfg, meta, b)
+	if err != nil || state.Active != "chunk_vectors_old" || state.Previous != "chunk_vectors_new" {
+		t.Fatalf("rollback = %+v, %v", state, err)
+	}
+	assertLive("old", 8)
+
+	// Rolling back again undoes the rollback; dropping the previous vectors
+	// then ends the chance to
+	if _, err := rollback(ctx, cfg, meta, b); err != nil {
+		t.Fatalf("second rollback: %v", err)
+	}
+	assertLive("new", 32)
+	if dropped, err := dropPrevious(ctx, cfg, meta, b); err != nil || dropped != "chunk_vectors_old" {
+		t.Fatalf("dropPrevious = %q, %v", dropped, err)
+	}
+	if _, err := rollback(ctx, cfg, meta, b); err == nil {
+		t.Error("rollback after dropping the previous vectors should fail")
+	}
+}
+
+func TestStoreName(t *testing.T) {
+	if got := storeName("messenger_chunks", "BAAI/bge-m3:latest"); got != "messenger_chunks_baai_bge_m3_latest" {
+		t.Errorf("storeName = %q", got)
+	}
+}
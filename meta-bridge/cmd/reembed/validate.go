@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"go.mau.fi/mautrix-meta/pkg/rag"
+)
+
+// queryWords is how many words a sampled query takes from its chunk
+const queryWords = 12
+
+// sampleQuery is a query searched with both models
+type sampleQuery struct {
+	text string
+	// chunkID is the chunk a sampled query was taken from, which both
+	// searches should find; empty for queries from -queries
+	chunkID string
+}
+
+// parity compares the top k of the same queries over the old and new
+// vectors
+type parity struct {
+	Queries int
+	// Overlap is the mean share of the old top k also in the new top k
+	Overlap float64
+	// Sampled queries were taken from chunks; the recalls are the share
+	// of them whose chunk came back
+	Sampled   int
+	OldRecall float64
+	NewRecall float64
+}
+
+// ok reports whether the new vectors pass: their results overlap the old
+// ones enough, and they find sampled chunks nearly as often
+func (p parity) ok(minOverlap, maxRecallDrop float64) bool {
+	if p.Overlap < minOverlap {
+		return false
+	}
+	return p.Sampled == 0 || p.NewRecall >= p.OldRecall-maxRecallDrop
+}
+
+// sampleQueries takes queries from n random indexable chunks
+func sampleQueries(ctx context.Context, db *sql.DB, n int) ([]sampleQuery, error) {
+	rows, err := db.QueryContext(ctx, `SELECT chunk_id, text FROM chunks WHERE is_indexable = 1 ORDER BY random() LIMIT ?`, n)
+	if err != nil {
+		return nil, fmt.Errorf("sampling chunks: %w", err)
+	}
+	defer rows.Close()
+	var queries []sampleQuery
+	for rows.Next() {
+		var id, text string
+		if err := rows.Scan(&id, &text); err != nil {
+			return nil, err
+		}
+		if q := queryFromText(text); q != "" {
+			queries = append(queries, sampleQuery{text: q, chunkID: id})
+		}
+	}
+	return queries, rows.Err()
+}
+
+// queryFromText takes a few words from the middle of a chunk: enough to
+// find it again, without being the whole text
+func queryFromText(text string) string {
+	words := strings.Fields(text)
+	if len(words) > queryWords {
+		start := (len(words) - queryWords) / 2
+		words = words[start : start+queryWords]
+	}
+	return strings.Join(words, " ")
+}
+
+// readQueries reads one query per line, skipping blank lines and # comments
+func readQueries(path string) ([]sampleQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var queries []sampleQuery
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			queries = append(queries, sampleQuery{text: line})
+		}
+	}
+	return queries, scanner.Err()
+}
+
+// validate searches every query with the old model over the vectors in use
+// and with the new one over the target
+func (m *migration) validate(ctx context.Context, queries []sampleQuery, k int) (parity, error) {
+	var p parity
+	oldEmbed, err := rag.NewEmbeddingClientAdapter(m.cfg)
+	if err != nil {
+		return p, err
+	}
+	newEmbed, err := rag.NewEmbeddingClientAdapter(m.newCfg)
+	if err != nil {
+		return p, err
+	}
+	oldVectors, err := rag.NewVectorSearcher(ctx, m.cfg, m.db)
+	if err != nil {
+		return p, fmt.Errorf("opening the vectors in use: %w", err)
+	}
+	defer oldVectors.Close()
+	newVectors, err := rag.NewVectorSearcherAt(ctx, m.newCfg, m.db, m.target)
+	if err != nil {
+		return p, fmt.Errorf("opening %s: %w", m.target, err)
+	}
+	defer newVectors.Close()
+
+	ef := max(m.cfg.Milvus.Search.Ef, k)
+	var overlap float64
+	oldFound, newFound := 0, 0
+	for _, q := range queries {
+		oldIDs, err := searchIDs(ctx, oldEmbed, oldVectors, q.text, k, ef)
+		if err != nil {
+			return p, fmt.Errorf("searching with %s: %w", m.cfg.Embedding.Model, err)
+		}
+		newIDs, err := searchIDs(ctx, newEmbed, newVectors, q.text, k, ef)
+		if err != nil {
+			return p, fmt.Errorf("searching with %s: %w", m.newCfg.Embedding.Model, err)
+		}
+
+		shared := 0
+		for _, id := range oldIDs {
+			if slices.Contains(newIDs, id) {
+				shared++
+			}
+		}
+		if len(oldIDs) > 0 {
+			overlap += float64(shared) / float64(len(oldIDs))
+		}
+		if q.chunkID != "" {
+			p.Sampled++
+			if slices.Contains(oldIDs, q.chunkID) {
+				oldFound++
+			}
+			if slices.Contains(newIDs, q.chunkID) {
+				newFound++
+			}
+		}
+		p.Queries++
+	}
+	if p.Queries > 0 {
+		p.Overlap = overlap / float64(p.Queries)
+	}
+	if p.Sampled > 0 {
+		p.OldRecall = float64(oldFound) / float64(p.Sampled)
+		p.NewRecall = float64(newFound) / float64(p.Sampled)
+	}
+	return p, nil
+}
+
+func searchIDs(ctx context.Context, embed rag.Embedder, vectors rag.VectorSearcher, query string, k, ef int) ([]string, error) {
+	embedding, err := embed.Embed(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	hits, err := vectors.Search(ctx, embedding, k, ef, rag.SearchFilter{})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(hits))
+	for i, h := range hits {
+		ids[i] = h.ChunkID
+	}
+	return ids, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/pseudonym"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// Bundle is the sanitized content of one shared thread. Participant and
+// message IDs are renumbered, so nothing in it points back into the archive.
+type Bundle struct {
+	Title        string        `json:"title"`
+	GeneratedAt  time.Time     `json:"generated_at"`
+	FirstMs      int64         `json:"first_timestamp_ms"`
+	LastMs       int64         `json:"last_timestamp_ms"`
+	Participants []Participant `json:"participants"`
+	Messages     []Message     `json:"messages"`
+}
+
+type Participant struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type Message struct {
+	ID          int          `json:"id"`
+	SenderID    int          `json:"sender_id"`
+	Text        string       `json:"text,omitempty"`
+	TimestampMs int64        `json:"timestamp_ms"`
+	ReplyToID   int          `json:"reply_to_id,omitempty"`
+	Forwarded   bool         `json:"forwarded,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Reactions   []Reaction   `json:"reactions,omitempty"`
+}
+
+// Attachment is described, never linked: archive URLs are signed CDN links
+// that expire and identify the account
+type Attachment struct {
+	Kind     string `json:"kind"`
+	Filename string `json:"filename,omitempty"`
+}
+
+type Reaction struct {
+	ParticipantID int    `json:"participant_id"`
+	Reaction      string `json:"reaction"`
+}
+
+// Options selects what goes into the bundle
+type Options struct {
+	ThreadID int64
+	Title    string
+	SinceMs  int64 // inclusive; 0 = no bound
+	UntilMs  int64 // exclusive; 0 = no bound
+
+	// Pseudonymize replaces participant names (in the roster and in message
+	// text) with "Participant N"
+	Pseudonymize bool
+	// RedactContacts masks e-mail addresses and phone numbers in text
+	RedactContacts bool
+	// RedactLinks masks URLs in text
+	RedactLinks bool
+	// NoAttachments drops attachment descriptions and filenames
+	NoAttachments bool
+	// ExcludeSenders drops messages from these archive contact IDs
+	ExcludeSenders map[int64]bool
+}
+
+var (
+	emailRe = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	phoneRe = regexp.MustCompile(`\+?\b(?:\d{2,3}[\s.-]?)?\d{3}[\s.-]?\d{3}[\s.-]?\d{3,4}\b`)
+	linkRe  = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+)
+
+// loadBundle reads the thread from the archive and applies the redactions
+func loadBundle(db *sql.DB, opts Options) (*Bundle, error) {
+	var threadName sql.NullString
+	err := db.QueryRow(`SELECT name FROM thread_names WHERE thread_id = ?`, opts.ThreadID).Scan(&threadName)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("thread %d not found", opts.ThreadID)
+	} else if err != nil {
+		return nil, fmt.Errorf("reading thread: %w", err)
+	}
+
+	b := &Bundle{Title: opts.Title, GeneratedAt: time.Now().UTC()}
+	if b.Title == "" {
+		b.Title = threadName.String
+	}
+
+	names, err := storage.ThreadMemberNames(db, opts.ThreadID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, archiveIDs, err := loadMessages(db, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("thread %d has no messages in the selected range", opts.ThreadID)
+	}
+
+	// Renumber participants in order of first appearance
+	participantIDs := make(map[int64]int)
+	participant := func(contactID int64) int {
+		if id, ok := participantIDs[contactID]; ok {
+			return id
+		}
+		id := len(b.Participants) + 1
+		participantIDs[contactID] = id
+		name := names[contactID]
+		if opts.Pseudonymize || name == "" {
+			name = pseudonym.Participant(int64(id))
+		}
+		b.Participants = append(b.Participants, Participant{ID: id, Name: name})
+		return id
+	}
+	messageIDs := make(map[string]int, len(messages))
+	for i := range messages {
+		messageIDs[archiveIDs[i].id] = i + 1
+	}
+	for i := range messages {
+		m := &messages[i]
+		m.ID = i + 1
+		m.SenderID = participant(archiveIDs[i].sender)
+		m.ReplyToID = messageIDs[archiveIDs[i].replyTo]
+	}
+
+	if err := loadReactions(db, opts, messageIDs, messages, participant); err != nil {
+		return nil, err
+	}
+	if !opts.NoAttachments {
+		if err := loadAttachments(db, opts.ThreadID, messageIDs, messages); err != nil {
+			return nil, err
+		}
+	}
+
+	redact := newRedactor(opts, names, b.Participants, participantIDs)
+	b.Title = redact(b.Title)
+	for i := range messages {
+		messages[i].Text = redact(messages[i].Text)
+	}
+
+	b.Messages = messages
+	b.FirstMs = messages[0].TimestampMs
+	b.LastMs = messages[len(messages)-1].TimestampMs
+	return b, nil
+}
+
+// archiveRef keeps the archive IDs of a loaded message for renumbering
+type archiveRef struct {
+	id      string
+	sender  int64
+	replyTo string
+}
+
+func loadMessages(db *sql.DB, opts Options) ([]Message, []archiveRef, error) {
+	query := `
+		SELECT id, sender_id, COALESCE(text, ''), timestamp_ms, COALESCE(reply_to_message_id, ''), is_forwarded
+		FROM messages
+		WHERE thread_id = ? AND is_unsent = 0`
+	args := []any{opts.ThreadID}
+	if opts.SinceMs > 0 {
+		query += ` AND timestamp_ms >= ?`
+		args = append(args, opts.SinceMs)
+	}
+	if opts.UntilMs > 0 {
+		query += ` AND timestamp_ms < ?`
+		args = append(args, opts.UntilMs)
+	}
+	query += ` ORDER BY timestamp_ms, id`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []Message
+	var refs []archiveRef
+	for rows.Next() {
+		var m Message
+		var ref archiveRef
+		if err := rows.Scan(&ref.id, &ref.sender, &m.Text, &m.TimestampMs, &ref.replyTo, &m.Forwarded); err != nil {
+			return nil, nil, err
+		}
+		if opts.ExcludeSenders[ref.sender] {
+			continue
+		}
+		messages = append(messages, m)
+		refs = append(refs, ref)
+	}
+	return messages, refs, rows.Err()
+}
+
+func loadReactions(db *sql.DB, opts Options, messageIDs map[string]int, messages []Message, participant func(int64) int) error {
+	rows, err := db.Query(`SELECT message_id, actor_id, reaction FROM reactions WHERE thread_id = ? ORDER BY timestamp_ms`, opts.ThreadID)
+	if err != nil {
+		return fmt.Errorf("reading reactions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID, reaction string
+		var actor int64
+		if err := rows.Scan(&messageID, &actor, &reaction); err != nil {
+			return err
+		}
+		if id, ok := messageIDs[messageID]; ok && !opts.ExcludeSenders[actor] {
+			m := &messages[id-1]
+			m.Reactions = append(m.Reactions, Reaction{ParticipantID: participant(actor), Reaction: reaction})
+		}
+	}
+	return rows.Err()
+}
+
+func loadAttachments(db *sql.DB, threadID int64, messageIDs map[string]int, messages []Message) error {
+	// Attachments have no thread_id; join through messages
+	rows, err := db.Query(`
+		SELECT a.message_id, a.attachment_type, COALESCE(a.filename, '')
+		FROM attachments a
+		JOIN messages m ON m.id = a.message_id
+		WHERE m.thread_id = ?
+		ORDER BY a.rowid
+	`, threadID)
+	if err != nil {
+		return fmt.Errorf("reading attachments: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID, filename string
+		var kind int64
+		if err := rows.Scan(&messageID, &kind, &filename); err != nil {
+			return err
+		}
+		if id, ok := messageIDs[messageID]; ok {
+			m := &messages[id-1]
+			m.Attachments = append(m.Attachments, Attachment{Kind: storage.AttachmentKind(table.AttachmentType(kind)), Filename: filename})
+		}
+	}
+	return rows.Err()
+}
+
+// newRedactor builds the text filter for the chosen options
+func newRedactor(opts Options, names map[int64]string, participants []Participant, participantIDs map[int64]int) func(string) string {
+	var replacer *pseudonym.Replacer
+	if opts.Pseudonymize {
+		aliases := make(pseudonym.Names)
+		for _, contactID := range slices.Sorted(maps.Keys(names)) {
+			// Members who didn't write in the selected range still get hidden
+			alias := pseudonym.Fallback
+			if id, ok := participantIDs[contactID]; ok {
+				alias = participants[id-1].Name
+			}
+			aliases.Add(names[contactID], alias)
+		}
+		replacer = pseudonym.NewReplacer(aliases)
+	}
+
+	return func(s string) string {
+		if s == "" {
+			return s
+		}
+		if opts.RedactLinks {
+			s = linkRe.ReplaceAllString(s, "[link]")
+		}
+		if opts.RedactContacts {
+			s = emailRe.ReplaceAllString(s, "[email]")
+			s = phoneRe.ReplaceAllString(s, "[phone]")
+		}
+		if replacer != nil {
+			s = replacer.Replace(s)
+		}
+		return s
+	}
+}
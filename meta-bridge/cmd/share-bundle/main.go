@@ -0,0 +1,169 @@
+// share-bundle exports one thread as a read-only static bundle for sharing
+// with its participants (e.g. a trip group chat):
+//
+//	index.html   pre-rendered page, no scripts or external assets
+//	thread.json  the same content as JSON
+//	thread.db    sanitized SQLite with only this thread
+//
+// The bundle never contains archive IDs, attachment URLs or anything from
+// other threads. Redaction is opt-in per category; check the output before
+// sending it anywhere.
+//
+// Usage:
+//
+//	share-bundle -thread 123456 -out trip-2019
+//	share-bundle -thread 123456 -out trip-2019 -since 2019-07 -until 2019-09 -title "Croatia 2019"
+//	share-bundle -thread 123456 -out trip -pseudonymize -redact-contacts -redact-links -no-attachments
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/rag"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	dbPath         = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile      = storage.KeyFileFlag()
+	cfgPath        = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	threadID       = flag.Int64("thread", 0, "Thread to export (required)")
+	outDir         = flag.String("out", "", "Output directory (required; created if missing)")
+	title          = flag.String("title", "", "Page title (default: the thread name)")
+	since          = flag.String("since", "", "Only messages at or after this time (2006, 2006-01, 2006-01-02 or RFC3339)")
+	until          = flag.String("until", "", "Only messages before this time")
+	timezone       = flag.String("tz", "Local", "Time zone for the rendered page (IANA name)")
+	pseudonymize   = flag.Bool("pseudonymize", false, "Replace participant names, including mentions in text, with Participant N")
+	redactContacts = flag.Bool("redact-contacts", false, "Mask e-mail addresses and phone numbers in text")
+	redactLinks    = flag.Bool("redact-links", false, "Mask URLs in text")
+	noAttachments  = flag.Bool("no-attachments", false, "Leave out attachment descriptions and filenames")
+	excludeSenders = flag.String("exclude-senders", "", "Comma-separated contact IDs whose messages and reactions are left out")
+	debug          = flag.Bool("debug", false, "Enable debug logging")
+)
+
+func main() {
+	flag.Parse()
+
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	if *threadID == 0 || *outDir == "" {
+		log.Fatal().Msg("-thread and -out are required")
+	}
+
+	opts := Options{
+		ThreadID:       *threadID,
+		Title:          *title,
+		Pseudonymize:   *pseudonymize,
+		RedactContacts: *redactContacts,
+		RedactLinks:    *redactLinks,
+		NoAttachments:  *noAttachments,
+	}
+	var err error
+	if opts.SinceMs, err = parseBound(*since); err != nil {
+		log.Fatal().Err(err).Msg("Invalid -since")
+	}
+	if opts.UntilMs, err = parseBound(*until); err != nil {
+		log.Fatal().Err(err).Msg("Invalid -until")
+	}
+	if opts.ExcludeSenders, err = parseIDList(*excludeSenders); err != nil {
+		log.Fatal().Err(err).Msg("Invalid -exclude-senders")
+	}
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid -tz")
+	}
+
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	db, err := sql.Open(storage.Driver("sqlite3"), sqlitePath+"?mode=ro")
+	if err != nil {
+		log.Fatal().Err(err).Str("path", sqlitePath).Msg("Failed to open database")
+	}
+	defer db.Close()
+
+	bundle, err := loadBundle(db, opts)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load thread")
+	}
+
+	if err := writeBundle(*outDir, bundle, loc); err != nil {
+		log.Fatal().Err(err).Str("out", *outDir).Msg("Failed to write bundle")
+	}
+	fmt.Printf("Wrote %d messages from %d participants to %s\n", len(bundle.Messages), len(bundle.Participants), *outDir)
+}
+
+func writeBundle(dir string, b *Bundle, loc *time.Location) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := writeSQLite(filepath.Join(dir, "thread.db"), b); err != nil {
+		return fmt.Errorf("thread.db: %w", err)
+	}
+	if err := writeJSON(filepath.Join(dir, "thread.json"), b); err != nil {
+		return fmt.Errorf("thread.json: %w", err)
+	}
+	f, err := os.Create(filepath.Join(dir, "index.html"))
+	if err != nil {
+		return err
+	}
+	if err := renderHTML(f, b, loc); err != nil {
+		f.Close()
+		return fmt.Errorf("index.html: %w", err)
+	}
+	return f.Close()
+}
+
+func parseBound(s string) (int64, error) {
+	t, err := rag.ParseSearchTime(s)
+	if err != nil || t.IsZero() {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
+
+func parseIDList(s string) (map[int64]bool, error) {
+	ids := make(map[int64]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
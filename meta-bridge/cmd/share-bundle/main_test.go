@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/storage/storagetest"
+)
+
+func newTestArchive(t *testing.T) *sql.DB {
+	t.Helper()
+	return storagetest.NewArchive(t,
+		`INSERT INTO contacts (id, name, created_at, updated_at) VALUES (11, 'Anna Nowak', 0, 0), (12, 'Bartek Kowalski', 0, 0)`,
+		`INSERT INTO threads (id, thread_type, name, created_at, updated_at) VALUES (5, 2, 'Chorwacja 2019', 0, 0), (6, 1, NULL, 0, 0)`,
+		`INSERT INTO thread_participants (thread_id, contact_id) VALUES (5, 11), (5, 12)`,
+		`INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms, created_at) VALUES
+			('m1', 5, 11, 'Bartek, call me at +48 600 123 456 or anna@example.com', 1000, 0),
+			('m2', 5, 12, 'ok Anna, see https://maps.example.com/x', 2000, 0),
+			('m3', 5, 11, 'unsent', 3000, 0),
+			('m4', 6, 11, 'other thread', 4000, 0)`,
+		`UPDATE messages SET is_unsent = 1 WHERE id = 'm3'`,
+		`UPDATE messages SET reply_to_message_id = 'm1' WHERE id = 'm2'`,
+		`INSERT INTO reactions (thread_id, message_id, actor_id, reaction, timestamp_ms) VALUES (5, 'm2', 11, '👍', 2500)`,
+		`INSERT INTO attachments (id, message_id, attachment_type, url, filename, created_at) VALUES ('a1', 'm2', 2, 'https://cdn.example/secret', 'IMG_1.jpg', 0)`,
+	)
+}
+
+func TestLoadBundle_Redaction(t *testing.T) {
+	db := newTestArchive(t)
+
+	b, err := loadBundle(db, Options{ThreadID: 5, Pseudonymize: true, RedactContacts: true, RedactLinks: true})
+	if err != nil {
+		t.Fatalf("loadBundle: %v", err)
+	}
+	if len(b.Messages) != 2 {
+		t.Fatalf("expected 2 messages (unsent and other threads excluded), got %d", len(b.Messages))
+	}
+	if b.Participants[0].Name != "Participant 1" || b.Participants[1].Name != "Participant 2" {
+		t.Fatalf("expected pseudonymized roster, got %+v", b.Participants)
+	}
+	if got := b.Messages[0].Text; got != "Participant 2, call me at [phone] or [email]" {
+		t.Errorf("unexpected first text: %q", got)
+	}
+	if got := b.Messages[1].Text; got != "ok Participant 1, see [link]" {
+		t.Errorf("unexpected second text: %q", got)
+	}
+	m := b.Messages[1]
+	if m.ReplyToID != 1 || len(m.Reactions) != 1 || m.Reactions[0].ParticipantID != 1 {
+		t.Errorf("unexpected reply/reactions: %+v", m)
+	}
+	if len(m.Attachments) != 1 || m.Attachments[0].Kind != "photo" {
+		t.Errorf("unexpected attachments: %+v", m.Attachments)
+	}
+
+	b, err = loadBundle(db, Options{ThreadID: 5, SinceMs: 1500, ExcludeSenders: map[int64]bool{11: true}})
+	if err != nil {
+		t.Fatalf("loadBundle: %v", err)
+	}
+	if len(b.Messages) != 1 || len(b.Messages[0].Reactions) != 0 || b.Participants[0].Name != "Bartek Kowalski" {
+		t.Fatalf("unexpected filtered bundle: %+v", b)
+	}
+}
+
+func TestWriteBundle(t *testing.T) {
+	db := newTestArchive(t)
+	b, err := loadBundle(db, Options{ThreadID: 5, Title: "<Trip>"})
+	if err != nil {
+		t.Fatalf("loadBundle: %v", err)
+	}
+	dir := t.TempDir()
+	if err := writeBundle(dir, b, time.UTC); err != nil {
+		t.Fatalf("writeBundle: %v", err)
+	}
+
+	out, err := sql.Open("sqlite3", filepath.Join(dir, "thread.db"))
+	if err != nil {
+		t.Fatalf("open bundle: %v", err)
+	}
+	defer out.Close()
+	var count int
+	if err := out.QueryRow(`SELECT COUNT(*) FROM messages m JOIN participants p ON p.id = m.sender_id`).Scan(&count); err != nil || count != 2 {
+		t.Fatalf("expected 2 messages in thread.db, got %d (%v)", count, err)
+	}
+
+	var html bytes.Buffer
+	if err := renderHTML(&html, b, time.UTC); err != nil {
+		t.Fatalf("renderHTML: %v", err)
+	}
+	page := html.String()
+	if !strings.Contains(page, "&lt;Trip&gt;") || strings.Contains(page, "cdn.example") || !strings.Contains(page, "[photo: IMG_1.jpg]") {
+		t.Fatalf("unexpected page:\n%s", page)
+	}
+}
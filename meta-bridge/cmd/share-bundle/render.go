@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// bundleSchema is deliberately not the archive schema: only what the viewer
+// needs, with renumbered IDs
+const bundleSchema = `
+CREATE TABLE bundle (
+    title TEXT NOT NULL,
+    generated_at INTEGER NOT NULL,
+    first_timestamp_ms INTEGER NOT NULL,
+    last_timestamp_ms INTEGER NOT NULL
+);
+CREATE TABLE participants (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL
+);
+CREATE TABLE messages (
+    id INTEGER PRIMARY KEY,
+    sender_id INTEGER NOT NULL REFERENCES participants(id),
+    text TEXT,
+    timestamp_ms INTEGER NOT NULL,
+    reply_to_id INTEGER REFERENCES messages(id),
+    is_forwarded BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE TABLE attachments (
+    message_id INTEGER NOT NULL REFERENCES messages(id),
+    kind TEXT NOT NULL,
+    filename TEXT
+);
+CREATE TABLE reactions (
+    message_id INTEGER NOT NULL REFERENCES messages(id),
+    participant_id INTEGER NOT NULL REFERENCES participants(id),
+    reaction TEXT NOT NULL
+);
+CREATE INDEX idx_messages_timestamp ON messages(timestamp_ms);
+`
+
+// writeSQLite writes the bundle to a new database at path
+func writeSQLite(path string, b *Bundle) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=on")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(bundleSchema); err != nil {
+		return fmt.Errorf("creating schema: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO bundle VALUES (?, ?, ?, ?)`,
+		b.Title, b.GeneratedAt.UnixMilli(), b.FirstMs, b.LastMs); err != nil {
+		return err
+	}
+	for _, p := range b.Participants {
+		if _, err := tx.Exec(`INSERT INTO participants (id, name) VALUES (?, ?)`, p.ID, p.Name); err != nil {
+			return err
+		}
+	}
+	for _, m := range b.Messages {
+		var replyTo any
+		if m.ReplyToID > 0 {
+			replyTo = m.ReplyToID
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO messages (id, sender_id, text, timestamp_ms, reply_to_id, is_forwarded)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, m.ID, m.SenderID, m.Text, m.TimestampMs, replyTo, m.Forwarded); err != nil {
+			return err
+		}
+		for _, a := range m.Attachments {
+			if _, err := tx.Exec(`INSERT INTO attachments (message_id, kind, filename) VALUES (?, ?, ?)`,
+				m.ID, a.Kind, a.Filename); err != nil {
+				return err
+			}
+		}
+		for _, r := range m.Reactions {
+			if _, err := tx.Exec(`INSERT INTO reactions (message_id, participant_id, reaction) VALUES (?, ?, ?)`,
+				m.ID, r.ParticipantID, r.Reaction); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func writeJSON(path string, b *Bundle) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// pageDay groups the messages of one calendar day for rendering
+type pageDay struct {
+	Date     string
+	Messages []pageMessage
+}
+
+type pageMessage struct {
+	ID          int
+	Sender      string
+	SameSender  bool // as the previous message, so the name is omitted
+	Time        string
+	Text        string
+	ReplyTo     string // snippet of the replied-to message
+	Forwarded   bool
+	Attachments []Attachment
+	Reactions   string
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 46rem; margin: 0 auto; padding: 1rem; background: #f5f5f7; color: #1c1c1e; }
+header { border-bottom: 1px solid #d1d1d6; margin-bottom: 1rem; }
+header p { color: #6e6e73; margin: .25rem 0 1rem; }
+h2 { font-size: .8rem; text-align: center; color: #6e6e73; margin: 1.5rem 0 .5rem; }
+.msg { margin: .15rem 0; }
+.msg .who { font-size: .75rem; font-weight: 600; margin-top: .6rem; color: #3a3a3c; }
+.bubble { display: inline-block; background: #fff; border-radius: .9rem; padding: .4rem .75rem; max-width: 85%; white-space: pre-wrap; overflow-wrap: anywhere; }
+.meta { font-size: .7rem; color: #8e8e93; margin-left: .4rem; }
+.reply { font-size: .75rem; color: #6e6e73; border-left: 2px solid #c7c7cc; padding-left: .4rem; margin-bottom: .2rem; }
+.att { font-size: .8rem; color: #6e6e73; font-style: italic; }
+.reactions { font-size: .8rem; margin-left: .4rem; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Title}}</h1>
+<p>{{.Range}} · {{.Count}} messages · {{.People}}</p>
+</header>
+<main>
+{{range .Days}}<h2>{{.Date}}</h2>
+{{range .Messages}}<div class="msg" id="m{{.ID}}">{{if not .SameSender}}<div class="who">{{.Sender}}</div>{{end}}<div class="bubble">{{if .ReplyTo}}<div class="reply">{{.ReplyTo}}</div>{{end}}{{if .Forwarded}}<div class="att">Forwarded</div>{{end}}{{.Text}}{{range .Attachments}}<div class="att">[{{.Kind}}{{if .Filename}}: {{.Filename}}{{end}}]</div>{{end}}</div><span class="meta">{{.Time}}</span>{{if .Reactions}}<span class="reactions">{{.Reactions}}</span>{{end}}</div>
+{{end}}{{end}}</main>
+<footer><p class="meta">Generated {{.Generated}}. Read-only copy; names and details may be redacted.</p></footer>
+</body>
+</html>
+`))
+
+// renderHTML writes a self-contained page (no scripts, no external assets).
+// Times are shown in loc.
+func renderHTML(w io.Writer, b *Bundle, loc *time.Location) error {
+	names := make(map[int]string, len(b.Participants))
+	people := make([]string, 0, len(b.Participants))
+	for _, p := range b.Participants {
+		names[p.ID] = p.Name
+		people = append(people, p.Name)
+	}
+
+	var days []pageDay
+	prevSender := 0
+	for _, m := range b.Messages {
+		t := time.UnixMilli(m.TimestampMs).In(loc)
+		date := t.Format("Monday, 2 January 2006")
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			days = append(days, pageDay{Date: date})
+			prevSender = 0
+		}
+		pm := pageMessage{
+			ID:          m.ID,
+			Sender:      names[m.SenderID],
+			SameSender:  m.SenderID == prevSender,
+			Time:        t.Format("15:04"),
+			Text:        m.Text,
+			Forwarded:   m.Forwarded,
+			Attachments: m.Attachments,
+		}
+		if m.ReplyToID > 0 {
+			orig := b.Messages[m.ReplyToID-1]
+			pm.ReplyTo = names[orig.SenderID] + ": " + snippet(orig.Text, 80)
+		}
+		var reactions []string
+		for _, r := range m.Reactions {
+			reactions = append(reactions, r.Reaction)
+		}
+		pm.Reactions = strings.Join(reactions, " ")
+		days[len(days)-1].Messages = append(days[len(days)-1].Messages, pm)
+		prevSender = m.SenderID
+	}
+
+	first := time.UnixMilli(b.FirstMs).In(loc).Format("2 Jan 2006")
+	last := time.UnixMilli(b.LastMs).In(loc).Format("2 Jan 2006")
+	dateRange := first
+	if last != first {
+		dateRange += " – " + last
+	}
+
+	return pageTemplate.Execute(w, map[string]any{
+		"Title":     b.Title,
+		"Range":     dateRange,
+		"Count":     len(b.Messages),
+		"People":    strings.Join(people, ", "),
+		"Days":      days,
+		"Generated": b.GeneratedAt.In(loc).Format("2 Jan 2006 15:04 MST"),
+	})
+}
+
+func snippet(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "…"
+	}
+	return s
+}
@@ -0,0 +1,258 @@
+// summarize writes LLM summaries of conversations for coarse-to-fine search.
+//
+// Each conversation session (chunks without a long pause between them) gets
+// a few sentences from the model configured in the llm section of rag.yaml,
+// and each thread of more than one session gets a summary of its session
+// summaries. They are stored in the summaries table. Summaries whose input,
+// model and prompt haven't changed are kept, so reruns after rag-pipeline
+// only summarize new and changed sessions.
+//
+// With summarize.collection set, summaries are also embedded with the
+// embedding model and indexed in that Milvus collection, to find the right
+// thread or session before searching its chunks.
+//
+// Run it after rag-pipeline: sessions come from the chunks table.
+//
+// Usage:
+//
+//	summarize --db messenger.db
+//	summarize --db messenger.db --thread 123456789  # one thread
+//	summarize --db messenger.db --limit 20          # the 20 most recently active threads
+//	summarize --db messenger.db --force             # rewrite every summary
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/llm"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+	"go.mau.fi/mautrix-meta/pkg/summarize"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+var (
+	dbPath    = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile = storage.KeyFileFlag()
+	cfgPath   = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	threadID  = flag.Int64("thread", 0, "Summarize only this thread")
+	limit     = flag.Int("limit", 0, "Summarize at most this many threads, most recently active first (0 = all)")
+	force     = flag.Bool("force", false, "Rewrite summaries even if their input is unchanged")
+	noIndex   = flag.Bool("no-index", false, "Don't index summaries, even with summarize.collection set")
+	batchSize = flag.Int("batch-size", 50, "Number of summaries to embed and insert per batch")
+	debug     = flag.Bool("debug", false, "Enable debug logging")
+)
+
+func main() {
+	flag.Parse()
+
+	// Setup logging
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	// Load configuration
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+	model := cfg.Summarize.Model
+	if model == "" {
+		model = cfg.LLM.Model
+	}
+	if model == "" {
+		log.Fatal().Msg("No model configured (set summarize.model or llm.model in rag.yaml)")
+	}
+
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+
+	db, err := sql.Open(storage.Driver("sqlite3"), sqlitePath+"?_busy_timeout=30000&_journal_mode=WAL")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open database")
+	}
+	defer db.Close()
+	store, err := storage.New(sqlitePath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open database")
+	}
+	defer store.Close()
+
+	client, err := llm.New(cfg.LLM)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid LLM config")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	threads := []int64{*threadID}
+	if *threadID == 0 {
+		threads, err = summarize.ThreadIDs(ctx, db)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to list threads (run rag-pipeline first)")
+		}
+		if *limit > 0 && len(threads) > *limit {
+			threads = threads[:*limit]
+		}
+	}
+
+	start := time.Now()
+	log.Info().Str("endpoint", cfg.LLM.BaseURL).Str("model", model).Int("threads", len(threads)).Msg("Summarizing")
+	s := summarize.New(client, cfg.Summarize, model)
+	var total summarize.Result
+	failed := 0
+	for i, id := range threads {
+		if ctx.Err() != nil {
+			break
+		}
+		res, err := s.SummarizeThread(ctx, db, store, id, *force)
+		// Deleted summaries are gone from the table even if a later step failed
+		total.DeletedIDs = append(total.DeletedIDs, res.DeletedIDs...)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			failed++
+			log.Warn().Err(err).Int64("thread", id).Msg("Summarizing thread failed")
+			continue
+		}
+		total.Written += res.Written
+		total.Unchanged += res.Unchanged
+		total.Skipped += res.Skipped
+		total.Deleted += res.Deleted
+		log.Debug().Int64("thread", id).Int("written", res.Written).Int("unchanged", res.Unchanged).Msg("Thread done")
+		if (i+1)%50 == 0 {
+			log.Info().Int("threads", i+1).Int("written", total.Written).Msg("Progress")
+		}
+	}
+
+	log.Info().
+		Int("written", total.Written).
+		Int("unchanged", total.Unchanged).
+		Int("short_sessions", total.Skipped).
+		Int("deleted", total.Deleted).
+		Int("failed_threads", failed).
+		Dur("took", time.Since(start)).
+		Msg("Summaries done")
+	recordUsage(db, cfg, "llm", model, client.Usage(), start)
+
+	if cfg.Summarize.Collection == "" || *noIndex || ctx.Err() != nil {
+		return
+	}
+	if cfg.Vector.Backend == ragconfig.VectorBackendSQLite {
+		log.Warn().Msg("Summary indexing needs Milvus (vector.backend is sqlite), skipping")
+		return
+	}
+	if err := index(ctx, cfg, db, store, total.DeletedIDs); err != nil {
+		log.Fatal().Err(err).Msg("Indexing summaries failed")
+	}
+}
+
+// index embeds the summaries not yet in the summary collection and inserts
+// them, after deleting the ones removed by this run
+func index(ctx context.Context, cfg *ragconfig.Config, db *sql.DB, store *storage.Storage, deleted []string) error {
+	start := time.Now()
+	embCfg, err := vectordb.EmbeddingConfigFrom(cfg.Embedding)
+	if err != nil {
+		return err
+	}
+	embClient := vectordb.NewEmbeddingClient(embCfg)
+	if !embClient.IsAvailable(ctx) {
+		return vectordb.ErrUnavailable
+	}
+
+	idx, err := summarize.OpenIndex(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
+	if err := idx.Delete(ctx, deleted); err != nil {
+		return err
+	}
+
+	indexed := 0
+	for ctx.Err() == nil {
+		sums, err := store.GetUnsyncedSummaries(*batchSize)
+		if err != nil {
+			return err
+		}
+		if len(sums) == 0 {
+			break
+		}
+		texts := make([]string, len(sums))
+		ids := make([]string, len(sums))
+		for i, sum := range sums {
+			texts[i] = sum.Text
+			ids[i] = sum.SummaryID
+		}
+		embeddings, err := embClient.EmbedBatch(ctx, texts)
+		if err != nil {
+			return err
+		}
+		if err := idx.Upsert(ctx, sums, embeddings); err != nil {
+			return err
+		}
+		if err := store.MarkSummariesSynced(ids); err != nil {
+			return err
+		}
+		indexed += len(sums)
+	}
+	if err := idx.Flush(ctx); err != nil {
+		return err
+	}
+
+	log.Info().Str("collection", cfg.Summarize.Collection).Int("indexed", indexed).Msg("Summaries indexed")
+	u := embClient.Usage()
+	recordUsage(db, cfg, "embedding", embClient.Model(), llm.Usage{
+		PromptTokens: u.PromptTokens,
+		TotalTokens:  u.TotalTokens,
+		Requests:     u.Requests,
+	}, start)
+	return nil
+}
+
+// recordUsage stores the tokens a component used as one "summarize" run
+func recordUsage(db *sql.DB, cfg *ragconfig.Config, component, model string, u llm.Usage, start time.Time) {
+	if u.Requests == 0 {
+		return
+	}
+	err := storage.RecordUsage(db, storage.UsageRun{
+		Kind:             "summarize",
+		Component:        component,
+		Model:            model,
+		Requests:         u.Requests,
+		PromptTokens:     u.PromptTokens,
+		CompletionTokens: u.CompletionTokens,
+		TotalTokens:      u.TotalTokens,
+		CostUSD:          cfg.EstimateCost(model, u.PromptTokens, u.CompletionTokens),
+		StartedAt:        start.UnixMilli(),
+		FinishedAt:       time.Now().UnixMilli(),
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("component", component).Msg("Failed to record usage")
+	}
+}
@@ -0,0 +1,200 @@
+// voice-transcribe turns voice messages into searchable text.
+//
+// It sends downloaded audio attachments (see media-sync, and messenger-cli
+// -media-dir for E2EE ones) to the Whisper-compatible endpoint configured in
+// the transcription section of rag.yaml and stores the results in
+// attachment_transcripts. Chunking appends each transcript to its message
+// after a "[Voice message]" marker, and the message is marked unindexed so
+// rag-indexerd (or the next rag-pipeline run) re-chunks its thread.
+//
+// Failed transcriptions are recorded and skipped until --retry-failed is
+// given.
+//
+// Usage:
+//
+//	voice-transcribe --db messenger.db
+//	voice-transcribe --db messenger.db --interval 10m  # keep running
+//	voice-transcribe --db messenger.db --retry-failed
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/media"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+var (
+	dbPath      = flag.String("db", "", "Path to SQLite database (defaults to database.sqlite from config)")
+	dbKeyFile   = storage.KeyFileFlag()
+	cfgPath     = flag.String("config", "", "Path to rag.yaml (auto-detected if not specified)")
+	inputDir    = flag.String("dir", "", "Attachment store directory (defaults to media.attachments_dir from config)")
+	limit       = flag.Int("limit", 100, "Maximum attachments transcribed per pass")
+	interval    = flag.Duration("interval", 0, "Run a pass every interval instead of once")
+	retryFailed = flag.Bool("retry-failed", false, "Retry attachments whose last transcription failed")
+	debug       = flag.Bool("debug", false, "Enable debug logging")
+)
+
+// transcriber is the state shared by all passes
+type transcriber struct {
+	store    *storage.Storage
+	client   *media.Transcriber
+	dir      string
+	maxBytes int64
+}
+
+func main() {
+	flag.Parse()
+
+	// Setup logging
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	// Load configuration
+	cfg, err := ragconfig.LoadFromFlagOrDir(*cfgPath, ".")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+	if !cfg.Transcribe.Enabled {
+		log.Fatal().Msg("Transcription is disabled (set transcription.enabled in rag.yaml)")
+	}
+
+	sqlitePath := *dbPath
+	if sqlitePath == "" {
+		sqlitePath = cfg.Database.SQLite
+	}
+	if sqlitePath == "" {
+		log.Fatal().Msg("SQLite database path is empty (set -db or database.sqlite in rag.yaml)")
+	}
+	if err := storage.LoadKey(*dbKeyFile); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the database key")
+	}
+	dir := *inputDir
+	if dir == "" {
+		dir = cfg.Media.AttachmentsDir
+	}
+	if dir == "" {
+		log.Fatal().Msg("Attachment directory is empty (set -dir or media.attachments_dir in rag.yaml)")
+	}
+
+	store, err := storage.New(sqlitePath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open database")
+	}
+	defer store.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	t := &transcriber{
+		store:    store,
+		client:   media.NewTranscriber(cfg.Transcribe),
+		dir:      dir,
+		maxBytes: int64(cfg.Transcribe.MaxFileMB) << 20,
+	}
+	log.Info().Str("endpoint", cfg.Transcribe.BaseURL).Str("model", cfg.Transcribe.Model).Msg("Transcribing voice messages")
+
+	for {
+		t.pass(ctx)
+		if *interval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("Shutting down")
+			return
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// pass transcribes one batch of pending audio attachments and logs the outcome
+func (t *transcriber) pass(ctx context.Context) {
+	start := time.Now()
+	pending, err := t.store.GetPendingTranscriptions(*limit, *retryFailed)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list pending transcriptions")
+		return
+	}
+
+	transcribed, failed := 0, 0
+	for _, p := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := t.transcribe(ctx, p); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			failed++
+			log.Warn().Err(err).Str("attachment", p.AttachmentID).Msg("Transcription failed")
+			if recErr := t.store.SetTranscriptError(p.AttachmentID, p.MessageID, err.Error()); recErr != nil {
+				log.Warn().Err(recErr).Str("attachment", p.AttachmentID).Msg("Failed to record transcription error")
+			}
+			continue
+		}
+		transcribed++
+	}
+
+	ready, notDownloaded, err := t.store.CountPendingTranscriptions()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to count pending transcriptions")
+	}
+	log.Info().
+		Int("transcribed", transcribed).
+		Int("failed", failed).
+		Int64("remaining", ready).
+		Dur("took", time.Since(start)).
+		Msg("Pass done")
+	if notDownloaded > 0 {
+		log.Info().Int64("count", notDownloaded).Msg("Voice messages not downloaded yet (run media-sync)")
+	}
+}
+
+// transcribe sends one attachment's file to the transcription endpoint and
+// stores the transcript
+func (t *transcriber) transcribe(ctx context.Context, p storage.PendingTranscription) error {
+	path, ok := media.Resolve(t.dir, p.LocalPath)
+	if !ok {
+		return fmt.Errorf("downloaded file %q is missing from %s", p.LocalPath, t.dir)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if t.maxBytes > 0 && info.Size() > t.maxBytes {
+		return fmt.Errorf("file is %d MB, above transcription.max_file_mb", info.Size()>>20)
+	}
+
+	// Servers detect the format from the extension, which the content-addressed
+	// name keeps; the original filename is often missing for voice messages
+	name := p.Filename
+	if filepath.Ext(name) == "" {
+		name = filepath.Base(p.LocalPath)
+	}
+	tr, err := t.client.Transcribe(ctx, name, f)
+	if err != nil {
+		return err
+	}
+	log.Debug().Str("attachment", p.AttachmentID).Int("chars", len(tr.Text)).Msg("Transcribed")
+	return t.store.SaveTranscript(p.AttachmentID, p.MessageID, tr.Text, tr.Language, t.client.Model())
+}
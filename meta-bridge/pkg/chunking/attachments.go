@@ -0,0 +1,77 @@
+package chunking
+
+import (
+	"strconv"
+	"strings"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+)
+
+// attachmentPlaceholders maps each attachment kind accepted in
+// chunking.attachments.placeholders (the same kinds share-bundle shows) to
+// the attachments it selects and the placeholder written for each of them
+var attachmentPlaceholders = map[string]struct{ where, text string }{
+	"photo": {
+		where: typeIn(table.AttachmentTypeImage, table.AttachmentTypeEphemeralImage) + ` AND COALESCE(a.mime_type, '') != 'image/gif'`,
+		text:  namedPlaceholder("photo"),
+	},
+	"gif": {
+		where: `(` + typeIn(table.AttachmentTypeAnimatedImage) + ` OR (a.mime_type = 'image/gif' AND ` +
+			typeIn(table.AttachmentTypeImage, table.AttachmentTypeEphemeralImage) + `))`,
+		text: `'[GIF]'`,
+	},
+	"sticker": {
+		where: typeIn(table.AttachmentTypeSticker, table.AttachmentTypeSelfieSticker, table.AttachmentTypeThirdPartySticker),
+		text:  `'[sticker]'`,
+	},
+	"video": {
+		where: typeIn(table.AttachmentTypeVideo, table.AttachmentTypeEphemeralVideo),
+		text:  namedPlaceholder("video"),
+	},
+	"audio": {
+		where: typeIn(table.AttachmentTypeAudio, table.AttachmentTypeSoundBite),
+		text:  namedPlaceholder("audio"),
+	},
+	"file": {
+		where: typeIn(table.AttachmentTypeFile),
+		text:  namedPlaceholder("file"),
+	},
+	"link": {
+		// Live sync stores the preview image's CDN URL, which says nothing
+		// about the link; imports store the shared URL itself
+		where: typeIn(table.AttachmentTypeXMA),
+		text: `'[shared link' || CASE
+			WHEN a.url LIKE 'http%' AND a.url NOT LIKE '%fbcdn.net/%' AND a.url NOT LIKE '%cdninstagram.com/%'
+			THEN ': ' || a.url ELSE '' END || ']'`,
+	},
+}
+
+// placeholderSQL returns a query for the (message_id, text) placeholder rows
+// of the given attachment kinds, or "" if none of them is known
+func placeholderSQL(kinds []string) string {
+	var parts []string
+	seen := make(map[string]bool)
+	for _, kind := range kinds {
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		p, ok := attachmentPlaceholders[kind]
+		if !ok || seen[kind] {
+			continue
+		}
+		seen[kind] = true
+		parts = append(parts, `SELECT a.message_id, `+p.text+` AS text FROM attachments a WHERE `+p.where)
+	}
+	return strings.Join(parts, " UNION ALL ")
+}
+
+// namedPlaceholder is "[kind: filename]", or "[kind]" without a filename
+func namedPlaceholder(kind string) string {
+	return `'[` + kind + `' || COALESCE(': ' || NULLIF(a.filename, ''), '') || ']'`
+}
+
+func typeIn(types ...table.AttachmentType) string {
+	ids := make([]string, len(types))
+	for i, t := range types {
+		ids[i] = strconv.Itoa(int(t))
+	}
+	return `a.attachment_type IN (` + strings.Join(ids, ", ") + `)`
+}
@@ -167,6 +167,29 @@ func CreateGreedyChunks(
 	return chunks
 }
 
+// CreateMessageChunks makes one chunk per message, without coalescing or
+// session splitting. Used for the "note to self" thread, where each message
+// is a standalone note. All chunks belong to session 0.
+func CreateMessageChunks(messages []Message, threadID int64, threadName string, cfg *ragconfig.Config) []Chunk {
+	chunks := make([]Chunk, 0, len(messages))
+	for i, msg := range messages {
+		single := CoalescedMessage{
+			MessageIDs:       []string{msg.ID},
+			ThreadID:         msg.ThreadID,
+			SenderID:         msg.SenderID,
+			SenderName:       msg.SenderName,
+			Text:             msg.Text,
+			StartTimestampMs: msg.TimestampMs,
+			EndTimestampMs:   msg.TimestampMs,
+			Replies:          replyOf(msg),
+			Sources:          addSource(nil, msg.Source),
+		}
+		text := FormatSingleMessage(&single, cfg.Chunking.Format.SenderPrefix)
+		chunks = append(chunks, FinalizeChunk([]CoalescedMessage{single}, text, threadID, threadName, 0, i, cfg))
+	}
+	return chunks
+}
+
 // FinalizeChunk creates a Chunk object from accumulated messages.
 func FinalizeChunk(
 	messages []CoalescedMessage,
@@ -176,10 +199,16 @@ func FinalizeChunk(
 	sessionIdx, chunkIdx int,
 	cfg *ragconfig.Config,
 ) Chunk {
-	// Collect all message IDs
+	// Collect all message IDs, reply links and sources
 	var allIDs []string
+	var replies []MessageReply
+	var sources []string
 	for _, msg := range messages {
 		allIDs = append(allIDs, msg.MessageIDs...)
+		replies = append(replies, msg.Replies...)
+		for _, source := range msg.Sources {
+			sources = addSource(sources, source)
+		}
 	}
 
 	// Collect unique participants (preserve order)
@@ -212,6 +241,8 @@ func FinalizeChunk(
 		StartTimestampMs: messages[0].StartTimestampMs,
 		EndTimestampMs:   messages[len(messages)-1].EndTimestampMs,
 		MessageCount:     len(messages),
+		Replies:          replies,
+		Sources:          sources,
 	}
 
 	// Compute indexability
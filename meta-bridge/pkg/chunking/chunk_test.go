@@ -1,6 +1,12 @@
 package chunking
 
-import "testing"
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
 
 func TestHasTopicMarker(t *testing.T) {
 	tests := []struct {
@@ -24,3 +30,72 @@ func TestHasTopicMarker(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessThread_SelfThreadOneMessagePerChunk(t *testing.T) {
+	cfg := ragconfig.Default()
+	thread := ThreadData{
+		ThreadID:   42,
+		ThreadName: "Me",
+		Messages: []Message{
+			{ID: "m1", ThreadID: 42, SenderID: 42, SenderName: "Me", Text: "buy milk", TimestampMs: 1000},
+			{ID: "m2", ThreadID: 42, SenderID: 42, SenderName: "Me", Text: "https://example.com/recipe", TimestampMs: 2000},
+			{ID: "m3", ThreadID: 42, SenderID: 42, SenderName: "Me", Text: "call the landlord", TimestampMs: 3000},
+		},
+	}
+
+	if got := ProcessThread(thread, cfg); len(got) != 1 {
+		t.Fatalf("regular thread: expected messages coalesced into 1 chunk, got %d", len(got))
+	}
+
+	thread.IsSelf = true
+	chunks := ProcessThread(thread, cfg)
+	if len(chunks) != 3 {
+		t.Fatalf("self thread: expected 3 chunks, got %d", len(chunks))
+	}
+	for i, c := range chunks {
+		if c.SessionIdx != 0 || c.ChunkIdx != i || len(c.MessageIDs) != 1 || c.MessageCount != 1 {
+			t.Fatalf("chunk %d: unexpected layout %+v", i, c)
+		}
+	}
+	if chunks[2].Text != "[Me]: call the landlord" {
+		t.Fatalf("unexpected chunk text %q", chunks[2].Text)
+	}
+
+	cfg.Chunking.SelfThread.Profile = ragconfig.SelfThreadProfileConversation
+	if got := ProcessThread(thread, cfg); len(got) != 1 {
+		t.Fatalf("conversation profile: expected 1 chunk, got %d", len(got))
+	}
+}
+
+func TestProcessThread_IncludeDate(t *testing.T) {
+	cfg := ragconfig.Default()
+	cfg.Chunking.Format.IncludeDate = true
+	thread := ThreadData{
+		ThreadID: 7,
+		Header:   "Group: Trip",
+		Messages: []Message{
+			{ID: "m1", ThreadID: 7, SenderID: 1, SenderName: "Anna", Text: "who packs the tent?", TimestampMs: 1498860000000}, // 2017-06-30 22:00 UTC
+			{ID: "m2", ThreadID: 7, SenderID: 2, SenderName: "Bob", Text: "me", TimestampMs: 1498860600000},                   // 2017-06-30 22:10 UTC
+		},
+	}
+
+	chunks := ProcessThread(thread, cfg)
+	if len(chunks) != 1 || !strings.HasPrefix(chunks[0].Text, "June 2017\nGroup: Trip\n[Anna]: ") {
+		t.Fatalf("unexpected chunks %+v", chunks)
+	}
+
+	for _, tt := range []struct {
+		start, end string
+		want       string
+	}{
+		{"2017-06-01", "2017-06-30", "June 2017"},
+		{"2017-06-30", "2017-07-01", "June – July 2017"},
+		{"2016-12-31", "2017-01-01", "December 2016 – January 2017"},
+	} {
+		start, _ := time.Parse(time.DateOnly, tt.start)
+		end, _ := time.Parse(time.DateOnly, tt.end)
+		if got := DateRange(start.UnixMilli(), end.UnixMilli()); got != tt.want {
+			t.Errorf("DateRange(%s, %s) = %q, want %q", tt.start, tt.end, got, tt.want)
+		}
+	}
+}
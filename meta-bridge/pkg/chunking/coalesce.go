@@ -1,6 +1,7 @@
 package chunking
 
 import (
+	"slices"
 	"unicode/utf8"
 
 	"go.mau.fi/mautrix-meta/pkg/ragconfig"
@@ -31,6 +32,8 @@ func CoalesceMessages(messages []Message, cfg *ragconfig.Config) []CoalescedMess
 				Text:             msg.Text,
 				StartTimestampMs: msg.TimestampMs,
 				EndTimestampMs:   msg.TimestampMs,
+				Replies:          replyOf(msg),
+				Sources:          addSource(nil, msg.Source),
 			}
 		} else if msg.SenderID == current.SenderID &&
 			msg.TimestampMs-current.EndTimestampMs <= gapMs &&
@@ -39,6 +42,8 @@ func CoalesceMessages(messages []Message, cfg *ragconfig.Config) []CoalescedMess
 			current.MessageIDs = append(current.MessageIDs, msg.ID)
 			current.Text = current.Text + "\n" + msg.Text
 			current.EndTimestampMs = msg.TimestampMs
+			current.Replies = append(current.Replies, replyOf(msg)...)
+			current.Sources = addSource(current.Sources, msg.Source)
 		} else {
 			// Save current and start new
 			coalesced = append(coalesced, *current)
@@ -50,6 +55,8 @@ func CoalesceMessages(messages []Message, cfg *ragconfig.Config) []CoalescedMess
 				Text:             msg.Text,
 				StartTimestampMs: msg.TimestampMs,
 				EndTimestampMs:   msg.TimestampMs,
+				Replies:          replyOf(msg),
+				Sources:          addSource(nil, msg.Source),
 			}
 		}
 	}
@@ -60,3 +67,23 @@ func CoalesceMessages(messages []Message, cfg *ragconfig.Config) []CoalescedMess
 
 	return coalesced
 }
+
+// replyOf returns msg's reply link, or nil if it isn't a reply
+func replyOf(msg Message) []MessageReply {
+	if msg.ReplyToID == "" {
+		return nil
+	}
+	return []MessageReply{{MessageID: msg.ID, ReplyToMessageID: msg.ReplyToID}}
+}
+
+// addSource adds source to the sorted set sources, unless it is empty
+func addSource(sources []string, source string) []string {
+	if source == "" {
+		return sources
+	}
+	i, found := slices.BinarySearch(sources, source)
+	if found {
+		return sources
+	}
+	return slices.Insert(sources, i, source)
+}
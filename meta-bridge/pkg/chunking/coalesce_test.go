@@ -1,6 +1,7 @@
 package chunking
 
 import (
+	"slices"
 	"testing"
 
 	"go.mau.fi/mautrix-meta/pkg/ragconfig"
@@ -36,3 +37,29 @@ func TestCoalesceMessagesUsesRuneCount(t *testing.T) {
 		t.Fatalf("unexpected coalesced text: %q", got)
 	}
 }
+
+func TestCoalesceMessages_CollectsSources(t *testing.T) {
+	cfg := ragconfig.Default()
+	messages := []Message{
+		{ID: "1", ThreadID: 1, SenderID: 1, Text: "are we going?", TimestampMs: 1_000, Source: "live"},
+		{ID: "2", ThreadID: 1, SenderID: 1, Text: "tell me soon", TimestampMs: 2_000, Source: "facebook-export"},
+		{ID: "3", ThreadID: 1, SenderID: 2, Text: "yes", TimestampMs: 3_000, Source: "live"},
+		{ID: "4", ThreadID: 1, SenderID: 1, Text: "great", TimestampMs: 4_000},
+	}
+
+	coalesced := CoalesceMessages(messages, cfg)
+	if len(coalesced) != 3 {
+		t.Fatalf("expected 3 coalesced messages, got %d", len(coalesced))
+	}
+	if got := coalesced[0].Sources; !slices.Equal(got, []string{"facebook-export", "live"}) {
+		t.Errorf("first message sources = %v", got)
+	}
+	if got := coalesced[2].Sources; len(got) != 0 {
+		t.Errorf("message without a source got %v", got)
+	}
+
+	chunk := FinalizeChunk(coalesced, "text", 1, "", 0, 0, cfg)
+	if !slices.Equal(chunk.Sources, []string{"facebook-export", "live"}) {
+		t.Errorf("chunk sources = %v", chunk.Sources)
+	}
+}
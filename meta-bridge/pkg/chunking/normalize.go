@@ -0,0 +1,182 @@
+package chunking
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+const zeroWidthJoiner = '\u200d'
+
+// NormalizeText applies the configured normalization steps to message or query text.
+// The same function must be used at index time and query time so both sides match.
+func NormalizeText(text string, cfg ragconfig.NormalizeConfig) string {
+	if !cfg.Enabled || text == "" {
+		return text
+	}
+
+	if cfg.StripZeroWidth {
+		text = stripZeroWidth(text)
+	}
+	if cfg.UnicodeNFC {
+		text = norm.NFC.String(text)
+	}
+	if cfg.MaxLetterRepeat > 0 || cfg.MaxEmojiRepeat > 0 {
+		text = collapseRepeats(text, cfg.MaxLetterRepeat, cfg.MaxEmojiRepeat)
+	}
+
+	return text
+}
+
+// NormalizeMessages returns a copy of messages with normalized text.
+// Messages left empty after normalization are dropped.
+func NormalizeMessages(messages []Message, cfg ragconfig.NormalizeConfig) []Message {
+	if !cfg.Enabled {
+		return messages
+	}
+
+	out := make([]Message, 0, len(messages))
+	for _, msg := range messages {
+		msg.Text = NormalizeText(msg.Text, cfg)
+		if strings.TrimSpace(msg.Text) == "" {
+			continue
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+func isZeroWidth(r rune) bool {
+	switch r {
+	case '\u200b', '\u200c', '\u2060', '\ufeff', '\u00ad', '\u180e': // ZWSP, ZWNJ, WJ, BOM, soft hyphen, MVS
+		return true
+	}
+	return false
+}
+
+// isEmojiRune is a rough check for pictographic runes (enough for repeat detection)
+func isEmojiRune(r rune) bool {
+	return (r >= 0x1F000 && r <= 0x1FAFF) ||
+		(r >= 0x2600 && r <= 0x27BF) ||
+		unicode.Is(unicode.So, r)
+}
+
+// isExtender reports runes that attach to the preceding rune
+// (combining marks, variation selectors, skin tone modifiers)
+func isExtender(r rune) bool {
+	return unicode.IsMark(r) ||
+		(r >= 0xFE00 && r <= 0xFE0F) ||
+		(r >= 0x1F3FB && r <= 0x1F3FF)
+}
+
+// stripZeroWidth removes invisible characters. Zero-width joiners are kept
+// inside emoji sequences (e.g. family emoji) where they carry meaning.
+func stripZeroWidth(text string) string {
+	runes := []rune(text)
+	var sb strings.Builder
+	sb.Grow(len(text))
+
+	var prev rune
+	for i, r := range runes {
+		if isZeroWidth(r) {
+			continue
+		}
+		if r == zeroWidthJoiner {
+			next := rune(0)
+			if i+1 < len(runes) {
+				next = runes[i+1]
+			}
+			if !(isEmojiRune(prev) || isExtender(prev)) || !isEmojiRune(next) {
+				continue
+			}
+		}
+		sb.WriteRune(r)
+		prev = r
+	}
+	return sb.String()
+}
+
+// minLetterRun is the shortest run of one letter that gets collapsed. Shorter
+// runs are ordinary spelling ("www", "AAA", "zzz").
+const minLetterRun = 4
+
+// collapseRepeats limits runs of the same character (or emoji sequence).
+// Letters are only collapsed in runs of minLetterRun or more inside a word
+// ("heeeelp", "noooo"), so acronyms and runs that make up a whole token are
+// kept. URLs, digits, punctuation and whitespace are left untouched.
+func collapseRepeats(text string, maxLetter, maxEmoji int) string {
+	var sb strings.Builder
+	sb.Grow(len(text))
+
+	last := 0
+	for _, loc := range urlPattern.FindAllStringIndex(text, -1) {
+		sb.WriteString(collapseSegment(text[last:loc[0]], maxLetter, maxEmoji))
+		sb.WriteString(text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	sb.WriteString(collapseSegment(text[last:], maxLetter, maxEmoji))
+	return sb.String()
+}
+
+// repeatRun is a run of identical clusters
+type repeatRun struct {
+	cluster string
+	base    rune
+	count   int
+}
+
+func collapseSegment(text string, maxLetter, maxEmoji int) string {
+	if text == "" {
+		return text
+	}
+
+	runes := []rune(text)
+	var runs []repeatRun
+	for i := 0; i < len(runes); {
+		// A cluster is a base rune plus extenders and ZWJ-joined runes
+		j := i + 1
+		for j < len(runes) {
+			if isExtender(runes[j]) {
+				j++
+			} else if runes[j] == zeroWidthJoiner && j+1 < len(runes) {
+				j += 2
+			} else {
+				break
+			}
+		}
+		cluster := string(runes[i:j])
+		if n := len(runs); n > 0 && runs[n-1].cluster == cluster {
+			runs[n-1].count++
+		} else {
+			runs = append(runs, repeatRun{cluster: cluster, base: runes[i], count: 1})
+		}
+		i = j
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(text))
+	for i, r := range runs {
+		limit := 0
+		switch {
+		case isEmojiRune(r.base):
+			limit = maxEmoji
+		case unicode.IsLetter(r.base) && r.count >= minLetterRun && inWord(runs, i):
+			limit = maxLetter
+		}
+		count := r.count
+		if limit > 0 && count > limit {
+			count = limit
+		}
+		sb.WriteString(strings.Repeat(r.cluster, count))
+	}
+	return sb.String()
+}
+
+// inWord reports whether the run at i borders another letter
+func inWord(runs []repeatRun, i int) bool {
+	return (i > 0 && unicode.IsLetter(runs[i-1].base)) ||
+		(i+1 < len(runs) && unicode.IsLetter(runs[i+1].base))
+}
@@ -0,0 +1,39 @@
+package chunking
+
+import (
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestNormalizeText(t *testing.T) {
+	cfg := ragconfig.Default().Normalize
+
+	cases := []struct {
+		in, want string
+	}{
+		{"he\u200bllo", "hello"},
+		{"cafe\u0301", "caf\u00e9"},
+		{"heeeelp!!!!", "heelp!!!!"},
+		{"noooo way", "noo way"},
+		{"AAA battery, AAAA cells", "AAA battery, AAAA cells"},
+		{"zzz... ok!!!", "zzz... ok!!!"},
+		{"www.example.com", "www.example.com"},
+		{"hmmm", "hmmm"},
+		{"😂😂😂 serio", "😂 serio"},
+		{"❤️❤️❤️", "❤️"},
+		{"zapłać 1000 zł", "zapłać 1000 zł"},
+		{"patrz https://www.example.com/aaaa", "patrz https://www.example.com/aaaa"},
+		{"\U0001F468\u200d\U0001F469\u200d\U0001F467", "\U0001F468\u200d\U0001F469\u200d\U0001F467"},
+	}
+	for _, tc := range cases {
+		if got := NormalizeText(tc.in, cfg); got != tc.want {
+			t.Errorf("NormalizeText(%q)=%q, want %q", tc.in, got, tc.want)
+		}
+	}
+
+	cfg.Enabled = false
+	if got := NormalizeText("heeeelp", cfg); got != "heeeelp" {
+		t.Errorf("disabled normalization changed text: %q", got)
+	}
+}
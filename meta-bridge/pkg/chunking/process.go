@@ -4,43 +4,140 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
 	"go.mau.fi/mautrix-meta/pkg/ragconfig"
 )
 
+// Markers introducing text extracted from attachments in chunk text
+const (
+	VoiceMessagePrefix = "[Voice message] "
+	ImagePrefix        = "[Image] "
+)
+
+// reactionSummarySQL is the "[Name reacted ❤️]" lines for message m, oldest
+// reaction first
+const reactionSummarySQL = `COALESCE((SELECT group_concat(line, char(10)) FROM (
+			SELECT '[' || COALESCE(NULLIF(rc.name, ''), 'Someone') || ' reacted ' || r.reaction || ']' AS line
+			FROM reactions r
+			LEFT JOIN contacts rc ON rc.id = r.actor_id
+			WHERE r.message_id = m.id
+			ORDER BY r.timestamp_ms, r.actor_id)), '')`
+
+// attachmentTextSources are the tables holding text extracted from
+// attachments, with the marker that introduces it
+var attachmentTextSources = []struct{ table, prefix string }{
+	{"attachment_transcripts", VoiceMessagePrefix},
+	{"attachment_captions", ImagePrefix},
+}
+
 // ThreadData contains a thread's messages and metadata.
 type ThreadData struct {
 	ThreadID   int64
 	ThreadName string
+	IsSelf     bool // The user's own "note to self" thread
 	Messages   []Message
+
+	// Header is the line every chunk of the thread starts with (see
+	// GroupHeader), or "" for none
+	Header string
 }
 
 // ProcessThread processes a single thread into chunks.
 func ProcessThread(thread ThreadData, cfg *ragconfig.Config) []Chunk {
-	// Step 1: Coalesce messages
-	coalesced := CoalesceMessages(thread.Messages, cfg)
-
-	// Step 2: Split into sessions
-	sessions := SplitIntoSessions(coalesced, cfg)
+	// Step 0: Normalize text (same pipeline as query-time normalization)
+	messages := NormalizeMessages(thread.Messages, cfg.Normalize)
 
-	// Step 3: Create greedy chunks
 	var allChunks []Chunk
-	for sessionIdx, session := range sessions {
-		chunks := CreateGreedyChunks(session, thread.ThreadID, thread.ThreadName, sessionIdx, cfg)
-		allChunks = append(allChunks, chunks...)
+	if thread.IsSelf && cfg.Chunking.SelfThread.Profile != ragconfig.SelfThreadProfileConversation {
+		allChunks = CreateMessageChunks(messages, thread.ThreadID, thread.ThreadName, cfg)
+	} else {
+		// Step 1: Coalesce messages
+		coalesced := CoalesceMessages(messages, cfg)
+
+		// Step 2: Split into sessions
+		sessions := SplitIntoSessions(coalesced, cfg)
+
+		// Step 3: Create greedy chunks
+		for sessionIdx, session := range sessions {
+			chunks := CreateGreedyChunks(session, thread.ThreadID, thread.ThreadName, sessionIdx, cfg)
+			allChunks = append(allChunks, chunks...)
+		}
+	}
+
+	// Step 4: Add the header lines: date range, then the thread's header.
+	// Sizes and indexability stay those of the conversation itself, so a
+	// header can't make a chunk worth indexing.
+	for i := range allChunks {
+		c := &allChunks[i]
+		if thread.Header != "" {
+			c.Text = thread.Header + "\n" + c.Text
+		}
+		if cfg.Chunking.Format.IncludeDate {
+			c.Text = DateRange(c.StartTimestampMs, c.EndTimestampMs) + "\n" + c.Text
+		}
 	}
 
 	return allChunks
 }
 
+// DateRange is the months a chunk spans (UTC), for its first line with
+// chunking.format.include_date: "June 2017", "June – July 2017" or
+// "December 2016 – January 2017"
+func DateRange(startMs, endMs int64) string {
+	start, end := time.UnixMilli(startMs).UTC(), time.UnixMilli(endMs).UTC()
+	switch {
+	case (end.Year() == start.Year() && end.Month() == start.Month()) || end.Before(start):
+		return start.Format("January 2006")
+	case end.Year() == start.Year():
+		return start.Format("January") + " – " + end.Format("January 2006")
+	default:
+		return start.Format("January 2006") + " – " + end.Format("January 2006")
+	}
+}
+
+// groupHeaderMaxNames is how many participants GroupHeader lists by name
+const groupHeaderMaxNames = 10
+
+// GroupHeader is the header line of a group chat's chunks: "Group: Trip
+// 2019 — participants: Anna, Bob, Cem", the most active participants first.
+// Past groupHeaderMaxNames the rest are counted ("… and 4 more").
+func GroupHeader(name string, participants []string) string {
+	header := "Group"
+	if name != "" {
+		header += ": " + name
+	}
+	if len(participants) == 0 {
+		return header
+	}
+	names := strings.Join(participants[:min(len(participants), groupHeaderMaxNames)], ", ")
+	if more := len(participants) - groupHeaderMaxNames; more > 0 {
+		names += fmt.Sprintf(" and %d more", more)
+	}
+	return header + " — participants: " + names
+}
+
 // FetchThreads fetches all threads with messages from the database.
-func FetchThreads(ctx context.Context, db *sql.DB) ([]ThreadData, error) {
-	// Get all thread IDs with messages
-	rows, err := db.QueryContext(ctx, `
+func FetchThreads(ctx context.Context, db *sql.DB, cfg *ragconfig.Config) ([]ThreadData, error) {
+	attachmentText, err := AttachmentTextSQL(ctx, db, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get all thread IDs with messages (or text extracted from attachments)
+	query := `
 		SELECT DISTINCT thread_id FROM messages
-		WHERE text IS NOT NULL AND text != ''
-		ORDER BY thread_id
-	`)
+		WHERE text IS NOT NULL AND text != ''`
+	if attachmentText != "" {
+		query += `
+		UNION
+		SELECT DISTINCT m.thread_id FROM (` + attachmentText + `) x
+		JOIN messages m ON m.id = x.message_id`
+	}
+	rows, err := db.QueryContext(ctx, query+` ORDER BY thread_id`)
 	if err != nil {
 		return nil, fmt.Errorf("querying thread IDs: %w", err)
 	}
@@ -60,13 +157,38 @@ func FetchThreads(ctx context.Context, db *sql.DB) ([]ThreadData, error) {
 		return nil, fmt.Errorf("iterating thread IDs: %w", err)
 	}
 
+	return FetchThreadsByID(ctx, db, cfg, threadIDs)
+}
+
+// FetchThreadsByID fetches the given threads. Threads without text messages
+// are left out. Voice message transcripts and image text are appended to
+// their message's text after VoiceMessagePrefix and ImagePrefix, as are the
+// attachment placeholders enabled in chunking.attachments and, with
+// chunking.format.reactions, reaction summaries. With chunking.format.replies,
+// replies start with a snippet of the message they answer, and with
+// chunking.format.group_header group chats get a Header.
+func FetchThreadsByID(ctx context.Context, db *sql.DB, cfg *ragconfig.Config, threadIDs []int64) ([]ThreadData, error) {
+	selfThreadID, err := fetchCurrentUserID(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	attachmentText, err := AttachmentTextSQL(ctx, db, cfg)
+	if err != nil {
+		return nil, err
+	}
+	source, err := messageSourceSQL(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
 	// Fetch each thread's data
 	var threads []ThreadData
 	for _, threadID := range threadIDs {
-		thread, err := fetchThread(ctx, db, threadID)
+		thread, err := fetchThread(ctx, db, threadID, attachmentText, source, cfg.Chunking.Format)
 		if err != nil {
 			return nil, err
 		}
+		thread.IsSelf = selfThreadID != 0 && threadID == selfThreadID
 		if len(thread.Messages) > 0 {
 			threads = append(threads, thread)
 		}
@@ -75,29 +197,115 @@ func FetchThreads(ctx context.Context, db *sql.DB) ([]ThreadData, error) {
 	return threads, nil
 }
 
-func fetchThread(ctx context.Context, db *sql.DB, threadID int64) (ThreadData, error) {
+// fetchCurrentUserID returns the archive owner's ID (0 if unknown), which is
+// also the ID of their "note to self" thread
+func fetchCurrentUserID(ctx context.Context, db *sql.DB) (int64, error) {
+	var value string
+	err := db.QueryRowContext(ctx, "SELECT value FROM sync_metadata WHERE key = 'current_user_id'").Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("fetching current user ID: %w", err)
+	}
+	id, _ := strconv.ParseInt(value, 10, 64)
+	return id, nil
+}
+
+// AttachmentTextSQL returns a query for the (message_id, text) rows of text
+// extracted from attachments, each text already behind its marker, plus the
+// placeholders enabled in cfg. It returns "" if there is nothing to add:
+// read-only consumers may open databases created before the tables existed.
+func AttachmentTextSQL(ctx context.Context, db *sql.DB, cfg *ragconfig.Config) (string, error) {
+	var parts []string
+	if placeholders := placeholderSQL(cfg.Chunking.Attachments.Placeholders); placeholders != "" {
+		parts = append(parts, placeholders)
+	}
+	for _, src := range attachmentTextSources {
+		var n int
+		err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, src.table).Scan(&n)
+		if err != nil {
+			return "", fmt.Errorf("checking for %s: %w", src.table, err)
+		}
+		if n > 0 {
+			parts = append(parts, `SELECT message_id, '`+src.prefix+`' || text AS text FROM `+src.table+` WHERE text != ''`)
+		}
+	}
+	return strings.Join(parts, " UNION ALL "), nil
+}
+
+// messageSourceSQL returns the expression for a message's provenance:
+// messages.source, or for databases created before it was recorded, the
+// "export" or "live" its ID format tells
+func messageSourceSQL(ctx context.Context, db *sql.DB) (string, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name = 'source'`).Scan(&n)
+	if err != nil {
+		return "", fmt.Errorf("checking for messages.source: %w", err)
+	}
+	if n > 0 {
+		return `m.source`, nil
+	}
+	return `CASE WHEN length(m.id) = 32 AND m.id NOT GLOB '*[^0-9a-f]*' THEN 'export' ELSE 'live' END`, nil
+}
+
+// fetchThread loads a thread's messages, with source as the expression for
+// their provenance (see messageSourceSQL). Reactions and reply snippets only
+// annotate messages that are chunked anyway; they don't make a message
+// chunkable on their own.
+func fetchThread(ctx context.Context, db *sql.DB, threadID int64, attachmentText, source string, format ragconfig.ChunkFormatConfig) (ThreadData, error) {
 	thread := ThreadData{ThreadID: threadID}
 
-	// Fetch thread name
-	row := db.QueryRowContext(ctx, "SELECT name FROM threads WHERE id = ?", threadID)
+	// Fetch thread name, derived for unnamed 1:1 threads. Databases not
+	// migrated yet lack the thread_names view and get the stored name.
 	var threadName sql.NullString
-	if err := row.Scan(&threadName); err != nil && err != sql.ErrNoRows {
+	err := db.QueryRowContext(ctx, "SELECT name FROM thread_names WHERE thread_id = ?", threadID).Scan(&threadName)
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		err = db.QueryRowContext(ctx, "SELECT name FROM threads WHERE id = ?", threadID).Scan(&threadName)
+	}
+	if err != nil && err != sql.ErrNoRows {
 		return thread, fmt.Errorf("fetching thread name: %w", err)
 	}
 	thread.ThreadName = threadName.String
 
+	if format.GroupHeader {
+		header, err := fetchGroupHeader(ctx, db, threadID, thread.ThreadName)
+		if err != nil {
+			return thread, err
+		}
+		thread.Header = header
+	}
+
 	// Fetch messages
+	extraSQL, filter := `''`, `m.text IS NOT NULL AND m.text != ''`
+	if attachmentText != "" {
+		extraSQL = `COALESCE((SELECT group_concat(x.text, char(10)) FROM (` + attachmentText + `) x
+			WHERE x.message_id = m.id), '')`
+		filter = `(` + filter + ` OR EXISTS (SELECT 1 FROM (` + attachmentText + `) x
+			WHERE x.message_id = m.id))`
+	}
+	reactionSQL := `''`
+	if format.Reactions {
+		reactionSQL = reactionSummarySQL
+	}
 	rows, err := db.QueryContext(ctx, `
 		SELECT
 			m.id,
 			m.thread_id,
 			m.sender_id,
-			m.text,
+			COALESCE(m.text, ''),
+			`+extraSQL+`,
+			`+reactionSQL+`,
 			m.timestamp_ms,
-			c.name as sender_name
+			c.name as sender_name,
+			COALESCE(m.reply_to_message_id, ''),
+			COALESCE(r.text, m.reply_snippet, ''),
+			rc.name,
+			`+source+`
 		FROM messages m
 		LEFT JOIN contacts c ON m.sender_id = c.id
-		WHERE m.thread_id = ? AND m.text IS NOT NULL AND m.text != ''
+		LEFT JOIN messages r ON r.id = m.reply_to_message_id
+		LEFT JOIN contacts rc ON rc.id = r.sender_id
+		WHERE m.thread_id = ? AND `+filter+`
 		ORDER BY m.timestamp_ms ASC
 	`, threadID)
 	if err != nil {
@@ -107,20 +315,36 @@ func fetchThread(ctx context.Context, db *sql.DB, threadID int64) (ThreadData, e
 
 	for rows.Next() {
 		var msg Message
-		var senderName sql.NullString
+		var senderName, repliedSender sql.NullString
+		var extra, reactionLines, repliedText string
 
 		if err := rows.Scan(
 			&msg.ID,
 			&msg.ThreadID,
 			&msg.SenderID,
 			&msg.Text,
+			&extra,
+			&reactionLines,
 			&msg.TimestampMs,
 			&senderName,
+			&msg.ReplyToID,
+			&repliedText,
+			&repliedSender,
+			&msg.Source,
 		); err != nil {
 			return thread, fmt.Errorf("scanning message: %w", err)
 		}
 
 		msg.SenderName = senderName.String
+		if extra != "" {
+			msg.Text = strings.TrimSpace(msg.Text + "\n" + extra)
+		}
+		if reactionLines != "" {
+			msg.Text += "\n" + reactionLines
+		}
+		if format.Replies && msg.ReplyToID != "" && repliedText != "" {
+			msg.Text = replyPrefix(repliedSender.String, repliedText) + "\n" + msg.Text
+		}
 		thread.Messages = append(thread.Messages, msg)
 	}
 
@@ -131,9 +355,76 @@ func fetchThread(ctx context.Context, db *sql.DB, threadID int64) (ThreadData, e
 	return thread, nil
 }
 
+// fetchGroupHeader returns the GroupHeader of a group chat, or "" for a
+// one-to-one thread. Group types other than plain groups (E2EE, community,
+// ...) count when they have more than two members.
+func fetchGroupHeader(ctx context.Context, db *sql.DB, threadID int64, name string) (string, error) {
+	var threadType, memberCount int64
+	err := db.QueryRowContext(ctx, "SELECT thread_type, COALESCE(member_count, 0) FROM threads WHERE id = ?", threadID).
+		Scan(&threadType, &memberCount)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("fetching thread type: %w", err)
+	}
+	tt := table.ThreadType(threadType)
+	if tt.IsOneToOne() || (tt != table.GROUP_THREAD && memberCount <= 2) {
+		return "", nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT participant_name FROM (
+			SELECT COALESCE(NULLIF(c.name, ''), NULLIF(tp.nickname, '')) AS participant_name,
+				(SELECT COUNT(*) FROM messages m WHERE m.thread_id = tp.thread_id AND m.sender_id = tp.contact_id) AS sent
+			FROM thread_participants tp
+			LEFT JOIN contacts c ON c.id = tp.contact_id
+			WHERE tp.thread_id = ?
+		)
+		WHERE participant_name IS NOT NULL
+		ORDER BY sent DESC, participant_name
+	`, threadID)
+	if err != nil {
+		return "", fmt.Errorf("fetching participants: %w", err)
+	}
+	defer rows.Close()
+
+	var participants []string
+	for rows.Next() {
+		var participant string
+		if err := rows.Scan(&participant); err != nil {
+			return "", fmt.Errorf("scanning participant: %w", err)
+		}
+		participants = append(participants, participant)
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("iterating participants: %w", err)
+	}
+	return GroupHeader(name, participants), nil
+}
+
+// replySnippetChars is how much of the replied-to message replyPrefix quotes
+const replySnippetChars = 80
+
+// replyPrefix is "[replying to Name: 'snippet']", or "[replying to: '…']"
+// when the replied-to sender is unknown
+func replyPrefix(sender, text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if r := []rune(text); len(r) > replySnippetChars {
+		text = string(r[:replySnippetChars]) + "…"
+	}
+	if sender == "" {
+		return "[replying to: '" + text + "']"
+	}
+	return "[replying to " + sender + ": '" + text + "']"
+}
+
 // ChunkCallback is called for each chunk produced.
 type ChunkCallback func(chunk Chunk) error
 
+// ProgressFunc is called after each thread with the threads done so far, the
+// number of threads being processed and the chunks produced so far
+type ProgressFunc func(threadsProcessed, totalThreads, totalChunks int)
+
 // ProcessAllThreads processes all threads and calls the callback for each chunk.
 // Returns statistics about the processing.
 func ProcessAllThreads(
@@ -141,13 +432,37 @@ func ProcessAllThreads(
 	db *sql.DB,
 	cfg *ragconfig.Config,
 	callback ChunkCallback,
-	progressFn func(threadsProcessed, totalChunks int),
+	progressFn ProgressFunc,
 ) (*Stats, error) {
-	threads, err := FetchThreads(ctx, db)
+	threads, err := FetchThreads(ctx, db, cfg)
 	if err != nil {
 		return nil, err
 	}
+	return processThreads(threads, cfg, callback, progressFn)
+}
 
+// ProcessThreadsByID is ProcessAllThreads limited to the given threads
+func ProcessThreadsByID(
+	ctx context.Context,
+	db *sql.DB,
+	cfg *ragconfig.Config,
+	threadIDs []int64,
+	callback ChunkCallback,
+	progressFn ProgressFunc,
+) (*Stats, error) {
+	threads, err := FetchThreadsByID(ctx, db, cfg, threadIDs)
+	if err != nil {
+		return nil, err
+	}
+	return processThreads(threads, cfg, callback, progressFn)
+}
+
+func processThreads(
+	threads []ThreadData,
+	cfg *ragconfig.Config,
+	callback ChunkCallback,
+	progressFn ProgressFunc,
+) (*Stats, error) {
 	stats := NewStats()
 
 	for _, thread := range threads {
@@ -172,8 +487,8 @@ func ProcessAllThreads(
 			}
 		}
 
-		if progressFn != nil && stats.ThreadsProcessed%100 == 0 {
-			progressFn(stats.ThreadsProcessed, stats.TotalChunks)
+		if progressFn != nil {
+			progressFn(stats.ThreadsProcessed, len(threads), stats.TotalChunks)
 		}
 	}
 
@@ -0,0 +1,248 @@
+package chunking
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestFetchThreads_AttachmentPlaceholders(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	for _, q := range []string{
+		`CREATE TABLE messages (id TEXT PRIMARY KEY, thread_id INTEGER, sender_id INTEGER, text TEXT, timestamp_ms INTEGER,
+			reply_to_message_id TEXT, reply_snippet TEXT)`,
+		`CREATE TABLE threads (id INTEGER PRIMARY KEY, name TEXT)`,
+		`CREATE TABLE contacts (id INTEGER PRIMARY KEY, name TEXT)`,
+		`CREATE TABLE sync_metadata (key TEXT PRIMARY KEY, value TEXT)`,
+		`CREATE TABLE attachments (id TEXT PRIMARY KEY, message_id TEXT, attachment_type INTEGER, url TEXT, filename TEXT, mime_type TEXT)`,
+		`INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms) VALUES ('m1', 10, 1, 'look', 1000), ('m2', 10, 1, NULL, 2000), ('m3', 10, 1, NULL, 3000), ('m4', 20, 1, NULL, 4000)`,
+		`INSERT INTO attachments VALUES
+			('a1', 'm1', 2, 'https://scontent.fbcdn.net/x.jpg', 'beach.jpg', 'image/jpeg'),
+			('a2', 'm2', 1, NULL, NULL, NULL),
+			('a3', 'm3', 7, 'https://example.com/post', NULL, NULL),
+			('a4', 'm4', 7, 'https://scontent.fbcdn.net/preview.jpg', NULL, NULL)`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	ctx := context.Background()
+
+	// Off by default: only the message with text
+	cfg := ragconfig.Default()
+	threads, err := FetchThreads(ctx, db, cfg)
+	if err != nil {
+		t.Fatalf("FetchThreads: %v", err)
+	}
+	if len(threads) != 1 || len(threads[0].Messages) != 1 || threads[0].Messages[0].Text != "look" {
+		t.Fatalf("got %+v, want thread 10 with just 'look'", threads)
+	}
+
+	cfg.Chunking.Attachments.Placeholders = []string{"photo", "sticker", "link"}
+	threads, err = FetchThreads(ctx, db, cfg)
+	if err != nil {
+		t.Fatalf("FetchThreads: %v", err)
+	}
+	if len(threads) != 2 {
+		t.Fatalf("got %d threads, want 2", len(threads))
+	}
+	want := []string{"look\n[photo: beach.jpg]", "[sticker]", "[shared link: https://example.com/post]"}
+	if len(threads[0].Messages) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(threads[0].Messages), len(want))
+	}
+	for i, msg := range threads[0].Messages {
+		if msg.Text != want[i] {
+			t.Errorf("message %d = %q, want %q", i, msg.Text, want[i])
+		}
+	}
+	// A CDN preview URL is not the shared link
+	if got := threads[1].Messages[0].Text; got != "[shared link]" {
+		t.Errorf("live-synced link = %q, want [shared link]", got)
+	}
+}
+
+func TestFetchThreads_Reactions(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	for _, q := range []string{
+		`CREATE TABLE messages (id TEXT PRIMARY KEY, thread_id INTEGER, sender_id INTEGER, text TEXT, timestamp_ms INTEGER,
+			reply_to_message_id TEXT, reply_snippet TEXT)`,
+		`CREATE TABLE threads (id INTEGER PRIMARY KEY, name TEXT)`,
+		`CREATE TABLE contacts (id INTEGER PRIMARY KEY, name TEXT)`,
+		`CREATE TABLE sync_metadata (key TEXT PRIMARY KEY, value TEXT)`,
+		`CREATE TABLE reactions (thread_id INTEGER, message_id TEXT, actor_id INTEGER, reaction TEXT, timestamp_ms INTEGER)`,
+		`INSERT INTO contacts VALUES (1, 'Anna'), (2, 'Bob')`,
+		`INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms) VALUES ('m1', 10, 1, 'we got the flat', 1000), ('m2', 10, 1, NULL, 2000)`,
+		`INSERT INTO reactions VALUES (10, 'm1', 2, '😮', 1600), (10, 'm1', 1, '❤️', 1500), (10, 'm2', 2, '👍', 2500)`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+
+	cfg := ragconfig.Default()
+	cfg.Chunking.Format.Reactions = true
+	threads, err := FetchThreads(context.Background(), db, cfg)
+	if err != nil {
+		t.Fatalf("FetchThreads: %v", err)
+	}
+	// The reaction to the empty message doesn't make it chunkable
+	if len(threads) != 1 || len(threads[0].Messages) != 1 {
+		t.Fatalf("got %+v, want one thread with one message", threads)
+	}
+	want := "we got the flat\n[Anna reacted ❤️]\n[Bob reacted 😮]"
+	if got := threads[0].Messages[0].Text; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFetchThreads_Replies(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	for _, q := range []string{
+		`CREATE TABLE messages (id TEXT PRIMARY KEY, thread_id INTEGER, sender_id INTEGER, text TEXT, timestamp_ms INTEGER,
+			reply_to_message_id TEXT, reply_snippet TEXT)`,
+		`CREATE TABLE threads (id INTEGER PRIMARY KEY, name TEXT)`,
+		`CREATE TABLE contacts (id INTEGER PRIMARY KEY, name TEXT)`,
+		`CREATE TABLE sync_metadata (key TEXT PRIMARY KEY, value TEXT)`,
+		`INSERT INTO contacts VALUES (1, 'Anna'), (2, 'Bob')`,
+		`INSERT INTO messages VALUES
+			('m1', 10, 1, 'are we still on for dinner on Friday?', 1000, NULL, NULL),
+			('m2', 10, 2, 'yes', 2000, 'm1', NULL),
+			('m3', 10, 2, 'and bring the  map', 3000, 'gone', 'the map of the old town')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	ctx := context.Background()
+
+	// Off by default: reply links are kept, the text is not touched
+	cfg := ragconfig.Default()
+	threads, err := FetchThreads(ctx, db, cfg)
+	if err != nil {
+		t.Fatalf("FetchThreads: %v", err)
+	}
+	if len(threads) != 1 || len(threads[0].Messages) != 3 {
+		t.Fatalf("got %+v, want one thread with three messages", threads)
+	}
+	if msg := threads[0].Messages[1]; msg.Text != "yes" || msg.ReplyToID != "m1" {
+		t.Errorf("got %+v, want unchanged reply to m1", msg)
+	}
+
+	cfg.Chunking.Format.Replies = true
+	threads, err = FetchThreads(ctx, db, cfg)
+	if err != nil {
+		t.Fatalf("FetchThreads: %v", err)
+	}
+	want := []string{
+		"are we still on for dinner on Friday?",
+		"[replying to Anna: 'are we still on for dinner on Friday?']\nyes",
+		// The original isn't archived: the stored snippet, without a name
+		"[replying to: 'the map of the old town']\nand bring the  map",
+	}
+	for i, msg := range threads[0].Messages {
+		if msg.Text != want[i] {
+			t.Errorf("message %d = %q, want %q", i, msg.Text, want[i])
+		}
+	}
+
+	// Bob's two replies coalesce, and the chunk keeps both links
+	chunks := ProcessThread(threads[0], cfg)
+	var replies []MessageReply
+	for _, c := range chunks {
+		replies = append(replies, c.Replies...)
+	}
+	if len(replies) != 2 || replies[0] != (MessageReply{"m2", "m1"}) || replies[1] != (MessageReply{"m3", "gone"}) {
+		t.Errorf("got replies %+v", replies)
+	}
+}
+
+func TestFetchThreads_GroupHeader(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	for _, q := range []string{
+		`CREATE TABLE messages (id TEXT PRIMARY KEY, thread_id INTEGER, sender_id INTEGER, text TEXT, timestamp_ms INTEGER,
+			reply_to_message_id TEXT, reply_snippet TEXT)`,
+		`CREATE TABLE threads (id INTEGER PRIMARY KEY, thread_type INTEGER, name TEXT, member_count INTEGER)`,
+		`CREATE TABLE thread_participants (thread_id INTEGER, contact_id INTEGER, nickname TEXT)`,
+		`CREATE TABLE contacts (id INTEGER PRIMARY KEY, name TEXT)`,
+		`CREATE TABLE sync_metadata (key TEXT PRIMARY KEY, value TEXT)`,
+		`INSERT INTO contacts VALUES (1, 'Anna'), (2, 'Bob'), (3, '')`,
+		`INSERT INTO threads VALUES (10, 2, 'Trip 2019', 3), (20, 1, NULL, 2)`,
+		`INSERT INTO thread_participants VALUES (10, 1, NULL), (10, 2, NULL), (10, 3, 'Cem'), (20, 1, NULL), (20, 2, NULL)`,
+		`INSERT INTO messages VALUES
+			('m1', 10, 2, 'who has the tent?', 1000, NULL, NULL),
+			('m2', 10, 1, 'I do', 2000, NULL, NULL),
+			('m3', 10, 2, 'great, I will bring the stove', 3000, NULL, NULL),
+			('m4', 20, 1, 'see you tomorrow', 4000, NULL, NULL)`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	ctx := context.Background()
+
+	cfg := ragconfig.Default()
+	cfg.Chunking.Format.GroupHeader = true
+	threads, err := FetchThreads(ctx, db, cfg)
+	if err != nil {
+		t.Fatalf("FetchThreads: %v", err)
+	}
+	if len(threads) != 2 {
+		t.Fatalf("got %d threads, want 2", len(threads))
+	}
+	// Most active first; Cem only has a nickname in the group
+	if want := "Group: Trip 2019 — participants: Bob, Anna, Cem"; threads[0].Header != want {
+		t.Errorf("group header = %q, want %q", threads[0].Header, want)
+	}
+	if threads[1].Header != "" {
+		t.Errorf("one-to-one thread got header %q", threads[1].Header)
+	}
+
+	chunks := ProcessThread(threads[0], cfg)
+	if len(chunks) == 0 || !strings.HasPrefix(chunks[0].Text, threads[0].Header+"\n[Bob]: who has the tent?") {
+		t.Fatalf("chunk doesn't start with the header: %+v", chunks)
+	}
+	plain := threads[0]
+	plain.Header = ""
+	if want := ProcessThread(plain, cfg)[0].CharCount; chunks[0].CharCount != want {
+		t.Errorf("header changed char count: %d, want %d", chunks[0].CharCount, want)
+	}
+}
+
+func TestGroupHeader(t *testing.T) {
+	names := []string{"A", "B", "C", "D", "E", "F", "G", "H", "I", "J", "K", "L"}
+	if got, want := GroupHeader("", names), "Group — participants: A, B, C, D, E, F, G, H, I, J and 2 more"; got != want {
+		t.Errorf("GroupHeader = %q, want %q", got, want)
+	}
+	if got := GroupHeader("Book club", nil); got != "Group: Book club" {
+		t.Errorf("GroupHeader without participants = %q", got)
+	}
+}
@@ -17,6 +17,14 @@ type Message struct {
 	SenderName  string
 	Text        string
 	TimestampMs int64
+	ReplyToID   string // ID of the message this one replies to, if any
+	Source      string // Provenance (messages.source): live, facebook-export, ...
+}
+
+// MessageReply links a message to the message it replies to.
+type MessageReply struct {
+	MessageID        string `json:"message_id"`
+	ReplyToMessageID string `json:"reply_to_message_id"`
 }
 
 // CoalescedMessage is a message composed of multiple original messages
@@ -29,6 +37,8 @@ type CoalescedMessage struct {
 	Text             string
 	StartTimestampMs int64
 	EndTimestampMs   int64
+	Replies          []MessageReply
+	Sources          []string
 }
 
 // Chunk is a chunk of conversation ready for embedding.
@@ -49,6 +59,10 @@ type Chunk struct {
 	CharCount        int      `json:"char_count"`
 	AlnumCount       int      `json:"alnum_count"`
 	UniqueWordCount  int      `json:"unique_word_count"`
+
+	Replies []MessageReply `json:"replies,omitempty"`
+	// Sources are the provenances of the chunk's messages, sorted
+	Sources []string `json:"sources,omitempty"`
 }
 
 // Stats contains chunking statistics.
@@ -0,0 +1,260 @@
+// Package httpauth checks the API keys and basic auth users in the auth
+// section of rag.yaml, for rag-server and the mcp-server SSE transport.
+//
+// Each credential has its own requests-per-minute limit; requests without
+// valid credentials get 401 and requests over the limit 429 with
+// Retry-After.
+package httpauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// credential is an API key or basic auth user, with its own rate limit
+type credential struct {
+	name    string
+	limiter *rateLimiter // nil = unlimited
+}
+
+type basicUser struct {
+	password [sha256.Size]byte
+	*credential
+}
+
+// Authenticator checks the credentials configured in the auth section
+type Authenticator struct {
+	realm   string
+	keys    map[[sha256.Size]byte]*credential // By key hash, so lookups don't leak key prefixes
+	users   map[string]basicUser
+	public  map[string]bool
+	pathKey func(string) string
+	now     func() time.Time
+}
+
+// New resolves the keys and passwords in cfg. It returns nil if no
+// credentials are configured. A key_env or password_env naming an unset
+// variable is an error rather than an entry that's silently skipped.
+//
+// realm is sent in the basic auth challenge. pathKey, if not nil, maps
+// request paths and auth.public entries to the form they're compared in.
+func New(cfg ragconfig.AuthConfig, realm string, pathKey func(string) string) (*Authenticator, error) {
+	if pathKey == nil {
+		pathKey = func(path string) string { return path }
+	}
+	a := &Authenticator{
+		realm:   realm,
+		keys:    make(map[[sha256.Size]byte]*credential),
+		users:   make(map[string]basicUser),
+		public:  make(map[string]bool),
+		pathKey: pathKey,
+		now:     time.Now,
+	}
+	limit := func(perMinute int) *rateLimiter {
+		if perMinute <= 0 {
+			perMinute = cfg.RateLimit
+		}
+		if perMinute <= 0 {
+			return nil
+		}
+		return newRateLimiter(perMinute)
+	}
+	addKey := func(name, key string, perMinute int) error {
+		hash := sha256.Sum256([]byte(key))
+		if _, ok := a.keys[hash]; ok {
+			return fmt.Errorf("API key %q is configured twice", name)
+		}
+		a.keys[hash] = &credential{name: name, limiter: limit(perMinute)}
+		return nil
+	}
+
+	for i, k := range cfg.Keys {
+		name := k.Name
+		if name == "" {
+			name = fmt.Sprintf("key-%d", i+1)
+		}
+		key, err := secret(k.Key, k.KeyEnv)
+		if err != nil {
+			return nil, fmt.Errorf("auth.keys[%s]: %w", name, err)
+		}
+		if err := addKey(name, key, k.RateLimit); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.KeysEnv != "" {
+		var n int
+		for entry := range strings.SplitSeq(os.Getenv(cfg.KeysEnv), ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			n++
+			name, key, ok := strings.Cut(entry, ":")
+			if !ok {
+				name, key = fmt.Sprintf("%s-%d", strings.ToLower(cfg.KeysEnv), n), entry
+			}
+			if key == "" {
+				return nil, fmt.Errorf("%s: key %q is empty", cfg.KeysEnv, name)
+			}
+			if err := addKey(name, key, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, u := range cfg.BasicAuth {
+		if u.Username == "" {
+			return nil, fmt.Errorf("auth.basic_auth: user without a username")
+		}
+		password, err := secret(u.Password, u.PasswordEnv)
+		if err != nil {
+			return nil, fmt.Errorf("auth.basic_auth[%s]: %w", u.Username, err)
+		}
+		a.users[u.Username] = basicUser{
+			password:   sha256.Sum256([]byte(password)),
+			credential: &credential{name: u.Username, limiter: limit(u.RateLimit)},
+		}
+	}
+
+	if len(a.keys) == 0 && len(a.users) == 0 {
+		return nil, nil
+	}
+	for _, path := range cfg.Public {
+		a.public[pathKey(path)] = true
+	}
+	return a, nil
+}
+
+// secret returns value, or the contents of the env var named by env
+func secret(value, env string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+	if env == "" {
+		return "", fmt.Errorf("neither a value nor an env var is set")
+	}
+	if v := os.Getenv(env); v != "" {
+		return v, nil
+	}
+	return "", fmt.Errorf("$%s is not set", env)
+}
+
+// Keys is the number of configured API keys
+func (a *Authenticator) Keys() int { return len(a.keys) }
+
+// Users is the number of configured basic auth users
+func (a *Authenticator) Users() int { return len(a.users) }
+
+// authenticate returns the credential a request carries, or nil
+func (a *Authenticator) authenticate(r *http.Request) *credential {
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key != "" {
+		return a.keys[sha256.Sum256([]byte(key))]
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil
+	}
+	user, found := a.users[username]
+	hash := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare(hash[:], user.password[:]) != 1 || !found {
+		return nil
+	}
+	return user.credential
+}
+
+// Middleware rejects requests without valid credentials (401) or over their
+// credential's rate limit (429). CORS preflights and public paths pass.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || a.public[a.pathKey(r.URL.Path)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cred := a.authenticate(r)
+		if cred == nil {
+			zerolog.Ctx(r.Context()).Debug().Str("path", r.URL.Path).Msg("Rejected unauthenticated request")
+			if len(a.users) > 0 {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, a.realm))
+			}
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		if ok, retryAfter := cred.limiter.allow(a.now()); !ok {
+			zerolog.Ctx(r.Context()).Debug().Str("credential", cred.name).Msg("Rate limited request")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+
+		logger := zerolog.Ctx(r.Context()).With().Str("credential", cred.name).Logger()
+		next.ServeHTTP(w, r.WithContext(logger.WithContext(r.Context())))
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// IsLoopback reports whether a listen host only accepts local connections
+func IsLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// rateLimiter is a token bucket holding up to a minute's worth of requests
+type rateLimiter struct {
+	mu        sync.Mutex
+	perMinute float64
+	tokens    float64
+	last      time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{perMinute: float64(perMinute), tokens: float64(perMinute)}
+}
+
+// allow takes a token if there is one, or says how long until there is
+func (l *rateLimiter) allow(now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.last.IsZero() {
+		refill := now.Sub(l.last).Minutes() * l.perMinute
+		l.tokens = min(l.tokens+max(refill, 0), l.perMinute)
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.perMinute * float64(time.Minute))
+}
@@ -0,0 +1,95 @@
+package httpauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	t.Setenv("TEST_RAG_KEYS", "phone:k2, k3")
+	t.Setenv("TEST_RAG_PASSWORD", "hunter2")
+	a, err := New(ragconfig.AuthConfig{
+		Keys:      []ragconfig.APIKeyConfig{{Name: "laptop", Key: "k1", RateLimit: 2}},
+		KeysEnv:   "TEST_RAG_KEYS",
+		BasicAuth: []ragconfig.BasicAuthConfig{{Username: "anna", PasswordEnv: "TEST_RAG_PASSWORD"}},
+		Public:    []string{"/health"},
+	}, "test", func(path string) string { return strings.TrimPrefix(path, "/v1") })
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Unix(1000, 0)
+	a.now = func() time.Time { return now }
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	do := func(path string, set func(r *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if set != nil {
+			set(req)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	bearer := func(key string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+key) }
+	}
+
+	if rec := do("/search", nil); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("no credentials: status %d, WWW-Authenticate %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+	for _, path := range []string{"/health", "/v1/health"} {
+		if rec := do(path, nil); rec.Code != http.StatusOK {
+			t.Errorf("public path %s: status %d", path, rec.Code)
+		}
+	}
+	for name, set := range map[string]func(r *http.Request){
+		"key from env with name":    bearer("k2"),
+		"key from env without name": func(r *http.Request) { r.Header.Set("X-API-Key", "k3") },
+		"basic auth":                func(r *http.Request) { r.SetBasicAuth("anna", "hunter2") },
+	} {
+		if rec := do("/search", set); rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d", name, rec.Code)
+		}
+	}
+	for name, set := range map[string]func(r *http.Request){
+		"wrong key":      bearer("nope"),
+		"wrong password": func(r *http.Request) { r.SetBasicAuth("anna", "hunter3") },
+		"unknown user":   func(r *http.Request) { r.SetBasicAuth("bob", "hunter2") },
+	} {
+		if rec := do("/search", set); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want 401", name, rec.Code)
+		}
+	}
+
+	// laptop may make 2 requests a minute, refilled one every 30s
+	for i := range 2 {
+		if rec := do("/search", bearer("k1")); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the limit: status %d", i+1, rec.Code)
+		}
+	}
+	rec := do("/search", bearer("k1"))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "30" {
+		t.Fatalf("over the limit: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	now = now.Add(30 * time.Second)
+	if rec := do("/search", bearer("k1")); rec.Code != http.StatusOK {
+		t.Fatalf("after refill: status %d", rec.Code)
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Setenv("RAG_API_KEYS", "")
+	if a, err := New(ragconfig.Default().Auth, "test", nil); a != nil || err != nil {
+		t.Errorf("default config: got %v, %v; want no authenticator", a, err)
+	}
+	if _, err := New(ragconfig.AuthConfig{
+		Keys: []ragconfig.APIKeyConfig{{Name: "laptop", KeyEnv: "TEST_RAG_UNSET_KEY"}},
+	}, "test", nil); err == nil {
+		t.Errorf("expected error for a key_env that isn't set")
+	}
+}
@@ -0,0 +1,266 @@
+// Package llm provides a provider-agnostic chat completion client.
+//
+// Features that need a language model (/ask, summaries, query rewrite) should
+// depend on the ChatCompleter interface and build it with New from the `llm:`
+// section of rag.yaml, instead of talking HTTP to a model server themselves.
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// Role of a chat message
+type Role string
+
+const (
+	RoleSystem    Role = "system"
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+)
+
+// Message is a single chat message
+type Message struct {
+	Role    Role   `json:"role"`
+	Content string `json:"content"`
+}
+
+// Request is a chat completion request.
+// Zero values fall back to the configured defaults.
+type Request struct {
+	Messages    []Message
+	Model       string
+	Temperature *float64
+	MaxTokens   int
+}
+
+// Usage is token accounting for one or more completions
+type Usage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+	Requests         int64 `json:"requests"`
+}
+
+// Add accumulates other into u
+func (u *Usage) Add(other Usage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+	u.Requests += other.Requests
+}
+
+// Response is a chat completion result
+type Response struct {
+	Content      string
+	Model        string
+	FinishReason string
+	Usage        Usage
+}
+
+// ChatCompleter generates chat completions
+type ChatCompleter interface {
+	Complete(ctx context.Context, req Request) (*Response, error)
+}
+
+// DeltaFunc receives a piece of generated text as soon as it arrives.
+// Returning an error stops the generation.
+type DeltaFunc func(text string) error
+
+// StreamCompleter generates chat completions incrementally. The returned
+// response holds the whole text, as from Complete.
+type StreamCompleter interface {
+	Stream(ctx context.Context, req Request, onDelta DeltaFunc) (*Response, error)
+}
+
+// StatusError is a non-2xx response from the model server
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("LLM server returned %d: %s", e.StatusCode, e.Body)
+}
+
+// retryable reports whether a failed request may succeed when repeated
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode == http.StatusTooManyRequests || se.StatusCode >= 500
+	}
+	// Transport errors (connection refused, reset, ...)
+	return true
+}
+
+// Client wraps a provider with defaults, retries and token accounting
+type Client struct {
+	provider    ChatCompleter
+	model       string
+	temperature float64
+	maxTokens   int
+	maxRetries  int
+	backoff     time.Duration
+
+	mu    sync.Mutex
+	usage Usage
+}
+
+// New creates a client for the provider configured in cfg
+func New(cfg ragconfig.LLMConfig) (*Client, error) {
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 120 * time.Second
+	}
+	httpClient := &http.Client{Timeout: timeout}
+
+	apiKey := ""
+	if cfg.APIKeyEnv != "" {
+		apiKey = os.Getenv(cfg.APIKeyEnv)
+	}
+
+	var provider ChatCompleter
+	switch strings.ToLower(strings.TrimSpace(cfg.Provider)) {
+	case "", "openai":
+		provider = NewOpenAI(cfg.BaseURL, apiKey, httpClient)
+	case "ollama":
+		provider = NewOllama(cfg.BaseURL, httpClient)
+	default:
+		return nil, fmt.Errorf("unknown LLM provider: %q (must be openai or ollama)", cfg.Provider)
+	}
+
+	return NewClient(provider, cfg), nil
+}
+
+// NewClient wraps an existing provider (useful for tests and custom backends)
+func NewClient(provider ChatCompleter, cfg ragconfig.LLMConfig) *Client {
+	return &Client{
+		provider:    provider,
+		model:       cfg.Model,
+		temperature: cfg.Temperature,
+		maxTokens:   cfg.MaxTokens,
+		maxRetries:  max(cfg.MaxRetries, 0),
+		backoff:     time.Second,
+	}
+}
+
+// Complete runs a chat completion, retrying transient failures
+func (c *Client) Complete(ctx context.Context, req Request) (*Response, error) {
+	req, err := c.withDefaults(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.retry(ctx, func() (*Response, bool, error) {
+		resp, err := c.provider.Complete(ctx, req)
+		return resp, true, err
+	})
+}
+
+// Stream runs a chat completion, passing the text to onDelta as it is
+// generated. Transient failures are retried only until the first piece of
+// text was passed on. Providers that can't stream deliver the whole answer
+// as one piece.
+func (c *Client) Stream(ctx context.Context, req Request, onDelta DeltaFunc) (*Response, error) {
+	req, err := c.withDefaults(req)
+	if err != nil {
+		return nil, err
+	}
+	streamer, ok := c.provider.(StreamCompleter)
+	if !ok {
+		resp, err := c.Complete(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if err := onDelta(resp.Content); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	sent := false
+	return c.retry(ctx, func() (*Response, bool, error) {
+		resp, err := streamer.Stream(ctx, req, func(text string) error {
+			sent = true
+			return onDelta(text)
+		})
+		return resp, !sent, err
+	})
+}
+
+// withDefaults fills in the configured model, temperature and token limit
+func (c *Client) withDefaults(req Request) (Request, error) {
+	if len(req.Messages) == 0 {
+		return req, fmt.Errorf("no messages")
+	}
+	if req.Model == "" {
+		req.Model = c.model
+	}
+	if req.Model == "" {
+		return req, fmt.Errorf("no LLM model configured (set llm.model in rag.yaml)")
+	}
+	if req.Temperature == nil {
+		t := c.temperature
+		req.Temperature = &t
+	}
+	if req.MaxTokens <= 0 {
+		req.MaxTokens = c.maxTokens
+	}
+	return req, nil
+}
+
+// retry calls attempt until it succeeds, fails permanently or reports that
+// it may not be repeated, and accounts the tokens of the successful call
+func (c *Client) retry(ctx context.Context, attempt func() (resp *Response, repeatable bool, err error)) (*Response, error) {
+	var lastErr error
+	for i := 0; i <= c.maxRetries; i++ {
+		if i > 0 {
+			wait := c.backoff << (i - 1)
+			log.Warn().
+				Err(lastErr).
+				Int("attempt", i+1).
+				Dur("wait", wait).
+				Msg("Retrying LLM request")
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		resp, repeatable, err := attempt()
+		if err == nil {
+			resp.Usage.Requests = 1
+			c.mu.Lock()
+			c.usage.Add(resp.Usage)
+			c.mu.Unlock()
+			return resp, nil
+		}
+
+		lastErr = err
+		if !repeatable || !retryable(err) {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+// Usage returns the tokens used by all successful completions so far
+func (c *Client) Usage() Usage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.usage
+}
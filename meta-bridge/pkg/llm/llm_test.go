@@ -0,0 +1,170 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestClient_RetriesAndAccountsTokens(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/v1/chat/completions" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var req openAIRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model != "test-model" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{
+			"model": "test-model",
+			"choices": [{"message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}],
+			"usage": {"prompt_tokens": 10, "completion_tokens": 2, "total_tokens": 12}
+		}`)
+	}))
+	defer srv.Close()
+
+	t.Setenv("TEST_LLM_KEY", "secret")
+	c, err := New(ragconfig.LLMConfig{
+		Provider:   "openai",
+		BaseURL:    srv.URL + "/v1",
+		Model:      "test-model",
+		APIKeyEnv:  "TEST_LLM_KEY",
+		MaxRetries: 1,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	c.backoff = time.Millisecond
+
+	resp, err := c.Complete(context.Background(), Request{
+		Messages: []Message{{Role: RoleUser, Content: "hello"}},
+	})
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if resp.Content != "hi" || calls != 2 {
+		t.Fatalf("unexpected response %+v after %d calls", resp, calls)
+	}
+
+	if u := c.Usage(); u != (Usage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12, Requests: 1}) {
+		t.Fatalf("unexpected usage: %+v", u)
+	}
+}
+
+func TestClient_DoesNotRetryClientErrors(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	c, err := New(ragconfig.LLMConfig{Provider: "ollama", BaseURL: srv.URL, Model: "m", MaxRetries: 3})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	c.backoff = time.Millisecond
+
+	if _, err := c.Complete(context.Background(), Request{
+		Messages: []Message{{Role: RoleUser, Content: "hello"}},
+	}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestClient_StreamOpenAI(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openAIRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.Stream || req.StreamOptions == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, `: keep-alive
+
+data: {"model":"test-model","choices":[{"delta":{"role":"assistant","content":"Hel"}}]}
+
+data: {"model":"test-model","choices":[{"delta":{"content":"lo"},"finish_reason":"stop"}]}
+
+data: {"model":"test-model","choices":[],"usage":{"prompt_tokens":7,"completion_tokens":2,"total_tokens":9}}
+
+data: [DONE]
+
+`)
+	}))
+	defer srv.Close()
+
+	c, err := New(ragconfig.LLMConfig{Provider: "openai", BaseURL: srv.URL, Model: "test-model"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	var deltas []string
+	resp, err := c.Stream(context.Background(), Request{
+		Messages: []Message{{Role: RoleUser, Content: "hello"}},
+	}, func(text string) error {
+		deltas = append(deltas, text)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if len(deltas) != 2 || resp.Content != "Hello" || resp.FinishReason != "stop" || resp.Model != "test-model" {
+		t.Fatalf("unexpected response %+v from deltas %q", resp, deltas)
+	}
+	if u := c.Usage(); u != (Usage{PromptTokens: 7, CompletionTokens: 2, TotalTokens: 9, Requests: 1}) {
+		t.Fatalf("unexpected usage: %+v", u)
+	}
+}
+
+func TestClient_StreamOllamaDoesNotRetryAfterText(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		// Cut off after the first line; a retry would repeat "Hi"
+		io.WriteString(w, `{"model":"m","message":{"role":"assistant","content":"Hi"},"done":false}`+"\n")
+	}))
+	defer srv.Close()
+
+	c, err := New(ragconfig.LLMConfig{Provider: "ollama", BaseURL: srv.URL, Model: "m", MaxRetries: 2})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	c.backoff = time.Millisecond
+
+	var got string
+	if _, err := c.Stream(context.Background(), Request{
+		Messages: []Message{{Role: RoleUser, Content: "hello"}},
+	}, func(text string) error {
+		got += text
+		return nil
+	}); err == nil {
+		t.Fatalf("expected error for a stream without done")
+	}
+	if calls != 1 || got != "Hi" {
+		t.Fatalf("got %q after %d calls, want one call", got, calls)
+	}
+}
@@ -0,0 +1,145 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Ollama implements ChatCompleter and StreamCompleter using Ollama's native
+// /api/chat endpoint
+type Ollama struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewOllama creates an Ollama provider; baseURL is the server root (no /api)
+func NewOllama(baseURL string, httpClient *http.Client) *Ollama {
+	if baseURL == "" {
+		baseURL = "http://127.0.0.1:11434"
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Ollama{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: httpClient,
+	}
+}
+
+type ollamaRequest struct {
+	Model    string        `json:"model"`
+	Messages []Message     `json:"messages"`
+	Stream   bool          `json:"stream"`
+	Options  ollamaOptions `json:"options"`
+}
+
+type ollamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+}
+
+type ollamaResponse struct {
+	Model           string  `json:"model"`
+	Message         Message `json:"message"`
+	Done            bool    `json:"done"`
+	DoneReason      string  `json:"done_reason"`
+	PromptEvalCount int64   `json:"prompt_eval_count"`
+	EvalCount       int64   `json:"eval_count"`
+}
+
+func (r ollamaResponse) response(content string) *Response {
+	return &Response{
+		Content:      content,
+		Model:        r.Model,
+		FinishReason: r.DoneReason,
+		Usage: Usage{
+			PromptTokens:     r.PromptEvalCount,
+			CompletionTokens: r.EvalCount,
+			TotalTokens:      r.PromptEvalCount + r.EvalCount,
+		},
+	}
+}
+
+// newRequest builds the POST /api/chat request
+func (o *Ollama) newRequest(ctx context.Context, req Request, stream bool) (*http.Request, error) {
+	body, err := json.Marshal(ollamaRequest{
+		Model:    req.Model,
+		Messages: req.Messages,
+		Stream:   stream,
+		Options: ollamaOptions{
+			Temperature: req.Temperature,
+			NumPredict:  req.MaxTokens,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+"/api/chat", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	return httpReq, nil
+}
+
+// Complete sends a non-streaming chat request
+func (o *Ollama) Complete(ctx context.Context, req Request) (*Response, error) {
+	httpReq, err := o.newRequest(ctx, req, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var out ollamaResponse
+	if err := doJSON(o.httpClient, httpReq, &out); err != nil {
+		return nil, err
+	}
+	return out.response(out.Message.Content), nil
+}
+
+// Stream sends a streaming chat request and reads the newline-delimited
+// JSON objects until the one marked done, which holds the token counts
+func (o *Ollama) Stream(ctx context.Context, req Request, onDelta DeltaFunc) (*Response, error) {
+	httpReq, err := o.newRequest(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := do(o.httpClient, httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var content strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var chunk ollamaResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return nil, fmt.Errorf("decoding LLM stream line: %w", err)
+		}
+		if text := chunk.Message.Content; text != "" {
+			content.WriteString(text)
+			if err := onDelta(text); err != nil {
+				return nil, err
+			}
+		}
+		if chunk.Done {
+			return chunk.response(content.String()), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading LLM stream: %w", err)
+	}
+	return nil, fmt.Errorf("LLM stream ended before done")
+}
@@ -0,0 +1,182 @@
+// Package media resolves locally stored avatars and attachment files.
+//
+// Layout (directories come from the media section of rag.yaml):
+//
+//	<avatars_dir>/<contact_id>.jpg|png        written by avatar-sync
+//	<attachments_dir>/<sha256[:2]>/<sha256>.<ext>  written by media-sync
+//	<attachments_dir>/<attachment_id>.<ext>   older per-attachment files
+//
+// Downloaded attachments are content-addressed, so the same file sent to
+// several threads is stored once; attachments.local_path maps an attachment
+// to its file.
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// avatarExtensions are the extensions avatar-sync writes, in lookup order
+var avatarExtensions = []string{".jpg", ".png"}
+
+// SafeName converts an attachment ID into a filesystem-safe base name.
+// Attachment IDs can be FB IDs, hashes or "message_id:index" fallbacks.
+func SafeName(attachmentID string) string {
+	var sb strings.Builder
+	for _, r := range attachmentID {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	name := strings.Trim(sb.String(), ".")
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// AttachmentPath returns where an attachment with the given extension is stored
+func AttachmentPath(dir, attachmentID, ext string) string {
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return filepath.Join(dir, SafeName(attachmentID)+strings.ToLower(ext))
+}
+
+// FindAttachment looks up a stored attachment file regardless of its extension
+func FindAttachment(dir, attachmentID string) (string, bool) {
+	base := filepath.Join(dir, SafeName(attachmentID))
+	if fileExists(base) {
+		return base, true
+	}
+	matches, err := filepath.Glob(globEscape(base) + ".*")
+	if err != nil {
+		return "", false
+	}
+	for _, m := range matches {
+		if fileExists(m) {
+			return m, true
+		}
+	}
+	return "", false
+}
+
+// FindAvatar looks up a downloaded avatar for the contact
+func FindAvatar(dir string, contactID int64) (string, bool) {
+	id := strconv.FormatInt(contactID, 10)
+	for _, ext := range avatarExtensions {
+		path := filepath.Join(dir, id+ext)
+		if fileExists(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// globEscape escapes glob metacharacters (the directory part may contain them)
+func globEscape(s string) string {
+	replacer := strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`)
+	return replacer.Replace(s)
+}
+
+// commonExtensions picks the usual extension where mime.ExtensionsByType
+// returns several in alphabetical order (image/jpeg -> .jfif first)
+var commonExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"audio/mpeg":      ".mp3",
+	"audio/mp4":       ".m4a",
+	"audio/ogg":       ".ogg",
+	"audio/aac":       ".aac",
+	"application/pdf": ".pdf",
+}
+
+// Extension picks a file extension for an attachment from its file name,
+// falling back to its MIME type. Returns "" if neither gives one.
+func Extension(filename, mimeType string) string {
+	if ext := strings.ToLower(filepath.Ext(filename)); ext != "" && len(ext) <= 10 && SafeName(ext) == ext[1:] {
+		return ext
+	}
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	if ext, ok := commonExtensions[mimeType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mimeType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// Put copies r into the content-addressed store under dir and returns the
+// file's path relative to dir, its hex SHA-256 and size. Content that is
+// already stored is not written again.
+func Put(dir string, r io.Reader, ext string) (relPath, sum string, size int64, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", 0, err
+	}
+	tmp, err := os.CreateTemp(dir, ".download-*")
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	h := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	sum = hex.EncodeToString(h.Sum(nil))
+	relPath = filepath.Join(sum[:2], sum+strings.ToLower(ext))
+	dst := filepath.Join(dir, relPath)
+	if fileExists(dst) {
+		return relPath, sum, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", "", 0, fmt.Errorf("storing %s: %w", relPath, err)
+	}
+	return relPath, sum, size, nil
+}
+
+// Resolve turns a path stored in attachments.local_path into a path under
+// dir, refusing ones that would escape it
+func Resolve(dir, relPath string) (string, bool) {
+	if relPath == "" || filepath.IsAbs(relPath) {
+		return "", false
+	}
+	clean := filepath.Clean(relPath)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	path := filepath.Join(dir, clean)
+	if !fileExists(path) {
+		return "", false
+	}
+	return path, true
+}
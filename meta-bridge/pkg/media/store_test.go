@@ -0,0 +1,57 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPut_DeduplicatesContent(t *testing.T) {
+	dir := t.TempDir()
+
+	first, sum, size, err := Put(dir, strings.NewReader("hello"), ".txt")
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if size != 5 || !strings.HasPrefix(first, sum[:2]+string(filepath.Separator)) {
+		t.Fatalf("Put = %q, %q, %d", first, sum, size)
+	}
+	second, _, _, err := Put(dir, strings.NewReader("hello"), ".txt")
+	if err != nil {
+		t.Fatalf("Put (again): %v", err)
+	}
+	if second != first {
+		t.Fatalf("same content stored twice: %q, %q", first, second)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the hash directory (temp files removed), got %d entries", len(entries))
+	}
+
+	if path, ok := Resolve(dir, first); !ok || path != filepath.Join(dir, first) {
+		t.Fatalf("Resolve = %q, %v", path, ok)
+	}
+	if _, ok := Resolve(dir, "../"+first); ok {
+		t.Fatal("Resolve accepted a path outside the store")
+	}
+}
+
+func TestExtension(t *testing.T) {
+	for _, tc := range []struct {
+		filename, mimeType, want string
+	}{
+		{"report.PDF", "", ".pdf"},
+		{"", "image/jpeg", ".jpg"},
+		{"", "video/mp4; codecs=avc1", ".mp4"},
+		{"noext", "", ""},
+	} {
+		if got := Extension(tc.filename, tc.mimeType); got != tc.want {
+			t.Errorf("Extension(%q, %q) = %q, want %q", tc.filename, tc.mimeType, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package media
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// Throttle limits download concurrency and request rate, in total and per
+// host, and pauses a host that answers 429 or 503. Share one Throttle between
+// all workers of a process.
+type Throttle struct {
+	cfg    ragconfig.DownloadsConfig
+	slots  chan struct{}
+	global pacer
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+type hostState struct {
+	slots       chan struct{}
+	pacer       pacer
+	pausedUntil time.Time
+}
+
+// pacer spaces requests evenly at a fixed rate (a token bucket without burst)
+type pacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// reserve books the next request slot and returns how long to wait for it
+func (p *pacer) reserve(now time.Time) time.Duration {
+	if p.interval <= 0 {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	wait := p.next.Sub(now)
+	p.next = p.next.Add(p.interval)
+	return wait
+}
+
+func interval(perSecond float64) time.Duration {
+	if perSecond <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / perSecond)
+}
+
+// NewThrottle creates a Throttle from the media.downloads config
+func NewThrottle(cfg ragconfig.DownloadsConfig) *Throttle {
+	cfg.Concurrency = max(cfg.Concurrency, 1)
+	if cfg.PerHostConcurrency <= 0 || cfg.PerHostConcurrency > cfg.Concurrency {
+		cfg.PerHostConcurrency = cfg.Concurrency
+	}
+	return &Throttle{
+		cfg:    cfg,
+		slots:  make(chan struct{}, cfg.Concurrency),
+		global: pacer{interval: interval(cfg.RequestsPerSecond)},
+		hosts:  make(map[string]*hostState),
+	}
+}
+
+// Concurrency is the number of downloads allowed at once, which is also the
+// useful number of workers
+func (t *Throttle) Concurrency() int {
+	return t.cfg.Concurrency
+}
+
+func (t *Throttle) host(name string) *hostState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hosts[name]
+	if !ok {
+		h = &hostState{
+			slots: make(chan struct{}, t.cfg.PerHostConcurrency),
+			pacer: pacer{interval: interval(t.cfg.PerHostRequestsPerSecond)},
+		}
+		t.hosts[name] = h
+	}
+	return h
+}
+
+// Wait blocks until a request to host may start and returns a release
+// function to call once the response body has been read
+func (t *Throttle) Wait(ctx context.Context, host string) (release func(), err error) {
+	h := t.host(host)
+
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case h.slots <- struct{}{}:
+	case <-ctx.Done():
+		<-t.slots
+		return nil, ctx.Err()
+	}
+	release = func() {
+		<-h.slots
+		<-t.slots
+	}
+
+	now := time.Now()
+	wait := max(t.global.reserve(now), h.pacer.reserve(now))
+	t.mu.Lock()
+	if pause := h.pausedUntil.Sub(now); pause > wait {
+		wait = pause
+	}
+	t.mu.Unlock()
+
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+// Observe pauses the host of resp when it asks clients to slow down,
+// honouring Retry-After (seconds or HTTP date) when present
+func (t *Throttle) Observe(host string, resp *http.Response) {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return
+	}
+	pause := time.Duration(t.cfg.BackoffSeconds) * time.Second
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			pause = time.Duration(secs) * time.Second
+		} else if at, err := http.ParseTime(v); err == nil {
+			pause = time.Until(at)
+		}
+	}
+	if pause <= 0 {
+		return
+	}
+
+	h := t.host(host)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until := time.Now().Add(pause); until.After(h.pausedUntil) {
+		h.pausedUntil = until
+	}
+}
+
+// IsExpiredURLStatus reports whether an HTTP status means the signed CDN URL
+// is no longer valid and has to be refreshed rather than retried
+func IsExpiredURLStatus(status int) bool {
+	return status == http.StatusForbidden || status == http.StatusNotFound || status == http.StatusGone
+}
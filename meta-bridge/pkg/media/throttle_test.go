@@ -0,0 +1,65 @@
+package media
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestThrottle_PacesPerHostAndBacksOff(t *testing.T) {
+	th := NewThrottle(ragconfig.DownloadsConfig{
+		Concurrency:              4,
+		PerHostConcurrency:       2,
+		PerHostRequestsPerSecond: 20, // 50ms apart
+	})
+	ctx := context.Background()
+
+	start := time.Now()
+	for range 3 {
+		release, err := th.Wait(ctx, "cdn.example")
+		if err != nil {
+			t.Fatalf("Wait: %v", err)
+		}
+		release()
+	}
+	if took := time.Since(start); took < 90*time.Millisecond {
+		t.Fatalf("3 requests to one host took %s, want >= 100ms of pacing", took)
+	}
+
+	// Other hosts are not held back by cdn.example's pacing
+	start = time.Now()
+	release, err := th.Wait(ctx, "other.example")
+	if err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	release()
+	if took := time.Since(start); took > 20*time.Millisecond {
+		t.Fatalf("first request to another host waited %s", took)
+	}
+
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"1"}}}
+	th.Observe("other.example", resp)
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, err := th.Wait(waitCtx, "other.example"); err == nil {
+		t.Fatal("Wait did not honour Retry-After")
+	}
+}
+
+func TestIsExpiredURLStatus(t *testing.T) {
+	for status, want := range map[int]bool{
+		http.StatusForbidden:          true,
+		http.StatusNotFound:           true,
+		http.StatusGone:               true,
+		http.StatusOK:                 false,
+		http.StatusTooManyRequests:    false,
+		http.StatusServiceUnavailable: false,
+	} {
+		if got := IsExpiredURLStatus(status); got != want {
+			t.Errorf("IsExpiredURLStatus(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
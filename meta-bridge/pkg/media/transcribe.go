@@ -0,0 +1,113 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// Transcript is the text of an audio file
+type Transcript struct {
+	Text     string
+	Language string // As detected by the server, if it reports it
+}
+
+// Transcriber calls an OpenAI-style audio transcription endpoint
+type Transcriber struct {
+	baseURL  string
+	model    string
+	language string
+	apiKey   string
+	client   *http.Client
+}
+
+// NewTranscriber creates a transcription client from the transcription
+// config section
+func NewTranscriber(cfg ragconfig.TranscribeConfig) *Transcriber {
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	apiKey := ""
+	if cfg.APIKeyEnv != "" {
+		apiKey = os.Getenv(cfg.APIKeyEnv)
+	}
+	return &Transcriber{
+		baseURL:  strings.TrimRight(cfg.BaseURL, "/"),
+		model:    cfg.Model,
+		language: cfg.Language,
+		apiKey:   apiKey,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// Model is the configured transcription model
+func (t *Transcriber) Model() string {
+	return t.model
+}
+
+// Transcribe uploads audio (named filename, which servers use to detect the
+// format) and returns its transcript
+func (t *Transcriber) Transcribe(ctx context.Context, filename string, audio io.Reader) (*Transcript, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, audio); err != nil {
+		return nil, err
+	}
+	fields := map[string]string{"model": t.model, "language": t.language, "response_format": "verbose_json"}
+	for name, value := range fields {
+		if value == "" {
+			continue
+		}
+		if err := w.WriteField(name, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.baseURL+"/audio/transcriptions", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if t.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, fmt.Errorf("reading transcription response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("transcription server returned %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	var parsed struct {
+		Text     string `json:"text"`
+		Language string `json:"language"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("decoding transcription response: %w", err)
+	}
+	return &Transcript{Text: strings.TrimSpace(parsed.Text), Language: parsed.Language}, nil
+}
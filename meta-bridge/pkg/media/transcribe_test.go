@@ -0,0 +1,52 @@
+package media
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestTranscriber_SendsMultipartAndParsesText(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/audio/transcriptions" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q", got)
+		}
+		f, hdr, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("FormFile: %v", err)
+			return
+		}
+		data, _ := io.ReadAll(f)
+		if hdr.Filename != "voice.ogg" || string(data) != "OggS" {
+			t.Errorf("file = %s %q", hdr.Filename, data)
+		}
+		if r.FormValue("model") != "whisper-1" || r.FormValue("language") != "pl" {
+			t.Errorf("model = %q, language = %q", r.FormValue("model"), r.FormValue("language"))
+		}
+		w.Write([]byte(`{"text": " Do zobaczenia jutro. ", "language": "polish"}`))
+	}))
+	defer srv.Close()
+
+	t.Setenv("TEST_TRANSCRIBE_KEY", "secret")
+	tr := NewTranscriber(ragconfig.TranscribeConfig{
+		BaseURL:   srv.URL + "/v1/",
+		Model:     "whisper-1",
+		Language:  "pl",
+		APIKeyEnv: "TEST_TRANSCRIBE_KEY",
+	})
+	got, err := tr.Transcribe(context.Background(), "voice.ogg", strings.NewReader("OggS"))
+	if err != nil {
+		t.Fatalf("Transcribe: %v", err)
+	}
+	if got.Text != "Do zobaczenia jutro." || got.Language != "polish" {
+		t.Fatalf("Transcribe = %+v", got)
+	}
+}
@@ -0,0 +1,135 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// Captioner asks a vision model for the text in an image and a short
+// description, through an OpenAI-style /chat/completions endpoint
+type Captioner struct {
+	baseURL   string
+	model     string
+	prompt    string
+	maxTokens int
+	apiKey    string
+	client    *http.Client
+}
+
+// NewCaptioner creates a vision client from the vision config section
+func NewCaptioner(cfg ragconfig.VisionConfig) *Captioner {
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+	apiKey := ""
+	if cfg.APIKeyEnv != "" {
+		apiKey = os.Getenv(cfg.APIKeyEnv)
+	}
+	return &Captioner{
+		baseURL:   strings.TrimRight(cfg.BaseURL, "/"),
+		model:     cfg.Model,
+		prompt:    cfg.Prompt,
+		maxTokens: cfg.MaxTokens,
+		apiKey:    apiKey,
+		client:    &http.Client{Timeout: timeout},
+	}
+}
+
+// Model is the configured vision model
+func (c *Captioner) Model() string {
+	return c.model
+}
+
+type visionContent struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *visionImageURL `json:"image_url,omitempty"`
+}
+
+type visionImageURL struct {
+	URL string `json:"url"`
+}
+
+type visionMessage struct {
+	Role    string          `json:"role"`
+	Content []visionContent `json:"content"`
+}
+
+type visionRequest struct {
+	Model       string          `json:"model"`
+	Messages    []visionMessage `json:"messages"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Temperature float64         `json:"temperature"`
+	Stream      bool            `json:"stream"`
+}
+
+// Caption sends an image (of the given MIME type) to the model and returns
+// its answer to the configured prompt
+func (c *Captioner) Caption(ctx context.Context, mimeType string, image io.Reader) (string, error) {
+	data, err := io.ReadAll(image)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(visionRequest{
+		Model: c.model,
+		Messages: []visionMessage{{
+			Role: "user",
+			Content: []visionContent{
+				{Type: "text", Text: c.prompt},
+				{Type: "image_url", ImageURL: &visionImageURL{URL: "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)}},
+			},
+		}},
+		MaxTokens: c.maxTokens,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respData, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return "", fmt.Errorf("reading vision response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vision server returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respData)))
+	}
+
+	var parsed struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(respData, &parsed); err != nil {
+		return "", fmt.Errorf("decoding vision response: %w", err)
+	}
+	if len(parsed.Choices) == 0 {
+		return "", fmt.Errorf("vision server returned no choices")
+	}
+	return strings.TrimSpace(parsed.Choices[0].Message.Content), nil
+}
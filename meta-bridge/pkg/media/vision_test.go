@@ -0,0 +1,45 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestCaptioner_SendsImageAsDataURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		var req visionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %v", err)
+			return
+		}
+		if req.Model != "llava" || len(req.Messages) != 1 || len(req.Messages[0].Content) != 2 {
+			t.Errorf("request = %+v", req)
+			return
+		}
+		content := req.Messages[0].Content
+		if content[0].Text != "What does it say?" || content[1].ImageURL == nil ||
+			content[1].ImageURL.URL != "data:image/png;base64,iVBORw==" {
+			t.Errorf("content = %+v", content)
+		}
+		w.Write([]byte(`{"choices": [{"message": {"content": "  CLOSED ON SUNDAYS\nA shop door sign. "}}]}`))
+	}))
+	defer srv.Close()
+
+	c := NewCaptioner(ragconfig.VisionConfig{BaseURL: srv.URL + "/v1", Model: "llava", Prompt: "What does it say?"})
+	got, err := c.Caption(context.Background(), "image/png", strings.NewReader("\x89PNG"))
+	if err != nil {
+		t.Fatalf("Caption: %v", err)
+	}
+	if got != "CLOSED ON SUNDAYS\nA shop door sign." {
+		t.Fatalf("Caption = %q", got)
+	}
+}
@@ -0,0 +1,340 @@
+// Package metrics keeps counters, gauges and histograms and writes them in
+// the Prometheus text exposition format, for the /metrics endpoints of
+// rag-server and rag-indexerd.
+//
+// Metrics register on a Registry when created, usually Default as package
+// variables next to the code they measure. Values that are cheap to read on
+// demand (row counts) are better written at scrape time with WriteValue.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type is a Prometheus metric type
+type Type string
+
+const (
+	TypeCounter   Type = "counter"
+	TypeGauge     Type = "gauge"
+	TypeHistogram Type = "histogram"
+)
+
+// DurationBuckets are histogram bounds in seconds, from 5ms to 1 minute,
+// for request and call durations
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Registry holds metrics in the order they were created
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Default is the registry the rest of the module registers on
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes every metric of the registry
+func (r *Registry) WriteText(w io.Writer) {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// ContentType is the Content-Type of the text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WriteValue writes a metric without labels that isn't kept in a registry
+func WriteValue(w io.Writer, typ Type, name, help string, value float64) {
+	writeHeader(w, name, help, typ)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+// vec is the label handling shared by all metric types: one series per
+// combination of label values
+type vec[T any] struct {
+	name   string
+	help   string
+	typ    Type
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*T
+	values map[string][]string
+	create func() *T
+}
+
+func newVec[T any](name, help string, typ Type, labels []string, create func() *T) *vec[T] {
+	return &vec[T]{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]*T),
+		values: make(map[string][]string),
+		create: create,
+	}
+}
+
+// get returns the series for labelValues, creating it on first use
+func (v *vec[T]) get(labelValues []string) *T {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = v.create()
+		v.series[key] = s
+		v.values[key] = slices.Clone(labelValues)
+	}
+	return s
+}
+
+// peek returns the series for labelValues, or nil if nothing was recorded
+func (v *vec[T]) peek(labelValues []string) *T {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.series[strings.Join(labelValues, "\xff")]
+}
+
+// each calls fn for every series in label order, with the label pairs
+// formatted for the exposition
+func (v *vec[T]) each(fn func(labels []string, s *T)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range slices.Sorted(maps.Keys(v.series)) {
+		pairs := make([]string, len(v.labels))
+		for i, l := range v.labels {
+			pairs[i] = l + `="` + escapeLabel(v.values[key][i]) + `"`
+		}
+		fn(pairs, v.series[key])
+	}
+}
+
+// value is the number behind a counter or gauge series
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (x *value) add(d float64) {
+	x.mu.Lock()
+	x.v += d
+	x.mu.Unlock()
+}
+
+func (x *value) set(v float64) {
+	x.mu.Lock()
+	x.v = v
+	x.mu.Unlock()
+}
+
+func (x *value) get() float64 {
+	if x == nil {
+		return 0
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.v
+}
+
+// Counter is a monotonically increasing count, per label values
+type Counter struct{ *vec[value] }
+
+// NewCounter registers a counter. name should end in _total.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, TypeCounter, labels, func() *value { return &value{} })}
+	r.register(name, c)
+	return c
+}
+
+// Inc adds one
+func (c *Counter) Inc(labelValues ...string) {
+	c.get(labelValues).add(1)
+}
+
+// Add adds n, which must not be negative
+func (c *Counter) Add(n float64, labelValues ...string) {
+	if n < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.get(labelValues).add(n)
+}
+
+// Value returns the current count
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.peek(labelValues).get()
+}
+
+func (c *Counter) write(w io.Writer) {
+	writeSeries(w, c.vec)
+}
+
+// Gauge is a value that goes up and down, per label values
+type Gauge struct{ *vec[value] }
+
+// NewGauge registers a gauge
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, TypeGauge, labels, func() *value { return &value{} })}
+	r.register(name, g)
+	return g
+}
+
+// Set replaces the value
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.get(labelValues).set(v)
+}
+
+// SetToCurrentTime sets the value to the current Unix time in seconds
+func (g *Gauge) SetToCurrentTime(labelValues ...string) {
+	g.Set(float64(time.Now().UnixMilli())/1000, labelValues...)
+}
+
+// Value returns the current value
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.peek(labelValues).get()
+}
+
+func (g *Gauge) write(w io.Writer) {
+	writeSeries(w, g.vec)
+}
+
+func writeSeries(w io.Writer, v *vec[value]) {
+	writeHeader(w, v.name, v.help, v.typ)
+	v.each(func(labels []string, s *value) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(labels), formatFloat(s.get()))
+	})
+}
+
+// Histogram counts observations into cumulative buckets, per label values
+type Histogram struct {
+	*vec[histogramSeries]
+	buckets []float64
+}
+
+type histogramSeries struct {
+	mu     sync.Mutex
+	counts []uint64 // Per bucket, not cumulative; the last one is +Inf
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the given upper bounds, which must
+// be sorted. name should end in a unit (_seconds).
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s aren't sorted", name))
+	}
+	h := &Histogram{buckets: buckets}
+	h.vec = newVec(name, help, TypeHistogram, labels, func() *histogramSeries {
+		return &histogramSeries{counts: make([]uint64, len(buckets)+1)}
+	})
+	r.register(name, h)
+	return h
+}
+
+// Observe records one value
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	s := h.get(labelValues)
+	i, _ := slices.BinarySearch(h.buckets, v)
+	s.mu.Lock()
+	s.counts[i]++
+	s.sum += v
+	s.mu.Unlock()
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Count returns how many values were observed
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	s := h.peek(labelValues)
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n uint64
+	for _, c := range s.counts {
+		n += c
+	}
+	return n
+}
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, h.typ)
+	h.each(func(labels []string, s *histogramSeries) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var cumulative uint64
+		for i, c := range s.counts {
+			cumulative += c
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			bucketLabels := append(slices.Clone(labels), `le="`+formatFloat(le)+`"`)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(labels), cumulative)
+	})
+}
+
+func writeHeader(w io.Writer, name, help string, typ Type) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help), name, typ)
+}
+
+func formatLabels(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
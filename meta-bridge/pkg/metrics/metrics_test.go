@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("test_requests_total", "Requests handled.", "route", "status")
+	backlog := r.NewGauge("test_backlog", "Items waiting.")
+	latency := r.NewHistogram("test_duration_seconds", "Time taken.", []float64{0.1, 1}, "route")
+
+	requests.Inc("/search", "200")
+	requests.Add(2, "/search", "200")
+	requests.Inc(`/a"b`, "500")
+	backlog.Set(7)
+	latency.Observe(0.1, "/search")
+	latency.Observe(0.5, "/search")
+	latency.Observe(3, "/search")
+
+	var out bytes.Buffer
+	r.WriteText(&out)
+	want := `# HELP test_requests_total Requests handled.
+# TYPE test_requests_total counter
+test_requests_total{route="/a\"b",status="500"} 1
+test_requests_total{route="/search",status="200"} 3
+# HELP test_backlog Items waiting.
+# TYPE test_backlog gauge
+test_backlog 7
+# HELP test_duration_seconds Time taken.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/search",le="0.1"} 1
+test_duration_seconds_bucket{route="/search",le="1"} 2
+test_duration_seconds_bucket{route="/search",le="+Inf"} 3
+test_duration_seconds_sum{route="/search"} 3.6
+test_duration_seconds_count{route="/search"} 3
+`
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	if requests.Value("/search", "200") != 3 || requests.Value("/none", "200") != 0 || latency.Count("/search") != 3 {
+		t.Errorf("unexpected values read back")
+	}
+	out.Reset()
+	r.WriteText(&out)
+	if strings.Contains(out.String(), "/none") {
+		t.Errorf("reading a value created a series")
+	}
+}
+
+func TestWriteValue(t *testing.T) {
+	var out bytes.Buffer
+	WriteValue(&out, TypeGauge, "test_chunks", "Chunks.", 1.5)
+	if want := "# HELP test_chunks Chunks.\n# TYPE test_chunks gauge\ntest_chunks 1.5\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
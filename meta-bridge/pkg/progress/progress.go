@@ -0,0 +1,249 @@
+// Package progress reports how far a long-running command is: items done,
+// rate and ETA, either as a human-readable line or as one JSON object per
+// line for scripts that wrap the command.
+//
+// Commands register the shared -progress flag with Flag and create a
+// Reporter per task. A nil *Reporter is valid and reports nothing, so
+// library code can take one without callers having to care.
+package progress
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format selects how progress is written
+type Format string
+
+const (
+	FormatText Format = "text" // "embed: 1200/5000 chunks (24.0%), 85.3 chunks/s, ETA 44s"
+	FormatJSON Format = "json" // One Snapshot per line
+	FormatNone Format = "none"
+)
+
+// DefaultInterval is how often a Reporter writes a line while counting
+const DefaultInterval = 2 * time.Second
+
+// Flag registers -progress on the default flag set
+func Flag() *string {
+	return flag.String("progress", string(FormatText), "Progress output on stderr: text, json (one object per line) or none")
+}
+
+// ParseFormat validates a -progress value
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(strings.TrimSpace(s))); f {
+	case FormatText, FormatJSON, FormatNone:
+		return f, nil
+	case "":
+		return FormatText, nil
+	default:
+		return "", fmt.Errorf("invalid progress format %q (must be text, json or none)", s)
+	}
+}
+
+// Snapshot is the state of a task at one point. It is what JSON lines hold.
+type Snapshot struct {
+	Type           string   `json:"type"` // "progress", or "done" for the last line
+	Task           string   `json:"task"`
+	Unit           string   `json:"unit"`
+	Done           int64    `json:"done"`
+	Total          int64    `json:"total,omitempty"` // 0 = unknown
+	Percent        float64  `json:"percent,omitempty"`
+	Rate           float64  `json:"rate"` // Units per second since the start
+	ElapsedSeconds float64  `json:"elapsed_seconds"`
+	ETASeconds     *float64 `json:"eta_seconds,omitempty"` // Absent without a total or a rate
+}
+
+// Reporter counts the progress of one task and writes it every interval
+type Reporter struct {
+	out      io.Writer
+	format   Format
+	task     string
+	unit     string
+	interval time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	start    time.Time
+	last     time.Time
+	done     int64
+	total    int64
+	finished bool
+}
+
+// New creates a reporter for task, counting unit ("chunks", "threads").
+// total may be 0 when it isn't known yet.
+func New(out io.Writer, format Format, task, unit string, total int64) *Reporter {
+	return newWithClock(out, format, task, unit, total, time.Now)
+}
+
+func newWithClock(out io.Writer, format Format, task, unit string, total int64, now func() time.Time) *Reporter {
+	start := now()
+	return &Reporter{
+		out:      out,
+		format:   format,
+		task:     task,
+		unit:     unit,
+		interval: DefaultInterval,
+		now:      now,
+		start:    start,
+		last:     start,
+		total:    total,
+	}
+}
+
+// SetInterval changes how often lines are written
+func (r *Reporter) SetInterval(d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interval = d
+}
+
+// Add counts n more items done
+func (r *Reporter) Add(n int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done += n
+	r.maybeReport()
+}
+
+// Set replaces the count of items done
+func (r *Reporter) Set(done int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done = done
+	r.maybeReport()
+}
+
+// SetTotal replaces the number of items expected
+func (r *Reporter) SetTotal(total int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total = total
+}
+
+// AddTotal raises the number of items expected, for tasks that discover
+// their work as they go
+func (r *Reporter) AddTotal(n int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total += n
+}
+
+// Finish writes the final line. Later calls do nothing.
+func (r *Reporter) Finish() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.finished {
+		return
+	}
+	r.finished = true
+	r.write(r.snapshot("done"))
+}
+
+// Snapshot returns the current state
+func (r *Reporter) Snapshot() Snapshot {
+	if r == nil {
+		return Snapshot{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.snapshot("progress")
+}
+
+func (r *Reporter) maybeReport() {
+	if r.finished || r.format == FormatNone {
+		return
+	}
+	now := r.now()
+	if now.Sub(r.last) < r.interval {
+		return
+	}
+	r.last = now
+	r.write(r.snapshot("progress"))
+}
+
+func (r *Reporter) snapshot(typ string) Snapshot {
+	elapsed := r.now().Sub(r.start).Seconds()
+	s := Snapshot{
+		Type:           typ,
+		Task:           r.task,
+		Unit:           r.unit,
+		Done:           r.done,
+		Total:          r.total,
+		ElapsedSeconds: elapsed,
+	}
+	if elapsed > 0 {
+		s.Rate = float64(r.done) / elapsed
+	}
+	if r.total > 0 {
+		s.Percent = min(100*float64(r.done)/float64(r.total), 100)
+		if s.Rate > 0 && typ != "done" {
+			eta := float64(max(r.total-r.done, 0)) / s.Rate
+			s.ETASeconds = &eta
+		}
+	}
+	return s
+}
+
+func (r *Reporter) write(s Snapshot) {
+	switch r.format {
+	case FormatJSON:
+		data, err := json.Marshal(s)
+		if err != nil {
+			return
+		}
+		r.out.Write(append(data, '\n'))
+	case FormatNone:
+	default:
+		fmt.Fprintln(r.out, FormatLine(s))
+	}
+}
+
+// FormatLine renders a snapshot as a text progress line
+func FormatLine(s Snapshot) string {
+	var b strings.Builder
+	b.WriteString(s.Task + ": ")
+	if s.Type == "done" {
+		fmt.Fprintf(&b, "%d %s in %s (%.1f %s/s)", s.Done, s.Unit, roundDuration(s.ElapsedSeconds), s.Rate, s.Unit)
+		return b.String()
+	}
+	if s.Total > 0 {
+		fmt.Fprintf(&b, "%d/%d %s (%.1f%%)", s.Done, s.Total, s.Unit, s.Percent)
+	} else {
+		fmt.Fprintf(&b, "%d %s", s.Done, s.Unit)
+	}
+	fmt.Fprintf(&b, ", %.1f %s/s", s.Rate, s.Unit)
+	if s.ETASeconds != nil {
+		b.WriteString(", ETA " + roundDuration(*s.ETASeconds))
+	}
+	return b.String()
+}
+
+// roundDuration formats seconds to whole seconds ("1h2m3s")
+func roundDuration(seconds float64) string {
+	return (time.Duration(seconds * float64(time.Second))).Round(time.Second).String()
+}
@@ -0,0 +1,94 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock advances only when told to
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestReporter_Text(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	var out bytes.Buffer
+	r := newWithClock(&out, FormatText, "embed", "chunks", 1000, clock.now)
+
+	// Within the interval nothing is written
+	clock.advance(time.Second)
+	r.Add(100)
+	if out.Len() != 0 {
+		t.Fatalf("wrote before the interval: %q", out.String())
+	}
+
+	clock.advance(3 * time.Second)
+	r.Add(300)
+	if got, want := out.String(), "embed: 400/1000 chunks (40.0%), 100.0 chunks/s, ETA 6s\n"; got != want {
+		t.Fatalf("progress line = %q, want %q", got, want)
+	}
+
+	out.Reset()
+	clock.advance(time.Second)
+	r.Set(1000)
+	r.Finish()
+	r.Finish()
+	if got, want := out.String(), "embed: 1000 chunks in 5s (200.0 chunks/s)\n"; got != want {
+		t.Fatalf("final line = %q, want %q", got, want)
+	}
+}
+
+func TestReporter_JSON(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	var out bytes.Buffer
+	r := newWithClock(&out, FormatJSON, "import", "conversations", 0, clock.now)
+
+	clock.advance(2 * time.Second)
+	r.AddTotal(10)
+	r.Add(5)
+	r.Finish()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", out.String())
+	}
+	var first, last Snapshot
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatalf("parsing %q: %v", lines[0], err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &last); err != nil {
+		t.Fatalf("parsing %q: %v", lines[1], err)
+	}
+	if first.Type != "progress" || first.Done != 5 || first.Total != 10 || first.Percent != 50 || first.Rate != 2.5 ||
+		first.ETASeconds == nil || *first.ETASeconds != 2 {
+		t.Errorf("unexpected progress snapshot %+v", first)
+	}
+	if last.Type != "done" || last.ETASeconds != nil {
+		t.Errorf("unexpected final snapshot %+v", last)
+	}
+}
+
+func TestReporter_Nil(t *testing.T) {
+	var r *Reporter
+	r.Add(1)
+	r.SetTotal(2)
+	r.Finish()
+	if s := r.Snapshot(); s.Done != 0 {
+		t.Errorf("nil reporter snapshot = %+v", s)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for in, want := range map[string]Format{"": FormatText, "JSON": FormatJSON, "none": FormatNone} {
+		if got, err := ParseFormat(in); err != nil || got != want {
+			t.Errorf("ParseFormat(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Errorf("expected error for unknown format")
+	}
+}
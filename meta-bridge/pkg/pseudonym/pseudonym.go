@@ -0,0 +1,132 @@
+// Package pseudonym replaces people's names in text with stand-ins such as
+// "Participant 3". share-bundle, anon-corpus and rag-server's read-only demo
+// share it, so names are hidden by the same rules everywhere.
+//
+// Only whole words are replaced, so a first name doesn't mangle the longer
+// words it is part of. Matching ignores case.
+package pseudonym
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Fallback stands in for a match whose case folding ToLower doesn't
+// reproduce, so it can't be looked up
+const Fallback = "a participant"
+
+// Participant is the stand-in for the n-th person
+func Participant(n int64) string {
+	return "Participant " + strconv.FormatInt(n, 10)
+}
+
+// Variants is the full name followed by its first word, skipping fragments
+// too short to replace safely
+func Variants(name string) []string {
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) < 3 {
+		return nil
+	}
+	variants := []string{name}
+	if first, _, ok := strings.Cut(name, " "); ok && utf8.RuneCountInString(first) >= 3 {
+		variants = append(variants, first)
+	}
+	return variants
+}
+
+// Names maps lowercased real names to pseudonyms
+type Names map[string]string
+
+// Add maps every variant of name to pseudonym. Variants an earlier name
+// already claimed keep their pseudonym, so two people sharing a first name
+// don't swap it between calls.
+func (n Names) Add(name, pseudonym string) {
+	for _, variant := range Variants(name) {
+		key := strings.ToLower(variant)
+		if _, ok := n[key]; !ok {
+			n[key] = pseudonym
+		}
+	}
+}
+
+// Replacer replaces names by their pseudonyms. One combined pattern keeps it
+// cheap enough to run on every rag-server response.
+type Replacer struct {
+	names   Names
+	pattern *regexp.Regexp // Matches any name, longest first
+}
+
+// NewReplacer builds a Replacer for names
+func NewReplacer(names Names) *Replacer {
+	r := &Replacer{names: make(Names, len(names))}
+	for real, pseudonym := range names {
+		r.names[strings.ToLower(real)] = pseudonym
+	}
+	if len(r.names) == 0 {
+		return r
+	}
+	keys := make([]string, 0, len(r.names))
+	for k := range r.names {
+		keys = append(keys, regexp.QuoteMeta(k))
+	}
+	// Longest first so "Anna Nowak" wins over "Anna"
+	slices.SortFunc(keys, func(a, b string) int { return len(b) - len(a) })
+	r.pattern = regexp.MustCompile(`(?i)` + strings.Join(keys, "|"))
+	return r
+}
+
+// Len is the number of names replaced
+func (r *Replacer) Len() int {
+	return len(r.names)
+}
+
+// Replace returns s with every whole-word name replaced by its pseudonym
+func (r *Replacer) Replace(s string) string {
+	return r.ReplaceFunc(s, func(pseudonym string) string { return pseudonym })
+}
+
+// ReplaceFunc is Replace with each pseudonym passed through repl, for
+// callers that set replacements aside before rewriting the rest of s
+func (r *Replacer) ReplaceFunc(s string, repl func(pseudonym string) string) string {
+	if r.pattern == nil {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range r.pattern.FindAllStringIndex(s, -1) {
+		if !wordBoundary(s, m[0], m[1]) {
+			continue
+		}
+		pseudonym, ok := r.names[strings.ToLower(s[m[0]:m[1]])]
+		if !ok {
+			pseudonym = Fallback
+		}
+		b.WriteString(s[last:m[0]])
+		b.WriteString(repl(pseudonym))
+		last = m[1]
+	}
+	if last == 0 {
+		return s
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// wordBoundary reports whether s[start:end] is not part of a longer word
+func wordBoundary(s string, start, end int) bool {
+	if r, _ := utf8.DecodeLastRuneInString(s[:start]); start > 0 && isWordRune(r) {
+		return false
+	}
+	if r, _ := utf8.DecodeRuneInString(s[end:]); end < len(s) && isWordRune(r) {
+		return false
+	}
+	return true
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
@@ -0,0 +1,61 @@
+package pseudonym
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestVariants(t *testing.T) {
+	for name, want := range map[string][]string{
+		"Anna Nowak":  {"Anna Nowak", "Anna"},
+		" Celina ":    {"Celina"},
+		"Jo Smith":    {"Jo Smith"},
+		"Al":          nil,
+		"Łukasz Wójt": {"Łukasz Wójt", "Łukasz"},
+	} {
+		if got := Variants(name); !slices.Equal(got, want) {
+			t.Errorf("Variants(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestNamesAdd_FirstClaimWins(t *testing.T) {
+	names := make(Names)
+	names.Add("Anna Nowak", Participant(1))
+	names.Add("Anna Kowalska", Participant(2))
+	if names["anna"] != "Participant 1" || names["anna kowalska"] != "Participant 2" {
+		t.Fatalf("names = %v", names)
+	}
+}
+
+func TestReplacer(t *testing.T) {
+	names := make(Names)
+	names.Add("Anna Nowak", Participant(1))
+	names.Add("Łukasz", Participant(2))
+	r := NewReplacer(names)
+	if r.Len() != 3 {
+		t.Fatalf("Len = %d, want 3", r.Len())
+	}
+
+	for in, want := range map[string]string{
+		"Anna Nowak: hi ŁUKASZ":     "Participant 1: hi Participant 2",
+		"Annabelle says hi to anna": "Annabelle says hi to Participant 1",
+		"anna_nowak and Anna2 stay": "anna_nowak and Anna2 stay",
+		`{"text":"ask Anna"}`:       `{"text":"ask Participant 1"}`,
+		"nobody here":               "nobody here",
+		"":                          "",
+	} {
+		if got := r.Replace(in); got != want {
+			t.Errorf("Replace(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	got := r.ReplaceFunc("Anna and Łukasz", func(p string) string { return "<" + p + ">" })
+	if want := "<Participant 1> and <Participant 2>"; got != want {
+		t.Errorf("ReplaceFunc = %q, want %q", got, want)
+	}
+
+	if got := NewReplacer(nil).Replace("Anna"); got != "Anna" {
+		t.Errorf("empty replacer changed text: %q", got)
+	}
+}
@@ -0,0 +1,195 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mau.fi/mautrix-meta/pkg/llm"
+)
+
+// AskRequest is a question to answer from the archive. The filters scope the
+// search that picks the chunks the answer is based on, as in SearchRequest.
+type AskRequest struct {
+	Question string `json:"question"`
+	Limit    int    `json:"limit,omitempty"` // Chunks retrieved (0 = ask.context_chunks)
+
+	Tags     []string `json:"tags,omitempty"`
+	ThreadID int64    `json:"thread_id,string,omitempty"`
+	Sender   string   `json:"sender,omitempty"`
+	After    string   `json:"after,omitempty"`
+	Before   string   `json:"before,omitempty"`
+	Source   string   `json:"source,omitempty"`
+	Lang     string   `json:"lang,omitempty"`
+}
+
+// AskResponse is an answer with the chunks it was given
+type AskResponse struct {
+	Question string `json:"question"`
+	// Answer is empty when the search found no chunks; the model isn't asked
+	Answer string    `json:"answer"`
+	Model  string    `json:"model,omitempty"`
+	Usage  llm.Usage `json:"usage"`
+	TookMs int64     `json:"took_ms"`
+
+	// Sources are the chunks in the prompt, in search order
+	Sources []AskSource `json:"sources"`
+}
+
+// AskSource is a chunk the model was given as excerpt [Ref]
+type AskSource struct {
+	Ref   int  `json:"ref"`
+	Cited bool `json:"cited"` // The answer refers to [Ref]
+	Hit
+}
+
+// SetLLM enables /ask through c
+func (s *Service) SetLLM(c llm.ChatCompleter) {
+	s.llm = c
+}
+
+// Ask runs a hybrid search for the question and has the LLM answer it from
+// the top chunks, numbered so the answer can cite them
+func (s *Service) Ask(ctx context.Context, req AskRequest) (*AskResponse, error) {
+	return s.ask(ctx, req, nil)
+}
+
+// AskStream is Ask passing the answer to onDelta as the LLM generates it.
+// The returned response is the same as from Ask, with the citations marked.
+// An LLM that can't stream delivers the whole answer as one piece.
+func (s *Service) AskStream(ctx context.Context, req AskRequest, onDelta llm.DeltaFunc) (*AskResponse, error) {
+	return s.ask(ctx, req, onDelta)
+}
+
+func (s *Service) ask(ctx context.Context, req AskRequest, onDelta llm.DeltaFunc) (*AskResponse, error) {
+	start := time.Now()
+	if s.llm == nil {
+		return nil, fmt.Errorf("no LLM configured (set llm.model in rag.yaml): %w", ErrUnavailable)
+	}
+
+	question := SanitizeQuery(req.Question)
+	if question == "" {
+		return nil, badRequestf("question cannot be empty")
+	}
+	if req.Limit < 0 || req.Limit > maxRequestLimit {
+		return nil, badRequestf("invalid limit: %d (must be 0 to %d)", req.Limit, maxRequestLimit)
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = s.cfg.Ask.ContextChunks
+	}
+	search := SearchRequest{
+		Query:    question,
+		Mode:     ModeHybrid,
+		Limit:    min(limit, 50),
+		Tags:     req.Tags,
+		ThreadID: req.ThreadID,
+		Sender:   req.Sender,
+		After:    req.After,
+		Before:   req.Before,
+		Source:   req.Source,
+		Lang:     req.Lang,
+	}
+	if err := ValidateSearchRequest(&search); err != nil {
+		return nil, err
+	}
+	found, err := s.Search(ctx, search)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &AskResponse{Question: question, Sources: []AskSource{}}
+	excerpts := ""
+	for i, hit := range found.Results {
+		excerpt := formatExcerpt(i+1, hit)
+		// The best chunk always goes in, cut to the budget if need be
+		if budget := s.cfg.Ask.MaxContextChars; budget > 0 && utf8.RuneCountInString(excerpts+excerpt) > budget {
+			if i > 0 {
+				break
+			}
+			excerpt = string([]rune(excerpt)[:budget])
+		}
+		excerpts += excerpt
+		resp.Sources = append(resp.Sources, AskSource{Ref: i + 1, Hit: hit})
+	}
+	if len(resp.Sources) == 0 {
+		resp.TookMs = time.Since(start).Milliseconds()
+		return resp, nil
+	}
+
+	prompt := llm.Request{
+		Model: s.cfg.Ask.Model,
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: s.cfg.Ask.Prompt},
+			{Role: llm.RoleUser, Content: "Chat excerpts:\n\n" + excerpts + "Question: " + question},
+		},
+		MaxTokens: s.cfg.Ask.MaxTokens,
+	}
+	var out *llm.Response
+	if streamer, ok := s.llm.(llm.StreamCompleter); ok && onDelta != nil {
+		out, err = streamer.Stream(ctx, prompt, onDelta)
+	} else {
+		out, err = s.llm.Complete(ctx, prompt)
+		if err == nil && onDelta != nil {
+			err = onDelta(out.Content)
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("asking LLM: %w: %w", ErrUnavailable, err)
+	}
+
+	resp.Answer = strings.TrimSpace(out.Content)
+	resp.Model = out.Model
+	resp.Usage = out.Usage
+	cited := citedRefs(resp.Answer)
+	for i := range resp.Sources {
+		resp.Sources[i].Cited = cited[resp.Sources[i].Ref]
+	}
+	resp.TookMs = time.Since(start).Milliseconds()
+	return resp, nil
+}
+
+// formatExcerpt renders a hit for the prompt: its number, thread, time span
+// (UTC) and chunk ID, then its text
+func formatExcerpt(ref int, hit Hit) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%d] ", ref)
+	if hit.ThreadName != "" {
+		fmt.Fprintf(&b, "Chat: %s | ", hit.ThreadName)
+	}
+	from := time.UnixMilli(hit.StartTimestampMs).UTC()
+	to := time.UnixMilli(hit.EndTimestampMs).UTC()
+	b.WriteString(from.Format("2006-01-02 15:04"))
+	if to.After(from) {
+		layout := "15:04"
+		if to.Format(time.DateOnly) != from.Format(time.DateOnly) {
+			layout = "2006-01-02 15:04"
+		}
+		b.WriteString(" – " + to.Format(layout))
+	}
+	fmt.Fprintf(&b, " UTC | chunk %s\n%s\n\n", hit.ChunkID, strings.TrimSpace(hit.Text))
+	return b.String()
+}
+
+// citationPattern matches [3] and [1, 4]
+var citationPattern = regexp.MustCompile(`\[(\d+(?:\s*,\s*\d+)*)\]`)
+
+// citedRefs returns the excerpt numbers an answer cites
+func citedRefs(answer string) map[int]bool {
+	refs := make(map[int]bool)
+	for _, m := range citationPattern.FindAllStringSubmatch(answer, -1) {
+		for _, part := range strings.Split(m[1], ",") {
+			if n, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+				refs[n] = true
+			}
+		}
+	}
+	return refs
+}
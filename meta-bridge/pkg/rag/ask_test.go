@@ -0,0 +1,138 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/llm"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// downEmbedder makes hybrid search fall back to BM25
+type downEmbedder struct{}
+
+func (downEmbedder) Embed(ctx context.Context, text string) ([]float64, error) {
+	return nil, ErrUnavailable
+}
+func (downEmbedder) IsAvailable(ctx context.Context) bool { return false }
+
+// fixedBM25 returns the same hits for every query
+type fixedBM25 struct{ hits []BM25Hit }
+
+func (f fixedBM25) Search(ctx context.Context, terms []QueryTerm, limit int, filter SearchFilter) ([]BM25Hit, error) {
+	return f.hits[:min(limit, len(f.hits))], nil
+}
+func (fixedBM25) Suggest(ctx context.Context, prefix string, minDocs, limit int) ([]Suggestion, error) {
+	return nil, nil
+}
+func (fixedBM25) Stats(ctx context.Context) (SQLiteStats, error) { return SQLiteStats{}, nil }
+
+// recordingLLM answers with a fixed text and keeps the last request
+type recordingLLM struct {
+	answer string
+	req    llm.Request
+}
+
+func (r *recordingLLM) Complete(ctx context.Context, req llm.Request) (*llm.Response, error) {
+	r.req = req
+	return &llm.Response{Content: r.answer, Model: "test-model", Usage: llm.Usage{TotalTokens: 42, Requests: 1}}, nil
+}
+
+func TestAsk(t *testing.T) {
+	cfg := ragconfig.Default()
+	cfg.Ask.MaxContextChars = 250
+	hits := []BM25Hit{
+		{Chunk: Chunk{ChunkID: "a", ThreadName: "Trip", Text: "Anna: the cabin is booked for May", StartTimestampMs: 1714557600000, EndTimestampMs: 1714561200000}},
+		{Chunk: Chunk{ChunkID: "c", ThreadName: "Trip", Text: "Bob: I'll bring the boat", StartTimestampMs: 1714647600000, EndTimestampMs: 1714647600000}},
+		{Chunk: Chunk{ChunkID: "d", ThreadName: "Work", Text: strings.Repeat("long ", 100)}},
+	}
+	svc := NewService(cfg, nil, fixedBM25{hits}, NewSQLiteChunkStore(newTestChunkDB(t)), downEmbedder{})
+	ctx := context.Background()
+
+	if _, err := svc.Ask(ctx, AskRequest{Question: "when is the cabin?"}); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("Ask without LLM: expected ErrUnavailable, got %v", err)
+	}
+
+	model := &recordingLLM{answer: "It's booked for May [1]."}
+	svc.SetLLM(model)
+	if _, err := svc.Ask(ctx, AskRequest{Question: "  "}); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("Ask with empty question: expected ErrBadRequest, got %v", err)
+	}
+
+	resp, err := svc.Ask(ctx, AskRequest{Question: "when is the cabin?"})
+	if err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if resp.Answer != "It's booked for May [1]." || resp.Model != "test-model" || resp.Usage.TotalTokens != 42 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	// The third chunk is past max_context_chars
+	if len(resp.Sources) != 2 || resp.Sources[0].ChunkID != "a" || !resp.Sources[0].Cited || resp.Sources[1].Cited {
+		t.Fatalf("unexpected sources %+v", resp.Sources)
+	}
+
+	prompt := model.req.Messages[1].Content
+	for _, want := range []string{
+		"[1] Chat: Trip | 2024-05-01 10:00 – 11:00 UTC | chunk a\nAnna: the cabin is booked for May",
+		"[2] Chat: Trip | 2024-05-02 11:00 UTC | chunk c\n",
+		"Question: when is the cabin?",
+	} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt lacks %q:\n%s", want, prompt)
+		}
+	}
+	if strings.Contains(prompt, "[3]") {
+		t.Errorf("prompt has the chunk past the budget:\n%s", prompt)
+	}
+}
+
+// streamingLLM streams its answer word by word
+type streamingLLM struct{ recordingLLM }
+
+func (s *streamingLLM) Stream(ctx context.Context, req llm.Request, onDelta llm.DeltaFunc) (*llm.Response, error) {
+	for _, word := range strings.SplitAfter(s.answer, " ") {
+		if err := onDelta(word); err != nil {
+			return nil, err
+		}
+	}
+	return s.Complete(ctx, req)
+}
+
+func TestAskStream(t *testing.T) {
+	hits := []BM25Hit{
+		{Chunk: Chunk{ChunkID: "a", ThreadName: "Trip", Text: "Anna: the cabin is booked for May"}},
+		{Chunk: Chunk{ChunkID: "b", ThreadName: "Trip", Text: "Bob: I'll bring the boat"}},
+	}
+	svc := NewService(ragconfig.Default(), nil, fixedBM25{hits}, NewSQLiteChunkStore(newTestChunkDB(t)), downEmbedder{})
+	ctx := context.Background()
+
+	for _, model := range []llm.ChatCompleter{
+		&streamingLLM{recordingLLM{answer: "Bob brings the boat [2]."}},
+		&recordingLLM{answer: "Bob brings the boat [2]."},
+	} {
+		svc.SetLLM(model)
+		var deltas []string
+		resp, err := svc.AskStream(ctx, AskRequest{Question: "who brings the boat?"}, func(text string) error {
+			deltas = append(deltas, text)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("AskStream with %T: %v", model, err)
+		}
+		if strings.Join(deltas, "") != resp.Answer || resp.Answer != "Bob brings the boat [2]." {
+			t.Errorf("%T: deltas %q don't make up the answer %q", model, deltas, resp.Answer)
+		}
+		if len(resp.Sources) != 2 || resp.Sources[0].Cited || !resp.Sources[1].Cited {
+			t.Errorf("%T: unexpected sources %+v", model, resp.Sources)
+		}
+	}
+}
+
+func TestCitedRefs(t *testing.T) {
+	got := citedRefs("Yes [2], and later [1, 4]; not [x] or [].")
+	if len(got) != 3 || !got[1] || !got[2] || !got[4] {
+		t.Errorf("citedRefs = %v, want 1, 2 and 4", got)
+	}
+}
@@ -0,0 +1,99 @@
+package rag
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// VectorParams are the vector search parameters a search ran with, reported
+// so results can be reproduced after the collection has grown
+type VectorParams struct {
+	Ef              int   `json:"ef"` // max(ef floor, fetch_limit), as sent to Milvus
+	FetchMultiplier int   `json:"fetch_multiplier"`
+	FetchLimit      int   `json:"fetch_limit"`
+	CollectionRows  int64 `json:"collection_rows,omitempty"` // Row count the values were scaled for
+	AutoScaled      bool  `json:"auto_scaled"`
+
+	minEf int // ef floor, configured or scaled
+}
+
+// rowCountCache holds the vector collection's row count between refreshes
+type rowCountCache struct {
+	mu      sync.Mutex
+	rows    int64
+	fetched time.Time
+}
+
+type vectorParamsKey struct{}
+
+// withVectorParams carries p through ctx so vectorCandidates can use it and
+// fill in the effective values
+func withVectorParams(ctx context.Context, p *VectorParams) context.Context {
+	return context.WithValue(ctx, vectorParamsKey{}, p)
+}
+
+// vectorParams returns the ef and fetch multiplier floors for the next
+// search: the configured ones, or with auto_scale enabled, those scaled for
+// the current collection size. A failed row count lookup falls back to the
+// configured values.
+func (s *Service) vectorParams(ctx context.Context) *VectorParams {
+	search := s.cfg.Milvus.Search
+	p := &VectorParams{minEf: search.Ef, FetchMultiplier: max(search.FetchMultiplier, 1)}
+	if !search.AutoScale.Enabled {
+		return p
+	}
+	rows, ok := s.collectionRows(ctx)
+	if !ok {
+		return p
+	}
+	p.minEf, p.FetchMultiplier = scaleVectorParams(search, rows)
+	p.CollectionRows = rows
+	p.AutoScaled = true
+	return p
+}
+
+// collectionRows returns the cached vector collection row count, refreshing
+// it from Stats once it is older than auto_scale.refresh_seconds
+func (s *Service) collectionRows(ctx context.Context) (int64, bool) {
+	s.rowCount.mu.Lock()
+	defer s.rowCount.mu.Unlock()
+
+	ttl := time.Duration(s.cfg.Milvus.Search.AutoScale.RefreshSeconds) * time.Second
+	if !s.rowCount.fetched.IsZero() && time.Since(s.rowCount.fetched) < ttl {
+		return s.rowCount.rows, true
+	}
+	stats, err := s.vectors.Stats(ctx)
+	if err != nil {
+		ctxLogger(ctx).Warn().Err(err).Msg("collection size lookup failed, using configured ef")
+		return 0, false
+	}
+	s.rowCount.rows = stats.RowCount
+	s.rowCount.fetched = time.Now()
+	return stats.RowCount, true
+}
+
+// scaleVectorParams multiplies ef and fetch_multiplier by
+// 1 + log10(rows / reference_rows) and clamps them to the configured bounds
+func scaleVectorParams(search ragconfig.MilvusSearchConfig, rows int64) (ef, fetchMult int) {
+	as := search.AutoScale
+	factor := 1.0
+	if as.ReferenceRows > 0 && rows > 0 {
+		factor = max(1+math.Log10(float64(rows)/float64(as.ReferenceRows)), 0)
+	}
+
+	ef = clampBound(int(math.Round(float64(search.Ef)*factor)), as.MinEf, as.MaxEf)
+	fetchMult = clampBound(int(math.Round(float64(search.FetchMultiplier)*factor)), 1, as.MaxFetchMultiplier)
+	return ef, fetchMult
+}
+
+// clampBound clamps v to [lo, hi], where hi <= 0 means unbounded
+func clampBound(v, lo, hi int) int {
+	if hi > 0 && v > hi {
+		v = hi
+	}
+	return max(v, lo)
+}
@@ -0,0 +1,61 @@
+package rag
+
+import (
+	"context"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestScaleVectorParams(t *testing.T) {
+	search := ragconfig.Default().Milvus.Search
+
+	cases := []struct {
+		rows          int64
+		ef, fetchMult int
+	}{
+		{10_000, 128, 3},       // Reference size: as configured
+		{100_000, 256, 6},      // One decade up doubles both
+		{1_000_000, 384, 9},    // Two decades up triples both
+		{100_000_000, 512, 10}, // Clamped to the maxima
+		{500, 64, 1},           // Small collections clamp to the minima
+	}
+	for _, c := range cases {
+		ef, fetchMult := scaleVectorParams(search, c.rows)
+		if ef != c.ef || fetchMult != c.fetchMult {
+			t.Errorf("rows=%d: got ef=%d fetch_multiplier=%d, want %d/%d", c.rows, ef, fetchMult, c.ef, c.fetchMult)
+		}
+	}
+}
+
+type countingVectors struct {
+	VectorSearcher
+	rows  int64
+	calls int
+}
+
+func (v *countingVectors) Stats(context.Context) (MilvusStats, error) {
+	v.calls++
+	return MilvusStats{RowCount: v.rows}, nil
+}
+
+func TestVectorParams_CachesRowCount(t *testing.T) {
+	cfg := ragconfig.Default()
+	cfg.Milvus.Search.AutoScale.Enabled = true
+	vectors := &countingVectors{rows: 100_000}
+	s := NewService(cfg, vectors, nil, nil, nil)
+
+	p := s.vectorParams(context.Background())
+	if !p.AutoScaled || p.minEf != 256 || p.FetchMultiplier != 6 || p.CollectionRows != 100_000 {
+		t.Fatalf("got %+v", p)
+	}
+	s.vectorParams(context.Background())
+	if vectors.calls != 1 {
+		t.Errorf("Stats called %d times, want 1 (cached)", vectors.calls)
+	}
+
+	cfg.Milvus.Search.AutoScale.Enabled = false
+	if p := s.vectorParams(context.Background()); p.AutoScaled || p.minEf != 128 || p.FetchMultiplier != 3 {
+		t.Errorf("disabled: got %+v", p)
+	}
+}
@@ -0,0 +1,193 @@
+package rag
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// FTS4 has no bm25(), so FTS4 indexes are ranked with BM25-lite: the
+// candidates' matchinfo() (term and document frequencies, column lengths) is
+// scored in Go with the usual Okapi parameters, the same ones FTS5 uses.
+const (
+	fts4K1 = 1.2
+	fts4B  = 0.75
+
+	// fts4MaxCandidates bounds how many matches are scored; past it, an OR of
+	// very common words keeps the first matches in index order
+	fts4MaxCandidates = 10000
+
+	// fts4MatchInfo asks for phrase and column counts, row count, average
+	// and row column lengths, and per phrase and column hit statistics
+	fts4MatchInfo = "pcnalx"
+	fts4TextCol   = 1 // chunk_id, text
+)
+
+// searchFTS4 ranks the matches of an FTS4 table with BM25-lite and loads
+// the best limit of them
+func (s *SQLiteBM25Searcher) searchFTS4(ctx context.Context, terms []QueryTerm, limit int, filter SearchFilter) ([]BM25Hit, error) {
+	sqlQuery, args := s.fts4CandidateQuery(terms, filter)
+	if sqlQuery == "" {
+		return []BM25Hit{}, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("BM25 search query: %w", err)
+	}
+	type candidate struct {
+		rowid int64
+		score float64
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		var info []byte
+		if err := rows.Scan(&c.rowid, &info); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scanning BM25 candidate: %w", err)
+		}
+		c.score = fts4BM25(info)
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating BM25 candidates: %w", err)
+	}
+
+	slices.SortStableFunc(candidates, func(a, b candidate) int { return cmp.Compare(b.score, a.score) })
+	candidates = candidates[:min(limit, len(candidates))]
+	if len(candidates) == 0 {
+		return []BM25Hit{}, nil
+	}
+
+	ids := make([]any, len(candidates))
+	ranks := make(map[int64]int, len(candidates))
+	for i, c := range candidates {
+		ids[i] = c.rowid
+		ranks[c.rowid] = i
+	}
+	rows, err = s.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT c.rowid, %s,
+			0 as bm25_score
+		FROM chunks c
+		WHERE c.rowid IN (%s)
+	`, bm25HitColumns, placeholders(len(ids))), ids...)
+	if err != nil {
+		return nil, fmt.Errorf("loading BM25 results: %w", err)
+	}
+	defer rows.Close()
+
+	results := make([]BM25Hit, len(candidates))
+	for rows.Next() {
+		var rowid int64
+		hit, err := scanBM25Hit(rows, &rowid)
+		if err != nil {
+			return nil, err
+		}
+		i := ranks[rowid]
+		hit.Rank = i + 1
+		hit.Score = candidates[i].score
+		results[i] = hit
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating BM25 results: %w", err)
+	}
+	// A chunk deleted between the two queries leaves a gap
+	results = slices.DeleteFunc(results, func(h BM25Hit) bool { return h.ChunkID == "" })
+	for i := range results {
+		results[i].Rank = i + 1
+	}
+	return results, nil
+}
+
+// fts4CandidateQuery selects the rowid and matchinfo of every chunk matching
+// terms and filter, up to fts4MaxCandidates
+func (s *SQLiteBM25Searcher) fts4CandidateQuery(terms []QueryTerm, filter SearchFilter) (string, []any) {
+	ftsQuery := buildFTS4Query(terms)
+	if ftsQuery == "" {
+		return "", nil
+	}
+
+	args := []any{ftsQuery}
+	filterClause, filterArgs := sqliteFilterClause(filter)
+	args = append(args, filterArgs...)
+	args = append(args, fts4MaxCandidates)
+
+	sqlQuery := fmt.Sprintf(`
+		SELECT c.rowid, matchinfo(%s, '%s')
+		FROM %s fts
+		JOIN chunks c ON c.rowid = fts.docid
+		WHERE %s MATCH ?
+		AND c.is_indexable = %d
+		%s
+		LIMIT ?
+	`, s.ftsTable, fts4MatchInfo, s.ftsTable, s.ftsTable, indexableFlag(filter), filterClause)
+	return sqlQuery, args
+}
+
+// fts4BM25 scores a row from its matchinfo 'pcnalx' blob: the BM25 of the
+// text column summed over the query's phrases. Malformed blobs score 0.
+func fts4BM25(info []byte) float64 {
+	if len(info)%4 != 0 {
+		return 0
+	}
+	v := make([]uint32, len(info)/4)
+	for i := range v {
+		v[i] = binary.NativeEndian.Uint32(info[i*4:])
+	}
+	if len(v) < 3 {
+		return 0
+	}
+	phrases, cols, rowCount := int(v[0]), int(v[1]), float64(v[2])
+	if fts4TextCol >= cols || len(v) != 3+2*cols+3*phrases*cols {
+		return 0
+	}
+	avgLen := float64(v[3+fts4TextCol])
+	rowLen := float64(v[3+cols+fts4TextCol])
+	if avgLen == 0 {
+		avgLen = 1
+	}
+	hits := v[3+2*cols:]
+
+	var score float64
+	for p := range phrases {
+		x := hits[3*(p*cols+fts4TextCol):]
+		tf, docs := float64(x[0]), float64(x[2])
+		if tf == 0 {
+			continue
+		}
+		idf := math.Log(1 + (rowCount-docs+0.5)/(docs+0.5))
+		score += idf * tf * (fts4K1 + 1) / (tf + fts4K1*(1-fts4B+fts4B*rowLen/avgLen))
+	}
+	return score
+}
+
+// buildFTS4Query converts analyzed terms to the FTS4 standard query syntax,
+// OR-ing them like buildFTSQuery. FTS4 strings can't hold a double quote, so
+// quotes in phrases become spaces (the tokenizer drops them anyway) and the
+// prefix star goes inside the quotes.
+func buildFTS4Query(terms []QueryTerm) string {
+	quoted := make([]string, 0, len(terms))
+	for _, t := range terms {
+		if t.Phrase {
+			if escapeFTSPhrase(t.Text) != "" {
+				quoted = append(quoted, `"`+strings.ReplaceAll(t.Text, `"`, " ")+`"`)
+			}
+			continue
+		}
+		w := escapeFTSWord(t.Text)
+		if w == "" {
+			continue
+		}
+		if t.Prefix {
+			w += "*"
+		}
+		quoted = append(quoted, `"`+w+`"`)
+	}
+	return strings.Join(quoted, " OR ")
+}
@@ -0,0 +1,74 @@
+package rag
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+)
+
+func TestSQLiteBM25Searcher_FTS4(t *testing.T) {
+	db := newTestChunkDB(t)
+	ctx := context.Background()
+	for id, text := range map[string]string{
+		"a": "Anna: the boat is at the lake, the boat needs paint",
+		"b": "Bob: boat",
+		"c": "Bob: we could take the boat to the island over the long weekend if the weather holds",
+		"d": "Cecilia: Zażółć gęślą jaźń, no boats here",
+	} {
+		if _, err := db.Exec("UPDATE chunks SET text = ? WHERE chunk_id = ?", text, id); err != nil {
+			t.Fatalf("updating chunk: %v", err)
+		}
+	}
+	if err := ragindex.EnsureTables(ctx, db, "chunks_fts", ragconfig.BM25EngineFTS4, "", io.Discard); err != nil {
+		t.Fatalf("EnsureTables: %v", err)
+	}
+	s, err := NewSQLiteBM25Searcher(db, ragconfig.Default())
+	if err != nil {
+		t.Fatalf("NewSQLiteBM25Searcher: %v", err)
+	}
+	if engine, err := s.CheckFTS(ctx); err != nil || engine != ragconfig.BM25EngineFTS4 {
+		t.Fatalf("CheckFTS = %q, %v", engine, err)
+	}
+
+	// Two hits beat one, a short chunk beats a long one; b isn't indexable
+	hits, err := s.Search(ctx, []QueryTerm{{Text: "boat"}}, 10, SearchFilter{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(hits) != 2 || hits[0].ChunkID != "a" || hits[1].ChunkID != "c" ||
+		hits[0].Rank != 1 || hits[1].Rank != 2 || hits[0].Score <= hits[1].Score || hits[1].Score <= 0 {
+		t.Fatalf("unexpected hits %+v", hits)
+	}
+	if hits[0].Text == "" || hits[0].ThreadName != "T" || len(hits[0].ParticipantNames) != 1 {
+		t.Errorf("hit not fully loaded: %+v", hits[0])
+	}
+
+	hits, err = s.Search(ctx, []QueryTerm{{Text: "boat", Prefix: true}, {Text: `long "weekend`, Phrase: true}}, 1, SearchFilter{})
+	if err != nil {
+		t.Fatalf("Search with prefix and phrase: %v", err)
+	}
+	if len(hits) != 1 || hits[0].ChunkID != "c" {
+		t.Errorf("expected the phrase match first, got %+v", hits)
+	}
+
+	hits, err = s.Search(ctx, []QueryTerm{{Text: "boat"}}, 10, SearchFilter{NonIndexable: true})
+	if err != nil || len(hits) != 1 || hits[0].ChunkID != "b" {
+		t.Errorf("NonIndexable search: %+v, %v", hits, err)
+	}
+
+	suggestions, err := s.Suggest(ctx, foldFTSTerm("Gęś"), 1, 5)
+	if err != nil {
+		t.Fatalf("Suggest: %v", err)
+	}
+	if len(suggestions) != 1 || suggestions[0].Term != "gesla" || suggestions[0].Docs != 1 {
+		t.Errorf("unexpected suggestions %+v", suggestions)
+	}
+
+	stats, err := s.Stats(ctx)
+	if err != nil || !stats.FtsAvailable || stats.FtsEngine != ragconfig.BM25EngineFTS4 {
+		t.Errorf("unexpected stats %+v, %v", stats, err)
+	}
+}
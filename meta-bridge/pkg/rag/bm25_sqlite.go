@@ -7,14 +7,22 @@ import (
 	"math"
 	"regexp"
 	"strings"
+	"sync"
+	"unicode"
 
 	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
 )
 
-// SQLiteBM25Searcher implements BM25Searcher using SQLite FTS5
+// SQLiteBM25Searcher implements BM25Searcher using SQLite FTS5, or FTS4
+// with BM25-lite ranking where the index was built without FTS5
 type SQLiteBM25Searcher struct {
 	db       *sql.DB
 	ftsTable string
+
+	mu     sync.Mutex
+	engine string // Module of the FTS table, looked up on first use
+	stems  bool   // The table's tokenizer stems words, looked up with engine
 }
 
 // NewSQLiteBM25Searcher creates a new SQLite BM25 searcher
@@ -41,18 +49,124 @@ func isValidIdentifier(s string) bool {
 	return matched
 }
 
+// ftsEngine returns the module of the FTS table. It is looked up once the
+// table exists; until then (and for FTS5 tables) it is ragconfig.BM25EngineFTS5.
+func (s *SQLiteBM25Searcher) ftsEngine(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.engine != "" {
+		return s.engine, nil
+	}
+	engine, err := ragindex.TableFTSEngine(ctx, s.db, s.ftsTable)
+	if err != nil {
+		return "", err
+	}
+	if engine == "" {
+		return ragconfig.BM25EngineFTS5, nil
+	}
+	if engine == ragconfig.BM25EngineFTS5 {
+		tokenize, err := ragindex.TableTokenizer(ctx, s.db, s.ftsTable)
+		if err != nil {
+			return "", err
+		}
+		s.stems = ragindex.TokenizerStems(tokenize)
+	}
+	s.engine = engine
+	return engine, nil
+}
+
+// IndexStems reports whether the FTS table was built with a stemming
+// tokenizer, which stems query words as well
+func (s *SQLiteBM25Searcher) IndexStems(ctx context.Context) bool {
+	if _, err := s.ftsEngine(ctx); err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stems
+}
+
+// CheckFTS returns the engine of the FTS table, or "" if it doesn't exist.
+// It fails with ragindex.ErrNoFTS5 if the table needs FTS5 and this build
+// lacks it, so servers can say so at startup rather than on every search.
+func (s *SQLiteBM25Searcher) CheckFTS(ctx context.Context) (string, error) {
+	return ragindex.CheckFTSTable(ctx, s.db, s.ftsTable)
+}
+
+// LogFTSStatus checks the FTS table with CheckFTS and logs what keyword
+// search will use, or why it won't work and how to fix that
+func (s *SQLiteBM25Searcher) LogFTSStatus(ctx context.Context) {
+	logger := ctxLogger(ctx)
+	engine, err := s.CheckFTS(ctx)
+	switch {
+	case err != nil:
+		logger.Error().Err(err).Str("table", s.ftsTable).Msg("Keyword search is unavailable")
+	case engine == "":
+		logger.Warn().Str("table", s.ftsTable).Msg("FTS table doesn't exist, keyword search is unavailable until fts5-setup or rag-pipeline runs")
+	case engine == ragconfig.BM25EngineFTS4:
+		logger.Info().Str("table", s.ftsTable).Msg("Using FTS4 index with BM25-lite ranking")
+	default:
+		if tokenize, _ := ragindex.TableTokenizer(ctx, s.db, s.ftsTable); tokenize != "" {
+			logger.Info().Str("table", s.ftsTable).Str("tokenize", tokenize).Msg("Using FTS5 index with a custom tokenizer")
+		}
+	}
+}
+
+// ftsError adds what to do to errors from a build without FTS5, or a
+// connection without the table's tokenizer
+func ftsError(err error) error {
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "no such module: fts5"):
+		return fmt.Errorf("%w (%w): %s", err, ragindex.ErrNoFTS5, ragindex.FTS5Hint)
+	case strings.Contains(msg, "no such tokenizer"):
+		return fmt.Errorf("%w (%w): %s", err, ragindex.ErrNoTokenizer, ragindex.TokenizerHint)
+	}
+	return err
+}
+
 // Search performs a BM25 full-text search
-func (s *SQLiteBM25Searcher) Search(ctx context.Context, query string, limit int) ([]BM25Hit, error) {
-	// Build FTS5 query from user input
-	ftsQuery := buildFTSQuery(query)
-	if ftsQuery == "" {
+func (s *SQLiteBM25Searcher) Search(ctx context.Context, terms []QueryTerm, limit int, filter SearchFilter) ([]BM25Hit, error) {
+	engine, err := s.ftsEngine(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("BM25 search: %w", err)
+	}
+	if engine == ragconfig.BM25EngineFTS4 {
+		return s.searchFTS4(ctx, terms, limit, filter)
+	}
+
+	sqlQuery, args := s.searchQuery(engine, terms, limit, filter)
+	if sqlQuery == "" {
 		return []BM25Hit{}, nil
 	}
 
-	// Query with FTS5 MATCH
-	// Note: bm25() returns negative scores where more negative = better match
-	sqlQuery := fmt.Sprintf(`
-		SELECT
+	rows, err := s.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("BM25 search query: %w", ftsError(err))
+	}
+	defer rows.Close()
+
+	var results []BM25Hit
+	for rows.Next() {
+		hit, err := scanBM25Hit(rows)
+		if err != nil {
+			return nil, err
+		}
+		hit.Rank = len(results) + 1
+		// BM25 scores are negative (lower = better match), convert to positive
+		hit.Score = math.Abs(hit.Score)
+		results = append(results, hit)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating BM25 results: %w", err)
+	}
+
+	return results, nil
+}
+
+// bm25HitColumns are the chunks columns scanBM25Hit reads, in order; the
+// score follows them
+const bm25HitColumns = `
 			c.chunk_id,
 			c.thread_id,
 			c.thread_name,
@@ -64,67 +178,163 @@ func (s *SQLiteBM25Searcher) Search(ctx context.Context, query string, limit int
 			c.message_ids,
 			c.start_timestamp_ms,
 			c.end_timestamp_ms,
-			c.message_count,
+			c.message_count`
+
+// scanBM25Hit reads a row of bm25HitColumns and a score, after any columns
+// scanned into lead
+func scanBM25Hit(rows *sql.Rows, lead ...any) (BM25Hit, error) {
+	var hit BM25Hit
+	var participantIDsJSON, participantNamesJSON, messageIDsJSON string
+	var threadName sql.NullString
+
+	err := rows.Scan(append(lead,
+		&hit.ChunkID,
+		&hit.ThreadID,
+		&threadName,
+		&hit.SessionIdx,
+		&hit.ChunkIdx,
+		&participantIDsJSON,
+		&participantNamesJSON,
+		&hit.Text,
+		&messageIDsJSON,
+		&hit.StartTimestampMs,
+		&hit.EndTimestampMs,
+		&hit.MessageCount,
+		&hit.Score,
+	)...)
+	if err != nil {
+		return hit, fmt.Errorf("scanning BM25 result: %w", err)
+	}
+
+	hit.ThreadName = threadName.String
+
+	// Parse JSON arrays
+	hit.ParticipantIDs = parseIntArray(participantIDsJSON)
+	hit.ParticipantNames = parseStringArray(participantNamesJSON)
+	hit.MessageIDs = parseStringArray(messageIDsJSON)
+	return hit, nil
+}
+
+// searchQuery builds the query for Search; an empty query means the terms
+// can't match anything. For FTS4 it is the candidate query of searchFTS4.
+func (s *SQLiteBM25Searcher) searchQuery(engine string, terms []QueryTerm, limit int, filter SearchFilter) (string, []any) {
+	if engine == ragconfig.BM25EngineFTS4 {
+		return s.fts4CandidateQuery(terms, filter)
+	}
+
+	// Build FTS5 query from the analyzed terms
+	ftsQuery := buildFTSQuery(terms)
+	if ftsQuery == "" {
+		return "", nil
+	}
+
+	args := []any{ftsQuery}
+	filterClause, filterArgs := sqliteFilterClause(filter)
+	args = append(args, filterArgs...)
+
+	// Query with FTS5 MATCH
+	// Note: bm25() returns negative scores where more negative = better match
+	sqlQuery := fmt.Sprintf(`
+		SELECT %s,
 			bm25(%s) as bm25_score
 		FROM %s fts
 		JOIN chunks c ON c.chunk_id = fts.chunk_id
 		WHERE %s MATCH ?
-		AND c.is_indexable = 1
+		AND c.is_indexable = %d
+		%s
 		ORDER BY bm25(%s)
 		LIMIT ?
-	`, s.ftsTable, s.ftsTable, s.ftsTable, s.ftsTable)
+	`, bm25HitColumns, s.ftsTable, s.ftsTable, s.ftsTable, indexableFlag(filter), filterClause, s.ftsTable)
 
-	rows, err := s.db.QueryContext(ctx, sqlQuery, ftsQuery, limit)
-	if err != nil {
-		return nil, fmt.Errorf("BM25 search query: %w", err)
+	args = append(args, limit)
+	return sqlQuery, args
+}
+
+// indexableFlag is the is_indexable value filter searches. The FTS table
+// holds every chunk; quality is decided by the join.
+func indexableFlag(filter SearchFilter) int {
+	if filter.NonIndexable {
+		return 0
 	}
-	defer rows.Close()
+	return 1
+}
 
-	var results []BM25Hit
-	rank := 0
-	for rows.Next() {
-		rank++
-		var hit BM25Hit
-		var participantIDsJSON, participantNamesJSON, messageIDsJSON string
-		var threadName sql.NullString
-
-		err := rows.Scan(
-			&hit.ChunkID,
-			&hit.ThreadID,
-			&threadName,
-			&hit.SessionIdx,
-			&hit.ChunkIdx,
-			&participantIDsJSON,
-			&participantNamesJSON,
-			&hit.Text,
-			&messageIDsJSON,
-			&hit.StartTimestampMs,
-			&hit.EndTimestampMs,
-			&hit.MessageCount,
-			&hit.Score,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("scanning BM25 result: %w", err)
+// sqliteFilterClause converts a search filter to AND conditions on the chunks
+// table (aliased c) and their arguments
+func sqliteFilterClause(filter SearchFilter) (string, []any) {
+	var conds []string
+	var args []any
+	if filter.ThreadIDs != nil {
+		conds = append(conds, "c.thread_id IN ("+placeholders(len(filter.ThreadIDs))+")")
+		for _, id := range filter.ThreadIDs {
+			args = append(args, id)
 		}
+	}
+	if filter.Sender != "" {
+		// participant_names is a JSON array; match the name as it's encoded there
+		conds = append(conds, "instr(c.participant_names, ?) > 0")
+		args = append(args, jsonStringFragment(filter.Sender))
+	}
+	if filter.Source != "" {
+		conds = append(conds, "instr(COALESCE(c.sources, ''), ?) > 0")
+		args = append(args, sourceFragment(filter.Source))
+	}
+	if filter.AfterMs != 0 {
+		conds = append(conds, "c.end_timestamp_ms >= ?")
+		args = append(args, filter.AfterMs)
+	}
+	if filter.BeforeMs != 0 {
+		conds = append(conds, "c.start_timestamp_ms < ?")
+		args = append(args, filter.BeforeMs)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "AND " + strings.Join(conds, " AND "), args
+}
 
-		hit.ThreadName = threadName.String
-		hit.Rank = rank
-		// BM25 scores are negative (lower = better match), convert to positive
-		hit.Score = math.Abs(hit.Score)
-
-		// Parse JSON arrays
-		hit.ParticipantIDs = parseIntArray(participantIDsJSON)
-		hit.ParticipantNames = parseStringArray(participantNamesJSON)
-		hit.MessageIDs = parseStringArray(messageIDsJSON)
+// ExplainSearch returns SQLite's EXPLAIN QUERY PLAN for the query Search would
+// run, one step per line, indented by nesting
+func (s *SQLiteBM25Searcher) ExplainSearch(ctx context.Context, terms []QueryTerm, limit int, filter SearchFilter) (string, error) {
+	engine, err := s.ftsEngine(ctx)
+	if err != nil {
+		return "", fmt.Errorf("explaining BM25 query: %w", err)
+	}
+	sqlQuery, args := s.searchQuery(engine, terms, limit, filter)
+	if sqlQuery == "" {
+		return "", nil
+	}
 
-		results = append(results, hit)
+	rows, err := s.db.QueryContext(ctx, "EXPLAIN QUERY PLAN "+sqlQuery, args...)
+	if err != nil {
+		return "", fmt.Errorf("explaining BM25 query: %w", err)
 	}
+	defer rows.Close()
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterating BM25 results: %w", err)
+	depth := map[int]int{}
+	var sb strings.Builder
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			return "", fmt.Errorf("scanning query plan: %w", err)
+		}
+		depth[id] = depth[parent] + 1
+		if sb.Len() > 0 {
+			sb.WriteByte('\n')
+		}
+		sb.WriteString(strings.Repeat("  ", depth[id]-1))
+		sb.WriteString(detail)
 	}
+	return sb.String(), rows.Err()
+}
 
-	return results, nil
+// placeholders returns n comma-separated SQL bind placeholders
+func placeholders(n int) string {
+	if n <= 0 {
+		return "NULL"
+	}
+	return "?" + strings.Repeat(", ?", n-1)
 }
 
 // Stats returns SQLite statistics
@@ -152,30 +362,35 @@ func (s *SQLiteBM25Searcher) Stats(ctx context.Context) (SQLiteStats, error) {
 		`SELECT name FROM sqlite_master WHERE type='table' AND name=?`, s.ftsTable)
 	if err := row.Scan(&name); err == nil {
 		stats.FtsAvailable = true
+		stats.FtsEngine, _ = s.ftsEngine(ctx)
 	}
 
 	return stats, nil
 }
 
-// buildFTSQuery converts user input to FTS5 query syntax.
+// buildFTSQuery converts analyzed terms to FTS5 query syntax.
 // Uses OR between terms for broad recall (keep consistent with the web UI).
 // Examples:
 //   - "cat dog"   -> "cat" OR "dog"
 //   - "cat | dog" -> "cat" OR "dog"
-func buildFTSQuery(query string) string {
-	// Remove quotes (we'll add our own)
-	query = strings.ReplaceAll(query, `"`, "")
-	query = strings.ReplaceAll(query, `'`, "")
-	query = strings.ReplaceAll(query, "|", " ")
-
-	words := strings.Fields(query)
-	quoted := make([]string, 0, len(words))
-	for _, w := range words {
-		if len(w) <= 1 {
+//   - stemmed "kotami" -> "kot"*
+//   - verbatim `PL61 1090/7 "A"` -> "PL61 1090/7 ""A"""
+func buildFTSQuery(terms []QueryTerm) string {
+	quoted := make([]string, 0, len(terms))
+	for _, t := range terms {
+		if t.Phrase {
+			if p := escapeFTSPhrase(t.Text); p != "" {
+				quoted = append(quoted, p)
+			}
 			continue
 		}
-		w = escapeFTSWord(w)
-		if w != "" {
+		w := escapeFTSWord(t.Text)
+		if w == "" {
+			continue
+		}
+		if t.Prefix {
+			quoted = append(quoted, fmt.Sprintf(`"%s"*`, w))
+		} else {
 			quoted = append(quoted, fmt.Sprintf(`"%s"`, w))
 		}
 	}
@@ -201,3 +416,14 @@ func escapeFTSWord(word string) string {
 	)
 	return replacer.Replace(word)
 }
+
+// escapeFTSPhrase quotes text as one FTS5 string, doubling embedded quotes,
+// so every character reaches the tokenizer. The tokenizer still splits on
+// punctuation, but the phrase requires the pieces in order: "5/7" matches
+// "5/7" and "5-7", never "7 ... 5". Returns "" if nothing would be indexed.
+func escapeFTSPhrase(text string) string {
+	if !strings.ContainsFunc(text, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) {
+		return ""
+	}
+	return `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+}
@@ -3,7 +3,12 @@ package rag
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
+
+	"go.mau.fi/mautrix-meta/pkg/chunking"
+	"go.mau.fi/mautrix-meta/pkg/storage"
 )
 
 // SQLiteChunkStore implements ChunkStore using SQLite
@@ -18,6 +23,11 @@ func NewSQLiteChunkStore(db *sql.DB) *SQLiteChunkStore {
 
 // GetContext retrieves chunks within a radius of the specified chunk
 func (s *SQLiteChunkStore) GetContext(ctx context.Context, threadID int64, sessionIdx, chunkIdx, radius int) ([]ContextChunk, error) {
+	return s.contextRange(ctx, threadID, sessionIdx, chunkIdx-radius, chunkIdx+radius)
+}
+
+// contextRange loads the chunks of a session with chunk_idx in [minIdx, maxIdx]
+func (s *SQLiteChunkStore) contextRange(ctx context.Context, threadID int64, sessionIdx, minIdx, maxIdx int) ([]ContextChunk, error) {
 	query := `
 		SELECT
 			chunk_id,
@@ -31,9 +41,6 @@ func (s *SQLiteChunkStore) GetContext(ctx context.Context, threadID int64, sessi
 		ORDER BY chunk_idx
 	`
 
-	minIdx := chunkIdx - radius
-	maxIdx := chunkIdx + radius
-
 	rows, err := s.db.QueryContext(ctx, query, threadID, sessionIdx, minIdx, maxIdx)
 	if err != nil {
 		return nil, fmt.Errorf("querying context: %w", err)
@@ -61,28 +68,62 @@ func (s *SQLiteChunkStore) GetContext(ctx context.Context, threadID int64, sessi
 	return results, nil
 }
 
-// GetByID retrieves a single chunk by its ID
-func (s *SQLiteChunkStore) GetByID(ctx context.Context, chunkID string) (*Chunk, error) {
-	query := `
-		SELECT
-			chunk_id,
-			thread_id,
-			thread_name,
-			session_idx,
-			chunk_idx,
-			participant_ids,
-			participant_names,
-			text,
-			message_ids,
-			start_timestamp_ms,
-			end_timestamp_ms,
-			message_count
-		FROM chunks
-		WHERE chunk_id = ?
-	`
+// MaxChunkContext caps the chunks ChunkContext loads on each side
+const MaxChunkContext = 20
+
+// ChunkContext loads a chunk with up to before and after chunks around it in
+// its session (clamped to 0..MaxChunkContext), so clients can expand a hit's
+// context on demand. Unknown IDs fail with ErrNotFound.
+func (s *SQLiteChunkStore) ChunkContext(ctx context.Context, chunkID string, before, after int) (*ChunkContext, error) {
+	chunk, err := s.GetByID(ctx, chunkID)
+	if err != nil {
+		return nil, err
+	}
+	before = min(max(before, 0), MaxChunkContext)
+	after = min(max(after, 0), MaxChunkContext)
+
+	// One more chunk on each side tells whether the session goes on
+	around, err := s.contextRange(ctx, chunk.ThreadID, chunk.SessionIdx, chunk.ChunkIdx-before-1, chunk.ChunkIdx+after+1)
+	if err != nil {
+		return nil, err
+	}
+	out := &ChunkContext{Chunk: chunk, ContextBefore: []ContextChunk{}, ContextAfter: []ContextChunk{}}
+	for _, cc := range around {
+		switch {
+		case cc.ChunkIdx < chunk.ChunkIdx-before:
+			out.HasMoreBefore = true
+		case cc.ChunkIdx < chunk.ChunkIdx:
+			out.ContextBefore = append(out.ContextBefore, cc)
+		case cc.ChunkIdx > chunk.ChunkIdx+after:
+			out.HasMoreAfter = true
+		case cc.ChunkIdx > chunk.ChunkIdx:
+			out.ContextAfter = append(out.ContextAfter, cc)
+		}
+	}
+	return out, nil
+}
 
-	row := s.db.QueryRowContext(ctx, query, chunkID)
+// chunkColumns are the chunks table columns read by scanChunk, in order
+const chunkColumns = `
+	chunk_id,
+	thread_id,
+	thread_name,
+	session_idx,
+	chunk_idx,
+	participant_ids,
+	participant_names,
+	text,
+	message_ids,
+	start_timestamp_ms,
+	end_timestamp_ms,
+	message_count,
+	char_count,
+	alnum_count,
+	unique_word_count,
+	is_indexable`
 
+// scanChunk reads a row selected with chunkColumns
+func scanChunk(row interface{ Scan(...any) error }) (*Chunk, error) {
 	var chunk Chunk
 	var threadName sql.NullString
 	var participantIDsJSON, participantNamesJSON, messageIDsJSON string
@@ -100,18 +141,296 @@ func (s *SQLiteChunkStore) GetByID(ctx context.Context, chunkID string) (*Chunk,
 		&chunk.StartTimestampMs,
 		&chunk.EndTimestampMs,
 		&chunk.MessageCount,
+		&chunk.CharCount,
+		&chunk.AlnumCount,
+		&chunk.UniqueWordCount,
+		&chunk.IsIndexable,
 	)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
 	if err != nil {
-		return nil, fmt.Errorf("scanning chunk: %w", err)
+		return nil, err
 	}
 
 	chunk.ThreadName = threadName.String
 	chunk.ParticipantIDs = parseIntArray(participantIDsJSON)
 	chunk.ParticipantNames = parseStringArray(participantNamesJSON)
 	chunk.MessageIDs = parseStringArray(messageIDsJSON)
-
 	return &chunk, nil
 }
+
+// GetByID retrieves a single chunk by its ID, or ErrNotFound
+func (s *SQLiteChunkStore) GetByID(ctx context.Context, chunkID string) (*Chunk, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+chunkColumns+` FROM chunks WHERE chunk_id = ?`, chunkID)
+	chunk, err := scanChunk(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("chunk %s: %w", chunkID, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("scanning chunk: %w", err)
+	}
+	replies, err := s.GetReplies(ctx, []string{chunkID})
+	if err != nil {
+		return nil, err
+	}
+	chunk.Replies = replies[chunkID]
+	sources, err := s.GetSources(ctx, []string{chunkID})
+	if err != nil {
+		return nil, err
+	}
+	chunk.Sources = sources[chunkID]
+	return chunk, nil
+}
+
+// ChunkListFilter narrows ListChunks; zero values don't filter
+type ChunkListFilter struct {
+	ThreadID  int64
+	Indexable *bool // nil = both
+	MinChars  int
+}
+
+// ListChunks pages through chunks in thread/session/chunk order without
+// searching, returning the page and the total number of matching chunks
+func (s *SQLiteChunkStore) ListChunks(ctx context.Context, filter ChunkListFilter, limit, offset int) ([]Chunk, int64, error) {
+	var where []string
+	var args []any
+	if filter.ThreadID != 0 {
+		where = append(where, "thread_id = ?")
+		args = append(args, filter.ThreadID)
+	}
+	if filter.Indexable != nil {
+		where = append(where, "is_indexable = ?")
+		args = append(args, *filter.Indexable)
+	}
+	if filter.MinChars > 0 {
+		where = append(where, "char_count >= ?")
+		args = append(args, filter.MinChars)
+	}
+	whereClause := ""
+	if len(where) > 0 {
+		whereClause = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int64
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM chunks `+whereClause, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("counting chunks: %w", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+chunkColumns+`
+		FROM chunks
+		`+whereClause+`
+		ORDER BY thread_id, session_idx, chunk_idx
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("listing chunks: %w", err)
+	}
+	defer rows.Close()
+
+	chunks := []Chunk{}
+	for rows.Next() {
+		chunk, err := scanChunk(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("scanning chunk: %w", err)
+		}
+		chunks = append(chunks, *chunk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	ids := make([]string, len(chunks))
+	for i, c := range chunks {
+		ids[i] = c.ChunkID
+	}
+	replies, err := s.GetReplies(ctx, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	sources, err := s.GetSources(ctx, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range chunks {
+		chunks[i].Replies = replies[chunks[i].ChunkID]
+		chunks[i].Sources = sources[chunks[i].ChunkID]
+	}
+	return chunks, total, nil
+}
+
+// GetQuality returns the quality metrics of the given chunks, keyed by chunk ID
+func (s *SQLiteChunkStore) GetQuality(ctx context.Context, chunkIDs []string) (map[string]ChunkQuality, error) {
+	out := make(map[string]ChunkQuality, len(chunkIDs))
+	if len(chunkIDs) == 0 {
+		return out, nil
+	}
+
+	args := make([]any, len(chunkIDs))
+	for i, id := range chunkIDs {
+		args[i] = id
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT chunk_id, char_count, alnum_count, unique_word_count, is_indexable
+		FROM chunks
+		WHERE chunk_id IN (`+placeholders(len(chunkIDs))+`)
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying chunk quality: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var q ChunkQuality
+		if err := rows.Scan(&id, &q.CharCount, &q.AlnumCount, &q.UniqueWordCount, &q.IsIndexable); err != nil {
+			return nil, fmt.Errorf("scanning chunk quality: %w", err)
+		}
+		out[id] = q
+	}
+	return out, rows.Err()
+}
+
+// GetReplies returns the reply links of the given chunks that have any, keyed
+// by chunk ID. Chunks tables built before reply links existed have none.
+func (s *SQLiteChunkStore) GetReplies(ctx context.Context, chunkIDs []string) (map[string][]chunking.MessageReply, error) {
+	out := make(map[string][]chunking.MessageReply)
+	if len(chunkIDs) == 0 {
+		return out, nil
+	}
+
+	args := make([]any, len(chunkIDs))
+	for i, id := range chunkIDs {
+		args[i] = id
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT chunk_id, replies
+		FROM chunks
+		WHERE replies IS NOT NULL AND chunk_id IN (`+placeholders(len(chunkIDs))+`)
+	`, args...)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such column") {
+			return out, nil
+		}
+		return nil, fmt.Errorf("querying chunk replies: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, repliesJSON string
+		if err := rows.Scan(&id, &repliesJSON); err != nil {
+			return nil, fmt.Errorf("scanning chunk replies: %w", err)
+		}
+		var replies []chunking.MessageReply
+		if err := json.Unmarshal([]byte(repliesJSON), &replies); err == nil && len(replies) > 0 {
+			out[id] = replies
+		}
+	}
+	return out, rows.Err()
+}
+
+// GetSources returns the message provenances of the given chunks that have
+// any, keyed by chunk ID. Chunks built before sources were recorded have none.
+func (s *SQLiteChunkStore) GetSources(ctx context.Context, chunkIDs []string) (map[string][]string, error) {
+	out := make(map[string][]string)
+	if len(chunkIDs) == 0 {
+		return out, nil
+	}
+
+	args := make([]any, len(chunkIDs))
+	for i, id := range chunkIDs {
+		args[i] = id
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT chunk_id, sources
+		FROM chunks
+		WHERE sources IS NOT NULL AND chunk_id IN (`+placeholders(len(chunkIDs))+`)
+	`, args...)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such column") {
+			return out, nil
+		}
+		return nil, fmt.Errorf("querying chunk sources: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, sourcesJSON string
+		if err := rows.Scan(&id, &sourcesJSON); err != nil {
+			return nil, fmt.Errorf("scanning chunk sources: %w", err)
+		}
+		if sources := parseStringArray(sourcesJSON); len(sources) > 0 {
+			out[id] = sources
+		}
+	}
+	return out, rows.Err()
+}
+
+// ThreadIDsForTags returns the threads carrying any of the given (normalized) tags
+func (s *SQLiteChunkStore) ThreadIDsForTags(ctx context.Context, tags []string) ([]int64, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	args := make([]any, len(tags))
+	for i, t := range tags {
+		args[i] = t
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT thread_id FROM thread_tags
+		WHERE tag IN (`+placeholders(len(tags))+`)
+	`, args...)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return []int64{}, nil
+		}
+		return nil, fmt.Errorf("querying thread tags: %w", err)
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scanning thread tag: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// UniqueThreadIDForName returns the thread named exactly name in the
+// archive, if only one is. Without the archive's tables (a chunks-only
+// database), no thread is.
+func (s *SQLiteChunkStore) UniqueThreadIDForName(ctx context.Context, name string) (int64, bool, error) {
+	id, ok, err := storage.FindUniqueThreadIDByName(s.db, name)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("looking up thread name: %w", err)
+	}
+	return id, ok, nil
+}
+
+// ThreadNames returns the names of the indexed threads, once per thread and
+// name (a renamed thread's older chunks keep the old one)
+func (s *SQLiteChunkStore) ThreadNames(ctx context.Context) ([]NamedThread, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT thread_id, thread_name FROM chunks WHERE thread_name != ''`)
+	if err != nil {
+		return nil, fmt.Errorf("querying thread names: %w", err)
+	}
+	defer rows.Close()
+
+	var threads []NamedThread
+	for rows.Next() {
+		var t NamedThread
+		if err := rows.Scan(&t.ID, &t.Name); err != nil {
+			return nil, fmt.Errorf("scanning thread name: %w", err)
+		}
+		threads = append(threads, t)
+	}
+	return threads, rows.Err()
+}
@@ -0,0 +1,119 @@
+package rag
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestChunkDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(`
+		CREATE TABLE chunks (
+			chunk_id TEXT PRIMARY KEY,
+			thread_id INTEGER NOT NULL,
+			thread_name TEXT,
+			session_idx INTEGER NOT NULL,
+			chunk_idx INTEGER NOT NULL,
+			message_ids TEXT NOT NULL,
+			participant_ids TEXT NOT NULL,
+			participant_names TEXT NOT NULL,
+			text TEXT NOT NULL,
+			start_timestamp_ms INTEGER NOT NULL,
+			end_timestamp_ms INTEGER NOT NULL,
+			message_count INTEGER NOT NULL,
+			is_indexable INTEGER NOT NULL,
+			char_count INTEGER NOT NULL,
+			alnum_count INTEGER NOT NULL,
+			unique_word_count INTEGER NOT NULL
+		)
+	`); err != nil {
+		t.Fatalf("creating chunks: %v", err)
+	}
+	rows := []struct {
+		id        string
+		thread    int64
+		idx       int
+		indexable bool
+		chars     int
+	}{
+		{"a", 1, 0, true, 500},
+		{"b", 1, 1, false, 40},
+		{"c", 1, 2, true, 300},
+		{"d", 2, 0, true, 900},
+	}
+	for _, r := range rows {
+		if _, err := db.Exec(`
+			INSERT INTO chunks VALUES (?, ?, 'T', 0, ?, '["m"]', '[1]', '["Alice"]', 'text', 1, 2, 1, ?, ?, 0, 0)
+		`, r.id, r.thread, r.idx, r.indexable, r.chars); err != nil {
+			t.Fatalf("inserting chunk: %v", err)
+		}
+	}
+	return db
+}
+
+func TestListChunks_Filters(t *testing.T) {
+	store := NewSQLiteChunkStore(newTestChunkDB(t))
+	ctx := context.Background()
+
+	indexable := true
+	got, total, err := store.ListChunks(ctx, ChunkListFilter{ThreadID: 1, Indexable: &indexable, MinChars: 100}, 1, 0)
+	if err != nil {
+		t.Fatalf("ListChunks: %v", err)
+	}
+	if total != 2 || len(got) != 1 || got[0].ChunkID != "a" {
+		t.Fatalf("page 1: total=%d chunks=%+v", total, got)
+	}
+
+	got, _, err = store.ListChunks(ctx, ChunkListFilter{ThreadID: 1, Indexable: &indexable, MinChars: 100}, 1, 1)
+	if err != nil || len(got) != 1 || got[0].ChunkID != "c" {
+		t.Fatalf("page 2: %+v, %v", got, err)
+	}
+
+	if _, total, _ = store.ListChunks(ctx, ChunkListFilter{}, 10, 0); total != 4 {
+		t.Fatalf("unfiltered total = %d, want 4", total)
+	}
+
+	if _, err := store.GetByID(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetByID(missing): expected ErrNotFound, got %v", err)
+	}
+	if c, err := store.GetByID(ctx, "d"); err != nil || c.ThreadID != 2 || c.ParticipantNames[0] != "Alice" {
+		t.Fatalf("GetByID(d) = %+v, %v", c, err)
+	}
+}
+
+func TestChunkContext(t *testing.T) {
+	store := NewSQLiteChunkStore(newTestChunkDB(t))
+	ctx := context.Background()
+
+	// Thread 1's session holds a, b, c at chunk_idx 0, 1, 2
+	cc, err := store.ChunkContext(ctx, "b", 1, 1)
+	if err != nil {
+		t.Fatalf("ChunkContext: %v", err)
+	}
+	if cc.Chunk.ChunkID != "b" || len(cc.ContextBefore) != 1 || cc.ContextBefore[0].ChunkID != "a" ||
+		len(cc.ContextAfter) != 1 || cc.ContextAfter[0].ChunkID != "c" || cc.HasMoreBefore || cc.HasMoreAfter {
+		t.Errorf("ChunkContext(b, 1, 1) = %+v", cc)
+	}
+
+	cc, err = store.ChunkContext(ctx, "a", 5, 1)
+	if err != nil {
+		t.Fatalf("ChunkContext: %v", err)
+	}
+	if len(cc.ContextBefore) != 0 || cc.HasMoreBefore || len(cc.ContextAfter) != 1 || !cc.HasMoreAfter {
+		t.Errorf("ChunkContext(a, 5, 1) = %+v", cc)
+	}
+
+	if _, err := store.ChunkContext(ctx, "missing", 1, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ChunkContext(missing): expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package rag
+
+import (
+	"context"
+	"hash/fnv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// minHashSize is the number of hash functions in a MinHash signature; the
+// similarity estimate is off by about 1/sqrt(minHashSize)
+const minHashSize = 64
+
+// dedupEnabled reports whether a search collapses near-duplicate hits
+func (s *Service) dedupEnabled(req SearchRequest) bool {
+	if req.Dedup != nil {
+		return *req.Dedup
+	}
+	return s.cfg.Dedup.Enabled
+}
+
+// dedupHits drops hits that repeat a better-ranked one: near-identical text,
+// like a message forwarded to several threads or pasted twice, or, within a
+// session, mostly the same messages. Hits are kept in order; each one kept
+// lists the chunks dropped for it in Duplicates.
+func (s *Service) dedupHits(ctx context.Context, hits []Hit) []Hit {
+	start := time.Now()
+	defer recordStage(ctx, "dedup", start)
+
+	cfg := s.cfg.Dedup
+	sigs := make([]minHash, len(hits))
+	for i, h := range hits {
+		sigs[i] = newMinHash(h.Text, cfg.ShingleWords)
+	}
+	out := make([]Hit, 0, len(hits))
+	kept := make([]int, 0, len(hits)) // Index in hits of each hit in out
+	for i, h := range hits {
+		dup := -1
+		for j, k := range kept {
+			if cfg.Similarity > 0 && sigs[i].similarity(sigs[k]) >= cfg.Similarity ||
+				cfg.SessionOverlap > 0 && sessionOverlap(hits[k].Chunk, h.Chunk) >= cfg.SessionOverlap {
+				dup = j
+				break
+			}
+		}
+		if dup >= 0 {
+			out[dup].Duplicates = append(out[dup].Duplicates, h.ChunkID)
+			continue
+		}
+		out = append(out, h)
+		kept = append(kept, i)
+	}
+	return out
+}
+
+// sessionOverlap returns the share of the smaller chunk's messages that the
+// other chunk has too, or 0 for chunks of different sessions
+func sessionOverlap(a, b Chunk) float64 {
+	if a.ThreadID != b.ThreadID || a.SessionIdx != b.SessionIdx || len(a.MessageIDs) == 0 || len(b.MessageIDs) == 0 {
+		return 0
+	}
+	if len(a.MessageIDs) > len(b.MessageIDs) {
+		a, b = b, a
+	}
+	in := make(map[string]bool, len(b.MessageIDs))
+	for _, id := range b.MessageIDs {
+		in[id] = true
+	}
+	shared := 0
+	for _, id := range a.MessageIDs {
+		if in[id] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a.MessageIDs))
+}
+
+// minHash is a MinHash signature of a text's word shingles: for each of
+// minHashSize hash functions, the least hash of any shingle. The share of
+// positions where two signatures agree estimates the Jaccard similarity of
+// the shingle sets. Nil for a text without words.
+type minHash []uint64
+
+// newMinHash signs the runs of size consecutive words of text, lowercased
+// and without punctuation. A text shorter than size is one shingle.
+func newMinHash(text string, size int) minHash {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) == 0 {
+		return nil
+	}
+	size = min(max(size, 1), len(words))
+
+	sig := make(minHash, minHashSize)
+	for i := range sig {
+		sig[i] = ^uint64(0)
+	}
+	for i := 0; i+size <= len(words); i++ {
+		h := fnv.New64a()
+		for _, w := range words[i : i+size] {
+			h.Write([]byte(w))
+			h.Write([]byte{0})
+		}
+		shingle := h.Sum64()
+		for j := range sig {
+			sig[j] = min(sig[j], mix64(shingle+uint64(j)*0x9e3779b97f4a7c15))
+		}
+	}
+	return sig
+}
+
+// similarity estimates the Jaccard similarity of the signed shingle sets
+func (m minHash) similarity(other minHash) float64 {
+	if m == nil || other == nil {
+		return 0
+	}
+	same := 0
+	for i := range m {
+		if m[i] == other[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(m))
+}
+
+// mix64 is the splitmix64 finalizer, which turns one shingle hash into
+// minHashSize independent-looking ones
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,49 @@
+package rag
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestDedupHits(t *testing.T) {
+	forwarded := "Anna: the ferry leaves Split at 7:40 from pier 3, tickets are 12 euro per person, bring the printed booking"
+	hits := []Hit{
+		{Chunk: Chunk{ChunkID: "a", ThreadID: 1, Text: forwarded}},
+		{Chunk: Chunk{ChunkID: "b", ThreadID: 1, SessionIdx: 1, Text: "we should book the apartment in Hvar soon", MessageIDs: []string{"m1", "m2", "m3"}}},
+		// The forwarded message in another thread, under another name
+		{Chunk: Chunk{ChunkID: "c", ThreadID: 2, Text: "Bartek: The ferry leaves Split at 7:40 from pier 3, tickets are 12 euro per person, bring the printed booking!"}},
+		// Overlaps b in the same session
+		{Chunk: Chunk{ChunkID: "d", ThreadID: 1, SessionIdx: 1, Text: "booking done, apartment paid", MessageIDs: []string{"m3", "m4"}}},
+		// Same messages, other session: kept
+		{Chunk: Chunk{ChunkID: "e", ThreadID: 1, SessionIdx: 2, Text: "what time is dinner", MessageIDs: []string{"m3", "m4"}}},
+	}
+
+	svc := NewService(ragconfig.Default(), nil, nil, nil, nil)
+	got := svc.dedupHits(context.Background(), hits)
+	var ids []string
+	for _, h := range got {
+		ids = append(ids, h.ChunkID)
+	}
+	if want := []string{"a", "b", "e"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("dedupHits kept %v, want %v", ids, want)
+	}
+	if !reflect.DeepEqual(got[0].Duplicates, []string{"c"}) || !reflect.DeepEqual(got[1].Duplicates, []string{"d"}) || got[2].Duplicates != nil {
+		t.Errorf("duplicates = %v, %v, %v", got[0].Duplicates, got[1].Duplicates, got[2].Duplicates)
+	}
+}
+
+func TestMinHash(t *testing.T) {
+	a := newMinHash("one two three four five six seven eight nine ten", 3)
+	if a.similarity(newMinHash("One, two, three four five six seven eight nine ten.", 3)) != 1 {
+		t.Error("punctuation and case should not matter")
+	}
+	if sim := a.similarity(newMinHash("eleven twelve thirteen fourteen fifteen", 3)); sim > 0.1 {
+		t.Errorf("unrelated texts have similarity %v", sim)
+	}
+	if newMinHash("?!", 3) != nil || a.similarity(nil) != 0 {
+		t.Error("a text without words should match nothing")
+	}
+}
@@ -15,13 +15,12 @@ type EmbeddingClientAdapter struct {
 }
 
 // NewEmbeddingClientAdapter creates a new adapter wrapping vectordb.EmbeddingClient
-func NewEmbeddingClientAdapter(cfg *ragconfig.Config) *EmbeddingClientAdapter {
-	client := vectordb.NewEmbeddingClient(vectordb.EmbeddingConfig{
-		BaseURL:   cfg.Embedding.BaseURL,
-		Model:     cfg.Embedding.Model,
-		Dimension: cfg.Embedding.Dimension,
-	})
-	return &EmbeddingClientAdapter{client: client}
+func NewEmbeddingClientAdapter(cfg *ragconfig.Config) (*EmbeddingClientAdapter, error) {
+	embCfg, err := vectordb.EmbeddingConfigFrom(cfg.Embedding)
+	if err != nil {
+		return nil, err
+	}
+	return &EmbeddingClientAdapter{client: vectordb.NewEmbeddingClient(embCfg)}, nil
 }
 
 // Embed generates an embedding for the given text, converting float32 to float64
@@ -40,6 +39,16 @@ func (a *EmbeddingClientAdapter) Embed(ctx context.Context, text string) ([]floa
 	return embedding64, nil
 }
 
+// Usage returns the cumulative token usage of the embedding client
+func (a *EmbeddingClientAdapter) Usage() vectordb.EmbeddingUsage {
+	return a.client.Usage()
+}
+
+// Model returns the embedding model name
+func (a *EmbeddingClientAdapter) Model() string {
+	return a.client.Model()
+}
+
 // IsAvailable checks if the embedding service is available
 func (a *EmbeddingClientAdapter) IsAvailable(ctx context.Context) bool {
 	return a.client.IsAvailable(ctx)
@@ -0,0 +1,30 @@
+package rag
+
+import (
+	"fmt"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+// Sentinel errors returned by the search service; test with errors.Is. The
+// request errors are storage's, so storage failures surfacing through the
+// service match them too.
+var (
+	ErrBadRequest = storage.ErrBadRequest
+	ErrNotFound   = storage.ErrNotFound
+	ErrConflict   = storage.ErrConflict
+	// ErrUnavailable is shared with vectordb so embedding and Milvus outages
+	// match without unwrapping twice
+	ErrUnavailable = vectordb.ErrUnavailable
+)
+
+// requestError is a validation failure whose message is safe to show to clients
+type requestError struct{ msg string }
+
+func (e *requestError) Error() string { return e.msg }
+func (e *requestError) Unwrap() error { return ErrBadRequest }
+
+func badRequestf(format string, args ...any) error {
+	return &requestError{fmt.Sprintf(format, args...)}
+}
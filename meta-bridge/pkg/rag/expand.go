@@ -0,0 +1,210 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"go.mau.fi/mautrix-meta/pkg/chunking"
+	"go.mau.fi/mautrix-meta/pkg/llm"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// maxExpandedQueryLen caps a generated variant; longer lines are the model
+// explaining itself, not queries
+const maxExpandedQueryLen = 200
+
+const expandPrompt = `You rewrite search queries for a personal chat archive in Polish and English.
+Give up to %d alternative queries for the user's query: first its translation into the other language, then paraphrases in other words.
+Reply with one query per line and nothing else.`
+
+// variantPrefixRe matches list markers models put before lines anyway
+var variantPrefixRe = regexp.MustCompile(`^(?:[-*•]|\d+[.)])\s*`)
+
+// expandEnabled reports whether a search gets multi-query expansion. Verbatim
+// searches never do: they look for an exact string. Neither do HyDE ones,
+// whose snippet already rephrases the query.
+func (s *Service) expandEnabled(req SearchRequest) bool {
+	if req.MatchMode == MatchVerbatim || req.Mode == ModeHyDE {
+		return false
+	}
+	if req.Expand != nil {
+		return *req.Expand
+	}
+	return s.cfg.Expand.Enabled
+}
+
+// expandSearch searches variants of the query in parallel and fuses their
+// result lists with the query's own results by RRF, so chunks found by
+// several phrasings rise. A chunk keeps the hit of the first list it's in,
+// the query's own first. Variants whose search fails are left out.
+func (s *Service) expandSearch(ctx context.Context, req SearchRequest, filter SearchFilter, results []Hit) ([]Hit, []string) {
+	variants := s.expandQuery(ctx, req.Query)
+	if len(variants) == 0 {
+		return results, nil
+	}
+
+	lists := make([][]Hit, len(variants)+1)
+	lists[0] = results
+	var wg sync.WaitGroup
+	for i, variant := range variants {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A translation is in another language, so detect it again
+			vreq := req
+			vreq.Query, vreq.Lang = variant, ""
+			hits, err := s.searchQuery(ctx, vreq, s.analyzerFor(ctx, vreq), filter)
+			if err != nil {
+				ctxLogger(ctx).Warn().Err(err).Str("variant", variant).Msg("Expanded query search failed")
+				return
+			}
+			lists[i+1] = hits
+		}()
+	}
+	wg.Wait()
+	return fuseHitLists(lists, s.getRrfK(req), req.Limit), variants
+}
+
+// expandQuery returns up to expand.max_queries variants of the query, not
+// including it, from the LLM or the synonym table
+func (s *Service) expandQuery(ctx context.Context, query string) []string {
+	start := time.Now()
+	defer recordStage(ctx, "expand", start)
+
+	cfg := s.cfg.Expand
+	if cfg.MaxQueries <= 0 {
+		return nil
+	}
+	var variants []string
+	if cfg.Source != ragconfig.ExpandSourceSynonyms && s.llm != nil {
+		var err error
+		if variants, err = s.llmVariants(ctx, query, cfg.MaxQueries); err != nil {
+			ctxLogger(ctx).Warn().Err(err).Msg("LLM query expansion failed, using synonyms")
+		}
+	}
+	if len(variants) == 0 {
+		variants = synonymVariants(query, cfg.Synonyms, cfg.MaxQueries)
+	}
+
+	// Variants are searched like the query, so normalize them the same way
+	out := make([]string, 0, len(variants))
+	for _, v := range variants {
+		v = chunking.NormalizeText(v, s.cfg.Normalize)
+		if v != "" && !strings.EqualFold(v, query) && !slices.Contains(out, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (s *Service) llmVariants(ctx context.Context, query string, maxQueries int) ([]string, error) {
+	if t := s.cfg.Expand.TimeoutSeconds; t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t)*time.Second)
+		defer cancel()
+	}
+	out, err := s.llm.Complete(ctx, llm.Request{
+		Model: s.cfg.Expand.Model,
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: fmt.Sprintf(expandPrompt, maxQueries)},
+			{Role: llm.RoleUser, Content: query},
+		},
+		MaxTokens: 50 * maxQueries,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseVariants(out.Content, maxQueries), nil
+}
+
+// parseVariants takes up to maxQueries queries from a model reply, one per
+// line, without list markers and quotes
+func parseVariants(reply string, maxQueries int) []string {
+	var out []string
+	for line := range strings.Lines(reply) {
+		line = strings.TrimSpace(variantPrefixRe.ReplaceAllString(strings.TrimSpace(line), ""))
+		line = strings.Trim(line, `"'„”`)
+		if line == "" || len(line) > maxExpandedQueryLen {
+			continue
+		}
+		out = append(out, line)
+		if len(out) == maxQueries {
+			break
+		}
+	}
+	return out
+}
+
+// synonymVariants swaps the words of the query for their alternatives in
+// table: the first variant uses every word's first alternative, the second
+// their second ones, and so on
+func synonymVariants(query string, table map[string][]string, maxQueries int) []string {
+	if len(table) == 0 {
+		return nil
+	}
+	lookup := make(map[string][]string, len(table))
+	for word, alts := range table {
+		lookup[strings.ToLower(word)] = alts
+	}
+
+	words := strings.Fields(query)
+	var out []string
+	for i := 0; len(out) < maxQueries; i++ {
+		changed := false
+		variant := make([]string, len(words))
+		for j, w := range words {
+			variant[j] = w
+			alts := lookup[strings.ToLower(strings.TrimFunc(w, unicode.IsPunct))]
+			if i < len(alts) {
+				variant[j] = alts[i]
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		out = append(out, strings.Join(variant, " "))
+	}
+	return out
+}
+
+// fuseHitLists merges ranked hit lists by Reciprocal Rank Fusion. Each hit
+// keeps its fields from the first list it appears in, with RrfScore replaced
+// by the fused score.
+func fuseHitLists(lists [][]Hit, k, limit int) []Hit {
+	scores := make(map[string]float64)
+	var fused []Hit
+	for _, hits := range lists {
+		for i, h := range hits {
+			if _, seen := scores[h.ChunkID]; !seen {
+				fused = append(fused, h)
+			}
+			scores[h.ChunkID] += 1 / float64(k+i+1)
+		}
+	}
+	for i := range fused {
+		score := scores[fused[i].ChunkID]
+		fused[i].RrfScore = &score
+	}
+	slices.SortStableFunc(fused, func(a, b Hit) int {
+		if *a.RrfScore > *b.RrfScore {
+			return -1
+		} else if *a.RrfScore < *b.RrfScore {
+			return 1
+		}
+		return 0
+	})
+	if len(fused) > limit {
+		fused = fused[:limit]
+	}
+	if fused == nil {
+		fused = []Hit{}
+	}
+	return fused
+}
@@ -0,0 +1,100 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/llm"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// wordBM25 returns the hits listed for the first query term it knows
+type wordBM25 struct {
+	fixedBM25
+	hits map[string][]string
+}
+
+func (f wordBM25) Search(ctx context.Context, terms []QueryTerm, limit int, filter SearchFilter) ([]BM25Hit, error) {
+	for _, term := range terms {
+		for word, ids := range f.hits {
+			if strings.HasPrefix(word, strings.ToLower(term.Text)) {
+				var hits []BM25Hit
+				for _, id := range ids {
+					hits = append(hits, BM25Hit{Chunk: Chunk{ChunkID: id}})
+				}
+				return hits, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+type failingLLM struct{}
+
+func (failingLLM) Complete(ctx context.Context, req llm.Request) (*llm.Response, error) {
+	return nil, errors.New("model down")
+}
+
+func TestSearch_Expand(t *testing.T) {
+	cfg := ragconfig.Default()
+	cfg.Expand.Synonyms = map[string][]string{"Cabin": {"chata"}}
+	bm25 := wordBM25{hits: map[string][]string{
+		"cabin": {"a", "b"},
+		"domek": {"c", "a"},
+		"chata": {"d"},
+	}}
+	svc := NewService(cfg, nil, bm25, NewSQLiteChunkStore(newTestChunkDB(t)), downEmbedder{})
+	model := &recordingLLM{answer: "1. domek\n- \"cabin\"\n\n"}
+	svc.SetLLM(model)
+	ctx := context.Background()
+	yes, no := true, false
+
+	ids := func(resp *SearchResponse) []string {
+		var out []string
+		for _, h := range resp.Results {
+			out = append(out, h.ChunkID)
+		}
+		return out
+	}
+
+	resp, err := svc.Search(ctx, SearchRequest{Query: "cabin", Mode: ModeBM25, Lang: "en", Expand: &yes})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	// a is found by both phrasings; c ranks first for domek, b second for cabin
+	if got := ids(resp); !reflect.DeepEqual(got, []string{"a", "c", "b"}) || !reflect.DeepEqual(resp.ExpandedQueries, []string{"domek"}) {
+		t.Errorf("expanded search = %v with %v", got, resp.ExpandedQueries)
+	}
+	if !strings.Contains(model.req.Messages[0].Content, "up to 3") || model.req.Messages[1].Content != "cabin" {
+		t.Errorf("unexpected prompt %+v", model.req.Messages)
+	}
+
+	resp, err = svc.Search(ctx, SearchRequest{Query: "cabin", Mode: ModeBM25, Expand: &no})
+	if err != nil || !reflect.DeepEqual(ids(resp), []string{"a", "b"}) || resp.ExpandedQueries != nil {
+		t.Errorf("unexpanded search = %v, %v", ids(resp), err)
+	}
+
+	// Without a working model the synonym table is used
+	svc.SetLLM(failingLLM{})
+	resp, err = svc.Search(ctx, SearchRequest{Query: "Cabin", Mode: ModeBM25, Expand: &yes})
+	if err != nil || !reflect.DeepEqual(ids(resp), []string{"a", "d", "b"}) || !reflect.DeepEqual(resp.ExpandedQueries, []string{"chata"}) {
+		t.Errorf("synonym search = %v with %v, %v", ids(resp), resp.ExpandedQueries, err)
+	}
+}
+
+func TestSynonymVariants(t *testing.T) {
+	table := map[string][]string{"urodziny": {"birthday", "party"}, "Anny": {"Ani"}}
+	got := synonymVariants("Urodziny Anny?", table, 3)
+	if want := []string{"birthday Ani", "party Anny?"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("synonymVariants = %q, want %q", got, want)
+	}
+	if got := synonymVariants("urodziny", table, 1); !reflect.DeepEqual(got, []string{"birthday"}) {
+		t.Errorf("capped synonymVariants = %q", got)
+	}
+	if got := synonymVariants("nothing here", table, 3); got != nil {
+		t.Errorf("no synonyms = %q", got)
+	}
+}
@@ -1,6 +1,11 @@
 package rag
 
-import "sort"
+import (
+	"cmp"
+	"math"
+	"slices"
+	"sort"
+)
 
 // sortHits sorts hits by RRF score with tiebreakers
 // Order: RRF score desc -> present in both -> lower BM25 rank -> lower vector rank
@@ -63,3 +68,36 @@ func sortHits(hits []Hit) {
 }
 
 const maxInt = 1<<31 - 1
+
+// msPerDay converts recency.half_life_days to the unit of chunk timestamps
+const msPerDay = 24 * 60 * 60 * 1000
+
+// boostRecent multiplies the RRF score of each hit by
+// 1 + boost * 2^(-age / halfLifeDays). Age is counted back from the newest
+// hit rather than from now, so the boost works the same on an archive whose
+// last messages are years old.
+func boostRecent(hits []Hit, boost, halfLifeDays float64) {
+	if boost <= 0 || halfLifeDays <= 0 {
+		return
+	}
+	var newest int64
+	for _, h := range hits {
+		newest = max(newest, h.EndTimestampMs)
+	}
+	for i := range hits {
+		if hits[i].RrfScore == nil {
+			continue
+		}
+		age := float64(newest-hits[i].EndTimestampMs) / msPerDay
+		score := *hits[i].RrfScore * (1 + boost*math.Exp2(-age/halfLifeDays))
+		hits[i].RrfScore = &score
+	}
+}
+
+// sortRecent orders hits newest first, keeping the relevance order of hits
+// ending at the same time
+func sortRecent(hits []Hit) {
+	slices.SortStableFunc(hits, func(a, b Hit) int {
+		return cmp.Compare(b.EndTimestampMs, a.EndTimestampMs)
+	})
+}
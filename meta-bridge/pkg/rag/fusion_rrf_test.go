@@ -0,0 +1,66 @@
+package rag
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestFuseRRF_Recency(t *testing.T) {
+	day := int64(msPerDay)
+	chunk := func(id string, endDays int64) Chunk {
+		return Chunk{ChunkID: id, EndTimestampMs: endDays * day}
+	}
+	// old ranks first in both lists; new is a year and a half younger
+	vectorHits := []VectorHit{{Chunk: chunk("old", 0)}, {Chunk: chunk("new", 540)}}
+	bm25Hits := []BM25Hit{{Chunk: chunk("old", 0)}, {Chunk: chunk("new", 540)}}
+
+	cfg := ragconfig.Default()
+	svc := NewService(cfg, nil, nil, nil, nil)
+	ids := func(hits []Hit) []string {
+		var out []string
+		for _, h := range hits {
+			out = append(out, h.ChunkID)
+		}
+		return out
+	}
+
+	if got := ids(svc.fuseRRF(vectorHits, bm25Hits, SearchRequest{}, 10)); !reflect.DeepEqual(got, []string{"old", "new"}) {
+		t.Errorf("without boost = %v", got)
+	}
+
+	boost := 1.0
+	hits := svc.fuseRRF(vectorHits, bm25Hits, SearchRequest{Recency: &boost}, 10)
+	if got := ids(hits); !reflect.DeepEqual(got, []string{"new", "old"}) {
+		t.Fatalf("with boost = %v", got)
+	}
+	// Three half-lives older than the newest: 1 + 1/8
+	if want := 1.125 * (1.0 / 61); math.Abs(*hits[1].RrfScore-want) > 1e-9 {
+		t.Errorf("old score = %v, want %v", *hits[1].RrfScore, want)
+	}
+
+	cfg.Hybrid.Recency.Boost = 1
+	zero := 0.0
+	if got := ids(svc.fuseRRF(vectorHits, bm25Hits, SearchRequest{Recency: &zero}, 10)); !reflect.DeepEqual(got, []string{"old", "new"}) {
+		t.Errorf("recency=0 should override the config, got %v", got)
+	}
+}
+
+func TestSortRecent(t *testing.T) {
+	hits := []Hit{
+		{Chunk: Chunk{ChunkID: "a", EndTimestampMs: 1}},
+		{Chunk: Chunk{ChunkID: "b", EndTimestampMs: 3}},
+		{Chunk: Chunk{ChunkID: "c", EndTimestampMs: 1}},
+		{Chunk: Chunk{ChunkID: "d", EndTimestampMs: 2}},
+	}
+	sortRecent(hits)
+	var got []string
+	for _, h := range hits {
+		got = append(got, h.ChunkID)
+	}
+	if want := []string{"b", "d", "a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sortRecent = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,68 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/llm"
+)
+
+// hydeSearch is a vector search with the embedding of a snippet the LLM
+// writes to answer the query (hypothetical document embeddings). Chats
+// rarely look like the question asked about them, but they do look like
+// its answer. If the model fails, the query itself is embedded, as in
+// vector mode, and the returned snippet is empty.
+func (s *Service) hydeSearch(ctx context.Context, req SearchRequest, an queryAnalyzer, filter SearchFilter) ([]Hit, string, error) {
+	if s.llm == nil {
+		return nil, "", fmt.Errorf("no LLM configured for mode=hyde (set llm.model in rag.yaml): %w", ErrUnavailable)
+	}
+
+	snippet, err := s.hypothetical(ctx, req.Query)
+	if err != nil {
+		ctxLogger(ctx).Warn().Err(err).Msg("HyDE snippet generation failed, searching with the query")
+		hits, err := s.vectorSearch(ctx, req, an, filter)
+		return hits, "", err
+	}
+
+	// The snippet stands in for a chunk, so it's embedded like one: without
+	// the query prefix
+	start := time.Now()
+	embedding, err := s.embed.Embed(ctx, snippet)
+	recordStage(ctx, "embed", start)
+	if err != nil {
+		return nil, snippet, fmt.Errorf("embedding hypothetical snippet: %w", err)
+	}
+	hits, err := s.embeddingSearch(ctx, embedding, req.Limit, filter)
+	return hits, snippet, err
+}
+
+// hypothetical has the LLM write a chat snippet answering query
+func (s *Service) hypothetical(ctx context.Context, query string) (string, error) {
+	start := time.Now()
+	defer recordStage(ctx, "hyde", start)
+
+	cfg := s.cfg.HyDE
+	if cfg.TimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	out, err := s.llm.Complete(ctx, llm.Request{
+		Model: cfg.Model,
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: cfg.Prompt},
+			{Role: llm.RoleUser, Content: query},
+		},
+		MaxTokens: cfg.MaxTokens,
+	})
+	if err != nil {
+		return "", err
+	}
+	snippet := strings.TrimSpace(out.Content)
+	if snippet == "" {
+		return "", fmt.Errorf("model returned an empty snippet")
+	}
+	return snippet, nil
+}
@@ -0,0 +1,71 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// recordingEmbedder embeds every text as the same vector and keeps the texts
+type recordingEmbedder struct{ texts []string }
+
+func (e *recordingEmbedder) Embed(ctx context.Context, text string) ([]float64, error) {
+	e.texts = append(e.texts, text)
+	return []float64{1, 0}, nil
+}
+func (e *recordingEmbedder) IsAvailable(ctx context.Context) bool { return true }
+
+// fixedVectors returns the same hits for every embedding
+type fixedVectors struct {
+	VectorSearcher
+	hits []VectorHit
+}
+
+func (v fixedVectors) Search(ctx context.Context, embedding []float64, limit int, ef int, filter SearchFilter) ([]VectorHit, error) {
+	return v.hits, nil
+}
+
+func TestSearch_HyDE(t *testing.T) {
+	cfg := ragconfig.Default()
+	cfg.Quality = ragconfig.QualityConfig{}
+	cfg.Language.Languages["en"] = ragconfig.LanguageProfile{QueryPrefix: "query: "}
+	vectors := fixedVectors{hits: []VectorHit{{Chunk: Chunk{ChunkID: "a", Text: "we booked the cabin by the lake for july"}, Score: 0.9}}}
+	embedder := &recordingEmbedder{}
+	svc := NewService(cfg, vectors, fixedBM25{}, NewSQLiteChunkStore(newTestChunkDB(t)), embedder)
+	ctx := context.Background()
+	req := SearchRequest{Query: "where did we go on holiday", Mode: ModeHyDE, Lang: "en"}
+
+	if _, err := svc.Search(ctx, req); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("without an LLM: err = %v, want ErrUnavailable", err)
+	}
+
+	model := &recordingLLM{answer: "  Anna: the cabin by the lake was great\nBartek: same place next year?\n"}
+	svc.SetLLM(model)
+	resp, err := svc.Search(ctx, req)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	snippet := "Anna: the cabin by the lake was great\nBartek: same place next year?"
+	if resp.Hypothetical != snippet || len(resp.Results) != 1 || resp.Results[0].VectorRank == nil {
+		t.Fatalf("hyde response = %+v", resp)
+	}
+	if len(embedder.texts) != 1 || embedder.texts[0] != snippet {
+		t.Errorf("embedded %q, want the snippet without the query prefix", embedder.texts)
+	}
+	if model.req.Messages[1].Content != req.Query || model.req.MaxTokens != cfg.HyDE.MaxTokens {
+		t.Errorf("unexpected LLM request %+v", model.req)
+	}
+
+	// A failing model falls back to embedding the query
+	svc.SetLLM(failingLLM{})
+	embedder.texts = nil
+	resp, err = svc.Search(ctx, req)
+	if err != nil || resp.Hypothetical != "" || len(resp.Results) != 1 {
+		t.Fatalf("fallback = %+v, %v", resp, err)
+	}
+	if len(embedder.texts) != 1 || embedder.texts[0] != "query: "+req.Query {
+		t.Errorf("fallback embedded %q, want the prefixed query", embedder.texts)
+	}
+}
@@ -37,3 +37,21 @@ func parseStringArray(s string) []string {
 	}
 	return out
 }
+
+// sourceFragment is what a chunk's JSON sources array contains when it has
+// messages of provenance source: the quoted value, or for "export" the end
+// of any export's ("facebook-export", or "export" for older imports)
+func sourceFragment(source string) string {
+	if source == "export" {
+		return `export"`
+	}
+	return `"` + jsonStringFragment(source) + `"`
+}
+
+// jsonStringFragment encodes s the way it appears inside a JSON array written
+// by encoding/json (escaped, without the surrounding quotes), for substring
+// matching against stored name lists
+func jsonStringFragment(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
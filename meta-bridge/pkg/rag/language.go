@@ -0,0 +1,197 @@
+package rag
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// QueryTerm is a single analyzed BM25 query term
+type QueryTerm struct {
+	Text   string
+	Prefix bool // Match as a prefix (stemmed term)
+	Phrase bool // Match Text as one phrase, digits and punctuation included
+}
+
+// queryAnalyzer applies a language profile to search queries
+type queryAnalyzer struct {
+	lang     string
+	profile  ragconfig.LanguageProfile
+	verbatim bool // BM25 matches the whole query as a phrase
+}
+
+// analyzerFor picks the analyzer for a request: the forced lang if given,
+// otherwise the detected language (or the configured default). Over an index
+// with a stemming tokenizer, words go to BM25 whole: FTS5 stems them the
+// same way, and the prefix of a suffix-stripped word could miss its stem.
+func (s *Service) analyzerFor(ctx context.Context, req SearchRequest) queryAnalyzer {
+	lc := s.cfg.Language
+
+	lang := strings.ToLower(strings.TrimSpace(req.Lang))
+	if lang == "" && lc.Detect {
+		lang = detectLanguage(req.Query, lc.Languages)
+	}
+	if lang == "" {
+		lang = lc.Default
+	}
+
+	// Unknown languages get plain analysis (no stopwords, stemming or prefix)
+	an := queryAnalyzer{lang: lang, profile: lc.Languages[lang], verbatim: req.MatchMode == MatchVerbatim}
+	if idx, ok := s.bm25.(StemmingIndex); ok && an.profile.Stemming && idx.IndexStems(ctx) {
+		an.profile.Stemming = false
+	}
+	return an
+}
+
+// embeddingText returns the query text to embed, with the instruction prefix
+func (a queryAnalyzer) embeddingText(query string) string {
+	return a.profile.QueryPrefix + query
+}
+
+// bm25Terms splits the query into BM25 terms, dropping stopwords and
+// stemming when the profile enables it. In verbatim mode the whole query is
+// a single phrase term instead.
+func (a queryAnalyzer) bm25Terms(query string) []QueryTerm {
+	if a.verbatim {
+		if strings.TrimSpace(query) == "" {
+			return nil
+		}
+		return []QueryTerm{{Text: query, Phrase: true}}
+	}
+	words := splitQueryWords(query)
+
+	var stop map[string]bool
+	if a.profile.Stopwords {
+		stop = stopwords[a.lang]
+	}
+
+	terms := make([]QueryTerm, 0, len(words))
+	for _, w := range words {
+		if stop[strings.ToLower(w)] {
+			continue
+		}
+		if a.profile.Stemming {
+			if stem, ok := stemWord(a.lang, w); ok {
+				terms = append(terms, QueryTerm{Text: stem, Prefix: true})
+				continue
+			}
+		}
+		terms = append(terms, QueryTerm{Text: w})
+	}
+
+	// A query made only of stopwords ("to be or not to be") is searched as-is
+	if len(terms) == 0 {
+		for _, w := range words {
+			terms = append(terms, QueryTerm{Text: w})
+		}
+	}
+	return terms
+}
+
+// splitQueryWords splits user input into FTS-safe words (see buildFTSQuery)
+func splitQueryWords(query string) []string {
+	query = strings.ReplaceAll(query, `"`, "")
+	query = strings.ReplaceAll(query, `'`, "")
+	query = strings.ReplaceAll(query, "|", " ")
+
+	fields := strings.Fields(query)
+	words := make([]string, 0, len(fields))
+	for _, w := range fields {
+		if len(w) <= 1 {
+			continue
+		}
+		if w = escapeFTSWord(w); w != "" {
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+// detectLanguage guesses the query language among the configured ones from
+// stopword hits and language-specific letters. Returns "" when undecided.
+func detectLanguage(query string, languages map[string]ragconfig.LanguageProfile) string {
+	scores := make(map[string]int, len(languages))
+	for _, w := range strings.Fields(strings.ToLower(query)) {
+		w = strings.Trim(w, ".,!?;:()\"'")
+		for lang := range languages {
+			if stopwords[lang][w] {
+				scores[lang] += 2
+			}
+		}
+	}
+	for _, r := range query {
+		for lang := range languages {
+			if strings.ContainsRune(languageLetters[lang], r) {
+				scores[lang]++
+			}
+		}
+	}
+
+	best, bestScore, tie := "", 0, false
+	for lang, score := range scores {
+		switch {
+		case score > bestScore:
+			best, bestScore, tie = lang, score, false
+		case score == bestScore && score > 0:
+			tie = true
+		}
+	}
+	if tie {
+		return ""
+	}
+	return best
+}
+
+// stemWord strips a common inflectional suffix. The FTS index isn't stemmed,
+// so the stem is matched as a prefix instead.
+func stemWord(lang, word string) (string, bool) {
+	lower := strings.ToLower(word)
+	if utf8.RuneCountInString(lower) < 4 {
+		return "", false
+	}
+	for _, suffix := range stemSuffixes[lang] {
+		if !strings.HasSuffix(lower, suffix) {
+			continue
+		}
+		stem := lower[:len(lower)-len(suffix)]
+		if utf8.RuneCountInString(stem) >= 3 {
+			return stem, true
+		}
+	}
+	return "", false
+}
+
+// languageLetters are letters that (within the supported set) only one language uses
+var languageLetters = map[string]string{
+	"pl": "ąćęłńóśźżĄĆĘŁŃÓŚŹŻ",
+}
+
+// stemSuffixes are tried in order, so longer suffixes come first
+var stemSuffixes = map[string][]string{
+	"pl": {
+		"owie", "ach", "ami", "ego", "emu", "ich", "imi", "owi", "ych", "ymi",
+		"ów", "om", "em", "ie", "ej", "ą", "ę", "a", "e", "i", "o", "u", "y",
+	},
+	"en": {"ing", "ies", "ed", "es", "ly", "s"},
+}
+
+var stopwords = map[string]map[string]bool{
+	"pl": wordSet(`a aby ale bo by był była było być co czy dla do go i ich ile ja jak
+		jego jej jest jestem już ku lub ma mi mnie mu my na nad nas nie no o od
+		on ona one oni ono po pod przez przy sie się są ta tak tam te tego tej ten
+		to tu ty tym u w we wy z za ze że żeby`),
+	"en": wordSet(`a about an and are as at be been but by can did do does for from
+		had has have he her his how i if in into is it its me my no not of on or
+		our she so than that the their them then there they this to too us was we
+		were what when where which who why will with you your`),
+}
+
+func wordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
@@ -0,0 +1,95 @@
+package rag
+
+import (
+	"context"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	langs := ragconfig.Default().Language.Languages
+
+	cases := map[string]string{
+		"gdzie jest mój kot": "pl",
+		"where is the cat":   "en",
+		"zażółć":             "pl",
+		"pizza":              "",
+	}
+	for query, want := range cases {
+		if got := detectLanguage(query, langs); got != want {
+			t.Errorf("detectLanguage(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestBM25Terms_StopwordsAndStemming(t *testing.T) {
+	an := queryAnalyzer{lang: "pl", profile: ragconfig.LanguageProfile{Stopwords: true, Stemming: true}}
+
+	got := buildFTSQuery(an.bm25Terms("co się stało z kotami"))
+	if want := `"stał"* OR "kot"*`; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	// Only stopwords: searched as-is rather than returning nothing
+	if got := buildFTSQuery(an.bm25Terms("to jest")); got != `"to" OR "jest"` {
+		t.Fatalf("got %s", got)
+	}
+
+	plain := queryAnalyzer{lang: "xx"}
+	if got := buildFTSQuery(plain.bm25Terms("cat | dogs")); got != `"cat" OR "dogs"` {
+		t.Fatalf("got %s", got)
+	}
+}
+
+// stemmingBM25 is a BM25 searcher over an index with a stemming tokenizer
+type stemmingBM25 struct{ BM25Searcher }
+
+func (stemmingBM25) IndexStems(context.Context) bool { return true }
+
+func TestAnalyzerFor_StemmingIndex(t *testing.T) {
+	cfg := ragconfig.Default()
+	req := SearchRequest{Query: "co się stało z kotami", Lang: "pl"}
+	if an := NewService(cfg, nil, nil, nil, nil).analyzerFor(context.Background(), req); !an.profile.Stemming {
+		t.Fatal("pl should stem queries by default")
+	}
+	an := NewService(cfg, nil, stemmingBM25{}, nil, nil).analyzerFor(context.Background(), req)
+	if got := buildFTSQuery(an.bm25Terms(req.Query)); got != `"stało" OR "kotami"` {
+		t.Errorf("over a stemming index got %s, want whole words", got)
+	}
+}
+
+func TestBM25Terms_Verbatim(t *testing.T) {
+	an := queryAnalyzer{lang: "pl", profile: ragconfig.LanguageProfile{Stopwords: true, Stemming: true}, verbatim: true}
+
+	// Nothing is dropped, stemmed or stripped; quotes are escaped
+	got := buildFTSQuery(an.bm25Terms(`ul. Długa 5/7, kod "A-12"`))
+	if want := `"ul. Długa 5/7, kod ""A-12"""`; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if got := buildFTSQuery(an.bm25Terms("PL61 1090 1014")); got != `"PL61 1090 1014"` {
+		t.Fatalf("got %s", got)
+	}
+	// Punctuation alone can't match anything
+	if got := buildFTSQuery(an.bm25Terms(`"*:^`)); got != "" {
+		t.Fatalf("got %s, want empty", got)
+	}
+}
+
+func TestDegenerateQuery(t *testing.T) {
+	cases := map[string]bool{
+		"😂😂":           true,
+		"2023":         true,
+		"12:30 👍":      true,
+		"x":            true,
+		"ok":           false,
+		"kot 3":        false,
+		"zażółć":       false,
+		"where is it?": false,
+	}
+	for query, want := range cases {
+		if got := degenerateQuery(query) != ""; got != want {
+			t.Errorf("degenerateQuery(%q) skipped = %v, want %v", query, got, want)
+		}
+	}
+}
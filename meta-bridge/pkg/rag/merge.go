@@ -0,0 +1,133 @@
+package rag
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+)
+
+// mergeEnabled reports whether a search merges hits whose context windows
+// meet, which needs context to have been loaded
+func (s *Service) mergeEnabled(req SearchRequest) bool {
+	return req.Context > 0 && s.dedupEnabled(req) && s.cfg.Dedup.MergeContext
+}
+
+// mergeWindow is the chunks of one session a merged result covers
+type mergeWindow struct {
+	threadID   int64
+	sessionIdx int
+	lo, hi     int // ChunkIdx range, inclusive
+}
+
+// mergeHits merges hits of one session whose windows of radius chunks
+// around them overlap or touch, so a conversation shows up once rather than
+// as a hit per chunk with most of the same context. The best-ranked hit of
+// each run stays; the others join its context and are listed in Merged.
+// The RRF and BM25 scores of a merged result are the sums of its hits', and
+// its rerank score the best of theirs, so a conversation matching in
+// several places ranks above one matching once; results are re-sorted by
+// them (unless sorted by time).
+func (s *Service) mergeHits(ctx context.Context, hits []Hit, radius int, sort SortOrder) []Hit {
+	start := time.Now()
+	defer recordStage(ctx, "merge", start)
+
+	out := make([]Hit, 0, len(hits))
+	windows := make([]mergeWindow, 0, len(hits))
+	for _, h := range hits {
+		w := mergeWindow{h.ThreadID, h.SessionIdx, h.ChunkIdx - radius, h.ChunkIdx + radius}
+		into := slices.IndexFunc(windows, func(o mergeWindow) bool {
+			return o.threadID == w.threadID && o.sessionIdx == w.sessionIdx && w.lo <= o.hi+1 && o.lo <= w.hi+1
+		})
+		if into < 0 {
+			out = append(out, h)
+			windows = append(windows, w)
+			continue
+		}
+		mergeHit(&out[into], h)
+		windows[into].lo = min(windows[into].lo, w.lo)
+		windows[into].hi = max(windows[into].hi, w.hi)
+	}
+	if len(out) == len(hits) || sort == SortRecent {
+		return out
+	}
+
+	slices.SortStableFunc(out, compareMerged)
+	return out
+}
+
+// mergeHit merges h into the better-ranked hit of its conversation
+func mergeHit(into *Hit, h Hit) {
+	into.Merged = append(into.Merged, h.ChunkID)
+	into.Merged = append(into.Merged, h.Merged...)
+	into.Duplicates = append(into.Duplicates, h.Duplicates...)
+	into.RrfScore = sumScores(into.RrfScore, h.RrfScore)
+	into.BM25Score = sumScores(into.BM25Score, h.BM25Score)
+	if h.RerankScore != nil && (into.RerankScore == nil || *h.RerankScore > *into.RerankScore) {
+		into.RerankScore = h.RerankScore
+	}
+
+	// Context is the union of both windows and h itself, in chunk order
+	seen := map[string]bool{into.ChunkID: true}
+	var all []ContextChunk
+	for _, cc := range slices.Concat(into.ContextBefore, into.ContextAfter, h.ContextBefore, h.ContextAfter, []ContextChunk{{
+		ChunkID:     h.ChunkID,
+		ChunkIdx:    h.ChunkIdx,
+		Text:        h.Text,
+		IsIndexable: h.IsIndexable,
+	}}) {
+		if !seen[cc.ChunkID] {
+			seen[cc.ChunkID] = true
+			all = append(all, cc)
+		}
+	}
+	slices.SortFunc(all, func(a, b ContextChunk) int { return cmp.Compare(a.ChunkIdx, b.ChunkIdx) })
+	split, _ := slices.BinarySearchFunc(all, into.ChunkIdx, func(cc ContextChunk, idx int) int {
+		return cmp.Compare(cc.ChunkIdx, idx)
+	})
+	into.ContextBefore = slices.Clip(all[:split])
+	into.ContextAfter = all[split:]
+	if len(into.ContextBefore) == 0 {
+		into.ContextBefore = nil
+	}
+	if len(into.ContextAfter) == 0 {
+		into.ContextAfter = nil
+	}
+}
+
+// sumScores adds two optional scores; nil if neither is set
+func sumScores(a, b *float64) *float64 {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+	sum := *a + *b
+	return &sum
+}
+
+// compareMerged orders results after merging by rerank, then RRF, then
+// BM25 score, hits without a score after those with one. Vector-only hits
+// have none of them, as their score's direction depends on the metric, and
+// keep their order.
+func compareMerged(a, b Hit) int {
+	for _, score := range []func(Hit) *float64{
+		func(h Hit) *float64 { return h.RerankScore },
+		func(h Hit) *float64 { return h.RrfScore },
+		func(h Hit) *float64 { return h.BM25Score },
+	} {
+		sa, sb := score(a), score(b)
+		switch {
+		case sa != nil && sb != nil:
+			if c := cmp.Compare(*sb, *sa); c != 0 {
+				return c
+			}
+		case sa != nil:
+			return -1
+		case sb != nil:
+			return 1
+		}
+	}
+	return 0
+}
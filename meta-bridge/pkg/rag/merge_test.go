@@ -0,0 +1,63 @@
+package rag
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestMergeHits(t *testing.T) {
+	rrf := func(f float64) *float64 { return &f }
+	cc := func(id string, idx int) ContextChunk { return ContextChunk{ChunkID: id, ChunkIdx: idx} }
+	hits := []Hit{
+		{Chunk: Chunk{ChunkID: "s1", ThreadID: 2, SessionIdx: 3, ChunkIdx: 0}, RrfScore: rrf(0.03)},
+		{Chunk: Chunk{ChunkID: "c5", ThreadID: 1, ChunkIdx: 5}, RrfScore: rrf(0.02),
+			ContextBefore: []ContextChunk{cc("c4", 4)}, ContextAfter: []ContextChunk{cc("c6", 6)}},
+		// Window 6-8 overlaps 4-6
+		{Chunk: Chunk{ChunkID: "c7", ThreadID: 1, ChunkIdx: 7}, RrfScore: rrf(0.015),
+			ContextBefore: []ContextChunk{cc("c6", 6)}, ContextAfter: []ContextChunk{cc("c8", 8)}},
+		// Window 9-11 touches 6-8, merged with the run
+		{Chunk: Chunk{ChunkID: "c10", ThreadID: 1, ChunkIdx: 10}, RrfScore: rrf(0.01),
+			ContextBefore: []ContextChunk{cc("c9", 9)}, ContextAfter: []ContextChunk{cc("c11", 11)}},
+		// Window 19-21 is apart from 4-11
+		{Chunk: Chunk{ChunkID: "c20", ThreadID: 1, ChunkIdx: 20}, RrfScore: rrf(0.005)},
+		// Same chunk index, another session
+		{Chunk: Chunk{ChunkID: "o5", ThreadID: 1, SessionIdx: 1, ChunkIdx: 5}, RrfScore: rrf(0.001)},
+	}
+
+	svc := NewService(ragconfig.Default(), nil, nil, nil, nil)
+	got := svc.mergeHits(context.Background(), hits, 1, "")
+	var ids []string
+	for _, h := range got {
+		ids = append(ids, h.ChunkID)
+	}
+	// c5 sums to 0.045 and moves above s1
+	if want := []string{"c5", "s1", "c20", "o5"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("mergeHits kept %v, want %v", ids, want)
+	}
+	m := got[0]
+	if !reflect.DeepEqual(m.Merged, []string{"c7", "c10"}) {
+		t.Errorf("merged = %v, want [c7 c10]", m.Merged)
+	}
+	if *m.RrfScore < 0.0449 || *m.RrfScore > 0.0451 {
+		t.Errorf("rrf score = %v, want 0.045", *m.RrfScore)
+	}
+	var before, after []string
+	for _, c := range m.ContextBefore {
+		before = append(before, c.ChunkID)
+	}
+	for _, c := range m.ContextAfter {
+		after = append(after, c.ChunkID)
+	}
+	if !reflect.DeepEqual(before, []string{"c4"}) || !reflect.DeepEqual(after, []string{"c6", "c7", "c8", "c9", "c10", "c11"}) {
+		t.Errorf("context = %v / %v", before, after)
+	}
+
+	// Sorted by time, the order stays
+	got = svc.mergeHits(context.Background(), hits, 1, SortRecent)
+	if got[0].ChunkID != "s1" || len(got) != 4 {
+		t.Errorf("sort=recent reordered merged hits: first %s of %d", got[0].ChunkID, len(got))
+	}
+}
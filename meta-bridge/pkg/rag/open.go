@@ -0,0 +1,114 @@
+package rag
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"go.mau.fi/mautrix-meta/pkg/llm"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// Archive is the search service over an archive, wired from rag.yaml the
+// way rag-server wires it, for Go programs (bots, TUIs) that search
+// in-process instead of over HTTP. Search, Ask, Stats and the other Service
+// methods are available on it directly.
+//
+//	archive, err := rag.Open("rag.yaml")
+//	if err != nil { ... }
+//	defer archive.Close()
+//	resp, err := archive.Search(ctx, rag.SearchRequest{Query: "cabin"})
+type Archive struct {
+	*Service
+	db *sql.DB
+}
+
+// Open loads the config at configPath (rag.yaml in the working directory if
+// empty) and opens the archive it points at
+func Open(configPath string) (*Archive, error) {
+	cfg, err := ragconfig.LoadFromFlagOrDir(configPath, ".")
+	if err != nil {
+		return nil, err
+	}
+	return OpenConfig(context.Background(), cfg)
+}
+
+// OpenConfig opens the archive of an already loaded config: the database at
+// database.sqlite, read-only and with the FTS tokenizer extension if there is
+// one, and the vector store (Milvus or SQLite), embedding server, reranker
+// and LLM it configures. Without an LLM model, Ask returns ErrUnavailable.
+func OpenConfig(ctx context.Context, cfg *ragconfig.Config) (*Archive, error) {
+	if cfg.Database.SQLite == "" {
+		return nil, fmt.Errorf("database.sqlite is empty")
+	}
+	driver, _, err := ragindex.LoadTokenizer(cfg)
+	if err != nil {
+		ctxLogger(ctx).Warn().Err(err).Msg("Keyword index tokenizer not loaded")
+	}
+	db, err := sql.Open(storage.Driver(driver), cfg.Database.SQLite+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", cfg.Database.SQLite, err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening %s: %w", cfg.Database.SQLite, err)
+	}
+
+	svc, err := newArchiveService(ctx, cfg, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Archive{Service: svc, db: db}, nil
+}
+
+func newArchiveService(ctx context.Context, cfg *ragconfig.Config, db *sql.DB) (*Service, error) {
+	bm25, err := NewSQLiteBM25Searcher(db, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("opening the FTS index: %w", err)
+	}
+	bm25.LogFTSStatus(ctx)
+	embedder, err := NewEmbeddingClientAdapter(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid embedding config: %w", err)
+	}
+	var model *llm.Client
+	if cmp.Or(cfg.Ask.Model, cfg.LLM.Model) != "" {
+		if model, err = llm.New(cfg.LLM); err != nil {
+			return nil, fmt.Errorf("invalid LLM config: %w", err)
+		}
+	}
+	vectors, err := NewVectorSearcher(ctx, cfg, db)
+	if err != nil {
+		return nil, fmt.Errorf("opening the %s vector store: %w", cfg.Vector.Backend, err)
+	}
+
+	svc := NewService(cfg, vectors, bm25, NewSQLiteChunkStore(db), embedder)
+	if cfg.Rerank.Enabled {
+		svc.SetReranker(NewHTTPReranker(cfg.Rerank))
+	}
+	if model != nil {
+		svc.SetLLM(model)
+	}
+	return svc, nil
+}
+
+// DB returns the archive's read-only database handle, for queries the
+// Service doesn't cover
+func (a *Archive) DB() *sql.DB {
+	return a.db
+}
+
+// Close closes the vector store connection and the database
+func (a *Archive) Close() error {
+	err := a.Service.Close()
+	if dbErr := a.db.Close(); err == nil {
+		err = dbErr
+	}
+	return err
+}
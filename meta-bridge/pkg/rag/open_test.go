@@ -0,0 +1,66 @@
+package rag
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/ragindex"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "messenger.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	ctx := context.Background()
+	if err := ragindex.EnsureTables(ctx, db, "chunks_fts", ragconfig.BM25EngineFTS4, "", io.Discard); err != nil {
+		t.Fatalf("EnsureTables: %v", err)
+	}
+	if _, err := vectordb.EnsureSQLiteVectorTable(ctx, db, vectordb.SQLiteVectorTable); err != nil {
+		t.Fatalf("EnsureSQLiteVectorTable: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO chunks (chunk_id, thread_id, thread_name, session_idx, chunk_idx, message_ids,
+		participant_ids, participant_names, text, start_timestamp_ms, end_timestamp_ms, message_count,
+		is_indexable, char_count, alnum_count, unique_word_count)
+		VALUES ('a', 1, 'Trip', 0, 0, '["m1"]', '[1]', '["Anna"]', 'Anna: the cabin by the lake is booked', 0, 0, 1, 1, 300, 250, 7)`); err != nil {
+		t.Fatalf("inserting chunk: %v", err)
+	}
+	db.Close()
+
+	cfgPath := filepath.Join(dir, "rag.yaml")
+	yaml := "database:\n  sqlite: " + dbPath + "\nvector:\n  backend: sqlite\nhybrid:\n  bm25:\n    engine: fts4\nllm:\n  model: \"\"\nask:\n  model: \"\"\n"
+	if err := os.WriteFile(cfgPath, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := Open(cfgPath)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer archive.Close()
+
+	resp, err := archive.Search(ctx, SearchRequest{Query: "cabin", Mode: ModeBM25})
+	if err != nil || len(resp.Results) != 1 || resp.Results[0].ChunkID != "a" {
+		t.Fatalf("Search = %+v, %v", resp, err)
+	}
+	if _, err := archive.Ask(ctx, AskRequest{Question: "Where is the cabin?"}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Ask without a model = %v, want ErrUnavailable", err)
+	}
+	var n int
+	if err := archive.DB().QueryRow(`SELECT COUNT(*) FROM chunks`).Scan(&n); err != nil || n != 1 {
+		t.Errorf("DB() count = %d, %v", n, err)
+	}
+
+	if _, err := Open(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("Open of a missing config should fail")
+	}
+}
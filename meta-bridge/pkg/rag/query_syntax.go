@@ -0,0 +1,183 @@
+package rag
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// Search queries accept a few operators next to the free text:
+//
+//	from:"Anna" thread:"Road trip" after:2022-01-01 beach
+//
+// from: is the sender filter, thread: the thread's name or part of it (see
+// resolveThreadName), tag: a thread tag (repeatable; threads with any of them),
+// after: and before: the time range, source: the messages' provenance (live,
+// export, facebook-export, ...) and lang: the query language. Values with
+// spaces are quoted. Everything else, including quoted phrases and words that
+// merely contain a colon (10:30, http://...), is free text for vector and
+// BM25 search.
+var queryOperators = []string{"from", "thread", "tag", "after", "before", "source", "lang"}
+
+// ParsedQuery is a query split into its operators and free text
+type ParsedQuery struct {
+	Text       string // Free text, operators removed
+	Sender     string
+	ThreadName string
+	Tags       []string
+	After      string
+	Before     string
+	Source     string
+	Lang       string
+}
+
+// HasOperators reports whether the query had any operator
+func (p ParsedQuery) HasOperators() bool {
+	return p.Sender != "" || p.ThreadName != "" || len(p.Tags) > 0 || p.After != "" || p.Before != "" || p.Source != "" || p.Lang != ""
+}
+
+// ParseQuery splits the operators out of a search query. Operator names are
+// case-insensitive. Errors wrap ErrBadRequest.
+func ParseQuery(query string) (ParsedQuery, error) {
+	var p ParsedQuery
+	var text []string
+	seen := make(map[string]bool)
+	for rest := strings.TrimLeftFunc(query, unicode.IsSpace); rest != ""; rest = strings.TrimLeftFunc(rest, unicode.IsSpace) {
+		name, value, n, ok := cutOperator(rest)
+		if !ok {
+			n = freeTextLen(rest)
+			text = append(text, rest[:n])
+			rest = rest[n:]
+			continue
+		}
+		rest = rest[n:]
+		if value == "" {
+			return p, badRequestf("%s: needs a value", name)
+		}
+		if name == "tag" {
+			p.Tags = append(p.Tags, value)
+			continue
+		}
+		if seen[name] {
+			return p, badRequestf("%s: given more than once", name)
+		}
+		seen[name] = true
+		switch name {
+		case "from":
+			p.Sender = value
+		case "thread":
+			p.ThreadName = value
+		case "after":
+			p.After = value
+		case "before":
+			p.Before = value
+		case "source":
+			p.Source = strings.ToLower(value)
+		case "lang":
+			p.Lang = strings.ToLower(value)
+		}
+	}
+	if !p.HasOperators() {
+		// Leave operator-free queries exactly as they were
+		p.Text = query
+		return p, nil
+	}
+	p.Text = strings.Join(text, " ")
+	return p, nil
+}
+
+// cutOperator reads an operator at the start of s, returning its lowercase
+// name, its unquoted value and how many bytes it took. An unterminated quote
+// runs to the end of the query.
+func cutOperator(s string) (name, value string, n int, ok bool) {
+	colon := strings.IndexByte(s, ':')
+	if colon <= 0 {
+		return "", "", 0, false
+	}
+	name = strings.ToLower(s[:colon])
+	if !slices.Contains(queryOperators, name) {
+		return "", "", 0, false
+	}
+	v := s[colon+1:]
+	if v == "" || unicode.IsSpace(rune(v[0])) {
+		// "from: Anna" is text, not an operator with a stray space
+		return "", "", 0, false
+	}
+	if v[0] == '"' {
+		end := strings.IndexByte(v[1:], '"')
+		if end < 0 {
+			return name, strings.TrimSpace(v[1:]), len(s), true
+		}
+		return name, strings.TrimSpace(v[1 : 1+end]), colon + 1 + end + 2, true
+	}
+	end := strings.IndexFunc(v, unicode.IsSpace)
+	if end < 0 {
+		end = len(v)
+	}
+	return name, v[:end], colon + 1 + end, true
+}
+
+// freeTextLen is the length of the free-text token at the start of s: a
+// quoted phrase (kept whole, quotes included, so operators inside it stay
+// text) or a word
+func freeTextLen(s string) int {
+	if s[0] == '"' {
+		if end := strings.IndexByte(s[1:], '"'); end >= 0 {
+			return end + 2
+		}
+		return len(s)
+	}
+	if end := strings.IndexFunc(s, unicode.IsSpace); end >= 0 {
+		return end
+	}
+	return len(s)
+}
+
+// applyQuerySyntax moves the operators of req.Query into the request's
+// filters, leaving the free text as the query. An operator may repeat a
+// filter set on the request but not contradict it; tags add to the request's.
+func applyQuerySyntax(req SearchRequest) (SearchRequest, error) {
+	parsed, err := ParseQuery(req.Query)
+	if err != nil || !parsed.HasOperators() {
+		return req, err
+	}
+	if strings.TrimSpace(parsed.Text) == "" {
+		return req, badRequestf("query has only filters; add words to search for")
+	}
+	for _, f := range []struct {
+		op, field string
+		value     string
+		dst       *string
+	}{
+		{"from", "sender", parsed.Sender, &req.Sender},
+		{"thread", "thread_name", parsed.ThreadName, &req.ThreadName},
+		{"after", "after", parsed.After, &req.After},
+		{"before", "before", parsed.Before, &req.Before},
+		{"source", "source", parsed.Source, &req.Source},
+		{"lang", "lang", parsed.Lang, &req.Lang},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if *f.dst != "" && *f.dst != f.value {
+			return req, badRequestf("%s:%s conflicts with %s %s", f.op, f.value, f.field, *f.dst)
+		}
+		*f.dst = f.value
+	}
+	if len(parsed.Tags) > 0 {
+		tags, err := storage.NormalizeTags(append(slices.Clone(req.Tags), parsed.Tags...))
+		if err != nil {
+			return req, badRequestf("%s", err.Error())
+		}
+		req.Tags = tags
+	}
+	req.Query = parsed.Text
+
+	// Operator values haven't been through the request validation yet
+	if err := ValidateSearchRequest(&req); err != nil {
+		return req, err
+	}
+	return req, nil
+}
@@ -0,0 +1,91 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  ParsedQuery
+	}{
+		{`from:"Anna" thread:"Road trip" after:2022-01-01 beach`,
+			ParsedQuery{Text: "beach", Sender: "Anna", ThreadName: "Road trip", After: "2022-01-01"}},
+		{`beach FROM:Bob before:2023 "sun set" Lang:PL`,
+			ParsedQuery{Text: `beach "sun set"`, Sender: "Bob", Before: "2023", Lang: "pl"}},
+		{`tag:family  tag:Trips   photos`,
+			ParsedQuery{Text: "photos", Tags: []string{"family", "Trips"}}},
+		{`thread:"Road trip`, ParsedQuery{ThreadName: "Road trip"}},
+		{`source:Live cabin`, ParsedQuery{Text: "cabin", Source: "live"}},
+		// Not operators: free text stays exactly as typed
+		{"meet at 10:30\nhttp://x.pl", ParsedQuery{Text: "meet at 10:30\nhttp://x.pl"}},
+		{`from: Anna`, ParsedQuery{Text: `from: Anna`}},
+		{`"from:Anna" says hi`, ParsedQuery{Text: `"from:Anna" says hi`}},
+		{`"from:Anna" lang:en`, ParsedQuery{Text: `"from:Anna"`, Lang: "en"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseQuery(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{`from:"" beach`, `from:Anna from:Bob beach`} {
+		if _, err := ParseQuery(query); !errors.Is(err, ErrBadRequest) {
+			t.Errorf("ParseQuery(%q): got %v, want ErrBadRequest", query, err)
+		}
+	}
+}
+
+func TestApplyQuerySyntax(t *testing.T) {
+	req, err := applyQuerySyntax(SearchRequest{Query: `tag:Trips from:Anna beach`, Sender: "Anna", Tags: []string{"family"}})
+	if err != nil {
+		t.Fatalf("applyQuerySyntax: %v", err)
+	}
+	if req.Query != "beach" || req.Sender != "Anna" || !reflect.DeepEqual(req.Tags, []string{"family", "trips"}) {
+		t.Errorf("unexpected request %+v", req)
+	}
+
+	for _, bad := range []SearchRequest{
+		{Query: `from:Anna beach`, Sender: "Bob"},
+		{Query: `from:Anna`},
+		{Query: `after:yesterday beach`},
+		{Query: `after:2023 before:2022 beach`},
+		{Query: `tag:"no spaces" beach`},
+		{Query: `lang:e_n beach`},
+		{Query: `source:"face book" beach`},
+	} {
+		if _, err := applyQuerySyntax(bad); !errors.Is(err, ErrBadRequest) {
+			t.Errorf("applyQuerySyntax(%+v): got %v, want ErrBadRequest", bad, err)
+		}
+	}
+}
+
+func TestBuildFilter_ThreadName(t *testing.T) {
+	db := newTestChunkDB(t)
+	if _, err := db.Exec(`UPDATE chunks SET thread_name = 'Wycieczka Łódź' WHERE thread_id = 2`); err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(nil, nil, nil, NewSQLiteChunkStore(db), nil)
+	ctx := context.Background()
+
+	filter, err := s.buildFilter(ctx, SearchRequest{ThreadName: "łÓDŹ"})
+	if err != nil || !reflect.DeepEqual(filter.ThreadIDs, []int64{2}) {
+		t.Errorf("thread name filter = %v, %v; want [2]", filter.ThreadIDs, err)
+	}
+	filter, err = s.buildFilter(ctx, SearchRequest{ThreadName: "łódź", ThreadID: 1})
+	if err != nil || filter.ThreadIDs == nil || len(filter.ThreadIDs) != 0 {
+		t.Errorf("disjoint thread filters = %v, %v; want []", filter.ThreadIDs, err)
+	}
+	filter, err = s.buildFilter(ctx, SearchRequest{ThreadName: "nope"})
+	if err != nil || filter.ThreadIDs == nil || len(filter.ThreadIDs) != 0 {
+		t.Errorf("unknown thread name = %v, %v; want []", filter.ThreadIDs, err)
+	}
+}
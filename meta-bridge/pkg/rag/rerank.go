@@ -0,0 +1,174 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// Reranker scores documents by relevance to a query, typically with a
+// cross-encoder. The result maps document index to score (higher = more
+// relevant); documents the reranker didn't score are absent.
+type Reranker interface {
+	Rerank(ctx context.Context, query string, documents []string) (map[int]float64, error)
+}
+
+// SetReranker enables reranking of fused hybrid results through r
+func (s *Service) SetReranker(r Reranker) {
+	s.reranker = r
+}
+
+// rerankHits reorders hits by reranker score. Unscored hits keep their fused
+// order after the scored ones. On failure the fused order is kept.
+func (s *Service) rerankHits(ctx context.Context, query string, hits []Hit) []Hit {
+	if len(hits) < 2 {
+		return hits
+	}
+	start := time.Now()
+	defer recordStage(ctx, "rerank", start)
+
+	docs := make([]string, len(hits))
+	for i, h := range hits {
+		docs[i] = h.Text
+	}
+	scores, err := s.reranker.Rerank(ctx, query, docs)
+	if err != nil {
+		ctxLogger(ctx).Warn().Err(err).Msg("Reranking failed, keeping fused order")
+		return hits
+	}
+
+	for i := range hits {
+		if score, ok := scores[i]; ok {
+			hits[i].RerankScore = &score
+		}
+	}
+	slices.SortStableFunc(hits, func(a, b Hit) int {
+		switch {
+		case a.RerankScore == nil && b.RerankScore == nil:
+			return 0
+		case a.RerankScore == nil:
+			return 1
+		case b.RerankScore == nil:
+			return -1
+		}
+		if *a.RerankScore > *b.RerankScore {
+			return -1
+		} else if *a.RerankScore < *b.RerankScore {
+			return 1
+		}
+		return 0
+	})
+	return hits
+}
+
+// HTTPReranker calls a Jina/Cohere-style rerank endpoint
+type HTTPReranker struct {
+	baseURL string
+	model   string
+	apiKey  string
+	client  *http.Client
+}
+
+// NewHTTPReranker creates a reranker client from the rerank config section
+func NewHTTPReranker(cfg ragconfig.RerankConfig) *HTTPReranker {
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	apiKey := ""
+	if cfg.APIKeyEnv != "" {
+		apiKey = os.Getenv(cfg.APIKeyEnv)
+	}
+	return &HTTPReranker{
+		baseURL: strings.TrimRight(cfg.BaseURL, "/"),
+		model:   cfg.Model,
+		apiKey:  apiKey,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+type rerankRequest struct {
+	Model     string   `json:"model,omitempty"`
+	Query     string   `json:"query"`
+	Documents []string `json:"documents"`
+	// TEI names the documents "texts"
+	Texts []string `json:"texts"`
+}
+
+type rerankResult struct {
+	Index          int      `json:"index"`
+	RelevanceScore *float64 `json:"relevance_score"`
+	Score          *float64 `json:"score"` // TEI
+}
+
+// Rerank implements Reranker
+func (r *HTTPReranker) Rerank(ctx context.Context, query string, documents []string) (map[int]float64, error) {
+	body, err := json.Marshal(rerankRequest{Model: r.model, Query: query, Documents: documents, Texts: documents})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.baseURL+"/rerank", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+r.apiKey)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reranker: %w", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, fmt.Errorf("reading reranker response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: reranker returned %d: %s", ErrUnavailable, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	results, err := parseRerankResponse(data)
+	if err != nil {
+		return nil, err
+	}
+	scores := make(map[int]float64, len(results))
+	for _, res := range results {
+		if res.Index < 0 || res.Index >= len(documents) {
+			continue
+		}
+		switch {
+		case res.RelevanceScore != nil:
+			scores[res.Index] = *res.RelevanceScore
+		case res.Score != nil:
+			scores[res.Index] = *res.Score
+		}
+	}
+	return scores, nil
+}
+
+// parseRerankResponse accepts {"results": [...]} (Jina/Cohere, llama.cpp,
+// Infinity) and a bare result array (TEI)
+func parseRerankResponse(data []byte) ([]rerankResult, error) {
+	var wrapped struct {
+		Results []rerankResult `json:"results"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err == nil {
+		return wrapped.Results, nil
+	}
+	var bare []rerankResult
+	if err := json.Unmarshal(data, &bare); err != nil {
+		return nil, fmt.Errorf("decoding reranker response: %w", err)
+	}
+	return bare, nil
+}
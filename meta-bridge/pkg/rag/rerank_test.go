@@ -0,0 +1,48 @@
+package rag
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestHTTPReranker(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/rerank" {
+			http.NotFound(w, r)
+			return
+		}
+		var req rerankRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Query != "apartment" || len(req.Documents) != 3 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"results": [{"index": 2, "relevance_score": 0.9}, {"index": 0, "relevance_score": 0.1}, {"index": 7, "relevance_score": 1}]}`))
+	}))
+	defer srv.Close()
+
+	svc := &Service{cfg: ragconfig.Default()}
+	svc.SetReranker(NewHTTPReranker(ragconfig.RerankConfig{BaseURL: srv.URL + "/v1/"}))
+
+	hits := []Hit{{Chunk: Chunk{ChunkID: "a", Text: "a"}}, {Chunk: Chunk{ChunkID: "b", Text: "b"}}, {Chunk: Chunk{ChunkID: "c", Text: "c"}}}
+	got := svc.rerankHits(context.Background(), "apartment", hits)
+
+	order := []string{got[0].ChunkID, got[1].ChunkID, got[2].ChunkID}
+	if order[0] != "c" || order[1] != "a" || order[2] != "b" {
+		t.Fatalf("unexpected order %v", order)
+	}
+	if got[0].RerankScore == nil || *got[0].RerankScore != 0.9 || got[2].RerankScore != nil {
+		t.Fatalf("unexpected scores: %v, %v", got[0].RerankScore, got[2].RerankScore)
+	}
+}
+
+func TestParseRerankResponse_TEI(t *testing.T) {
+	results, err := parseRerankResponse([]byte(`[{"index": 1, "score": 0.5}]`))
+	if err != nil || len(results) != 1 || results[0].Index != 1 || results[0].Score == nil || *results[0].Score != 0.5 {
+		t.Fatalf("unexpected results %+v (err=%v)", results, err)
+	}
+}
@@ -0,0 +1,28 @@
+package rag
+
+// RetrievalRecorder is told which chunks each search returned. It is called
+// on the request path, so implementations should only queue the IDs.
+type RetrievalRecorder interface {
+	RecordRetrievals(chunkIDs []string)
+}
+
+// SetRetrievalRecorder reports the chunks returned by every search to r
+func (s *Service) SetRetrievalRecorder(r RetrievalRecorder) {
+	s.retrievals = r
+}
+
+// recordRetrievals passes the chunk IDs of hits to the retrieval recorder
+func (s *Service) recordRetrievals(hits ...[]Hit) {
+	if s.retrievals == nil {
+		return
+	}
+	var ids []string
+	for _, hs := range hits {
+		for _, h := range hs {
+			ids = append(ids, h.ChunkID)
+		}
+	}
+	if len(ids) > 0 {
+		s.retrievals.RecordRetrievals(ids)
+	}
+}
@@ -0,0 +1,131 @@
+package rag
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestParseSearchTime(t *testing.T) {
+	cases := map[string]time.Time{
+		"":                     {},
+		"2021":                 time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		"2021-05":              time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC),
+		"2021-05-07":           time.Date(2021, 5, 7, 0, 0, 0, 0, time.UTC),
+		"2021-05-07T10:00:00Z": time.Date(2021, 5, 7, 10, 0, 0, 0, time.UTC),
+	}
+	for in, want := range cases {
+		got, err := ParseSearchTime(in)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("ParseSearchTime(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseSearchTime("last year"); err == nil {
+		t.Errorf("expected error for free-form time")
+	}
+
+	req := SearchRequest{Query: "x", After: "2022", Before: "2021"}
+	if err := ValidateSearchRequest(&req); err == nil {
+		t.Errorf("expected error for after >= before")
+	}
+}
+
+func TestSQLiteFilterClause(t *testing.T) {
+	db := newTestChunkDB(t)
+	if _, err := db.Exec(`UPDATE chunks SET participant_names = '["Anna Nowak","Bob"]', start_timestamp_ms = 100, end_timestamp_ms = 200 WHERE chunk_id = 'c'`); err != nil {
+		t.Fatalf("updating chunk: %v", err)
+	}
+
+	query := func(filter SearchFilter) []string {
+		t.Helper()
+		clause, args := sqliteFilterClause(filter)
+		rows, err := db.Query("SELECT chunk_id FROM chunks c WHERE 1 = 1 "+clause+" ORDER BY chunk_id", args...)
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		defer rows.Close()
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				t.Fatalf("scan: %v", err)
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	if got := query(SearchFilter{}); len(got) != 4 {
+		t.Errorf("empty filter: got %v", got)
+	}
+	if got := query(SearchFilter{ThreadIDs: []int64{2}}); !slices.Equal(got, []string{"d"}) {
+		t.Errorf("thread filter: got %v", got)
+	}
+	if got := query(SearchFilter{Sender: "Anna"}); !slices.Equal(got, []string{"c"}) {
+		t.Errorf("sender filter: got %v", got)
+	}
+	if got := query(SearchFilter{AfterMs: 150, BeforeMs: 300}); !slices.Equal(got, []string{"c"}) {
+		t.Errorf("time filter: got %v", got)
+	}
+	if got := query(SearchFilter{ThreadIDs: []int64{2}, Sender: "Anna"}); len(got) != 0 {
+		t.Errorf("combined filter: got %v", got)
+	}
+
+	if _, err := db.Exec(`ALTER TABLE chunks ADD COLUMN sources TEXT`); err != nil {
+		t.Fatalf("adding sources: %v", err)
+	}
+	if _, err := db.Exec(`UPDATE chunks SET sources = CASE chunk_id
+		WHEN 'c' THEN '["facebook-export","live"]' WHEN 'd' THEN '["export"]' ELSE '["live"]' END`); err != nil {
+		t.Fatalf("updating sources: %v", err)
+	}
+	for source, want := range map[string][]string{
+		"facebook-export":  {"c"},
+		"export":           {"c", "d"},
+		"messenger-export": nil,
+	} {
+		if got := query(SearchFilter{Source: source}); !slices.Equal(got, want) {
+			t.Errorf("source %s filter: got %v, want %v", source, got, want)
+		}
+	}
+	if got := query(SearchFilter{Source: "live"}); len(got) != 3 || slices.Contains(got, "d") {
+		t.Errorf("source live filter: got %v", got)
+	}
+}
+
+func TestMilvusFilterExpr(t *testing.T) {
+	if got := milvusFilterExpr(SearchFilter{}); got != "" {
+		t.Errorf("empty filter: got %q", got)
+	}
+	got := milvusFilterExpr(SearchFilter{ThreadIDs: []int64{1, 2}, Sender: `Anna "A_1"`, AfterMs: 10, BeforeMs: 20})
+	want := `thread_id in [1, 2] && participant_names like "%Anna \\\"A\\_1\\\"%" && end_timestamp_ms >= 10 && start_timestamp_ms < 20`
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	if got, want := milvusFilterExpr(SearchFilter{Source: "export"}), `sources like "%export\"%"`; got != want {
+		t.Errorf("source filter: got %s, want %s", got, want)
+	}
+}
+
+func TestBM25SearchQuery_NonIndexable(t *testing.T) {
+	s, err := NewSQLiteBM25Searcher(nil, ragconfig.Default())
+	if err != nil {
+		t.Fatalf("NewSQLiteBM25Searcher: %v", err)
+	}
+	terms := []QueryTerm{{Text: "kod"}}
+
+	for _, engine := range []string{ragconfig.BM25EngineFTS5, ragconfig.BM25EngineFTS4} {
+		if q, _ := s.searchQuery(engine, terms, 10, SearchFilter{}); !strings.Contains(q, "c.is_indexable = 1") {
+			t.Errorf("%s: default query should only match indexable chunks:\n%s", engine, q)
+		}
+		filter := SearchFilter{NonIndexable: true}
+		if filter.IsEmpty() {
+			t.Errorf("NonIndexable filter reported as empty")
+		}
+		if q, _ := s.searchQuery(engine, terms, 10, filter); !strings.Contains(q, "c.is_indexable = 0") {
+			t.Errorf("%s: NonIndexable query should only match non-indexable chunks:\n%s", engine, q)
+		}
+	}
+}
@@ -4,13 +4,29 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"slices"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"go.mau.fi/mautrix-meta/pkg/chunking"
+	"go.mau.fi/mautrix-meta/pkg/llm"
 	"go.mau.fi/mautrix-meta/pkg/ragconfig"
 )
 
+// ctxLogger returns the logger carried by ctx (e.g. tagged with a request ID
+// by rag-server), falling back to the global logger
+func ctxLogger(ctx context.Context) *zerolog.Logger {
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		return l
+	}
+	return &log.Logger
+}
+
 // Service is the main RAG service that coordinates search operations
 type Service struct {
 	cfg     *ragconfig.Config
@@ -18,25 +34,44 @@ type Service struct {
 	bm25    BM25Searcher
 	chunks  ChunkStore
 	embed   Embedder
+
+	slowQueries SlowQueryRecorder
+	reranker    Reranker
+	retrievals  RetrievalRecorder
+	llm         llm.ChatCompleter
+	rowCount    rowCountCache
 }
 
 // VectorSearcher provides vector similarity search
 type VectorSearcher interface {
-	Search(ctx context.Context, embedding []float64, limit int, ef int) ([]VectorHit, error)
+	Search(ctx context.Context, embedding []float64, limit int, ef int, filter SearchFilter) ([]VectorHit, error)
 	Stats(ctx context.Context) (MilvusStats, error)
 	Close() error
 }
 
 // BM25Searcher provides BM25 full-text search
 type BM25Searcher interface {
-	Search(ctx context.Context, query string, limit int) ([]BM25Hit, error)
+	Search(ctx context.Context, terms []QueryTerm, limit int, filter SearchFilter) ([]BM25Hit, error)
+	Suggest(ctx context.Context, prefix string, minDocs, limit int) ([]Suggestion, error)
 	Stats(ctx context.Context) (SQLiteStats, error)
 }
 
+// StemmingIndex is implemented by BM25 searchers that can tell whether their
+// index stems words itself
+type StemmingIndex interface {
+	IndexStems(ctx context.Context) bool
+}
+
 // ChunkStore provides chunk retrieval and context expansion
 type ChunkStore interface {
 	GetContext(ctx context.Context, threadID int64, sessionIdx, chunkIdx, radius int) ([]ContextChunk, error)
 	GetByID(ctx context.Context, chunkID string) (*Chunk, error)
+	GetQuality(ctx context.Context, chunkIDs []string) (map[string]ChunkQuality, error)
+	GetReplies(ctx context.Context, chunkIDs []string) (map[string][]chunking.MessageReply, error)
+	GetSources(ctx context.Context, chunkIDs []string) (map[string][]string, error)
+	ThreadIDsForTags(ctx context.Context, tags []string) ([]int64, error)
+	UniqueThreadIDForName(ctx context.Context, name string) (int64, bool, error)
+	ThreadNames(ctx context.Context) ([]NamedThread, error)
 }
 
 // Embedder generates embeddings for text
@@ -59,57 +94,184 @@ func NewService(cfg *ragconfig.Config, vectors VectorSearcher, bm25 BM25Searcher
 // Search performs a search based on the request parameters
 func (s *Service) Search(ctx context.Context, req SearchRequest) (*SearchResponse, error) {
 	start := time.Now()
+	ctx, timings := withStageTimings(ctx)
+
+	// Split from:, thread: and the other operators out of the query
+	req, err := applyQuerySyntax(req)
+	if err != nil {
+		return nil, err
+	}
 
 	// Apply defaults and clamp values
 	req = s.normalizeRequest(req)
 
+	stageStart := time.Now()
+	filter, err := s.buildFilter(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	recordStage(ctx, "filter", stageStart)
+	an := s.analyzerFor(ctx, req)
+
 	var results []Hit
-	var err error
-
-	switch req.Mode {
-	case ModeVector:
-		results, err = s.vectorSearch(ctx, req)
-	case ModeBM25:
-		results, err = s.bm25Search(ctx, req)
-	case ModeHybrid:
-		results, err = s.hybridSearch(ctx, req)
+	vectorSkipped := ""
+	if req.Mode == ModeHybrid {
+		vectorSkipped = degenerateQuery(req.Query)
+	}
+	var vectorParams *VectorParams
+	if req.Mode != ModeBM25 && vectorSkipped == "" {
+		vectorParams = s.vectorParams(ctx)
+		ctx = withVectorParams(ctx, vectorParams)
+	}
+
+	// Dedup drops hits, so search past the limit to still fill it
+	search := req
+	dedup := s.dedupEnabled(req)
+	if dedup {
+		search.Limit = min(2*req.Limit, 100)
+	}
+
+	var expanded []string
+	var hypothetical string
+	switch {
+	case filter.ThreadIDs != nil && len(filter.ThreadIDs) == 0:
+		// Tags (and thread) matched no threads, so nothing can match
+		results = []Hit{}
+	case req.Mode == ModeHyDE:
+		results, hypothetical, err = s.hydeSearch(ctx, search, an, filter)
+	case req.Mode != ModeVector && req.Mode != ModeBM25 && req.Mode != ModeHybrid:
+		return nil, badRequestf("invalid search mode: %s", req.Mode)
 	default:
-		return nil, fmt.Errorf("invalid search mode: %s", req.Mode)
+		results, err = s.searchQuery(ctx, search, an, filter)
+		if err == nil && s.expandEnabled(req) {
+			results, expanded = s.expandSearch(ctx, search, filter, results)
+		}
 	}
 
 	if err != nil {
 		return nil, err
 	}
+	if dedup {
+		results = s.dedupHits(ctx, results)
+		if len(results) > req.Limit {
+			results = results[:req.Limit]
+		}
+	}
+	if req.Sort == SortRecent {
+		sortRecent(results)
+	}
+
+	var lowQuality []Hit
+	if req.IncludeLowQuality && (filter.ThreadIDs == nil || len(filter.ThreadIDs) > 0) {
+		lowQuality, err = s.lowQualitySearch(ctx, req, an, filter)
+		if err != nil {
+			// Log but don't fail - the secondary pass is optional
+			ctxLogger(ctx).Warn().Err(err).Msg("low-quality search failed")
+		}
+		if req.Sort == SortRecent {
+			sortRecent(lowQuality)
+		}
+	}
+
+	// Vector hits come from Milvus, which doesn't store quality metrics
+	stageStart = time.Now()
+	if err := s.addQuality(ctx, results); err != nil {
+		ctxLogger(ctx).Warn().Err(err).Msg("quality metadata lookup failed")
+	}
+	if err := s.addQuality(ctx, lowQuality); err != nil {
+		ctxLogger(ctx).Warn().Err(err).Msg("quality metadata lookup failed")
+	}
+	recordStage(ctx, "quality", stageStart)
 
 	// Add context if requested
 	if req.Context > 0 {
+		stageStart = time.Now()
 		results, err = s.addContext(ctx, results, req.Context)
 		if err != nil {
 			// Log but don't fail - context is optional
-			log.Warn().Err(err).Msg("context expansion failed")
+			ctxLogger(ctx).Warn().Err(err).Msg("context expansion failed")
+		}
+		if len(lowQuality) > 0 {
+			lowQuality, err = s.addContext(ctx, lowQuality, req.Context)
+			if err != nil {
+				ctxLogger(ctx).Warn().Err(err).Msg("context expansion failed")
+			}
+		}
+		recordStage(ctx, "context", stageStart)
+		if s.mergeEnabled(req) {
+			results = s.mergeHits(ctx, results, req.Context, req.Sort)
+			lowQuality = s.mergeHits(ctx, lowQuality, req.Context, req.Sort)
 		}
 	}
 
 	weights := s.getWeights(req)
+	if vectorSkipped != "" {
+		weights = Weights{Vector: 0, BM25: 1}
+	}
+	if vectorParams != nil && vectorParams.FetchLimit == 0 {
+		// Vector search didn't run (no matching threads, embedding failed)
+		vectorParams = nil
+	}
+	took := time.Since(start)
+	s.reportSlowQuery(ctx, req, an, filter, timings, took, len(results))
+	s.recordRetrievals(results, lowQuality)
 
 	return &SearchResponse{
 		Query:   req.Query,
 		Mode:    req.Mode,
 		Limit:   req.Limit,
 		Context: req.Context,
-		RrfK:    s.getRrfK(req),
-		Weights: weights,
-		TookMs:  time.Since(start).Milliseconds(),
-		Results: results,
+		Tags:    req.Tags,
+		Lang:    an.lang,
+
+		MatchMode: req.MatchMode,
+
+		ThreadID:   req.ThreadID,
+		ThreadName: req.ThreadName,
+		Sender:     req.Sender,
+		After:      req.After,
+		Before:     req.Before,
+		Source:     req.Source,
+
+		RrfK:          s.getRrfK(req),
+		Weights:       weights,
+		Recency:       s.getRecency(req),
+		Sort:          req.Sort,
+		VectorSkipped: vectorSkipped,
+		Vector:        vectorParams,
+		TookMs:        took.Milliseconds(),
+		Results:       results,
+
+		IncludeLowQuality: req.IncludeLowQuality,
+		LowQualityResults: lowQuality,
+
+		ExpandedQueries: expanded,
+		Hypothetical:    hypothetical,
 	}, nil
 }
 
+// searchQuery runs the search of the request's mode for its query. Hybrid
+// searches of queries vector search can't handle run BM25 only.
+func (s *Service) searchQuery(ctx context.Context, req SearchRequest, an queryAnalyzer, filter SearchFilter) ([]Hit, error) {
+	switch {
+	case req.Mode == ModeVector:
+		return s.vectorSearch(ctx, req, an, filter)
+	case req.Mode == ModeBM25, degenerateQuery(req.Query) != "":
+		return s.bm25Search(ctx, req, an, filter)
+	default:
+		return s.hybridSearch(ctx, req, an, filter)
+	}
+}
+
 // normalizeRequest applies defaults and clamps values
 func (s *Service) normalizeRequest(req SearchRequest) SearchRequest {
 	if req.Mode == "" {
 		req.Mode = ModeHybrid
 	}
 
+	// Match the normalization applied to indexed chunk text
+	req.Query = chunking.NormalizeText(req.Query, s.cfg.Normalize)
+
 	if req.Limit <= 0 {
 		req.Limit = 20
 	} else if req.Limit > 100 {
@@ -131,6 +293,62 @@ func (s *Service) normalizeRequest(req SearchRequest) SearchRequest {
 	return req
 }
 
+// buildFilter resolves request scoping (tags, thread, sender, time range)
+// into a search filter. Thread restrictions intersect, so a thread outside
+// the requested tags leaves an empty thread list, which matches nothing.
+func (s *Service) buildFilter(ctx context.Context, req SearchRequest) (SearchFilter, error) {
+	filter := SearchFilter{Sender: strings.TrimSpace(req.Sender), Source: req.Source}
+
+	after, err := ParseSearchTime(req.After)
+	if err != nil {
+		return filter, badRequestf("invalid after: %s", req.After)
+	}
+	before, err := ParseSearchTime(req.Before)
+	if err != nil {
+		return filter, badRequestf("invalid before: %s", req.Before)
+	}
+	if !after.IsZero() {
+		filter.AfterMs = after.UnixMilli()
+	}
+	if !before.IsZero() {
+		filter.BeforeMs = before.UnixMilli()
+	}
+
+	if req.ThreadID != 0 {
+		filter.ThreadIDs = []int64{req.ThreadID}
+	}
+	if len(req.Tags) > 0 {
+		tagged, err := s.chunks.ThreadIDsForTags(ctx, req.Tags)
+		if err != nil {
+			return filter, fmt.Errorf("resolving tags: %w", err)
+		}
+		filter.ThreadIDs = restrictThreads(filter.ThreadIDs, tagged)
+	}
+	if name := strings.TrimSpace(req.ThreadName); name != "" {
+		named, err := s.resolveThreadName(ctx, name, filter.ThreadIDs)
+		if err != nil {
+			return filter, err
+		}
+		filter.ThreadIDs = restrictThreads(filter.ThreadIDs, named)
+	}
+	return filter, nil
+}
+
+// restrictThreads narrows a thread list (nil = all threads) to the threads
+// in matching. The result is never nil.
+func restrictThreads(threadIDs, matching []int64) []int64 {
+	out := []int64{}
+	if threadIDs == nil {
+		return append(out, matching...)
+	}
+	for _, id := range threadIDs {
+		if slices.Contains(matching, id) {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
 // getRrfK returns the RRF k parameter
 func (s *Service) getRrfK(req SearchRequest) int {
 	if req.RrfK > 0 {
@@ -142,6 +360,14 @@ func (s *Service) getRrfK(req SearchRequest) int {
 	return 60
 }
 
+// getRecency returns the recency boost of fused scores
+func (s *Service) getRecency(req SearchRequest) float64 {
+	if req.Recency != nil {
+		return *req.Recency
+	}
+	return s.cfg.Hybrid.Recency.Boost
+}
+
 // getWeights returns normalized weights
 func (s *Service) getWeights(req SearchRequest) Weights {
 	wv := req.WeightVec
@@ -166,27 +392,46 @@ func (s *Service) getWeights(req SearchRequest) Weights {
 	return Weights{Vector: vector, BM25: bm25}
 }
 
+// degenerateQuery returns why a hybrid query should skip vector search, or ""
+// if it shouldn't. Emoji, numbers and single letters embed to vectors that sit
+// close to everything, so their nearest neighbours only dilute the BM25 hits.
+func degenerateQuery(query string) string {
+	letters := 0
+	for _, r := range query {
+		if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	switch {
+	case letters == 0:
+		return "query has no letters"
+	case letters < 2:
+		return "query is too short"
+	}
+	return ""
+}
+
 func isFinite(v float64) bool {
 	return !math.IsNaN(v) && !math.IsInf(v, 0)
 }
 
-func (s *Service) vectorCandidates(ctx context.Context, embedding []float64, want int) ([]VectorHit, error) {
+func (s *Service) vectorCandidates(ctx context.Context, embedding []float64, want int, filter SearchFilter) ([]VectorHit, error) {
 	if want <= 0 {
 		return []VectorHit{}, nil
 	}
 
-	fetchMult := s.cfg.Milvus.Search.FetchMultiplier
-	if fetchMult < 1 {
-		fetchMult = 1
+	params, _ := ctx.Value(vectorParamsKey{}).(*VectorParams)
+	if params == nil {
+		params = s.vectorParams(ctx)
 	}
 
-	fetchLimit := want * fetchMult
-	ef := s.cfg.Milvus.Search.Ef
-	if fetchLimit > ef {
-		ef = fetchLimit
-	}
+	fetchLimit := want * params.FetchMultiplier
+	ef := max(params.minEf, fetchLimit)
+	params.Ef, params.FetchLimit = ef, fetchLimit
 
-	vectorHits, err := s.vectors.Search(ctx, embedding, fetchLimit, ef)
+	start := time.Now()
+	vectorHits, err := s.vectors.Search(ctx, embedding, fetchLimit, ef, filter)
+	recordStage(ctx, "vector", start)
 	if err != nil {
 		return nil, err
 	}
@@ -199,15 +444,34 @@ func (s *Service) vectorCandidates(ctx context.Context, embedding []float64, wan
 	return vectorHits, nil
 }
 
+// embedQuery embeds the analyzed query text, timing the "embed" stage
+func (s *Service) embedQuery(ctx context.Context, an queryAnalyzer, query string) ([]float64, error) {
+	start := time.Now()
+	defer recordStage(ctx, "embed", start)
+	return s.embed.Embed(ctx, an.embeddingText(query))
+}
+
+// bm25Candidates runs the BM25 query, timing the "bm25" stage
+func (s *Service) bm25Candidates(ctx context.Context, an queryAnalyzer, query string, limit int, filter SearchFilter) ([]BM25Hit, error) {
+	start := time.Now()
+	defer recordStage(ctx, "bm25", start)
+	return s.bm25.Search(ctx, an.bm25Terms(query), limit, filter)
+}
+
 // vectorSearch performs vector-only search
-func (s *Service) vectorSearch(ctx context.Context, req SearchRequest) ([]Hit, error) {
+func (s *Service) vectorSearch(ctx context.Context, req SearchRequest, an queryAnalyzer, filter SearchFilter) ([]Hit, error) {
 	// Get embedding for query
-	embedding, err := s.embed.Embed(ctx, req.Query)
+	embedding, err := s.embedQuery(ctx, an, req.Query)
 	if err != nil {
 		return nil, fmt.Errorf("embedding query: %w", err)
 	}
 
-	vectorHits, err := s.vectorCandidates(ctx, embedding, req.Limit)
+	return s.embeddingSearch(ctx, embedding, req.Limit, filter)
+}
+
+// embeddingSearch returns the vector hits for an embedding
+func (s *Service) embeddingSearch(ctx context.Context, embedding []float64, limit int, filter SearchFilter) ([]Hit, error) {
+	vectorHits, err := s.vectorCandidates(ctx, embedding, limit, filter)
 	if err != nil {
 		return nil, fmt.Errorf("vector search: %w", err)
 	}
@@ -229,8 +493,8 @@ func (s *Service) vectorSearch(ctx context.Context, req SearchRequest) ([]Hit, e
 }
 
 // bm25Search performs BM25-only search
-func (s *Service) bm25Search(ctx context.Context, req SearchRequest) ([]Hit, error) {
-	bm25Hits, err := s.bm25.Search(ctx, req.Query, req.Limit)
+func (s *Service) bm25Search(ctx context.Context, req SearchRequest, an queryAnalyzer, filter SearchFilter) ([]Hit, error) {
+	bm25Hits, err := s.bm25Candidates(ctx, an, req.Query, req.Limit, filter)
 	if err != nil {
 		return nil, fmt.Errorf("bm25 search: %w", err)
 	}
@@ -250,20 +514,46 @@ func (s *Service) bm25Search(ctx context.Context, req SearchRequest) ([]Hit, err
 	return results, nil
 }
 
+// lowQualitySearch is the secondary BM25 pass over non-indexable chunks,
+// which neither the vector store nor the main BM25 query can return. Short
+// messages are exactly where one-off strings like door codes end up.
+func (s *Service) lowQualitySearch(ctx context.Context, req SearchRequest, an queryAnalyzer, filter SearchFilter) ([]Hit, error) {
+	filter.NonIndexable = true
+	start := time.Now()
+	bm25Hits, err := s.bm25.Search(ctx, an.bm25Terms(req.Query), req.Limit, filter)
+	recordStage(ctx, "bm25_low_quality", start)
+	if err != nil {
+		return nil, fmt.Errorf("low-quality bm25 search: %w", err)
+	}
+
+	results := make([]Hit, 0, len(bm25Hits))
+	for i, bh := range bm25Hits {
+		rank := i + 1
+		score := bh.Score
+
+		results = append(results, Hit{
+			Chunk:     bh.Chunk,
+			BM25Rank:  &rank,
+			BM25Score: &score,
+		})
+	}
+	return results, nil
+}
+
 // hybridSearch performs hybrid RRF fusion search with graceful degradation.
 // If one search fails, it falls back to single-mode search rather than failing entirely.
-func (s *Service) hybridSearch(ctx context.Context, req SearchRequest) ([]Hit, error) {
+func (s *Service) hybridSearch(ctx context.Context, req SearchRequest, an queryAnalyzer, filter SearchFilter) ([]Hit, error) {
 	// Get embedding for query
-	embedding, err := s.embed.Embed(ctx, req.Query)
+	embedding, err := s.embedQuery(ctx, an, req.Query)
 	if err != nil {
 		// If embedding fails, fall back to BM25-only search
-		return s.bm25Search(ctx, req)
+		return s.bm25Search(ctx, req, an, filter)
 	}
 
 	// Match TypeScript behavior: if hybrid is disabled, do vector-only fallback
 	// but keep RRF scoring/ranks.
 	if !s.cfg.Hybrid.Enabled {
-		vectorHits, err := s.vectorCandidates(ctx, embedding, req.Limit)
+		vectorHits, err := s.vectorCandidates(ctx, embedding, req.Limit, filter)
 		if err != nil {
 			return nil, fmt.Errorf("vector search: %w", err)
 		}
@@ -304,12 +594,12 @@ func (s *Service) hybridSearch(ctx context.Context, req SearchRequest) ([]Hit, e
 	bm25Ch := make(chan bm25Result, 1)
 
 	go func() {
-		hits, err := s.vectorCandidates(ctx, embedding, candidates)
+		hits, err := s.vectorCandidates(ctx, embedding, candidates, filter)
 		vectorCh <- vectorResult{hits, err}
 	}()
 
 	go func() {
-		hits, err := s.bm25.Search(ctx, req.Query, candidates)
+		hits, err := s.bm25Candidates(ctx, an, req.Query, candidates, filter)
 		bm25Ch <- bm25Result{hits, err}
 	}()
 
@@ -322,7 +612,7 @@ func (s *Service) hybridSearch(ctx context.Context, req SearchRequest) ([]Hit, e
 
 	if !vectorOK && !bm25OK {
 		// Both failed - return error with both reasons
-		return nil, fmt.Errorf("both searches failed: vector=%v, bm25=%v", vr.err, br.err)
+		return nil, fmt.Errorf("both searches failed: vector=%w, bm25=%w", vr.err, br.err)
 	}
 
 	if !vectorOK {
@@ -374,12 +664,28 @@ func (s *Service) hybridSearch(ctx context.Context, req SearchRequest) ([]Hit, e
 		return results, nil
 	}
 
-	// Both succeeded - fuse results using RRF
-	return s.fuseRRF(vr.hits, br.hits, req), nil
+	// Both succeeded - fuse results using RRF. With a reranker, fuse extra
+	// candidates for it to choose from.
+	limit := req.Limit
+	if s.reranker != nil {
+		limit = max(limit, s.cfg.Rerank.TopN)
+	}
+	start := time.Now()
+	results := s.fuseRRF(vr.hits, br.hits, req, limit)
+	recordStage(ctx, "fusion", start)
+
+	if s.reranker != nil {
+		results = s.rerankHits(ctx, req.Query, results)
+		if len(results) > req.Limit {
+			results = results[:req.Limit]
+		}
+	}
+	return results, nil
 }
 
-// fuseRRF combines vector and BM25 results using Reciprocal Rank Fusion
-func (s *Service) fuseRRF(vectorHits []VectorHit, bm25Hits []BM25Hit, req SearchRequest) []Hit {
+// fuseRRF combines vector and BM25 results using Reciprocal Rank Fusion,
+// returning at most limit hits
+func (s *Service) fuseRRF(vectorHits []VectorHit, bm25Hits []BM25Hit, req SearchRequest, limit int) []Hit {
 	k := s.getRrfK(req)
 	weights := s.getWeights(req)
 
@@ -440,17 +746,50 @@ func (s *Service) fuseRRF(vectorHits []VectorHit, bm25Hits []BM25Hit, req Search
 		})
 	}
 
+	boostRecent(results, s.getRecency(req), s.cfg.Hybrid.Recency.HalfLifeDays)
+
 	// Sort by RRF score with tiebreakers
 	sortHits(results)
 
 	// Limit results
-	if len(results) > req.Limit {
-		results = results[:req.Limit]
+	if len(results) > limit {
+		results = results[:limit]
 	}
 
 	return results
 }
 
+// addQuality fills in chunk quality metrics, reply links and sources from
+// SQLite
+func (s *Service) addQuality(ctx context.Context, hits []Hit) error {
+	if len(hits) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(hits))
+	for i, h := range hits {
+		ids[i] = h.ChunkID
+	}
+	quality, err := s.chunks.GetQuality(ctx, ids)
+	if err != nil {
+		return err
+	}
+	replies, err := s.chunks.GetReplies(ctx, ids)
+	if err != nil {
+		return err
+	}
+	sources, err := s.chunks.GetSources(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := range hits {
+		hits[i].ChunkQuality = quality[hits[i].ChunkID]
+		hits[i].Replies = replies[hits[i].ChunkID]
+		hits[i].Sources = sources[hits[i].ChunkID]
+	}
+	return nil
+}
+
 // addContext adds surrounding chunks to each hit
 func (s *Service) addContext(ctx context.Context, hits []Hit, radius int) ([]Hit, error) {
 	failures := 0
@@ -485,6 +824,40 @@ func (s *Service) addContext(ctx context.Context, hits []Hit, radius int) ([]Hit
 	return hits, nil
 }
 
+// Suggest returns auto-complete terms for the last word of prefix,
+// most frequent first. Terms found in fewer than minDocs chunks are skipped.
+func (s *Service) Suggest(ctx context.Context, prefix string, minDocs, limit int) (*SuggestResponse, error) {
+	if limit <= 0 {
+		limit = 10
+	} else if limit > 50 {
+		limit = 50
+	}
+	if minDocs <= 0 {
+		minDocs = 1
+	}
+
+	resp := &SuggestResponse{Query: prefix, Suggestions: []Suggestion{}}
+
+	// Complete only the word being typed, folded the way the FTS tokenizer does
+	words := strings.Fields(chunking.NormalizeText(prefix, s.cfg.Normalize))
+	if len(words) == 0 {
+		return resp, nil
+	}
+	term := foldFTSTerm(words[len(words)-1])
+	if utf8.RuneCountInString(term) < 2 {
+		return resp, nil
+	}
+
+	suggestions, err := s.bm25.Suggest(ctx, term, minDocs, limit)
+	if err != nil {
+		return nil, err
+	}
+	if suggestions != nil {
+		resp.Suggestions = suggestions
+	}
+	return resp, nil
+}
+
 // Stats returns statistics about the RAG system
 func (s *Service) Stats(ctx context.Context) (*StatsResponse, error) {
 	milvusStats, err := s.vectors.Stats(ctx)
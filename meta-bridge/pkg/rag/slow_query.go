@@ -0,0 +1,117 @@
+package rag
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SlowQuery describes a search that took longer than slow_query.threshold_ms
+type SlowQuery struct {
+	Query   string
+	Mode    SearchMode
+	Tags    []string
+	Results int
+	TookMs  int64
+	Stages  map[string]int64 // Milliseconds spent per stage (embed, vector, bm25, ...)
+	Plan    string           // SQLite EXPLAIN QUERY PLAN of the BM25 query, if captured
+}
+
+// SlowQueryRecorder persists slow queries for later inspection
+type SlowQueryRecorder interface {
+	RecordSlowQuery(ctx context.Context, q SlowQuery) error
+}
+
+// QueryExplainer is implemented by BM25 searchers that can describe how
+// SQLite executes their query
+type QueryExplainer interface {
+	ExplainSearch(ctx context.Context, terms []QueryTerm, limit int, filter SearchFilter) (string, error)
+}
+
+// SetSlowQueryRecorder stores slow queries through r in addition to logging them
+func (s *Service) SetSlowQueryRecorder(r SlowQueryRecorder) {
+	s.slowQueries = r
+}
+
+// stageTimings collects per-stage durations of one search. Hybrid search
+// runs stages concurrently, hence the mutex.
+type stageTimings struct {
+	mu sync.Mutex
+	ms map[string]int64
+}
+
+type stageTimingsKey struct{}
+
+func withStageTimings(ctx context.Context) (context.Context, *stageTimings) {
+	t := &stageTimings{ms: make(map[string]int64)}
+	return context.WithValue(ctx, stageTimingsKey{}, t), t
+}
+
+// recordStage adds the time since start to stage, if ctx carries timings
+func recordStage(ctx context.Context, stage string, start time.Time) {
+	t, _ := ctx.Value(stageTimingsKey{}).(*stageTimings)
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.ms[stage] += time.Since(start).Milliseconds()
+	t.mu.Unlock()
+}
+
+func (t *stageTimings) snapshot() map[string]int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]int64, len(t.ms))
+	for k, v := range t.ms {
+		out[k] = v
+	}
+	return out
+}
+
+// reportSlowQuery logs (and optionally persists) a search that exceeded the
+// configured threshold. The BM25 plan is only computed here, so fast
+// searches pay nothing for it.
+func (s *Service) reportSlowQuery(ctx context.Context, req SearchRequest, an queryAnalyzer, filter SearchFilter, timings *stageTimings, took time.Duration, results int) {
+	threshold := s.cfg.SlowQuery.ThresholdMs
+	if threshold <= 0 || took.Milliseconds() < int64(threshold) {
+		return
+	}
+
+	q := SlowQuery{
+		Query:   req.Query,
+		Mode:    req.Mode,
+		Tags:    req.Tags,
+		Results: results,
+		TookMs:  took.Milliseconds(),
+		Stages:  timings.snapshot(),
+	}
+
+	if s.cfg.SlowQuery.Explain && req.Mode != ModeVector && req.Mode != ModeHyDE {
+		if ex, ok := s.bm25.(QueryExplainer); ok {
+			plan, err := ex.ExplainSearch(ctx, an.bm25Terms(req.Query), req.Limit*req.CandMult, filter)
+			if err != nil {
+				ctxLogger(ctx).Debug().Err(err).Msg("Explaining slow BM25 query failed")
+			}
+			q.Plan = plan
+		}
+	}
+
+	evt := ctxLogger(ctx).Warn().
+		Str("query", q.Query).
+		Str("mode", string(q.Mode)).
+		Int64("took_ms", q.TookMs).
+		Int("results", q.Results)
+	for stage, ms := range q.Stages {
+		evt = evt.Int64("stage_"+stage+"_ms", ms)
+	}
+	if q.Plan != "" {
+		evt = evt.Str("plan", q.Plan)
+	}
+	evt.Msg("Slow search")
+
+	if s.slowQueries != nil && s.cfg.SlowQuery.Persist {
+		if err := s.slowQueries.RecordSlowQuery(ctx, q); err != nil {
+			ctxLogger(ctx).Warn().Err(err).Msg("Failed to record slow query")
+		}
+	}
+}
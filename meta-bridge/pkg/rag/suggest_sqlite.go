@@ -0,0 +1,86 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// Suggest returns vocabulary terms of the FTS table starting with prefix.
+// The fts5vocab (or for FTS4, fts4aux) table is created in the temp schema so
+// it works on read-only connections; it is per-connection, hence the
+// dedicated conn.
+func (s *SQLiteBM25Searcher) Suggest(ctx context.Context, prefix string, minDocs, limit int) ([]Suggestion, error) {
+	engine, err := s.ftsEngine(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("suggest: %w", err)
+	}
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("suggest conn: %w", err)
+	}
+	defer conn.Close()
+
+	vocabTable := s.ftsTable + "_vocab"
+	createVocab := `CREATE VIRTUAL TABLE IF NOT EXISTS temp.%s USING fts5vocab('main', '%s', 'row')`
+	// Range scan on term is handled efficiently by fts5vocab and fts4aux
+	query := `
+		SELECT term, doc, cnt FROM temp.%s
+		WHERE term >= ? AND term < ? AND doc >= ?
+		ORDER BY doc DESC, cnt DESC
+		LIMIT ?
+	`
+	if engine == ragconfig.BM25EngineFTS4 {
+		// The col = '*' rows total each term over all columns
+		createVocab = `CREATE VIRTUAL TABLE IF NOT EXISTS temp.%s USING fts4aux(main, %s)`
+		query = `
+		SELECT term, documents, occurrences FROM temp.%s
+		WHERE term >= ? AND term < ? AND col = '*' AND documents >= ?
+		ORDER BY documents DESC, occurrences DESC
+		LIMIT ?
+	`
+	}
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(createVocab, vocabTable, s.ftsTable)); err != nil {
+		return nil, fmt.Errorf("creating FTS vocab table: %w", ftsError(err))
+	}
+
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(query, vocabTable), prefix, prefix+"\U0010FFFF", minDocs, limit)
+	if err != nil {
+		return nil, fmt.Errorf("suggest query: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Suggestion
+	for rows.Next() {
+		var sg Suggestion
+		if err := rows.Scan(&sg.Term, &sg.Docs, &sg.Count); err != nil {
+			return nil, fmt.Errorf("scanning suggestion: %w", err)
+		}
+		out = append(out, sg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating suggestions: %w", err)
+	}
+
+	return out, nil
+}
+
+// foldFTSTerm lowercases and strips diacritics the way the unicode61
+// tokenizer (remove_diacritics=1) stores vocabulary terms
+func foldFTSTerm(term string) string {
+	term = escapeFTSWord(strings.ToLower(term))
+
+	var sb strings.Builder
+	for _, r := range norm.NFD.String(term) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return norm.NFC.String(sb.String())
+}
@@ -0,0 +1,143 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+
+	"go.mau.fi/mautrix-meta/pkg/util"
+)
+
+// maxListedThreads caps the candidates an ambiguous thread name error lists
+const maxListedThreads = 10
+
+// NamedThread is an indexed thread and a name it goes by
+type NamedThread struct {
+	ID   int64
+	Name string
+}
+
+// resolveThreadName finds the thread a thread: filter (or thread_name)
+// names, among scope (nil = all threads). It tries, in order, the one thread
+// named exactly that, the names equal to it ignoring case and diacritics, the
+// names containing it, and failing those, the names a typo or two away
+// (about one per four letters). No thread matching is an empty list, so the
+// search finds nothing; several matching is a bad request listing them, to
+// pick one by a longer name or by thread_id.
+func (s *Service) resolveThreadName(ctx context.Context, name string, scope []int64) ([]int64, error) {
+	if id, ok, err := s.chunks.UniqueThreadIDForName(ctx, name); err != nil {
+		return nil, fmt.Errorf("resolving thread name: %w", err)
+	} else if ok {
+		return []int64{id}, nil
+	}
+
+	threads, err := s.chunks.ThreadNames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolving thread name: %w", err)
+	}
+	if scope != nil {
+		threads = slices.DeleteFunc(threads, func(t NamedThread) bool {
+			return !slices.Contains(scope, t.ID)
+		})
+	}
+
+	matches := matchThreadNames(threads, name)
+	switch len(matches) {
+	case 0:
+		return []int64{}, nil
+	case 1:
+		return []int64{matches[0].ID}, nil
+	}
+	slices.SortFunc(matches, func(a, b NamedThread) int {
+		return strings.Compare(foldName(a.Name), foldName(b.Name))
+	})
+	listed := make([]string, 0, maxListedThreads)
+	for _, t := range matches[:min(len(matches), maxListedThreads)] {
+		listed = append(listed, fmt.Sprintf("%q (thread_id %d)", t.Name, t.ID))
+	}
+	more := ""
+	if len(matches) > maxListedThreads {
+		more = fmt.Sprintf(" and %d more", len(matches)-maxListedThreads)
+	}
+	return nil, badRequestf("thread name %q matches %d threads: %s%s; use more of the name or thread_id",
+		name, len(matches), strings.Join(listed, ", "), more)
+}
+
+// matchThreadNames returns the threads the best way of matching name finds,
+// one entry per thread
+func matchThreadNames(threads []NamedThread, name string) []NamedThread {
+	query := strings.Join(strings.Fields(foldName(name)), " ")
+	folded := make([]string, len(threads))
+	for i, t := range threads {
+		folded[i] = strings.Join(strings.Fields(foldName(t.Name)), " ")
+	}
+
+	for _, match := range []func(string) bool{
+		func(n string) bool { return n == query },
+		func(n string) bool { return strings.Contains(n, query) },
+	} {
+		var out []NamedThread
+		for i, t := range threads {
+			if match(folded[i]) {
+				out = appendThread(out, t)
+			}
+		}
+		if len(out) > 0 {
+			return out
+		}
+	}
+
+	maxTypos := len([]rune(query)) / 4
+	if maxTypos == 0 {
+		return nil
+	}
+	var out []NamedThread
+	best := maxTypos + 1
+	for i, t := range threads {
+		d := nameDistance(folded[i], query)
+		switch {
+		case d > maxTypos:
+		case d < best:
+			best, out = d, []NamedThread{t}
+		case d == best:
+			out = appendThread(out, t)
+		}
+	}
+	return out
+}
+
+// appendThread appends t unless the thread is listed already, under another name
+func appendThread(threads []NamedThread, t NamedThread) []NamedThread {
+	if slices.ContainsFunc(threads, func(o NamedThread) bool { return o.ID == t.ID }) {
+		return threads
+	}
+	return append(threads, t)
+}
+
+// nameDistance is the fewest typos between query and the name, or a run of
+// as many of its words as the query has
+func nameDistance(name, query string) int {
+	best := util.EditDistance(name, query)
+	words := strings.Fields(name)
+	n := len(strings.Fields(query))
+	for i := 0; i+n <= len(words); i++ {
+		best = min(best, util.EditDistance(strings.Join(words[i:i+n], " "), query))
+	}
+	return best
+}
+
+// foldName lowercases a name and strips its diacritics, so "lodz" is one
+// typo from "Łódź" (ł has no decomposition) rather than four
+func foldName(name string) string {
+	var sb strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(name)) {
+		if !unicode.Is(unicode.Mn, r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,69 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchThreadNames(t *testing.T) {
+	threads := []NamedThread{
+		{1, "Anna Nowak"},
+		{2, "Wycieczka Łódź 2023"},
+		{3, "Anna i Bartek"},
+		{4, "Rodzina"},
+		{4, "Rodzinka"}, // Renamed
+		{5, "Anna"},
+	}
+	for _, tc := range []struct {
+		name string
+		want []int64
+	}{
+		{"ANNA", []int64{5}},            // Exact beats containing
+		{"  anna   nowak ", []int64{1}}, // Spacing ignored
+		{"lodz", []int64{2}},            // One typo after folding
+		{"rodzin", []int64{4}},          // Both names, one thread
+		{"Bartk", []int64{3}},           // Typo in one word
+		{"wycieczka lodz", []int64{2}},  // Run of words
+		{"anna i", []int64{3}},          // Substring
+		{"nowk", []int64{1}},            // A typo per four letters
+		{"nwk", nil},                    // None below four
+		{"kolega", nil},
+		{"bartek", []int64{3}},
+	} {
+		var got []int64
+		for _, m := range matchThreadNames(threads, tc.name) {
+			got = append(got, m.ID)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("matchThreadNames(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestResolveThreadName_Ambiguous(t *testing.T) {
+	db := newTestChunkDB(t)
+	if _, err := db.Exec(`UPDATE chunks SET thread_name = CASE thread_id WHEN 1 THEN 'Anna Nowak' ELSE 'Anna i Bartek' END`); err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(nil, nil, nil, NewSQLiteChunkStore(db), nil)
+	ctx := context.Background()
+
+	_, err := s.buildFilter(ctx, SearchRequest{ThreadName: "anna"})
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("ambiguous name: got %v, want ErrBadRequest", err)
+	}
+	for _, want := range []string{`"Anna Nowak" (thread_id 1)`, `"Anna i Bartek" (thread_id 2)`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't list %s", err, want)
+		}
+	}
+
+	// thread_id picks one of them
+	filter, err := s.buildFilter(ctx, SearchRequest{ThreadName: "anna", ThreadID: 2})
+	if err != nil || !reflect.DeepEqual(filter.ThreadIDs, []int64{2}) {
+		t.Errorf("scoped name = %v, %v; want [2]", filter.ThreadIDs, err)
+	}
+}
@@ -2,7 +2,7 @@
 // capabilities combining vector search (Milvus) and BM25 search (SQLite FTS5).
 //
 // This is the authoritative backend for all search operations. CLI, web UI,
-// and future MCP server should all use this package.
+// and mcp-server should all use this package.
 package rag
 
 import (
@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"strconv"
 	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/chunking"
 )
 
 // Int64Strings marshals int64 values as JSON strings to preserve precision in JavaScript.
@@ -72,6 +74,23 @@ const (
 	ModeVector SearchMode = "vector" // Vector-only search (Milvus)
 	ModeBM25   SearchMode = "bm25"   // BM25-only search (SQLite FTS5)
 	ModeHybrid SearchMode = "hybrid" // Hybrid RRF fusion of both
+	ModeHyDE   SearchMode = "hyde"   // Vector search with an LLM-written snippet answering the query
+)
+
+// MatchMode controls how the query becomes a BM25 match expression
+type MatchMode string
+
+const (
+	MatchTerms    MatchMode = "terms"    // Analyzed words, OR-ed (default)
+	MatchVerbatim MatchMode = "verbatim" // Whole input as one phrase; keeps digits and punctuation
+)
+
+// SortOrder is the order search results are returned in
+type SortOrder string
+
+const (
+	SortRelevance SortOrder = "relevance" // Best match first (default)
+	SortRecent    SortOrder = "recent"    // The best matches, newest first
 )
 
 // SearchRequest contains parameters for a search operation
@@ -86,6 +105,73 @@ type SearchRequest struct {
 	WeightVec  float64 `json:"w_vector,omitempty"`
 	WeightBM25 float64 `json:"w_bm25,omitempty"`
 	CandMult   int     `json:"candidate_mult,omitempty"` // Candidate multiplier for fusion
+
+	// Restrict results to threads carrying any of these tags
+	Tags []string `json:"tags,omitempty"`
+
+	// Restrict results to one thread, to chunks with a message from a sender
+	// (case-sensitive substring of the name), and to a time range. After and
+	// Before accept RFC3339 or a UTC date prefix (2006, 2006-01, 2006-01-02);
+	// After is inclusive, Before exclusive, so after=2021&before=2022 is 2021.
+	ThreadID int64  `json:"thread_id,string,omitempty"`
+	Sender   string `json:"sender,omitempty"`
+	After    string `json:"after,omitempty"`
+	Before   string `json:"before,omitempty"`
+
+	// Restrict results to chunks with messages of this provenance: live,
+	// import-sample or an export (facebook-export, messenger-export, ...);
+	// "export" matches every export
+	Source string `json:"source,omitempty"`
+
+	// Restrict results to the thread with this name, or the one whose name
+	// contains it or is a typo away; a name several threads match is refused
+	ThreadName string `json:"thread_name,omitempty"`
+
+	// Query language (e.g. "pl", "en"); empty = detect
+	Lang string `json:"lang,omitempty"`
+
+	// BM25 match mode; verbatim is for exact strings like ticket numbers,
+	// IBANs and addresses. Empty = terms.
+	MatchMode MatchMode `json:"match_mode,omitempty"`
+
+	// Also run a BM25 pass over non-indexable chunks (too short or noisy to
+	// embed), for exact lookups like codes and addresses. Those hits are
+	// returned separately in LowQualityResults.
+	IncludeLowQuality bool `json:"include_low_quality,omitempty"`
+
+	// Also search paraphrases and translations of the query and fuse the
+	// results (see expand in rag.yaml); nil = expand.enabled
+	Expand *bool `json:"expand,omitempty"`
+
+	// Recency boost of hybrid RRF scores (see hybrid.recency in rag.yaml);
+	// nil = hybrid.recency.boost, 0 = none
+	Recency *float64 `json:"recency,omitempty"`
+
+	// Result order; empty = relevance
+	Sort SortOrder `json:"sort,omitempty"`
+
+	// Collapse near-duplicate hits (see dedup in rag.yaml); nil =
+	// dedup.enabled
+	Dedup *bool `json:"dedup,omitempty"`
+}
+
+// SearchFilter restricts the candidate set of a vector or BM25 search.
+// The zero value matches everything.
+type SearchFilter struct {
+	ThreadIDs []int64 // Only these threads (nil = all)
+	Sender    string  // Only chunks with a participant name containing this
+	AfterMs   int64   // Only chunks ending at or after this time (0 = no bound)
+	BeforeMs  int64   // Only chunks starting before this time (0 = no bound)
+	Source    string  // Only chunks with messages of this provenance (see SearchRequest.Source)
+
+	// NonIndexable searches non-indexable chunks instead of indexable ones.
+	// Only BM25 honours it; vector stores hold indexable chunks only.
+	NonIndexable bool
+}
+
+// IsEmpty reports whether the filter matches everything
+func (f SearchFilter) IsEmpty() bool {
+	return f.ThreadIDs == nil && f.Sender == "" && f.AfterMs == 0 && f.BeforeMs == 0 && f.Source == "" && !f.NonIndexable
 }
 
 // SearchResponse contains the search results and metadata
@@ -94,16 +180,50 @@ type SearchResponse struct {
 	Mode    SearchMode `json:"mode"`
 	Limit   int        `json:"limit"`
 	Context int        `json:"context"`
+	Tags    []string   `json:"tags,omitempty"`
+	Lang    string     `json:"lang"` // Language used for query analysis
+
+	MatchMode MatchMode `json:"match_mode,omitempty"`
+
+	// Filters as applied, including those given as query operators (Query
+	// is then the free text alone)
+	ThreadID   int64  `json:"thread_id,string,omitempty"`
+	ThreadName string `json:"thread_name,omitempty"`
+	Sender     string `json:"sender,omitempty"`
+	After      string `json:"after,omitempty"`
+	Before     string `json:"before,omitempty"`
+	Source     string `json:"source,omitempty"`
 
 	// Config values used
 	RrfK    int     `json:"rrf_k"`
 	Weights Weights `json:"weights"`
+	Recency float64 `json:"recency,omitempty"`
+
+	Sort SortOrder `json:"sort,omitempty"`
+
+	// Why a hybrid search ran BM25 only (emoji-only, number-only or
+	// single-letter queries); weights are then reported as 0/1
+	VectorSkipped string `json:"vector_skipped,omitempty"`
+
+	// Vector search parameters used (absent if no vector search ran)
+	Vector *VectorParams `json:"vector,omitempty"`
 
 	// Timing
 	TookMs int64 `json:"took_ms"`
 
-	// Results ordered by relevance (best first)
+	// Results ordered by relevance (best first), or newest first with
+	// sort=recent
 	Results []Hit `json:"results"`
+
+	// BM25 hits among non-indexable chunks (include_low_quality only)
+	IncludeLowQuality bool  `json:"include_low_quality,omitempty"`
+	LowQualityResults []Hit `json:"low_quality_results,omitempty"`
+
+	// Variants of the query searched along with it (expansion only)
+	ExpandedQueries []string `json:"expanded_queries,omitempty"`
+
+	// Snippet whose embedding was searched (mode=hyde only)
+	Hypothetical string `json:"hypothetical,omitempty"`
 }
 
 // Weights contains the normalized weights used for hybrid search
@@ -121,7 +241,13 @@ type Hit struct {
 	VectorScore *float64 `json:"vector_score"`
 	BM25Rank    *int     `json:"bm25_rank"` // nil if not in BM25 results
 	BM25Score   *float64 `json:"bm25_score"`
-	RrfScore    *float64 `json:"rrf_score"` // nil for single-mode searches
+	RrfScore    *float64 `json:"rrf_score"`    // nil for single-mode searches
+	RerankScore *float64 `json:"rerank_score"` // nil unless reranking is enabled
+
+	// Chunks left out of the results as near-duplicates of this one
+	Duplicates []string `json:"duplicates,omitempty"`
+	// Hits next to this one in its session, merged into its context
+	Merged []string `json:"merged,omitempty"`
 
 	// Context (only populated if context > 0)
 	ContextBefore []ContextChunk `json:"context_before,omitempty"`
@@ -142,6 +268,24 @@ type Chunk struct {
 	MessageCount     int          `json:"message_count"`
 	SessionIdx       int          `json:"session_idx"`
 	ChunkIdx         int          `json:"chunk_idx"`
+	ChunkQuality
+
+	// Replies links the chunk's replies to the messages they answer, which
+	// may be in another chunk
+	Replies []chunking.MessageReply `json:"replies,omitempty"`
+
+	// Sources are the provenances of the chunk's messages (live,
+	// facebook-export, ...); empty for chunks built before they were recorded
+	Sources []string `json:"sources,omitempty"`
+}
+
+// ChunkQuality holds the quality metrics computed when the chunk was built.
+// They explain why a chunk is (not) indexable and why a hit may look thin.
+type ChunkQuality struct {
+	CharCount       int  `json:"char_count"`
+	AlnumCount      int  `json:"alnum_count"`
+	UniqueWordCount int  `json:"unique_word_count"`
+	IsIndexable     bool `json:"is_indexable"`
 }
 
 // ContextChunk is a simplified chunk for context display
@@ -152,6 +296,16 @@ type ContextChunk struct {
 	IsIndexable bool   `json:"is_indexable"`
 }
 
+// ChunkContext is a chunk with the chunks around it in its session
+type ChunkContext struct {
+	Chunk         *Chunk         `json:"chunk"`
+	ContextBefore []ContextChunk `json:"context_before"`
+	ContextAfter  []ContextChunk `json:"context_after"`
+	// The session has more chunks past the loaded context
+	HasMoreBefore bool `json:"has_more_before"`
+	HasMoreAfter  bool `json:"has_more_after"`
+}
+
 // VectorHit is an intermediate result from vector search
 type VectorHit struct {
 	Chunk
@@ -177,6 +331,7 @@ type StatsResponse struct {
 // MilvusStats contains Milvus collection statistics
 type MilvusStats struct {
 	Connected      bool   `json:"connected"`
+	Database       string `json:"database,omitempty"`
 	Collection     string `json:"collection"`
 	RowCount       int64  `json:"row_count"`
 	IndexType      string `json:"index_type"`
@@ -191,6 +346,7 @@ type SQLiteStats struct {
 	ChunksIndexed int64  `json:"chunks_indexed"` // is_indexable = 1
 	FtsTable      string `json:"fts_table"`
 	FtsAvailable  bool   `json:"fts_available"`
+	FtsEngine     string `json:"fts_engine,omitempty"` // "fts5", or "fts4" with BM25-lite ranking
 }
 
 // ConfigInfo contains configuration metadata
@@ -209,3 +365,16 @@ type HealthResponse struct {
 	Embedding bool      `json:"embedding"`
 	Timestamp time.Time `json:"timestamp"`
 }
+
+// Suggestion is a single auto-complete term from the FTS vocabulary
+type Suggestion struct {
+	Term  string `json:"term"`
+	Docs  int64  `json:"docs"`  // Number of chunks containing the term
+	Count int64  `json:"count"` // Total occurrences
+}
+
+// SuggestResponse for /suggest endpoint
+type SuggestResponse struct {
+	Query       string       `json:"q"`
+	Suggestions []Suggestion `json:"suggestions"`
+}
@@ -1,30 +1,199 @@
 package rag
 
 import (
-	"fmt"
+	"cmp"
+	"maps"
+	"math"
+	"slices"
 	"strings"
+	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
-// ValidateSearchRequest validates search request parameters
+// Bounds past which search parameters are rejected instead of clamped.
+// Values within them are clamped by normalizeRequest to what the service
+// actually uses (limit 100, context 5, candidate_mult 10); values beyond them
+// point at a broken client rather than a greedy one.
+const (
+	maxRequestLimit    = 1000
+	maxRequestContext  = 50
+	maxRequestCandMult = 100
+	maxRequestRrfK     = 100000
+	maxRequestWeight   = 1000
+	maxRequestRecency  = 100
+	// maxContextWindow caps limit × (2 × context + 1), the chunks a search
+	// with adjacent context loads
+	maxContextWindow = 500
+)
+
+// ValidateSearchRequest validates search request parameters. Failures wrap
+// ErrBadRequest and their messages are safe to return to clients.
 func ValidateSearchRequest(req *SearchRequest) error {
+	if err := validateUTF8(map[string]string{
+		"query":       req.Query,
+		"sender":      req.Sender,
+		"thread_name": req.ThreadName,
+		"lang":        req.Lang,
+		"after":       req.After,
+		"before":      req.Before,
+		"source":      req.Source,
+	}); err != nil {
+		return err
+	}
+	for _, tag := range req.Tags {
+		if !utf8.ValidString(tag) {
+			return badRequestf("tags are not valid UTF-8")
+		}
+	}
+
 	if strings.TrimSpace(req.Query) == "" {
-		return fmt.Errorf("query cannot be empty")
+		return badRequestf("query cannot be empty")
 	}
 
 	// Check query length (prevent very long queries)
 	if len(req.Query) > 2000 {
-		return fmt.Errorf("query too long (max 2000 characters)")
+		return badRequestf("query too long (max 2000 characters)")
 	}
 
 	// Validate mode
 	switch req.Mode {
-	case ModeVector, ModeBM25, ModeHybrid, "":
+	case ModeVector, ModeBM25, ModeHybrid, ModeHyDE, "":
 		// Valid
 	default:
-		return fmt.Errorf("invalid mode: %s (must be vector, bm25, or hybrid)", req.Mode)
+		return badRequestf("invalid mode: %s (must be vector, bm25, hybrid, or hyde)", req.Mode)
+	}
+
+	switch req.MatchMode {
+	case MatchTerms, MatchVerbatim, "":
+	default:
+		return badRequestf("invalid match_mode: %s (must be terms or verbatim)", req.MatchMode)
+	}
+
+	switch req.Sort {
+	case SortRelevance, SortRecent, "":
+	default:
+		return badRequestf("invalid sort: %s (must be relevance or recent)", req.Sort)
+	}
+
+	if req.Lang != "" && !isValidLang(req.Lang) {
+		return badRequestf("invalid lang: %s (use a language code like pl or en)", req.Lang)
 	}
 
+	if len(req.Tags) > 20 {
+		return badRequestf("too many tags (max 20)")
+	}
+
+	if req.ThreadID < 0 {
+		return badRequestf("invalid thread_id")
+	}
+
+	if req.Limit < 0 || req.Limit > maxRequestLimit {
+		return badRequestf("invalid limit: %d (must be 0 to %d)", req.Limit, maxRequestLimit)
+	}
+	if req.Context < 0 || req.Context > maxRequestContext {
+		return badRequestf("invalid context: %d (must be 0 to %d)", req.Context, maxRequestContext)
+	}
+	if limit := cmp.Or(req.Limit, 20); req.Context > 0 && limit*(2*req.Context+1) > maxContextWindow {
+		return badRequestf("limit %d with context %d would load %d chunks (max %d); lower either",
+			limit, req.Context, limit*(2*req.Context+1), maxContextWindow)
+	}
+	if req.CandMult < 0 || req.CandMult > maxRequestCandMult {
+		return badRequestf("invalid candidate_mult: %d (must be 0 to %d)", req.CandMult, maxRequestCandMult)
+	}
+	if req.RrfK < 0 || req.RrfK > maxRequestRrfK {
+		return badRequestf("invalid rrf_k: %d (must be 0 to %d)", req.RrfK, maxRequestRrfK)
+	}
+	for _, w := range []struct {
+		name  string
+		value float64
+	}{{"w_vector", req.WeightVec}, {"w_bm25", req.WeightBM25}} {
+		if math.IsNaN(w.value) || w.value < 0 || w.value > maxRequestWeight {
+			return badRequestf("invalid %s (must be 0 to %d)", w.name, maxRequestWeight)
+		}
+	}
+	if r := req.Recency; r != nil && (math.IsNaN(*r) || *r < 0 || *r > maxRequestRecency) {
+		return badRequestf("invalid recency (must be 0 to %d)", maxRequestRecency)
+	}
+	if len(req.Sender) > 200 {
+		return badRequestf("sender too long (max 200 characters)")
+	}
+	if len(req.ThreadName) > 200 {
+		return badRequestf("thread_name too long (max 200 characters)")
+	}
+	if req.Source != "" && !isValidSource(req.Source) {
+		return badRequestf("invalid source: %s (e.g. live, export, facebook-export, import-sample)", req.Source)
+	}
+
+	after, err := ParseSearchTime(req.After)
+	if err != nil {
+		return badRequestf("invalid after: %s (use RFC3339 or YYYY[-MM[-DD]])", req.After)
+	}
+	before, err := ParseSearchTime(req.Before)
+	if err != nil {
+		return badRequestf("invalid before: %s (use RFC3339 or YYYY[-MM[-DD]])", req.Before)
+	}
+	if !after.IsZero() && !before.IsZero() && !after.Before(before) {
+		return badRequestf("after must be earlier than before")
+	}
+
+	return nil
+}
+
+// searchTimeLayouts are the accepted after/before formats, most specific first
+var searchTimeLayouts = []string{time.RFC3339, "2006-01-02", "2006-01", "2006"}
+
+// ParseSearchTime parses an after/before bound. Date-only values are midnight
+// UTC at the start of the period; an empty string is the zero time.
+func ParseSearchTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	var err error
+	for _, layout := range searchTimeLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// isValidLang checks for a short lowercase language code
+func isValidLang(lang string) bool {
+	if len(lang) < 2 || len(lang) > 8 {
+		return false
+	}
+	for _, r := range lang {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidSource checks for a provenance like messages.source stores: lowercase
+// letters and hyphens
+func isValidSource(source string) bool {
+	if len(source) > 50 {
+		return false
+	}
+	for _, r := range source {
+		if (r < 'a' || r > 'z') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// validateUTF8 rejects the first field (in name order) that isn't valid UTF-8
+func validateUTF8(fields map[string]string) error {
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		if !utf8.ValidString(fields[name]) {
+			return badRequestf("%s is not valid UTF-8", name)
+		}
+	}
 	return nil
 }
 
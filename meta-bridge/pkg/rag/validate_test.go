@@ -0,0 +1,45 @@
+package rag
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestValidateSearchRequest_Bounds(t *testing.T) {
+	negative := -1.0
+	for name, req := range map[string]SearchRequest{
+		"negative limit":     {Limit: -1},
+		"huge limit":         {Limit: 1_000_000},
+		"huge context":       {Context: 1000},
+		"limit × context":    {Limit: 100, Context: 3},
+		"default × context":  {Context: 20},
+		"negative cand mult": {CandMult: -2},
+		"huge rrf_k":         {RrfK: math.MaxInt32},
+		"NaN weight":         {WeightVec: math.NaN()},
+		"negative weight":    {WeightBM25: -1},
+		"invalid UTF-8":      {Query: "caf\xe9"},
+		"invalid UTF-8 tag":  {Tags: []string{"\xff"}},
+		"unknown sort":       {Sort: "oldest"},
+		"negative recency":   {Recency: &negative},
+	} {
+		if req.Query == "" {
+			req.Query = "boat"
+		}
+		if err := ValidateSearchRequest(&req); !errors.Is(err, ErrBadRequest) {
+			t.Errorf("%s: got %v, want ErrBadRequest", name, err)
+		}
+	}
+
+	// Values the service clamps are still fine
+	for _, req := range []SearchRequest{
+		{Query: "boat", Limit: 200},
+		{Query: "boat", Limit: 1000},
+		{Query: "boat", Limit: 100, Context: 2},
+		{Query: "boat", Context: 5, CandMult: 50, WeightVec: 2},
+	} {
+		if err := ValidateSearchRequest(&req); err != nil {
+			t.Errorf("%+v: %v", req, err)
+		}
+	}
+}
@@ -3,26 +3,34 @@ package rag
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/milvus-io/milvus-sdk-go/v2/client"
 	"github.com/milvus-io/milvus-sdk-go/v2/entity"
 
+	"go.mau.fi/mautrix-meta/pkg/metrics"
 	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
 )
 
+var milvusSearchDuration = metrics.Default.NewHistogram("rag_milvus_search_duration_seconds",
+	"Milvus vector searches by outcome (ok or error).", metrics.DurationBuckets, "outcome")
+
 // MilvusVectorSearcher implements VectorSearcher using Milvus
 type MilvusVectorSearcher struct {
 	client     client.Client
 	collection string
 	cfg        *ragconfig.Config
+	// sources is set when the collection has the sources field, which
+	// collections created before it lack until rebuilt
+	sources bool
 }
 
 // NewMilvusVectorSearcher creates a new Milvus vector searcher
 func NewMilvusVectorSearcher(ctx context.Context, cfg *ragconfig.Config) (*MilvusVectorSearcher, error) {
-	c, err := client.NewClient(ctx, client.Config{
-		Address: cfg.Milvus.Address,
-	})
+	c, err := vectordb.NewMilvusClient(ctx, cfg.Milvus)
 	if err != nil {
 		return nil, fmt.Errorf("connecting to Milvus: %w", err)
 	}
@@ -46,16 +54,26 @@ func NewMilvusVectorSearcher(ctx context.Context, cfg *ragconfig.Config) (*Milvu
 		}
 	}
 
+	sources, err := vectordb.MilvusHasField(ctx, c, collection, "sources")
+	if err != nil {
+		return nil, fmt.Errorf("describing collection: %w", err)
+	}
+
 	needsClose = false
 	return &MilvusVectorSearcher{
 		client:     c,
 		collection: collection,
 		cfg:        cfg,
+		sources:    sources,
 	}, nil
 }
 
 // Search performs a vector similarity search
-func (m *MilvusVectorSearcher) Search(ctx context.Context, embedding []float64, limit int, ef int) ([]VectorHit, error) {
+func (m *MilvusVectorSearcher) Search(ctx context.Context, embedding []float64, limit int, ef int, filter SearchFilter) ([]VectorHit, error) {
+	if filter.Source != "" && !m.sources {
+		return nil, badRequestf("collection %s has no chunk sources to filter by; rebuild it with rag-pipeline -force -drop", m.collection)
+	}
+
 	// Convert float64 to float32 for Milvus
 	vec := make([]float32, len(embedding))
 	for i, v := range embedding {
@@ -86,11 +104,12 @@ func (m *MilvusVectorSearcher) Search(ctx context.Context, embedding []float64,
 		return nil, fmt.Errorf("creating search params: %w", err)
 	}
 
+	start := time.Now()
 	results, err := m.client.Search(
 		ctx,
 		m.collection,
 		nil, // partitions
-		"",  // expression filter
+		milvusFilterExpr(filter),
 		outputFields,
 		vectors,
 		"embedding",
@@ -99,8 +118,10 @@ func (m *MilvusVectorSearcher) Search(ctx context.Context, embedding []float64,
 		sp,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("Milvus search: %w", err)
+		milvusSearchDuration.ObserveSince(start, "error")
+		return nil, fmt.Errorf("%w: Milvus search: %w", ErrUnavailable, err)
 	}
+	milvusSearchDuration.ObserveSince(start, "ok")
 
 	if len(results) == 0 {
 		return []VectorHit{}, nil
@@ -222,6 +243,49 @@ func (m *MilvusVectorSearcher) Search(ctx context.Context, embedding []float64,
 	return hits, nil
 }
 
+// milvusFilterExpr converts a search filter to a Milvus boolean expression
+func milvusFilterExpr(filter SearchFilter) string {
+	var conds []string
+	if filter.ThreadIDs != nil {
+		ids := make([]string, len(filter.ThreadIDs))
+		for i, id := range filter.ThreadIDs {
+			ids[i] = strconv.FormatInt(id, 10)
+		}
+		conds = append(conds, "thread_id in ["+strings.Join(ids, ", ")+"]")
+	}
+	if filter.Sender != "" {
+		// participant_names holds the JSON-encoded name list
+		conds = append(conds, `participant_names like "%`+milvusLikeEscape(jsonStringFragment(filter.Sender))+`%"`)
+	}
+	if filter.Source != "" {
+		// sources holds the JSON-encoded provenance list
+		conds = append(conds, `sources like "%`+milvusLikeEscape(sourceFragment(filter.Source))+`%"`)
+	}
+	if filter.AfterMs != 0 {
+		conds = append(conds, "end_timestamp_ms >= "+strconv.FormatInt(filter.AfterMs, 10))
+	}
+	if filter.BeforeMs != 0 {
+		conds = append(conds, "start_timestamp_ms < "+strconv.FormatInt(filter.BeforeMs, 10))
+	}
+	return strings.Join(conds, " && ")
+}
+
+// milvusLikeEscape escapes a string for use inside a double-quoted Milvus
+// like pattern, so quotes and wildcards match literally
+func milvusLikeEscape(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\', '"':
+			sb.WriteByte('\\')
+		case '%', '_':
+			sb.WriteString(`\\`)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
 func milvusMetricFromConfig(metric string) entity.MetricType {
 	switch strings.ToUpper(strings.TrimSpace(metric)) {
 	case "L2":
@@ -239,6 +303,7 @@ func milvusMetricFromConfig(metric string) entity.MetricType {
 func (m *MilvusVectorSearcher) Stats(ctx context.Context) (MilvusStats, error) {
 	stats := MilvusStats{
 		Connected:      true,
+		Database:       m.cfg.Milvus.Database,
 		Collection:     m.collection,
 		EmbeddingModel: m.cfg.Embedding.Model,
 		EmbeddingDim:   m.cfg.Embedding.Dimension,
@@ -248,7 +313,7 @@ func (m *MilvusVectorSearcher) Stats(ctx context.Context) (MilvusStats, error) {
 	// Get collection statistics
 	collStats, err := m.client.GetCollectionStatistics(ctx, m.collection)
 	if err != nil {
-		return stats, fmt.Errorf("getting collection stats: %w", err)
+		return stats, fmt.Errorf("%w: getting collection stats: %w", ErrUnavailable, err)
 	}
 
 	if rowCount, ok := collStats["row_count"]; ok {
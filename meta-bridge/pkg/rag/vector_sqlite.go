@@ -0,0 +1,322 @@
+package rag
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+// SQLiteVectorSearcher implements VectorSearcher over the chunk_vectors table
+// written by milvus-index with the sqlite backend. Search is exact
+// brute force over an in-memory copy of the vectors, reloaded when the table
+// changes; that stays fast up to a few hundred thousand chunks.
+type SQLiteVectorSearcher struct {
+	db     *sql.DB
+	cfg    *ragconfig.Config
+	table  string
+	metric string
+
+	mu      sync.Mutex
+	version vectordb.SQLiteVectorVersion
+	loaded  bool
+	ids     []string
+	vecs    [][]float32
+}
+
+// NewSQLiteVectorSearcher creates a searcher over db's chunk_vectors table,
+// which must exist (run milvus-index with vector.backend: sqlite first)
+func NewSQLiteVectorSearcher(ctx context.Context, db *sql.DB, cfg *ragconfig.Config) (*SQLiteVectorSearcher, error) {
+	return newSQLiteVectorSearcher(ctx, db, cfg, vectordb.SQLiteVectorTable)
+}
+
+func newSQLiteVectorSearcher(ctx context.Context, db *sql.DB, cfg *ragconfig.Config, table string) (*SQLiteVectorSearcher, error) {
+	exists, err := vectordb.SQLiteVectorTableExists(ctx, db, table)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("table %s not found (run milvus-index with vector.backend: sqlite)", table)
+	}
+	s := &SQLiteVectorSearcher{
+		db:     db,
+		cfg:    cfg,
+		table:  table,
+		metric: sqliteMetricFromConfig(cfg.Milvus.Index.Metric),
+	}
+	if err := s.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewVectorSearcher creates the VectorSearcher for the configured backend.
+// db is only used by the sqlite backend.
+func NewVectorSearcher(ctx context.Context, cfg *ragconfig.Config, db *sql.DB) (VectorSearcher, error) {
+	switch cfg.Vector.Backend {
+	case ragconfig.VectorBackendMilvus, "":
+		return NewMilvusVectorSearcher(ctx, cfg)
+	case ragconfig.VectorBackendSQLite:
+		return NewSQLiteVectorSearcher(ctx, db, cfg)
+	default:
+		return nil, fmt.Errorf("unknown vector backend %q (want %q or %q)", cfg.Vector.Backend, ragconfig.VectorBackendMilvus, ragconfig.VectorBackendSQLite)
+	}
+}
+
+// NewVectorSearcherAt is NewVectorSearcher over the named collection (or
+// vector table) instead of the configured one
+func NewVectorSearcherAt(ctx context.Context, cfg *ragconfig.Config, db *sql.DB, name string) (VectorSearcher, error) {
+	switch cfg.Vector.Backend {
+	case ragconfig.VectorBackendMilvus, "":
+		named := *cfg
+		named.Milvus.ChunkCollection = name
+		return NewMilvusVectorSearcher(ctx, &named)
+	case ragconfig.VectorBackendSQLite:
+		return newSQLiteVectorSearcher(ctx, db, cfg, name)
+	default:
+		return nil, fmt.Errorf("unknown vector backend %q (want %q or %q)", cfg.Vector.Backend, ragconfig.VectorBackendMilvus, ragconfig.VectorBackendSQLite)
+	}
+}
+
+// sqliteMetricFromConfig normalizes milvus.index.metric the same way
+// milvusMetricFromConfig does
+func sqliteMetricFromConfig(metric string) string {
+	switch strings.ToUpper(strings.TrimSpace(metric)) {
+	case "L2":
+		return "L2"
+	case "IP", "INNER_PRODUCT":
+		return "IP"
+	default:
+		return "COSINE"
+	}
+}
+
+// refresh reloads the vectors if the table changed since the last load
+func (s *SQLiteVectorSearcher) refresh(ctx context.Context) error {
+	version, err := vectordb.GetSQLiteVectorVersion(ctx, s.db, s.table)
+	if err != nil {
+		return fmt.Errorf("%w: reading %s: %w", ErrUnavailable, s.table, err)
+	}
+	if s.loaded && version == s.version {
+		return nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT chunk_id, embedding FROM `+s.table)
+	if err != nil {
+		return fmt.Errorf("%w: loading vectors: %w", ErrUnavailable, err)
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0, version.Rows)
+	vecs := make([][]float32, 0, version.Rows)
+	for rows.Next() {
+		var id string
+		var blob []byte
+		if err := rows.Scan(&id, &blob); err != nil {
+			return fmt.Errorf("scanning vector: %w", err)
+		}
+		vec, err := vectordb.DecodeVector(blob)
+		if err != nil {
+			return fmt.Errorf("vector for %s: %w", id, err)
+		}
+		if s.metric == "COSINE" {
+			normalize(vec)
+		}
+		ids = append(ids, id)
+		vecs = append(vecs, vec)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("loading vectors: %w", err)
+	}
+
+	s.ids, s.vecs, s.version, s.loaded = ids, vecs, version, true
+	return nil
+}
+
+// Search scores every stored vector against embedding. Scores follow Milvus:
+// cosine similarity or inner product (higher is better), or squared L2
+// distance (lower is better). ef is ignored since the search is exact.
+func (s *SQLiteVectorSearcher) Search(ctx context.Context, embedding []float64, limit int, ef int, filter SearchFilter) ([]VectorHit, error) {
+	if limit <= 0 {
+		return []VectorHit{}, nil
+	}
+	query := make([]float32, len(embedding))
+	for i, v := range embedding {
+		query[i] = float32(v)
+	}
+	if s.metric == "COSINE" {
+		normalize(query)
+	}
+
+	var allowed map[string]bool
+	if !filter.IsEmpty() {
+		var err error
+		if allowed, err = s.filteredChunkIDs(ctx, filter); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	if err := s.refresh(ctx); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	type scored struct {
+		id    string
+		score float64
+	}
+	candidates := make([]scored, 0, len(s.ids))
+	for i, id := range s.ids {
+		if allowed != nil && !allowed[id] {
+			continue
+		}
+		vec := s.vecs[i]
+		if len(vec) != len(query) {
+			continue
+		}
+		var score float64
+		if s.metric == "L2" {
+			score = squaredDistance(query, vec)
+		} else {
+			score = dot(query, vec)
+		}
+		candidates = append(candidates, scored{id, score})
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(candidates, func(a, b scored) int {
+		if s.metric == "L2" {
+			return cmp.Compare(a.score, b.score)
+		}
+		return cmp.Compare(b.score, a.score)
+	})
+
+	// Fetch chunk rows for the best candidates; a vector whose chunk was
+	// deleted or became non-indexable since indexing is skipped
+	hits := make([]VectorHit, 0, limit)
+	for start := 0; start < len(candidates) && len(hits) < limit; start += limit {
+		page := candidates[start:min(start+limit, len(candidates))]
+		ids := make([]string, len(page))
+		for i, c := range page {
+			ids[i] = c.id
+		}
+		chunks, err := s.loadChunks(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range page {
+			chunk, ok := chunks[c.id]
+			if !ok {
+				continue
+			}
+			hits = append(hits, VectorHit{Chunk: *chunk, Rank: len(hits) + 1, Score: c.score})
+			if len(hits) == limit {
+				break
+			}
+		}
+	}
+	return hits, nil
+}
+
+// filteredChunkIDs returns the indexable chunks matching filter
+func (s *SQLiteVectorSearcher) filteredChunkIDs(ctx context.Context, filter SearchFilter) (map[string]bool, error) {
+	clause, args := sqliteFilterClause(filter)
+	rows, err := s.db.QueryContext(ctx, `SELECT c.chunk_id FROM chunks c WHERE c.is_indexable = 1 `+clause, args...)
+	if err != nil {
+		return nil, fmt.Errorf("filtering chunks: %w", err)
+	}
+	defer rows.Close()
+	allowed := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scanning chunk_id: %w", err)
+		}
+		allowed[id] = true
+	}
+	return allowed, rows.Err()
+}
+
+func (s *SQLiteVectorSearcher) loadChunks(ctx context.Context, ids []string) (map[string]*Chunk, error) {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT `+chunkColumns+` FROM chunks WHERE is_indexable = 1 AND chunk_id IN (`+placeholders(len(ids))+`)`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("loading chunks: %w", err)
+	}
+	defer rows.Close()
+	chunks := make(map[string]*Chunk, len(ids))
+	for rows.Next() {
+		chunk, err := scanChunk(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scanning chunk: %w", err)
+		}
+		chunks[chunk.ChunkID] = chunk
+	}
+	return chunks, rows.Err()
+}
+
+// Stats reports the vector table in the shape of Milvus collection stats
+func (s *SQLiteVectorSearcher) Stats(ctx context.Context) (MilvusStats, error) {
+	stats := MilvusStats{
+		Connected:      true,
+		Collection:     s.table,
+		IndexType:      "FLAT (sqlite)",
+		EmbeddingModel: s.cfg.Embedding.Model,
+		EmbeddingDim:   s.cfg.Embedding.Dimension,
+	}
+	version, err := vectordb.GetSQLiteVectorVersion(ctx, s.db, s.table)
+	if err != nil {
+		return stats, fmt.Errorf("%w: reading %s: %w", ErrUnavailable, s.table, err)
+	}
+	stats.RowCount = version.Rows
+	return stats, nil
+}
+
+// Close releases the cached vectors; the database handle belongs to the caller
+func (s *SQLiteVectorSearcher) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids, s.vecs, s.loaded = nil, nil, false
+	return nil
+}
+
+func normalize(v []float32) {
+	var sum float64
+	for _, f := range v {
+		sum += float64(f) * float64(f)
+	}
+	if sum == 0 {
+		return
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= norm
+	}
+}
+
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+func squaredDistance(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		d := float64(a[i]) - float64(b[i])
+		sum += d * d
+	}
+	return sum
+}
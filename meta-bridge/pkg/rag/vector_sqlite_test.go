@@ -0,0 +1,109 @@
+package rag
+
+import (
+	"context"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+func TestSQLiteVectorSearcher(t *testing.T) {
+	db := newTestChunkDB(t)
+	db.SetMaxOpenConns(1) // one :memory: database
+	ctx := context.Background()
+
+	if _, err := NewSQLiteVectorSearcher(ctx, db, ragconfig.Default()); err == nil {
+		t.Fatal("expected an error without the vector table")
+	}
+	if _, err := vectordb.EnsureSQLiteVectorTable(ctx, db, vectordb.SQLiteVectorTable); err != nil {
+		t.Fatalf("EnsureSQLiteVectorTable: %v", err)
+	}
+	// b is not indexable; e has no chunk row (deleted since indexing)
+	err := vectordb.UpsertSQLiteVectors(ctx, db, vectordb.SQLiteVectorTable,
+		[]string{"a", "b", "c", "d", "e"},
+		[][]float32{{1, 0}, {1, 0.01}, {0, 1}, {0.8, 0.6}, {1, 0.02}})
+	if err != nil {
+		t.Fatalf("UpsertSQLiteVectors: %v", err)
+	}
+
+	s, err := NewSQLiteVectorSearcher(ctx, db, ragconfig.Default())
+	if err != nil {
+		t.Fatalf("NewSQLiteVectorSearcher: %v", err)
+	}
+
+	hits, err := s.Search(ctx, []float64{2, 0}, 3, 0, SearchFilter{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if got := hitIDs(hits); got != "a,d,c" {
+		t.Fatalf("hits = %s, want a,d,c", got)
+	}
+	if hits[0].Rank != 1 || hits[0].Score < 0.999 || hits[0].ThreadID != 1 {
+		t.Fatalf("first hit = %+v", hits[0])
+	}
+
+	hits, err = s.Search(ctx, []float64{1, 0}, 3, 0, SearchFilter{ThreadIDs: []int64{1}})
+	if err != nil {
+		t.Fatalf("Search with filter: %v", err)
+	}
+	if got := hitIDs(hits); got != "a,c" {
+		t.Fatalf("filtered hits = %s, want a,c", got)
+	}
+
+	// Writes after construction are picked up on the next search
+	if err := vectordb.UpsertSQLiteVectors(ctx, db, vectordb.SQLiteVectorTable, []string{"c"}, [][]float32{{1, 0}}); err != nil {
+		t.Fatalf("UpsertSQLiteVectors: %v", err)
+	}
+	if _, err := vectordb.DeleteSQLiteVectors(ctx, db, vectordb.SQLiteVectorTable, []string{"a"}); err != nil {
+		t.Fatalf("DeleteSQLiteVectors: %v", err)
+	}
+	hits, err = s.Search(ctx, []float64{1, 0}, 1, 0, SearchFilter{})
+	if err != nil || hitIDs(hits) != "c" {
+		t.Fatalf("after update: %s, %v", hitIDs(hits), err)
+	}
+
+	stats, err := s.Stats(ctx)
+	if err != nil || stats.RowCount != 4 || stats.Collection != vectordb.SQLiteVectorTable {
+		t.Fatalf("Stats = %+v, %v", stats, err)
+	}
+}
+
+func TestSQLiteVectorSearcher_L2(t *testing.T) {
+	db := newTestChunkDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	if _, err := vectordb.EnsureSQLiteVectorTable(ctx, db, vectordb.SQLiteVectorTable); err != nil {
+		t.Fatalf("EnsureSQLiteVectorTable: %v", err)
+	}
+	err := vectordb.UpsertSQLiteVectors(ctx, db, vectordb.SQLiteVectorTable, []string{"a", "c"}, [][]float32{{10, 0}, {1, 1}})
+	if err != nil {
+		t.Fatalf("UpsertSQLiteVectors: %v", err)
+	}
+
+	cfg := ragconfig.Default()
+	cfg.Milvus.Index.Metric = "L2"
+	s, err := NewSQLiteVectorSearcher(ctx, db, cfg)
+	if err != nil {
+		t.Fatalf("NewSQLiteVectorSearcher: %v", err)
+	}
+	// Cosine would rank a first; by distance c is much closer
+	hits, err := s.Search(ctx, []float64{1, 0}, 2, 0, SearchFilter{})
+	if err != nil || hitIDs(hits) != "c,a" {
+		t.Fatalf("hits = %s, %v", hitIDs(hits), err)
+	}
+	if hits[0].Score != 1 {
+		t.Fatalf("score = %v, want squared distance 1", hits[0].Score)
+	}
+}
+
+func hitIDs(hits []VectorHit) string {
+	var s string
+	for i, h := range hits {
+		if i > 0 {
+			s += ","
+		}
+		s += h.ChunkID
+	}
+	return s
+}
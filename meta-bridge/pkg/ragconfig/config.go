@@ -15,17 +15,57 @@ import (
 
 // Config represents the unified RAG configuration
 type Config struct {
-	Milvus    MilvusConfig    `yaml:"milvus"`
-	Embedding EmbeddingConfig `yaml:"embedding"`
-	Chunking  ChunkingConfig  `yaml:"chunking"`
-	Quality   QualityConfig   `yaml:"quality"`
-	Hybrid    HybridConfig    `yaml:"hybrid"`
-	Database  DatabaseConfig  `yaml:"database"`
-	Metadata  MetadataConfig  `yaml:"metadata"`
+	// Profile presets defaults for the machine: "standard" (or empty) or
+	// "low-power" (see ProfileLowPower). omitempty keeps the hash of configs
+	// without it unchanged.
+	Profile string `yaml:"profile,omitempty"`
+
+	Vector     VectorConfig     `yaml:"vector"`
+	Milvus     MilvusConfig     `yaml:"milvus"`
+	Embedding  EmbeddingConfig  `yaml:"embedding"`
+	Chunking   ChunkingConfig   `yaml:"chunking"`
+	Normalize  NormalizeConfig  `yaml:"normalize"`
+	Language   LanguageConfig   `yaml:"language"`
+	Quality    QualityConfig    `yaml:"quality"`
+	Hybrid     HybridConfig     `yaml:"hybrid"`
+	Database   DatabaseConfig   `yaml:"database"`
+	Media      MediaConfig      `yaml:"media"`
+	LLM        LLMConfig        `yaml:"llm"`
+	Ask        AskConfig        `yaml:"ask"`
+	Rerank     RerankConfig     `yaml:"rerank"`
+	Expand     ExpandConfig     `yaml:"expand"`
+	HyDE       HyDEConfig       `yaml:"hyde"`
+	Dedup      DedupConfig      `yaml:"dedup"`
+	Transcribe TranscribeConfig `yaml:"transcription"`
+	Vision     VisionConfig     `yaml:"vision"`
+	Summarize  SummarizeConfig  `yaml:"summarize"`
+	Rechunk    RechunkConfig    `yaml:"rechunk"`
+	Usage      UsageConfig      `yaml:"usage"`
+	SlowQuery  SlowQueryConfig  `yaml:"slow_query"`
+	Metadata   MetadataConfig   `yaml:"metadata"`
+	Auth       AuthConfig       `yaml:"auth"`
 }
 
+// VectorConfig selects where chunk embeddings are stored and searched
+type VectorConfig struct {
+	// Backend is "milvus" or "sqlite" (vectors in the main database,
+	// brute-force search; no external services, fine for small archives)
+	Backend string `yaml:"backend"`
+}
+
+// Vector backends
+const (
+	VectorBackendMilvus = "milvus"
+	VectorBackendSQLite = "sqlite"
+)
+
 type MilvusConfig struct {
 	Address                 string             `yaml:"address"`
+	Database                string             `yaml:"database"` // Empty = server default database
+	Username                string             `yaml:"username"`
+	PasswordEnv             string             `yaml:"password_env"` // Env var holding the password (never stored in the config)
+	APIKeyEnv               string             `yaml:"api_key_env"`  // Env var holding the API key, e.g. for Zilliz Cloud
+	TLS                     bool               `yaml:"tls"`
 	ChunkCollection         string             `yaml:"chunk_collection"`
 	LegacyMessageCollection string             `yaml:"legacy_message_collection"`
 	Index                   MilvusIndexConfig  `yaml:"index"`
@@ -40,23 +80,79 @@ type MilvusIndexConfig struct {
 }
 
 type MilvusSearchConfig struct {
-	Ef              int `yaml:"ef"`
-	FetchMultiplier int `yaml:"fetch_multiplier"`
+	Ef              int                   `yaml:"ef"`
+	FetchMultiplier int                   `yaml:"fetch_multiplier"`
+	AutoScale       MilvusAutoScaleConfig `yaml:"auto_scale"`
+}
+
+// MilvusAutoScaleConfig grows ef and fetch_multiplier with the number of
+// vectors in the collection, since values tuned for 10k chunks recall too
+// little at 1M. Both scale by 1 + log10(rows / reference_rows), then are
+// clamped to the bounds.
+type MilvusAutoScaleConfig struct {
+	Enabled            bool  `yaml:"enabled"`
+	ReferenceRows      int64 `yaml:"reference_rows"` // Collection size ef and fetch_multiplier are tuned for
+	MinEf              int   `yaml:"min_ef"`
+	MaxEf              int   `yaml:"max_ef"`               // 0 = unbounded
+	MaxFetchMultiplier int   `yaml:"max_fetch_multiplier"` // 0 = unbounded
+	RefreshSeconds     int   `yaml:"refresh_seconds"`      // How long the row count is cached
 }
 
 type EmbeddingConfig struct {
-	BaseURL   string `yaml:"base_url"`
-	Model     string `yaml:"model"`
-	Dimension int    `yaml:"dimension"`
-	BatchSize int    `yaml:"batch_size"`
+	// Provider is the server's API: "openai" (OpenAI-compatible, incl.
+	// LMStudio), "ollama" (native /api/embed) or "llamacpp" (native /embedding)
+	Provider     string `yaml:"provider"`
+	BaseURL      string `yaml:"base_url"`
+	Model        string `yaml:"model"`
+	Dimension    int    `yaml:"dimension"`
+	BatchSize    int    `yaml:"batch_size"`
+	MaxBatchSize int    `yaml:"max_batch_size"` // Texts per request; 0 = the provider's limit
+	APIKeyEnv    string `yaml:"api_key_env"`    // Env var holding the API key (never stored in the config)
+
+	// Transport is "http" (native client) or "curl" (shell out to curl,
+	// only for servers that misbehave with Go's client)
+	Transport           string `yaml:"transport"`
+	TimeoutSeconds      int    `yaml:"timeout_seconds"`       // Single-text requests
+	BatchTimeoutSeconds int    `yaml:"batch_timeout_seconds"` // Batch requests
+	MaxRetries          int    `yaml:"max_retries"`           // Attempts per request, including the first
+	RetryWaitSeconds    int    `yaml:"retry_wait_seconds"`    // Pause before a retry (model reloads take a while)
+	KeepAlive           bool   `yaml:"keep_alive"`            // Reuse connections between requests
+	MaxConnsPerHost     int    `yaml:"max_conns_per_host"`    // 0 = unlimited
+
+	Server EmbeddingServerConfig `yaml:"server"`
 }
 
+// EmbeddingServerConfig has the tools that embed (milvus-index, rag-pipeline,
+// rag-indexerd) start the embedding server themselves and restart it if it
+// dies, instead of expecting it to be running
+type EmbeddingServerConfig struct {
+	Command             []string `yaml:"command"`               // Program and arguments; empty = don't start one
+	ReadyTimeoutSeconds int      `yaml:"ready_timeout_seconds"` // How long loading the model may take
+	RestartWaitSeconds  int      `yaml:"restart_wait_seconds"`  // Pause before a restart, doubled up to a minute while it keeps crashing
+}
+
+// Embedding providers
+const (
+	EmbeddingProviderOpenAI   = "openai"
+	EmbeddingProviderOllama   = "ollama"
+	EmbeddingProviderLlamaCpp = "llamacpp"
+)
+
+// Embedding transports
+const (
+	EmbeddingTransportHTTP = "http"
+	EmbeddingTransportCurl = "curl"
+)
+
 type ChunkingConfig struct {
-	Version  int                 `yaml:"version"`
-	Coalesce ChunkCoalesceConfig `yaml:"coalesce"`
-	Session  ChunkSessionConfig  `yaml:"session"`
-	Size     ChunkSizeConfig     `yaml:"size"`
-	Format   ChunkFormatConfig   `yaml:"format"`
+	Version    int                   `yaml:"version"`
+	Coalesce   ChunkCoalesceConfig   `yaml:"coalesce"`
+	Session    ChunkSessionConfig    `yaml:"session"`
+	Size       ChunkSizeConfig       `yaml:"size"`
+	Format     ChunkFormatConfig     `yaml:"format"`
+	SelfThread ChunkSelfThreadConfig `yaml:"self_thread"`
+	// omitempty keeps the source fingerprint of configs without it unchanged
+	Attachments ChunkAttachmentsConfig `yaml:"attachments,omitempty"`
 }
 
 type ChunkCoalesceConfig struct {
@@ -74,9 +170,69 @@ type ChunkSizeConfig struct {
 	MinChars    int `yaml:"min_chars"`
 }
 
+// ChunkSelfThreadConfig sets how the user's own "note to self" thread
+// (thread_id == current_user_id) is chunked. Saved notes and links have no
+// conversational rhythm, so coalescing and session splitting don't fit.
+type ChunkSelfThreadConfig struct {
+	// Profile is "message" (one message per chunk) or "conversation" (same
+	// rules as every other thread)
+	Profile string `yaml:"profile"`
+}
+
+// Self-thread chunking profiles
+const (
+	SelfThreadProfileMessage      = "message"
+	SelfThreadProfileConversation = "conversation"
+)
+
+// ChunkAttachmentsConfig sets which attachments are noted in chunk text, so
+// a chunk shows that a photo or link was sent even when no text came with it
+type ChunkAttachmentsConfig struct {
+	// Placeholders lists the attachment kinds noted in chunk text: photo,
+	// gif, sticker, video, audio, file and link. Empty notes none.
+	Placeholders []string `yaml:"placeholders,omitempty"`
+}
+
 type ChunkFormatConfig struct {
 	SenderPrefix    bool   `yaml:"sender_prefix"`
 	TimestampFormat string `yaml:"timestamp_format"`
+	// Reactions appends "[Name reacted ❤️]" lines to reacted messages
+	// (omitempty keeps the source fingerprint of configs without it unchanged)
+	Reactions bool `yaml:"reactions,omitempty"`
+	// Replies prefixes replies with "[replying to Name: '…']", a snippet of
+	// the message they answer
+	Replies bool `yaml:"replies,omitempty"`
+	// GroupHeader starts group-chat chunks with a "Group: Name — participants:
+	// A, B, C" line, so the embedding knows the social context
+	GroupHeader bool `yaml:"group_header,omitempty"`
+	// IncludeDate starts chunks with the months they span ("June 2017"),
+	// for embedding models that never see timestamps
+	IncludeDate bool `yaml:"include_date,omitempty"`
+}
+
+// NormalizeConfig controls text normalization applied to message text before
+// chunking (FTS + embeddings) and to search queries.
+type NormalizeConfig struct {
+	Enabled         bool `yaml:"enabled"`
+	StripZeroWidth  bool `yaml:"strip_zero_width"`
+	UnicodeNFC      bool `yaml:"unicode_nfc"`
+	MaxLetterRepeat int  `yaml:"max_letter_repeat"` // Applies to runs of 4+ letters inside words; 0 = don't collapse
+	MaxEmojiRepeat  int  `yaml:"max_emoji_repeat"`  // 0 = don't collapse
+}
+
+// LanguageConfig controls per-query language analysis (BM25 stopwords and
+// stemming, embedding instruction prefix)
+type LanguageConfig struct {
+	Default   string                     `yaml:"default"` // Used when detection is off or undecided
+	Detect    bool                       `yaml:"detect"`
+	Languages map[string]LanguageProfile `yaml:"languages"`
+}
+
+// LanguageProfile is the query analysis applied for one language
+type LanguageProfile struct {
+	Stopwords   bool   `yaml:"stopwords"`    // Drop stopwords from BM25 queries
+	Stemming    bool   `yaml:"stemming"`     // Match stemmed BM25 terms as prefixes
+	QueryPrefix string `yaml:"query_prefix"` // Prepended to the query before embedding
 }
 
 type QualityConfig struct {
@@ -103,6 +259,16 @@ type HybridConfig struct {
 	RRF     RRFConfig     `yaml:"rrf"`
 	Weights HybridWeights `yaml:"weights"`
 	BM25    BM25Config    `yaml:"bm25"`
+	Recency RecencyConfig `yaml:"recency"`
+}
+
+// RecencyConfig boosts the fused scores of recent chunks, so a question
+// about an ongoing plan finds its latest discussion before older ones.
+// A chunk's score is multiplied by 1 + Boost * 2^(-age / HalfLifeDays),
+// where age is how much older it ends than the newest candidate.
+type RecencyConfig struct {
+	Boost        float64 `yaml:"boost"` // 0 disables the boost
+	HalfLifeDays float64 `yaml:"half_life_days"`
 }
 
 type RRFConfig struct {
@@ -116,10 +282,241 @@ type HybridWeights struct {
 
 type BM25Config struct {
 	Table string `yaml:"table"`
+	// Engine is the SQLite module new FTS tables are created with: "auto"
+	// (FTS5 if the SQLite build has it, FTS4 otherwise), "fts5" or "fts4".
+	// FTS4 has no bm25(), so results are ranked by a BM25-lite in Go.
+	Engine    string          `yaml:"engine"`
+	Tokenizer TokenizerConfig `yaml:"tokenizer"`
+}
+
+// TokenizerConfig is the tokenizer of new FTS5 tables. A stemming tokenizer
+// indexes inflected forms ("wakacje", "wakacjach", "wakacjami") as one term,
+// where the default unicode61 only gets query-side suffix stripping
+// (language.languages.*.stemming). Tokenizers outside FTS5 (Snowball and
+// other custom ones) come from a SQLite extension, loaded into every
+// connection that reads or writes the index.
+type TokenizerConfig struct {
+	Tokenize   string `yaml:"tokenize"`    // FTS5 tokenize= argument; empty = unicode61
+	Extension  string `yaml:"extension"`   // Shared library registering the tokenizer; empty for built-in ones
+	EntryPoint string `yaml:"entry_point"` // Extension init function; empty = derived from the file name
 }
 
+// BM25 engines
+const (
+	BM25EngineAuto = "auto"
+	BM25EngineFTS5 = "fts5"
+	BM25EngineFTS4 = "fts4"
+)
+
 type DatabaseConfig struct {
 	SQLite string `yaml:"sqlite"`
+	// E2EE places messenger-cli's E2EE key store in its own file instead of
+	// sharing SQLite, so key writes don't contend with chunking and indexing.
+	// Existing keys are moved on first use.
+	E2EE string `yaml:"e2ee,omitempty"`
+}
+
+type MediaConfig struct {
+	AvatarsDir     string          `yaml:"avatars_dir"`
+	AttachmentsDir string          `yaml:"attachments_dir"`
+	Downloads      DownloadsConfig `yaml:"downloads"`
+}
+
+// DownloadsConfig throttles avatar-sync and media-sync so bulk downloads stay
+// below the CDN's anti-abuse thresholds. Zero rates mean unlimited.
+type DownloadsConfig struct {
+	Concurrency              int     `yaml:"concurrency"`                  // Parallel downloads in total
+	RequestsPerSecond        float64 `yaml:"requests_per_second"`          // Across all hosts
+	PerHostConcurrency       int     `yaml:"per_host_concurrency"`         // Parallel downloads per host
+	PerHostRequestsPerSecond float64 `yaml:"per_host_requests_per_second"` // Per host
+	// BackoffSeconds pauses a host after a 429 or 503 without Retry-After
+	BackoffSeconds int `yaml:"backoff_seconds"`
+}
+
+// LLMConfig configures the chat model used by /ask, summaries and query rewrite
+type LLMConfig struct {
+	Provider       string  `yaml:"provider"` // "openai" (any OpenAI-compatible server) or "ollama"
+	BaseURL        string  `yaml:"base_url"`
+	Model          string  `yaml:"model"`
+	APIKeyEnv      string  `yaml:"api_key_env"` // Env var holding the API key (never stored in the config)
+	Temperature    float64 `yaml:"temperature"`
+	MaxTokens      int     `yaml:"max_tokens"`
+	TimeoutSeconds int     `yaml:"timeout_seconds"`
+	MaxRetries     int     `yaml:"max_retries"`
+}
+
+// AskConfig configures rag-server's /ask, which answers a question with the
+// model in the llm section from the chunks a hybrid search returns for it
+type AskConfig struct {
+	Model           string `yaml:"model"`             // Overrides llm.model
+	MaxTokens       int    `yaml:"max_tokens"`        // Answer length cap (0 = llm.max_tokens)
+	ContextChunks   int    `yaml:"context_chunks"`    // Chunks retrieved per question
+	MaxContextChars int    `yaml:"max_context_chars"` // Chunks past this are left out of the prompt
+	Prompt          string `yaml:"prompt"`            // System prompt; excerpts are numbered [1], [2], ...
+}
+
+// RerankConfig configures the optional cross-encoder reranking of fused
+// hybrid results. The endpoint must speak the Jina/Cohere-style rerank API
+// (POST {base_url}/rerank), as served by llama.cpp, Infinity, vLLM or TEI.
+type RerankConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	BaseURL        string `yaml:"base_url"`
+	Model          string `yaml:"model"`
+	APIKeyEnv      string `yaml:"api_key_env"` // Env var holding the API key (never stored in the config)
+	TopN           int    `yaml:"top_n"`       // Fused candidates sent to the reranker
+	TimeoutSeconds int    `yaml:"timeout_seconds"`
+}
+
+// ExpandConfig configures multi-query expansion: the query is searched
+// along with paraphrases and translations of it, and the result lists are
+// fused with RRF. It finds Polish messages for an English query and the
+// other way round.
+type ExpandConfig struct {
+	Enabled bool `yaml:"enabled"` // Expand searches that don't set expand themselves
+	// Source of the variants: "llm" (the model in the llm section, falling
+	// back to synonyms when there is none or it fails) or "synonyms"
+	Source         string              `yaml:"source"`
+	Model          string              `yaml:"model"`           // Overrides llm.model
+	MaxQueries     int                 `yaml:"max_queries"`     // Variants searched besides the query
+	TimeoutSeconds int                 `yaml:"timeout_seconds"` // LLM wait before falling back
+	Synonyms       map[string][]string `yaml:"synonyms"`        // Word -> alternatives, matched ignoring case
+}
+
+// Expansion sources
+const (
+	ExpandSourceLLM      = "llm"
+	ExpandSourceSynonyms = "synonyms"
+)
+
+// HyDEConfig configures mode=hyde searches: the model in the llm section
+// writes a chat snippet that would answer the query, and the vector search
+// uses its embedding instead of the query's
+type HyDEConfig struct {
+	Model          string `yaml:"model"`           // Overrides llm.model
+	MaxTokens      int    `yaml:"max_tokens"`      // Snippet length cap
+	TimeoutSeconds int    `yaml:"timeout_seconds"` // LLM wait before searching with the query itself
+	Prompt         string `yaml:"prompt"`          // System prompt; the query is the user message
+}
+
+// DedupConfig configures collapsing near-duplicate search hits, so a
+// message forwarded to several threads, or overlapping chunks of one
+// session, take one place in the results instead of several. The
+// best-ranked of them stays.
+type DedupConfig struct {
+	Enabled bool `yaml:"enabled"` // Dedup searches that don't set dedup themselves
+	// Similarity is the Jaccard similarity of word shingles (estimated by
+	// MinHash) from which two chunks count as the same text; 0 = never
+	Similarity   float64 `yaml:"similarity"`
+	ShingleWords int     `yaml:"shingle_words"` // Words per shingle
+	// SessionOverlap is the share of the smaller chunk's messages that a
+	// chunk of the same session must also have to count as the same; 0 =
+	// never
+	SessionOverlap float64 `yaml:"session_overlap"`
+	// MergeContext merges hits of one session whose context windows
+	// overlap or touch into one result, when a search asks for context
+	MergeContext bool `yaml:"merge_context"`
+}
+
+// TranscribeConfig configures voice message transcription by voice-transcribe.
+// The endpoint must speak the OpenAI audio API (POST
+// {base_url}/audio/transcriptions, multipart), as served by whisper.cpp,
+// faster-whisper-server, LocalAI or OpenAI itself.
+type TranscribeConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	BaseURL        string `yaml:"base_url"`
+	Model          string `yaml:"model"`
+	Language       string `yaml:"language"`    // ISO-639-1 hint; empty = auto-detect
+	APIKeyEnv      string `yaml:"api_key_env"` // Env var holding the API key (never stored in the config)
+	TimeoutSeconds int    `yaml:"timeout_seconds"`
+	MaxFileMB      int    `yaml:"max_file_mb"` // Larger files are skipped (OpenAI accepts 25 MB)
+}
+
+// VisionConfig configures image text extraction by image-caption: a vision
+// model reads the text in each image (OCR) and describes it in a sentence.
+// The endpoint must accept OpenAI-style /chat/completions requests with
+// image_url content (LM Studio, Ollama, llama.cpp server, vLLM, OpenAI).
+type VisionConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	BaseURL        string `yaml:"base_url"`
+	Model          string `yaml:"model"`
+	APIKeyEnv      string `yaml:"api_key_env"` // Env var holding the API key (never stored in the config)
+	Prompt         string `yaml:"prompt"`
+	MaxTokens      int    `yaml:"max_tokens"`
+	TimeoutSeconds int    `yaml:"timeout_seconds"`
+	MaxFileMB      int    `yaml:"max_file_mb"` // Larger images are skipped
+}
+
+// SummarizeConfig configures summarize, which has the model in the llm
+// section write a summary of each conversation session and of each thread
+type SummarizeConfig struct {
+	Model           string `yaml:"model"`             // Overrides llm.model
+	MaxTokens       int    `yaml:"max_tokens"`        // Summary length cap
+	MaxInputChars   int    `yaml:"max_input_chars"`   // Longer sessions are cut in the middle
+	MinSessionChars int    `yaml:"min_session_chars"` // Shorter sessions aren't summarized
+	SessionPrompt   string `yaml:"session_prompt"`
+	ThreadPrompt    string `yaml:"thread_prompt"`
+	// Collection is the Milvus collection summary embeddings are indexed in
+	// ("" = don't index)
+	Collection string `yaml:"collection"`
+}
+
+// RechunkConfig controls rag-indexerd's rolling re-chunk: once a night it
+// regenerates the chunks of the threads chunked longest ago, so chunking
+// config changes and edits the change tracking missed reach the index a few
+// threads at a time instead of in one full re-chunk
+type RechunkConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	Threads    int  `yaml:"threads"`      // Threads re-chunked per night
+	Hour       int  `yaml:"hour"`         // Local hour (0-23) from which the nightly run is due
+	MinAgeDays int  `yaml:"min_age_days"` // Threads chunked more recently are left alone
+}
+
+// UsageConfig controls token usage accounting
+type UsageConfig struct {
+	// Prices per model name, used to estimate the cost of recorded usage
+	Prices map[string]ModelPrice `yaml:"prices"`
+}
+
+// ModelPrice is the price in USD per million tokens
+type ModelPrice struct {
+	PromptPer1M     float64 `yaml:"prompt_per_1m"`
+	CompletionPer1M float64 `yaml:"completion_per_1m"`
+}
+
+// SlowQueryConfig controls logging of searches that exceed a latency threshold
+type SlowQueryConfig struct {
+	ThresholdMs int  `yaml:"threshold_ms"` // 0 = disabled
+	Explain     bool `yaml:"explain"`      // Capture SQLite EXPLAIN QUERY PLAN for the BM25 query
+	Persist     bool `yaml:"persist"`      // Store slow queries in the slow_queries table
+}
+
+// AuthConfig protects rag-server and the mcp-server SSE transport with API
+// keys and HTTP basic auth. With neither configured every request is served,
+// as on a loopback-only server.
+type AuthConfig struct {
+	Keys      []APIKeyConfig    `yaml:"keys"`
+	KeysEnv   string            `yaml:"keys_env"` // Env var with more keys, comma-separated "name:key" or "key"
+	BasicAuth []BasicAuthConfig `yaml:"basic_auth"`
+	RateLimit int               `yaml:"rate_limit"` // Requests per minute per key or user (0 = unlimited)
+	Public    []string          `yaml:"public"`     // Paths served without credentials
+}
+
+// APIKeyConfig is a key clients send as "Authorization: Bearer <key>" or
+// "X-API-Key: <key>"
+type APIKeyConfig struct {
+	Name      string `yaml:"name"` // Identifies the key in logs
+	Key       string `yaml:"key"`
+	KeyEnv    string `yaml:"key_env"`    // Env var holding the key, instead of key
+	RateLimit int    `yaml:"rate_limit"` // Requests per minute (0 = auth.rate_limit)
+}
+
+// BasicAuthConfig is a user for HTTP basic auth, which browsers also send
+// for images and media
+type BasicAuthConfig struct {
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	PasswordEnv string `yaml:"password_env"` // Env var holding the password, instead of password
+	RateLimit   int    `yaml:"rate_limit"`   // Requests per minute (0 = auth.rate_limit)
 }
 
 type MetadataConfig struct {
@@ -133,13 +530,23 @@ type MetadataKeysConfig struct {
 	ChunkingVersion string `yaml:"chunking_version"`
 	ConfigHash      string `yaml:"config_hash"`
 	IndexedAt       string `yaml:"indexed_at"`
+	// VectorBackend is the vector.backend the stored vectors were written to
+	VectorBackend string `yaml:"vector_backend"`
+	// SourceFingerprint summarizes the messages and config chunks were last
+	// generated from (see ragindex.SourceFingerprint)
+	SourceFingerprint string `yaml:"source_fingerprint"`
 }
 
 // Default returns the default configuration
 func Default() *Config {
 	return &Config{
+		Vector: VectorConfig{
+			Backend: VectorBackendMilvus,
+		},
 		Milvus: MilvusConfig{
 			Address:                 "localhost:19530",
+			PasswordEnv:             "MILVUS_PASSWORD",
+			APIKeyEnv:               "MILVUS_API_KEY",
 			ChunkCollection:         "messenger_message_chunks_v2",
 			LegacyMessageCollection: "messenger_messages",
 			Index: MilvusIndexConfig{
@@ -151,13 +558,31 @@ func Default() *Config {
 			Search: MilvusSearchConfig{
 				Ef:              128,
 				FetchMultiplier: 3,
+				AutoScale: MilvusAutoScaleConfig{
+					ReferenceRows:      10000,
+					MinEf:              64,
+					MaxEf:              512,
+					MaxFetchMultiplier: 10,
+					RefreshSeconds:     300,
+				},
 			},
 		},
 		Embedding: EmbeddingConfig{
+			Provider:  EmbeddingProviderOpenAI,
 			BaseURL:   "http://127.0.0.1:1235/v1",
 			Model:     "mmlw-roberta-large",
 			Dimension: 1024,
 			BatchSize: 32,
+
+			Transport:           EmbeddingTransportHTTP,
+			TimeoutSeconds:      30,
+			BatchTimeoutSeconds: 120,
+			MaxRetries:          3,
+			RetryWaitSeconds:    10,
+			Server: EmbeddingServerConfig{
+				ReadyTimeoutSeconds: 120,
+				RestartWaitSeconds:  5,
+			},
 		},
 		Chunking: ChunkingConfig{
 			Version: 2,
@@ -177,6 +602,24 @@ func Default() *Config {
 				SenderPrefix:    true,
 				TimestampFormat: "",
 			},
+			SelfThread: ChunkSelfThreadConfig{
+				Profile: SelfThreadProfileMessage,
+			},
+		},
+		Normalize: NormalizeConfig{
+			Enabled:         true,
+			StripZeroWidth:  true,
+			UnicodeNFC:      true,
+			MaxLetterRepeat: 2,
+			MaxEmojiRepeat:  1,
+		},
+		Language: LanguageConfig{
+			Default: "pl",
+			Detect:  true,
+			Languages: map[string]LanguageProfile{
+				"pl": {Stopwords: true, Stemming: true},
+				"en": {Stopwords: true, Stemming: true},
+			},
 		},
 		Quality: QualityConfig{
 			MinChars:       250,
@@ -202,22 +645,130 @@ func Default() *Config {
 				BM25:   0.5,
 			},
 			BM25: BM25Config{
-				Table: "chunks_fts",
+				Table:  "chunks_fts",
+				Engine: BM25EngineAuto,
+			},
+			Recency: RecencyConfig{
+				HalfLifeDays: 180,
 			},
 		},
 		Database: DatabaseConfig{
 			SQLite: "messenger.db",
 		},
+		Media: MediaConfig{
+			AvatarsDir:     "web/static/avatars",
+			AttachmentsDir: "media/attachments",
+			Downloads: DownloadsConfig{
+				Concurrency:              4,
+				RequestsPerSecond:        5,
+				PerHostConcurrency:       2,
+				PerHostRequestsPerSecond: 2,
+				BackoffSeconds:           60,
+			},
+		},
+		LLM: LLMConfig{
+			Provider:       "openai",
+			BaseURL:        "http://127.0.0.1:1234/v1",
+			Model:          "",
+			APIKeyEnv:      "LLM_API_KEY",
+			Temperature:    0.2,
+			MaxTokens:      1024,
+			TimeoutSeconds: 120,
+			MaxRetries:     2,
+		},
+		Ask: AskConfig{
+			MaxTokens:       0,
+			ContextChunks:   8,
+			MaxContextChars: 12000,
+			Prompt: "You answer questions about the user's chat history using only the numbered chat excerpts " +
+				"given with the question. Cite the excerpts you rely on as [n]. If they don't contain the answer, " +
+				"say so instead of guessing. Answer in the language of the question.",
+		},
+		Rerank: RerankConfig{
+			Enabled:        false,
+			BaseURL:        "http://127.0.0.1:1234/v1",
+			Model:          "bge-reranker-v2-m3",
+			APIKeyEnv:      "RERANK_API_KEY",
+			TopN:           30,
+			TimeoutSeconds: 10,
+		},
+		Expand: ExpandConfig{
+			Enabled:        false,
+			Source:         ExpandSourceLLM,
+			MaxQueries:     3,
+			TimeoutSeconds: 10,
+		},
+		Dedup: DedupConfig{
+			Enabled:        true,
+			Similarity:     0.8,
+			ShingleWords:   3,
+			SessionOverlap: 0.5,
+			MergeContext:   true,
+		},
+		HyDE: HyDEConfig{
+			MaxTokens:      200,
+			TimeoutSeconds: 15,
+			Prompt: "You write a short excerpt of a Messenger conversation that answers the user's query, " +
+				"as a few lines of casual chat between friends, in the language of the query. " +
+				"Make up plausible details. Reply with the excerpt only.",
+		},
+		Transcribe: TranscribeConfig{
+			Enabled:        false,
+			BaseURL:        "http://127.0.0.1:8080/v1",
+			Model:          "whisper-1",
+			APIKeyEnv:      "TRANSCRIBE_API_KEY",
+			TimeoutSeconds: 300,
+			MaxFileMB:      25,
+		},
+		Vision: VisionConfig{
+			Enabled:   false,
+			BaseURL:   "http://127.0.0.1:1234/v1",
+			Model:     "",
+			APIKeyEnv: "VISION_API_KEY",
+			Prompt: "Transcribe all readable text in this image verbatim. Then describe the image in one sentence. " +
+				"Reply with plain text only, in the language of the text in the image if there is any.",
+			MaxTokens:      512,
+			TimeoutSeconds: 120,
+			MaxFileMB:      10,
+		},
+		Summarize: SummarizeConfig{
+			MaxTokens:       300,
+			MaxInputChars:   12000,
+			MinSessionChars: 300,
+			SessionPrompt: "Summarize this chat conversation in 2-4 sentences: who took part, what was discussed " +
+				"and anything decided or planned. Use the language of the conversation. Reply with the summary only.",
+			ThreadPrompt: "These are summaries of the conversations in one chat, oldest first. Summarize the whole chat " +
+				"in 3-6 sentences: who is in it, recurring topics and notable events. Use the language of the " +
+				"summaries. Reply with the summary only.",
+			Collection: "",
+		},
+		Rechunk: RechunkConfig{
+			Enabled:    false,
+			Threads:    200,
+			Hour:       3,
+			MinAgeDays: 7,
+		},
+		SlowQuery: SlowQueryConfig{
+			ThresholdMs: 1000,
+			Explain:     true,
+			Persist:     true,
+		},
 		Metadata: MetadataConfig{
 			Table: "rag_metadata",
 			Keys: MetadataKeysConfig{
-				EmbeddingModel:  "rag_embedding_model",
-				EmbeddingDim:    "rag_embedding_dim",
-				ChunkingVersion: "rag_chunking_version",
-				ConfigHash:      "rag_config_hash",
-				IndexedAt:       "rag_indexed_at",
+				EmbeddingModel:    "rag_embedding_model",
+				EmbeddingDim:      "rag_embedding_dim",
+				ChunkingVersion:   "rag_chunking_version",
+				ConfigHash:        "rag_config_hash",
+				IndexedAt:         "rag_indexed_at",
+				VectorBackend:     "rag_vector_backend",
+				SourceFingerprint: "rag_source_fingerprint",
 			},
 		},
+		Auth: AuthConfig{
+			KeysEnv: "RAG_API_KEYS",
+			Public:  []string{"/health"},
+		},
 	}
 }
 
@@ -232,6 +783,9 @@ func Load(path string) (*Config, error) {
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	if err := cfg.applyProfile(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
 
 	return cfg, nil
 }
@@ -272,6 +826,16 @@ func (c *Config) Hash() string {
 	return hex.EncodeToString(hash[:])
 }
 
+// EstimateCost returns the USD cost of the given token counts for model,
+// or 0 if no price is configured for it
+func (c *Config) EstimateCost(model string, promptTokens, completionTokens int64) float64 {
+	price, ok := c.Usage.Prices[model]
+	if !ok {
+		return 0
+	}
+	return (float64(promptTokens)*price.PromptPer1M + float64(completionTokens)*price.CompletionPer1M) / 1e6
+}
+
 // EmbeddingIdentity returns a string identifying the embedding configuration
 // Use this to detect mismatches between index and query embeddings
 func (c *Config) EmbeddingIdentity() string {
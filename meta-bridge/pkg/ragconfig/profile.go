@@ -0,0 +1,62 @@
+package ragconfig
+
+import "fmt"
+
+// Profiles preset defaults for a kind of machine
+const (
+	ProfileStandard = "standard"
+	// ProfileLowPower suits Raspberry Pi-class boards: a small embedding
+	// model, a smaller HNSW graph and search width, fewer candidates and
+	// smaller batches
+	ProfileLowPower = "low-power"
+)
+
+// LowPowerEmbeddingModel is the embedding model of the low-power profile:
+// the small Polish-tuned E5, which scripts/embed_server.py also serves
+const (
+	LowPowerEmbeddingModel     = "mmlw-e5-small"
+	LowPowerEmbeddingDimension = 384
+)
+
+// applyProfile changes the settings the profile covers that are still at
+// their standard defaults. A rag.yaml that spells out every default then
+// switches with the profile key alone, and values changed by hand win.
+func (c *Config) applyProfile() error {
+	switch c.Profile {
+	case "", ProfileStandard:
+		return nil
+	case ProfileLowPower:
+	default:
+		return fmt.Errorf("unknown profile %q (use %s or %s)", c.Profile, ProfileStandard, ProfileLowPower)
+	}
+
+	std := Default()
+	// The dimension belongs to the model, so they only change together
+	if c.Embedding.Model == std.Embedding.Model && c.Embedding.Dimension == std.Embedding.Dimension {
+		c.Embedding.Model = LowPowerEmbeddingModel
+		c.Embedding.Dimension = LowPowerEmbeddingDimension
+	}
+	preset(&c.Embedding.BatchSize, std.Embedding.BatchSize, 8)
+	preset(&c.Embedding.BatchTimeoutSeconds, std.Embedding.BatchTimeoutSeconds, 300)
+
+	preset(&c.Milvus.Index.M, std.Milvus.Index.M, 8)
+	preset(&c.Milvus.Index.EfConstruction, std.Milvus.Index.EfConstruction, 64)
+	preset(&c.Milvus.Search.Ef, std.Milvus.Search.Ef, 48)
+	preset(&c.Milvus.Search.FetchMultiplier, std.Milvus.Search.FetchMultiplier, 2)
+	preset(&c.Milvus.Search.AutoScale.MinEf, std.Milvus.Search.AutoScale.MinEf, 32)
+	preset(&c.Milvus.Search.AutoScale.MaxEf, std.Milvus.Search.AutoScale.MaxEf, 128)
+	preset(&c.Milvus.Search.AutoScale.MaxFetchMultiplier, std.Milvus.Search.AutoScale.MaxFetchMultiplier, 4)
+
+	preset(&c.Rerank.TopN, std.Rerank.TopN, 10)
+	preset(&c.Ask.ContextChunks, std.Ask.ContextChunks, 5)
+	preset(&c.Rechunk.Threads, std.Rechunk.Threads, 50)
+	preset(&c.Media.Downloads.Concurrency, std.Media.Downloads.Concurrency, 2)
+	return nil
+}
+
+// preset sets *v to value if it's still the standard default
+func preset[T comparable](v *T, standard, value T) {
+	if *v == standard {
+		*v = value
+	}
+}
@@ -0,0 +1,44 @@
+package ragconfig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad_LowPowerProfile(t *testing.T) {
+	load := func(yaml string) (*Config, error) {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "rag.yaml")
+		if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return Load(path)
+	}
+
+	// Defaults spelled out in the file still give way to the profile
+	cfg, err := load("profile: low-power\nembedding:\n  model: mmlw-roberta-large\n  dimension: 1024\nmilvus:\n  index:\n    m: 16\n")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Embedding.Model != LowPowerEmbeddingModel || cfg.Embedding.Dimension != LowPowerEmbeddingDimension ||
+		cfg.Embedding.BatchSize != 8 || cfg.Milvus.Index.M != 8 || cfg.Milvus.Search.FetchMultiplier != 2 {
+		t.Errorf("profile not applied: embedding %+v, milvus %+v", cfg.Embedding, cfg.Milvus)
+	}
+
+	// Values changed by hand win, and a custom model keeps its dimension
+	cfg, err = load("profile: low-power\nembedding:\n  model: nomic-embed-text\n  dimension: 768\n  batch_size: 4\n")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Embedding.Model != "nomic-embed-text" || cfg.Embedding.Dimension != 768 || cfg.Embedding.BatchSize != 4 {
+		t.Errorf("explicit values overridden: %+v", cfg.Embedding)
+	}
+
+	if cfg, err = load("embedding:\n  batch_size: 32\n"); err != nil || cfg.Embedding.Model != Default().Embedding.Model {
+		t.Errorf("no profile: %v, model %q", err, cfg.Embedding.Model)
+	}
+	if _, err := load("profile: turbo\n"); err == nil {
+		t.Errorf("expected error for unknown profile")
+	}
+}
@@ -0,0 +1,43 @@
+package ragindex
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.mau.fi/mautrix-meta/pkg/metrics"
+)
+
+// Backlog is how far the indexes are behind the messages table
+type Backlog struct {
+	UnsyncedChunks  int // Indexable chunks not in the vector store yet
+	IndexableChunks int
+	// UnindexedMessages counts messages added, edited or unsent since
+	// rag-indexerd last indexed them (messages.indexed_at is NULL)
+	UnindexedMessages int
+}
+
+// CountBacklog counts the backlog. A database whose messages table predates
+// indexed_at reports no unindexed messages.
+func CountBacklog(ctx context.Context, db *sql.DB) (Backlog, error) {
+	var b Backlog
+	var err error
+	b.UnsyncedChunks, b.IndexableChunks, err = CountPending(ctx, db)
+	if err != nil {
+		return b, err
+	}
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM messages WHERE indexed_at IS NULL").Scan(&b.UnindexedMessages)
+	if err != nil && !strings.Contains(err.Error(), "no such") {
+		return b, fmt.Errorf("counting unindexed messages: %w", err)
+	}
+	return b, nil
+}
+
+// WriteMetrics writes the backlog as Prometheus gauges
+func (b Backlog) WriteMetrics(w io.Writer) {
+	metrics.WriteValue(w, metrics.TypeGauge, "rag_chunks_unsynced", "Indexable chunks not yet in the vector store.", float64(b.UnsyncedChunks))
+	metrics.WriteValue(w, metrics.TypeGauge, "rag_chunks_indexable", "Indexable chunks.", float64(b.IndexableChunks))
+	metrics.WriteValue(w, metrics.TypeGauge, "rag_messages_unindexed", "Messages added, edited or unsent since they were last indexed.", float64(b.UnindexedMessages))
+}
@@ -0,0 +1,235 @@
+package ragindex
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// ErrNoFTS5 means the SQLite library the binary was built with lacks FTS5
+var ErrNoFTS5 = errors.New("this SQLite build has no FTS5 module")
+
+// FTS5Hint is what to do about ErrNoFTS5
+const FTS5Hint = "build with -tags fts5 (and CGO_CFLAGS=-DSQLITE_ENABLE_FTS5 when linking a system SQLite), " +
+	"or leave hybrid.bm25.engine at auto (or fts4) to index with FTS4 and BM25-lite ranking"
+
+// HasFTS5 reports whether FTS5 tables can be created. The probe table lives
+// in the temp schema of a dedicated connection, so read-only handles work.
+func HasFTS5(ctx context.Context, db *sql.DB) bool {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "CREATE VIRTUAL TABLE temp.rag_fts5_probe USING fts5(x)"); err != nil {
+		return false
+	}
+	_, _ = conn.ExecContext(ctx, "DROP TABLE temp.rag_fts5_probe")
+	return true
+}
+
+// TableFTSEngine returns the module table was created with,
+// ragconfig.BM25EngineFTS5 or BM25EngineFTS4 (FTS3 tables count as FTS4),
+// or "" if there is no such table
+func TableFTSEngine(ctx context.Context, db *sql.DB, table string) (string, error) {
+	var ddl string
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(sql, '') FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&ddl)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("looking up %s: %w", table, err)
+	}
+	ddl = strings.ToLower(ddl)
+	switch {
+	case strings.Contains(ddl, "using fts5"):
+		return ragconfig.BM25EngineFTS5, nil
+	case strings.Contains(ddl, "using fts4"), strings.Contains(ddl, "using fts3"):
+		return ragconfig.BM25EngineFTS4, nil
+	default:
+		return "", fmt.Errorf("%s is not an FTS table", table)
+	}
+}
+
+// CheckFTSTable returns the engine of an existing FTS table, failing with
+// ErrNoFTS5 and what to do about it when the table needs FTS5 and this
+// build lacks it, or with ErrNoTokenizer when its tokenizer isn't loaded.
+// It returns "" if the table doesn't exist.
+func CheckFTSTable(ctx context.Context, db *sql.DB, table string) (string, error) {
+	engine, err := TableFTSEngine(ctx, db, table)
+	if err != nil || engine != ragconfig.BM25EngineFTS5 {
+		return engine, err
+	}
+	if !HasFTS5(ctx, db) {
+		return "", fmt.Errorf("%s is an FTS5 table, but %w: build with -tags fts5, "+
+			"or set hybrid.bm25.table to a new name and re-run fts5-setup --from-db to build an FTS4 index", table, ErrNoFTS5)
+	}
+	tokenize, err := TableTokenizer(ctx, db, table)
+	if err != nil {
+		return "", err
+	}
+	if tokenize != "" {
+		// Opening the table instantiates its tokenizer
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("SELECT rowid FROM %s LIMIT 0", table)); err != nil {
+			return "", fmt.Errorf("%s uses the tokenizer %q, but %w (%w): %s", table, tokenize, ErrNoTokenizer, err, TokenizerHint)
+		}
+	}
+	return engine, nil
+}
+
+// chooseFTSEngine resolves hybrid.bm25.engine for a new FTS table
+func chooseFTSEngine(ctx context.Context, db *sql.DB, setting string) (string, error) {
+	switch setting {
+	case ragconfig.BM25EngineFTS4:
+		return ragconfig.BM25EngineFTS4, nil
+	case ragconfig.BM25EngineFTS5:
+		if !HasFTS5(ctx, db) {
+			return "", fmt.Errorf("hybrid.bm25.engine is fts5, but %w: %s", ErrNoFTS5, FTS5Hint)
+		}
+		return ragconfig.BM25EngineFTS5, nil
+	case "", ragconfig.BM25EngineAuto:
+		if HasFTS5(ctx, db) {
+			return ragconfig.BM25EngineFTS5, nil
+		}
+		return ragconfig.BM25EngineFTS4, nil
+	default:
+		return "", fmt.Errorf("invalid hybrid.bm25.engine %q (must be auto, fts5 or fts4)", setting)
+	}
+}
+
+// ensureFTS creates the FTS index of the chunks table and the triggers that
+// keep it in sync, unless the table already exists with the engine and
+// tokenizer wanted. An existing table's engine is kept under auto; an
+// explicit engine replaces it, and so does another tokenizer. tokenize is
+// the FTS5 tokenize= argument ("" = unicode61); FTS4 tables always use
+// unicode61. New tables are filled from the chunks already there.
+func ensureFTS(ctx context.Context, db *sql.DB, ftsTable, setting, tokenize string, out io.Writer) error {
+	existing, err := CheckFTSTable(ctx, db, ftsTable)
+	if err != nil {
+		return err
+	}
+	engine, err := chooseFTSEngine(ctx, db, setting)
+	if err != nil {
+		return err
+	}
+	if existing != "" && (setting == "" || setting == ragconfig.BM25EngineAuto) {
+		engine = existing
+	}
+	if engine == ragconfig.BM25EngineFTS4 && tokenize != "" {
+		fmt.Fprintf(out, "FTS4 can't use the %q tokenizer, %s uses unicode61\n", tokenize, ftsTable)
+		tokenize = ""
+	}
+	var current string
+	if existing == ragconfig.BM25EngineFTS5 {
+		if current, err = TableTokenizer(ctx, db, ftsTable); err != nil {
+			return err
+		}
+	}
+	if existing == engine && current == tokenize {
+		return nil
+	}
+
+	if existing != "" {
+		fmt.Fprintf(out, "Replacing %s %s table with %s\n", describeFTS(existing, current), ftsTable, describeFTS(engine, tokenize))
+		if _, err := db.ExecContext(ctx, "DROP TABLE "+ftsTable); err != nil {
+			return fmt.Errorf("dropping %s: %w", ftsTable, err)
+		}
+	} else if engine == ragconfig.BM25EngineFTS4 {
+		fmt.Fprintf(out, "No FTS5 in this SQLite build, using FTS4 with BM25-lite ranking for %s (%s)\n", ftsTable, FTS5Hint)
+	}
+
+	stmts := ftsSchema(ftsTable, engine, tokenize)
+	for _, trigger := range []string{"chunks_ai", "chunks_ad", "chunks_au", "chunks_bd", "chunks_bu"} {
+		stmts = append([]string{"DROP TRIGGER IF EXISTS " + trigger}, stmts...)
+	}
+	// Fills the index from the content table; a no-op when it is empty
+	stmts = append(stmts, fmt.Sprintf("INSERT INTO %s(%s) VALUES('rebuild')", ftsTable, ftsTable))
+	for _, stmt := range stmts {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("creating %s index %s: %w", strings.ToUpper(engine), ftsTable, err)
+		}
+	}
+	return nil
+}
+
+// describeFTS names an FTS engine and its tokenizer for messages
+func describeFTS(engine, tokenize string) string {
+	if tokenize == "" {
+		return strings.ToUpper(engine)
+	}
+	return fmt.Sprintf("%s (tokenize %q)", strings.ToUpper(engine), tokenize)
+}
+
+// ftsSchema is the external-content FTS table over chunks and its sync
+// triggers. FTS4 reads the old values for deletes from the content table, so
+// its delete triggers run before the row changes.
+func ftsSchema(ftsTable, engine, tokenize string) []string {
+	if engine == ragconfig.BM25EngineFTS4 {
+		return []string{
+			fmt.Sprintf(`CREATE VIRTUAL TABLE %s USING fts4(
+				chunk_id,
+				text,
+				content="chunks",
+				notindexed=chunk_id,
+				tokenize=unicode61
+			)`, ftsTable),
+			fmt.Sprintf(`CREATE TRIGGER chunks_ai AFTER INSERT ON chunks BEGIN
+				INSERT INTO %s(docid, chunk_id, text) VALUES (new.rowid, new.chunk_id, new.text);
+			END`, ftsTable),
+			fmt.Sprintf(`CREATE TRIGGER chunks_bd BEFORE DELETE ON chunks BEGIN
+				DELETE FROM %s WHERE docid = old.rowid;
+			END`, ftsTable),
+			fmt.Sprintf(`CREATE TRIGGER chunks_bu BEFORE UPDATE ON chunks BEGIN
+				DELETE FROM %s WHERE docid = old.rowid;
+			END`, ftsTable),
+			fmt.Sprintf(`CREATE TRIGGER chunks_au AFTER UPDATE ON chunks BEGIN
+				INSERT INTO %s(docid, chunk_id, text) VALUES (new.rowid, new.chunk_id, new.text);
+			END`, ftsTable),
+		}
+	}
+	var tokenizer string
+	if tokenize != "" {
+		tokenizer = ",\n\t\t\ttokenize=" + quoteSQL(tokenize)
+	}
+	return []string{
+		fmt.Sprintf(`CREATE VIRTUAL TABLE %s USING fts5(
+			chunk_id UNINDEXED,
+			text,
+			content='chunks',
+			content_rowid='rowid'%s
+		)`, ftsTable, tokenizer),
+		fmt.Sprintf(`CREATE TRIGGER chunks_ai AFTER INSERT ON chunks BEGIN
+			INSERT INTO %s(rowid, chunk_id, text)
+			VALUES (new.rowid, new.chunk_id, new.text);
+		END`, ftsTable),
+		fmt.Sprintf(`CREATE TRIGGER chunks_ad AFTER DELETE ON chunks BEGIN
+			INSERT INTO %s(%s, rowid, chunk_id, text)
+			VALUES('delete', old.rowid, old.chunk_id, old.text);
+		END`, ftsTable, ftsTable),
+		fmt.Sprintf(`CREATE TRIGGER chunks_au AFTER UPDATE ON chunks BEGIN
+			INSERT INTO %s(%s, rowid, chunk_id, text)
+			VALUES('delete', old.rowid, old.chunk_id, old.text);
+			INSERT INTO %s(rowid, chunk_id, text)
+			VALUES (new.rowid, new.chunk_id, new.text);
+		END`, ftsTable, ftsTable, ftsTable),
+	}
+}
+
+// CheckFTSIntegrity runs the FTS integrity-check of table against the chunks
+// table. It fails if the index is out of sync (or can't be checked).
+func CheckFTSIntegrity(ctx context.Context, db *sql.DB, table string) error {
+	engine, err := CheckFTSTable(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT INTO %s(%s, rank) VALUES('integrity-check', 1)", table, table)
+	if engine == ragconfig.BM25EngineFTS4 {
+		query = fmt.Sprintf("INSERT INTO %s(%s) VALUES('integrity-check')", table, table)
+	}
+	_, err = db.ExecContext(ctx, query)
+	return err
+}
@@ -0,0 +1,96 @@
+package ragindex
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestEnsureTables_FTS4(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	if err := EnsureTables(ctx, db, "chunks_fts", ragconfig.BM25EngineFTS4, "", io.Discard); err != nil {
+		t.Fatalf("EnsureTables: %v", err)
+	}
+	if engine, err := CheckFTSTable(ctx, db, "chunks_fts"); err != nil || engine != ragconfig.BM25EngineFTS4 {
+		t.Fatalf("CheckFTSTable = %q, %v", engine, err)
+	}
+
+	insert := func(id, text string) {
+		t.Helper()
+		if _, err := db.Exec(`INSERT INTO chunks (chunk_id, thread_id, session_idx, chunk_idx, message_ids, participant_ids,
+			participant_names, text, start_timestamp_ms, end_timestamp_ms, message_count, is_indexable, char_count,
+			alnum_count, unique_word_count) VALUES (?, 1, 0, 0, '[]', '[]', '[]', ?, 0, 0, 1, 1, 0, 0, 0)`, id, text); err != nil {
+			t.Fatalf("inserting %s: %v", id, err)
+		}
+	}
+	matches := func(query string) []string {
+		t.Helper()
+		rows, err := db.Query("SELECT chunk_id FROM chunks_fts WHERE chunks_fts MATCH ? ORDER BY chunk_id", query)
+		if err != nil {
+			t.Fatalf("MATCH %q: %v", query, err)
+		}
+		defer rows.Close()
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	// The triggers keep the index in sync through inserts, updates and deletes
+	insert("a", "the boat is at the lake")
+	insert("b", "see you at the station")
+	if _, err := db.Exec(`UPDATE chunks SET text = 'the boat left the station' WHERE chunk_id = 'b'`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`DELETE FROM chunks WHERE chunk_id = 'a'`); err != nil {
+		t.Fatal(err)
+	}
+	if got := matches("boat"); len(got) != 1 || got[0] != "b" {
+		t.Errorf("boat matches %v, want [b]", got)
+	}
+	if got := matches("lake OR see"); len(got) != 0 {
+		t.Errorf("stale terms still match %v", got)
+	}
+	if err := CheckFTSIntegrity(ctx, db, "chunks_fts"); err != nil {
+		t.Errorf("CheckFTSIntegrity: %v", err)
+	}
+
+	// An existing chunks table without an FTS index gets one, filled from it
+	if _, err := db.Exec(`DROP TABLE chunks_fts`); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureTables(ctx, db, "chunks_fts", ragconfig.BM25EngineAuto, "", io.Discard); err != nil {
+		t.Fatalf("EnsureTables on existing chunks: %v", err)
+	}
+	if got := matches("station"); len(got) != 1 || got[0] != "b" {
+		t.Errorf("rebuilt index matches %v, want [b]", got)
+	}
+	if err := CheckFTSIntegrity(ctx, db, "chunks_fts"); err != nil {
+		t.Errorf("CheckFTSIntegrity after rebuild: %v", err)
+	}
+
+	if !HasFTS5(ctx, db) {
+		if err := EnsureTables(ctx, db, "chunks_fts", ragconfig.BM25EngineFTS5, "", io.Discard); !errors.Is(err, ErrNoFTS5) {
+			t.Errorf("forcing fts5 without FTS5: got %v, want ErrNoFTS5", err)
+		}
+	}
+	if err := EnsureTables(ctx, db, "chunks_fts", "fts3", "", io.Discard); err == nil {
+		t.Errorf("expected error for unknown engine")
+	}
+}
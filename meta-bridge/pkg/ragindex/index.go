@@ -0,0 +1,392 @@
+package ragindex
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/progress"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+// ChunkRow is an indexable chunk as stored in the vector store
+type ChunkRow struct {
+	ChunkID          string
+	ThreadID         int64
+	ThreadName       string
+	SessionIdx       int
+	ChunkIdx         int
+	ParticipantIDs   string
+	ParticipantNames string
+	Text             string
+	MessageIDs       string
+	StartTimestampMs int64
+	EndTimestampMs   int64
+	MessageCount     int
+	Sources          string // JSON array of message provenances
+	ContentHash      string // Used for race-condition-safe UPDATE
+}
+
+// IndexChunks embeds and upserts all unsynced indexable chunks. With
+// fileEmbeddings set, vectors are taken from it instead of embClient and
+// chunks it lacks are counted as missing and left unsynced. Chunks processed
+// are counted on prog, which may be nil.
+func IndexChunks(ctx context.Context, db *sql.DB, sink Sink, embClient *vectordb.EmbeddingClient, fileEmbeddings map[string][]float32, batchSize int, prog *progress.Reporter) (int, int, error) {
+	// Only select unsynced chunks, include content_hash for race-safe UPDATE
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+chunkRowColumns+`
+		FROM chunks
+		WHERE is_indexable = 1 AND (milvus_synced = 0 OR milvus_synced IS NULL)
+		ORDER BY thread_id, session_idx, chunk_idx
+	`)
+	if err != nil {
+		return 0, 0, fmt.Errorf("querying chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var batch []ChunkRow
+	inserted, missing := 0, 0
+	batchNum := 0
+
+	// flush embeds (or looks up) and upserts the batch, then marks it synced
+	flush := func() error {
+		chunks := batch
+		var embeddings [][]float32
+		if fileEmbeddings != nil {
+			chunks = chunks[:0:0]
+			for _, c := range batch {
+				if v, ok := fileEmbeddings[c.ChunkID]; ok {
+					chunks = append(chunks, c)
+					embeddings = append(embeddings, v)
+				} else {
+					missing++
+				}
+			}
+		} else {
+			var err error
+			if embeddings, err = embedBatch(ctx, embClient, chunks); err != nil {
+				return err
+			}
+		}
+
+		n, err := sink.Upsert(ctx, chunks, embeddings)
+		if err != nil {
+			return err
+		}
+
+		// Mark batch as synced with content_hash guard (prevents race condition)
+		if err := markBatchSynced(ctx, db, chunks); err != nil {
+			log.Warn().Err(err).Msg("Failed to mark batch as synced")
+		}
+		inserted += n
+		prog.Add(int64(len(batch)))
+		return nil
+	}
+
+	for rows.Next() {
+		chunk, err := scanChunkRow(rows)
+		if err != nil {
+			return inserted, missing, err
+		}
+		batch = append(batch, chunk)
+
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return inserted, missing, fmt.Errorf("inserting batch %d: %w", batchNum, err)
+			}
+			batchNum++
+
+			// Small delay between batches
+			time.Sleep(50 * time.Millisecond)
+
+			batch = batch[:0]
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return inserted, missing, fmt.Errorf("iterating rows: %w", err)
+	}
+
+	// Insert remaining
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return inserted, missing, fmt.Errorf("inserting final batch: %w", err)
+		}
+	}
+	prog.Finish()
+
+	return inserted, missing, nil
+}
+
+// chunkRowColumns are the chunks columns scanChunkRow reads, content_hash
+// included for the race-safe UPDATE
+const chunkRowColumns = `
+	chunk_id, thread_id, thread_name, session_idx, chunk_idx,
+	participant_ids, participant_names, text, message_ids,
+	start_timestamp_ms, end_timestamp_ms, message_count,
+	COALESCE(sources, '[]') as sources,
+	COALESCE(content_hash, '') as content_hash`
+
+func scanChunkRow(rows *sql.Rows) (ChunkRow, error) {
+	var chunk ChunkRow
+	var threadName sql.NullString
+	if err := rows.Scan(
+		&chunk.ChunkID,
+		&chunk.ThreadID,
+		&threadName,
+		&chunk.SessionIdx,
+		&chunk.ChunkIdx,
+		&chunk.ParticipantIDs,
+		&chunk.ParticipantNames,
+		&chunk.Text,
+		&chunk.MessageIDs,
+		&chunk.StartTimestampMs,
+		&chunk.EndTimestampMs,
+		&chunk.MessageCount,
+		&chunk.Sources,
+		&chunk.ContentHash,
+	); err != nil {
+		return chunk, fmt.Errorf("scanning chunk: %w", err)
+	}
+	chunk.ThreadName = threadName.String
+	return chunk, nil
+}
+
+// EmbedAll embeds every indexable chunk not in skip into sink, with workers
+// embedding requests in flight at once. Unlike IndexChunks it leaves
+// milvus_synced alone: it fills a store other than the one the flag tracks
+// (see reembed). It returns how many chunks were stored; on error, the
+// batches stored before it stay.
+func EmbedAll(ctx context.Context, db *sql.DB, sink Sink, embClient *vectordb.EmbeddingClient, skip map[string]bool, batchSize, workers int, prog *progress.Reporter) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+chunkRowColumns+`
+		FROM chunks
+		WHERE is_indexable = 1
+		ORDER BY thread_id, session_idx, chunk_idx
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("querying chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var mu sync.Mutex
+	stored := 0
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	batches := make(chan []ChunkRow)
+	var wg sync.WaitGroup
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				embeddings, err := embedBatch(ctx, embClient, batch)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				n, err := sink.Upsert(ctx, batch, embeddings)
+				if err != nil {
+					fail(fmt.Errorf("storing batch: %w", err))
+					continue
+				}
+				mu.Lock()
+				stored += n
+				mu.Unlock()
+				prog.Add(int64(len(batch)))
+			}
+		}()
+	}
+
+	var batch []ChunkRow
+	send := func() bool {
+		select {
+		case batches <- batch:
+			batch = nil
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for rows.Next() {
+		chunk, err := scanChunkRow(rows)
+		if err != nil {
+			fail(err)
+			break
+		}
+		if skip[chunk.ChunkID] {
+			continue
+		}
+		batch = append(batch, chunk)
+		if len(batch) >= batchSize && !send() {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		fail(fmt.Errorf("iterating rows: %w", err))
+	}
+	if len(batch) > 0 {
+		send()
+	}
+	close(batches)
+	wg.Wait()
+	prog.Finish()
+
+	return stored, firstErr
+}
+
+// markBatchSynced marks chunks as synced only if their content_hash hasn't changed
+// This prevents race conditions where fts5-setup updates content while we're indexing
+func markBatchSynced(ctx context.Context, db *sql.DB, batch []ChunkRow) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	// Build batched UPDATE with content_hash guard
+	// Only mark as synced if content_hash matches what we indexed
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		UPDATE chunks SET milvus_synced = 1
+		WHERE chunk_id = ? AND (content_hash = ? OR (content_hash IS NULL AND ? = ''))
+	`)
+	if err != nil {
+		return fmt.Errorf("preparing statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, c := range batch {
+		if _, err := stmt.ExecContext(ctx, c.ChunkID, c.ContentHash, c.ContentHash); err != nil {
+			log.Warn().Err(err).Str("chunk_id", c.ChunkID).Msg("Failed to mark chunk as synced")
+		}
+	}
+
+	return tx.Commit()
+}
+
+// embedBatch generates embeddings for a batch of chunks in one request for
+// better GPU utilization
+func embedBatch(ctx context.Context, embClient *vectordb.EmbeddingClient, chunks []ChunkRow) ([][]float32, error) {
+	// Log chunk IDs for debugging crashes (only build slice when debug enabled)
+	if log.Debug().Enabled() {
+		chunkIDsForLog := make([]string, len(chunks))
+		for i, c := range chunks {
+			chunkIDsForLog[i] = c.ChunkID
+		}
+		log.Debug().Strs("chunk_ids", chunkIDsForLog).Msg("Processing batch")
+	}
+
+	texts := make([]string, len(chunks))
+	for i, c := range chunks {
+		texts[i] = c.Text
+	}
+	embeddings, err := embClient.EmbedBatch(ctx, texts)
+	if err != nil {
+		// Log the failing batch for debugging
+		failedIDs := make([]string, len(chunks))
+		for i, c := range chunks {
+			failedIDs[i] = c.ChunkID
+		}
+		log.Error().Strs("chunk_ids", failedIDs).Err(err).Msg("Batch failed - these chunks caused crash")
+		return nil, fmt.Errorf("generating embeddings: %w", err)
+	}
+	return embeddings, nil
+}
+
+// CleanupStale removes chunks from the vector store that are no longer
+// valid in SQLite (either deleted or marked as non-indexable)
+func CleanupStale(ctx context.Context, db *sql.DB, sink Sink, out io.Writer) (int, error) {
+	fmt.Fprintln(out, "\nChecking for stale chunks in the vector store...")
+
+	// Get all valid indexable chunk_ids from SQLite
+	validIDs := make(map[string]struct{})
+	rows, err := db.QueryContext(ctx, "SELECT chunk_id FROM chunks WHERE is_indexable = 1")
+	if err != nil {
+		return 0, fmt.Errorf("querying valid chunks: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return 0, fmt.Errorf("scanning chunk_id: %w", err)
+		}
+		validIDs[id] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterating rows: %w", err)
+	}
+
+	fmt.Fprintf(out, "  Valid indexable chunks in SQLite: %d\n", len(validIDs))
+
+	storedIDs, err := sink.IDs(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("listing stored chunks: %w", err)
+	}
+	var staleIDs []string
+	for _, id := range storedIDs {
+		if _, valid := validIDs[id]; !valid {
+			staleIDs = append(staleIDs, id)
+		}
+	}
+
+	fmt.Fprintf(out, "  Chunks scanned in the vector store: %d\n", len(storedIDs))
+
+	if len(staleIDs) == 0 {
+		fmt.Fprintln(out, "  No stale chunks found")
+		return 0, nil
+	}
+
+	fmt.Fprintf(out, "  Found %d stale chunks, deleting...\n", len(staleIDs))
+	deleted, err := sink.Delete(ctx, staleIDs)
+	if err != nil {
+		return deleted, err
+	}
+
+	// Also reset milvus_synced for non-indexable chunks in SQLite (for consistency)
+	_, _ = db.ExecContext(ctx, "UPDATE chunks SET milvus_synced = 0 WHERE is_indexable = 0 AND milvus_synced = 1")
+
+	return deleted, nil
+}
+
+// ResetSynced marks every chunk unsynced, for a full reindex after the
+// vector store was dropped or newly created. ALL chunks are reset (not just
+// indexable) so that if is_indexable changes later, they get re-evaluated.
+func ResetSynced(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, "UPDATE chunks SET milvus_synced = 0")
+	return err
+}
+
+// CountPending returns how many indexable chunks are not yet in the vector
+// store, and how many indexable chunks there are in total
+func CountPending(ctx context.Context, db *sql.DB) (unsynced, indexable int, err error) {
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM chunks WHERE is_indexable = 1 AND (milvus_synced = 0 OR milvus_synced IS NULL)").Scan(&unsynced)
+	if err != nil {
+		return 0, 0, fmt.Errorf("counting unsynced chunks: %w", err)
+	}
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM chunks WHERE is_indexable = 1").Scan(&indexable)
+	if err != nil {
+		return 0, 0, fmt.Errorf("counting indexable chunks: %w", err)
+	}
+	return unsynced, indexable, nil
+}
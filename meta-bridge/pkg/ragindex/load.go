@@ -0,0 +1,349 @@
+package ragindex
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/chunking"
+	"go.mau.fi/mautrix-meta/pkg/progress"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// ContentHash generates a hash of all Milvus-stored fields for change detection
+// Includes all fields that get stored in Milvus to detect any staleness
+// Also includes is_indexable so that indexability changes trigger re-sync
+func ContentHash(text, messageIDs, threadName, participantIDs, participantNames string, isIndexable bool) string {
+	h := sha256.New()
+	h.Write([]byte(text))
+	h.Write([]byte{0}) // separator
+	h.Write([]byte(messageIDs))
+	h.Write([]byte{0})
+	h.Write([]byte(threadName))
+	h.Write([]byte{0})
+	h.Write([]byte(participantIDs))
+	h.Write([]byte{0})
+	h.Write([]byte(participantNames))
+	h.Write([]byte{0})
+	if isIndexable {
+		h.Write([]byte("1"))
+	} else {
+		h.Write([]byte("0"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16] // First 16 chars is enough
+}
+
+// Use INSERT OR REPLACE with content_hash tracking
+// When content_hash changes (or was NULL), milvus_synced is reset to 0
+const upsertChunkQuery = `
+	INSERT INTO chunks (
+		chunk_id, thread_id, thread_name, session_idx, chunk_idx,
+		message_ids, participant_ids, participant_names, text,
+		start_timestamp_ms, end_timestamp_ms, message_count,
+		is_indexable, char_count, alnum_count, unique_word_count,
+		content_hash, milvus_synced, replies, sources
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?)
+	ON CONFLICT(chunk_id) DO UPDATE SET
+		thread_id = excluded.thread_id,
+		thread_name = excluded.thread_name,
+		session_idx = excluded.session_idx,
+		chunk_idx = excluded.chunk_idx,
+		message_ids = excluded.message_ids,
+		participant_ids = excluded.participant_ids,
+		participant_names = excluded.participant_names,
+		text = excluded.text,
+		start_timestamp_ms = excluded.start_timestamp_ms,
+		end_timestamp_ms = excluded.end_timestamp_ms,
+		message_count = excluded.message_count,
+		is_indexable = excluded.is_indexable,
+		char_count = excluded.char_count,
+		alnum_count = excluded.alnum_count,
+		unique_word_count = excluded.unique_word_count,
+		content_hash = excluded.content_hash,
+		replies = excluded.replies,
+		sources = excluded.sources,
+		milvus_synced = CASE
+			WHEN chunks.content_hash IS NULL OR chunks.content_hash IS NOT excluded.content_hash THEN 0
+			ELSE chunks.milvus_synced
+		END
+`
+
+// upsertChunk writes chunk with stmt (prepared from upsertChunkQuery)
+func upsertChunk(ctx context.Context, stmt *sql.Stmt, chunk chunking.Chunk) error {
+	messageIDsJSON, _ := json.Marshal(chunk.MessageIDs)
+	participantIDsJSON, _ := json.Marshal(chunk.ParticipantIDs)
+	participantNamesJSON, _ := json.Marshal(chunk.ParticipantNames)
+
+	isIndexable := 0
+	if chunk.IsIndexable {
+		isIndexable = 1
+	}
+
+	// Reply links are SQLite-only metadata, so they stay out of the hash
+	var replies any
+	if len(chunk.Replies) > 0 {
+		b, _ := json.Marshal(chunk.Replies)
+		replies = string(b)
+	}
+	// A chunk's sources follow from its messages, so message_ids covers them
+	var sources any
+	if len(chunk.Sources) > 0 {
+		b, _ := json.Marshal(chunk.Sources)
+		sources = string(b)
+	}
+
+	contentHash := ContentHash(chunk.Text, string(messageIDsJSON), chunk.ThreadName, string(participantIDsJSON), string(participantNamesJSON), chunk.IsIndexable)
+
+	_, err := stmt.ExecContext(ctx,
+		chunk.ChunkID,
+		chunk.ThreadID,
+		chunk.ThreadName,
+		chunk.SessionIdx,
+		chunk.ChunkIdx,
+		string(messageIDsJSON),
+		string(participantIDsJSON),
+		string(participantNamesJSON),
+		chunk.Text,
+		chunk.StartTimestampMs,
+		chunk.EndTimestampMs,
+		chunk.MessageCount,
+		isIndexable,
+		chunk.CharCount,
+		chunk.AlnumCount,
+		chunk.UniqueWordCount,
+		contentHash,
+		replies,
+		sources,
+	)
+	if err != nil {
+		return fmt.Errorf("inserting chunk %s: %w", chunk.ChunkID, err)
+	}
+	return nil
+}
+
+// LoadFromJSONL upserts the chunks in a chunker JSONL file and returns how
+// many it read and how many of them are indexable. Chunks read are counted
+// on prog, which may be nil.
+func LoadFromJSONL(ctx context.Context, db *sql.DB, jsonlPath string, out io.Writer, prog *progress.Reporter) (int, int, error) {
+	file, err := os.Open(jsonlPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("opening file: %w", err)
+	}
+	defer file.Close()
+
+	fmt.Fprintf(out, "Loading chunks from: %s\n", jsonlPath)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, upsertChunkQuery)
+	if err != nil {
+		return 0, 0, fmt.Errorf("preparing statement: %w", err)
+	}
+	defer stmt.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024) // 10MB max line
+
+	total := 0
+	indexable := 0
+
+	for scanner.Scan() {
+		var chunk chunking.Chunk
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			return total, indexable, fmt.Errorf("parsing line %d: %w", total+1, err)
+		}
+		if err := upsertChunk(ctx, stmt, chunk); err != nil {
+			return total, indexable, err
+		}
+		if chunk.IsIndexable {
+			indexable++
+		}
+
+		total++
+		prog.Add(1)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return total, indexable, fmt.Errorf("reading file: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return total, indexable, fmt.Errorf("committing transaction: %w", err)
+	}
+	prog.Finish()
+
+	fmt.Fprintf(out, "Loaded %d chunks (%d indexable)\n", total, indexable)
+	return total, indexable, nil
+}
+
+// LoadFromMessages chunks every thread in the messages table and upserts the
+// result, returning how many chunks were generated and how many of them are
+// indexable. Threads done are counted on prog, which may be nil.
+func LoadFromMessages(ctx context.Context, db *sql.DB, cfg *ragconfig.Config, out io.Writer, prog *progress.Reporter) (int, int, error) {
+	fmt.Fprintln(out, "Generating chunks from messages table...")
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, upsertChunkQuery)
+	if err != nil {
+		return 0, 0, fmt.Errorf("preparing statement: %w", err)
+	}
+	defer stmt.Close()
+
+	total := 0
+	indexable := 0
+
+	callback := func(chunk chunking.Chunk) error {
+		if err := upsertChunk(ctx, stmt, chunk); err != nil {
+			return err
+		}
+		if chunk.IsIndexable {
+			indexable++
+		}
+		total++
+		return nil
+	}
+
+	progressFn := func(threadsProcessed, totalThreads, totalChunks int) {
+		prog.SetTotal(int64(totalThreads))
+		prog.Set(int64(threadsProcessed))
+	}
+
+	_, err = chunking.ProcessAllThreads(ctx, db, cfg, callback, progressFn)
+	if err != nil {
+		return total, indexable, fmt.Errorf("processing threads: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO chunked_threads (thread_id, chunked_at)
+		SELECT DISTINCT thread_id, ? FROM chunks WHERE true
+		ON CONFLICT(thread_id) DO UPDATE SET chunked_at = excluded.chunked_at
+	`, time.Now().UnixMilli())
+	if err != nil {
+		return total, indexable, fmt.Errorf("recording chunked threads: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return total, indexable, fmt.Errorf("committing transaction: %w", err)
+	}
+	prog.Finish()
+
+	fmt.Fprintf(out, "Generated %d chunks (%d indexable)\n", total, indexable)
+	return total, indexable, nil
+}
+
+// LoadThreads regenerates the chunks of the given threads and deletes their
+// chunks that were not produced again (boundaries moved, messages deleted).
+// The threads are recorded as chunked now in chunked_threads.
+// It returns how many chunks were generated and the IDs of the deleted ones,
+// whose vectors the caller should remove from the vector store.
+func LoadThreads(ctx context.Context, db *sql.DB, cfg *ragconfig.Config, threadIDs []int64) (int, []string, error) {
+	if len(threadIDs) == 0 {
+		return 0, nil, nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, upsertChunkQuery)
+	if err != nil {
+		return 0, nil, fmt.Errorf("preparing statement: %w", err)
+	}
+	defer stmt.Close()
+
+	produced := make(map[string]bool)
+	callback := func(chunk chunking.Chunk) error {
+		produced[chunk.ChunkID] = true
+		return upsertChunk(ctx, stmt, chunk)
+	}
+	if _, err := chunking.ProcessThreadsByID(ctx, db, cfg, threadIDs, callback, nil); err != nil {
+		return 0, nil, fmt.Errorf("processing threads: %w", err)
+	}
+
+	var removed []string
+	for _, threadID := range threadIDs {
+		rows, err := tx.QueryContext(ctx, "SELECT chunk_id FROM chunks WHERE thread_id = ?", threadID)
+		if err != nil {
+			return 0, nil, fmt.Errorf("listing chunks of thread %d: %w", threadID, err)
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return 0, nil, fmt.Errorf("scanning chunk_id: %w", err)
+			}
+			if !produced[id] {
+				removed = append(removed, id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, nil, fmt.Errorf("listing chunks of thread %d: %w", threadID, err)
+		}
+	}
+	for _, id := range removed {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM chunks WHERE chunk_id = ?", id); err != nil {
+			return 0, nil, fmt.Errorf("deleting chunk %s: %w", id, err)
+		}
+	}
+	now := time.Now().UnixMilli()
+	for _, threadID := range threadIDs {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO chunked_threads (thread_id, chunked_at) VALUES (?, ?)
+			ON CONFLICT(thread_id) DO UPDATE SET chunked_at = excluded.chunked_at
+		`, threadID, now)
+		if err != nil {
+			return 0, nil, fmt.Errorf("recording thread %d as chunked: %w", threadID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, fmt.Errorf("committing transaction: %w", err)
+	}
+	return len(produced), removed, nil
+}
+
+// OldestChunkedThreads returns up to limit threads that have chunks and were
+// last chunked before beforeMs (Unix ms), longest ago first. Threads chunked
+// before chunked_threads existed count as the oldest.
+func OldestChunkedThreads(ctx context.Context, db *sql.DB, limit int, beforeMs int64) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.thread_id
+		FROM (SELECT DISTINCT thread_id FROM chunks) c
+		LEFT JOIN chunked_threads t ON t.thread_id = c.thread_id
+		WHERE COALESCE(t.chunked_at, 0) < ?
+		ORDER BY COALESCE(t.chunked_at, 0), c.thread_id
+		LIMIT ?
+	`, beforeMs, limit)
+	if err != nil {
+		return nil, fmt.Errorf("listing oldest chunked threads: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scanning thread ID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
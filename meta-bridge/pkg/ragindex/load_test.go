@@ -0,0 +1,127 @@
+package ragindex
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestLoadThreads(t *testing.T) {
+	// A file, not :memory:, since chunking reads on another connection while
+	// the load transaction is open
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	// The chunks table as EnsureTables creates it, minus FTS5 (not in the
+	// default test build)
+	for _, q := range []string{
+		`CREATE TABLE messages (id TEXT PRIMARY KEY, thread_id INTEGER, sender_id INTEGER, text TEXT, timestamp_ms INTEGER,
+			reply_to_message_id TEXT, reply_snippet TEXT)`,
+		`CREATE TABLE threads (id INTEGER PRIMARY KEY, name TEXT)`,
+		`CREATE TABLE contacts (id INTEGER PRIMARY KEY, name TEXT)`,
+		`CREATE TABLE sync_metadata (key TEXT PRIMARY KEY, value TEXT)`,
+		`CREATE TABLE chunks (
+			chunk_id TEXT PRIMARY KEY, thread_id INTEGER NOT NULL, thread_name TEXT,
+			session_idx INTEGER NOT NULL, chunk_idx INTEGER NOT NULL, message_ids TEXT NOT NULL,
+			participant_ids TEXT NOT NULL, participant_names TEXT NOT NULL, text TEXT NOT NULL,
+			start_timestamp_ms INTEGER NOT NULL, end_timestamp_ms INTEGER NOT NULL,
+			message_count INTEGER NOT NULL, is_indexable INTEGER NOT NULL, char_count INTEGER NOT NULL,
+			alnum_count INTEGER NOT NULL, unique_word_count INTEGER NOT NULL,
+			content_hash TEXT, milvus_synced INTEGER DEFAULT 0, replies TEXT, sources TEXT
+		)`,
+		`CREATE TABLE chunked_threads (thread_id INTEGER PRIMARY KEY, chunked_at INTEGER NOT NULL)`,
+		`INSERT INTO contacts VALUES (1, 'Alice'), (2, 'Bob')`,
+		`INSERT INTO threads VALUES (10, 'Trip'), (20, 'Work')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	// Two sessions a day apart in thread 10, one message in thread 20
+	insert := func(id string, thread, sender, ts int64) {
+		t.Helper()
+		text := fmt.Sprintf("message %s about the trip to the mountains next summer", id)
+		if _, err := db.Exec(`INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms) VALUES (?, ?, ?, ?, ?)`, id, thread, sender, text, ts); err != nil {
+			t.Fatalf("inserting %s: %v", id, err)
+		}
+	}
+	day := int64(24 * 60 * 60 * 1000)
+	insert("a1", 10, 1, day)
+	insert("a2", 10, 2, day+60_000)
+	insert("b1", 10, 1, 3*day)
+	insert("c1", 20, 2, day)
+
+	cfg := ragconfig.Default()
+	n, removed, err := LoadThreads(ctx, db, cfg, []int64{10, 20})
+	if err != nil {
+		t.Fatalf("LoadThreads: %v", err)
+	}
+	if n != 3 || len(removed) != 0 {
+		t.Fatalf("LoadThreads = %d chunks, removed %v; want 3 chunks, none removed", n, removed)
+	}
+	if _, err := db.Exec(`UPDATE chunks SET milvus_synced = 1`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unsending the second session's only message drops its chunk; thread 20
+	// is not reprocessed and keeps its chunk
+	var secondSession string
+	if err := db.QueryRow(`SELECT chunk_id FROM chunks WHERE thread_id = 10 AND session_idx = 1`).Scan(&secondSession); err != nil {
+		t.Fatalf("finding second session chunk: %v", err)
+	}
+	if _, err := db.Exec(`UPDATE messages SET text = NULL WHERE id = 'b1'`); err != nil {
+		t.Fatal(err)
+	}
+	n, removed, err = LoadThreads(ctx, db, cfg, []int64{10})
+	if err != nil {
+		t.Fatalf("LoadThreads: %v", err)
+	}
+	if n != 1 || len(removed) != 1 || removed[0] != secondSession {
+		t.Fatalf("LoadThreads = %d chunks, removed %v; want 1 chunk, removed [%s]", n, removed, secondSession)
+	}
+	var remaining, unsynced int
+	if err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(milvus_synced = 0), 0) FROM chunks`).Scan(&remaining, &unsynced); err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 2 || unsynced != 0 {
+		t.Fatalf("%d chunks left (%d unsynced), want 2 (unchanged chunks stay synced)", remaining, unsynced)
+	}
+
+	// Thread 20 was chunked before thread 10's reload, and a thread chunked
+	// before chunked_threads existed comes first
+	if _, err := db.Exec(`UPDATE chunked_threads SET chunked_at = 1 WHERE thread_id = 20`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO chunks (chunk_id, thread_id, session_idx, chunk_idx, message_ids, participant_ids,
+		participant_names, text, start_timestamp_ms, end_timestamp_ms, message_count, is_indexable, char_count,
+		alnum_count, unique_word_count) VALUES ('legacy', 30, 0, 0, '[]', '[]', '[]', '', 0, 0, 0, 0, 0, 0, 0)`); err != nil {
+		t.Fatal(err)
+	}
+	oldest, err := OldestChunkedThreads(ctx, db, 10, time.Now().Add(time.Hour).UnixMilli())
+	if err != nil {
+		t.Fatalf("OldestChunkedThreads: %v", err)
+	}
+	if !slices.Equal(oldest, []int64{30, 20, 10}) {
+		t.Errorf("OldestChunkedThreads = %v, want [30 20 10]", oldest)
+	}
+	// Threads chunked since the cutoff are left alone
+	oldest, err = OldestChunkedThreads(ctx, db, 10, 2)
+	if err != nil {
+		t.Fatalf("OldestChunkedThreads: %v", err)
+	}
+	if !slices.Equal(oldest, []int64{30, 20}) {
+		t.Errorf("OldestChunkedThreads before 2 = %v, want [30 20]", oldest)
+	}
+}
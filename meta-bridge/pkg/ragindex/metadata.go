@@ -0,0 +1,167 @@
+package ragindex
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+
+	"go.mau.fi/mautrix-meta/pkg/chunking"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// Metadata is the key/value table (metadata.table in rag.yaml) recording what
+// the current index was built from
+type Metadata struct {
+	db    *sql.DB
+	table string
+}
+
+// OpenMetadata creates the metadata table if missing
+func OpenMetadata(ctx context.Context, db *sql.DB, cfg *ragconfig.Config) (*Metadata, error) {
+	table := cfg.Metadata.Table
+	if table == "" || !validIdentRe.MatchString(table) {
+		table = "rag_metadata"
+	}
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+table+` (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL,
+		updated_at INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER) * 1000)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("creating %s: %w", table, err)
+	}
+	return &Metadata{db: db, table: table}, nil
+}
+
+// Get returns the value stored under key, or "" if there is none
+func (m *Metadata) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	err := m.db.QueryRowContext(ctx, `SELECT value FROM `+m.table+` WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// Set stores values (key → value) in one transaction
+func (m *Metadata) Set(ctx context.Context, values map[string]string) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for key, value := range values {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO `+m.table+` (key, value, updated_at)
+			VALUES (?, ?, CAST(strftime('%s', 'now') AS INTEGER) * 1000)
+			ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at
+		`, key, value)
+		if err != nil {
+			return fmt.Errorf("storing %s: %w", key, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// SourceFingerprint summarizes everything chunk generation reads: the
+// messages, text extracted from attachments, reactions and group
+// participants (when chunks include them), thread and contact names, and the
+// chunking, normalize and quality
+// config. It is cheap (a few aggregate queries). The newest change feed seq
+// covers every edit and rename a sync or import makes, including ones that
+// keep the text's length, so an unchanged fingerprint means regenerating
+// chunks would produce the same rows.
+func SourceFingerprint(ctx context.Context, db *sql.DB, cfg *ragconfig.Config) (string, error) {
+	h := sha256.New()
+	for _, q := range []string{
+		`SELECT COUNT(*), COALESCE(MAX(rowid), 0), COALESCE(SUM(timestamp_ms), 0), COALESCE(SUM(LENGTH(text)), 0) FROM messages`,
+		`SELECT COUNT(*), COALESCE(MAX(rowid), 0), COALESCE(SUM(LENGTH(name)), 0), 0 FROM threads`,
+		`SELECT COUNT(*), COALESCE(MAX(rowid), 0), COALESCE(SUM(LENGTH(name)), 0), 0 FROM contacts`,
+	} {
+		var a, b, c, d int64
+		if err := db.QueryRowContext(ctx, q).Scan(&a, &b, &c, &d); err != nil {
+			return "", fmt.Errorf("fingerprinting source tables: %w", err)
+		}
+		fmt.Fprintf(h, "%d:%d:%d:%d\n", a, b, c, d)
+	}
+
+	// Databases created before the change feed only have the aggregates
+	var hasChanges int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'changes'`).Scan(&hasChanges)
+	if err != nil {
+		return "", fmt.Errorf("checking for the change feed: %w", err)
+	}
+	if hasChanges > 0 {
+		var seq int64
+		if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM changes`).Scan(&seq); err != nil {
+			return "", fmt.Errorf("fingerprinting the change feed: %w", err)
+		}
+		fmt.Fprintf(h, "changes:%d\n", seq)
+	}
+
+	// Attachment text only counts once there is some, so databases without
+	// it keep their fingerprint
+	attachmentText, err := chunking.AttachmentTextSQL(ctx, db, cfg)
+	if err != nil {
+		return "", err
+	}
+	if attachmentText != "" {
+		var n, chars int64
+		err := db.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(LENGTH(text)), 0) FROM (`+attachmentText+`)`).Scan(&n, &chars)
+		if err != nil {
+			return "", fmt.Errorf("fingerprinting attachment text: %w", err)
+		}
+		if n > 0 {
+			fmt.Fprintf(h, "attachments:%d:%d\n", n, chars)
+		}
+	}
+
+	// Likewise reactions, only when chunks include them
+	if cfg.Chunking.Format.Reactions {
+		var n, maxRowID, chars, ts int64
+		err := db.QueryRowContext(ctx, `
+			SELECT COUNT(*), COALESCE(MAX(rowid), 0), COALESCE(SUM(LENGTH(reaction)), 0), COALESCE(SUM(timestamp_ms), 0)
+			FROM reactions
+		`).Scan(&n, &maxRowID, &chars, &ts)
+		if err != nil {
+			return "", fmt.Errorf("fingerprinting reactions: %w", err)
+		}
+		fmt.Fprintf(h, "reactions:%d:%d:%d:%d\n", n, maxRowID, chars, ts)
+	}
+
+	// The group header lists participants and checks the member count
+	if cfg.Chunking.Format.GroupHeader {
+		var n, threads, contacts, members int64
+		err := db.QueryRowContext(ctx, `
+			SELECT COUNT(*), COALESCE(SUM(thread_id), 0), COALESCE(SUM(contact_id), 0),
+				(SELECT COALESCE(SUM(member_count), 0) FROM threads)
+			FROM thread_participants
+		`).Scan(&n, &threads, &contacts, &members)
+		if err != nil {
+			return "", fmt.Errorf("fingerprinting participants: %w", err)
+		}
+		fmt.Fprintf(h, "participants:%d:%d:%d:%d\n", n, threads, contacts, members)
+	}
+
+	var owner sql.NullString
+	err = db.QueryRowContext(ctx, "SELECT value FROM sync_metadata WHERE key = 'current_user_id'").Scan(&owner)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("fingerprinting source tables: %w", err)
+	}
+	fmt.Fprintf(h, "%s\n", owner.String)
+
+	data, err := yaml.Marshal(struct {
+		Chunking  ragconfig.ChunkingConfig
+		Normalize ragconfig.NormalizeConfig
+		Quality   ragconfig.QualityConfig
+	}{cfg.Chunking, cfg.Normalize, cfg.Quality})
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
@@ -0,0 +1,102 @@
+package ragindex
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestMetadata(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	meta, err := OpenMetadata(ctx, db, ragconfig.Default())
+	if err != nil {
+		t.Fatalf("OpenMetadata: %v", err)
+	}
+	if v, err := meta.Get(ctx, "missing"); err != nil || v != "" {
+		t.Fatalf("Get(missing) = %q, %v", v, err)
+	}
+	if err := meta.Set(ctx, map[string]string{"a": "1", "b": "2"}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := meta.Set(ctx, map[string]string{"a": "3"}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	for key, want := range map[string]string{"a": "3", "b": "2"} {
+		if v, err := meta.Get(ctx, key); err != nil || v != want {
+			t.Fatalf("Get(%s) = %q, %v; want %q", key, v, err, want)
+		}
+	}
+}
+
+func TestSourceFingerprint(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	for _, q := range []string{
+		`CREATE TABLE messages (id TEXT PRIMARY KEY, thread_id INTEGER, text TEXT, timestamp_ms INTEGER)`,
+		`CREATE TABLE threads (id INTEGER PRIMARY KEY, name TEXT, member_count INTEGER)`,
+		`CREATE TABLE thread_participants (thread_id INTEGER, contact_id INTEGER)`,
+		`CREATE TABLE contacts (id INTEGER PRIMARY KEY, name TEXT)`,
+		`CREATE TABLE sync_metadata (key TEXT PRIMARY KEY, value TEXT)`,
+		`CREATE TABLE changes (seq INTEGER PRIMARY KEY AUTOINCREMENT, entity_id TEXT)`,
+		`CREATE TRIGGER changes_messages_au AFTER UPDATE ON messages BEGIN INSERT INTO changes (entity_id) VALUES (NEW.id); END`,
+		`INSERT INTO threads VALUES (1, 'Family', 3)`,
+		`INSERT INTO messages VALUES ('m1', 1, 'hello', 1000)`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+
+	cfg := ragconfig.Default()
+	fingerprint := func() string {
+		t.Helper()
+		fp, err := SourceFingerprint(ctx, db, cfg)
+		if err != nil {
+			t.Fatalf("SourceFingerprint: %v", err)
+		}
+		return fp
+	}
+
+	base := fingerprint()
+	if fingerprint() != base {
+		t.Fatal("fingerprint is not stable")
+	}
+	steps := []struct {
+		name   string
+		change func()
+	}{
+		{"edited message", func() { db.Exec(`UPDATE messages SET text = 'hello!' WHERE id = 'm1'`) }},
+		{"same-length edit", func() { db.Exec(`UPDATE messages SET text = 'hellO!' WHERE id = 'm1'`) }},
+		{"new message", func() { db.Exec(`INSERT INTO messages VALUES ('m2', 1, 'hi', 2000)`) }},
+		{"renamed thread", func() { db.Exec(`UPDATE threads SET name = 'Family chat'`) }},
+		{"chunking config", func() { cfg.Chunking.Version++ }},
+		{"group header on", func() { cfg.Chunking.Format.GroupHeader = true }},
+		{"new participant", func() { db.Exec(`INSERT INTO thread_participants VALUES (1, 7)`) }},
+		{"member count", func() { db.Exec(`UPDATE threads SET member_count = 4`) }},
+	}
+	for _, step := range steps {
+		step.change()
+		fp := fingerprint()
+		if fp == base {
+			t.Fatalf("%s: fingerprint unchanged", step.name)
+		}
+		base = fp
+	}
+}
@@ -0,0 +1,167 @@
+// Package ragindex builds the search indexes from the messages table: chunks
+// and their FTS5 (or FTS4) table (fts5-setup), and chunk embeddings in the configured
+// vector store (milvus-index). rag-pipeline runs both in one go.
+package ragindex
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"regexp"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+var validIdentRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// FTSTable returns hybrid.bm25.table, falling back to chunks_fts if it is
+// empty or not a plain identifier
+func FTSTable(cfg *ragconfig.Config) string {
+	ftsTable := cfg.Hybrid.BM25.Table
+	if ftsTable == "" || !validIdentRe.MatchString(ftsTable) {
+		return "chunks_fts"
+	}
+	return ftsTable
+}
+
+// EnsureTables creates the chunks table, or migrates an existing one to the
+// current columns, and its FTS index ftsTable with the triggers keeping them
+// in sync. engine is hybrid.bm25.engine: auto picks FTS5 when SQLite has it,
+// FTS4 otherwise. tokenize is the FTS5 tokenizer from LoadTokenizer. It also
+// creates chunked_threads, which records when each thread was last chunked.
+func EnsureTables(ctx context.Context, db *sql.DB, ftsTable, engine, tokenize string, out io.Writer) error {
+	// Check if chunks table exists
+	var tableExists int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='chunks'").Scan(&tableExists)
+	if err != nil {
+		return fmt.Errorf("checking table existence: %w", err)
+	}
+
+	if tableExists == 0 {
+		// Create chunks table with new schema (includes content_hash and milvus_synced)
+		_, err := db.ExecContext(ctx, `
+			CREATE TABLE chunks (
+				chunk_id TEXT PRIMARY KEY,
+				thread_id INTEGER NOT NULL,
+				thread_name TEXT,
+				session_idx INTEGER NOT NULL,
+				chunk_idx INTEGER NOT NULL,
+				message_ids TEXT NOT NULL,
+				participant_ids TEXT NOT NULL,
+				participant_names TEXT NOT NULL,
+				text TEXT NOT NULL,
+				start_timestamp_ms INTEGER NOT NULL,
+				end_timestamp_ms INTEGER NOT NULL,
+				message_count INTEGER NOT NULL,
+				is_indexable INTEGER NOT NULL,
+				char_count INTEGER NOT NULL,
+				alnum_count INTEGER NOT NULL,
+				unique_word_count INTEGER NOT NULL,
+				content_hash TEXT,
+				milvus_synced INTEGER DEFAULT 0,
+				replies TEXT,
+				sources TEXT
+			)
+		`)
+		if err != nil {
+			return fmt.Errorf("creating chunks table: %w", err)
+		}
+
+		// Create indexes
+		indexes := []string{
+			"CREATE INDEX idx_chunks_thread_session ON chunks(thread_id, session_idx, chunk_idx)",
+			"CREATE INDEX idx_chunks_indexable ON chunks(is_indexable)",
+			"CREATE INDEX idx_chunks_timestamp ON chunks(start_timestamp_ms)",
+			"CREATE INDEX idx_chunks_milvus_synced ON chunks(milvus_synced)",
+		}
+		for _, idx := range indexes {
+			if _, err := db.ExecContext(ctx, idx); err != nil {
+				return fmt.Errorf("creating index: %w", err)
+			}
+		}
+
+		fmt.Fprintln(out, "Created chunks table")
+	} else {
+		// Table exists - check if we need to add new columns
+		var hasContentHash, hasMilvusSynced, hasReplies, hasSources int
+		err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('chunks') WHERE name='content_hash'").Scan(&hasContentHash)
+		if err != nil {
+			return fmt.Errorf("checking content_hash column: %w", err)
+		}
+		err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('chunks') WHERE name='milvus_synced'").Scan(&hasMilvusSynced)
+		if err != nil {
+			return fmt.Errorf("checking milvus_synced column: %w", err)
+		}
+		err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('chunks') WHERE name='replies'").Scan(&hasReplies)
+		if err != nil {
+			return fmt.Errorf("checking replies column: %w", err)
+		}
+		err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('chunks') WHERE name='sources'").Scan(&hasSources)
+		if err != nil {
+			return fmt.Errorf("checking sources column: %w", err)
+		}
+
+		if hasContentHash == 0 || hasMilvusSynced == 0 || hasReplies == 0 || hasSources == 0 {
+			fmt.Fprintln(out, "Migrating chunks table...")
+			if hasContentHash == 0 {
+				fmt.Fprintln(out, "  Adding content_hash column...")
+				_, err = db.ExecContext(ctx, "ALTER TABLE chunks ADD COLUMN content_hash TEXT")
+				if err != nil {
+					return fmt.Errorf("adding content_hash column: %w", err)
+				}
+			}
+			if hasMilvusSynced == 0 {
+				fmt.Fprintln(out, "  Adding milvus_synced column...")
+				_, err = db.ExecContext(ctx, "ALTER TABLE chunks ADD COLUMN milvus_synced INTEGER DEFAULT 0")
+				if err != nil {
+					return fmt.Errorf("adding milvus_synced column: %w", err)
+				}
+			}
+			if hasReplies == 0 {
+				fmt.Fprintln(out, "  Adding replies column...")
+				_, err = db.ExecContext(ctx, "ALTER TABLE chunks ADD COLUMN replies TEXT")
+				if err != nil {
+					return fmt.Errorf("adding replies column: %w", err)
+				}
+			}
+			if hasSources == 0 {
+				fmt.Fprintln(out, "  Adding sources column...")
+				_, err = db.ExecContext(ctx, "ALTER TABLE chunks ADD COLUMN sources TEXT")
+				if err != nil {
+					return fmt.Errorf("adding sources column: %w", err)
+				}
+			}
+			fmt.Fprintln(out, "Migration complete")
+		}
+
+		// Always ensure index exists
+		_, err = db.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS idx_chunks_milvus_synced ON chunks(milvus_synced)")
+		if err != nil {
+			return fmt.Errorf("creating milvus_synced index: %w", err)
+		}
+
+		fmt.Fprintf(out, "Using existing chunks table (incremental mode)\n")
+	}
+
+	if err := ensureFTS(ctx, db, ftsTable, engine, tokenize, out); err != nil {
+		return err
+	}
+
+	// When each thread was last chunked, for the rolling re-chunk
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS chunked_threads (
+			thread_id INTEGER PRIMARY KEY,
+			chunked_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("creating chunked_threads table: %w", err)
+	}
+	_, err = db.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS idx_chunked_threads_at ON chunked_threads(chunked_at)")
+	if err != nil {
+		return fmt.Errorf("creating chunked_threads index: %w", err)
+	}
+
+	return nil
+}
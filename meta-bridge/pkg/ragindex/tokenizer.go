@@ -0,0 +1,130 @@
+package ragindex
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// ErrNoTokenizer means an FTS tokenizer isn't registered on the connection:
+// its extension isn't configured, or couldn't be loaded
+var ErrNoTokenizer = errors.New("FTS tokenizer unavailable")
+
+// TokenizerHint is what to do about ErrNoTokenizer
+const TokenizerHint = "set hybrid.bm25.tokenizer.extension to the SQLite extension that registers it, " +
+	"or clear hybrid.bm25.tokenizer.tokenize and re-run fts5-setup --from-db to rebuild the index with unicode61"
+
+// nonStemmingTokenizers are the FTS5 tokenizers that index words as written
+var nonStemmingTokenizers = map[string]bool{"": true, "unicode61": true, "ascii": true, "trigram": true}
+
+// TokenizerStems reports whether an FTS5 tokenize= argument stems words,
+// that is, names anything but the built-in unicode61, ascii or trigram
+func TokenizerStems(tokenize string) bool {
+	name, _, _ := strings.Cut(strings.TrimSpace(tokenize), " ")
+	return !nonStemmingTokenizers[strings.ToLower(name)]
+}
+
+type tokenizerDriver struct {
+	name string
+	err  error
+}
+
+var (
+	tokenizerDriversMu sync.Mutex
+	tokenizerDrivers   = map[ragconfig.TokenizerConfig]tokenizerDriver{}
+)
+
+// LoadTokenizer returns the database/sql driver to open the database with,
+// so hybrid.bm25.tokenizer is available on every connection, and the
+// tokenize= argument new FTS5 tables get. Without an extension to load,
+// the driver is plain "sqlite3". When the extension can't be loaded or
+// doesn't register the tokenizer, LoadTokenizer falls back to "sqlite3"
+// and unicode61 (an empty argument), and says why in an error wrapping
+// ErrNoTokenizer; callers warn and carry on.
+func LoadTokenizer(cfg *ragconfig.Config) (driver, tokenize string, err error) {
+	tc := cfg.Hybrid.BM25.Tokenizer
+	tc.Tokenize = strings.TrimSpace(tc.Tokenize)
+	if tc.Extension == "" {
+		return "sqlite3", tc.Tokenize, nil
+	}
+
+	tokenizerDriversMu.Lock()
+	defer tokenizerDriversMu.Unlock()
+	d, ok := tokenizerDrivers[tc]
+	if !ok {
+		d = registerTokenizerDriver(tc, len(tokenizerDrivers))
+		tokenizerDrivers[tc] = d
+	}
+	if d.err != nil {
+		return "sqlite3", "", d.err
+	}
+	return d.name, tc.Tokenize, nil
+}
+
+// registerTokenizerDriver registers a driver loading the extension of tc and
+// checks on an in-memory database that it loads and registers tc.Tokenize
+func registerTokenizerDriver(tc ragconfig.TokenizerConfig, n int) tokenizerDriver {
+	d := &sqlite3.SQLiteDriver{}
+	if tc.EntryPoint == "" {
+		d.Extensions = []string{tc.Extension}
+	} else {
+		d.ConnectHook = func(conn *sqlite3.SQLiteConn) error {
+			return conn.LoadExtension(tc.Extension, tc.EntryPoint)
+		}
+	}
+	name := fmt.Sprintf("sqlite3_tokenizer_%d", n)
+	sql.Register(name, d)
+
+	db, err := sql.Open(name, ":memory:")
+	if err != nil {
+		return tokenizerDriver{err: fmt.Errorf("%w: loading %s: %w", ErrNoTokenizer, tc.Extension, err)}
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if err := db.PingContext(ctx); err != nil {
+		return tokenizerDriver{err: fmt.Errorf("%w: loading %s: %w", ErrNoTokenizer, tc.Extension, err)}
+	}
+	if tc.Tokenize != "" && HasFTS5(ctx, db) {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return tokenizerDriver{err: err}
+		}
+		defer conn.Close()
+		if _, err := conn.ExecContext(ctx, "CREATE VIRTUAL TABLE temp.rag_tokenizer_probe USING fts5(x, tokenize="+quoteSQL(tc.Tokenize)+")"); err != nil {
+			return tokenizerDriver{err: fmt.Errorf("%w: %s doesn't provide %q: %w", ErrNoTokenizer, tc.Extension, tc.Tokenize, err)}
+		}
+		_, _ = conn.ExecContext(ctx, "DROP TABLE temp.rag_tokenizer_probe")
+	}
+	return tokenizerDriver{name: name}
+}
+
+var tokenizeRe = regexp.MustCompile(`(?i)\btokenize\s*=\s*'((?:[^']|'')*)'`)
+
+// TableTokenizer returns the tokenize= argument an FTS5 table was created
+// with, "" for the default unicode61 (or no such table)
+func TableTokenizer(ctx context.Context, db *sql.DB, table string) (string, error) {
+	var ddl string
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(sql, '') FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&ddl)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("looking up %s: %w", table, err)
+	}
+	if m := tokenizeRe.FindStringSubmatch(ddl); m != nil {
+		return strings.ReplaceAll(m[1], "''", "'"), nil
+	}
+	return "", nil
+}
+
+// quoteSQL quotes s as an SQL string literal
+func quoteSQL(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
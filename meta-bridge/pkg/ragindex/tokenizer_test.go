@@ -0,0 +1,94 @@
+package ragindex
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestTokenizerStems(t *testing.T) {
+	for tokenize, want := range map[string]bool{
+		"":                                  false,
+		"unicode61 remove_diacritics 2":     false,
+		"trigram":                           false,
+		"porter unicode61":                  true,
+		"snowball polish english unicode61": true,
+	} {
+		if got := TokenizerStems(tokenize); got != want {
+			t.Errorf("TokenizerStems(%q) = %v, want %v", tokenize, got, want)
+		}
+	}
+}
+
+func TestLoadTokenizer_Fallback(t *testing.T) {
+	cfg := ragconfig.Default()
+	cfg.Hybrid.BM25.Tokenizer.Tokenize = "porter unicode61"
+	if driver, tokenize, err := LoadTokenizer(cfg); err != nil || driver != "sqlite3" || tokenize != "porter unicode61" {
+		t.Errorf("built-in tokenizer: %q, %q, %v", driver, tokenize, err)
+	}
+
+	cfg.Hybrid.BM25.Tokenizer = ragconfig.TokenizerConfig{
+		Tokenize:  "snowball polish",
+		Extension: filepath.Join(t.TempDir(), "missing.so"),
+	}
+	driver, tokenize, err := LoadTokenizer(cfg)
+	if !errors.Is(err, ErrNoTokenizer) || driver != "sqlite3" || tokenize != "" {
+		t.Errorf("missing extension: %q, %q, %v; want sqlite3, unicode61 and ErrNoTokenizer", driver, tokenize, err)
+	}
+}
+
+func TestEnsureTables_Tokenizer(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	// FTS4 has no tokenizer choice
+	var out bytes.Buffer
+	if err := EnsureTables(ctx, db, "chunks_fts", ragconfig.BM25EngineFTS4, "porter unicode61", &out); err != nil {
+		t.Fatalf("EnsureTables: %v", err)
+	}
+	if !strings.Contains(out.String(), "FTS4 can't use") {
+		t.Errorf("no notice that FTS4 ignores the tokenizer: %s", out.String())
+	}
+	if !HasFTS5(ctx, db) {
+		t.Skip("SQLite built without FTS5 (build with -tags fts5)")
+	}
+
+	// A new tokenizer replaces the table; porter is FTS5's built-in stemmer
+	if err := EnsureTables(ctx, db, "chunks_fts", ragconfig.BM25EngineFTS5, "porter unicode61", &out); err != nil {
+		t.Fatalf("EnsureTables: %v", err)
+	}
+	if tokenize, err := TableTokenizer(ctx, db, "chunks_fts"); err != nil || tokenize != "porter unicode61" {
+		t.Fatalf("TableTokenizer = %q, %v", tokenize, err)
+	}
+	if _, err := db.Exec(`INSERT INTO chunks (chunk_id, thread_id, session_idx, chunk_idx, message_ids, participant_ids,
+		participant_names, text, start_timestamp_ms, end_timestamp_ms, message_count, is_indexable, char_count,
+		alnum_count, unique_word_count) VALUES ('a', 1, 0, 0, '[]', '[]', '[]', 'we went running', 0, 0, 1, 1, 0, 0, 0)`); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM chunks_fts WHERE chunks_fts MATCH 'runs'`).Scan(&n); err != nil || n != 1 {
+		t.Errorf("stemmed match = %d, %v; want 1", n, err)
+	}
+
+	// Back to unicode61, auto keeps the engine but not the tokenizer
+	if err := EnsureTables(ctx, db, "chunks_fts", ragconfig.BM25EngineAuto, "", &out); err != nil {
+		t.Fatalf("EnsureTables: %v", err)
+	}
+	if tokenize, err := TableTokenizer(ctx, db, "chunks_fts"); err != nil || tokenize != "" {
+		t.Fatalf("TableTokenizer after reset = %q, %v", tokenize, err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM chunks_fts WHERE chunks_fts MATCH 'running'`).Scan(&n); err != nil || n != 1 {
+		t.Errorf("rebuilt index match = %d, %v; want 1", n, err)
+	}
+}
@@ -0,0 +1,495 @@
+package ragindex
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/milvus-io/milvus-sdk-go/v2/client"
+	"github.com/milvus-io/milvus-sdk-go/v2/entity"
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+// Sink is the vector store chunks are indexed into, picked by
+// vector.backend in rag.yaml
+type Sink interface {
+	// Prepare creates the store if missing, dropping it first with drop.
+	// created reports that it starts empty, so every chunk needs indexing.
+	Prepare(ctx context.Context, drop bool) (created bool, err error)
+	Upsert(ctx context.Context, chunks []ChunkRow, embeddings [][]float32) (int, error)
+	Flush(ctx context.Context) error
+	Count(ctx context.Context) (int64, error)
+	// IDs lists the stored chunk IDs, for stale-chunk cleanup
+	IDs(ctx context.Context) ([]string, error)
+	Delete(ctx context.Context, chunkIDs []string) (int, error)
+	Close() error
+}
+
+// NewSink connects to the configured backend
+func NewSink(ctx context.Context, cfg *ragconfig.Config, db *sql.DB, out io.Writer) (Sink, error) {
+	return NewSinkAt(ctx, cfg, db, DefaultVectorStore(cfg), out)
+}
+
+// DefaultVectorStore is the collection (or vector table) searches use:
+// milvus.chunk_collection, or the chunk_vectors table
+func DefaultVectorStore(cfg *ragconfig.Config) string {
+	if cfg.Vector.Backend == ragconfig.VectorBackendSQLite {
+		return vectordb.SQLiteVectorTable
+	}
+	return cfg.Milvus.ChunkCollection
+}
+
+// NewSinkAt is NewSink writing to the named collection (or vector table)
+// instead of the configured one
+func NewSinkAt(ctx context.Context, cfg *ragconfig.Config, db *sql.DB, name string, out io.Writer) (Sink, error) {
+	switch cfg.Vector.Backend {
+	case ragconfig.VectorBackendMilvus, "":
+		if created, err := vectordb.EnsureMilvusDatabase(ctx, cfg.Milvus); err != nil {
+			return nil, fmt.Errorf("preparing Milvus database: %w", err)
+		} else if created {
+			fmt.Fprintf(out, "Created Milvus database %s\n", cfg.Milvus.Database)
+		}
+		c, err := vectordb.NewMilvusClient(ctx, cfg.Milvus)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to Milvus: %w", err)
+		}
+		fmt.Fprintf(out, "Connected to Milvus at %s\n", cfg.Milvus.Address)
+		named := *cfg
+		named.Milvus.ChunkCollection = name
+		return &milvusSink{client: c, cfg: &named, out: out}, nil
+	case ragconfig.VectorBackendSQLite:
+		return &sqliteSink{db: db, table: name, out: out}, nil
+	default:
+		return nil, fmt.Errorf("unknown vector backend %q (want %q or %q)", cfg.Vector.Backend, ragconfig.VectorBackendMilvus, ragconfig.VectorBackendSQLite)
+	}
+}
+
+// milvusSink writes to the Milvus chunk collection
+type milvusSink struct {
+	client client.Client
+	cfg    *ragconfig.Config
+	out    io.Writer
+	// sources is set when the collection has the sources field, which
+	// collections created before it lack until rebuilt with -drop
+	sources bool
+}
+
+func (m *milvusSink) Prepare(ctx context.Context, drop bool) (bool, error) {
+	collection := m.cfg.Milvus.ChunkCollection
+	if drop {
+		if err := dropCollection(ctx, m.client, collection, m.out); err != nil {
+			return false, fmt.Errorf("dropping collection: %w", err)
+		}
+	}
+
+	exists, err := m.client.HasCollection(ctx, collection)
+	if err != nil {
+		return false, fmt.Errorf("checking collection existence: %w", err)
+	}
+	if !exists {
+		if err := createCollection(ctx, m.client, m.cfg, m.out); err != nil {
+			return false, fmt.Errorf("creating collection: %w", err)
+		}
+		m.sources = true
+		return true, nil
+	}
+
+	fmt.Fprintf(m.out, "Collection %s already exists, using existing\n", collection)
+	if m.sources, err = vectordb.MilvusHasField(ctx, m.client, collection, "sources"); err != nil {
+		return false, fmt.Errorf("describing collection: %w", err)
+	} else if !m.sources {
+		fmt.Fprintf(m.out, "Collection %s predates chunk sources; rebuild it with -drop to filter searches by source\n", collection)
+	}
+	// Load collection for insertion
+	if err := m.client.LoadCollection(ctx, collection, false); err != nil {
+		log.Warn().Err(err).Msg("Failed to load collection (may already be loaded)")
+	}
+	return false, nil
+}
+
+func (m *milvusSink) Upsert(ctx context.Context, chunks []ChunkRow, embeddings [][]float32) (int, error) {
+	return insertBatch(ctx, m.client, m.cfg.Milvus.ChunkCollection, chunks, embeddings, m.cfg.Embedding.Dimension, m.sources)
+}
+
+func (m *milvusSink) Flush(ctx context.Context) error {
+	return m.client.Flush(ctx, m.cfg.Milvus.ChunkCollection, false)
+}
+
+func (m *milvusSink) Count(ctx context.Context) (int64, error) {
+	stats, err := m.client.GetCollectionStatistics(ctx, m.cfg.Milvus.ChunkCollection)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	if rowCount, ok := stats["row_count"]; ok {
+		fmt.Sscanf(rowCount, "%d", &count)
+	}
+	return count, nil
+}
+
+// IDs queries chunk_ids by hex prefix to work around Milvus's default result
+// limits. For very large collections (>100k chunks) this may still miss
+// some; use --drop for a complete rebuild in such cases.
+func (m *milvusSink) IDs(ctx context.Context) ([]string, error) {
+	var ids []string
+	hexPrefixes := []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "a", "b", "c", "d", "e", "f"}
+
+	for _, prefix := range hexPrefixes {
+		// Query chunks with this hex prefix (chunk_ids are hex hashes)
+		expr := fmt.Sprintf("chunk_id like \"%s%%\"", prefix)
+		results, err := m.client.Query(ctx, m.cfg.Milvus.ChunkCollection, []string{}, expr, []string{"chunk_id"})
+		if err != nil {
+			log.Warn().Err(err).Str("prefix", prefix).Msg("Failed to query Milvus partition")
+			continue
+		}
+
+		for _, col := range results {
+			if col.Name() == "chunk_id" {
+				if strCol, ok := col.(*entity.ColumnVarChar); ok {
+					for i := 0; i < strCol.Len(); i++ {
+						val, err := strCol.ValueByIdx(i)
+						if err != nil {
+							continue
+						}
+						ids = append(ids, val)
+					}
+				}
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (m *milvusSink) Delete(ctx context.Context, chunkIDs []string) (int, error) {
+	// Delete in batches
+	deleteBatchSize := 1000
+	deleted := 0
+
+	for i := 0; i < len(chunkIDs); i += deleteBatchSize {
+		batch := chunkIDs[i:min(i+deleteBatchSize, len(chunkIDs))]
+
+		// Build expression for deletion
+		expr := fmt.Sprintf("chunk_id in [\"%s\"]", strings.Join(batch, "\",\""))
+		if err := m.client.Delete(ctx, m.cfg.Milvus.ChunkCollection, "", expr); err != nil {
+			log.Warn().Err(err).Int("batch_start", i).Msg("Failed to delete batch")
+			continue
+		}
+		deleted += len(batch)
+	}
+	return deleted, nil
+}
+
+func (m *milvusSink) Close() error {
+	return m.client.Close()
+}
+
+// sqliteSink writes to a vector table (chunk_vectors) in the main database
+type sqliteSink struct {
+	db    *sql.DB
+	table string
+	out   io.Writer
+}
+
+func (s *sqliteSink) Prepare(ctx context.Context, drop bool) (bool, error) {
+	if drop {
+		fmt.Fprintf(s.out, "Dropping table %s...\n", s.table)
+		if err := vectordb.DropSQLiteVectorTable(ctx, s.db, s.table); err != nil {
+			return false, fmt.Errorf("dropping %s: %w", s.table, err)
+		}
+	}
+	created, err := vectordb.EnsureSQLiteVectorTable(ctx, s.db, s.table)
+	if err != nil {
+		return false, err
+	}
+	if created {
+		fmt.Fprintf(s.out, "Created table %s\n", s.table)
+	} else {
+		fmt.Fprintf(s.out, "Table %s already exists, using existing\n", s.table)
+	}
+	return created, nil
+}
+
+func (s *sqliteSink) Upsert(ctx context.Context, chunks []ChunkRow, embeddings [][]float32) (int, error) {
+	if len(chunks) == 0 {
+		return 0, nil
+	}
+	ids := make([]string, len(chunks))
+	for i, c := range chunks {
+		ids[i] = c.ChunkID
+	}
+	if err := vectordb.UpsertSQLiteVectors(ctx, s.db, s.table, ids, embeddings); err != nil {
+		return 0, fmt.Errorf("upserting: %w", err)
+	}
+	return len(chunks), nil
+}
+
+// Flush is a no-op: every upsert is its own committed transaction
+func (s *sqliteSink) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (s *sqliteSink) Count(ctx context.Context) (int64, error) {
+	version, err := vectordb.GetSQLiteVectorVersion(ctx, s.db, s.table)
+	return version.Rows, err
+}
+
+func (s *sqliteSink) IDs(ctx context.Context) ([]string, error) {
+	return vectordb.SQLiteVectorIDs(ctx, s.db, s.table)
+}
+
+func (s *sqliteSink) Delete(ctx context.Context, chunkIDs []string) (int, error) {
+	return vectordb.DeleteSQLiteVectors(ctx, s.db, s.table, chunkIDs)
+}
+
+// Close is a no-op: the database handle belongs to the caller
+func (s *sqliteSink) Close() error {
+	return nil
+}
+
+func dropCollection(ctx context.Context, c client.Client, collection string, out io.Writer) error {
+	exists, err := c.HasCollection(ctx, collection)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	fmt.Fprintf(out, "Dropping existing collection %s...\n", collection)
+	return c.DropCollection(ctx, collection)
+}
+
+func createCollection(ctx context.Context, c client.Client, cfg *ragconfig.Config, out io.Writer) error {
+	collection := cfg.Milvus.ChunkCollection
+	dim := cfg.Embedding.Dimension
+
+	fmt.Fprintf(out, "Creating collection %s...\n", collection)
+
+	schema := &entity.Schema{
+		CollectionName: collection,
+		Description:    "Messenger message chunks v2 - improved coherence",
+		Fields: []*entity.Field{
+			{
+				Name:       "chunk_id",
+				DataType:   entity.FieldTypeVarChar,
+				PrimaryKey: true,
+				TypeParams: map[string]string{"max_length": "32"},
+			},
+			{
+				Name:     "thread_id",
+				DataType: entity.FieldTypeInt64,
+			},
+			{
+				Name:       "thread_name",
+				DataType:   entity.FieldTypeVarChar,
+				TypeParams: map[string]string{"max_length": "512"},
+			},
+			{
+				Name:     "session_idx",
+				DataType: entity.FieldTypeInt16,
+			},
+			{
+				Name:     "chunk_idx",
+				DataType: entity.FieldTypeInt16,
+			},
+			{
+				Name:       "participant_ids",
+				DataType:   entity.FieldTypeVarChar,
+				TypeParams: map[string]string{"max_length": "1024"},
+			},
+			{
+				Name:       "participant_names",
+				DataType:   entity.FieldTypeVarChar,
+				TypeParams: map[string]string{"max_length": "2048"},
+			},
+			{
+				Name:       "text",
+				DataType:   entity.FieldTypeVarChar,
+				TypeParams: map[string]string{"max_length": "8192"},
+			},
+			{
+				Name:       "message_ids",
+				DataType:   entity.FieldTypeVarChar,
+				TypeParams: map[string]string{"max_length": "8192"},
+			},
+			{
+				Name:     "start_timestamp_ms",
+				DataType: entity.FieldTypeInt64,
+			},
+			{
+				Name:     "end_timestamp_ms",
+				DataType: entity.FieldTypeInt64,
+			},
+			{
+				Name:     "message_count",
+				DataType: entity.FieldTypeInt16,
+			},
+			{
+				Name:       "sources",
+				DataType:   entity.FieldTypeVarChar,
+				TypeParams: map[string]string{"max_length": "256"},
+			},
+			{
+				Name:       "embedding",
+				DataType:   entity.FieldTypeFloatVector,
+				TypeParams: map[string]string{"dim": fmt.Sprintf("%d", dim)},
+			},
+		},
+	}
+
+	if err := c.CreateCollection(ctx, schema, entity.DefaultShardNumber); err != nil {
+		return fmt.Errorf("creating collection: %w", err)
+	}
+
+	// Create HNSW index
+	idx, err := entity.NewIndexHNSW(
+		milvusMetricFromConfig(cfg.Milvus.Index.Metric),
+		cfg.Milvus.Index.M,
+		cfg.Milvus.Index.EfConstruction,
+	)
+	if err != nil {
+		return fmt.Errorf("creating index params: %w", err)
+	}
+
+	if err := c.CreateIndex(ctx, collection, "embedding", idx, false); err != nil {
+		return fmt.Errorf("creating index: %w", err)
+	}
+
+	// Load collection
+	if err := c.LoadCollection(ctx, collection, false); err != nil {
+		return fmt.Errorf("loading collection: %w", err)
+	}
+
+	fmt.Fprintf(out, "Collection created with HNSW index (M=%d, ef_construction=%d)\n",
+		cfg.Milvus.Index.M, cfg.Milvus.Index.EfConstruction)
+
+	return nil
+}
+
+func milvusMetricFromConfig(metric string) entity.MetricType {
+	switch strings.ToUpper(strings.TrimSpace(metric)) {
+	case "L2":
+		return entity.L2
+	case "IP", "INNER_PRODUCT":
+		return entity.IP
+	case "COSINE":
+		return entity.COSINE
+	default:
+		return entity.COSINE
+	}
+}
+
+// insertBatch upserts chunks with their embeddings (same order) into Milvus,
+// including their sources if the collection has the field
+func insertBatch(ctx context.Context, milvus client.Client, collection string, chunks []ChunkRow, embeddings [][]float32, dim int, withSources bool) (int, error) {
+	if len(chunks) == 0 {
+		return 0, nil
+	}
+
+	// Prepare columns
+	chunkIDs := make([]string, len(chunks))
+	threadIDs := make([]int64, len(chunks))
+	threadNames := make([]string, len(chunks))
+	sessionIdxs := make([]int16, len(chunks))
+	chunkIdxs := make([]int16, len(chunks))
+	participantIDsList := make([]string, len(chunks))
+	participantNamesList := make([]string, len(chunks))
+	textList := make([]string, len(chunks))
+	messageIDsList := make([]string, len(chunks))
+	startTimestamps := make([]int64, len(chunks))
+	endTimestamps := make([]int64, len(chunks))
+	messageCounts := make([]int16, len(chunks))
+	sourcesList := make([]string, len(chunks))
+	embeddingsList := make([][]float32, len(chunks))
+
+	for i, c := range chunks {
+		chunkIDs[i] = c.ChunkID
+		threadIDs[i] = c.ThreadID
+		threadNames[i] = truncate(c.ThreadName, 511)
+		sessionIdxs[i] = int16(c.SessionIdx)
+		chunkIdxs[i] = int16(c.ChunkIdx)
+		participantIDsList[i] = truncateJSON(c.ParticipantIDs, 1023)
+		participantNamesList[i] = truncateJSON(c.ParticipantNames, 2047)
+		textList[i] = truncate(c.Text, 8191)
+		messageIDsList[i] = truncateJSON(c.MessageIDs, 8191)
+		startTimestamps[i] = c.StartTimestampMs
+		endTimestamps[i] = c.EndTimestampMs
+		messageCounts[i] = int16(c.MessageCount)
+		sourcesList[i] = truncateJSON(c.Sources, 255)
+		embeddingsList[i] = embeddings[i]
+	}
+
+	// Create columns
+	cols := []entity.Column{
+		entity.NewColumnVarChar("chunk_id", chunkIDs),
+		entity.NewColumnInt64("thread_id", threadIDs),
+		entity.NewColumnVarChar("thread_name", threadNames),
+		entity.NewColumnInt16("session_idx", sessionIdxs),
+		entity.NewColumnInt16("chunk_idx", chunkIdxs),
+		entity.NewColumnVarChar("participant_ids", participantIDsList),
+		entity.NewColumnVarChar("participant_names", participantNamesList),
+		entity.NewColumnVarChar("text", textList),
+		entity.NewColumnVarChar("message_ids", messageIDsList),
+		entity.NewColumnInt64("start_timestamp_ms", startTimestamps),
+		entity.NewColumnInt64("end_timestamp_ms", endTimestamps),
+		entity.NewColumnInt16("message_count", messageCounts),
+		entity.NewColumnFloatVector("embedding", dim, embeddingsList),
+	}
+	if withSources {
+		cols = append(cols, entity.NewColumnVarChar("sources", sourcesList))
+	}
+
+	// Insert (use Upsert for idempotency)
+	_, err := milvus.Upsert(ctx, collection, "", cols...)
+	if err != nil {
+		return 0, fmt.Errorf("upserting: %w", err)
+	}
+
+	return len(chunks), nil
+}
+
+func truncate(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	// UTF-8 safe truncation: don't cut in the middle of a multi-byte character
+	// Walk backwards from maxLen to find a valid UTF-8 boundary
+	for maxLen > 0 && !isUTF8Start(s[maxLen]) {
+		maxLen--
+	}
+	return s[:maxLen]
+}
+
+// isUTF8Start returns true if byte is a valid UTF-8 start byte (not a continuation)
+func isUTF8Start(b byte) bool {
+	// UTF-8 continuation bytes are 10xxxxxx (0x80-0xBF)
+	return (b & 0xC0) != 0x80
+}
+
+func truncateJSON(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+
+	// Try to parse and trim JSON array
+	var arr []interface{}
+	if err := json.Unmarshal([]byte(s), &arr); err != nil {
+		return "[]"
+	}
+
+	for len(arr) > 0 {
+		arr = arr[:len(arr)-1]
+		trimmed, _ := json.Marshal(arr)
+		if len(trimmed) <= maxLen {
+			return string(trimmed)
+		}
+	}
+
+	return "[]"
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PendingAttachment is an attachment that has not been downloaded yet
+type PendingAttachment struct {
+	ID             string
+	MessageID      string
+	AttachmentType int64
+	URL            string
+	Filename       string
+	MimeType       string
+	// E2EEMedia is the marshalled WAMediaTransport for E2EE attachments, which
+	// have no URL and are fetched and decrypted through whatsmeow
+	E2EEMedia     []byte
+	E2EEMediaType string
+}
+
+// E2EEAttachment is an attachment of an E2EE message
+type E2EEAttachment struct {
+	ID             string
+	MessageID      string
+	AttachmentType int64
+	Filename       string
+	MimeType       string
+	FileSize       int64
+	Width          int64
+	Height         int64
+	DurationMs     int64
+	Media          []byte // Marshalled WAMediaTransport
+	MediaType      string // whatsmeow MediaType
+}
+
+// UpsertE2EEAttachment stores an E2EE attachment with the keys needed to
+// download it later
+func (s *Storage) UpsertE2EEAttachment(a *E2EEAttachment) error {
+	now := time.Now().UnixMilli()
+	_, err := s.db.Exec(`
+		INSERT INTO attachments (id, message_id, attachment_type, filename, mime_type, file_size,
+			width, height, duration_ms, e2ee_media, e2ee_media_type, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			filename = COALESCE(excluded.filename, attachments.filename),
+			mime_type = COALESCE(excluded.mime_type, attachments.mime_type),
+			file_size = COALESCE(excluded.file_size, attachments.file_size),
+			width = COALESCE(excluded.width, attachments.width),
+			height = COALESCE(excluded.height, attachments.height),
+			duration_ms = COALESCE(excluded.duration_ms, attachments.duration_ms),
+			e2ee_media = excluded.e2ee_media,
+			e2ee_media_type = excluded.e2ee_media_type
+	`, a.ID, a.MessageID, a.AttachmentType, nullIfEmpty(a.Filename), nullIfEmpty(a.MimeType), nullIfZero(a.FileSize),
+		nullIfZero(a.Width), nullIfZero(a.Height), nullIfZero(a.DurationMs), a.Media, a.MediaType, now)
+	return err
+}
+
+// GetPendingAttachments returns up to limit attachments without a local file,
+// newest first since CDN URLs expire. e2ee selects E2EE attachments instead
+// of ones with a URL. Attachments whose last download failed are skipped
+// unless retryFailed is set.
+func (s *Storage) GetPendingAttachments(limit int, e2ee, retryFailed bool) ([]PendingAttachment, error) {
+	source := `url IS NOT NULL AND url != '' AND e2ee_media IS NULL`
+	if e2ee {
+		source = `e2ee_media IS NOT NULL`
+	}
+	query := `
+		SELECT id, message_id, attachment_type, COALESCE(url, ''), COALESCE(filename, ''),
+			COALESCE(mime_type, ''), e2ee_media, COALESCE(e2ee_media_type, '')
+		FROM attachments
+		WHERE local_path IS NULL AND ` + source
+	if !retryFailed {
+		query += ` AND download_error IS NULL`
+	}
+	query += ` ORDER BY created_at DESC LIMIT ?`
+
+	rows, err := s.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []PendingAttachment
+	for rows.Next() {
+		var a PendingAttachment
+		if err := rows.Scan(&a.ID, &a.MessageID, &a.AttachmentType, &a.URL, &a.Filename,
+			&a.MimeType, &a.E2EEMedia, &a.E2EEMediaType); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// CountPendingAttachments counts attachments without a local file, split by
+// plain and E2EE, including failed ones
+func (s *Storage) CountPendingAttachments() (plain, e2ee int64, err error) {
+	err = s.db.QueryRow(`
+		SELECT COALESCE(SUM(e2ee_media IS NULL AND url IS NOT NULL AND url != ''), 0),
+			COALESCE(SUM(e2ee_media IS NOT NULL), 0)
+		FROM attachments
+		WHERE local_path IS NULL
+	`).Scan(&plain, &e2ee)
+	return plain, e2ee, err
+}
+
+// SetAttachmentDownloaded records where an attachment's file was stored.
+// localPath is relative to the attachments directory.
+func (s *Storage) SetAttachmentDownloaded(attachmentID, localPath, sha256Hex string, size int64) error {
+	_, err := s.q().Exec(`
+		UPDATE attachments SET
+			local_path = ?,
+			content_sha256 = ?,
+			file_size = COALESCE(file_size, ?),
+			downloaded_at = ?,
+			download_error = NULL
+		WHERE id = ?
+	`, localPath, sha256Hex, nullIfZero(size), time.Now().UnixMilli(), attachmentID)
+	return err
+}
+
+// SetAttachmentDownloadError records a failed download so later passes skip
+// the attachment until retried
+func (s *Storage) SetAttachmentDownloadError(attachmentID, msg string) error {
+	_, err := s.db.Exec(`UPDATE attachments SET download_error = ? WHERE id = ?`, msg, attachmentID)
+	return err
+}
+
+// GetAttachmentLocalPath returns an attachment's stored file, or "" if it has not been downloaded.
+func GetAttachmentLocalPath(db *sql.DB, attachmentID string) (string, error) {
+	return attachmentLocalPath(db, attachmentID)
+}
+
+// AttachmentLocalPath is GetAttachmentLocalPath for a Storage
+func (s *Storage) AttachmentLocalPath(attachmentID string) (string, error) {
+	return attachmentLocalPath(s.q(), attachmentID)
+}
+
+func attachmentLocalPath(db querier, attachmentID string) (string, error) {
+	var path sql.NullString
+	err := db.QueryRow(`SELECT local_path FROM attachments WHERE id = ?`, attachmentID).Scan(&path)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return path.String, err
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"time"
+)
+
+// AvatarRefresh is a contact whose avatar URL needs to be refreshed
+type AvatarRefresh struct {
+	ContactID    int64
+	StatusCode   int
+	FailedURL    string
+	FailureCount int
+	FailedAtMs   int64
+}
+
+// RecordAvatarFailure marks a contact's profile picture URL as expired/broken.
+// Repeated failures for the same URL bump failure_count.
+func (s *Storage) RecordAvatarFailure(contactID int64, statusCode int, url string) error {
+	now := time.Now().UnixMilli()
+	_, err := s.db.Exec(`
+		INSERT INTO avatar_refresh_queue (contact_id, status_code, failed_url, failure_count, failed_at)
+		VALUES (?, ?, ?, 1, ?)
+		ON CONFLICT(contact_id) DO UPDATE SET
+			status_code = excluded.status_code,
+			failed_url = excluded.failed_url,
+			failure_count = avatar_refresh_queue.failure_count + 1,
+			failed_at = excluded.failed_at
+	`, contactID, statusCode, nullIfEmpty(url), now)
+	return err
+}
+
+// GetPendingAvatarRefreshes returns queued contacts that have not been requested
+// since requestedBeforeMs (0 = only never-requested entries).
+func (s *Storage) GetPendingAvatarRefreshes(requestedBeforeMs int64, limit int) ([]AvatarRefresh, error) {
+	rows, err := s.db.Query(`
+		SELECT contact_id, status_code, COALESCE(failed_url, ''), failure_count, failed_at
+		FROM avatar_refresh_queue
+		WHERE requested_at IS NULL OR requested_at < ?
+		ORDER BY failed_at ASC
+		LIMIT ?
+	`, requestedBeforeMs, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []AvatarRefresh
+	for rows.Next() {
+		var r AvatarRefresh
+		if err := rows.Scan(&r.ContactID, &r.StatusCode, &r.FailedURL, &r.FailureCount, &r.FailedAtMs); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// MarkAvatarRefreshRequested records that fresh contact info was requested
+func (s *Storage) MarkAvatarRefreshRequested(contactIDs []int64) error {
+	if len(contactIDs) == 0 {
+		return nil
+	}
+
+	now := time.Now().UnixMilli()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`UPDATE avatar_refresh_queue SET requested_at = ? WHERE contact_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, id := range contactIDs {
+		if _, err := stmt.Exec(now, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// clearAvatarRefresh drops a queued refresh once the contact has a new URL
+func (s *Storage) clearAvatarRefresh(contactID int64, newURL string) error {
+	if newURL == "" {
+		return nil
+	}
+	_, err := s.db.Exec(`
+		DELETE FROM avatar_refresh_queue
+		WHERE contact_id = ? AND (failed_url IS NULL OR failed_url != ?)
+	`, contactID, newURL)
+	return err
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+)
+
+// PendingCaption is an image attachment without extracted text
+type PendingCaption struct {
+	AttachmentID string
+	MessageID    string
+	LocalPath    string // Relative to media.attachments_dir; empty for export images
+	URL          string // For export images: the path inside the export
+	Filename     string
+	MimeType     string
+}
+
+// imageAttachmentSQL selects still images. GIFs and stickers are left out:
+// vision endpoints often reject animations, and stickers carry no text.
+var imageAttachmentSQL = `((a.attachment_type IN (` +
+	strconv.Itoa(int(table.AttachmentTypeImage)) + `, ` + strconv.Itoa(int(table.AttachmentTypeEphemeralImage)) +
+	`) OR (a.mime_type LIKE 'image/%' AND a.attachment_type NOT IN (` +
+	strconv.Itoa(int(table.AttachmentTypeSticker)) + `, ` + strconv.Itoa(int(table.AttachmentTypeSelfieSticker)) + `, ` +
+	strconv.Itoa(int(table.AttachmentTypeThirdPartySticker)) + `, ` + strconv.Itoa(int(table.AttachmentTypeAnimatedImage)) +
+	`))) AND COALESCE(a.mime_type, '') != 'image/gif')`
+
+// exportedAttachmentSQL selects attachments imported from an export, whose url
+// is a path inside the export rather than a CDN URL
+const exportedAttachmentSQL = `(a.url IS NOT NULL AND a.url != '' AND a.url NOT LIKE 'http://%' AND a.url NOT LIKE 'https://%')`
+
+// GetPendingCaptions returns up to limit image attachments without extracted
+// text, newest first: downloaded ones, plus export images when exported is set
+// (their files are read from the export). Attachments whose last attempt
+// failed are skipped unless retryFailed is set.
+func (s *Storage) GetPendingCaptions(limit int, exported, retryFailed bool) ([]PendingCaption, error) {
+	source := `a.local_path IS NOT NULL`
+	if exported {
+		source = `(a.local_path IS NOT NULL OR ` + exportedAttachmentSQL + `)`
+	}
+	query := `
+		SELECT a.id, a.message_id, COALESCE(a.local_path, ''), COALESCE(a.url, ''),
+			COALESCE(a.filename, ''), COALESCE(a.mime_type, '')
+		FROM attachments a
+		LEFT JOIN attachment_captions c ON c.attachment_id = a.id
+		WHERE ` + source + ` AND ` + imageAttachmentSQL
+	if retryFailed {
+		query += ` AND (c.attachment_id IS NULL OR c.error IS NOT NULL)`
+	} else {
+		query += ` AND c.attachment_id IS NULL`
+	}
+	query += ` ORDER BY a.created_at DESC LIMIT ?`
+
+	rows, err := s.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []PendingCaption
+	for rows.Next() {
+		var p PendingCaption
+		if err := rows.Scan(&p.AttachmentID, &p.MessageID, &p.LocalPath, &p.URL, &p.Filename, &p.MimeType); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// CountPendingCaptions counts image attachments without extracted text:
+// downloaded ones that can be processed now, and the rest
+func (s *Storage) CountPendingCaptions() (ready, notDownloaded int64, err error) {
+	err = s.db.QueryRow(`
+		SELECT COALESCE(SUM(a.local_path IS NOT NULL), 0), COALESCE(SUM(a.local_path IS NULL), 0)
+		FROM attachments a
+		LEFT JOIN attachment_captions c ON c.attachment_id = a.id
+		WHERE c.attachment_id IS NULL AND `+imageAttachmentSQL).Scan(&ready, &notDownloaded)
+	return ready, notDownloaded, err
+}
+
+// SaveCaption stores the text extracted from an image attachment and marks
+// its message unindexed, like SaveTranscript
+func (s *Storage) SaveCaption(attachmentID, messageID, text, model string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO attachment_captions (attachment_id, message_id, text, model, error, created_at)
+		VALUES (?, ?, ?, ?, NULL, ?)
+		ON CONFLICT(attachment_id) DO UPDATE SET
+			text = excluded.text,
+			model = excluded.model,
+			error = NULL,
+			created_at = excluded.created_at
+	`, attachmentID, messageID, text, nullIfEmpty(model), time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE messages SET indexed_at = NULL WHERE id = ?`, messageID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetCaptionError records a failed extraction so later passes skip the
+// attachment until retried. Existing text is kept.
+func (s *Storage) SetCaptionError(attachmentID, messageID, msg string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO attachment_captions (attachment_id, message_id, error, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(attachment_id) DO UPDATE SET error = excluded.error
+	`, attachmentID, messageID, msg, time.Now().UnixMilli())
+	return err
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Change is a single row of the change feed
+type Change struct {
+	Seq         int64  `json:"seq"`
+	EntityType  string `json:"entity_type"`
+	EntityID    string `json:"entity_id"`
+	ThreadID    int64  `json:"thread_id,string,omitempty"`
+	Op          string `json:"op"`
+	TimestampMs int64  `json:"ts"`
+}
+
+// ListChanges returns changes with seq > afterSeq in order.
+func ListChanges(db *sql.DB, afterSeq int64, limit int) ([]Change, error) {
+	rows, err := db.Query(`
+		SELECT seq, entity_type, entity_id, COALESCE(thread_id, 0), op, ts
+		FROM changes
+		WHERE seq > ?
+		ORDER BY seq ASC
+		LIMIT ?
+	`, afterSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Change
+	for rows.Next() {
+		var c Change
+		if err := rows.Scan(&c.Seq, &c.EntityType, &c.EntityID, &c.ThreadID, &c.Op, &c.TimestampMs); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// GetChanges returns changes with seq > afterSeq in order
+func (s *Storage) GetChanges(afterSeq int64, limit int) ([]Change, error) {
+	return ListChanges(s.db, afterSeq, limit)
+}
+
+// PruneChanges deletes change feed rows older than maxAge
+func (s *Storage) PruneChanges(maxAge time.Duration) (int64, error) {
+	cutoff := time.Now().Add(-maxAge).UnixMilli()
+	res, err := s.db.Exec(`DELETE FROM changes WHERE ts < ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
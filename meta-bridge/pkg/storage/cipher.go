@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Encryption at rest uses SQLCipher. The key is read from $MESSENGER_DB_KEY,
+// or from a file named by -db-key-file or $MESSENGER_DB_KEY_FILE. The binaries
+// must be linked against libsqlcipher (go build -tags libsqlite3 with
+// CGO_CFLAGS/CGO_LDFLAGS pointing at it); the bundled SQLite can't decrypt.
+const (
+	KeyEnv     = "MESSENGER_DB_KEY"
+	KeyFileEnv = "MESSENGER_DB_KEY_FILE"
+)
+
+var (
+	// ErrKeyRequired is returned opening an encrypted database without a key
+	ErrKeyRequired = errors.New("database is encrypted or not a SQLite database: set " + KeyEnv + " or -db-key-file")
+	// ErrWrongKey is returned when the key doesn't decrypt the database
+	ErrWrongKey = errors.New("database key is wrong, or the file is not a SQLite database")
+	// ErrNoSQLCipher is returned when a key is set but SQLite can't use it
+	ErrNoSQLCipher = errors.New("a database key is set, but SQLite was built without SQLCipher (build with -tags libsqlite3 against libsqlcipher)")
+)
+
+var (
+	keyMu        sync.Mutex
+	dbKey        string
+	keyedDrivers = map[string]string{}
+)
+
+// KeyFileFlag registers -db-key-file on the default flag set
+func KeyFileFlag() *string {
+	return flag.String("db-key-file", os.Getenv(KeyFileEnv), "File holding the SQLCipher key of the database (default $"+KeyFileEnv+"; $"+KeyEnv+" may hold the key itself)")
+}
+
+// LoadKey sets the key databases are opened with: the contents of keyFile,
+// or $MESSENGER_DB_KEY. Without either, databases are plain SQLite.
+func LoadKey(keyFile string) error {
+	key := os.Getenv(KeyEnv)
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return fmt.Errorf("reading database key: %w", err)
+		}
+		if key = strings.TrimSpace(string(data)); key == "" {
+			return fmt.Errorf("database key file %s is empty", keyFile)
+		}
+	}
+	SetKey(key)
+	return nil
+}
+
+// SetKey sets the key of databases opened from now on; "" opens them
+// unencrypted
+func SetKey(key string) {
+	keyMu.Lock()
+	defer keyMu.Unlock()
+	dbKey = key
+}
+
+func currentKey() string {
+	keyMu.Lock()
+	defer keyMu.Unlock()
+	return dbKey
+}
+
+// Driver returns the database/sql driver to open messenger.db with in place
+// of name ("sqlite3", or a driver from ragindex.LoadTokenizer). Its
+// connections are keyed with the key set by LoadKey, and opening an
+// encrypted database without the key fails with ErrKeyRequired instead of
+// at the first query.
+func Driver(name string) string {
+	keyMu.Lock()
+	defer keyMu.Unlock()
+	if keyed, ok := keyedDrivers[name]; ok {
+		return keyed
+	}
+	db, err := sql.Open(name, "") // Doesn't connect
+	if err != nil {
+		return name
+	}
+	base, ok := db.Driver().(*sqlite3.SQLiteDriver)
+	db.Close()
+	if !ok {
+		return name
+	}
+	keyed := name + "_keyed"
+	sql.Register(keyed, &keyedDriver{base: base})
+	keyedDrivers[name] = keyed
+	return keyed
+}
+
+// keyedDriver opens connections with base and keys them before anything
+// reads the database
+type keyedDriver struct {
+	base *sqlite3.SQLiteDriver
+}
+
+func (d *keyedDriver) Open(dsn string) (driver.Conn, error) {
+	key := currentKey()
+	// Setting the journal mode reads the database, which fails until it
+	// is keyed
+	var journal string
+	if key != "" {
+		dsn, journal = cutDSNParam(dsn, "_journal_mode")
+	}
+	conn, err := d.base.Open(dsn)
+	if err != nil {
+		return nil, unreadable(err, key)
+	}
+	c := conn.(*sqlite3.SQLiteConn)
+	if err := unlock(c, key, journal); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// unlock keys c and checks that it can read the database
+func unlock(c *sqlite3.SQLiteConn, key, journal string) error {
+	if key != "" {
+		if _, err := c.Exec("PRAGMA key = "+quoteLiteral(key), nil); err != nil {
+			return fmt.Errorf("setting database key: %w", err)
+		}
+		version, err := queryString(c, "PRAGMA cipher_version")
+		if err != nil {
+			return err
+		}
+		if version == "" {
+			return ErrNoSQLCipher
+		}
+	}
+	if _, err := queryString(c, "SELECT count(*) FROM sqlite_master"); err != nil {
+		return unreadable(err, key)
+	}
+	if journal != "" {
+		if _, err := c.Exec("PRAGMA journal_mode = "+journal, nil); err != nil {
+			return fmt.Errorf("setting journal mode: %w", err)
+		}
+	}
+	return nil
+}
+
+// unreadable explains SQLite failing to read a database it can't decrypt
+func unreadable(err error, key string) error {
+	var se sqlite3.Error
+	if !errors.As(err, &se) || se.Code != sqlite3.ErrNotADB {
+		return err
+	}
+	if key == "" {
+		return ErrKeyRequired
+	}
+	return ErrWrongKey
+}
+
+// queryString returns the first column of the first row of query, "" if
+// it returns no rows
+func queryString(c *sqlite3.SQLiteConn, query string) (string, error) {
+	rows, err := c.Query(query, nil)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, len(rows.Columns()))
+	if len(dest) == 0 {
+		return "", nil
+	}
+	if err := rows.Next(dest); err == io.EOF {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(dest[0]), nil
+}
+
+// cutDSNParam removes a query parameter from a DSN and returns its value
+func cutDSNParam(dsn, name string) (string, string) {
+	path, query, ok := strings.Cut(dsn, "?")
+	if !ok {
+		return dsn, ""
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil || !params.Has(name) {
+		return dsn, ""
+	}
+	value := params.Get(name)
+	params.Del(name)
+	if len(params) == 0 {
+		return path, value
+	}
+	return path + "?" + params.Encode(), value
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
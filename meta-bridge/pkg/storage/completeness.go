@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"cmp"
+	"database/sql"
+	"math"
+	"slices"
+	"strings"
+)
+
+const (
+	dayMs = 24 * 60 * 60 * 1000
+
+	// A gap between two days with messages is a hole when it's at least
+	// holeMinDays long and holeCadences times the thread's typical gap
+	holeMinDays  = 30
+	holeCadences = 8
+	// maxListedHoles caps the holes listed per thread, largest kept
+	maxListedHoles = 5
+	// behindMinDays is how far threads.last_activity_ms may be past the
+	// newest stored message before the difference counts as missing
+	behindMinDays = 2
+)
+
+// CompletenessHole is a stretch of a thread with no messages, much longer
+// than its usual silences
+type CompletenessHole struct {
+	FromMs int64 `json:"from_ms"` // Last message before it
+	ToMs   int64 `json:"to_ms"`   // First message after it
+	Days   int   `json:"days"`
+}
+
+// ThreadCompleteness estimates how much of a thread's history the archive
+// holds. Score is the share of the days from its first message to its last
+// activity not lost to holes or to messages missing since the newest one
+// stored: 1 looks complete, 0 has nothing. NeedsImport flags threads an
+// export import would likely add to: ones with holes, behind their last
+// activity, or with no imported history at all.
+type ThreadCompleteness struct {
+	ThreadID       int64   `json:"thread_id,string"`
+	ThreadName     string  `json:"thread_name"`
+	Score          float64 `json:"score"`
+	Messages       int64   `json:"messages"`
+	ActiveDays     int     `json:"active_days"`
+	FirstMs        int64   `json:"first_ms,omitempty"`
+	LastMs         int64   `json:"last_ms,omitempty"`
+	LastActivityMs int64   `json:"last_activity_ms,omitempty"`
+	// CadenceDays is the median gap between days with messages
+	CadenceDays float64            `json:"cadence_days"`
+	Holes       []CompletenessHole `json:"holes,omitempty"`
+	// BehindDays is how far the thread's last activity is past its newest
+	// stored message
+	BehindDays  int      `json:"behind_days,omitempty"`
+	MissingDays int      `json:"missing_days"` // In holes or behind
+	Sources     []string `json:"sources"`      // ProvenanceLive, ProvenanceExport and/or ProvenanceImportSample
+	NeedsImport bool     `json:"needs_import"`
+}
+
+// activeDay is a UTC day with messages in a thread
+type activeDay struct {
+	day     int64
+	firstMs int64
+	lastMs  int64
+}
+
+// ListThreadCompleteness estimates the completeness of the given threads
+// (nil = all), ordered by thread ID
+func ListThreadCompleteness(db *sql.DB, threadIDs []int64) ([]ThreadCompleteness, error) {
+	if threadIDs != nil && len(threadIDs) == 0 {
+		return nil, nil
+	}
+	threadsWhere, args := idsIn("t.id", threadIDs)
+	messagesWhere, _ := idsIn("m.thread_id", threadIDs)
+
+	byID := map[int64]*ThreadCompleteness{}
+	rows, err := db.Query(`
+		SELECT t.id, COALESCE(n.name, ''), COALESCE(t.last_activity_ms, 0)
+		FROM threads t
+		LEFT JOIN thread_names n ON n.thread_id = t.id
+		WHERE `+threadsWhere, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		c := &ThreadCompleteness{Sources: []string{}}
+		if err := rows.Scan(&c.ThreadID, &c.ThreadName, &c.LastActivityMs); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		byID[c.ThreadID] = c
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`
+		SELECT m.thread_id, m.timestamp_ms / 86400000 AS day, `+sourceSQL+` AS kind,
+		       COUNT(*), MIN(m.timestamp_ms), MAX(m.timestamp_ms)
+		FROM messages m
+		WHERE m.is_unsent = 0 AND `+messagesWhere+`
+		GROUP BY m.thread_id, day, kind
+		ORDER BY m.thread_id, day
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := map[int64][]activeDay{}
+	for rows.Next() {
+		var threadID, count int64
+		var d activeDay
+		var source string
+		if err := rows.Scan(&threadID, &d.day, &source, &count, &d.firstMs, &d.lastMs); err != nil {
+			return nil, err
+		}
+		c := byID[threadID]
+		if c == nil {
+			// Messages of a thread the threads table doesn't have
+			c = &ThreadCompleteness{ThreadID: threadID, Sources: []string{}}
+			byID[threadID] = c
+		}
+		c.Messages += count
+		if !slices.Contains(c.Sources, source) {
+			c.Sources = append(c.Sources, source)
+		}
+		ds := days[threadID]
+		if n := len(ds); n > 0 && ds[n-1].day == d.day {
+			// The other source's messages that day
+			ds[n-1].firstMs = min(ds[n-1].firstMs, d.firstMs)
+			ds[n-1].lastMs = max(ds[n-1].lastMs, d.lastMs)
+			continue
+		}
+		days[threadID] = append(ds, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]ThreadCompleteness, 0, len(byID))
+	for id, c := range byID {
+		scoreCompleteness(c, days[id])
+		out = append(out, *c)
+	}
+	slices.SortFunc(out, func(a, b ThreadCompleteness) int { return cmp.Compare(a.ThreadID, b.ThreadID) })
+	return out, nil
+}
+
+// idsIn is an SQL condition on column being one of ids (nil = any) and its
+// arguments
+func idsIn(column string, ids []int64) (string, []any) {
+	if ids == nil {
+		return "1", nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return column + " IN (?" + strings.Repeat(", ?", len(ids)-1) + ")", args
+}
+
+// scoreCompleteness fills in c from its thread's days with messages, in order
+func scoreCompleteness(c *ThreadCompleteness, days []activeDay) {
+	slices.Sort(c.Sources)
+	c.NeedsImport = !slices.Contains(c.Sources, ProvenanceExport)
+	c.ActiveDays = len(days)
+	if len(days) == 0 {
+		c.Score = 0
+		return
+	}
+	c.FirstMs, c.LastMs = days[0].firstMs, days[len(days)-1].lastMs
+
+	gaps := make([]int64, 0, len(days)-1)
+	for i := 1; i < len(days); i++ {
+		gaps = append(gaps, days[i].day-days[i-1].day)
+	}
+	if len(gaps) > 0 {
+		sorted := slices.Sorted(slices.Values(gaps))
+		mid := len(sorted) / 2
+		c.CadenceDays = float64(sorted[mid])
+		if len(sorted)%2 == 0 {
+			c.CadenceDays = float64(sorted[mid-1]+sorted[mid]) / 2
+		}
+	}
+
+	minHole := max(float64(holeMinDays), holeCadences*c.CadenceDays)
+	for i, gap := range gaps {
+		if float64(gap) < minHole {
+			continue
+		}
+		c.MissingDays += int(gap)
+		c.Holes = append(c.Holes, CompletenessHole{FromMs: days[i].lastMs, ToMs: days[i+1].firstMs, Days: int(gap)})
+	}
+	if len(c.Holes) > maxListedHoles {
+		slices.SortStableFunc(c.Holes, func(a, b CompletenessHole) int { return cmp.Compare(b.Days, a.Days) })
+		c.Holes = c.Holes[:maxListedHoles]
+		slices.SortFunc(c.Holes, func(a, b CompletenessHole) int { return cmp.Compare(a.FromMs, b.FromMs) })
+	}
+
+	endMs := c.LastMs
+	if behind := (c.LastActivityMs - c.LastMs) / dayMs; behind >= behindMinDays {
+		c.BehindDays = int(behind)
+		c.MissingDays += c.BehindDays
+		endMs = c.LastActivityMs
+	}
+
+	spanDays := (endMs-c.FirstMs)/dayMs + 1
+	c.Score = math.Round(100*max(0, 1-float64(c.MissingDays)/float64(spanDays))) / 100
+	c.NeedsImport = c.NeedsImport || len(c.Holes) > 0 || c.BehindDays > 0
+}
@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"cmp"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// StaleContact is a contact that has never sent a message. Most are
+// placeholders created by EnsureContactExists for receipts or reactions.
+type StaleContact struct {
+	ID        int64  `json:"id,string"`
+	Name      string `json:"name"`
+	Threads   int64  `json:"threads"`   // thread_participants rows
+	Reactions int64  `json:"reactions"` // Reactions they left
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Deletable reports whether DeleteStaleContacts removes the contact: their
+// reactions would be lost, so those have to be merged instead
+func (c StaleContact) Deletable() bool {
+	return c.Reactions == 0
+}
+
+// ListStaleContacts returns contacts without messages created before
+// createdBeforeMs, oldest first. The current user is never listed.
+func (s *Storage) ListStaleContacts(createdBeforeMs int64) ([]StaleContact, error) {
+	currentUser, err := s.currentUserID()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT c.id, COALESCE(c.name, ''), c.created_at,
+			(SELECT COUNT(*) FROM thread_participants tp WHERE tp.contact_id = c.id),
+			(SELECT COUNT(*) FROM reactions r WHERE r.actor_id = c.id)
+		FROM contacts c
+		WHERE c.created_at < ? AND c.id != ?
+			AND NOT EXISTS (SELECT 1 FROM messages m WHERE m.sender_id = c.id)
+		ORDER BY c.created_at, c.id
+	`, createdBeforeMs, currentUser)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []StaleContact
+	for rows.Next() {
+		var c StaleContact
+		if err := rows.Scan(&c.ID, &c.Name, &c.CreatedAt, &c.Threads, &c.Reactions); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// DeleteStaleContacts deletes the given contacts along with their thread
+// participation and avatar refresh rows. Contacts that have messages or
+// reactions (or are the current user) are left alone; the number actually
+// deleted is returned.
+func (s *Storage) DeleteStaleContacts(ids []int64) (int64, error) {
+	currentUser, err := s.currentUserID()
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var deleted int64
+	for _, id := range ids {
+		if id == currentUser {
+			continue
+		}
+		var used bool
+		err := tx.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM messages WHERE sender_id = ?)
+				OR EXISTS (SELECT 1 FROM reactions WHERE actor_id = ?)
+		`, id, id).Scan(&used)
+		if err != nil {
+			return 0, err
+		}
+		if used {
+			continue
+		}
+		for _, query := range []string{
+			`DELETE FROM thread_participants WHERE contact_id = ?`,
+			`DELETE FROM avatar_refresh_queue WHERE contact_id = ?`,
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				return 0, err
+			}
+		}
+		res, err := tx.Exec(`DELETE FROM contacts WHERE id = ?`, id)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+	return deleted, tx.Commit()
+}
+
+// MergeContact moves everything that references contact from onto contact
+// into (messages, thread participation, reactions, links), fills profile
+// fields into lacks, and deletes from, recording it as an alias of into.
+// Read and delivery watermarks keep the later value; where both reacted to a
+// message, into's reaction is kept. The moved messages are marked unindexed,
+// since their chunks name the sender.
+func (s *Storage) MergeContact(from, into int64) error {
+	return s.MergeContacts(into, from)
+}
+
+// MergeContacts merges every contact in from into into (see MergeContact),
+// all or none
+func (s *Storage) MergeContacts(into int64, from ...int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range from {
+		if err := mergeContact(tx, id, into); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func mergeContact(tx *sql.Tx, from, into int64) error {
+	if from == into {
+		return fmt.Errorf("cannot merge contact %d into itself", from)
+	}
+	for _, id := range []int64{from, into} {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM contacts WHERE id = ?)`, id).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("contact %d: %w", id, ErrNotFound)
+		}
+	}
+
+	for _, query := range []string{
+		`UPDATE messages SET sender_id = :into, indexed_at = NULL WHERE sender_id = :from`,
+		`UPDATE links SET sender_id = :into WHERE sender_id = :from`,
+		`INSERT INTO thread_participants (thread_id, contact_id, nickname, is_admin, joined_at,
+			read_watermark_ms, read_action_timestamp_ms, delivered_watermark_ms)
+		SELECT thread_id, :into, nickname, is_admin, joined_at,
+			read_watermark_ms, read_action_timestamp_ms, delivered_watermark_ms
+		FROM thread_participants WHERE contact_id = :from
+		ON CONFLICT(thread_id, contact_id) DO UPDATE SET
+			nickname = COALESCE(thread_participants.nickname, excluded.nickname),
+			is_admin = thread_participants.is_admin OR excluded.is_admin,
+			joined_at = COALESCE(thread_participants.joined_at, excluded.joined_at),
+			read_watermark_ms = MAX(COALESCE(thread_participants.read_watermark_ms, 0), COALESCE(excluded.read_watermark_ms, 0)),
+			read_action_timestamp_ms = MAX(COALESCE(thread_participants.read_action_timestamp_ms, 0), COALESCE(excluded.read_action_timestamp_ms, 0)),
+			delivered_watermark_ms = MAX(COALESCE(thread_participants.delivered_watermark_ms, 0), COALESCE(excluded.delivered_watermark_ms, 0))`,
+		`DELETE FROM thread_participants WHERE contact_id = :from`,
+		`UPDATE OR IGNORE reactions SET actor_id = :into WHERE actor_id = :from`,
+		`DELETE FROM reactions WHERE actor_id = :from`,
+		`DELETE FROM avatar_refresh_queue WHERE contact_id = :from`,
+		`UPDATE sync_metadata SET value = CAST(:into AS TEXT), updated_at = ` + nowMsSQL + `
+		WHERE key = 'current_user_id' AND value = CAST(:from AS TEXT)`,
+		`UPDATE contacts SET
+			name = COALESCE(NULLIF(contacts.name, ''), f.name),
+			first_name = COALESCE(NULLIF(contacts.first_name, ''), f.first_name),
+			username = COALESCE(NULLIF(contacts.username, ''), f.username),
+			profile_picture_url = COALESCE(NULLIF(contacts.profile_picture_url, ''), f.profile_picture_url),
+			updated_at = MAX(contacts.updated_at, f.updated_at)
+		FROM (SELECT * FROM contacts WHERE id = :from) AS f
+		WHERE contacts.id = :into`,
+		// Aliases of from (earlier merges) follow it into into
+		`UPDATE contact_aliases SET contact_id = :into WHERE contact_id = :from`,
+		`INSERT INTO contact_aliases (alias_id, contact_id, name, merged_at)
+		SELECT id, :into, NULLIF(name, ''), ` + nowMsSQL + ` FROM contacts WHERE id = :from
+		ON CONFLICT(alias_id) DO UPDATE SET
+			contact_id = excluded.contact_id,
+			name = COALESCE(excluded.name, contact_aliases.name),
+			merged_at = excluded.merged_at`,
+		// into is a contact again if it was once merged away
+		`DELETE FROM contact_aliases WHERE alias_id = :into`,
+		`DELETE FROM contacts WHERE id = :from`,
+	} {
+		if _, err := tx.Exec(query, sql.Named("from", from), sql.Named("into", into)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ContactAlias is a contact ID merged into another
+type ContactAlias struct {
+	AliasID   int64  `json:"alias_id,string"`
+	ContactID int64  `json:"contact_id,string"`
+	Name      string `json:"name"`
+	MergedAt  int64  `json:"merged_at"`
+}
+
+// ResolveContactAlias returns the contact id was merged into, or id itself
+// if it never was
+func (s *Storage) ResolveContactAlias(id int64) (int64, error) {
+	var into int64
+	err := s.q().QueryRow(`SELECT contact_id FROM contact_aliases WHERE alias_id = ?`, id).Scan(&into)
+	if err == sql.ErrNoRows {
+		return id, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return into, nil
+}
+
+// ListContactAliases returns the recorded aliases, newest merge first
+func (s *Storage) ListContactAliases() ([]ContactAlias, error) {
+	rows, err := s.db.Query(`
+		SELECT alias_id, contact_id, COALESCE(name, ''), merged_at
+		FROM contact_aliases
+		ORDER BY merged_at DESC, alias_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ContactAlias
+	for rows.Next() {
+		var a ContactAlias
+		if err := rows.Scan(&a.AliasID, &a.ContactID, &a.Name, &a.MergedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// DuplicateContact is one of several contacts with the same name
+type DuplicateContact struct {
+	ID             int64  `json:"id,string"`
+	Name           string `json:"name"`
+	SyncMessages   int64  `json:"sync_messages"`
+	ExportMessages int64  `json:"export_messages"`
+}
+
+// ListDuplicateContacts groups contacts whose names match ignoring case and
+// spacing, typically someone imported from an export under a name-hash ID
+// and synced under their real one. Each group starts with the contact to
+// merge the others into: the one with the most synced messages (live sync
+// keeps using its ID), then the most messages. Groups with the most messages
+// come first.
+func (s *Storage) ListDuplicateContacts() ([][]DuplicateContact, error) {
+	rows, err := s.db.Query(`
+		SELECT c.id, c.name,
+			COALESCE(SUM(CASE WHEN m.id IS NULL THEN 0 WHEN ` + sourceSQL + ` = 'live' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN m.id IS NULL THEN 0 WHEN ` + sourceSQL + ` = 'export' THEN 1 ELSE 0 END), 0)
+		FROM contacts c
+		LEFT JOIN messages m ON m.sender_id = c.id
+		WHERE c.name IS NOT NULL AND TRIM(c.name) != ''
+		GROUP BY c.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byName := make(map[string][]DuplicateContact)
+	for rows.Next() {
+		var c DuplicateContact
+		if err := rows.Scan(&c.ID, &c.Name, &c.SyncMessages, &c.ExportMessages); err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(strings.Join(strings.Fields(c.Name), " "))
+		byName[key] = append(byName[key], c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	total := func(group []DuplicateContact) (n int64) {
+		for _, c := range group {
+			n += c.SyncMessages + c.ExportMessages
+		}
+		return n
+	}
+	var groups [][]DuplicateContact
+	for _, group := range byName {
+		if len(group) < 2 {
+			continue
+		}
+		slices.SortFunc(group, func(a, b DuplicateContact) int {
+			return cmp.Or(
+				cmp.Compare(b.SyncMessages, a.SyncMessages),
+				cmp.Compare(b.SyncMessages+b.ExportMessages, a.SyncMessages+a.ExportMessages),
+				cmp.Compare(a.ID, b.ID),
+			)
+		})
+		groups = append(groups, group)
+	}
+	slices.SortFunc(groups, func(a, b []DuplicateContact) int {
+		return cmp.Or(cmp.Compare(total(b), total(a)), cmp.Compare(a[0].ID, b[0].ID))
+	})
+	return groups, nil
+}
+
+// currentUserID returns the account's own contact ID, or 0 if unknown
+func (s *Storage) currentUserID() (int64, error) {
+	value, err := s.GetSyncMetadata("current_user_id")
+	if err != nil || value == "" {
+		return 0, err
+	}
+	id, _ := strconv.ParseInt(value, 10, 64)
+	return id, nil
+}
@@ -1,12 +1,17 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 
 	"github.com/google/uuid"
 )
 
+// e2eeTablePrefix is the prefix of all tables created by the whatsmeow sqlstore
+const e2eeTablePrefix = "whatsmeow_"
+
 // E2EEMetadata stores E2EE-related metadata in our sync_metadata table
 type E2EEMetadata struct {
 	DeviceID     uint16
@@ -67,3 +72,130 @@ func (s *Storage) GetE2EEMetadata() (*E2EEMetadata, error) {
 func (s *Storage) GetDB() *sql.DB {
 	return s.db
 }
+
+// OpenE2EEDB opens a separate database file for the whatsmeow E2EE store.
+// Keeping the frequent key writes out of the main database avoids contention
+// with chunking/indexing readers.
+func OpenE2EEDB(path string) (*sql.DB, error) {
+	db, err := sql.Open(Driver("sqlite3"), path+"?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open E2EE database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open E2EE database: %w", err)
+	}
+	return db, nil
+}
+
+// HasE2EETables reports whether the main database still contains whatsmeow tables
+func (s *Storage) HasE2EETables() (bool, error) {
+	tables, err := listTables(s.db, "main", e2eeTablePrefix)
+	return len(tables) > 0, err
+}
+
+// MoveE2EETables copies the whatsmeow tables from the main database into the
+// database at dstPath and drops them from the main database. The destination
+// schema must already exist (run the sqlstore upgrade on it first); only
+// columns present on both sides are copied. Returns the number of tables moved.
+func (s *Storage) MoveE2EETables(ctx context.Context, dstPath string) (int, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// Foreign keys can't be toggled inside a transaction, and the copy order
+	// doesn't follow the whatsmeow FK graph
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return 0, err
+	}
+	defer conn.ExecContext(context.Background(), `PRAGMA foreign_keys = ON`)
+
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS e2ee`, dstPath); err != nil {
+		return 0, fmt.Errorf("failed to attach E2EE database: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `DETACH DATABASE e2ee`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	tables, err := listTables(tx, "main", e2eeTablePrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, table := range tables {
+		// The destination keeps its own schema version
+		if table != e2eeTablePrefix+"version" {
+			cols, err := commonColumns(tx, table)
+			if err != nil {
+				return moved, err
+			}
+			if len(cols) == 0 {
+				return moved, fmt.Errorf("table %s missing from E2EE database (run the store upgrade first)", table)
+			}
+			colList := strings.Join(cols, ", ")
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+				`INSERT OR REPLACE INTO e2ee.%s (%s) SELECT %s FROM main.%s`, table, colList, colList, table,
+			)); err != nil {
+				return moved, fmt.Errorf("failed to copy %s: %w", table, err)
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DROP TABLE main.%s`, table)); err != nil {
+			return moved, fmt.Errorf("failed to drop %s: %w", table, err)
+		}
+		moved++
+	}
+
+	return moved, tx.Commit()
+}
+
+// listTables returns the tables of schema whose name starts with prefix
+func listTables(q querier, schema, prefix string) ([]string, error) {
+	rows, err := q.Query(fmt.Sprintf(
+		`SELECT name FROM %s.sqlite_master WHERE type = 'table' AND substr(name, 1, ?) = ?`, schema,
+	), len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		out = append(out, name)
+	}
+	return out, rows.Err()
+}
+
+// commonColumns returns the (quoted) columns of table present in both main and e2ee
+func commonColumns(q querier, table string) ([]string, error) {
+	rows, err := q.Query(`
+		SELECT m.name FROM pragma_table_info(?, 'main') m
+		JOIN pragma_table_info(?, 'e2ee') e ON e.name = m.name
+		ORDER BY m.cid
+	`, table, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		out = append(out, `"`+strings.ReplaceAll(name, `"`, `""`)+`"`)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Sentinel errors returned by storage operations; test with errors.Is
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrBadRequest = errors.New("bad request")
+	// ErrSchemaBehind is returned by OpenExisting for a database with
+	// pending migrations
+	ErrSchemaBehind = errors.New("database schema is behind")
+)
+
+// inputError is a validation failure whose message is safe to show to clients
+type inputError struct{ msg string }
+
+func (e *inputError) Error() string { return e.msg }
+func (e *inputError) Unwrap() error { return ErrBadRequest }
+
+// classifySQLiteError maps constraint violations onto the sentinel errors.
+// Foreign key failures mean a referenced row is missing; unique/primary key
+// failures mean the row already exists.
+func classifySQLiteError(err error) error {
+	var se sqlite3.Error
+	if !errors.As(err, &se) || se.Code != sqlite3.ErrConstraint {
+		return err
+	}
+	switch se.ExtendedCode {
+	case sqlite3.ErrConstraintForeignKey:
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		return fmt.Errorf("%w: %w", ErrConflict, err)
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ImportCheckpoint records a conversation an export import has stored
+type ImportCheckpoint struct {
+	Imported int
+	Skipped  int
+}
+
+// GetImportCheckpoint returns the checkpoint of a conversation of an import,
+// and whether there is one
+func (s *Storage) GetImportCheckpoint(importKey, conversation string) (ImportCheckpoint, bool, error) {
+	var cp ImportCheckpoint
+	err := s.q().QueryRow(`
+		SELECT imported, skipped FROM import_checkpoints WHERE import_key = ? AND conversation = ?
+	`, importKey, conversation).Scan(&cp.Imported, &cp.Skipped)
+	if err == sql.ErrNoRows {
+		return cp, false, nil
+	} else if err != nil {
+		return cp, false, err
+	}
+	return cp, true, nil
+}
+
+// SetImportCheckpoint records that a conversation of an import is stored.
+// Called on the Storage returned by Begin, it commits with the conversation.
+func (s *Storage) SetImportCheckpoint(importKey, conversation string, cp ImportCheckpoint) error {
+	_, err := s.q().Exec(`
+		INSERT INTO import_checkpoints (import_key, conversation, imported, skipped, completed_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(import_key, conversation) DO UPDATE SET
+			imported = excluded.imported,
+			skipped = excluded.skipped,
+			completed_at = excluded.completed_at
+	`, importKey, conversation, cp.Imported, cp.Skipped, time.Now().UnixMilli())
+	return err
+}
+
+// CountImportCheckpoints counts the conversations recorded for an import
+func (s *Storage) CountImportCheckpoints(importKey string) (int, error) {
+	var n int
+	err := s.q().QueryRow(`SELECT COUNT(*) FROM import_checkpoints WHERE import_key = ?`, importKey).Scan(&n)
+	return n, err
+}
+
+// ClearImportCheckpoints removes the checkpoints of a completed import
+func (s *Storage) ClearImportCheckpoints(importKey string) error {
+	_, err := s.q().Exec(`DELETE FROM import_checkpoints WHERE import_key = ?`, importKey)
+	return err
+}
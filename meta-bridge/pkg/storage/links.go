@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// linkRe finds URLs in message text: http(s) links and bare www. hosts
+var linkRe = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// linksCursorKey is the sync_metadata key holding the last messages rowid
+// IndexLinks has looked at
+const linksCursorKey = "links_indexed_rowid"
+
+// Link is a URL found in a message
+type Link struct {
+	URL         string `json:"url"`
+	Domain      string `json:"domain"`
+	MessageID   string `json:"message_id"`
+	ThreadID    int64  `json:"thread_id,string"`
+	ThreadName  string `json:"thread_name"`
+	SenderID    int64  `json:"sender_id,string"`
+	SenderName  string `json:"sender_name"`
+	TimestampMs int64  `json:"timestamp_ms"`
+	Text        string `json:"text"` // The whole message
+}
+
+// DomainCount is a domain with the number of links to it
+type DomainCount struct {
+	Domain string `json:"domain"`
+	Links  int64  `json:"links"`
+}
+
+// LinkFilter selects links. Domain also matches its subdomains; Query is a
+// case-insensitive substring of the URL or the message text.
+type LinkFilter struct {
+	Domain   string
+	Query    string
+	ThreadID int64
+	AfterMs  int64 // Inclusive; 0 = unbounded
+	BeforeMs int64 // Exclusive; 0 = unbounded
+}
+
+// ExtractLinks returns the distinct URLs in text with their domains, in
+// order of appearance. Trailing punctuation is left out, and so is a closing
+// parenthesis the URL doesn't open.
+func ExtractLinks(text string) (urls, domains []string) {
+	seen := make(map[string]bool)
+	for _, u := range linkRe.FindAllString(text, -1) {
+		u = trimLinkPunctuation(u)
+		domain := LinkDomain(u)
+		if domain == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		urls = append(urls, u)
+		domains = append(domains, domain)
+	}
+	return urls, domains
+}
+
+func trimLinkPunctuation(u string) string {
+	for len(u) > 0 {
+		last := u[len(u)-1]
+		switch {
+		case strings.IndexByte(".,;:!?'*", last) >= 0:
+		case last == ')' && strings.Count(u, "(") < strings.Count(u, ")"):
+		case last == ']' && strings.Count(u, "[") < strings.Count(u, "]"):
+		default:
+			return u
+		}
+		u = u[:len(u)-1]
+	}
+	return u
+}
+
+// LinkDomain is the lowercase host of a URL without "www." and the port, or
+// "" if it has none that looks like a domain or an IP address
+func LinkDomain(rawURL string) string {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if !strings.Contains(host, ".") && net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// NormalizeDomain turns a domain filter into the form links are stored
+// with, accepting a pasted URL too
+func NormalizeDomain(domain string) string {
+	domain = strings.TrimSpace(domain)
+	if d := LinkDomain(domain); d != "" {
+		return d
+	}
+	return strings.TrimPrefix(strings.ToLower(domain), "www.")
+}
+
+// hasLinkCandidate is a cheap check for text that may hold a link, matching
+// the LIKE filter of IndexLinks
+func hasLinkCandidate(text string) bool {
+	lower := strings.ToLower(text)
+	return strings.Contains(lower, "http") || strings.Contains(lower, "www.")
+}
+
+// linkExecer is what indexMessageLinks writes through: the database or a
+// transaction
+type linkExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// indexMessageLinks replaces the links of a message with those in its
+// current text, so edits and unsends update them
+func indexMessageLinks(db linkExecer, messageID string) error {
+	if _, err := db.Exec(`DELETE FROM links WHERE message_id = ?`, messageID); err != nil {
+		return fmt.Errorf("clearing links of %s: %w", messageID, err)
+	}
+	var threadID, senderID, timestampMs int64
+	var text sql.NullString
+	err := db.QueryRow(`SELECT thread_id, COALESCE(sender_id, 0), timestamp_ms, text FROM messages WHERE id = ?`, messageID).
+		Scan(&threadID, &senderID, &timestampMs, &text)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading message %s: %w", messageID, err)
+	}
+	urls, domains := ExtractLinks(text.String)
+	for i, u := range urls {
+		if _, err := db.Exec(`
+			INSERT OR IGNORE INTO links (message_id, url, domain, thread_id, sender_id, timestamp_ms)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, messageID, u, domains[i], threadID, nullIfZero(senderID), timestampMs); err != nil {
+			return fmt.Errorf("storing link of %s: %w", messageID, err)
+		}
+	}
+	return nil
+}
+
+// IndexLinks extracts the links of messages stored since its last run,
+// including ones written without Storage (imports that insert directly).
+// Storage's own message writes keep links current as they happen; this
+// catches up the rest and fills the table for databases that predate it.
+// It returns how many messages with a link candidate were indexed.
+func (s *Storage) IndexLinks() (int, error) {
+	cursor, err := s.GetSyncMetadata(linksCursorKey)
+	if err != nil {
+		return 0, err
+	}
+	after, _ := strconv.ParseInt(cursor, 10, 64)
+	var upTo int64
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(rowid), 0) FROM messages`).Scan(&upTo); err != nil {
+		return 0, err
+	}
+	if upTo <= after {
+		return 0, nil
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id FROM messages
+		WHERE rowid > ? AND rowid <= ? AND (text LIKE '%http%' OR text LIKE '%www.%')
+	`, after, upTo)
+	if err != nil {
+		return 0, fmt.Errorf("listing messages with links: %w", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, id := range ids {
+		if err := indexMessageLinks(tx, id); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(ids), s.SetSyncMetadata(linksCursorKey, strconv.FormatInt(upTo, 10))
+}
+
+// linkFilterSQL is the WHERE clause (on links l joined to messages m) and
+// arguments of a filter; withDomain false leaves the domain out, for facets
+func linkFilterSQL(f LinkFilter, withDomain bool) (string, []any) {
+	conds := []string{"1 = 1"}
+	var args []any
+	if domain := NormalizeDomain(f.Domain); withDomain && domain != "" {
+		conds = append(conds, `(l.domain = ? OR l.domain LIKE ? ESCAPE '\')`)
+		args = append(args, domain, "%."+escapeLike(domain))
+	}
+	if q := strings.TrimSpace(f.Query); q != "" {
+		conds = append(conds, `(l.url LIKE ? ESCAPE '\' OR m.text LIKE ? ESCAPE '\')`)
+		pattern := "%" + escapeLike(q) + "%"
+		args = append(args, pattern, pattern)
+	}
+	if f.ThreadID != 0 {
+		conds = append(conds, "l.thread_id = ?")
+		args = append(args, f.ThreadID)
+	}
+	if f.AfterMs != 0 {
+		conds = append(conds, "l.timestamp_ms >= ?")
+		args = append(args, f.AfterMs)
+	}
+	if f.BeforeMs != 0 {
+		conds = append(conds, "l.timestamp_ms < ?")
+		args = append(args, f.BeforeMs)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ListLinks returns the links matching f, newest first, and how many match
+// in total
+func ListLinks(db *sql.DB, f LinkFilter, limit, offset int) ([]Link, int64, error) {
+	where, args := linkFilterSQL(f, true)
+
+	var total int64
+	if err := db.QueryRow(`
+		SELECT COUNT(*) FROM links l JOIN messages m ON m.id = l.message_id
+		WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(`
+		SELECT l.url, l.domain, l.message_id, l.thread_id, COALESCE(t.name, ''),
+			COALESCE(l.sender_id, 0), COALESCE(c.name, ''), l.timestamp_ms, COALESCE(m.text, '')
+		FROM links l
+		JOIN messages m ON m.id = l.message_id
+		LEFT JOIN thread_names t ON t.thread_id = l.thread_id
+		LEFT JOIN contacts c ON c.id = l.sender_id
+		WHERE `+where+`
+		ORDER BY l.timestamp_ms DESC, l.message_id, l.url
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	links := []Link{}
+	for rows.Next() {
+		var l Link
+		if err := rows.Scan(&l.URL, &l.Domain, &l.MessageID, &l.ThreadID, &l.ThreadName,
+			&l.SenderID, &l.SenderName, &l.TimestampMs, &l.Text); err != nil {
+			return nil, 0, err
+		}
+		links = append(links, l)
+	}
+	return links, total, rows.Err()
+}
+
+// LinkDomains counts the links matching f per domain, ignoring f.Domain so
+// the counts work as facets next to a domain-filtered list. The limit most
+// linked domains are returned.
+func LinkDomains(db *sql.DB, f LinkFilter, limit int) ([]DomainCount, error) {
+	where, args := linkFilterSQL(f, false)
+	join := ""
+	if strings.TrimSpace(f.Query) != "" {
+		join = "JOIN messages m ON m.id = l.message_id"
+	}
+	rows, err := db.Query(`
+		SELECT l.domain, COUNT(*) FROM links l `+join+`
+		WHERE `+where+`
+		GROUP BY l.domain
+		ORDER BY COUNT(*) DESC, l.domain
+		LIMIT ?
+	`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []DomainCount{}
+	for rows.Next() {
+		var dc DomainCount
+		if err := rows.Scan(&dc.Domain, &dc.Links); err != nil {
+			return nil, err
+		}
+		out = append(out, dc)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+)
+
+// messageIDBatch caps the message IDs bound in one IN (...) query, well
+// under SQLite's variable limit
+const messageIDBatch = 500
+
+// MessageAttachment is an attachment listed with its message
+type MessageAttachment struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"` // See AttachmentKind
+	Filename string `json:"filename,omitempty"`
+	MimeType string `json:"mime_type,omitempty"`
+	// URL is where the attachment was fetched from (CDN URLs expire) or,
+	// for imported links, the shared URL
+	URL        string `json:"url,omitempty"`
+	FileSize   int64  `json:"file_size,omitempty"`
+	Width      int64  `json:"width,omitempty"`
+	Height     int64  `json:"height,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	// LocalPath is the downloaded file, relative to media.attachments_dir;
+	// empty until media-sync fetched it
+	LocalPath string `json:"local_path,omitempty"`
+}
+
+// MessageReaction is a reaction listed with its message
+type MessageReaction struct {
+	ActorID     int64  `json:"actor_id,string"`
+	ActorName   string `json:"actor_name"`
+	Reaction    string `json:"reaction"`
+	TimestampMs int64  `json:"timestamp_ms"`
+}
+
+// AttachmentKind names an attachment type the way chunk placeholders and
+// share bundles do: sticker, photo, gif, video, audio, link or file
+func AttachmentKind(t table.AttachmentType) string {
+	switch t {
+	case table.AttachmentTypeSticker, table.AttachmentTypeSelfieSticker, table.AttachmentTypeThirdPartySticker:
+		return "sticker"
+	case table.AttachmentTypeImage, table.AttachmentTypeEphemeralImage:
+		return "photo"
+	case table.AttachmentTypeAnimatedImage:
+		return "gif"
+	case table.AttachmentTypeVideo, table.AttachmentTypeEphemeralVideo:
+		return "video"
+	case table.AttachmentTypeAudio, table.AttachmentTypeSoundBite:
+		return "audio"
+	case table.AttachmentTypeXMA:
+		return "link"
+	default:
+		return "file"
+	}
+}
+
+// ListMessageAttachments returns the attachments of the given messages, by
+// message ID, in the order they were stored
+func ListMessageAttachments(db *sql.DB, messageIDs []string) (map[string][]MessageAttachment, error) {
+	out := make(map[string][]MessageAttachment)
+	err := forMessageIDBatches(messageIDs, func(in string, args []any) error {
+		rows, err := db.Query(`
+			SELECT message_id, id, attachment_type, COALESCE(filename, ''), COALESCE(mime_type, ''),
+				COALESCE(url, ''), COALESCE(file_size, 0), COALESCE(width, 0), COALESCE(height, 0),
+				COALESCE(duration_ms, 0), COALESCE(local_path, '')
+			FROM attachments
+			WHERE message_id IN (`+in+`)
+			ORDER BY rowid
+		`, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var messageID string
+			var kind int64
+			var a MessageAttachment
+			if err := rows.Scan(&messageID, &a.ID, &kind, &a.Filename, &a.MimeType, &a.URL,
+				&a.FileSize, &a.Width, &a.Height, &a.DurationMs, &a.LocalPath); err != nil {
+				return err
+			}
+			a.Type = AttachmentKind(table.AttachmentType(kind))
+			out[messageID] = append(out[messageID], a)
+		}
+		return rows.Err()
+	})
+	return out, err
+}
+
+// ListMessageReactions returns the reactions to the given messages, by
+// message ID, oldest first
+func ListMessageReactions(db *sql.DB, messageIDs []string) (map[string][]MessageReaction, error) {
+	out := make(map[string][]MessageReaction)
+	err := forMessageIDBatches(messageIDs, func(in string, args []any) error {
+		rows, err := db.Query(`
+			SELECT r.message_id, r.actor_id, COALESCE(c.name, ''), r.reaction, r.timestamp_ms
+			FROM reactions r
+			LEFT JOIN contacts c ON c.id = r.actor_id
+			WHERE r.message_id IN (`+in+`)
+			ORDER BY r.timestamp_ms, r.actor_id
+		`, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var messageID string
+			var r MessageReaction
+			if err := rows.Scan(&messageID, &r.ActorID, &r.ActorName, &r.Reaction, &r.TimestampMs); err != nil {
+				return err
+			}
+			out[messageID] = append(out[messageID], r)
+		}
+		return rows.Err()
+	})
+	return out, err
+}
+
+// forMessageIDBatches calls query with the placeholders and arguments of
+// each batch of up to messageIDBatch IDs
+func forMessageIDBatches(ids []string, query func(in string, args []any) error) error {
+	for start := 0; start < len(ids); start += messageIDBatch {
+		batch := ids[start:min(start+messageIDBatch, len(ids))]
+		args := make([]any, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		if err := query("?"+strings.Repeat(", ?", len(batch)-1), args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
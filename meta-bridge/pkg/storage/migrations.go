@@ -0,0 +1,684 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migration is a versioned schema change. Up and Down run in one transaction
+// each; a nil Down marks the migration irreversible.
+//
+// Fresh databases get the current schema directly and are baselined (all
+// migrations recorded as applied without running), so migrations only run on
+// databases created before them and may assume the tables they touch exist.
+type migration struct {
+	Version     int
+	Description string
+	Up          []string
+	Down        []string
+}
+
+// checksum identifies the migration's SQL; applied migrations whose code
+// changes afterwards fail verification
+func (m migration) checksum() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n", m.Version, m.Description)
+	for _, stmt := range m.Up {
+		fmt.Fprintf(h, "up:%s\n", strings.TrimSpace(stmt))
+	}
+	for _, stmt := range m.Down {
+		fmt.Fprintf(h, "down:%s\n", strings.TrimSpace(stmt))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// migrations in version order
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "messages.indexed_at for vector indexing state",
+		Up: []string{
+			`ALTER TABLE messages ADD COLUMN indexed_at INTEGER;`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_indexed_at ON messages(indexed_at);`,
+		},
+		Down: []string{
+			`DROP INDEX IF EXISTS idx_messages_indexed_at;`,
+			`ALTER TABLE messages DROP COLUMN indexed_at;`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "drop unused index on message text",
+		Up: []string{
+			`DROP INDEX IF EXISTS idx_messages_text;`,
+		},
+		Down: []string{
+			`CREATE INDEX IF NOT EXISTS idx_messages_text ON messages(text);`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "per-participant read and delivery watermarks",
+		Up: []string{
+			`ALTER TABLE thread_participants ADD COLUMN read_watermark_ms INTEGER;`,
+			`ALTER TABLE thread_participants ADD COLUMN read_action_timestamp_ms INTEGER;`,
+			`ALTER TABLE thread_participants ADD COLUMN delivered_watermark_ms INTEGER;`,
+		},
+		Down: []string{
+			`ALTER TABLE thread_participants DROP COLUMN delivered_watermark_ms;`,
+			`ALTER TABLE thread_participants DROP COLUMN read_action_timestamp_ms;`,
+			`ALTER TABLE thread_participants DROP COLUMN read_watermark_ms;`,
+		},
+	},
+	{
+		// The FTS table is derived from messages, so reverting just drops it
+		// and re-applying rebuilds it
+		Version:     4,
+		Description: "rebuild messages_fts as FTS4 with rowid-keyed triggers",
+		Up: []string{
+			`DROP TRIGGER IF EXISTS messages_ai;`,
+			`DROP TRIGGER IF EXISTS messages_ad;`,
+			`DROP TRIGGER IF EXISTS messages_au;`,
+			`DROP TABLE IF EXISTS messages_fts;`,
+			`CREATE VIRTUAL TABLE messages_fts USING fts4(
+				text,
+				tokenize=unicode61
+			);`,
+			`CREATE TRIGGER messages_ai AFTER INSERT ON messages BEGIN
+				INSERT INTO messages_fts(docid, text)
+				SELECT NEW.rowid, NEW.text
+				WHERE NEW.text IS NOT NULL AND NEW.text != '';
+			END;`,
+			`CREATE TRIGGER messages_ad AFTER DELETE ON messages BEGIN
+				DELETE FROM messages_fts WHERE docid = OLD.rowid;
+			END;`,
+			`CREATE TRIGGER messages_au AFTER UPDATE ON messages BEGIN
+				DELETE FROM messages_fts WHERE docid = OLD.rowid;
+				INSERT INTO messages_fts(docid, text)
+				SELECT NEW.rowid, NEW.text
+				WHERE NEW.text IS NOT NULL AND NEW.text != '';
+			END;`,
+			`INSERT INTO messages_fts(docid, text)
+			 SELECT rowid, text FROM messages
+			 WHERE text IS NOT NULL AND text != '';`,
+		},
+		Down: []string{
+			`DROP TRIGGER IF EXISTS messages_ai;`,
+			`DROP TRIGGER IF EXISTS messages_ad;`,
+			`DROP TRIGGER IF EXISTS messages_au;`,
+			`DROP TABLE IF EXISTS messages_fts;`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "attachments download state and E2EE media keys",
+		Up: []string{
+			`ALTER TABLE attachments ADD COLUMN local_path TEXT;`,
+			`ALTER TABLE attachments ADD COLUMN content_sha256 TEXT;`,
+			`ALTER TABLE attachments ADD COLUMN downloaded_at INTEGER;`,
+			`ALTER TABLE attachments ADD COLUMN download_error TEXT;`,
+			`ALTER TABLE attachments ADD COLUMN e2ee_media BLOB;`,
+			`ALTER TABLE attachments ADD COLUMN e2ee_media_type TEXT;`,
+		},
+		Down: []string{
+			`ALTER TABLE attachments DROP COLUMN e2ee_media_type;`,
+			`ALTER TABLE attachments DROP COLUMN e2ee_media;`,
+			`ALTER TABLE attachments DROP COLUMN download_error;`,
+			`ALTER TABLE attachments DROP COLUMN downloaded_at;`,
+			`ALTER TABLE attachments DROP COLUMN content_sha256;`,
+			`ALTER TABLE attachments DROP COLUMN local_path;`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "attachment_transcripts for voice messages",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS attachment_transcripts (
+				attachment_id TEXT PRIMARY KEY,
+				message_id TEXT NOT NULL,
+				text TEXT NOT NULL DEFAULT '',
+				language TEXT,
+				model TEXT,
+				error TEXT,
+				created_at INTEGER NOT NULL,
+				FOREIGN KEY (attachment_id) REFERENCES attachments(id)
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_attachment_transcripts_message_id ON attachment_transcripts(message_id);`,
+		},
+		Down: []string{
+			`DROP INDEX IF EXISTS idx_attachment_transcripts_message_id;`,
+			`DROP TABLE IF EXISTS attachment_transcripts;`,
+		},
+	},
+	{
+		Version:     7,
+		Description: "attachment_captions for image OCR and captions",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS attachment_captions (
+				attachment_id TEXT PRIMARY KEY,
+				message_id TEXT NOT NULL,
+				text TEXT NOT NULL DEFAULT '',
+				model TEXT,
+				error TEXT,
+				created_at INTEGER NOT NULL,
+				FOREIGN KEY (attachment_id) REFERENCES attachments(id)
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_attachment_captions_message_id ON attachment_captions(message_id);`,
+		},
+		Down: []string{
+			`DROP INDEX IF EXISTS idx_attachment_captions_message_id;`,
+			`DROP TABLE IF EXISTS attachment_captions;`,
+		},
+	},
+	{
+		Version:     8,
+		Description: "chunk_retrievals for search hit tracking",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS chunk_retrievals (
+				chunk_id TEXT PRIMARY KEY,
+				first_retrieved_at INTEGER NOT NULL,
+				last_retrieved_at INTEGER NOT NULL,
+				retrieval_count INTEGER NOT NULL DEFAULT 0
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_chunk_retrievals_last ON chunk_retrievals(last_retrieved_at);`,
+		},
+		Down: []string{
+			`DROP INDEX IF EXISTS idx_chunk_retrievals_last;`,
+			`DROP TABLE IF EXISTS chunk_retrievals;`,
+		},
+	},
+	{
+		Version:     9,
+		Description: "summaries for LLM session and thread summaries",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS summaries (
+				summary_id TEXT PRIMARY KEY,
+				thread_id INTEGER NOT NULL,
+				session_idx INTEGER NOT NULL,
+				text TEXT NOT NULL,
+				model TEXT NOT NULL,
+				source_hash TEXT NOT NULL,
+				start_timestamp_ms INTEGER NOT NULL,
+				end_timestamp_ms INTEGER NOT NULL,
+				created_at INTEGER NOT NULL,
+				milvus_synced INTEGER NOT NULL DEFAULT 0,
+				UNIQUE (thread_id, session_idx)
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_summaries_unsynced ON summaries(milvus_synced);`,
+		},
+		Down: []string{
+			`DROP INDEX IF EXISTS idx_summaries_unsynced;`,
+			`DROP TABLE IF EXISTS summaries;`,
+		},
+	},
+	{
+		Version:     10,
+		Description: "links extracted from message text",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS links (
+				message_id TEXT NOT NULL,
+				url TEXT NOT NULL,
+				domain TEXT NOT NULL,
+				thread_id INTEGER NOT NULL,
+				sender_id INTEGER,
+				timestamp_ms INTEGER NOT NULL,
+				PRIMARY KEY (message_id, url)
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_links_domain ON links(domain, timestamp_ms);`,
+			`CREATE INDEX IF NOT EXISTS idx_links_timestamp ON links(timestamp_ms);`,
+		},
+		Down: []string{
+			`DROP INDEX IF EXISTS idx_links_timestamp;`,
+			`DROP INDEX IF EXISTS idx_links_domain;`,
+			`DROP TABLE IF EXISTS links;`,
+		},
+	},
+	{
+		Version:     11,
+		Description: "thread display names for unnamed 1:1 threads",
+		Up: []string{
+			`CREATE VIEW IF NOT EXISTS thread_names AS
+				SELECT th.id AS thread_id, COALESCE(
+					NULLIF(th.name, ''),
+					CASE WHEN th.thread_type IN (1, 7, 10, 13, 15, 201) THEN COALESCE(
+						(SELECT NULLIF(name, '') FROM contacts WHERE id = th.id),
+						(SELECT NULLIF(nickname, '') FROM thread_participants WHERE thread_id = th.id AND contact_id = th.id),
+						(SELECT COALESCE(NULLIF(c.name, ''), NULLIF(tp.nickname, ''))
+						 FROM thread_participants tp
+						 LEFT JOIN contacts c ON c.id = tp.contact_id
+						 WHERE tp.thread_id = th.id
+						   AND tp.contact_id != COALESCE((SELECT CAST(value AS INTEGER) FROM sync_metadata WHERE key = 'current_user_id'), 0)
+						   AND COALESCE(NULLIF(c.name, ''), NULLIF(tp.nickname, '')) IS NOT NULL
+						 ORDER BY tp.contact_id
+						 LIMIT 1)
+					) END,
+					'') AS name
+				FROM threads th;`,
+		},
+		Down: []string{
+			`DROP VIEW IF EXISTS thread_names;`,
+		},
+	},
+	{
+		Version:     12,
+		Description: "contact aliases recorded by contact merges",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS contact_aliases (
+				alias_id INTEGER PRIMARY KEY,
+				contact_id INTEGER NOT NULL,
+				name TEXT,
+				merged_at INTEGER NOT NULL
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_contact_aliases_contact ON contact_aliases(contact_id);`,
+		},
+		Down: []string{
+			`DROP INDEX IF EXISTS idx_contact_aliases_contact;`,
+			`DROP TABLE IF EXISTS contact_aliases;`,
+		},
+	},
+	{
+		Version:     13,
+		Description: "thread aliases recorded by thread merges",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS thread_aliases (
+				alias_id INTEGER PRIMARY KEY,
+				thread_id INTEGER NOT NULL,
+				name TEXT,
+				merged_at INTEGER NOT NULL
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_thread_aliases_thread ON thread_aliases(thread_id);`,
+		},
+		Down: []string{
+			`DROP INDEX IF EXISTS idx_thread_aliases_thread;`,
+			`DROP TABLE IF EXISTS thread_aliases;`,
+		},
+	},
+	{
+		Version:     14,
+		Description: "messages.source provenance",
+		Up: []string{
+			`ALTER TABLE messages ADD COLUMN source TEXT NOT NULL DEFAULT 'live';`,
+			// Imports so far didn't record their platform
+			`UPDATE messages SET source = 'export' WHERE length(id) = 32 AND id NOT GLOB '*[^0-9a-f]*';`,
+		},
+		Down: []string{
+			`ALTER TABLE messages DROP COLUMN source;`,
+		},
+	},
+	{
+		Version:     15,
+		Description: "import checkpoints for resumable export imports",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS import_checkpoints (
+				import_key TEXT NOT NULL,
+				conversation TEXT NOT NULL,
+				imported INTEGER NOT NULL,
+				skipped INTEGER NOT NULL,
+				completed_at INTEGER NOT NULL,
+				PRIMARY KEY (import_key, conversation)
+			);`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS import_checkpoints;`,
+		},
+	},
+	{
+		Version:     16,
+		Description: "change feed delete triggers for threads and attachments",
+		Up: []string{
+			`CREATE TRIGGER IF NOT EXISTS changes_threads_ad AFTER DELETE ON threads BEGIN
+				INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+				VALUES ('thread', OLD.id, OLD.id, 'delete', ` + nowMsSQL + `);
+			END;`,
+			`CREATE TRIGGER IF NOT EXISTS changes_attachments_ad AFTER DELETE ON attachments BEGIN
+				INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+				VALUES ('attachment', OLD.id, (SELECT thread_id FROM messages WHERE id = OLD.message_id), 'delete', ` + nowMsSQL + `);
+			END;`,
+		},
+		Down: []string{
+			`DROP TRIGGER IF EXISTS changes_attachments_ad;`,
+			`DROP TRIGGER IF EXISTS changes_threads_ad;`,
+		},
+	},
+}
+
+const migrationsTableSQL = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    description TEXT NOT NULL,
+    checksum TEXT NOT NULL,
+    applied_at INTEGER NOT NULL
+);
+`
+
+// LatestSchemaVersion is the version of the newest migration
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// MigrationStatus is the state of one migration in a database
+type MigrationStatus struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	Applied     bool   `json:"applied"`
+	AppliedAt   int64  `json:"applied_at,omitempty"` // Unix ms
+	Reversible  bool   `json:"reversible"`
+	// Modified is set when the applied migration's checksum doesn't match
+	// the code
+	Modified bool `json:"modified,omitempty"`
+}
+
+type appliedMigration struct {
+	checksum  string
+	appliedAt int64
+}
+
+// prepareMigrations creates the tracking table and, on first use, records
+// the existing state: a database at the legacy sync_metadata.schema_version
+// gets those migrations marked applied, and a database without any tables
+// yet (fresh is true) is baselined at the latest version by the caller.
+func prepareMigrations(db *sql.DB) (fresh bool, err error) {
+	var tables int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'messages'`).Scan(&tables); err != nil {
+		return false, fmt.Errorf("inspecting schema: %w", err)
+	}
+	if _, err := db.Exec(migrationsTableSQL); err != nil {
+		return false, fmt.Errorf("creating schema_migrations: %w", err)
+	}
+	if tables == 0 {
+		return true, nil
+	}
+
+	applied, err := loadAppliedMigrations(db)
+	if err != nil || len(applied) > 0 {
+		return false, err
+	}
+	legacy, err := legacySchemaVersion(db)
+	if err != nil || legacy == 0 {
+		return false, err
+	}
+	return false, recordMigrations(db, legacy)
+}
+
+// legacySchemaVersion reads the version tracked in sync_metadata before
+// schema_migrations existed (0 if none)
+func legacySchemaVersion(db *sql.DB) (int, error) {
+	var value string
+	err := db.QueryRow(`SELECT value FROM sync_metadata WHERE key = 'schema_version'`).Scan(&value)
+	if err == sql.ErrNoRows || (err != nil && strings.Contains(err.Error(), "no such table")) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema_version %q: %w", value, err)
+	}
+	return v, nil
+}
+
+// recordMigrations marks migrations up to version as applied without running
+// them
+func recordMigrations(db *sql.DB, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixMilli()
+	for _, m := range migrations {
+		if m.Version > version {
+			break
+		}
+		if _, err := tx.Exec(`
+			INSERT OR IGNORE INTO schema_migrations (version, description, checksum, applied_at)
+			VALUES (?, ?, ?, ?)
+		`, m.Version, m.Description, m.checksum(), now); err != nil {
+			return fmt.Errorf("recording migration %d: %w", m.Version, err)
+		}
+	}
+	if err := syncLegacySchemaVersion(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// syncLegacySchemaVersion mirrors the newest applied migration into
+// sync_metadata.schema_version, which older binaries still read
+func syncLegacySchemaVersion(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		INSERT INTO sync_metadata (key, value, updated_at)
+		SELECT 'schema_version', CAST(COALESCE(MAX(version), 0) AS TEXT), ? FROM schema_migrations
+		WHERE true
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at
+	`, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("updating schema_version: %w", err)
+	}
+	return nil
+}
+
+func loadAppliedMigrations(db *sql.DB) (map[int]appliedMigration, error) {
+	rows, err := db.Query(`SELECT version, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var version int
+		var a appliedMigration
+		if err := rows.Scan(&version, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = a
+	}
+	return applied, rows.Err()
+}
+
+// verifyMigrations fails if an applied migration was changed in code or if
+// the database has migrations this build doesn't know
+func verifyMigrations(applied map[int]appliedMigration) error {
+	known := make(map[int]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = true
+		if a, ok := applied[m.Version]; ok && a.checksum != m.checksum() {
+			return fmt.Errorf("migration %d was modified after it was applied (checksum %s, expected %s)", m.Version, a.checksum, m.checksum())
+		}
+	}
+	for version := range applied {
+		if !known[version] {
+			return fmt.Errorf("database has migration %d, which this build doesn't know (newer binary?)", version)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs one direction of m and updates the tracking tables in
+// the same transaction
+func applyMigration(db *sql.DB, m migration, up bool) error {
+	stmts := m.Up
+	direction := "up"
+	if !up {
+		stmts = m.Down
+		direction = "down"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("migration %d %s: %w", m.Version, direction, err)
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range stmts {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("migration %d %s failed: %w", m.Version, direction, err)
+		}
+	}
+
+	if up {
+		_, err = tx.Exec(`
+			INSERT INTO schema_migrations (version, description, checksum, applied_at)
+			VALUES (?, ?, ?, ?)
+		`, m.Version, m.Description, m.checksum(), time.Now().UnixMilli())
+	} else {
+		_, err = tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("migration %d %s: recording: %w", m.Version, direction, err)
+	}
+
+	if err := syncLegacySchemaVersion(tx); err != nil {
+		return fmt.Errorf("migration %d %s: %w", m.Version, direction, err)
+	}
+
+	return tx.Commit()
+}
+
+// checkSchemaCurrent fails with ErrSchemaBehind unless every known
+// migration is applied. It only reads, so it works on databases the caller
+// must not change.
+func checkSchemaCurrent(db *sql.DB) error {
+	var tracked int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`).Scan(&tracked); err != nil {
+		return fmt.Errorf("inspecting schema: %w", err)
+	}
+	if tracked == 0 {
+		return fmt.Errorf("%w: no schema_migrations table, run migrate up", ErrSchemaBehind)
+	}
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	if err := verifyMigrations(applied); err != nil {
+		return err
+	}
+	var pending []int
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m.Version)
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: migrations %v pending, run migrate up", ErrSchemaBehind, pending)
+	}
+	return nil
+}
+
+// MigrateUp applies pending migrations up to target (0 = all) and returns
+// the versions applied. Databases without tables must be created with New,
+// which builds the current schema directly.
+func MigrateUp(db *sql.DB, target int) ([]int, error) {
+	fresh, err := prepareMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	if fresh {
+		return nil, fmt.Errorf("database has no schema yet; open it with the bridge or import tools first")
+	}
+	return migrateUp(db, target)
+}
+
+func migrateUp(db *sql.DB, target int) ([]int, error) {
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyMigrations(applied); err != nil {
+		return nil, err
+	}
+
+	var done []int
+	for _, m := range migrations {
+		if target > 0 && m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := applyMigration(db, m, true); err != nil {
+			return done, err
+		}
+		done = append(done, m.Version)
+	}
+	return done, nil
+}
+
+// MigrateDown reverts applied migrations newer than target, newest first,
+// and returns the versions reverted. It stops with an error at an
+// irreversible migration.
+//
+// Note that New (used by every tool) applies pending migrations again, so a
+// downgraded database stays downgraded only until the next start of a
+// current binary.
+func MigrateDown(db *sql.DB, target int) ([]int, error) {
+	if target < 0 {
+		return nil, &inputError{"target version must not be negative"}
+	}
+	if _, err := prepareMigrations(db); err != nil {
+		return nil, err
+	}
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyMigrations(applied); err != nil {
+		return nil, err
+	}
+
+	var done []int
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= target {
+			break
+		}
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == nil {
+			return done, fmt.Errorf("migration %d (%s) is irreversible", m.Version, m.Description)
+		}
+		if err := applyMigration(db, m, false); err != nil {
+			return done, err
+		}
+		done = append(done, m.Version)
+	}
+	return done, nil
+}
+
+// GetMigrationStatus lists every known migration with its state in db
+func GetMigrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	if _, err := prepareMigrations(db); err != nil {
+		return nil, err
+	}
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		st := MigrationStatus{
+			Version:     m.Version,
+			Description: m.Description,
+			Reversible:  m.Down != nil,
+		}
+		if a, ok := applied[m.Version]; ok {
+			st.Applied = true
+			st.AppliedAt = a.appliedAt
+			st.Modified = a.checksum != m.checksum()
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
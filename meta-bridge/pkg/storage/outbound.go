@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"time"
+)
+
+// Outbound queue statuses
+const (
+	OutboundPending = "pending"
+	// OutboundAwaitingAck is a message the server accepted whose
+	// confirmation hasn't arrived yet; it isn't sent again
+	OutboundAwaitingAck = "awaiting_ack"
+	OutboundSent        = "sent"
+	OutboundFailed      = "failed"
+)
+
+// OutboundMessage is a queued message waiting to be sent
+type OutboundMessage struct {
+	OTID        string
+	ThreadID    int64
+	Text        string
+	Attempts    int
+	CreatedAtMs int64
+}
+
+// EnqueueOutbound stores a message to be sent. otid must be a fresh offline
+// threading ID; it stays the same across retries. Reusing an otid fails with
+// ErrConflict.
+func (s *Storage) EnqueueOutbound(otid string, threadID int64, text string) error {
+	now := time.Now().UnixMilli()
+	_, err := s.db.Exec(`
+		INSERT INTO outbound_queue (otid, thread_id, text, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, otid, threadID, text, OutboundPending, now, now)
+	return classifySQLiteError(err)
+}
+
+// GetPendingOutbound returns pending messages, oldest first
+func (s *Storage) GetPendingOutbound(limit int) ([]OutboundMessage, error) {
+	rows, err := s.db.Query(`
+		SELECT otid, thread_id, text, attempts, created_at
+		FROM outbound_queue
+		WHERE status = ?
+		ORDER BY created_at ASC
+		LIMIT ?
+	`, OutboundPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []OutboundMessage
+	for rows.Next() {
+		var m OutboundMessage
+		if err := rows.Scan(&m.OTID, &m.ThreadID, &m.Text, &m.Attempts, &m.CreatedAtMs); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// RecordOutboundAttempt counts a send attempt. A successful send moves the
+// message to OutboundAwaitingAck until its confirmation arrives; a failed
+// one that has reached maxAttempts is marked failed.
+func (s *Storage) RecordOutboundAttempt(otid string, sendErr error, maxAttempts int) error {
+	var lastError any
+	if sendErr != nil {
+		lastError = sendErr.Error()
+	}
+	_, err := s.db.Exec(`
+		UPDATE outbound_queue SET
+			attempts = attempts + 1,
+			last_error = COALESCE(?1, last_error),
+			status = CASE
+				WHEN ?1 IS NULL THEN ?2
+				WHEN attempts + 1 >= ?3 THEN ?4
+				ELSE status
+			END,
+			updated_at = ?5
+		WHERE otid = ?6 AND status = ?7
+	`, lastError, OutboundAwaitingAck, maxAttempts, OutboundFailed, time.Now().UnixMilli(), otid, OutboundPending)
+	return err
+}
+
+// MarkOutboundSent records the server's confirmation of a queued message,
+// which may arrive before or after its send attempt is recorded. Returns
+// false if otid isn't a queued message waiting for confirmation.
+func (s *Storage) MarkOutboundSent(otid, messageID string) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE outbound_queue SET status = ?, message_id = ?, updated_at = ?
+		WHERE otid = ? AND status IN (?, ?)
+	`, OutboundSent, nullIfEmpty(messageID), time.Now().UnixMilli(), otid, OutboundPending, OutboundAwaitingAck)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// MarkOutboundFailed marks a queued message as permanently failed
+func (s *Storage) MarkOutboundFailed(otid, reason string) error {
+	_, err := s.db.Exec(`
+		UPDATE outbound_queue SET status = ?, last_error = ?, updated_at = ?
+		WHERE otid = ? AND status IN (?, ?)
+	`, OutboundFailed, reason, time.Now().UnixMilli(), otid, OutboundPending, OutboundAwaitingAck)
+	return err
+}
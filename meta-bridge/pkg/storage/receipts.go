@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"database/sql"
+)
+
+// Receipt is a thread participant's read state relative to one message
+type Receipt struct {
+	ContactID       int64  `json:"contact_id,string"`
+	Name            string `json:"name"`
+	ReadWatermarkMs int64  `json:"read_watermark_ms"`
+	ReadActionMs    int64  `json:"read_action_ms,omitempty"` // When the read happened, if known
+}
+
+// MessageReceipts lists which participants have seen a message, derived from
+// their read watermarks. The sender is never listed.
+type MessageReceipts struct {
+	MessageID   string    `json:"message_id"`
+	ThreadID    int64     `json:"thread_id,string"`
+	SenderID    int64     `json:"sender_id,string"`
+	TimestampMs int64     `json:"timestamp_ms"`
+	SeenBy      []Receipt `json:"seen_by"` // Latest readers first
+	NotSeenBy   []Receipt `json:"not_seen_by"`
+}
+
+// GetMessageReceipts returns the seen-by data for a message, or ErrNotFound if
+// the message doesn't exist
+func GetMessageReceipts(db *sql.DB, messageID string) (*MessageReceipts, error) {
+	mr := &MessageReceipts{MessageID: messageID, SeenBy: []Receipt{}, NotSeenBy: []Receipt{}}
+	err := db.QueryRow(`SELECT thread_id, sender_id, timestamp_ms FROM messages WHERE id = ?`, messageID).
+		Scan(&mr.ThreadID, &mr.SenderID, &mr.TimestampMs)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT p.contact_id, COALESCE(NULLIF(p.nickname, ''), c.name, ''),
+			COALESCE(p.read_watermark_ms, 0), COALESCE(p.read_action_timestamp_ms, 0)
+		FROM thread_participants p
+		LEFT JOIN contacts c ON c.id = p.contact_id
+		WHERE p.thread_id = ? AND p.contact_id != ?
+		ORDER BY COALESCE(p.read_watermark_ms, 0) DESC, p.contact_id
+	`, mr.ThreadID, mr.SenderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Receipt
+		if err := rows.Scan(&r.ContactID, &r.Name, &r.ReadWatermarkMs, &r.ReadActionMs); err != nil {
+			return nil, err
+		}
+		if r.ReadWatermarkMs >= mr.TimestampMs {
+			mr.SeenBy = append(mr.SeenBy, r)
+		} else {
+			mr.NotSeenBy = append(mr.NotSeenBy, r)
+		}
+	}
+	return mr, rows.Err()
+}
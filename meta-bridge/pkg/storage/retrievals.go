@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"database/sql"
+)
+
+// RecordChunkRetrievals adds hits (chunk ID -> times returned) to the
+// retrieval history, with at (Unix ms) as the last retrieval time
+func (s *Storage) RecordChunkRetrievals(hits map[string]int, at int64) error {
+	if len(hits) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO chunk_retrievals (chunk_id, first_retrieved_at, last_retrieved_at, retrieval_count)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(chunk_id) DO UPDATE SET
+			last_retrieved_at = MAX(chunk_retrievals.last_retrieved_at, excluded.last_retrieved_at),
+			retrieval_count = chunk_retrievals.retrieval_count + excluded.retrieval_count
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for chunkID, n := range hits {
+		if _, err := stmt.Exec(chunkID, at, at, n); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RetrievalCoverage counts indexable chunks, and those returned by a search
+// at or after sinceMs (0 = ever)
+type RetrievalCoverage struct {
+	Chunks    int64 `json:"chunks"`
+	Retrieved int64 `json:"retrieved"`
+}
+
+// GetRetrievalCoverage summarizes how much of the index searches reach
+func GetRetrievalCoverage(db *sql.DB, sinceMs int64) (RetrievalCoverage, error) {
+	var c RetrievalCoverage
+	err := db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(r.last_retrieved_at IS NOT NULL AND r.last_retrieved_at >= ?), 0)
+		FROM chunks c
+		LEFT JOIN chunk_retrievals r ON r.chunk_id = c.chunk_id
+		WHERE c.is_indexable = 1
+	`, sinceMs).Scan(&c.Chunks, &c.Retrieved)
+	return c, err
+}
+
+// ColdSegment is a conversation session none of whose indexable chunks was
+// returned by a search in the reporting window
+type ColdSegment struct {
+	ThreadID   int64  `json:"thread_id,string"`
+	ThreadName string `json:"thread_name"`
+	SessionIdx int    `json:"session_idx"`
+	Chunks     int    `json:"chunks"`
+	Chars      int64  `json:"chars"`
+	StartMs    int64  `json:"start_ms"`
+	EndMs      int64  `json:"end_ms"`
+	// LastRetrievedAt is the session's latest hit before the window (Unix ms,
+	// 0 = never retrieved)
+	LastRetrievedAt int64 `json:"last_retrieved_at,omitempty"`
+}
+
+// ListColdSegments returns up to limit sessions with no chunk retrieved at or
+// after sinceMs (0 = never retrieved), largest first
+func ListColdSegments(db *sql.DB, sinceMs int64, limit int) ([]ColdSegment, error) {
+	rows, err := db.Query(`
+		SELECT c.thread_id, COALESCE(MAX(c.thread_name), ''), c.session_idx, COUNT(*),
+			SUM(c.char_count), MIN(c.start_timestamp_ms), MAX(c.end_timestamp_ms),
+			COALESCE(MAX(r.last_retrieved_at), 0) AS last_hit
+		FROM chunks c
+		LEFT JOIN chunk_retrievals r ON r.chunk_id = c.chunk_id
+		WHERE c.is_indexable = 1
+		GROUP BY c.thread_id, c.session_idx
+		HAVING last_hit = 0 OR (? > 0 AND last_hit < ?)
+		ORDER BY SUM(c.char_count) DESC, c.thread_id, c.session_idx
+		LIMIT ?
+	`, sinceMs, sinceMs, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []ColdSegment
+	for rows.Next() {
+		var seg ColdSegment
+		if err := rows.Scan(&seg.ThreadID, &seg.ThreadName, &seg.SessionIdx, &seg.Chunks,
+			&seg.Chars, &seg.StartMs, &seg.EndMs, &seg.LastRetrievedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, seg)
+	}
+	return out, rows.Err()
+}
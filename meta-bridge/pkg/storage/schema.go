@@ -62,6 +62,7 @@ CREATE TABLE IF NOT EXISTS messages (
     offline_threading_id TEXT,
     created_at INTEGER NOT NULL,
     indexed_at INTEGER,               -- NULL = not vector indexed, timestamp when indexed
+    source TEXT NOT NULL DEFAULT 'live', -- Where it came from: live, <platform>-export, import-sample
     FOREIGN KEY (thread_id) REFERENCES threads(id),
     FOREIGN KEY (sender_id) REFERENCES contacts(id)
 );
@@ -79,9 +80,42 @@ CREATE TABLE IF NOT EXISTS attachments (
     height INTEGER,
     duration_ms INTEGER,               -- For audio/video
     created_at INTEGER NOT NULL,
+    local_path TEXT,                   -- Downloaded file, relative to media.attachments_dir (see media-sync)
+    content_sha256 TEXT,               -- Hex SHA-256 of the downloaded file
+    downloaded_at INTEGER,
+    download_error TEXT,               -- Last failed download; skipped until retried
+    e2ee_media BLOB,                   -- Marshalled WAMediaTransport of E2EE media (keys, direct path)
+    e2ee_media_type TEXT,              -- whatsmeow MediaType used to derive the keys
     FOREIGN KEY (message_id) REFERENCES messages(id)
 );
 
+-- Transcripts of audio attachments (voice messages), written by voice-transcribe
+-- and appended to the message text when chunking. A failed attempt leaves an
+-- empty text and the error, so it is not retried on every pass.
+CREATE TABLE IF NOT EXISTS attachment_transcripts (
+    attachment_id TEXT PRIMARY KEY,
+    message_id TEXT NOT NULL,
+    text TEXT NOT NULL DEFAULT '',
+    language TEXT,
+    model TEXT,
+    error TEXT,
+    created_at INTEGER NOT NULL,
+    FOREIGN KEY (attachment_id) REFERENCES attachments(id)
+);
+
+-- Text read from image attachments (OCR and a short caption), written by
+-- image-caption and appended to the message text when chunking. Failures are
+-- recorded like transcription failures.
+CREATE TABLE IF NOT EXISTS attachment_captions (
+    attachment_id TEXT PRIMARY KEY,
+    message_id TEXT NOT NULL,
+    text TEXT NOT NULL DEFAULT '',
+    model TEXT,
+    error TEXT,
+    created_at INTEGER NOT NULL,
+    FOREIGN KEY (attachment_id) REFERENCES attachments(id)
+);
+
 -- Reactions table: stores reactions to messages
 CREATE TABLE IF NOT EXISTS reactions (
     thread_id INTEGER NOT NULL,
@@ -99,8 +133,11 @@ CREATE INDEX IF NOT EXISTS idx_messages_thread_id ON messages(thread_id);
 CREATE INDEX IF NOT EXISTS idx_messages_sender_id ON messages(sender_id);
 CREATE INDEX IF NOT EXISTS idx_messages_timestamp ON messages(timestamp_ms);
 CREATE INDEX IF NOT EXISTS idx_messages_indexed_at ON messages(indexed_at);
+CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at);  -- /recent (ingestion time)
 CREATE INDEX IF NOT EXISTS idx_threads_last_activity ON threads(last_activity_ms);
 CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments(message_id);
+CREATE INDEX IF NOT EXISTS idx_attachment_transcripts_message_id ON attachment_transcripts(message_id);
+CREATE INDEX IF NOT EXISTS idx_attachment_captions_message_id ON attachment_captions(message_id);
 CREATE INDEX IF NOT EXISTS idx_reactions_message_id ON reactions(message_id);
 CREATE INDEX IF NOT EXISTS idx_thread_participants_contact ON thread_participants(contact_id);
 
@@ -128,70 +165,336 @@ CREATE TRIGGER IF NOT EXISTS messages_au AFTER UPDATE ON messages BEGIN
     WHERE NEW.text IS NOT NULL AND NEW.text != '';
 END;
 
+-- Upsert path counters, maintained by the triggers below for every writer.
+-- A re-import storm shows as dedup_skipped and fts_rewritten climbing while
+-- text_changed stays flat.
+CREATE TABLE IF NOT EXISTS upsert_stats (
+    counter TEXT PRIMARY KEY,
+    value INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT OR IGNORE INTO upsert_stats (counter) VALUES
+    ('inserted'), ('dedup_skipped'), ('text_changed'), ('fts_rewritten');
+
+-- Fires for every insert attempt, so an existing id means the insert was
+-- skipped (ON CONFLICT DO NOTHING) or merged into the row (DO UPDATE)
+CREATE TRIGGER IF NOT EXISTS upsert_stats_messages_bi BEFORE INSERT ON messages
+WHEN EXISTS (SELECT 1 FROM messages WHERE id = NEW.id) BEGIN
+    UPDATE upsert_stats SET value = value + 1 WHERE counter = 'dedup_skipped';
+END;
+
+CREATE TRIGGER IF NOT EXISTS upsert_stats_messages_ai AFTER INSERT ON messages BEGIN
+    UPDATE upsert_stats SET value = value + 1 WHERE counter = 'inserted';
+END;
+
+-- messages_au rewrites the FTS row on every update, text changed or not
+CREATE TRIGGER IF NOT EXISTS upsert_stats_messages_au AFTER UPDATE ON messages BEGIN
+    UPDATE upsert_stats SET value = value + 1
+    WHERE counter = 'fts_rewritten'
+       OR (counter = 'text_changed' AND OLD.text IS NOT NEW.text);
+END;
+
 -- Metadata table for tracking sync state
 CREATE TABLE IF NOT EXISTS sync_metadata (
     key TEXT PRIMARY KEY,
     value TEXT,
     updated_at INTEGER NOT NULL
 );
+
+-- Avatar refresh queue: contacts whose profile_picture_url failed to download
+-- (expired CDN URLs). messenger-cli requests fresh contact info for these.
+CREATE TABLE IF NOT EXISTS avatar_refresh_queue (
+    contact_id INTEGER PRIMARY KEY,
+    status_code INTEGER NOT NULL,      -- HTTP status from the failed download
+    failed_url TEXT,
+    failure_count INTEGER NOT NULL DEFAULT 1,
+    failed_at INTEGER NOT NULL,
+    requested_at INTEGER,              -- When messenger-cli last asked for fresh info
+    FOREIGN KEY (contact_id) REFERENCES contacts(id)
+);
+
+-- Outbound queue: messages composed with messenger-cli -send. They are kept
+-- until the server confirms them; the otid (offline threading ID) is reused on
+-- every retry so the server dedups retransmissions, like the official clients.
+CREATE TABLE IF NOT EXISTS outbound_queue (
+    otid TEXT PRIMARY KEY,
+    thread_id INTEGER NOT NULL,
+    text TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',  -- pending, awaiting_ack, sent, failed
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    message_id TEXT,                   -- Server message ID once confirmed
+    created_at INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbound_queue_status ON outbound_queue(status, created_at);
+
+-- Thread tags: user-assigned labels (family, work, travel) for scoping search
+CREATE TABLE IF NOT EXISTS thread_tags (
+    thread_id INTEGER NOT NULL,
+    tag TEXT NOT NULL,                 -- Normalized: lowercase, [a-z0-9_-]
+    created_at INTEGER NOT NULL,
+    PRIMARY KEY (thread_id, tag),
+    FOREIGN KEY (thread_id) REFERENCES threads(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_thread_tags_tag ON thread_tags(tag);
+
+-- Token usage of embedding/LLM providers, one row per pipeline run
+-- (an indexing run, a window of search traffic, an /ask request, ...)
+CREATE TABLE IF NOT EXISTS usage_runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL,                -- 'index', 'search', 'ask', ...
+    component TEXT NOT NULL,           -- 'embedding' or 'llm'
+    model TEXT NOT NULL,
+    requests INTEGER NOT NULL DEFAULT 0,
+    prompt_tokens INTEGER NOT NULL DEFAULT 0,
+    completion_tokens INTEGER NOT NULL DEFAULT 0,
+    total_tokens INTEGER NOT NULL DEFAULT 0,
+    cost_usd REAL NOT NULL DEFAULT 0,  -- Estimated from usage.prices at record time
+    started_at INTEGER NOT NULL,       -- Unix ms
+    finished_at INTEGER NOT NULL       -- Unix ms
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_runs_finished ON usage_runs(finished_at);
+
+-- Slow query log: searches over slow_query.threshold_ms in rag.yaml
+CREATE TABLE IF NOT EXISTS slow_queries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at INTEGER NOT NULL,       -- Unix ms
+    request_id TEXT NOT NULL DEFAULT '',
+    query TEXT NOT NULL,
+    mode TEXT NOT NULL,
+    tags TEXT NOT NULL DEFAULT '',     -- Comma-separated
+    results INTEGER NOT NULL DEFAULT 0,
+    took_ms INTEGER NOT NULL,
+    stages TEXT NOT NULL DEFAULT '{}', -- JSON object of stage -> ms
+    plan TEXT NOT NULL DEFAULT ''      -- EXPLAIN QUERY PLAN of the BM25 query
+);
+
+CREATE INDEX IF NOT EXISTS idx_slow_queries_created ON slow_queries(created_at);
+
+-- When each chunk last came back as a search hit, recorded in batches by
+-- rag-server. Keyed by chunk_id rather than stored on chunks so the history
+-- survives re-chunking; chunks that are never hit are the cold data.
+CREATE TABLE IF NOT EXISTS chunk_retrievals (
+    chunk_id TEXT PRIMARY KEY,
+    first_retrieved_at INTEGER NOT NULL, -- Unix ms
+    last_retrieved_at INTEGER NOT NULL,  -- Unix ms
+    retrieval_count INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_chunk_retrievals_last ON chunk_retrievals(last_retrieved_at);
+
+-- LLM summaries written by summarize: one per conversation session, and one
+-- per thread (session_idx -1) made from its session summaries. source_hash
+-- covers the input, model and prompt, so unchanged sessions are skipped.
+CREATE TABLE IF NOT EXISTS summaries (
+    summary_id TEXT PRIMARY KEY,
+    thread_id INTEGER NOT NULL,
+    session_idx INTEGER NOT NULL,      -- -1 = the whole thread
+    text TEXT NOT NULL,
+    model TEXT NOT NULL,
+    source_hash TEXT NOT NULL,
+    start_timestamp_ms INTEGER NOT NULL,
+    end_timestamp_ms INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,       -- Unix ms
+    milvus_synced INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (thread_id, session_idx)
+);
+
+CREATE INDEX IF NOT EXISTS idx_summaries_unsynced ON summaries(milvus_synced);
+
+-- URLs found in message text, kept current by Storage's message writes and
+-- caught up by IndexLinks for rows written directly (see GET /links)
+CREATE TABLE IF NOT EXISTS links (
+    message_id TEXT NOT NULL,
+    url TEXT NOT NULL,
+    domain TEXT NOT NULL,              -- Lowercase host without www. and port
+    thread_id INTEGER NOT NULL,
+    sender_id INTEGER,
+    timestamp_ms INTEGER NOT NULL,     -- Of the message
+    PRIMARY KEY (message_id, url)
+);
+
+CREATE INDEX IF NOT EXISTS idx_links_domain ON links(domain, timestamp_ms);
+CREATE INDEX IF NOT EXISTS idx_links_timestamp ON links(timestamp_ms);
+
+-- Contacts merged into another (MergeContacts), e.g. the name-hash ID an
+-- export import gave someone who live sync knows by their real ID. Importers
+-- resolve IDs through it so re-imports don't recreate merged contacts.
+CREATE TABLE IF NOT EXISTS contact_aliases (
+    alias_id INTEGER PRIMARY KEY,      -- The merged (deleted) contact ID
+    contact_id INTEGER NOT NULL,       -- The contact it was merged into
+    name TEXT,                         -- The alias's name when merged
+    merged_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_contact_aliases_contact ON contact_aliases(contact_id);
+
+-- Threads merged into another (MergeThreads), e.g. the hash-based ID an export
+-- import gave a conversation that live sync stores under its real thread key
+CREATE TABLE IF NOT EXISTS thread_aliases (
+    alias_id INTEGER PRIMARY KEY,      -- The merged (deleted) thread ID
+    thread_id INTEGER NOT NULL,        -- The thread it was merged into
+    name TEXT,                         -- The alias's display name when merged
+    merged_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_thread_aliases_thread ON thread_aliases(thread_id);
+
+-- Conversations an export import has stored, committed with them, so an
+-- interrupted import resumes after them; cleared when the import completes
+CREATE TABLE IF NOT EXISTS import_checkpoints (
+    import_key TEXT NOT NULL,          -- The export: its path, size and modification time
+    conversation TEXT NOT NULL,        -- The conversation within it, with its message count
+    imported INTEGER NOT NULL,
+    skipped INTEGER NOT NULL,
+    completed_at INTEGER NOT NULL,
+    PRIMARY KEY (import_key, conversation)
+);
+
+-- Display names of threads: the thread's own name, or for an unnamed 1:1
+-- thread (thread types 1, 7, 10, 13, 15 and 201) the other person's. A 1:1
+-- thread's ID is the other person's contact ID, which also names the
+-- note-to-self thread after the owner; failing that, the first participant
+-- other than the owner (current_user_id in sync_metadata) with a name.
+-- Everything that shows a thread name reads it from here.
+CREATE VIEW IF NOT EXISTS thread_names AS
+SELECT th.id AS thread_id, COALESCE(
+    NULLIF(th.name, ''),
+    CASE WHEN th.thread_type IN (1, 7, 10, 13, 15, 201) THEN COALESCE(
+        (SELECT NULLIF(name, '') FROM contacts WHERE id = th.id),
+        (SELECT NULLIF(nickname, '') FROM thread_participants WHERE thread_id = th.id AND contact_id = th.id),
+        (SELECT COALESCE(NULLIF(c.name, ''), NULLIF(tp.nickname, ''))
+         FROM thread_participants tp
+         LEFT JOIN contacts c ON c.id = tp.contact_id
+         WHERE tp.thread_id = th.id
+           AND tp.contact_id != COALESCE((SELECT CAST(value AS INTEGER) FROM sync_metadata WHERE key = 'current_user_id'), 0)
+           AND COALESCE(NULLIF(c.name, ''), NULLIF(tp.nickname, '')) IS NOT NULL
+         ORDER BY tp.contact_id
+         LIMIT 1)
+    ) END,
+    '') AS name
+FROM threads th;
+
+-- Change feed: one row per mutation, written by the triggers below so every
+-- writer (messenger-cli, import-export, ...) is covered. Consumers page through
+-- it with a seq cursor (see GET /changes in rag-server).
+CREATE TABLE IF NOT EXISTS changes (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    entity_type TEXT NOT NULL,         -- contact, thread, participant, message, attachment, reaction, thread_tag
+    entity_id TEXT NOT NULL,           -- Composite keys are joined with ':'
+    thread_id INTEGER,                 -- Owning thread, when known
+    op TEXT NOT NULL,                  -- insert, update, delete
+    ts INTEGER NOT NULL                -- Unix ms
+);
+
+CREATE INDEX IF NOT EXISTS idx_changes_ts ON changes(ts);
+
+CREATE TRIGGER IF NOT EXISTS changes_contacts_ai AFTER INSERT ON contacts BEGIN
+    INSERT INTO changes (entity_type, entity_id, op, ts)
+    VALUES ('contact', NEW.id, 'insert', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_contacts_au AFTER UPDATE ON contacts BEGIN
+    INSERT INTO changes (entity_type, entity_id, op, ts)
+    VALUES ('contact', NEW.id, 'update', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_contacts_ad AFTER DELETE ON contacts BEGIN
+    INSERT INTO changes (entity_type, entity_id, op, ts)
+    VALUES ('contact', OLD.id, 'delete', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_threads_ai AFTER INSERT ON threads BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('thread', NEW.id, NEW.id, 'insert', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_threads_au AFTER UPDATE ON threads BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('thread', NEW.id, NEW.id, 'update', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_threads_ad AFTER DELETE ON threads BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('thread', OLD.id, OLD.id, 'delete', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_participants_ai AFTER INSERT ON thread_participants BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('participant', NEW.thread_id || ':' || NEW.contact_id, NEW.thread_id, 'insert', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_participants_au AFTER UPDATE ON thread_participants BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('participant', NEW.thread_id || ':' || NEW.contact_id, NEW.thread_id, 'update', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_participants_ad AFTER DELETE ON thread_participants BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('participant', OLD.thread_id || ':' || OLD.contact_id, OLD.thread_id, 'delete', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_messages_ai AFTER INSERT ON messages BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('message', NEW.id, NEW.thread_id, 'insert', ` + nowMsSQL + `);
+END;
+
+-- Only content columns: indexed_at bookkeeping is not a change
+CREATE TRIGGER IF NOT EXISTS changes_messages_au
+AFTER UPDATE OF text, is_unsent, reply_to_message_id, reply_snippet, edit_count, sticker_id ON messages BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('message', NEW.id, NEW.thread_id, 'update', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_messages_ad AFTER DELETE ON messages BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('message', OLD.id, OLD.thread_id, 'delete', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_attachments_ai AFTER INSERT ON attachments BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('attachment', NEW.id, (SELECT thread_id FROM messages WHERE id = NEW.message_id), 'insert', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_attachments_au AFTER UPDATE ON attachments BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('attachment', NEW.id, (SELECT thread_id FROM messages WHERE id = NEW.message_id), 'update', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_attachments_ad AFTER DELETE ON attachments BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('attachment', OLD.id, (SELECT thread_id FROM messages WHERE id = OLD.message_id), 'delete', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_reactions_ai AFTER INSERT ON reactions BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('reaction', NEW.message_id || ':' || NEW.actor_id, NEW.thread_id, 'insert', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_reactions_au AFTER UPDATE ON reactions BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('reaction', NEW.message_id || ':' || NEW.actor_id, NEW.thread_id, 'update', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_reactions_ad AFTER DELETE ON reactions BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('reaction', OLD.message_id || ':' || OLD.actor_id, OLD.thread_id, 'delete', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_thread_tags_ai AFTER INSERT ON thread_tags BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('thread_tag', NEW.thread_id || ':' || NEW.tag, NEW.thread_id, 'insert', ` + nowMsSQL + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS changes_thread_tags_ad AFTER DELETE ON thread_tags BEGIN
+    INSERT INTO changes (entity_type, entity_id, thread_id, op, ts)
+    VALUES ('thread_tag', OLD.thread_id || ':' || OLD.tag, OLD.thread_id, 'delete', ` + nowMsSQL + `);
+END;
 `
 
-type migration struct {
-	Version    int
-	Statements []string
-}
-
-// migrations contains SQL migrations to run in order (tracked via sync_metadata.schema_version).
-var migrations = []migration{
-	{
-		Version: 1,
-		Statements: []string{
-			`ALTER TABLE messages ADD COLUMN indexed_at INTEGER;`,
-			`CREATE INDEX IF NOT EXISTS idx_messages_indexed_at ON messages(indexed_at);`,
-		},
-	},
-	{
-		Version: 2,
-		Statements: []string{
-			`DROP INDEX IF EXISTS idx_messages_text;`,
-		},
-	},
-	{
-		Version: 3,
-		Statements: []string{
-			`ALTER TABLE thread_participants ADD COLUMN read_watermark_ms INTEGER;`,
-			`ALTER TABLE thread_participants ADD COLUMN read_action_timestamp_ms INTEGER;`,
-			`ALTER TABLE thread_participants ADD COLUMN delivered_watermark_ms INTEGER;`,
-		},
-	},
-	{
-		Version: 4,
-		Statements: []string{
-			`DROP TRIGGER IF EXISTS messages_ai;`,
-			`DROP TRIGGER IF EXISTS messages_ad;`,
-			`DROP TRIGGER IF EXISTS messages_au;`,
-			`DROP TABLE IF EXISTS messages_fts;`,
-			`CREATE VIRTUAL TABLE messages_fts USING fts4(
-				text,
-				tokenize=unicode61
-			);`,
-			`CREATE TRIGGER messages_ai AFTER INSERT ON messages BEGIN
-				INSERT INTO messages_fts(docid, text)
-				SELECT NEW.rowid, NEW.text
-				WHERE NEW.text IS NOT NULL AND NEW.text != '';
-			END;`,
-			`CREATE TRIGGER messages_ad AFTER DELETE ON messages BEGIN
-				DELETE FROM messages_fts WHERE docid = OLD.rowid;
-			END;`,
-			`CREATE TRIGGER messages_au AFTER UPDATE ON messages BEGIN
-				DELETE FROM messages_fts WHERE docid = OLD.rowid;
-				INSERT INTO messages_fts(docid, text)
-				SELECT NEW.rowid, NEW.text
-				WHERE NEW.text IS NOT NULL AND NEW.text != '';
-			END;`,
-			`INSERT INTO messages_fts(docid, text)
-			 SELECT rowid, text FROM messages
-			 WHERE text IS NOT NULL AND text != '';`,
-		},
-	},
-}
+// nowMsSQL is the current Unix time in ms, portable to SQLite builds without unixepoch('subsec')
+const nowMsSQL = `CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)`
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// SlowQuery is a logged search that exceeded the slow query threshold
+type SlowQuery struct {
+	ID        int64            `json:"id"`
+	CreatedAt int64            `json:"created_at"`
+	RequestID string           `json:"request_id,omitempty"`
+	Query     string           `json:"query"`
+	Mode      string           `json:"mode"`
+	Tags      []string         `json:"tags,omitempty"`
+	Results   int              `json:"results"`
+	TookMs    int64            `json:"took_ms"`
+	Stages    map[string]int64 `json:"stages"`
+	Plan      string           `json:"plan,omitempty"`
+}
+
+// RecordSlowQuery stores a slow query; CreatedAt defaults to now
+func (s *Storage) RecordSlowQuery(q SlowQuery) error {
+	if q.CreatedAt == 0 {
+		q.CreatedAt = time.Now().UnixMilli()
+	}
+	stages, err := json.Marshal(q.Stages)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO slow_queries (created_at, request_id, query, mode, tags, results, took_ms, stages, plan)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, q.CreatedAt, q.RequestID, q.Query, q.Mode, strings.Join(q.Tags, ","), q.Results, q.TookMs, string(stages), q.Plan)
+	return err
+}
+
+// ListSlowQueries returns slow queries logged at or after sinceMs, newest first
+func ListSlowQueries(db *sql.DB, sinceMs int64, limit int) ([]SlowQuery, error) {
+	rows, err := db.Query(`
+		SELECT id, created_at, request_id, query, mode, tags, results, took_ms, stages, plan
+		FROM slow_queries
+		WHERE created_at >= ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?
+	`, sinceMs, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []SlowQuery
+	for rows.Next() {
+		var q SlowQuery
+		var tags, stages string
+		if err := rows.Scan(&q.ID, &q.CreatedAt, &q.RequestID, &q.Query, &q.Mode, &tags,
+			&q.Results, &q.TookMs, &stages, &q.Plan); err != nil {
+			return nil, err
+		}
+		if tags != "" {
+			q.Tags = strings.Split(tags, ",")
+		}
+		_ = json.Unmarshal([]byte(stages), &q.Stages)
+		out = append(out, q)
+	}
+	return out, rows.Err()
+}
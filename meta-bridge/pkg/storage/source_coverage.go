@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"database/sql"
+)
+
+// Values of messages.source, the provenance recorded when a message is
+// stored: live sync, an import of some platform's export (ExportProvenance)
+// or import-sample. Exports imported before it was recorded are plain
+// "export".
+const (
+	ProvenanceLive         = "live"
+	ProvenanceExport       = "export"
+	ProvenanceImportSample = "import-sample"
+)
+
+// ExportProvenance is the messages.source of messages imported from an
+// export of platform (facebook, messenger, ...), e.g. "facebook-export"
+func ExportProvenance(platform string) string {
+	return platform + "-" + ProvenanceExport
+}
+
+// sourceSQL classifies a message (aliased m) by its recorded source as
+// ProvenanceLive, ProvenanceExport (an export of any platform) or
+// ProvenanceImportSample. Rows without one fall back to the ID format:
+// import-export stores a 32-char hex content hash, live sync Meta's message
+// IDs (mid.$…, numeric E2EE IDs).
+const sourceSQL = `COALESCE(
+	CASE WHEN m.source LIKE '%-export' THEN 'export' ELSE NULLIF(m.source, '') END,
+	CASE WHEN length(m.id) = 32 AND m.id NOT GLOB '*[^0-9a-f]*' THEN 'export' ELSE 'live' END)`
+
+// SourceMonth is the number of messages one source contributed to a thread
+// in one calendar month (UTC)
+type SourceMonth struct {
+	ThreadID   int64  `json:"thread_id,string"`
+	ThreadName string `json:"thread_name"`
+	Source     string `json:"source"`
+	Month      string `json:"month"` // YYYY-MM
+	Messages   int64  `json:"messages"`
+	FirstMs    int64  `json:"first_ms"`
+	LastMs     int64  `json:"last_ms"`
+}
+
+// ListSourceMonths returns per-month message counts by source, ordered by
+// thread, source and month. threadID 0 covers all threads. Unnamed threads
+// get their participants' names.
+func ListSourceMonths(db *sql.DB, threadID int64) ([]SourceMonth, error) {
+	rows, err := db.Query(`
+		SELECT m.thread_id,
+		       COALESCE(NULLIF(t.name, ''), (
+		           SELECT group_concat(c.name, ', ')
+		           FROM thread_participants tp JOIN contacts c ON c.id = tp.contact_id
+		           WHERE tp.thread_id = m.thread_id
+		       ), ''),
+		       `+sourceSQL+` AS kind,
+		       strftime('%Y-%m', m.timestamp_ms / 1000, 'unixepoch') AS month,
+		       COUNT(*), MIN(m.timestamp_ms), MAX(m.timestamp_ms)
+		FROM messages m
+		LEFT JOIN thread_names t ON t.thread_id = m.thread_id
+		WHERE m.is_unsent = 0 AND (? = 0 OR m.thread_id = ?)
+		GROUP BY m.thread_id, kind, month
+		ORDER BY m.thread_id, kind, month
+	`, threadID, threadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []SourceMonth
+	for rows.Next() {
+		var sm SourceMonth
+		if err := rows.Scan(&sm.ThreadID, &sm.ThreadName, &sm.Source, &sm.Month, &sm.Messages, &sm.FirstMs, &sm.LastMs); err != nil {
+			return nil, err
+		}
+		out = append(out, sm)
+	}
+	return out, rows.Err()
+}
@@ -3,7 +3,6 @@ package storage
 import (
 	"database/sql"
 	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
@@ -14,11 +13,20 @@ import (
 // Storage handles all database operations for message storage
 type Storage struct {
 	db *sql.DB
+	// tx is set on the Storage returned by Begin
+	tx *sql.Tx
+}
+
+// querier is the database or a transaction, such as the one started by Begin
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
 }
 
 // New creates a new Storage instance and initializes the database
 func New(dbPath string) (*Storage, error) {
-	db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000")
+	db, err := sql.Open(Driver("sqlite3"), dbPath+"?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -32,93 +40,112 @@ func New(dbPath string) (*Storage, error) {
 	return s, nil
 }
 
-// init creates the database schema and runs migrations
-func (s *Storage) init() error {
-	_, err := s.db.Exec(schema)
+// OpenExisting opens a database for writing without creating or migrating
+// its schema, for long-running readers such as rag-server that must not
+// change the schema of a live archive. It fails with ErrSchemaBehind when
+// migrations are pending.
+func OpenExisting(dbPath string) (*Storage, error) {
+	db, err := sql.Open(Driver("sqlite3"), dbPath+"?_foreign_keys=on&_busy_timeout=5000")
 	if err != nil {
-		return fmt.Errorf("failed to create schema: %w", err)
+		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
-
-	if err := s.runMigrations(); err != nil {
-		return err
+	if err := checkSchemaCurrent(db); err != nil {
+		db.Close()
+		return nil, err
 	}
-
-	return nil
+	return &Storage{db: db}, nil
 }
 
-func (s *Storage) runMigrations() error {
-	currentVersion, err := s.getSchemaVersion()
+// init brings an existing database up to date with pending migrations, then
+// creates any missing schema objects. Fresh databases get the current schema
+// directly and are baselined at the latest migration.
+func (s *Storage) init() error {
+	fresh, err := prepareMigrations(s.db)
 	if err != nil {
 		return err
 	}
-
-	for _, m := range migrations {
-		if m.Version <= currentVersion {
-			continue
-		}
-
-		tx, err := s.db.Begin()
-		if err != nil {
-			return fmt.Errorf("failed to begin migration %d: %w", m.Version, err)
-		}
-
-		for _, stmt := range m.Statements {
-			if strings.TrimSpace(stmt) == "" {
-				continue
-			}
-			if _, err := tx.Exec(stmt); err != nil && !isIgnorableMigrationError(err) {
-				_ = tx.Rollback()
-				return fmt.Errorf("migration %d failed: %w", m.Version, err)
-			}
-		}
-
-		now := time.Now().UnixMilli()
-		if _, err := tx.Exec(`
-			INSERT INTO sync_metadata (key, value, updated_at)
-			VALUES (?, ?, ?)
-			ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at
-		`, "schema_version", strconv.Itoa(m.Version), now); err != nil {
-			_ = tx.Rollback()
-			return fmt.Errorf("failed to update schema_version for migration %d: %w", m.Version, err)
-		}
-
-		if err := tx.Commit(); err != nil {
-			return fmt.Errorf("failed to commit migration %d: %w", m.Version, err)
+	if !fresh {
+		if _, err := migrateUp(s.db, 0); err != nil {
+			return err
 		}
+	}
 
-		currentVersion = m.Version
+	if _, err := s.db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create schema: %w", err)
+	}
+	if _, err := s.IndexLinks(); err != nil {
+		return fmt.Errorf("indexing links: %w", err)
 	}
 
+	if fresh {
+		return recordMigrations(s.db, LatestSchemaVersion())
+	}
 	return nil
 }
 
-func (s *Storage) getSchemaVersion() (int, error) {
-	value, err := s.GetSyncMetadata("schema_version")
+// Close closes the database connection
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+// Begin starts a transaction and returns a Storage whose writes go into it
+// until Commit or Rollback, so an export import stores a conversation whole
+// or not at all. Only the methods import-export uses run in the
+// transaction; others still use the database directly and would wait for
+// its write lock.
+func (s *Storage) Begin() (*Storage, error) {
+	if s.tx != nil {
+		return nil, fmt.Errorf("transaction already started")
+	}
+	tx, err := s.db.Begin()
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	return &Storage{db: s.db, tx: tx}, nil
+}
+
+// Commit commits the transaction started by Begin
+func (s *Storage) Commit() error {
+	if s.tx == nil {
+		return fmt.Errorf("no transaction")
 	}
-	if value == "" {
-		return 0, nil
+	return s.tx.Commit()
+}
+
+// Rollback discards the transaction started by Begin; it is a no-op after
+// Commit
+func (s *Storage) Rollback() error {
+	if s.tx == nil {
+		return fmt.Errorf("no transaction")
 	}
-	v, err := strconv.Atoi(value)
-	if err != nil {
-		return 0, fmt.Errorf("invalid schema_version %q: %w", value, err)
+	if err := s.tx.Rollback(); err != sql.ErrTxDone {
+		return err
 	}
-	return v, nil
+	return nil
 }
 
-func isIgnorableMigrationError(err error) bool {
-	if err == nil {
-		return false
+// q returns what to run statements on: the transaction if there is one
+func (s *Storage) q() querier {
+	if s.tx != nil {
+		return s.tx
 	}
-	msg := err.Error()
-	return strings.Contains(msg, "duplicate column name") ||
-		strings.Contains(msg, "already exists")
+	return s.db
 }
 
-// Close closes the database connection
-func (s *Storage) Close() error {
-	return s.db.Close()
+// inTx runs fn in a transaction of its own, or in the one started by Begin
+func (s *Storage) inTx(fn func(tx *sql.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // UpsertContact inserts or updates a contact
@@ -136,7 +163,10 @@ func (s *Storage) UpsertContact(contact *table.LSDeleteThenInsertContact) error
 			updated_at = excluded.updated_at
 	`, contact.Id, contact.Name, contact.FirstName, contact.SecondaryName,
 		contact.ProfilePictureUrl, contact.IsMessengerUser, now, now)
-	return err
+	if err != nil {
+		return err
+	}
+	return s.clearAvatarRefresh(contact.Id, contact.ProfilePictureUrl)
 }
 
 // UpsertContactFromVerify inserts or updates a contact from LSVerifyContactRowExists
@@ -154,13 +184,16 @@ func (s *Storage) UpsertContactFromVerify(contact *table.LSVerifyContactRowExist
 			updated_at = excluded.updated_at
 	`, contact.ContactId, contact.Name, contact.FirstName, contact.SecondaryName,
 		contact.ProfilePictureUrl, contact.IsBlocked, now, now)
-	return err
+	if err != nil {
+		return err
+	}
+	return s.clearAvatarRefresh(contact.ContactId, contact.ProfilePictureUrl)
 }
 
 // EnsureContactExists creates a minimal contact record if it doesn't exist
 func (s *Storage) EnsureContactExists(contactID int64) error {
 	now := time.Now().UnixMilli()
-	_, err := s.db.Exec(`
+	_, err := s.q().Exec(`
 		INSERT OR IGNORE INTO contacts (id, created_at, updated_at)
 		VALUES (?, ?, ?)
 	`, contactID, now, now)
@@ -170,7 +203,7 @@ func (s *Storage) EnsureContactExists(contactID int64) error {
 // EnsureContactExistsWithName creates a contact record with name if it doesn't exist
 func (s *Storage) EnsureContactExistsWithName(contactID int64, name string) error {
 	now := time.Now().UnixMilli()
-	_, err := s.db.Exec(`
+	_, err := s.q().Exec(`
 		INSERT INTO contacts (id, name, created_at, updated_at)
 		VALUES (?, ?, ?, ?)
 		ON CONFLICT(id) DO UPDATE SET
@@ -183,7 +216,7 @@ func (s *Storage) EnsureContactExistsWithName(contactID int64, name string) erro
 // EnsureThreadExistsWithName creates a thread record with name if it doesn't exist
 func (s *Storage) EnsureThreadExistsWithName(threadID int64, name string) error {
 	now := time.Now().UnixMilli()
-	_, err := s.db.Exec(`
+	_, err := s.q().Exec(`
 		INSERT INTO threads (id, thread_type, name, created_at, updated_at)
 		VALUES (?, 1, ?, ?, ?)
 		ON CONFLICT(id) DO UPDATE SET
@@ -308,7 +341,10 @@ func (s *Storage) InsertMessage(msg *table.LSInsertMessage) error {
 	`, msg.MessageId, msg.ThreadKey, msg.SenderId, msg.Text, msg.TimestampMs,
 		msg.IsUnsent, msg.IsForwarded, nullIfEmpty(msg.ReplySourceId), msg.ReplySnippet,
 		msg.EditCount, nullIfZero(msg.StickerId), msg.OfflineThreadingId, now)
-	return err
+	if err != nil || !hasLinkCandidate(msg.Text) {
+		return err
+	}
+	return indexMessageLinks(s.db, msg.MessageId)
 }
 
 // UpsertMessage updates or inserts a message (for edits)
@@ -339,7 +375,10 @@ func (s *Storage) UpsertMessage(msg *table.LSUpsertMessage) error {
 	`, msg.MessageId, msg.ThreadKey, msg.SenderId, msg.Text, msg.TimestampMs,
 		msg.IsUnsent, msg.IsForwarded, nullIfEmpty(msg.ReplySourceId), msg.ReplySnippet,
 		msg.EditCount, nullIfZero(msg.StickerId), msg.OfflineThreadingId, now)
-	return err
+	if err != nil {
+		return err
+	}
+	return indexMessageLinks(s.db, msg.MessageId)
 }
 
 // DeleteThenInsertMessage handles LSDeleteThenInsertMessage
@@ -378,7 +417,10 @@ func (s *Storage) DeleteThenInsertMessage(msg *table.LSDeleteThenInsertMessage)
 	`, msg.MessageId, msg.ThreadKey, msg.SenderId, msg.Text, msg.TimestampMs,
 		msg.IsUnsent, msg.IsForwarded, nullIfEmpty(msg.ReplySourceId), msg.ReplySnippet,
 		msg.EditCount, nullIfZero(msg.StickerId), msg.OfflineThreadingId, now)
-	return err
+	if err != nil {
+		return err
+	}
+	return indexMessageLinks(s.db, msg.MessageId)
 }
 
 // DeleteMessage marks a message as deleted (we keep it but clear the text)
@@ -387,6 +429,10 @@ func (s *Storage) DeleteMessage(threadKey int64, messageID string) error {
 		UPDATE messages SET text = NULL, is_unsent = TRUE, indexed_at = NULL
 		WHERE id = ? AND thread_id = ?
 	`, messageID, threadKey)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`DELETE FROM links WHERE message_id = ? AND thread_id = ?`, messageID, threadKey)
 	return err
 }
 
@@ -437,7 +483,8 @@ func (s *Storage) UpdateThreadSnippet(r *table.LSUpdateThreadSnippet) error {
 	return err
 }
 
-// UpsertAttachment stores an attachment record.
+// UpsertAttachment stores an attachment record. A new URL clears a failed
+// download so media-sync retries it.
 func (s *Storage) UpsertAttachment(a *table.LSInsertAttachment) error {
 	if a == nil || a.MessageId == "" {
 		return nil
@@ -468,35 +515,74 @@ func (s *Storage) UpsertAttachment(a *table.LSInsertAttachment) error {
 			file_size = COALESCE(excluded.file_size, attachments.file_size),
 			width = COALESCE(excluded.width, attachments.width),
 			height = COALESCE(excluded.height, attachments.height),
-			duration_ms = COALESCE(excluded.duration_ms, attachments.duration_ms)
+			duration_ms = COALESCE(excluded.duration_ms, attachments.duration_ms),
+			download_error = CASE
+				WHEN excluded.url IS NOT NULL AND excluded.url IS NOT attachments.url THEN NULL
+				ELSE attachments.download_error
+			END
 	`, attID, a.MessageId, int64(a.AttachmentType), nullIfEmpty(url), nullIfEmpty(a.Filename), nullIfEmpty(mime),
 		nullIfZero(a.Filesize), nullIfZero(a.PreviewWidth), nullIfZero(a.PreviewHeight), nullIfZero(a.PlayableDurationMs), now)
 	return err
 }
 
-// UpsertReaction inserts or updates a reaction
+// UpsertReaction inserts or updates a reaction. A changed reaction marks its
+// message unindexed, since chunks can include reaction summaries.
 func (s *Storage) UpsertReaction(r *table.LSUpsertReaction) error {
 	// Ensure actor exists
 	if err := s.EnsureContactExists(r.ActorId); err != nil {
 		return err
 	}
+	return s.upsertReaction(r.ThreadKey, r.MessageId, r.ActorId, r.Reaction, r.TimestampMs)
+}
 
-	_, err := s.db.Exec(`
-		INSERT INTO reactions (thread_id, message_id, actor_id, reaction, timestamp_ms)
-		VALUES (?, ?, ?, ?, ?)
-		ON CONFLICT(thread_id, message_id, actor_id) DO UPDATE SET
-			reaction = excluded.reaction,
-			timestamp_ms = excluded.timestamp_ms
-	`, r.ThreadKey, r.MessageId, r.ActorId, r.Reaction, r.TimestampMs)
-	return err
+// UpsertExportedReaction stores a reaction parsed from an export, like
+// UpsertReaction. The actor must already exist as a contact.
+func (s *Storage) UpsertExportedReaction(threadID int64, messageID string, actorID int64, reaction string, timestampMs int64) error {
+	return s.upsertReaction(threadID, messageID, actorID, reaction, timestampMs)
 }
 
-// DeleteReaction removes a reaction
+func (s *Storage) upsertReaction(threadID int64, messageID string, actorID int64, reaction string, timestampMs int64) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`
+			INSERT INTO reactions (thread_id, message_id, actor_id, reaction, timestamp_ms)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(thread_id, message_id, actor_id) DO UPDATE SET
+				reaction = excluded.reaction,
+				timestamp_ms = excluded.timestamp_ms
+			WHERE reactions.reaction != excluded.reaction OR reactions.timestamp_ms != excluded.timestamp_ms
+		`, threadID, messageID, actorID, reaction, timestampMs)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			if _, err := tx.Exec(`UPDATE messages SET indexed_at = NULL WHERE id = ?`, messageID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteReaction removes a reaction and marks its message unindexed
 func (s *Storage) DeleteReaction(r *table.LSDeleteReaction) error {
-	_, err := s.db.Exec(`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
 		DELETE FROM reactions WHERE thread_id = ? AND message_id = ? AND actor_id = ?
 	`, r.ThreadKey, r.MessageId, r.ActorId)
-	return err
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		if _, err := tx.Exec(`UPDATE messages SET indexed_at = NULL WHERE id = ?`, r.MessageId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 // SetSyncMetadata stores a sync metadata value
@@ -520,7 +606,7 @@ func (s *Storage) GetSyncMetadata(key string) (string, error) {
 	return value, err
 }
 
-// Query methods for later use (MCP server)
+// Query methods (also used by mcp-server)
 
 // SearchMessages performs a full-text search on messages
 func (s *Storage) SearchMessages(query string, limit int) ([]Message, error) {
@@ -530,7 +616,7 @@ func (s *Storage) SearchMessages(query string, limit int) ([]Message, error) {
 		FROM messages_fts
 		JOIN messages m ON messages_fts.docid = m.rowid
 		LEFT JOIN contacts c ON m.sender_id = c.id
-		LEFT JOIN threads t ON m.thread_id = t.id
+		LEFT JOIN thread_names t ON t.thread_id = m.thread_id
 		WHERE messages_fts MATCH ?
 		ORDER BY m.timestamp_ms DESC
 		LIMIT ?
@@ -556,27 +642,33 @@ func (s *Storage) SearchMessages(query string, limit int) ([]Message, error) {
 
 // GetConversation retrieves messages from a specific thread
 func (s *Storage) GetConversation(threadID int64, limit int, beforeTimestamp int64) ([]Message, error) {
+	return GetConversation(s.db, threadID, limit, beforeTimestamp)
+}
+
+// GetConversation retrieves the newest messages of a thread sent before
+// beforeTimestamp (0 = now), newest first
+func GetConversation(db *sql.DB, threadID int64, limit int, beforeTimestamp int64) ([]Message, error) {
 	var rows *sql.Rows
 	var err error
 
 	if beforeTimestamp > 0 {
-		rows, err = s.db.Query(`
+		rows, err = db.Query(`
 			SELECT m.id, m.thread_id, m.sender_id, m.text, m.timestamp_ms,
 				   c.name as sender_name, t.name as thread_name
 			FROM messages m
 			LEFT JOIN contacts c ON m.sender_id = c.id
-			LEFT JOIN threads t ON m.thread_id = t.id
+			LEFT JOIN thread_names t ON t.thread_id = m.thread_id
 			WHERE m.thread_id = ? AND m.timestamp_ms < ?
 			ORDER BY m.timestamp_ms DESC
 			LIMIT ?
 		`, threadID, beforeTimestamp, limit)
 	} else {
-		rows, err = s.db.Query(`
+		rows, err = db.Query(`
 			SELECT m.id, m.thread_id, m.sender_id, m.text, m.timestamp_ms,
 				   c.name as sender_name, t.name as thread_name
 			FROM messages m
 			LEFT JOIN contacts c ON m.sender_id = c.id
-			LEFT JOIN threads t ON m.thread_id = t.id
+			LEFT JOIN thread_names t ON t.thread_id = m.thread_id
 			WHERE m.thread_id = ?
 			ORDER BY m.timestamp_ms DESC
 			LIMIT ?
@@ -630,10 +722,16 @@ func (s *Storage) ListContacts() ([]Contact, error) {
 
 // ListThreads returns all threads ordered by last activity
 func (s *Storage) ListThreads(limit int) ([]Thread, error) {
-	rows, err := s.db.Query(`
-		SELECT id, thread_type, name, snippet, last_activity_ms, member_count
-		FROM threads
-		ORDER BY last_activity_ms DESC
+	return ListThreads(s.db, limit)
+}
+
+// ListThreads returns up to limit threads, most recently active first
+func ListThreads(db *sql.DB, limit int) ([]Thread, error) {
+	rows, err := db.Query(`
+		SELECT t.id, t.thread_type, n.name, t.snippet, t.last_activity_ms, t.member_count
+		FROM threads t
+		JOIN thread_names n ON n.thread_id = t.id
+		ORDER BY t.last_activity_ms DESC
 		LIMIT ?
 	`, limit)
 	if err != nil {
@@ -681,7 +779,7 @@ func (s *Storage) GetMessagesBySenderName(name string, limit int) ([]Message, er
 			   c.name as sender_name, t.name as thread_name
 		FROM messages m
 		LEFT JOIN contacts c ON m.sender_id = c.id
-		LEFT JOIN threads t ON m.thread_id = t.id
+		LEFT JOIN thread_names t ON t.thread_id = m.thread_id
 		WHERE c.name LIKE ? AND m.text IS NOT NULL AND m.text != ''
 		ORDER BY m.timestamp_ms DESC
 		LIMIT ?
@@ -705,25 +803,83 @@ func (s *Storage) GetMessagesBySenderName(name string, limit int) ([]Message, er
 	return messages, rows.Err()
 }
 
-// InsertExportedMessage inserts a message from an export file.
+// InsertExportedMessage inserts a message from an export file, recording
+// source as its provenance (see ExportProvenance).
 // Returns true if a new row was inserted, false if it already existed.
-func (s *Storage) InsertExportedMessage(messageID string, threadID, senderID int64, text string, timestampMs int64) (bool, error) {
+func (s *Storage) InsertExportedMessage(messageID string, threadID, senderID int64, text string, timestampMs int64, source string) (bool, error) {
 	now := time.Now().UnixMilli()
-	res, err := s.db.Exec(`
-		INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms, created_at)
-		VALUES (?, ?, ?, ?, ?, ?)
+	res, err := s.q().Exec(`
+		INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms, created_at, source)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(id) DO NOTHING
-	`, messageID, threadID, senderID, text, timestampMs, now)
+	`, messageID, threadID, senderID, text, timestampMs, now, source)
 	if err != nil {
 		return false, err
 	}
 	affected, _ := res.RowsAffected()
+	if affected > 0 && hasLinkCandidate(text) {
+		if err := indexMessageLinks(s.q(), messageID); err != nil {
+			return true, err
+		}
+	}
 	return affected > 0, nil
 }
 
+// SetExportedThreadParticipants adds the participants listed in an export to
+// the thread and derives member_count and 1:1 vs group thread_type from the
+// resulting participant count. Thread types set by live sync other than plain
+// 1:1/group (E2EE, community, ...) are kept.
+func (s *Storage) SetExportedThreadParticipants(threadID int64, contactIDs []int64) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(`
+			INSERT INTO thread_participants (thread_id, contact_id)
+			VALUES (?, ?)
+			ON CONFLICT(thread_id, contact_id) DO NOTHING
+		`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, contactID := range contactIDs {
+			if _, err := stmt.Exec(threadID, contactID); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(`
+			UPDATE threads SET
+				member_count = (SELECT COUNT(*) FROM thread_participants WHERE thread_id = threads.id),
+				thread_type = CASE
+					WHEN thread_type NOT IN (?, ?) THEN thread_type
+					WHEN (SELECT COUNT(*) FROM thread_participants WHERE thread_id = threads.id) > 2 THEN ?
+					ELSE ?
+				END,
+				updated_at = ?
+			WHERE id = ?
+		`, table.ONE_TO_ONE, table.GROUP_THREAD, table.GROUP_THREAD, table.ONE_TO_ONE, time.Now().UnixMilli(), threadID)
+		return err
+	})
+}
+
+// LastMessageTimestamp returns the newest stored message timestamp of a
+// thread, or 0 if it has no messages
+func (s *Storage) LastMessageTimestamp(threadID int64) (int64, error) {
+	var ts sql.NullInt64
+	err := s.db.QueryRow(`SELECT MAX(timestamp_ms) FROM messages WHERE thread_id = ?`, threadID).Scan(&ts)
+	return ts.Int64, err
+}
+
+// CountMessagesAfter counts the thread's messages sent after afterMs
+func (s *Storage) CountMessagesAfter(threadID, afterMs int64) (int64, error) {
+	var n int64
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE thread_id = ? AND timestamp_ms > ?`, threadID, afterMs).Scan(&n)
+	return n, err
+}
+
 // FindUniqueContactIDByName returns the contact ID if the name matches exactly one contact.
 func (s *Storage) FindUniqueContactIDByName(name string) (int64, bool, error) {
-	rows, err := s.db.Query(`SELECT id FROM contacts WHERE name = ? LIMIT 2`, name)
+	rows, err := s.q().Query(`SELECT id FROM contacts WHERE name = ? LIMIT 2`, name)
 	if err != nil {
 		return 0, false, err
 	}
@@ -746,9 +902,107 @@ func (s *Storage) FindUniqueContactIDByName(name string) (int64, bool, error) {
 	return 0, false, nil
 }
 
+// minPhoneSuffix is how many trailing digits two phone numbers must share to
+// match when only one of them has a country code
+const minPhoneSuffix = 9
+
+// FindUniqueContactIDByPhone returns the contact ID if the phone number
+// matches the username (handle) of exactly one contact. Numbers are compared
+// by their digits, so "+48 600 100 200" matches "0048600100200", and
+// "600100200" matches either.
+func (s *Storage) FindUniqueContactIDByPhone(phone string) (int64, bool, error) {
+	want := phoneDigits(phone)
+	if want == "" {
+		return 0, false, nil
+	}
+	rows, err := s.q().Query(`SELECT id, username FROM contacts WHERE username GLOB '*[0-9]*'`)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	var found int64
+	var n int
+	for rows.Next() {
+		var id int64
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			return 0, false, err
+		}
+		if phonesMatch(want, phoneDigits(username)) {
+			found = id
+			n++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, false, err
+	}
+	return found, n == 1, nil
+}
+
+// phoneDigits returns the digits of a phone number without an international
+// "00" prefix, or "" if s doesn't look like one
+func phoneDigits(s string) string {
+	s = strings.TrimSpace(s)
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' && b.Len() == 0, r == ' ', r == '-', r == '.', r == '(', r == ')':
+		default:
+			return ""
+		}
+	}
+	digits := b.String()
+	if !strings.HasPrefix(s, "+") {
+		digits = strings.TrimPrefix(digits, "00")
+	}
+	if len(digits) < 7 {
+		return ""
+	}
+	return digits
+}
+
+// phonesMatch compares the digits of two numbers, one of which may lack its
+// country code
+func phonesMatch(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	if a == b {
+		return true
+	}
+	short, long := a, b
+	if len(short) > len(long) {
+		short, long = long, short
+	}
+	return len(short) >= minPhoneSuffix && strings.HasSuffix(long, strings.TrimPrefix(short, "0"))
+}
+
+// SetContactHandleIfEmpty stores handle (e.g. a phone number from an export)
+// as the contact's username unless it already has one
+func (s *Storage) SetContactHandleIfEmpty(contactID int64, handle string) error {
+	_, err := s.q().Exec(`
+		UPDATE contacts SET username = ?, updated_at = ?
+		WHERE id = ? AND COALESCE(username, '') = ''
+	`, handle, time.Now().UnixMilli(), contactID)
+	return err
+}
+
 // FindUniqueThreadIDByName returns the thread ID if the name matches exactly one thread.
 func (s *Storage) FindUniqueThreadIDByName(name string) (int64, bool, error) {
-	rows, err := s.db.Query(`SELECT id FROM threads WHERE name = ? LIMIT 2`, name)
+	return findUniqueThreadIDByName(s.q(), name)
+}
+
+// FindUniqueThreadIDByName returns the thread ID if the name matches exactly
+// one thread, for read-only handles without a Storage.
+func FindUniqueThreadIDByName(db *sql.DB, name string) (int64, bool, error) {
+	return findUniqueThreadIDByName(db, name)
+}
+
+func findUniqueThreadIDByName(q querier, name string) (int64, bool, error) {
+	rows, err := q.Query(`SELECT thread_id FROM thread_names WHERE name = ? LIMIT 2`, name)
 	if err != nil {
 		return 0, false, err
 	}
@@ -771,6 +1025,34 @@ func (s *Storage) FindUniqueThreadIDByName(name string) (int64, bool, error) {
 	return 0, false, nil
 }
 
+// ThreadMemberNames maps the contact IDs of a thread's senders to their
+// display name there: the thread nickname, else the contact name. With
+// participants, listed members who never wrote are included too.
+func ThreadMemberNames(db *sql.DB, threadID int64, participants bool) (map[int64]string, error) {
+	rows, err := db.Query(`
+		SELECT c.id, COALESCE(NULLIF(tp.nickname, ''), c.name, '')
+		FROM contacts c
+		LEFT JOIN thread_participants tp ON tp.contact_id = c.id AND tp.thread_id = :thread
+		WHERE (:participants AND c.id IN (SELECT contact_id FROM thread_participants WHERE thread_id = :thread))
+		   OR c.id IN (SELECT DISTINCT sender_id FROM messages WHERE thread_id = :thread)
+	`, sql.Named("thread", threadID), sql.Named("participants", participants))
+	if err != nil {
+		return nil, fmt.Errorf("reading participants: %w", err)
+	}
+	defer rows.Close()
+
+	names := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	return names, rows.Err()
+}
+
 // IsMessageIndexed returns true if the message has an indexed_at timestamp.
 func (s *Storage) IsMessageIndexed(messageID string) (bool, error) {
 	var indexedAt sql.NullInt64
@@ -787,7 +1069,7 @@ func (s *Storage) IsMessageIndexed(messageID string) (bool, error) {
 // UpsertExportedAttachment stores an attachment from an export (best-effort metadata only).
 func (s *Storage) UpsertExportedAttachment(attachmentID, messageID string, attachmentType int64, url, filename string) error {
 	now := time.Now().UnixMilli()
-	_, err := s.db.Exec(`
+	_, err := s.q().Exec(`
 		INSERT INTO attachments (id, message_id, attachment_type, url, filename, created_at)
 		VALUES (?, ?, ?, ?, ?, ?)
 		ON CONFLICT(id) DO UPDATE SET
@@ -802,13 +1084,27 @@ func (s *Storage) UpsertExportedAttachment(attachmentID, messageID string, attac
 // HasMessage checks if a message with the given ID exists
 func (s *Storage) HasMessage(messageID string) (bool, error) {
 	var count int
-	err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE id = ?`, messageID).Scan(&count)
+	err := s.q().QueryRow(`SELECT COUNT(*) FROM messages WHERE id = ?`, messageID).Scan(&count)
 	if err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
 
+// HasContact checks if a contact with the given ID exists
+func (s *Storage) HasContact(id int64) (bool, error) {
+	var exists bool
+	err := s.q().QueryRow(`SELECT EXISTS (SELECT 1 FROM contacts WHERE id = ?)`, id).Scan(&exists)
+	return exists, err
+}
+
+// HasThread checks if a thread with the given ID exists
+func (s *Storage) HasThread(id int64) (bool, error) {
+	var exists bool
+	err := s.q().QueryRow(`SELECT EXISTS (SELECT 1 FROM threads WHERE id = ?)`, id).Scan(&exists)
+	return exists, err
+}
+
 // HasMessageByTimestamp checks if a message exists with the same thread and timestamp
 // This is used for deduplication when message IDs differ between sources
 func (s *Storage) HasMessageByTimestamp(threadID, timestampMs int64) (bool, error) {
@@ -823,6 +1119,30 @@ func (s *Storage) HasMessageByTimestamp(threadID, timestampMs int64) (bool, erro
 	return count > 0, nil
 }
 
+// SyncMessagesNear returns the text of the live-sync messages of a thread
+// within windowMs of timestampMs, for spotting an exported copy of a message
+// sync already stored under its real ID (import-export -dedup-sync)
+func (s *Storage) SyncMessagesNear(threadID, timestampMs, windowMs int64) ([]string, error) {
+	rows, err := s.q().Query(`
+		SELECT COALESCE(m.text, '') FROM messages m
+		WHERE m.thread_id = ? AND m.timestamp_ms BETWEEN ? AND ?
+		  AND `+sourceSQL+` = 'live'
+	`, threadID, timestampMs-windowMs, timestampMs+windowMs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var texts []string
+	for rows.Next() {
+		var text string
+		if err := rows.Scan(&text); err != nil {
+			return nil, err
+		}
+		texts = append(texts, text)
+	}
+	return texts, rows.Err()
+}
+
 // GetUnindexedMessages returns messages that haven't been vector indexed yet
 func (s *Storage) GetUnindexedMessages(limit int) ([]Message, error) {
 	rows, err := s.db.Query(`
@@ -830,7 +1150,7 @@ func (s *Storage) GetUnindexedMessages(limit int) ([]Message, error) {
 			   c.name as sender_name, t.name as thread_name
 		FROM messages m
 		LEFT JOIN contacts c ON m.sender_id = c.id
-		LEFT JOIN threads t ON m.thread_id = t.id
+		LEFT JOIN thread_names t ON t.thread_id = m.thread_id
 		WHERE m.indexed_at IS NULL AND m.text IS NOT NULL AND m.text != ''
 		ORDER BY m.timestamp_ms DESC
 		LIMIT ?
@@ -866,6 +1186,29 @@ func (s *Storage) GetUnindexedCount() (int64, error) {
 	return count, err
 }
 
+// GetUnindexedByThread returns the IDs of messages that were added, edited or
+// unsent since they were last indexed, grouped by thread. Unlike
+// GetUnindexedCount it includes messages without text, since an unsend
+// removes text a chunk may still hold.
+func (s *Storage) GetUnindexedByThread() (map[int64][]string, error) {
+	rows, err := s.db.Query(`SELECT thread_id, id FROM messages WHERE indexed_at IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byThread := make(map[int64][]string)
+	for rows.Next() {
+		var threadID int64
+		var id string
+		if err := rows.Scan(&threadID, &id); err != nil {
+			return nil, err
+		}
+		byThread[threadID] = append(byThread[threadID], id)
+	}
+	return byThread, rows.Err()
+}
+
 // MarkMessagesIndexed marks the given message IDs as indexed
 func (s *Storage) MarkMessagesIndexed(messageIDs []string) error {
 	if len(messageIDs) == 0 {
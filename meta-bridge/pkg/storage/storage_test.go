@@ -1,8 +1,16 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"go.mau.fi/mautrix-meta/pkg/messagix/table"
 )
@@ -103,6 +111,51 @@ func TestDeleteThenInsertMessage_DoesNotBreakReactions(t *testing.T) {
 	}
 }
 
+func TestReactions_MarkMessageUnindexed(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.InsertMessage(&table.LSInsertMessage{MessageId: "mid.1", ThreadKey: 2, SenderId: 1, Text: "hi", TimestampMs: 100}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	indexed := func() bool {
+		t.Helper()
+		var at sql.NullInt64
+		if err := s.db.QueryRow(`SELECT indexed_at FROM messages WHERE id = 'mid.1'`).Scan(&at); err != nil {
+			t.Fatalf("query indexed_at: %v", err)
+		}
+		return at.Valid
+	}
+	reaction := &table.LSUpsertReaction{ThreadKey: 2, MessageId: "mid.1", ActorId: 3, Reaction: "👍", TimestampMs: 200}
+
+	for _, step := range []struct {
+		name    string
+		apply   func() error
+		indexed bool
+	}{
+		{"new reaction", func() error { return s.UpsertReaction(reaction) }, false},
+		{"same reaction again", func() error { return s.UpsertReaction(reaction) }, true},
+		{"exported duplicate", func() error { return s.UpsertExportedReaction(2, "mid.1", 3, "👍", 200) }, true},
+		{"changed reaction", func() error { return s.UpsertExportedReaction(2, "mid.1", 3, "❤️", 300) }, false},
+		{"removed reaction", func() error {
+			return s.DeleteReaction(&table.LSDeleteReaction{ThreadKey: 2, MessageId: "mid.1", ActorId: 3})
+		}, false},
+	} {
+		if err := s.MarkMessagesIndexed([]string{"mid.1"}); err != nil {
+			t.Fatalf("MarkMessagesIndexed: %v", err)
+		}
+		if err := step.apply(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := indexed(); got != step.indexed {
+			t.Errorf("%s: indexed = %v, want %v", step.name, got, step.indexed)
+		}
+	}
+}
+
 func TestAddParticipant_StoresWatermarks(t *testing.T) {
 	s, err := New(":memory:")
 	if err != nil {
@@ -200,3 +253,1757 @@ func TestFTSTriggers_SkipEmptyAndNullText(t *testing.T) {
 		t.Fatalf("expected FTS match count 0 after delete, got %d", count)
 	}
 }
+
+func TestAvatarRefreshQueue_ClearedOnNewURL(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.EnsureContactExists(1); err != nil {
+		t.Fatalf("EnsureContactExists: %v", err)
+	}
+	if err := s.RecordAvatarFailure(1, 403, "https://cdn/old.jpg"); err != nil {
+		t.Fatalf("RecordAvatarFailure: %v", err)
+	}
+	if err := s.RecordAvatarFailure(1, 404, "https://cdn/old.jpg"); err != nil {
+		t.Fatalf("RecordAvatarFailure (again): %v", err)
+	}
+
+	pending, err := s.GetPendingAvatarRefreshes(0, 10)
+	if err != nil {
+		t.Fatalf("GetPendingAvatarRefreshes: %v", err)
+	}
+	if len(pending) != 1 || pending[0].FailureCount != 2 || pending[0].StatusCode != 404 {
+		t.Fatalf("unexpected pending refreshes: %+v", pending)
+	}
+
+	// Same (still broken) URL must not clear the entry
+	if err := s.UpsertContact(&table.LSDeleteThenInsertContact{Id: 1, ProfilePictureUrl: "https://cdn/old.jpg"}); err != nil {
+		t.Fatalf("UpsertContact (same URL): %v", err)
+	}
+	if pending, _ = s.GetPendingAvatarRefreshes(0, 10); len(pending) != 1 {
+		t.Fatalf("expected entry to remain for unchanged URL, got %d", len(pending))
+	}
+
+	if err := s.UpsertContact(&table.LSDeleteThenInsertContact{Id: 1, ProfilePictureUrl: "https://cdn/new.jpg"}); err != nil {
+		t.Fatalf("UpsertContact (new URL): %v", err)
+	}
+	if pending, _ = s.GetPendingAvatarRefreshes(0, 10); len(pending) != 0 {
+		t.Fatalf("expected entry to be cleared, got %d", len(pending))
+	}
+}
+
+func TestChanges_RecordsMutationsButNotIndexing(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.EnsureContactExists(1); err != nil {
+		t.Fatalf("EnsureContactExists: %v", err)
+	}
+	if err := s.EnsureThreadExistsWithName(2, ""); err != nil {
+		t.Fatalf("EnsureThreadExistsWithName: %v", err)
+	}
+
+	before, err := s.GetChanges(0, 100)
+	if err != nil {
+		t.Fatalf("GetChanges: %v", err)
+	}
+	cursor := before[len(before)-1].Seq
+
+	if err := s.InsertMessage(&table.LSInsertMessage{
+		MessageId:   "mid.1",
+		ThreadKey:   2,
+		SenderId:    1,
+		Text:        "hello",
+		TimestampMs: 123,
+	}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	if err := s.MarkMessagesIndexed([]string{"mid.1"}); err != nil {
+		t.Fatalf("MarkMessagesIndexed: %v", err)
+	}
+	if err := s.DeleteMessage(2, "mid.1"); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+
+	all, err := s.GetChanges(cursor, 100)
+	if err != nil {
+		t.Fatalf("GetChanges: %v", err)
+	}
+	var changes []Change
+	for _, c := range all {
+		if c.EntityType == "message" {
+			changes = append(changes, c)
+		}
+	}
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 message changes after cursor, got %d: %+v", len(changes), changes)
+	}
+	for i, op := range []string{"insert", "update"} {
+		c := changes[i]
+		if c.EntityType != "message" || c.EntityID != "mid.1" || c.ThreadID != 2 || c.Op != op {
+			t.Fatalf("change %d: unexpected %+v", i, c)
+		}
+	}
+}
+
+func TestChanges_RecordsThreadAndAttachmentDeletes(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	for _, id := range []int64{10, 20} {
+		if err := s.EnsureThreadExistsWithName(id, "Trip"); err != nil {
+			t.Fatalf("EnsureThreadExistsWithName: %v", err)
+		}
+	}
+	if err := s.EnsureContactExists(1); err != nil {
+		t.Fatalf("EnsureContactExists: %v", err)
+	}
+	if _, err := s.InsertExportedMessage("m1", 20, 1, "photo", 1, "facebook-export"); err != nil {
+		t.Fatalf("InsertExportedMessage: %v", err)
+	}
+	if _, err := s.db.Exec(`INSERT INTO attachments (id, message_id, attachment_type, created_at) VALUES ('a1', 'm1', 2, 0)`); err != nil {
+		t.Fatalf("insert attachment: %v", err)
+	}
+
+	before, err := s.GetChanges(0, 100)
+	if err != nil {
+		t.Fatalf("GetChanges: %v", err)
+	}
+	cursor := before[len(before)-1].Seq
+
+	if _, err := s.db.Exec(`DELETE FROM attachments WHERE id = 'a1'`); err != nil {
+		t.Fatalf("delete attachment: %v", err)
+	}
+	if err := s.MergeThreads(10, 20); err != nil {
+		t.Fatalf("MergeThreads: %v", err)
+	}
+
+	all, err := s.GetChanges(cursor, 100)
+	if err != nil {
+		t.Fatalf("GetChanges: %v", err)
+	}
+	deletes := map[string]Change{}
+	for _, c := range all {
+		if c.Op == "delete" {
+			deletes[c.EntityType+":"+c.EntityID] = c
+		}
+	}
+	if c, ok := deletes["attachment:a1"]; !ok || c.ThreadID != 20 {
+		t.Errorf("attachment delete: got %+v (recorded %v)", c, ok)
+	}
+	if c, ok := deletes["thread:20"]; !ok || c.ThreadID != 20 {
+		t.Errorf("merged thread delete: got %+v (recorded %v)", c, ok)
+	}
+}
+
+func TestUpsertStats_CountsDedupEditsAndFTSRewrites(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.EnsureContactExists(1); err != nil {
+		t.Fatalf("EnsureContactExists: %v", err)
+	}
+	if err := s.EnsureThreadExistsWithName(2, ""); err != nil {
+		t.Fatalf("EnsureThreadExistsWithName: %v", err)
+	}
+
+	msg := &table.LSInsertMessage{
+		MessageId:   "mid.1",
+		ThreadKey:   2,
+		SenderId:    1,
+		Text:        "hello",
+		TimestampMs: 123,
+	}
+	if err := s.InsertMessage(msg); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	// Redelivery: merged into the row, text kept, FTS row rewritten anyway
+	if err := s.InsertMessage(msg); err != nil {
+		t.Fatalf("InsertMessage (again): %v", err)
+	}
+	if inserted, err := s.InsertExportedMessage("mid.1", 2, 1, "hello", 123, "facebook-export"); err != nil || inserted {
+		t.Fatalf("InsertExportedMessage = %v, %v", inserted, err)
+	}
+	if err := s.UpsertMessage(&table.LSUpsertMessage{
+		MessageId:   "mid.1",
+		ThreadKey:   2,
+		SenderId:    1,
+		Text:        "hello, edited",
+		TimestampMs: 123,
+		EditCount:   1,
+	}); err != nil {
+		t.Fatalf("UpsertMessage: %v", err)
+	}
+
+	stats, err := s.GetUpsertStats()
+	if err != nil {
+		t.Fatalf("GetUpsertStats: %v", err)
+	}
+	want := UpsertStats{Inserted: 1, DedupSkipped: 3, TextChanged: 1, FTSRewritten: 2}
+	if stats != want {
+		t.Fatalf("GetUpsertStats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestPendingAttachments(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.InsertMessage(&table.LSInsertMessage{MessageId: "mid.1", ThreadKey: 2, SenderId: 1, TimestampMs: 123}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	if err := s.UpsertAttachment(&table.LSInsertAttachment{MessageId: "mid.1", AttachmentFbid: "att.1", ImageUrl: "https://cdn/1"}); err != nil {
+		t.Fatalf("UpsertAttachment: %v", err)
+	}
+	if err := s.UpsertE2EEAttachment(&E2EEAttachment{ID: "att.2", MessageID: "mid.1", Media: []byte{1}, MediaType: "WhatsApp Image Keys"}); err != nil {
+		t.Fatalf("UpsertE2EEAttachment: %v", err)
+	}
+
+	plain, err := s.GetPendingAttachments(10, false, false)
+	if err != nil || len(plain) != 1 || plain[0].ID != "att.1" || plain[0].URL != "https://cdn/1" {
+		t.Fatalf("GetPendingAttachments(plain) = %+v, %v", plain, err)
+	}
+	e2ee, err := s.GetPendingAttachments(10, true, false)
+	if err != nil || len(e2ee) != 1 || e2ee[0].ID != "att.2" || e2ee[0].E2EEMediaType != "WhatsApp Image Keys" {
+		t.Fatalf("GetPendingAttachments(e2ee) = %+v, %v", e2ee, err)
+	}
+
+	// A failed download is skipped until the URL is refreshed
+	if err := s.SetAttachmentDownloadError("att.1", "HTTP 403"); err != nil {
+		t.Fatalf("SetAttachmentDownloadError: %v", err)
+	}
+	if plain, _ := s.GetPendingAttachments(10, false, false); len(plain) != 0 {
+		t.Fatalf("failed attachment still pending: %+v", plain)
+	}
+	if plain, _ := s.GetPendingAttachments(10, false, true); len(plain) != 1 {
+		t.Fatalf("failed attachment not retried: %+v", plain)
+	}
+	if err := s.UpsertAttachment(&table.LSInsertAttachment{MessageId: "mid.1", AttachmentFbid: "att.1", ImageUrl: "https://cdn/1-fresh"}); err != nil {
+		t.Fatalf("UpsertAttachment (fresh URL): %v", err)
+	}
+	if plain, _ := s.GetPendingAttachments(10, false, false); len(plain) != 1 {
+		t.Fatalf("refreshed attachment not pending: %+v", plain)
+	}
+
+	if err := s.SetAttachmentDownloaded("att.1", "ab/abc.jpg", "abc", 42); err != nil {
+		t.Fatalf("SetAttachmentDownloaded: %v", err)
+	}
+	if path, err := GetAttachmentLocalPath(s.db, "att.1"); err != nil || path != "ab/abc.jpg" {
+		t.Fatalf("GetAttachmentLocalPath = %q, %v", path, err)
+	}
+	if path, err := GetAttachmentLocalPath(s.db, "att.missing"); err != nil || path != "" {
+		t.Fatalf("GetAttachmentLocalPath(missing) = %q, %v", path, err)
+	}
+	if plainCount, e2eeCount, err := s.CountPendingAttachments(); err != nil || plainCount != 0 || e2eeCount != 1 {
+		t.Fatalf("CountPendingAttachments = %d, %d, %v", plainCount, e2eeCount, err)
+	}
+}
+
+func TestStaleContacts_DeleteAndMerge(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	// 1 sends messages, 2 only has a read receipt, 3 only reacted, 4 is us
+	if err := s.SetSyncMetadata("current_user_id", "4"); err != nil {
+		t.Fatalf("SetSyncMetadata: %v", err)
+	}
+	if err := s.EnsureContactExists(4); err != nil {
+		t.Fatalf("EnsureContactExists: %v", err)
+	}
+	if err := s.InsertMessage(&table.LSInsertMessage{MessageId: "mid.1", ThreadKey: 10, SenderId: 1, Text: "hi", TimestampMs: 1}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	if err := s.UpdateReadReceipt(&table.LSUpdateReadReceipt{ThreadKey: 10, ContactId: 2, ReadWatermarkTimestampMs: 5}); err != nil {
+		t.Fatalf("UpdateReadReceipt: %v", err)
+	}
+	if err := s.UpsertReaction(&table.LSUpsertReaction{ThreadKey: 10, MessageId: "mid.1", ActorId: 3, Reaction: "👍"}); err != nil {
+		t.Fatalf("UpsertReaction: %v", err)
+	}
+
+	stale, err := s.ListStaleContacts(time.Now().Add(time.Minute).UnixMilli())
+	if err != nil {
+		t.Fatalf("ListStaleContacts: %v", err)
+	}
+	if len(stale) != 2 || stale[0].ID != 2 || stale[0].Threads != 1 || !stale[0].Deletable() ||
+		stale[1].ID != 3 || stale[1].Reactions != 1 || stale[1].Deletable() {
+		t.Fatalf("ListStaleContacts = %+v", stale)
+	}
+
+	deleted, err := s.DeleteStaleContacts([]int64{1, 2, 3, 4})
+	if err != nil || deleted != 1 {
+		t.Fatalf("DeleteStaleContacts = %d, %v", deleted, err)
+	}
+
+	if err := s.MergeContact(3, 1); err != nil {
+		t.Fatalf("MergeContact: %v", err)
+	}
+	var actor int64
+	if err := s.db.QueryRow(`SELECT actor_id FROM reactions WHERE message_id = 'mid.1'`).Scan(&actor); err != nil || actor != 1 {
+		t.Fatalf("reaction actor after merge = %d, %v", actor, err)
+	}
+	var contacts int64
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM contacts`).Scan(&contacts); err != nil || contacts != 2 {
+		t.Fatalf("contacts after cleanup = %d, %v", contacts, err)
+	}
+	if err := s.MergeContact(3, 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("MergeContact of a deleted contact = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMergeContacts_AliasesAndDuplicates(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	// 100 is Anna from live sync, 200 the same Anna from an export (name-hash ID)
+	for id, name := range map[int64]string{100: "Anna Nowak", 200: "anna  nowak", 300: "Bartek"} {
+		if err := s.EnsureContactExistsWithName(id, name); err != nil {
+			t.Fatalf("EnsureContactExistsWithName: %v", err)
+		}
+	}
+	if err := s.EnsureThreadExistsWithName(10, ""); err != nil {
+		t.Fatalf("EnsureThreadExistsWithName: %v", err)
+	}
+	if err := s.InsertMessage(&table.LSInsertMessage{MessageId: "mid.1", ThreadKey: 10, SenderId: 100, Text: "hi", TimestampMs: 1}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	for i, sender := range []int64{200, 200, 300} {
+		if _, err := s.InsertExportedMessage(fmt.Sprintf("%032x", i), 10, sender, "see https://example.com", int64(2+i), "facebook-export"); err != nil {
+			t.Fatalf("InsertExportedMessage: %v", err)
+		}
+	}
+	if _, err := s.db.Exec(`UPDATE messages SET indexed_at = 1`); err != nil {
+		t.Fatalf("marking indexed: %v", err)
+	}
+	if err := s.SetSyncMetadata("current_user_id", "200"); err != nil {
+		t.Fatalf("SetSyncMetadata: %v", err)
+	}
+
+	groups, err := s.ListDuplicateContacts()
+	if err != nil {
+		t.Fatalf("ListDuplicateContacts: %v", err)
+	}
+	if len(groups) != 1 || len(groups[0]) != 2 || groups[0][0].ID != 100 || groups[0][0].SyncMessages != 1 ||
+		groups[0][1].ID != 200 || groups[0][1].ExportMessages != 2 {
+		t.Fatalf("ListDuplicateContacts = %+v", groups)
+	}
+
+	if err := s.MergeContacts(100, 200); err != nil {
+		t.Fatalf("MergeContacts: %v", err)
+	}
+	var moved, unindexed, links int64
+	s.db.QueryRow(`SELECT COUNT(*), COUNT(*) FILTER (WHERE indexed_at IS NULL) FROM messages WHERE sender_id = 100`).Scan(&moved, &unindexed)
+	s.db.QueryRow(`SELECT COUNT(*) FROM links WHERE sender_id = 100`).Scan(&links)
+	if moved != 3 || unindexed != 2 || links != 2 {
+		t.Errorf("after merge: %d messages of 100 (%d unindexed), %d links; want 3 (2), 2", moved, unindexed, links)
+	}
+	if owner, _ := s.GetSyncMetadata("current_user_id"); owner != "100" {
+		t.Errorf("current_user_id = %q, want 100", owner)
+	}
+	if id, err := s.ResolveContactAlias(200); err != nil || id != 100 {
+		t.Errorf("ResolveContactAlias(200) = %d, %v; want 100", id, err)
+	}
+	if id, err := s.ResolveContactAlias(300); err != nil || id != 300 {
+		t.Errorf("ResolveContactAlias(300) = %d, %v; want 300", id, err)
+	}
+
+	// Merging on carries earlier aliases along; a failed merge changes nothing
+	if err := s.MergeContacts(300, 100, 999); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("MergeContacts with a missing contact = %v, want ErrNotFound", err)
+	}
+	if id, _ := s.ResolveContactAlias(100); id != 100 {
+		t.Fatalf("failed merge recorded an alias: 100 -> %d", id)
+	}
+	if err := s.MergeContacts(300, 100); err != nil {
+		t.Fatalf("MergeContacts: %v", err)
+	}
+	aliases, err := s.ListContactAliases()
+	if err != nil {
+		t.Fatalf("ListContactAliases: %v", err)
+	}
+	if len(aliases) != 2 || aliases[0].ContactID != 300 || aliases[1].ContactID != 300 {
+		t.Fatalf("ListContactAliases = %+v", aliases)
+	}
+	names := map[int64]string{}
+	for _, a := range aliases {
+		names[a.AliasID] = a.Name
+	}
+	if names[100] != "Anna Nowak" || names[200] != "anna  nowak" {
+		t.Errorf("alias names = %v", names)
+	}
+}
+
+func TestMergeThreads_AliasesAndDuplicates(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	// 10 is the synced thread, 20 the same conversation from an export
+	for id, name := range map[int64]string{10: "Trip 2019", 20: "trip  2019", 30: "Other"} {
+		if err := s.EnsureThreadExistsWithName(id, name); err != nil {
+			t.Fatalf("EnsureThreadExistsWithName: %v", err)
+		}
+	}
+	for _, id := range []int64{1, 2} {
+		if err := s.EnsureContactExists(id); err != nil {
+			t.Fatalf("EnsureContactExists: %v", err)
+		}
+	}
+	if err := s.InsertMessage(&table.LSInsertMessage{MessageId: "mid.1", ThreadKey: 10, SenderId: 1, Text: "hi", TimestampMs: 5}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	for i := range 2 {
+		if _, err := s.InsertExportedMessage(fmt.Sprintf("%032x", i), 20, 2, "see https://example.com", int64(1+i), "facebook-export"); err != nil {
+			t.Fatalf("InsertExportedMessage: %v", err)
+		}
+	}
+	if err := s.UpsertExportedReaction(20, fmt.Sprintf("%032x", 0), 1, "👍", 3); err != nil {
+		t.Fatalf("UpsertExportedReaction: %v", err)
+	}
+	if err := s.SetExportedThreadParticipants(20, []int64{1, 2}); err != nil {
+		t.Fatalf("SetExportedThreadParticipants: %v", err)
+	}
+	if err := s.TagThreads([]int64{20}, []string{"travel"}); err != nil {
+		t.Fatalf("TagThreads: %v", err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE chunks (chunk_id TEXT PRIMARY KEY, thread_id INTEGER)`,
+		`CREATE TABLE chunked_threads (thread_id INTEGER PRIMARY KEY, chunked_at INTEGER NOT NULL)`,
+		`INSERT INTO chunks VALUES ('c10', 10), ('c20', 20)`,
+		`INSERT INTO chunked_threads VALUES (10, 1), (20, 1)`,
+		`UPDATE messages SET indexed_at = 1`,
+	} {
+		if _, err := s.db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	groups, err := s.ListDuplicateThreads()
+	if err != nil {
+		t.Fatalf("ListDuplicateThreads: %v", err)
+	}
+	if len(groups) != 1 || len(groups[0]) != 2 || groups[0][0].ID != 10 || groups[0][1].ExportMessages != 2 {
+		t.Fatalf("ListDuplicateThreads = %+v", groups)
+	}
+
+	if err := s.MergeThreads(10, 20, 999); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("MergeThreads with a missing thread = %v, want ErrNotFound", err)
+	}
+	if err := s.MergeThreads(10, 20); err != nil {
+		t.Fatalf("MergeThreads: %v", err)
+	}
+
+	counts := map[string]int64{}
+	for name, query := range map[string]string{
+		"messages":     `SELECT COUNT(*) FROM messages WHERE thread_id = 10`,
+		"unindexed":    `SELECT COUNT(*) FROM messages WHERE thread_id = 10 AND indexed_at IS NULL`,
+		"reactions":    `SELECT COUNT(*) FROM reactions WHERE thread_id = 10`,
+		"links":        `SELECT COUNT(*) FROM links WHERE thread_id = 10`,
+		"participants": `SELECT COUNT(*) FROM thread_participants WHERE thread_id = 10`,
+		"tags":         `SELECT COUNT(*) FROM thread_tags WHERE thread_id = 10`,
+		"left":         `SELECT (SELECT COUNT(*) FROM threads WHERE id = 20) + (SELECT COUNT(*) FROM chunks WHERE thread_id = 20) + (SELECT COUNT(*) FROM chunked_threads WHERE thread_id = 20)`,
+	} {
+		var n int64
+		if err := s.db.QueryRow(query).Scan(&n); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		counts[name] = n
+	}
+	want := map[string]int64{"messages": 3, "unindexed": 2, "reactions": 1, "links": 2, "participants": 2, "tags": 1, "left": 0}
+	if fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("after merge: %v, want %v", counts, want)
+	}
+
+	if id, err := s.ResolveThreadAlias(20); err != nil || id != 10 {
+		t.Errorf("ResolveThreadAlias(20) = %d, %v; want 10", id, err)
+	}
+	aliases, err := s.ListThreadAliases()
+	if err != nil || len(aliases) != 1 || aliases[0].Name != "trip  2019" {
+		t.Errorf("ListThreadAliases = %+v, %v", aliases, err)
+	}
+}
+
+func TestGetUnindexedByThread(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.EnsureContactExists(1); err != nil {
+		t.Fatalf("EnsureContactExists: %v", err)
+	}
+	for _, thread := range []int64{2, 3} {
+		if err := s.EnsureThreadExistsWithName(thread, ""); err != nil {
+			t.Fatalf("EnsureThreadExistsWithName: %v", err)
+		}
+	}
+	for _, m := range []struct {
+		id     string
+		thread int64
+	}{{"mid.1", 2}, {"mid.2", 2}, {"mid.3", 3}} {
+		if err := s.InsertMessage(&table.LSInsertMessage{
+			MessageId:   m.id,
+			ThreadKey:   m.thread,
+			SenderId:    1,
+			Text:        "hello",
+			TimestampMs: 123,
+		}); err != nil {
+			t.Fatalf("InsertMessage: %v", err)
+		}
+	}
+	if err := s.MarkMessagesIndexed([]string{"mid.1", "mid.2", "mid.3"}); err != nil {
+		t.Fatalf("MarkMessagesIndexed: %v", err)
+	}
+	if pending, err := s.GetUnindexedByThread(); err != nil || len(pending) != 0 {
+		t.Fatalf("GetUnindexedByThread after marking = %v, %v", pending, err)
+	}
+
+	// An unsend clears the text but still needs its thread re-chunked
+	if err := s.DeleteMessage(2, "mid.2"); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	pending, err := s.GetUnindexedByThread()
+	if err != nil {
+		t.Fatalf("GetUnindexedByThread: %v", err)
+	}
+	if len(pending) != 1 || len(pending[2]) != 1 || pending[2][0] != "mid.2" {
+		t.Fatalf("GetUnindexedByThread = %v, want thread 2: [mid.2]", pending)
+	}
+}
+
+func TestMoveE2EETables(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(filepath.Join(dir, "main.db"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := s.db.Exec(`
+		CREATE TABLE whatsmeow_device (jid TEXT PRIMARY KEY, registration_id INTEGER);
+		INSERT INTO whatsmeow_device VALUES ('1.0:2@msgr', 42);
+	`); err != nil {
+		t.Fatalf("create legacy table: %v", err)
+	}
+
+	dstPath := filepath.Join(dir, "e2ee.db")
+	dst, err := OpenE2EEDB(dstPath)
+	if err != nil {
+		t.Fatalf("OpenE2EEDB: %v", err)
+	}
+	defer dst.Close()
+	// Destination schema has an extra column, as after a store upgrade
+	if _, err := dst.Exec(`CREATE TABLE whatsmeow_device (jid TEXT PRIMARY KEY, registration_id INTEGER, extra TEXT)`); err != nil {
+		t.Fatalf("create destination table: %v", err)
+	}
+
+	moved, err := s.MoveE2EETables(context.Background(), dstPath)
+	if err != nil {
+		t.Fatalf("MoveE2EETables: %v", err)
+	}
+	if moved != 1 {
+		t.Fatalf("expected 1 table moved, got %d", moved)
+	}
+
+	if has, err := s.HasE2EETables(); err != nil || has {
+		t.Fatalf("expected no whatsmeow tables left in main db (has=%v, err=%v)", has, err)
+	}
+	var regID int
+	if err := dst.QueryRow(`SELECT registration_id FROM whatsmeow_device WHERE jid = ?`, "1.0:2@msgr").Scan(&regID); err != nil {
+		t.Fatalf("query moved row: %v", err)
+	}
+	if regID != 42 {
+		t.Fatalf("expected registration_id 42, got %d", regID)
+	}
+}
+
+func TestThreadTags(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "tags.db"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	for _, id := range []int64{1, 2, 3} {
+		if err := s.EnsureThreadExistsWithName(id, ""); err != nil {
+			t.Fatalf("EnsureThreadExistsWithName: %v", err)
+		}
+	}
+
+	if err := s.TagThreads([]int64{1, 2}, []string{"Family", "family"}); err != nil {
+		t.Fatalf("TagThreads: %v", err)
+	}
+	if err := s.TagThreads([]int64{3}, []string{"work"}); err != nil {
+		t.Fatalf("TagThreads: %v", err)
+	}
+	if err := s.TagThreads([]int64{1}, []string{"bad tag"}); err == nil {
+		t.Fatalf("expected invalid tag to be rejected")
+	}
+
+	ids, err := ThreadIDsWithTags(s.db, []string{"family", "travel"})
+	if err != nil {
+		t.Fatalf("ThreadIDsWithTags: %v", err)
+	}
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Fatalf("unexpected family threads: %v", ids)
+	}
+
+	if err := s.UntagThreads([]int64{2}, []string{"family"}); err != nil {
+		t.Fatalf("UntagThreads: %v", err)
+	}
+	if removed, err := s.DeleteTag("work"); err != nil || removed != 1 {
+		t.Fatalf("DeleteTag: removed=%d err=%v", removed, err)
+	}
+
+	tags, err := ListTags(s.db)
+	if err != nil {
+		t.Fatalf("ListTags: %v", err)
+	}
+	if len(tags) != 1 || tags[0] != (TagCount{Tag: "family", Threads: 1}) {
+		t.Fatalf("unexpected tags: %+v", tags)
+	}
+}
+
+func TestUsage_SummarizesRunsSince(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	runs := []UsageRun{
+		{Kind: "index", Component: "embedding", Model: "emb", Requests: 2, PromptTokens: 100, TotalTokens: 100, CostUSD: 0.5, StartedAt: 10, FinishedAt: 20},
+		{Kind: "index", Component: "embedding", Model: "emb", Requests: 1, PromptTokens: 50, TotalTokens: 50, CostUSD: 0.25, StartedAt: 30, FinishedAt: 40},
+		{Kind: "search", Component: "embedding", Model: "emb", Requests: 9, PromptTokens: 9, TotalTokens: 9, StartedAt: 1, FinishedAt: 5},
+	}
+	for _, r := range runs {
+		if err := s.RecordUsage(r); err != nil {
+			t.Fatalf("RecordUsage: %v", err)
+		}
+	}
+
+	summaries, err := SummarizeUsage(s.db, 10)
+	if err != nil {
+		t.Fatalf("SummarizeUsage: %v", err)
+	}
+	want := UsageSummary{Kind: "index", Component: "embedding", Model: "emb", Runs: 2, Requests: 3, PromptTokens: 150, TotalTokens: 150, CostUSD: 0.75}
+	if len(summaries) != 1 || summaries[0] != want {
+		t.Fatalf("unexpected summaries: %+v", summaries)
+	}
+}
+
+func TestSetExportedThreadParticipants_DerivesThreadType(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	for _, id := range []int64{1, 2, 3} {
+		if err := s.EnsureContactExists(id); err != nil {
+			t.Fatalf("EnsureContactExists: %v", err)
+		}
+	}
+	if err := s.EnsureThreadExistsWithName(10, "dm"); err != nil {
+		t.Fatalf("EnsureThreadExistsWithName: %v", err)
+	}
+	if err := s.EnsureThreadExistsWithName(20, "group"); err != nil {
+		t.Fatalf("EnsureThreadExistsWithName: %v", err)
+	}
+
+	if err := s.SetExportedThreadParticipants(10, []int64{1, 2}); err != nil {
+		t.Fatalf("SetExportedThreadParticipants: %v", err)
+	}
+	if err := s.SetExportedThreadParticipants(20, []int64{1, 2, 3}); err != nil {
+		t.Fatalf("SetExportedThreadParticipants: %v", err)
+	}
+	// Re-importing is idempotent
+	if err := s.SetExportedThreadParticipants(20, []int64{1, 2, 3}); err != nil {
+		t.Fatalf("SetExportedThreadParticipants: %v", err)
+	}
+
+	for _, tc := range []struct {
+		threadID    int64
+		threadType  int64
+		memberCount int64
+	}{
+		{10, 1, 2},
+		{20, 2, 3},
+	} {
+		var threadType, memberCount int64
+		if err := s.db.QueryRow(`SELECT thread_type, member_count FROM threads WHERE id = ?`, tc.threadID).Scan(&threadType, &memberCount); err != nil {
+			t.Fatalf("query thread %d: %v", tc.threadID, err)
+		}
+		if threadType != tc.threadType || memberCount != tc.memberCount {
+			t.Fatalf("thread %d: got type=%d members=%d, want type=%d members=%d",
+				tc.threadID, threadType, memberCount, tc.threadType, tc.memberCount)
+		}
+	}
+}
+
+func TestGetMessageReceipts_SplitsByWatermark(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	for _, p := range []table.LSAddParticipantIdToGroupThread{
+		{ThreadKey: 5, ContactId: 1, ReadWatermarkTimestampMs: 1000},
+		{ThreadKey: 5, ContactId: 2, ReadWatermarkTimestampMs: 1500},
+		{ThreadKey: 5, ContactId: 3, ReadWatermarkTimestampMs: 900},
+	} {
+		if err := s.AddParticipant(&p); err != nil {
+			t.Fatalf("AddParticipant: %v", err)
+		}
+	}
+	if _, err := s.InsertExportedMessage("m1", 5, 1, "hello", 1000, "facebook-export"); err != nil {
+		t.Fatalf("InsertExportedMessage: %v", err)
+	}
+
+	mr, err := GetMessageReceipts(s.db, "m1")
+	if err != nil {
+		t.Fatalf("GetMessageReceipts: %v", err)
+	}
+	if len(mr.SeenBy) != 1 || mr.SeenBy[0].ContactID != 2 {
+		t.Fatalf("expected seen by contact 2 only, got %+v", mr.SeenBy)
+	}
+	if len(mr.NotSeenBy) != 1 || mr.NotSeenBy[0].ContactID != 3 {
+		t.Fatalf("expected not seen by contact 3 only, got %+v", mr.NotSeenBy)
+	}
+
+	if mr, err := GetMessageReceipts(s.db, "missing"); !errors.Is(err, ErrNotFound) || mr != nil {
+		t.Fatalf("expected ErrNotFound for missing message, got %+v, %v", mr, err)
+	}
+}
+
+func TestLastMessageTimestamp(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if ts, err := s.LastMessageTimestamp(1); err != nil || ts != 0 {
+		t.Fatalf("expected 0 for empty thread, got %d, %v", ts, err)
+	}
+
+	if err := s.EnsureContactExists(2); err != nil {
+		t.Fatalf("EnsureContactExists: %v", err)
+	}
+	if err := s.EnsureThreadExistsWithName(1, ""); err != nil {
+		t.Fatalf("EnsureThreadExistsWithName: %v", err)
+	}
+	for i, ts := range []int64{1000, 3000, 2000} {
+		if _, err := s.InsertExportedMessage(fmt.Sprintf("m%d", i), 1, 2, "hi", ts, "facebook-export"); err != nil {
+			t.Fatalf("InsertExportedMessage: %v", err)
+		}
+	}
+
+	if ts, err := s.LastMessageTimestamp(1); err != nil || ts != 3000 {
+		t.Fatalf("expected 3000, got %d, %v", ts, err)
+	}
+	if n, err := s.CountMessagesAfter(1, 1000); err != nil || n != 2 {
+		t.Fatalf("expected 2 messages after 1000, got %d, %v", n, err)
+	}
+}
+
+func TestFindUniqueContactIDByPhone(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	for id, name := range map[int64]string{1: "Anna", 2: "Bartek", 3: "Celina"} {
+		if err := s.EnsureContactExistsWithName(id, name); err != nil {
+			t.Fatalf("EnsureContactExistsWithName: %v", err)
+		}
+	}
+	if err := s.SetContactHandleIfEmpty(1, "+48 600 100 200"); err != nil {
+		t.Fatalf("SetContactHandleIfEmpty: %v", err)
+	}
+	if err := s.SetContactHandleIfEmpty(2, "bartek.k"); err != nil {
+		t.Fatalf("SetContactHandleIfEmpty: %v", err)
+	}
+	// Kept: Anna already has a handle
+	if err := s.SetContactHandleIfEmpty(1, "+48 700 000 000"); err != nil {
+		t.Fatalf("SetContactHandleIfEmpty: %v", err)
+	}
+
+	for _, tc := range []struct {
+		phone string
+		want  int64
+		ok    bool
+	}{
+		{"+48600100200", 1, true},
+		{"0048 600-100-200", 1, true},
+		{"600100200", 1, true}, // No country code
+		{"+48700000000", 0, false},
+		{"100200", 0, false}, // Too short to match a suffix
+		{"bartek.k", 0, false},
+	} {
+		id, ok, err := s.FindUniqueContactIDByPhone(tc.phone)
+		if err != nil || id != tc.want || ok != tc.ok {
+			t.Errorf("FindUniqueContactIDByPhone(%q) = %d, %v, %v; want %d, %v", tc.phone, id, ok, err, tc.want, tc.ok)
+		}
+	}
+
+	// Two contacts with the number: ambiguous
+	if err := s.SetContactHandleIfEmpty(3, "600 100 200"); err != nil {
+		t.Fatalf("SetContactHandleIfEmpty: %v", err)
+	}
+	if _, ok, err := s.FindUniqueContactIDByPhone("+48600100200"); err != nil || ok {
+		t.Errorf("expected no unique match for a shared number, got %v, %v", ok, err)
+	}
+}
+
+func TestOutboundQueue_Lifecycle(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.EnqueueOutbound("1", 10, "first"); err != nil {
+		t.Fatalf("EnqueueOutbound: %v", err)
+	}
+	if err := s.EnqueueOutbound("2", 10, "second"); err != nil {
+		t.Fatalf("EnqueueOutbound: %v", err)
+	}
+	if err := s.EnqueueOutbound("3", 10, "third"); err != nil {
+		t.Fatalf("EnqueueOutbound: %v", err)
+	}
+
+	// Third is sent; its ack isn't in the send response but arrives later
+	if err := s.RecordOutboundAttempt("3", nil, 2); err != nil {
+		t.Fatalf("RecordOutboundAttempt: %v", err)
+	}
+	if pending, _ := s.GetPendingOutbound(10); len(pending) != 2 {
+		t.Fatalf("expected the sent message to leave the queue, got %+v", pending)
+	}
+	if ok, err := s.MarkOutboundSent("3", "mid.3"); err != nil || !ok {
+		t.Fatalf("late MarkOutboundSent: %v, %v", ok, err)
+	}
+
+	// First message is confirmed, second keeps failing until it gives up
+	if ok, err := s.MarkOutboundSent("1", "mid.1"); err != nil || !ok {
+		t.Fatalf("MarkOutboundSent: %v, %v", ok, err)
+	}
+	if ok, _ := s.MarkOutboundSent("1", "mid.1"); ok {
+		t.Fatalf("expected repeated confirmation to be a no-op")
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.RecordOutboundAttempt("2", fmt.Errorf("offline"), 2); err != nil {
+			t.Fatalf("RecordOutboundAttempt: %v", err)
+		}
+	}
+
+	pending, err := s.GetPendingOutbound(10)
+	if err != nil {
+		t.Fatalf("GetPendingOutbound: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("expected empty queue, got %+v", pending)
+	}
+
+	var status, lastError string
+	if err := s.db.QueryRow(`SELECT status, last_error FROM outbound_queue WHERE otid = '2'`).Scan(&status, &lastError); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if status != OutboundFailed || lastError != "offline" {
+		t.Fatalf("unexpected state: status=%s error=%s", status, lastError)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.TagThreads([]int64{999}, []string{"work"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("tagging unknown thread: expected ErrNotFound, got %v", err)
+	}
+	if _, err := NormalizeTag("Not Valid!"); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("invalid tag: expected ErrBadRequest, got %v", err)
+	}
+
+	if err := s.EnqueueOutbound("otid-1", 1, "hi"); err != nil {
+		t.Fatalf("EnqueueOutbound: %v", err)
+	}
+	if err := s.EnqueueOutbound("otid-1", 1, "hi"); !errors.Is(err, ErrConflict) {
+		t.Fatalf("duplicate otid: expected ErrConflict, got %v", err)
+	}
+}
+
+func TestSlowQueries_RoundTrip(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	for i, took := range []int64{1500, 2500} {
+		if err := s.RecordSlowQuery(SlowQuery{
+			CreatedAt: int64(1000 + i),
+			RequestID: fmt.Sprintf("req-%d", i),
+			Query:     "wakacje",
+			Mode:      "hybrid",
+			Tags:      []string{"family", "travel"},
+			TookMs:    took,
+			Stages:    map[string]int64{"embed": took - 100, "bm25": 40},
+			Plan:      "SCAN fts VIRTUAL TABLE INDEX 0:M1",
+		}); err != nil {
+			t.Fatalf("RecordSlowQuery: %v", err)
+		}
+	}
+
+	got, err := ListSlowQueries(s.db, 1001, 10)
+	if err != nil {
+		t.Fatalf("ListSlowQueries: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 query since 1001, got %d", len(got))
+	}
+	q := got[0]
+	if q.RequestID != "req-1" || q.TookMs != 2500 || q.Stages["embed"] != 2400 || len(q.Tags) != 2 || q.Plan == "" {
+		t.Fatalf("unexpected slow query: %+v", q)
+	}
+}
+
+func TestMigrations_DownUpRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	s, err := New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	statuses, err := GetMigrationStatus(s.db)
+	if err != nil {
+		t.Fatalf("GetMigrationStatus: %v", err)
+	}
+	for _, st := range statuses {
+		if !st.Applied || st.Modified {
+			t.Fatalf("fresh database should be baselined, got %+v", st)
+		}
+	}
+
+	reverted, err := MigrateDown(s.db, 0)
+	if err != nil {
+		t.Fatalf("MigrateDown: %v", err)
+	}
+	if len(reverted) != LatestSchemaVersion() || reverted[0] != LatestSchemaVersion() {
+		t.Fatalf("expected all migrations reverted newest first, got %v", reverted)
+	}
+	if _, err := s.db.Exec(`SELECT indexed_at FROM messages`); err == nil {
+		t.Fatalf("expected indexed_at to be dropped")
+	}
+	if v, _ := legacySchemaVersion(s.db); v != 0 {
+		t.Fatalf("expected legacy schema_version 0, got %d", v)
+	}
+
+	applied, err := MigrateUp(s.db, 2)
+	if err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	if len(applied) != 2 {
+		t.Fatalf("expected migrations 1-2 applied, got %v", applied)
+	}
+	s.Close()
+
+	// Reopening applies the rest before the schema is (re)created
+	s, err = New(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	if v, _ := legacySchemaVersion(s.db); v != LatestSchemaVersion() {
+		t.Fatalf("expected schema_version %d after reopen, got %d", LatestSchemaVersion(), v)
+	}
+	if _, err := s.db.Exec(`SELECT read_watermark_ms FROM thread_participants`); err != nil {
+		t.Fatalf("expected migration 3 re-applied: %v", err)
+	}
+}
+
+func TestMigrations_LegacyVersionAndChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	s, err := New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// Simulate a database from before schema_migrations existed
+	if _, err := s.db.Exec(`DROP TABLE schema_migrations`); err != nil {
+		t.Fatalf("drop: %v", err)
+	}
+	statuses, err := GetMigrationStatus(s.db)
+	if err != nil {
+		t.Fatalf("GetMigrationStatus: %v", err)
+	}
+	for _, st := range statuses {
+		if !st.Applied {
+			t.Fatalf("expected legacy schema_version to be imported, got %+v", st)
+		}
+	}
+
+	if _, err := s.db.Exec(`UPDATE schema_migrations SET checksum = 'stale' WHERE version = 1`); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	s.Close()
+	if _, err := New(path); err == nil || !strings.Contains(err.Error(), "modified") {
+		t.Fatalf("expected checksum mismatch error, got %v", err)
+	}
+}
+
+func TestOpenExisting_RequiresCurrentSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	s, err := New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := MigrateDown(s.db, LatestSchemaVersion()-1); err != nil {
+		t.Fatalf("MigrateDown: %v", err)
+	}
+	s.Close()
+
+	// Twice: OpenExisting must not migrate the database itself
+	for i := 0; i < 2; i++ {
+		if _, err := OpenExisting(path); !errors.Is(err, ErrSchemaBehind) {
+			t.Fatalf("expected ErrSchemaBehind, got %v", err)
+		}
+	}
+	s, err = New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	s.Close()
+
+	s, err = OpenExisting(path)
+	if err != nil {
+		t.Fatalf("OpenExisting on a current schema: %v", err)
+	}
+	s.Close()
+}
+
+func TestListSourceMonths_ClassifiesBySource(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.EnsureContactExists(1); err != nil {
+		t.Fatalf("EnsureContactExists: %v", err)
+	}
+	if err := s.EnsureThreadExistsWithName(7, "Trip"); err != nil {
+		t.Fatalf("EnsureThreadExistsWithName: %v", err)
+	}
+	jan2015 := int64(1420070400000)
+	for _, m := range []struct {
+		id, source string
+		ts         int64
+	}{
+		{"0123456789abcdef0123456789abcdef", ExportProvenance("facebook"), jan2015},
+		{"whatsapp-1", ExportProvenance("whatsapp"), jan2015 + 1000},
+		{"sample-1", ProvenanceImportSample, jan2015 + 2000},
+	} {
+		if _, err := s.InsertExportedMessage(m.id, 7, 1, "hi", m.ts, m.source); err != nil {
+			t.Fatalf("InsertExportedMessage: %v", err)
+		}
+	}
+	if err := s.InsertMessage(&table.LSInsertMessage{MessageId: "mid.$abc", ThreadKey: 7, SenderId: 1, Text: "hi", TimestampMs: jan2015 + 3000}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	// A row without a recorded source falls back to the ID format
+	if _, err := s.db.Exec(`UPDATE messages SET source = '' WHERE id = '0123456789abcdef0123456789abcdef'`); err != nil {
+		t.Fatalf("clear source: %v", err)
+	}
+
+	got, err := ListSourceMonths(s.db, 7)
+	if err != nil {
+		t.Fatalf("ListSourceMonths: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected export, sample and live rows, got %+v", got)
+	}
+	if got[0].Source != ProvenanceExport || got[0].Messages != 2 || got[0].Month != "2015-01" || got[0].ThreadName != "Trip" {
+		t.Fatalf("unexpected export row: %+v", got[0])
+	}
+	if got[1].Source != ProvenanceImportSample || got[1].Messages != 1 {
+		t.Fatalf("unexpected sample row: %+v", got[1])
+	}
+	if got[2].Source != ProvenanceLive || got[2].Messages != 1 {
+		t.Fatalf("unexpected live row: %+v", got[2])
+	}
+
+	if texts, err := s.SyncMessagesNear(7, jan2015, 10000); err != nil || len(texts) != 1 {
+		t.Fatalf("SyncMessagesNear = %q, %v; want only the live message", texts, err)
+	}
+}
+
+func TestMessageSource_Recorded(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.InsertMessage(&table.LSInsertMessage{MessageId: "mid.$live", ThreadKey: 7, SenderId: 1, Text: "hi", TimestampMs: 1000}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	if _, err := s.InsertExportedMessage("0123456789abcdef0123456789abcdef", 7, 1, "hi", 1000, ExportProvenance("messenger")); err != nil {
+		t.Fatalf("InsertExportedMessage: %v", err)
+	}
+
+	for id, want := range map[string]string{
+		"mid.$live":                        ProvenanceLive,
+		"0123456789abcdef0123456789abcdef": "messenger-export",
+	} {
+		var got string
+		if err := s.db.QueryRow(`SELECT source FROM messages WHERE id = ?`, id).Scan(&got); err != nil {
+			t.Fatalf("reading source of %s: %v", id, err)
+		}
+		if got != want {
+			t.Errorf("source of %s = %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestBegin_CommitsConversationWithCheckpoint(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	importConversation := func(id, text string, commit bool) {
+		tx, err := s.Begin()
+		if err != nil {
+			t.Fatalf("Begin: %v", err)
+		}
+		defer tx.Rollback()
+		for id, name := range map[int64]string{1: "Anna", 2: "Bartek"} {
+			if err := tx.EnsureContactExistsWithName(id, name); err != nil {
+				t.Fatalf("EnsureContactExistsWithName: %v", err)
+			}
+		}
+		if err := tx.EnsureThreadExistsWithName(7, "Trip"); err != nil {
+			t.Fatalf("EnsureThreadExistsWithName: %v", err)
+		}
+		if err := tx.SetExportedThreadParticipants(7, []int64{1, 2}); err != nil {
+			t.Fatalf("SetExportedThreadParticipants: %v", err)
+		}
+		if _, err := tx.InsertExportedMessage(id, 7, 1, text, 1000, ExportProvenance("facebook")); err != nil {
+			t.Fatalf("InsertExportedMessage: %v", err)
+		}
+		if err := tx.SetImportCheckpoint("export.zip", id, ImportCheckpoint{Imported: 1}); err != nil {
+			t.Fatalf("SetImportCheckpoint: %v", err)
+		}
+		if commit {
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit: %v", err)
+			}
+		}
+	}
+	importConversation("0123456789abcdef0123456789abcdef", "see https://example.com", true)
+	importConversation("fedcba9876543210fedcba9876543210", "interrupted", false)
+
+	for id, want := range map[string]bool{
+		"0123456789abcdef0123456789abcdef": true,
+		"fedcba9876543210fedcba9876543210": false,
+	} {
+		if has, _ := s.HasMessage(id); has != want {
+			t.Errorf("message %s stored = %v, want %v", id, has, want)
+		}
+		if _, ok, _ := s.GetImportCheckpoint("export.zip", id); ok != want {
+			t.Errorf("checkpoint %s = %v, want %v", id, ok, want)
+		}
+	}
+	if stats, _ := s.GetStats(); stats.ThreadCount != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+	var links int
+	s.db.QueryRow(`SELECT COUNT(*) FROM links`).Scan(&links)
+	if links != 1 {
+		t.Errorf("links = %d, want 1", links)
+	}
+
+	if err := s.ClearImportCheckpoints("export.zip"); err != nil {
+		t.Fatalf("ClearImportCheckpoints: %v", err)
+	}
+	if n, _ := s.CountImportCheckpoints("export.zip"); n != 0 {
+		t.Errorf("%d checkpoints left", n)
+	}
+}
+
+func TestTranscripts_PendingAndReindex(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.InsertMessage(&table.LSInsertMessage{MessageId: "mid.1", ThreadKey: 2, SenderId: 1, TimestampMs: 123}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	for _, a := range []*table.LSInsertAttachment{
+		{MessageId: "mid.1", AttachmentFbid: "att.voice", AttachmentType: table.AttachmentTypeAudio, PlayableUrl: "https://cdn/v"},
+		{MessageId: "mid.1", AttachmentFbid: "att.image", AttachmentType: table.AttachmentTypeImage, ImageUrl: "https://cdn/i"},
+	} {
+		if err := s.UpsertAttachment(a); err != nil {
+			t.Fatalf("UpsertAttachment: %v", err)
+		}
+	}
+
+	// Not downloaded yet
+	if pending, _ := s.GetPendingTranscriptions(10, false); len(pending) != 0 {
+		t.Fatalf("undownloaded attachment pending: %+v", pending)
+	}
+	if ready, waiting, err := s.CountPendingTranscriptions(); err != nil || ready != 0 || waiting != 1 {
+		t.Fatalf("CountPendingTranscriptions = %d, %d, %v", ready, waiting, err)
+	}
+
+	for _, id := range []string{"att.voice", "att.image"} {
+		if err := s.SetAttachmentDownloaded(id, "ab/"+id, "ab", 1); err != nil {
+			t.Fatalf("SetAttachmentDownloaded: %v", err)
+		}
+	}
+	pending, err := s.GetPendingTranscriptions(10, false)
+	if err != nil || len(pending) != 1 || pending[0].AttachmentID != "att.voice" || pending[0].LocalPath != "ab/att.voice" {
+		t.Fatalf("GetPendingTranscriptions = %+v, %v", pending, err)
+	}
+
+	// A failure is skipped until retried
+	if err := s.SetTranscriptError("att.voice", "mid.1", "HTTP 500"); err != nil {
+		t.Fatalf("SetTranscriptError: %v", err)
+	}
+	if pending, _ := s.GetPendingTranscriptions(10, false); len(pending) != 0 {
+		t.Fatalf("failed transcription still pending: %+v", pending)
+	}
+	if pending, _ := s.GetPendingTranscriptions(10, true); len(pending) != 1 {
+		t.Fatalf("failed transcription not retried: %+v", pending)
+	}
+
+	// Saving a transcript marks the message for re-indexing
+	if err := s.MarkMessagesIndexed([]string{"mid.1"}); err != nil {
+		t.Fatalf("MarkMessagesIndexed: %v", err)
+	}
+	if err := s.SaveTranscript("att.voice", "mid.1", "see you at noon", "en", "whisper-1"); err != nil {
+		t.Fatalf("SaveTranscript: %v", err)
+	}
+	if pending, _ := s.GetPendingTranscriptions(10, true); len(pending) != 0 {
+		t.Fatalf("transcribed attachment still pending: %+v", pending)
+	}
+	if indexed, err := s.IsMessageIndexed("mid.1"); err != nil || indexed {
+		t.Fatalf("IsMessageIndexed after SaveTranscript = %v, %v", indexed, err)
+	}
+	var text string
+	var transcriptErr sql.NullString
+	if err := s.db.QueryRow(`SELECT text, error FROM attachment_transcripts WHERE attachment_id = 'att.voice'`).Scan(&text, &transcriptErr); err != nil {
+		t.Fatalf("reading transcript: %v", err)
+	}
+	if text != "see you at noon" || transcriptErr.Valid {
+		t.Fatalf("transcript = %q, error %v", text, transcriptErr)
+	}
+}
+
+func TestCaptions_PendingImagesAndExports(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.InsertMessage(&table.LSInsertMessage{MessageId: "mid.1", ThreadKey: 2, SenderId: 1, TimestampMs: 123}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	for _, a := range []*table.LSInsertAttachment{
+		{MessageId: "mid.1", AttachmentFbid: "att.photo", AttachmentType: table.AttachmentTypeImage, ImageUrl: "https://cdn/p"},
+		{MessageId: "mid.1", AttachmentFbid: "att.sticker", AttachmentType: table.AttachmentTypeSticker, ImageUrl: "https://cdn/s", AttachmentMimeType: "image/png"},
+	} {
+		if err := s.UpsertAttachment(a); err != nil {
+			t.Fatalf("UpsertAttachment: %v", err)
+		}
+		if err := s.SetAttachmentDownloaded(a.AttachmentFbid, "ab/"+a.AttachmentFbid, "ab", 1); err != nil {
+			t.Fatalf("SetAttachmentDownloaded: %v", err)
+		}
+	}
+	if err := s.UpsertExportedAttachment("att.export", "mid.1", int64(table.AttachmentTypeImage), "messages/inbox/x/photos/1.jpg", "1.jpg"); err != nil {
+		t.Fatalf("UpsertExportedAttachment: %v", err)
+	}
+
+	pending, err := s.GetPendingCaptions(10, false, false)
+	if err != nil || len(pending) != 1 || pending[0].AttachmentID != "att.photo" {
+		t.Fatalf("GetPendingCaptions = %+v, %v", pending, err)
+	}
+	pending, err = s.GetPendingCaptions(10, true, false)
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("GetPendingCaptions(exported) = %+v, %v", pending, err)
+	}
+
+	if err := s.SaveCaption("att.photo", "mid.1", "A cat holding a sign that says hello", "llava"); err != nil {
+		t.Fatalf("SaveCaption: %v", err)
+	}
+	if err := s.SetCaptionError("att.export", "mid.1", "HTTP 500"); err != nil {
+		t.Fatalf("SetCaptionError: %v", err)
+	}
+	if pending, _ := s.GetPendingCaptions(10, true, false); len(pending) != 0 {
+		t.Fatalf("processed images still pending: %+v", pending)
+	}
+	if pending, _ := s.GetPendingCaptions(10, true, true); len(pending) != 1 || pending[0].URL != "messages/inbox/x/photos/1.jpg" {
+		t.Fatalf("failed export image not retried: %+v", pending)
+	}
+	if indexed, err := s.IsMessageIndexed("mid.1"); err != nil || indexed {
+		t.Fatalf("IsMessageIndexed after SaveCaption = %v, %v", indexed, err)
+	}
+}
+
+func TestChunkRetrievals_ColdSegments(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	// The chunks table is created by ragindex; only the columns read here
+	for _, q := range []string{
+		`CREATE TABLE chunks (chunk_id TEXT PRIMARY KEY, thread_id INTEGER, thread_name TEXT, session_idx INTEGER,
+			char_count INTEGER, start_timestamp_ms INTEGER, end_timestamp_ms INTEGER, is_indexable INTEGER)`,
+		`INSERT INTO chunks VALUES
+			('a0', 1, 'Trip', 0, 500, 100, 200, 1),
+			('a1', 1, 'Trip', 0, 400, 200, 300, 1),
+			('b0', 1, 'Trip', 1, 300, 900, 950, 1),
+			('c0', 2, 'Work', 0, 800, 100, 400, 1),
+			('x0', 2, 'Work', 1, 10, 500, 500, 0)`,
+	} {
+		if _, err := s.db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+
+	if err := s.RecordChunkRetrievals(map[string]int{"a1": 2, "b0": 1}, 1000); err != nil {
+		t.Fatalf("RecordChunkRetrievals: %v", err)
+	}
+	if err := s.RecordChunkRetrievals(map[string]int{"b0": 1}, 5000); err != nil {
+		t.Fatalf("RecordChunkRetrievals: %v", err)
+	}
+
+	var count, last int64
+	if err := s.db.QueryRow(`SELECT retrieval_count, last_retrieved_at FROM chunk_retrievals WHERE chunk_id = 'b0'`).Scan(&count, &last); err != nil {
+		t.Fatalf("query b0: %v", err)
+	}
+	if count != 2 || last != 5000 {
+		t.Fatalf("b0: count=%d last=%d, want 2/5000", count, last)
+	}
+
+	// Never retrieved: only Work session 0 (session 1 is not indexable)
+	cold, err := ListColdSegments(s.db, 0, 10)
+	if err != nil {
+		t.Fatalf("ListColdSegments: %v", err)
+	}
+	if len(cold) != 1 || cold[0].ThreadID != 2 || cold[0].SessionIdx != 0 || cold[0].Chars != 800 {
+		t.Fatalf("never retrieved = %+v, want Work session 0", cold)
+	}
+
+	// Not retrieved since 2000: Trip session 0 (last hit at 1000) joins it,
+	// ahead of the smaller Work session
+	cold, err = ListColdSegments(s.db, 2000, 10)
+	if err != nil {
+		t.Fatalf("ListColdSegments: %v", err)
+	}
+	if len(cold) != 2 || cold[0].ThreadID != 1 || cold[0].SessionIdx != 0 || cold[0].Chunks != 2 || cold[0].LastRetrievedAt != 1000 {
+		t.Fatalf("cold since 2000 = %+v", cold)
+	}
+
+	coverage, err := GetRetrievalCoverage(s.db, 2000)
+	if err != nil {
+		t.Fatalf("GetRetrievalCoverage: %v", err)
+	}
+	if coverage.Chunks != 4 || coverage.Retrieved != 1 {
+		t.Fatalf("coverage = %+v, want 4 chunks, 1 retrieved", coverage)
+	}
+}
+
+func TestLinks_IndexedOnWriteAndBackfilled(t *testing.T) {
+	urls, domains := ExtractLinks("see https://WWW.Example.com/a?b=1, (www.foo.pl/x) and https://example.com/a?b=1. http://localhost:8080 http://10.0.0.1/")
+	if strings.Join(urls, " ") != "https://WWW.Example.com/a?b=1 www.foo.pl/x https://example.com/a?b=1 http://10.0.0.1/" ||
+		strings.Join(domains, " ") != "example.com foo.pl example.com 10.0.0.1" {
+		t.Fatalf("ExtractLinks = %q %q", urls, domains)
+	}
+
+	s, err := New(filepath.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.EnsureContactExistsWithName(1, "Anna"); err != nil {
+		t.Fatalf("EnsureContactExistsWithName: %v", err)
+	}
+	for _, id := range []int64{2, 3} {
+		if err := s.EnsureThreadExistsWithName(id, fmt.Sprintf("Thread %d", id)); err != nil {
+			t.Fatalf("EnsureThreadExistsWithName: %v", err)
+		}
+	}
+
+	if err := s.InsertMessage(&table.LSInsertMessage{MessageId: "mid.1", ThreadKey: 2, SenderId: 1,
+		Text: "recipe https://blog.example.com/pierogi", TimestampMs: 100}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	if err := s.UpsertMessage(&table.LSUpsertMessage{MessageId: "mid.2", ThreadKey: 2, SenderId: 1,
+		Text: "https://youtu.be/abc", TimestampMs: 200}); err != nil {
+		t.Fatalf("UpsertMessage: %v", err)
+	}
+	// An edit replaces the links of the message
+	if err := s.UpsertMessage(&table.LSUpsertMessage{MessageId: "mid.2", ThreadKey: 2, SenderId: 1,
+		Text: "better: https://example.com/pierogi", TimestampMs: 200}); err != nil {
+		t.Fatalf("UpsertMessage (edit): %v", err)
+	}
+	if _, err := s.InsertExportedMessage("mid.3", 3, 1, "www.example.com/x", 300, "facebook-export"); err != nil {
+		t.Fatalf("InsertExportedMessage: %v", err)
+	}
+	if _, err := s.InsertExportedMessage("mid.4", 3, 1, "gone https://foo.pl", 400, "facebook-export"); err != nil {
+		t.Fatalf("InsertExportedMessage: %v", err)
+	}
+	if err := s.DeleteMessage(3, "mid.4"); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	// Written behind Storage's back, found by IndexLinks, which also goes
+	// over the messages above again as they're past its cursor
+	if _, err := s.db.Exec(`INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms, created_at)
+		VALUES ('mid.5', 3, 1, 'direct http://foo.pl/pierogi', 500, 0)`); err != nil {
+		t.Fatalf("insert mid.5: %v", err)
+	}
+	if n, err := s.IndexLinks(); err != nil || n != 4 {
+		t.Fatalf("IndexLinks = %d, %v; want 4", n, err)
+	}
+	if n, err := s.IndexLinks(); err != nil || n != 0 {
+		t.Fatalf("second IndexLinks = %d, %v; want 0", n, err)
+	}
+
+	links, total, err := ListLinks(s.db, LinkFilter{}, 10, 0)
+	if err != nil {
+		t.Fatalf("ListLinks: %v", err)
+	}
+	if total != 4 || len(links) != 4 || links[0].MessageID != "mid.5" || links[3].URL != "https://blog.example.com/pierogi" {
+		t.Fatalf("all links = %d %+v", total, links)
+	}
+	if links[3].ThreadName != "Thread 2" || links[3].SenderName != "Anna" {
+		t.Fatalf("link names = %+v", links[3])
+	}
+
+	// The domain filter takes subdomains and pasted URLs; q matches URL or text
+	links, total, err = ListLinks(s.db, LinkFilter{Domain: "https://www.Example.com/", Query: "pierogi"}, 10, 0)
+	if err != nil {
+		t.Fatalf("ListLinks (filtered): %v", err)
+	}
+	if total != 2 || links[0].MessageID != "mid.2" || links[1].MessageID != "mid.1" {
+		t.Fatalf("example.com pierogi = %d %+v", total, links)
+	}
+
+	facets, err := LinkDomains(s.db, LinkFilter{Domain: "example.com", Query: "pierogi"}, 10)
+	if err != nil {
+		t.Fatalf("LinkDomains: %v", err)
+	}
+	want := []DomainCount{{"blog.example.com", 1}, {"example.com", 1}, {"foo.pl", 1}}
+	if fmt.Sprint(facets) != fmt.Sprint(want) {
+		t.Fatalf("facets = %+v, want %+v", facets, want)
+	}
+}
+
+func TestThreadNames_DerivedForUnnamedOneToOne(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "names.db"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	for _, stmt := range []string{
+		`INSERT INTO sync_metadata (key, value, updated_at) VALUES ('current_user_id', '100', 0)`,
+		`INSERT INTO contacts (id, name, created_at, updated_at) VALUES (100, 'Me', 0, 0), (11, 'Anna Nowak', 0, 0), (12, '', 0, 0), (13, 'Bartek', 0, 0)`,
+		`INSERT INTO threads (id, thread_type, name, created_at, updated_at) VALUES
+			(1, 2, 'Chorwacja 2019', 0, 0),
+			(11, 1, NULL, 0, 0),
+			(12, 1, '', 0, 0),
+			(13, 1, '', 0, 0),
+			(14, 2, '', 0, 0),
+			(15, 7, '', 0, 0)`,
+		`INSERT INTO thread_participants (thread_id, contact_id, nickname) VALUES
+			(11, 100, NULL), (11, 11, NULL),
+			(12, 100, NULL), (12, 12, 'Kasia'),
+			(14, 11, NULL), (14, 13, NULL),
+			(15, 100, NULL), (15, 13, NULL)`,
+	} {
+		if _, err := s.db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	want := map[int64]string{
+		1:  "Chorwacja 2019", // Named threads keep their name
+		11: "Anna Nowak",     // The contact the thread is with
+		12: "Kasia",          // Their nickname when the contact has no name
+		13: "Bartek",         // Even with no participants synced
+		14: "",               // Unnamed groups aren't derived
+		15: "Bartek",         // Otherwise the participant who isn't the owner
+	}
+	threads, err := s.ListThreads(10)
+	if err != nil {
+		t.Fatalf("ListThreads: %v", err)
+	}
+	if len(threads) != len(want) {
+		t.Fatalf("ListThreads returned %d threads, want %d", len(threads), len(want))
+	}
+	for _, th := range threads {
+		if th.Name != want[th.ID] {
+			t.Errorf("thread %d name = %q, want %q", th.ID, th.Name, want[th.ID])
+		}
+	}
+
+	if id, ok, err := s.FindUniqueThreadIDByName("Anna Nowak"); err != nil || !ok || id != 11 {
+		t.Errorf("FindUniqueThreadIDByName = %d, %v, %v", id, ok, err)
+	}
+	if st, err := GetThreadStats(s.db, 12, 5); err != nil || st.Name != "Kasia" {
+		t.Errorf("GetThreadStats = %+v, %v", st, err)
+	}
+}
+
+func TestThreadMemberNames(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	for _, stmt := range []string{
+		`INSERT INTO contacts (id, name, created_at, updated_at) VALUES (1, 'Anna Nowak', 0, 0), (2, 'Bartek', 0, 0), (3, 'Celina', 0, 0)`,
+		`INSERT INTO threads (id, thread_type, created_at, updated_at) VALUES (5, 2, 0, 0)`,
+		`INSERT INTO thread_participants (thread_id, contact_id, nickname) VALUES (5, 1, 'Ania'), (5, 2, NULL), (5, 3, '')`,
+		`INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms, created_at) VALUES ('m1', 5, 1, 'hi', 1, 0), ('m2', 5, 2, 'hey', 2, 0)`,
+	} {
+		if _, err := s.db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	senders, err := ThreadMemberNames(s.db, 5, false)
+	if err != nil {
+		t.Fatalf("ThreadMemberNames: %v", err)
+	}
+	if fmt.Sprint(senders) != "map[1:Ania 2:Bartek]" {
+		t.Errorf("senders = %v", senders)
+	}
+	all, err := ThreadMemberNames(s.db, 5, true)
+	if err != nil {
+		t.Fatalf("ThreadMemberNames: %v", err)
+	}
+	if fmt.Sprint(all) != "map[1:Ania 2:Bartek 3:Celina]" {
+		t.Errorf("with participants = %v", all)
+	}
+}
+
+func TestThreadCompleteness(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	const day = int64(dayMs)
+	exportID := func(n int) string { return fmt.Sprintf("%032x", n) }
+	stmts := []string{
+		`INSERT INTO contacts (id, name, created_at, updated_at) VALUES (1, 'Anna', 0, 0)`,
+		// Thread 1 is quiet for 90 days, and active 10 days past its last message
+		fmt.Sprintf(`INSERT INTO threads (id, thread_type, name, last_activity_ms, created_at, updated_at) VALUES
+			(1, 2, 'Trip', %d, 0, 0), (2, 2, 'Work', %d, 0, 0), (3, 2, 'Empty', %d, 0, 0)`, 140*day, 9*day, day),
+	}
+	var msgs []string
+	for d := int64(0); d < 20; d++ {
+		msgs = append(msgs, fmt.Sprintf("('%s', 1, 1, 'hi', %d, 0)", exportID(int(d)), d*day+1000))
+	}
+	for d := int64(110); d < 130; d++ {
+		msgs = append(msgs, fmt.Sprintf("('mid.%d', 1, 1, 'hi', %d, 0)", d, d*day+1000))
+	}
+	for d := int64(0); d < 10; d++ {
+		msgs = append(msgs, fmt.Sprintf("('mid.w%d', 2, 1, 'hi', %d, 0)", d, d*day))
+	}
+	stmts = append(stmts, "INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms, created_at) VALUES "+strings.Join(msgs, ", "),
+		`UPDATE messages SET source = 'facebook-export' WHERE id NOT LIKE 'mid.%'`)
+	for _, q := range stmts {
+		if _, err := s.db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+
+	got, err := ListThreadCompleteness(s.db, nil)
+	if err != nil {
+		t.Fatalf("ListThreadCompleteness: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d threads, want 3", len(got))
+	}
+
+	trip := got[0]
+	if trip.ThreadName != "Trip" || trip.Messages != 40 || trip.ActiveDays != 40 || trip.CadenceDays != 1 {
+		t.Errorf("trip = %+v", trip)
+	}
+	if len(trip.Holes) != 1 || trip.Holes[0].Days != 91 || trip.BehindDays != 10 || trip.MissingDays != 101 {
+		t.Errorf("trip holes = %+v, behind %d, missing %d", trip.Holes, trip.BehindDays, trip.MissingDays)
+	}
+	// 101 of 140 days missing
+	if trip.Score != 0.28 || !trip.NeedsImport || strings.Join(trip.Sources, ",") != "export,live" {
+		t.Errorf("trip score %v, needs import %v, sources %v", trip.Score, trip.NeedsImport, trip.Sources)
+	}
+
+	// Daily messages up to its last activity: complete, but only synced
+	work := got[1]
+	if work.Score != 1 || work.Holes != nil || work.BehindDays != 0 || !work.NeedsImport {
+		t.Errorf("work = %+v", work)
+	}
+
+	if empty := got[2]; empty.Score != 0 || empty.Messages != 0 || !empty.NeedsImport {
+		t.Errorf("empty = %+v", empty)
+	}
+
+	only, err := ListThreadCompleteness(s.db, []int64{2})
+	if err != nil || len(only) != 1 || only[0].ThreadID != 2 || only[0].Messages != 10 {
+		t.Errorf("thread 2 only = %+v, %v", only, err)
+	}
+}
+
+func TestListMessageAttachmentsAndReactions(t *testing.T) {
+	s, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	for _, q := range []string{
+		`INSERT INTO contacts (id, name, created_at, updated_at) VALUES (1, 'Anna', 0, 0), (2, 'Bartek', 0, 0)`,
+		`INSERT INTO threads (id, thread_type, created_at, updated_at) VALUES (1, 2, 0, 0)`,
+		`INSERT INTO messages (id, thread_id, sender_id, text, timestamp_ms, created_at) VALUES
+			('m1', 1, 1, 'look', 100, 0), ('m2', 1, 2, 'nice', 200, 0), ('m3', 1, 1, '', 300, 0)`,
+		fmt.Sprintf(`INSERT INTO attachments (id, message_id, attachment_type, filename, mime_type, width, local_path, created_at) VALUES
+			('a1', 'm1', %d, 'beach.jpg', 'image/jpeg', 800, 'a1.jpg', 0),
+			('a2', 'm1', %d, 'clip.mp4', NULL, NULL, NULL, 0)`, table.AttachmentTypeImage, table.AttachmentTypeVideo),
+		`INSERT INTO reactions (thread_id, message_id, actor_id, reaction, timestamp_ms) VALUES
+			(1, 'm1', 2, '😍', 150), (1, 'm1', 1, '👍', 120)`,
+	} {
+		if _, err := s.db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+
+	attachments, err := ListMessageAttachments(s.db, []string{"m1", "m2"})
+	if err != nil {
+		t.Fatalf("ListMessageAttachments: %v", err)
+	}
+	got := attachments["m1"]
+	if len(attachments) != 1 || len(got) != 2 {
+		t.Fatalf("attachments = %+v, want two on m1", attachments)
+	}
+	if got[0].ID != "a1" || got[0].Type != "photo" || got[0].Width != 800 || got[0].LocalPath != "a1.jpg" ||
+		got[1].Type != "video" || got[1].Filename != "clip.mp4" || got[1].LocalPath != "" {
+		t.Errorf("attachments of m1 = %+v", got)
+	}
+
+	reactions, err := ListMessageReactions(s.db, []string{"m1", "m2", "m3"})
+	if err != nil {
+		t.Fatalf("ListMessageReactions: %v", err)
+	}
+	if r := reactions["m1"]; len(reactions) != 1 || len(r) != 2 || r[0].ActorName != "Anna" || r[0].Reaction != "👍" || r[1].ActorID != 2 {
+		t.Errorf("reactions = %+v", reactions)
+	}
+
+	if empty, err := ListMessageAttachments(s.db, nil); err != nil || len(empty) != 0 {
+		t.Errorf("no messages = %v, %v", empty, err)
+	}
+}
+
+func TestDriver_Key(t *testing.T) {
+	dir := t.TempDir()
+
+	// Without a key, a file SQLite can't read is reported as encrypted
+	garbage := filepath.Join(dir, "encrypted.db")
+	if err := os.WriteFile(garbage, bytes.Repeat([]byte{0xa5}, 4096), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(garbage); !errors.Is(err, ErrKeyRequired) {
+		t.Fatalf("New without key = %v, want ErrKeyRequired", err)
+	}
+
+	SetKey("it's secret")
+	defer SetKey("")
+	path := filepath.Join(dir, "messenger.db")
+	s, err := New(path)
+	if errors.Is(err, ErrNoSQLCipher) {
+		// The bundled SQLite can't encrypt; the key must not be ignored
+		return
+	} else if err != nil {
+		t.Fatalf("New with key: %v", err)
+	}
+	s.Close()
+
+	SetKey("")
+	if _, err := New(path); !errors.Is(err, ErrKeyRequired) {
+		t.Errorf("New without key = %v, want ErrKeyRequired", err)
+	}
+	SetKey("wrong")
+	if _, err := New(path); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("New with wrong key = %v, want ErrWrongKey", err)
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	defer SetKey("")
+	t.Setenv(KeyEnv, "from env")
+	if err := LoadKey(""); err != nil || currentKey() != "from env" {
+		t.Errorf("LoadKey from env: %q, %v", currentKey(), err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "db.key")
+	os.WriteFile(keyFile, []byte("from file\n"), 0o600)
+	if err := LoadKey(keyFile); err != nil || currentKey() != "from file" {
+		t.Errorf("LoadKey from file: %q, %v", currentKey(), err)
+	}
+	os.WriteFile(keyFile, []byte("\n"), 0o600)
+	if err := LoadKey(keyFile); err == nil {
+		t.Error("empty key file accepted")
+	}
+}
+
+func TestCutDSNParam(t *testing.T) {
+	for _, tc := range []struct{ dsn, rest, value string }{
+		{"a.db?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000", "a.db?_busy_timeout=5000&_foreign_keys=on", "WAL"},
+		{"a.db?_journal_mode=WAL", "a.db", "WAL"},
+		{"a.db?mode=ro", "a.db?mode=ro", ""},
+		{"a.db", "a.db", ""},
+	} {
+		if rest, value := cutDSNParam(tc.dsn, "_journal_mode"); rest != tc.rest || value != tc.value {
+			t.Errorf("cutDSNParam(%q) = %q, %q; want %q, %q", tc.dsn, rest, value, tc.rest, tc.value)
+		}
+	}
+}
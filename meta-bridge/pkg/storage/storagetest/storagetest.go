@@ -0,0 +1,44 @@
+// Package storagetest builds throwaway archives for tests of the commands
+// that read the database directly.
+package storagetest
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// NewArchive creates an archive with the current schema in a temp dir, runs
+// stmts against it and returns a handle that is closed when the test ends
+func NewArchive(t testing.TB, stmts ...string) *sql.DB {
+	t.Helper()
+	s, db := NewStore(t, stmts...)
+	s.Close()
+	return db
+}
+
+// NewStore is NewArchive for tests that also write through storage: the
+// returned Storage is open on the same file and closed when the test ends
+func NewStore(t testing.TB, stmts ...string) (*storage.Storage, *sql.DB) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "messages.db")
+	s, err := storage.New(path)
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	return s, db
+}
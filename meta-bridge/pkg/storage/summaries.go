@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"strings"
+	"time"
+)
+
+// ThreadSummaryIdx is the session index of a whole-thread summary
+const ThreadSummaryIdx = -1
+
+// Summary is an LLM summary of a conversation session, or of a whole thread
+// when SessionIdx is ThreadSummaryIdx
+type Summary struct {
+	SummaryID        string `json:"summary_id"`
+	ThreadID         int64  `json:"thread_id,string"`
+	SessionIdx       int    `json:"session_idx"`
+	Text             string `json:"text"`
+	Model            string `json:"model"`
+	SourceHash       string `json:"-"`
+	StartTimestampMs int64  `json:"start_timestamp_ms"`
+	EndTimestampMs   int64  `json:"end_timestamp_ms"`
+	CreatedAt        int64  `json:"created_at"` // Unix ms
+}
+
+const summaryColumns = `summary_id, thread_id, session_idx, text, model, source_hash,
+	start_timestamp_ms, end_timestamp_ms, created_at`
+
+// UpsertSummary stores sum, replacing the thread's summary of the same
+// session, and queues it for (re)indexing
+func (s *Storage) UpsertSummary(sum Summary) error {
+	if sum.CreatedAt == 0 {
+		sum.CreatedAt = time.Now().UnixMilli()
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO summaries (`+summaryColumns+`, milvus_synced)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0)
+		ON CONFLICT(thread_id, session_idx) DO UPDATE SET
+			summary_id = excluded.summary_id,
+			text = excluded.text,
+			model = excluded.model,
+			source_hash = excluded.source_hash,
+			start_timestamp_ms = excluded.start_timestamp_ms,
+			end_timestamp_ms = excluded.end_timestamp_ms,
+			created_at = excluded.created_at,
+			milvus_synced = 0
+	`, sum.SummaryID, sum.ThreadID, sum.SessionIdx, sum.Text, sum.Model, sum.SourceHash,
+		sum.StartTimestampMs, sum.EndTimestampMs, sum.CreatedAt)
+	return err
+}
+
+// GetSummaries returns a thread's summaries, the thread summary first and
+// then the sessions in order
+func (s *Storage) GetSummaries(threadID int64) ([]Summary, error) {
+	return s.querySummaries(`WHERE thread_id = ? ORDER BY session_idx`, threadID)
+}
+
+// GetUnsyncedSummaries returns up to limit summaries not yet indexed in the
+// summary collection
+func (s *Storage) GetUnsyncedSummaries(limit int) ([]Summary, error) {
+	return s.querySummaries(`WHERE milvus_synced = 0 ORDER BY thread_id, session_idx LIMIT ?`, limit)
+}
+
+func (s *Storage) querySummaries(where string, args ...any) ([]Summary, error) {
+	rows, err := s.db.Query(`SELECT `+summaryColumns+` FROM summaries `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Summary
+	for rows.Next() {
+		var sum Summary
+		if err := rows.Scan(&sum.SummaryID, &sum.ThreadID, &sum.SessionIdx, &sum.Text, &sum.Model,
+			&sum.SourceHash, &sum.StartTimestampMs, &sum.EndTimestampMs, &sum.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, sum)
+	}
+	return out, rows.Err()
+}
+
+// MarkSummariesSynced records that the given summaries are indexed
+func (s *Storage) MarkSummariesSynced(summaryIDs []string) error {
+	return s.execForIDs(`UPDATE summaries SET milvus_synced = 1 WHERE summary_id IN `, summaryIDs)
+}
+
+// DeleteSummaries removes the given summaries
+func (s *Storage) DeleteSummaries(summaryIDs []string) error {
+	return s.execForIDs(`DELETE FROM summaries WHERE summary_id IN `, summaryIDs)
+}
+
+func (s *Storage) execForIDs(query string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	_, err := s.db.Exec(query+`(?`+strings.Repeat(", ?", len(ids)-1)+`)`, args...)
+	return err
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxTagLength caps tag names so they stay usable as filter values
+const maxTagLength = 32
+
+var validTagRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// TagCount is a tag with the number of threads carrying it
+type TagCount struct {
+	Tag     string `json:"tag"`
+	Threads int64  `json:"threads"`
+}
+
+// NormalizeTag lowercases and validates a tag name
+func NormalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || len(tag) > maxTagLength || !validTagRe.MatchString(tag) {
+		return "", &inputError{fmt.Sprintf("invalid tag %q (use a-z, 0-9, '-' and '_', max %d chars)", tag, maxTagLength)}
+	}
+	return tag, nil
+}
+
+// NormalizeTags normalizes and de-duplicates a list of tags
+func NormalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]struct{}, len(tags))
+	out := make([]string, 0, len(tags))
+	for _, t := range tags {
+		norm, err := NormalizeTag(t)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[norm]; ok {
+			continue
+		}
+		seen[norm] = struct{}{}
+		out = append(out, norm)
+	}
+	return out, nil
+}
+
+// TagThreads adds every tag to every thread (already-present pairs are ignored).
+// Unknown thread IDs fail with ErrNotFound.
+func (s *Storage) TagThreads(threadIDs []int64, tags []string) error {
+	tags, err := NormalizeTags(tags)
+	if err != nil {
+		return err
+	}
+	if len(threadIDs) == 0 || len(tags) == 0 {
+		return nil
+	}
+
+	now := time.Now().UnixMilli()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO thread_tags (thread_id, tag, created_at) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, threadID := range threadIDs {
+		for _, tag := range tags {
+			if _, err := stmt.Exec(threadID, tag, now); err != nil {
+				return fmt.Errorf("tagging thread %d: %w", threadID, classifySQLiteError(err))
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UntagThreads removes every tag from every thread
+func (s *Storage) UntagThreads(threadIDs []int64, tags []string) error {
+	tags, err := NormalizeTags(tags)
+	if err != nil {
+		return err
+	}
+	if len(threadIDs) == 0 || len(tags) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`DELETE FROM thread_tags WHERE thread_id = ? AND tag = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, threadID := range threadIDs {
+		for _, tag := range tags {
+			if _, err := stmt.Exec(threadID, tag); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteTag removes a tag from all threads, returning how many were untagged
+func (s *Storage) DeleteTag(tag string) (int64, error) {
+	tag, err := NormalizeTag(tag)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.db.Exec(`DELETE FROM thread_tags WHERE tag = ?`, tag)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ListTags returns all tags with their thread counts, most used first
+func ListTags(db *sql.DB) ([]TagCount, error) {
+	rows, err := db.Query(`
+		SELECT tag, COUNT(*) FROM thread_tags
+		GROUP BY tag
+		ORDER BY COUNT(*) DESC, tag ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []TagCount
+	for rows.Next() {
+		var tc TagCount
+		if err := rows.Scan(&tc.Tag, &tc.Threads); err != nil {
+			return nil, err
+		}
+		out = append(out, tc)
+	}
+	return out, rows.Err()
+}
+
+// ThreadIDsWithTags returns the threads carrying any of the given tags
+func ThreadIDsWithTags(db *sql.DB, tags []string) ([]int64, error) {
+	tags, err := NormalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	args := make([]any, len(tags))
+	for i, t := range tags {
+		args[i] = t
+	}
+	rows, err := db.Query(`
+		SELECT DISTINCT thread_id FROM thread_tags
+		WHERE tag IN (?`+strings.Repeat(", ?", len(tags)-1)+`)
+		ORDER BY thread_id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+// TagsForThreads returns the tags of each given thread
+func TagsForThreads(db *sql.DB, threadIDs []int64) (map[int64][]string, error) {
+	out := make(map[int64][]string, len(threadIDs))
+	if len(threadIDs) == 0 {
+		return out, nil
+	}
+
+	args := make([]any, len(threadIDs))
+	for i, id := range threadIDs {
+		args[i] = id
+	}
+	rows, err := db.Query(`
+		SELECT thread_id, tag FROM thread_tags
+		WHERE thread_id IN (?`+strings.Repeat(", ?", len(threadIDs)-1)+`)
+		ORDER BY tag
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return nil, err
+		}
+		out[id] = append(out[id], tag)
+	}
+	return out, rows.Err()
+}
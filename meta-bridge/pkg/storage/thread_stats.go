@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"database/sql"
+)
+
+// SenderCount is the number of messages one participant sent in a thread
+type SenderCount struct {
+	ContactID int64  `json:"contact_id,string"`
+	Name      string `json:"name"`
+	Messages  int64  `json:"messages"`
+}
+
+// ThreadStats summarizes a thread's participants and message history
+type ThreadStats struct {
+	ThreadID       int64         `json:"thread_id,string"`
+	Name           string        `json:"name"`
+	ThreadType     int64         `json:"thread_type"`
+	MemberCount    int64         `json:"member_count"`
+	MessageCount   int64         `json:"message_count"`
+	FirstMessageMs int64         `json:"first_message_ms"`
+	LastMessageMs  int64         `json:"last_message_ms"`
+	Participants   []string      `json:"participants"`
+	TopSenders     []SenderCount `json:"top_senders"`
+}
+
+// GetThreadStats returns statistics for a thread, or ErrNotFound.
+// topSenders limits the per-sender breakdown.
+func GetThreadStats(db *sql.DB, threadID int64, topSenders int) (*ThreadStats, error) {
+	st := &ThreadStats{ThreadID: threadID, Participants: []string{}, TopSenders: []SenderCount{}}
+
+	var name sql.NullString
+	var memberCount sql.NullInt64
+	err := db.QueryRow(`
+		SELECT n.name, t.thread_type, t.member_count
+		FROM threads t JOIN thread_names n ON n.thread_id = t.id
+		WHERE t.id = ?`, threadID).
+		Scan(&name, &st.ThreadType, &memberCount)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	st.Name = name.String
+	st.MemberCount = memberCount.Int64
+
+	var first, last sql.NullInt64
+	err = db.QueryRow(`
+		SELECT COUNT(*), MIN(timestamp_ms), MAX(timestamp_ms)
+		FROM messages WHERE thread_id = ?
+	`, threadID).Scan(&st.MessageCount, &first, &last)
+	if err != nil {
+		return nil, err
+	}
+	st.FirstMessageMs = first.Int64
+	st.LastMessageMs = last.Int64
+
+	rows, err := db.Query(`
+		SELECT COALESCE(c.name, CAST(tp.contact_id AS TEXT))
+		FROM thread_participants tp
+		LEFT JOIN contacts c ON c.id = tp.contact_id
+		WHERE tp.thread_id = ?
+		ORDER BY c.name
+	`, threadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		st.Participants = append(st.Participants, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	senders, err := db.Query(`
+		SELECT m.sender_id, COALESCE(c.name, ''), COUNT(*) AS n
+		FROM messages m
+		LEFT JOIN contacts c ON c.id = m.sender_id
+		WHERE m.thread_id = ?
+		GROUP BY m.sender_id
+		ORDER BY n DESC
+		LIMIT ?
+	`, threadID, topSenders)
+	if err != nil {
+		return nil, err
+	}
+	defer senders.Close()
+	for senders.Next() {
+		var sc SenderCount
+		if err := senders.Scan(&sc.ContactID, &sc.Name, &sc.Messages); err != nil {
+			return nil, err
+		}
+		st.TopSenders = append(st.TopSenders, sc)
+	}
+	return st, senders.Err()
+}
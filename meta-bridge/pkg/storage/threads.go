@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"cmp"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// MergeThread moves everything in thread from onto thread into (messages,
+// reactions, links, participants, tags, queued outbound messages), fills
+// thread fields into lacks, and deletes from, recording it as an alias of
+// into. The moved messages are marked unindexed so the next indexing pass
+// re-chunks into with them; from's chunks are deleted, and their vectors are
+// left for the vector store cleanup (search skips them meanwhile). from's
+// summaries are deleted too.
+func (s *Storage) MergeThread(from, into int64) error {
+	return s.MergeThreads(into, from)
+}
+
+// MergeThreads merges every thread in from into into (see MergeThread), all
+// or none
+func (s *Storage) MergeThreads(into int64, from ...int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The RAG tables exist once chunks were generated
+	var hasChunks bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'chunks')`).Scan(&hasChunks); err != nil {
+		return err
+	}
+	for _, id := range from {
+		if err := mergeThread(tx, id, into, hasChunks); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func mergeThread(tx *sql.Tx, from, into int64, hasChunks bool) error {
+	if from == into {
+		return fmt.Errorf("cannot merge thread %d into itself", from)
+	}
+	for _, id := range []int64{from, into} {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM threads WHERE id = ?)`, id).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("thread %d: %w", id, ErrNotFound)
+		}
+	}
+
+	queries := []string{
+		// Recorded first, while from's display name can still be read
+		`UPDATE thread_aliases SET thread_id = :into WHERE thread_id = :from`,
+		`INSERT INTO thread_aliases (alias_id, thread_id, name, merged_at)
+		SELECT :from, :into, NULLIF(name, ''), ` + nowMsSQL + ` FROM thread_names WHERE thread_id = :from
+		ON CONFLICT(alias_id) DO UPDATE SET
+			thread_id = excluded.thread_id,
+			name = COALESCE(excluded.name, thread_aliases.name),
+			merged_at = excluded.merged_at`,
+		// into is a thread again if it was once merged away
+		`DELETE FROM thread_aliases WHERE alias_id = :into`,
+
+		`UPDATE messages SET thread_id = :into, indexed_at = NULL WHERE thread_id = :from`,
+		`UPDATE OR IGNORE reactions SET thread_id = :into WHERE thread_id = :from`,
+		`DELETE FROM reactions WHERE thread_id = :from`,
+		`UPDATE links SET thread_id = :into WHERE thread_id = :from`,
+		`INSERT INTO thread_participants (thread_id, contact_id, nickname, is_admin, joined_at,
+			read_watermark_ms, read_action_timestamp_ms, delivered_watermark_ms)
+		SELECT :into, contact_id, nickname, is_admin, joined_at,
+			read_watermark_ms, read_action_timestamp_ms, delivered_watermark_ms
+		FROM thread_participants WHERE thread_id = :from
+		ON CONFLICT(thread_id, contact_id) DO UPDATE SET
+			nickname = COALESCE(thread_participants.nickname, excluded.nickname),
+			is_admin = thread_participants.is_admin OR excluded.is_admin,
+			joined_at = COALESCE(thread_participants.joined_at, excluded.joined_at),
+			read_watermark_ms = MAX(COALESCE(thread_participants.read_watermark_ms, 0), COALESCE(excluded.read_watermark_ms, 0)),
+			read_action_timestamp_ms = MAX(COALESCE(thread_participants.read_action_timestamp_ms, 0), COALESCE(excluded.read_action_timestamp_ms, 0)),
+			delivered_watermark_ms = MAX(COALESCE(thread_participants.delivered_watermark_ms, 0), COALESCE(excluded.delivered_watermark_ms, 0))`,
+		`DELETE FROM thread_participants WHERE thread_id = :from`,
+		`INSERT OR IGNORE INTO thread_tags (thread_id, tag, created_at)
+		SELECT :into, tag, created_at FROM thread_tags WHERE thread_id = :from`,
+		`DELETE FROM thread_tags WHERE thread_id = :from`,
+		`UPDATE outbound_queue SET thread_id = :into WHERE thread_id = :from`,
+		`DELETE FROM summaries WHERE thread_id = :from`,
+		`UPDATE threads SET
+			name = COALESCE(NULLIF(threads.name, ''), f.name),
+			picture_url = COALESCE(NULLIF(threads.picture_url, ''), f.picture_url),
+			snippet = CASE WHEN COALESCE(f.last_activity_ms, 0) > COALESCE(threads.last_activity_ms, 0)
+				THEN f.snippet ELSE threads.snippet END,
+			last_activity_ms = MAX(COALESCE(threads.last_activity_ms, 0), COALESCE(f.last_activity_ms, 0)),
+			updated_at = MAX(threads.updated_at, f.updated_at)
+		FROM (SELECT * FROM threads WHERE id = :from) AS f
+		WHERE threads.id = :into`,
+		`DELETE FROM threads WHERE id = :from`,
+	}
+	if hasChunks {
+		queries = append(queries,
+			`DELETE FROM chunks WHERE thread_id = :from`,
+			`DELETE FROM chunked_threads WHERE thread_id = :from`,
+		)
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, sql.Named("from", from), sql.Named("into", into)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ThreadAlias is a thread ID merged into another
+type ThreadAlias struct {
+	AliasID  int64  `json:"alias_id,string"`
+	ThreadID int64  `json:"thread_id,string"`
+	Name     string `json:"name"`
+	MergedAt int64  `json:"merged_at"`
+}
+
+// ResolveThreadAlias returns the thread id was merged into, or id itself if
+// it never was
+func (s *Storage) ResolveThreadAlias(id int64) (int64, error) {
+	var into int64
+	err := s.q().QueryRow(`SELECT thread_id FROM thread_aliases WHERE alias_id = ?`, id).Scan(&into)
+	if err == sql.ErrNoRows {
+		return id, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return into, nil
+}
+
+// ListThreadAliases returns the recorded aliases, newest merge first
+func (s *Storage) ListThreadAliases() ([]ThreadAlias, error) {
+	rows, err := s.db.Query(`
+		SELECT alias_id, thread_id, COALESCE(name, ''), merged_at
+		FROM thread_aliases
+		ORDER BY merged_at DESC, alias_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ThreadAlias
+	for rows.Next() {
+		var a ThreadAlias
+		if err := rows.Scan(&a.AliasID, &a.ThreadID, &a.Name, &a.MergedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// DuplicateThread is one of several threads with the same display name
+type DuplicateThread struct {
+	ID             int64  `json:"id,string"`
+	Name           string `json:"name"`
+	SyncMessages   int64  `json:"sync_messages"`
+	ExportMessages int64  `json:"export_messages"`
+}
+
+// ListDuplicateThreads groups threads whose display names match ignoring
+// case and spacing, typically a conversation imported from an export under a
+// hash-based ID and synced under its real thread key. Each group starts with
+// the thread to merge the others into, chosen like in ListDuplicateContacts;
+// groups with the most messages come first.
+func (s *Storage) ListDuplicateThreads() ([][]DuplicateThread, error) {
+	rows, err := s.db.Query(`
+		SELECT n.thread_id, n.name,
+			COALESCE(SUM(CASE WHEN m.id IS NULL THEN 0 WHEN ` + sourceSQL + ` = 'live' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN m.id IS NULL THEN 0 WHEN ` + sourceSQL + ` = 'export' THEN 1 ELSE 0 END), 0)
+		FROM thread_names n
+		LEFT JOIN messages m ON m.thread_id = n.thread_id
+		WHERE TRIM(n.name) != ''
+		GROUP BY n.thread_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byName := make(map[string][]DuplicateThread)
+	for rows.Next() {
+		var t DuplicateThread
+		if err := rows.Scan(&t.ID, &t.Name, &t.SyncMessages, &t.ExportMessages); err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(strings.Join(strings.Fields(t.Name), " "))
+		byName[key] = append(byName[key], t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	total := func(group []DuplicateThread) (n int64) {
+		for _, t := range group {
+			n += t.SyncMessages + t.ExportMessages
+		}
+		return n
+	}
+	var groups [][]DuplicateThread
+	for _, group := range byName {
+		if len(group) < 2 {
+			continue
+		}
+		slices.SortFunc(group, func(a, b DuplicateThread) int {
+			return cmp.Or(
+				cmp.Compare(b.SyncMessages, a.SyncMessages),
+				cmp.Compare(b.SyncMessages+b.ExportMessages, a.SyncMessages+a.ExportMessages),
+				cmp.Compare(a.ID, b.ID),
+			)
+		})
+		groups = append(groups, group)
+	}
+	slices.SortFunc(groups, func(a, b []DuplicateThread) int {
+		return cmp.Or(cmp.Compare(total(b), total(a)), cmp.Compare(a[0].ID, b[0].ID))
+	})
+	return groups, nil
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+)
+
+// PendingTranscription is a downloaded audio attachment without a transcript
+type PendingTranscription struct {
+	AttachmentID string
+	MessageID    string
+	LocalPath    string // Relative to media.attachments_dir
+	Filename     string
+	MimeType     string
+}
+
+// audioAttachmentSQL selects audio attachments (voice messages and sound
+// bites), including ones stored with a generic type but an audio MIME type
+var audioAttachmentSQL = `(a.attachment_type IN (` +
+	strconv.Itoa(int(table.AttachmentTypeAudio)) + `, ` + strconv.Itoa(int(table.AttachmentTypeSoundBite)) +
+	`) OR a.mime_type LIKE 'audio/%')`
+
+// GetPendingTranscriptions returns up to limit downloaded audio attachments
+// that have no transcript yet, newest first. Attachments whose last
+// transcription failed are skipped unless retryFailed is set.
+func (s *Storage) GetPendingTranscriptions(limit int, retryFailed bool) ([]PendingTranscription, error) {
+	query := `
+		SELECT a.id, a.message_id, a.local_path, COALESCE(a.filename, ''), COALESCE(a.mime_type, '')
+		FROM attachments a
+		LEFT JOIN attachment_transcripts t ON t.attachment_id = a.id
+		WHERE a.local_path IS NOT NULL AND ` + audioAttachmentSQL
+	if retryFailed {
+		query += ` AND (t.attachment_id IS NULL OR t.error IS NOT NULL)`
+	} else {
+		query += ` AND t.attachment_id IS NULL`
+	}
+	query += ` ORDER BY a.created_at DESC LIMIT ?`
+
+	rows, err := s.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []PendingTranscription
+	for rows.Next() {
+		var p PendingTranscription
+		if err := rows.Scan(&p.AttachmentID, &p.MessageID, &p.LocalPath, &p.Filename, &p.MimeType); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// CountPendingTranscriptions counts audio attachments without a transcript:
+// downloaded ones that can be transcribed now, and ones still waiting for
+// their file
+func (s *Storage) CountPendingTranscriptions() (ready, notDownloaded int64, err error) {
+	err = s.db.QueryRow(`
+		SELECT COALESCE(SUM(a.local_path IS NOT NULL), 0), COALESCE(SUM(a.local_path IS NULL), 0)
+		FROM attachments a
+		LEFT JOIN attachment_transcripts t ON t.attachment_id = a.id
+		WHERE t.attachment_id IS NULL AND `+audioAttachmentSQL).Scan(&ready, &notDownloaded)
+	return ready, notDownloaded, err
+}
+
+// SaveTranscript stores the transcript of an audio attachment and marks its
+// message unindexed, so the next indexing pass re-chunks the thread with the
+// transcript included
+func (s *Storage) SaveTranscript(attachmentID, messageID, text, language, model string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO attachment_transcripts (attachment_id, message_id, text, language, model, error, created_at)
+		VALUES (?, ?, ?, ?, ?, NULL, ?)
+		ON CONFLICT(attachment_id) DO UPDATE SET
+			text = excluded.text,
+			language = excluded.language,
+			model = excluded.model,
+			error = NULL,
+			created_at = excluded.created_at
+	`, attachmentID, messageID, text, nullIfEmpty(language), nullIfEmpty(model), time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE messages SET indexed_at = NULL WHERE id = ?`, messageID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetTranscriptError records a failed transcription so later passes skip the
+// attachment until retried. An existing transcript is kept.
+func (s *Storage) SetTranscriptError(attachmentID, messageID, msg string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO attachment_transcripts (attachment_id, message_id, error, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(attachment_id) DO UPDATE SET error = excluded.error
+	`, attachmentID, messageID, msg, time.Now().UnixMilli())
+	return err
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"database/sql"
+)
+
+// UpsertStats are the message upsert path counters kept by the upsert_stats
+// triggers, cumulative since the table was created
+type UpsertStats struct {
+	// Inserted counts new message rows
+	Inserted int64 `json:"inserted"`
+	// DedupSkipped counts inserts of a message id that already existed
+	DedupSkipped int64 `json:"dedup_skipped"`
+	// TextChanged counts updates that changed the message text (edits, unsends)
+	TextChanged int64 `json:"text_changed"`
+	// FTSRewritten counts messages_fts rows rewritten by updates
+	FTSRewritten int64 `json:"fts_rewritten"`
+}
+
+// GetUpsertStats reads the upsert path counters.
+func GetUpsertStats(db *sql.DB) (UpsertStats, error) {
+	var stats UpsertStats
+	rows, err := db.Query(`SELECT counter, value FROM upsert_stats`)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var counter string
+		var value int64
+		if err := rows.Scan(&counter, &value); err != nil {
+			return stats, err
+		}
+		switch counter {
+		case "inserted":
+			stats.Inserted = value
+		case "dedup_skipped":
+			stats.DedupSkipped = value
+		case "text_changed":
+			stats.TextChanged = value
+		case "fts_rewritten":
+			stats.FTSRewritten = value
+		}
+	}
+	return stats, rows.Err()
+}
+
+// GetUpsertStats reads the upsert path counters
+func (s *Storage) GetUpsertStats() (UpsertStats, error) {
+	return GetUpsertStats(s.db)
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"database/sql"
+)
+
+// UsageRun is the token usage of one pipeline run
+type UsageRun struct {
+	ID               int64   `json:"id"`
+	Kind             string  `json:"kind"`
+	Component        string  `json:"component"`
+	Model            string  `json:"model"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+	StartedAt        int64   `json:"started_at"`
+	FinishedAt       int64   `json:"finished_at"`
+}
+
+// UsageSummary aggregates usage runs of one kind/component/model
+type UsageSummary struct {
+	Kind             string  `json:"kind"`
+	Component        string  `json:"component"`
+	Model            string  `json:"model"`
+	Runs             int64   `json:"runs"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// RecordUsage stores a usage run.
+func RecordUsage(db *sql.DB, run UsageRun) error {
+	_, err := db.Exec(`
+		INSERT INTO usage_runs (kind, component, model, requests, prompt_tokens,
+			completion_tokens, total_tokens, cost_usd, started_at, finished_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, run.Kind, run.Component, run.Model, run.Requests, run.PromptTokens,
+		run.CompletionTokens, run.TotalTokens, run.CostUSD, run.StartedAt, run.FinishedAt)
+	return err
+}
+
+// RecordUsage stores a usage run
+func (s *Storage) RecordUsage(run UsageRun) error {
+	return RecordUsage(s.db, run)
+}
+
+// SummarizeUsage aggregates runs finished at or after sinceMs, most expensive first
+func SummarizeUsage(db *sql.DB, sinceMs int64) ([]UsageSummary, error) {
+	rows, err := db.Query(`
+		SELECT kind, component, model, COUNT(*), SUM(requests), SUM(prompt_tokens),
+			SUM(completion_tokens), SUM(total_tokens), SUM(cost_usd)
+		FROM usage_runs
+		WHERE finished_at >= ?
+		GROUP BY kind, component, model
+		ORDER BY SUM(cost_usd) DESC, SUM(total_tokens) DESC
+	`, sinceMs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []UsageSummary
+	for rows.Next() {
+		var u UsageSummary
+		if err := rows.Scan(&u.Kind, &u.Component, &u.Model, &u.Runs, &u.Requests,
+			&u.PromptTokens, &u.CompletionTokens, &u.TotalTokens, &u.CostUSD); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// ListUsageRuns returns the most recent runs finished at or after sinceMs
+func ListUsageRuns(db *sql.DB, sinceMs int64, limit int) ([]UsageRun, error) {
+	rows, err := db.Query(`
+		SELECT id, kind, component, model, requests, prompt_tokens, completion_tokens,
+			total_tokens, cost_usd, started_at, finished_at
+		FROM usage_runs
+		WHERE finished_at >= ?
+		ORDER BY finished_at DESC
+		LIMIT ?
+	`, sinceMs, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []UsageRun
+	for rows.Next() {
+		var r UsageRun
+		if err := rows.Scan(&r.ID, &r.Kind, &r.Component, &r.Model, &r.Requests, &r.PromptTokens,
+			&r.CompletionTokens, &r.TotalTokens, &r.CostUSD, &r.StartedAt, &r.FinishedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
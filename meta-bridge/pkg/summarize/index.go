@@ -0,0 +1,170 @@
+package summarize
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/milvus-io/milvus-sdk-go/v2/client"
+	"github.com/milvus-io/milvus-sdk-go/v2/entity"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+	"go.mau.fi/mautrix-meta/pkg/vectordb"
+)
+
+// maxSummaryChars is the text field length in the summary collection
+const maxSummaryChars = 8192
+
+// Index is the Milvus collection summary embeddings are stored in
+// (summarize.collection). It has the chunk collection's metric and HNSW
+// parameters, so its scores compare with chunk scores.
+type Index struct {
+	client     client.Client
+	cfg        *ragconfig.Config
+	collection string
+}
+
+// OpenIndex connects to Milvus and creates the summary collection if missing
+func OpenIndex(ctx context.Context, cfg *ragconfig.Config) (*Index, error) {
+	if _, err := vectordb.EnsureMilvusDatabase(ctx, cfg.Milvus); err != nil {
+		return nil, fmt.Errorf("preparing Milvus database: %w", err)
+	}
+	c, err := vectordb.NewMilvusClient(ctx, cfg.Milvus)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to Milvus: %w", err)
+	}
+	idx := &Index{client: c, cfg: cfg, collection: cfg.Summarize.Collection}
+
+	exists, err := c.HasCollection(ctx, idx.collection)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("checking collection existence: %w", err)
+	}
+	if !exists {
+		if err := idx.create(ctx); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("creating collection: %w", err)
+		}
+	} else if err := c.LoadCollection(ctx, idx.collection, false); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("loading collection: %w", err)
+	}
+	return idx, nil
+}
+
+func (x *Index) create(ctx context.Context) error {
+	schema := &entity.Schema{
+		CollectionName: x.collection,
+		Description:    "Messenger conversation summaries",
+		Fields: []*entity.Field{
+			{
+				Name:       "summary_id",
+				DataType:   entity.FieldTypeVarChar,
+				PrimaryKey: true,
+				TypeParams: map[string]string{"max_length": "32"},
+			},
+			{Name: "thread_id", DataType: entity.FieldTypeInt64},
+			{Name: "session_idx", DataType: entity.FieldTypeInt16}, // -1 = whole thread
+			{
+				Name:       "text",
+				DataType:   entity.FieldTypeVarChar,
+				TypeParams: map[string]string{"max_length": fmt.Sprint(maxSummaryChars)},
+			},
+			{Name: "start_timestamp_ms", DataType: entity.FieldTypeInt64},
+			{Name: "end_timestamp_ms", DataType: entity.FieldTypeInt64},
+			{
+				Name:       "embedding",
+				DataType:   entity.FieldTypeFloatVector,
+				TypeParams: map[string]string{"dim": fmt.Sprint(x.cfg.Embedding.Dimension)},
+			},
+		},
+	}
+	if err := x.client.CreateCollection(ctx, schema, entity.DefaultShardNumber); err != nil {
+		return err
+	}
+
+	idx, err := entity.NewIndexHNSW(
+		milvusMetricFromConfig(x.cfg.Milvus.Index.Metric),
+		x.cfg.Milvus.Index.M,
+		x.cfg.Milvus.Index.EfConstruction,
+	)
+	if err != nil {
+		return fmt.Errorf("creating index params: %w", err)
+	}
+	if err := x.client.CreateIndex(ctx, x.collection, "embedding", idx, false); err != nil {
+		return fmt.Errorf("creating index: %w", err)
+	}
+	return x.client.LoadCollection(ctx, x.collection, false)
+}
+
+// Upsert stores summaries with their embeddings (same order)
+func (x *Index) Upsert(ctx context.Context, sums []storage.Summary, embeddings [][]float32) error {
+	if len(sums) == 0 {
+		return nil
+	}
+	ids := make([]string, len(sums))
+	threadIDs := make([]int64, len(sums))
+	sessionIdxs := make([]int16, len(sums))
+	texts := make([]string, len(sums))
+	starts := make([]int64, len(sums))
+	ends := make([]int64, len(sums))
+	for i, sum := range sums {
+		ids[i] = sum.SummaryID
+		threadIDs[i] = sum.ThreadID
+		sessionIdxs[i] = int16(sum.SessionIdx)
+		texts[i] = truncateUTF8(sum.Text, maxSummaryChars-1)
+		starts[i] = sum.StartTimestampMs
+		ends[i] = sum.EndTimestampMs
+	}
+	_, err := x.client.Upsert(ctx, x.collection, "",
+		entity.NewColumnVarChar("summary_id", ids),
+		entity.NewColumnInt64("thread_id", threadIDs),
+		entity.NewColumnInt16("session_idx", sessionIdxs),
+		entity.NewColumnVarChar("text", texts),
+		entity.NewColumnInt64("start_timestamp_ms", starts),
+		entity.NewColumnInt64("end_timestamp_ms", ends),
+		entity.NewColumnFloatVector("embedding", x.cfg.Embedding.Dimension, embeddings),
+	)
+	return err
+}
+
+// Delete removes summaries from the collection
+func (x *Index) Delete(ctx context.Context, summaryIDs []string) error {
+	if len(summaryIDs) == 0 {
+		return nil
+	}
+	expr := fmt.Sprintf("summary_id in [\"%s\"]", strings.Join(summaryIDs, "\",\""))
+	return x.client.Delete(ctx, x.collection, "", expr)
+}
+
+// Flush persists pending writes
+func (x *Index) Flush(ctx context.Context) error {
+	return x.client.Flush(ctx, x.collection, false)
+}
+
+func (x *Index) Close() error {
+	return x.client.Close()
+}
+
+func milvusMetricFromConfig(metric string) entity.MetricType {
+	switch strings.ToUpper(strings.TrimSpace(metric)) {
+	case "L2":
+		return entity.L2
+	case "IP", "INNER_PRODUCT":
+		return entity.IP
+	default:
+		return entity.COSINE
+	}
+}
+
+// truncateUTF8 cuts s to at most maxLen bytes without splitting a character
+func truncateUTF8(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	for maxLen > 0 && s[maxLen]&0xC0 == 0x80 {
+		maxLen--
+	}
+	return s[:maxLen]
+}
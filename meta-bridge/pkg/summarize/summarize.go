@@ -0,0 +1,284 @@
+// Package summarize writes LLM summaries of conversations: one per session
+// (a run of chunks without a long pause, see chunking), made from its chunk
+// text, and one per thread, made from its session summaries. Summaries are
+// stored in the summaries table and skipped while their input, model and
+// prompt are unchanged.
+package summarize
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"go.mau.fi/mautrix-meta/pkg/llm"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+)
+
+// Session is the chunk text of one conversation session
+type Session struct {
+	ThreadID         int64
+	ThreadName       string
+	SessionIdx       int
+	Text             string
+	StartTimestampMs int64
+	EndTimestampMs   int64
+}
+
+// ThreadIDs returns the threads that have chunks, most recently active first
+func ThreadIDs(ctx context.Context, db *sql.DB) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT thread_id FROM chunks
+		GROUP BY thread_id
+		ORDER BY MAX(end_timestamp_ms) DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("listing threads: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scanning thread ID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// LoadSessions returns a thread's sessions in order, each with the text of
+// its chunks
+func LoadSessions(ctx context.Context, db *sql.DB, threadID int64) ([]Session, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT COALESCE(thread_name, ''), session_idx, text, start_timestamp_ms, end_timestamp_ms
+		FROM chunks
+		WHERE thread_id = ?
+		ORDER BY session_idx, chunk_idx
+	`, threadID)
+	if err != nil {
+		return nil, fmt.Errorf("loading chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var name, text string
+		var sessionIdx int
+		var startMs, endMs int64
+		if err := rows.Scan(&name, &sessionIdx, &text, &startMs, &endMs); err != nil {
+			return nil, fmt.Errorf("scanning chunk: %w", err)
+		}
+		if n := len(sessions); n > 0 && sessions[n-1].SessionIdx == sessionIdx {
+			last := &sessions[n-1]
+			last.Text += "\n" + text
+			last.EndTimestampMs = max(last.EndTimestampMs, endMs)
+			continue
+		}
+		sessions = append(sessions, Session{
+			ThreadID:         threadID,
+			ThreadName:       name,
+			SessionIdx:       sessionIdx,
+			Text:             text,
+			StartTimestampMs: startMs,
+			EndTimestampMs:   endMs,
+		})
+	}
+	return sessions, rows.Err()
+}
+
+// SummaryID is the stable ID of a thread's summary of sessionIdx
+// (storage.ThreadSummaryIdx for the whole thread), 16 hex chars like chunk IDs
+func SummaryID(threadID int64, sessionIdx int) string {
+	hash := md5.Sum([]byte(fmt.Sprintf("summary_%d_%d", threadID, sessionIdx)))
+	return fmt.Sprintf("%x", hash)[:16]
+}
+
+// Summarizer writes summaries with a chat model
+type Summarizer struct {
+	llm   llm.ChatCompleter
+	cfg   ragconfig.SummarizeConfig
+	model string
+}
+
+// New creates a summarizer. model is the one requests are sent with:
+// summarize.model, else llm.model.
+func New(client llm.ChatCompleter, cfg ragconfig.SummarizeConfig, model string) *Summarizer {
+	return &Summarizer{llm: client, cfg: cfg, model: model}
+}
+
+// Result counts what SummarizeThread did
+type Result struct {
+	Written   int // Summaries (re)written
+	Unchanged int // Summaries whose input didn't change
+	Skipped   int // Sessions below summarize.min_session_chars
+	Deleted   int // Summaries of sessions that no longer exist
+	// DeletedIDs are the deleted summaries, to drop from the summary index
+	DeletedIDs []string
+}
+
+// SummarizeThread brings a thread's summaries up to date: each session long
+// enough gets one, then the thread gets one made from them. Summaries whose
+// input, model and prompt are unchanged are kept unless force is set.
+func (s *Summarizer) SummarizeThread(ctx context.Context, db *sql.DB, store *storage.Storage, threadID int64, force bool) (Result, error) {
+	var res Result
+	sessions, err := LoadSessions(ctx, db, threadID)
+	if err != nil {
+		return res, err
+	}
+	existing, err := store.GetSummaries(threadID)
+	if err != nil {
+		return res, fmt.Errorf("loading summaries: %w", err)
+	}
+	old := make(map[int]storage.Summary, len(existing))
+	for _, sum := range existing {
+		old[sum.SessionIdx] = sum
+	}
+
+	keep := make(map[int]bool)
+	var sessionSummaries []storage.Summary
+	threadName := ""
+	for _, sess := range sessions {
+		threadName = sess.ThreadName
+		if utf8.RuneCountInString(sess.Text) < s.cfg.MinSessionChars {
+			res.Skipped++
+			continue
+		}
+		keep[sess.SessionIdx] = true
+
+		hash := s.sourceHash(s.cfg.SessionPrompt, sess.Text)
+		if prev, ok := old[sess.SessionIdx]; ok && prev.SourceHash == hash && !force {
+			res.Unchanged++
+			sessionSummaries = append(sessionSummaries, prev)
+			continue
+		}
+		text, err := s.complete(ctx, s.cfg.SessionPrompt, sessionInput(sess, s.cfg.MaxInputChars))
+		if err != nil {
+			return res, fmt.Errorf("summarizing session %d: %w", sess.SessionIdx, err)
+		}
+		sum := storage.Summary{
+			SummaryID:        SummaryID(threadID, sess.SessionIdx),
+			ThreadID:         threadID,
+			SessionIdx:       sess.SessionIdx,
+			Text:             text,
+			Model:            s.model,
+			SourceHash:       hash,
+			StartTimestampMs: sess.StartTimestampMs,
+			EndTimestampMs:   sess.EndTimestampMs,
+		}
+		if err := store.UpsertSummary(sum); err != nil {
+			return res, fmt.Errorf("storing summary: %w", err)
+		}
+		res.Written++
+		sessionSummaries = append(sessionSummaries, sum)
+	}
+
+	// A thread of one session is summarized by it already
+	if len(sessionSummaries) > 1 {
+		keep[storage.ThreadSummaryIdx] = true
+		input := threadInput(threadName, sessionSummaries, s.cfg.MaxInputChars)
+		hash := s.sourceHash(s.cfg.ThreadPrompt, input)
+		if prev, ok := old[storage.ThreadSummaryIdx]; ok && prev.SourceHash == hash && !force {
+			res.Unchanged++
+		} else {
+			text, err := s.complete(ctx, s.cfg.ThreadPrompt, input)
+			if err != nil {
+				return res, fmt.Errorf("summarizing thread: %w", err)
+			}
+			err = store.UpsertSummary(storage.Summary{
+				SummaryID:        SummaryID(threadID, storage.ThreadSummaryIdx),
+				ThreadID:         threadID,
+				SessionIdx:       storage.ThreadSummaryIdx,
+				Text:             text,
+				Model:            s.model,
+				SourceHash:       hash,
+				StartTimestampMs: sessionSummaries[0].StartTimestampMs,
+				EndTimestampMs:   sessionSummaries[len(sessionSummaries)-1].EndTimestampMs,
+			})
+			if err != nil {
+				return res, fmt.Errorf("storing summary: %w", err)
+			}
+			res.Written++
+		}
+	}
+
+	// Re-chunking can merge or drop sessions
+	for _, sum := range existing {
+		if !keep[sum.SessionIdx] {
+			res.DeletedIDs = append(res.DeletedIDs, sum.SummaryID)
+		}
+	}
+	if err := store.DeleteSummaries(res.DeletedIDs); err != nil {
+		return res, fmt.Errorf("deleting stale summaries: %w", err)
+	}
+	res.Deleted = len(res.DeletedIDs)
+	return res, nil
+}
+
+// complete sends prompt as the system message and input as the user message
+func (s *Summarizer) complete(ctx context.Context, prompt, input string) (string, error) {
+	resp, err := s.llm.Complete(ctx, llm.Request{
+		Model: s.model,
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: prompt},
+			{Role: llm.RoleUser, Content: input},
+		},
+		MaxTokens: s.cfg.MaxTokens,
+	})
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(resp.Content)
+	if text == "" {
+		return "", fmt.Errorf("model returned an empty summary")
+	}
+	return text, nil
+}
+
+// sourceHash covers everything a summary depends on
+func (s *Summarizer) sourceHash(prompt, input string) string {
+	h := sha256.New()
+	for _, part := range []string{s.model, prompt, fmt.Sprint(s.cfg.MaxInputChars), input} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// sessionInput is the transcript the model summarizes
+func sessionInput(sess Session, maxChars int) string {
+	header := ""
+	if sess.ThreadName != "" {
+		header = "Chat: " + sess.ThreadName + "\n\n"
+	}
+	return header + fitInput(sess.Text, maxChars)
+}
+
+// threadInput lists the session summaries, oldest first
+func threadInput(threadName string, sessions []storage.Summary, maxChars int) string {
+	var b strings.Builder
+	if threadName != "" {
+		b.WriteString("Chat: " + threadName + "\n\n")
+	}
+	for _, sum := range sessions {
+		fmt.Fprintf(&b, "- %s\n", sum.Text)
+	}
+	return fitInput(b.String(), maxChars)
+}
+
+// fitInput cuts text longer than maxChars runes in the middle, keeping how
+// the conversation started and ended
+func fitInput(text string, maxChars int) string {
+	r := []rune(text)
+	if maxChars <= 0 || len(r) <= maxChars {
+		return text
+	}
+	head := maxChars / 2
+	tail := maxChars - head
+	return string(r[:head]) + "\n[…]\n" + string(r[len(r)-tail:])
+}
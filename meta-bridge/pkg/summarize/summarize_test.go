@@ -0,0 +1,93 @@
+package summarize
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.mau.fi/mautrix-meta/pkg/llm"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+	"go.mau.fi/mautrix-meta/pkg/storage"
+	"go.mau.fi/mautrix-meta/pkg/storage/storagetest"
+)
+
+// fakeLLM answers with the first line of the input it was given
+type fakeLLM struct{ calls int }
+
+func (f *fakeLLM) Complete(ctx context.Context, req llm.Request) (*llm.Response, error) {
+	f.calls++
+	input := req.Messages[len(req.Messages)-1].Content
+	first, _, _ := strings.Cut(input, "\n")
+	return &llm.Response{Content: "summary of " + first}, nil
+}
+
+func TestSummarizeThread(t *testing.T) {
+	long := strings.Repeat("we should book the cabin before the prices go up. ", 10)
+	store, db := storagetest.NewStore(t,
+		`CREATE TABLE chunks (chunk_id TEXT PRIMARY KEY, thread_id INTEGER, thread_name TEXT, session_idx INTEGER,
+			chunk_idx INTEGER, text TEXT, start_timestamp_ms INTEGER, end_timestamp_ms INTEGER)`,
+		`INSERT INTO chunks VALUES
+			('a', 1, 'Trip', 0, 0, 'Anna: `+long+`', 100, 200),
+			('b', 1, 'Trip', 0, 1, 'Bob: agreed', 200, 300),
+			('c', 1, 'Trip', 1, 0, 'Bob: ok', 1000, 1100),
+			('d', 1, 'Trip', 2, 0, 'Bob: `+long+`', 2000, 2100)`,
+	)
+
+	ctx := context.Background()
+	cfg := ragconfig.Default().Summarize
+	fake := &fakeLLM{}
+	s := New(fake, cfg, "test-model")
+
+	// Sessions 0 and 2, then the thread; session 1 is too short
+	res, err := s.SummarizeThread(ctx, db, store, 1, false)
+	if err != nil {
+		t.Fatalf("SummarizeThread: %v", err)
+	}
+	if res.Written != 3 || res.Skipped != 1 || fake.calls != 3 {
+		t.Fatalf("first run: %+v after %d calls, want 3 written, 1 skipped", res, fake.calls)
+	}
+	sums, err := store.GetSummaries(1)
+	if err != nil {
+		t.Fatalf("GetSummaries: %v", err)
+	}
+	if len(sums) != 3 || sums[0].SessionIdx != storage.ThreadSummaryIdx || sums[0].StartTimestampMs != 100 || sums[0].EndTimestampMs != 2100 {
+		t.Fatalf("unexpected summaries %+v", sums)
+	}
+	if sums[1].Text != "summary of Chat: Trip" || sums[1].EndTimestampMs != 300 {
+		t.Errorf("session 0 summary = %+v", sums[1])
+	}
+
+	// Nothing changed: no model calls
+	res, err = s.SummarizeThread(ctx, db, store, 1, false)
+	if err != nil {
+		t.Fatalf("SummarizeThread: %v", err)
+	}
+	if res.Written != 0 || res.Unchanged != 3 || fake.calls != 3 {
+		t.Fatalf("rerun: %+v after %d calls, want all unchanged", res, fake.calls)
+	}
+
+	// Re-chunking dropped session 2: its summary and the thread summary go
+	if _, err := db.Exec(`DELETE FROM chunks WHERE session_idx = 2`); err != nil {
+		t.Fatalf("deleting session: %v", err)
+	}
+	res, err = s.SummarizeThread(ctx, db, store, 1, false)
+	if err != nil {
+		t.Fatalf("SummarizeThread: %v", err)
+	}
+	want := []string{SummaryID(1, storage.ThreadSummaryIdx), SummaryID(1, 2)}
+	if res.Deleted != 2 || len(res.DeletedIDs) != 2 || res.DeletedIDs[0] != want[0] || res.DeletedIDs[1] != want[1] {
+		t.Fatalf("after dropping a session: %+v, want %v deleted", res, want)
+	}
+	if sums, _ := store.GetSummaries(1); len(sums) != 1 || sums[0].SessionIdx != 0 {
+		t.Errorf("remaining summaries %+v, want session 0 only", sums)
+	}
+}
+
+func TestFitInput(t *testing.T) {
+	if got := fitInput("short", 10); got != "short" {
+		t.Errorf("fitInput(short) = %q", got)
+	}
+	if got := fitInput("abcdefghij", 4); got != "ab\n[…]\nij" {
+		t.Errorf("fitInput = %q, want head and tail", got)
+	}
+}
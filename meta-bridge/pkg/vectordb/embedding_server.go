@@ -0,0 +1,196 @@
+package vectordb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// maxRestartWait caps the backoff between restarts of a crashing server
+const maxRestartWait = time.Minute
+
+// EmbeddingServer supervises a local embedding server process started from
+// embedding.server.command: it is restarted whenever it exits, until Stop
+type EmbeddingServer struct {
+	command      []string
+	readyTimeout time.Duration
+	restartWait  time.Duration
+	ready        func(context.Context) bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartEmbeddingServer starts the configured embedding server and waits
+// until ready reports it answering (typically EmbeddingClient.IsAvailable).
+// It returns nil without starting anything when no command is configured or
+// a server already answers. The server is supervised until Stop, which
+// callers must run before exiting, also on errors: a server left behind keeps
+// its model in memory.
+func StartEmbeddingServer(ctx context.Context, cfg ragconfig.EmbeddingServerConfig, ready func(context.Context) bool) (*EmbeddingServer, error) {
+	if len(cfg.Command) == 0 {
+		return nil, nil
+	}
+	if ready(ctx) {
+		log.Info().Msg("Embedding server already running, not starting embedding.server.command")
+		return nil, nil
+	}
+
+	defaults := ragconfig.Default().Embedding.Server
+	s := &EmbeddingServer{
+		command:      cfg.Command,
+		readyTimeout: time.Duration(cfg.ReadyTimeoutSeconds) * time.Second,
+		restartWait:  time.Duration(cfg.RestartWaitSeconds) * time.Second,
+		ready:        ready,
+		done:         make(chan struct{}),
+	}
+	if s.readyTimeout <= 0 {
+		s.readyTimeout = time.Duration(defaults.ReadyTimeoutSeconds) * time.Second
+	}
+	if s.restartWait <= 0 {
+		s.restartWait = time.Duration(defaults.RestartWaitSeconds) * time.Second
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	exited, err := s.start(runCtx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := s.waitReady(ctx, exited); err != nil {
+		cancel()
+		return nil, err
+	}
+	log.Info().Str("command", s.command[0]).Msg("Embedding server ready")
+
+	go s.supervise(runCtx, exited)
+	return s, nil
+}
+
+// Stop terminates the server and waits for it to exit
+func (s *EmbeddingServer) Stop() {
+	if s == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
+
+// start launches the process; exited receives its exit error once it is gone
+func (s *EmbeddingServer) start(ctx context.Context) (<-chan error, error) {
+	cmd := exec.CommandContext(ctx, s.command[0], s.command[1:]...)
+	// Give the server a chance to shut down cleanly before it is killed
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 10 * time.Second
+
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return nil, fmt.Errorf("starting embedding server: %w", err)
+	}
+	log.Info().Int("pid", cmd.Process.Pid).Strs("command", s.command).Msg("Started embedding server")
+
+	go func() {
+		scanner := bufio.NewScanner(pr)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			log.Debug().Str("line", scanner.Text()).Msg("Embedding server")
+		}
+		io.Copy(io.Discard, pr)
+	}()
+
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		pw.Close()
+		exited <- err
+	}()
+	return exited, nil
+}
+
+// waitReady polls ready until it succeeds, the process exits or the ready
+// timeout passes. On failure the process is gone.
+func (s *EmbeddingServer) waitReady(ctx context.Context, exited <-chan error) error {
+	deadline := time.NewTimer(s.readyTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("embedding server exited before it was ready: %w", exitError(err))
+		case <-deadline.C:
+			s.cancel()
+			<-exited
+			return fmt.Errorf("embedding server not ready after %s", s.readyTimeout)
+		case <-ctx.Done():
+			s.cancel()
+			<-exited
+			return ctx.Err()
+		case <-ticker.C:
+			if s.ready(ctx) {
+				return nil
+			}
+		}
+	}
+}
+
+// supervise restarts the server whenever it exits, waiting longer between
+// restarts while it keeps exiting soon after starting
+func (s *EmbeddingServer) supervise(ctx context.Context, exited <-chan error) {
+	defer close(s.done)
+
+	wait := s.restartWait
+	started := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			<-exited
+			log.Info().Msg("Embedding server stopped")
+			return
+		case err := <-exited:
+			if ctx.Err() != nil {
+				log.Info().Msg("Embedding server stopped")
+				return
+			}
+			if time.Since(started) > maxRestartWait {
+				wait = s.restartWait
+			}
+			log.Warn().Err(exitError(err)).Dur("restart_in", wait).Msg("Embedding server exited, restarting")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			wait = min(wait*2, maxRestartWait)
+
+			started = time.Now()
+			var startErr error
+			if exited, startErr = s.start(ctx); startErr != nil {
+				log.Error().Err(startErr).Msg("Failed to restart embedding server, giving up")
+				return
+			}
+		}
+	}
+}
+
+// exitError describes a clean exit too, which for a server is still a failure
+func exitError(err error) error {
+	if err == nil {
+		return errors.New("exited with status 0")
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package vectordb
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+func TestEmbeddingServer_RestartsAfterExit(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	starts := filepath.Join(t.TempDir(), "starts")
+	// Each run records itself and "crashes" shortly after becoming ready
+	cfg := ragconfig.EmbeddingServerConfig{
+		Command:             []string{"sh", "-c", `echo start >> "$0"; sleep 1`, starts},
+		ReadyTimeoutSeconds: 5,
+		RestartWaitSeconds:  1,
+	}
+	ready := func(context.Context) bool {
+		_, err := os.Stat(starts)
+		return err == nil
+	}
+
+	srv, err := StartEmbeddingServer(context.Background(), cfg, ready)
+	if err != nil {
+		t.Fatalf("StartEmbeddingServer: %v", err)
+	}
+	if srv == nil {
+		t.Fatal("expected a supervised server")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if b, _ := os.ReadFile(starts); strings.Count(string(b), "start") >= 2 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	srv.Stop()
+
+	b, _ := os.ReadFile(starts)
+	n := strings.Count(string(b), "start")
+	if n < 2 {
+		t.Fatalf("server started %d times, want a restart", n)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if b, _ := os.ReadFile(starts); strings.Count(string(b), "start") != n {
+		t.Error("server restarted after Stop")
+	}
+}
+
+func TestEmbeddingServer_ExitBeforeReady(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	cfg := ragconfig.EmbeddingServerConfig{Command: []string{"sh", "-c", "exit 3"}, ReadyTimeoutSeconds: 5}
+	never := func(context.Context) bool { return false }
+
+	start := time.Now()
+	if _, err := StartEmbeddingServer(context.Background(), cfg, never); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Fatalf("StartEmbeddingServer = %v, want the exit status", err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Error("waited for the ready timeout instead of noticing the exit")
+	}
+
+	// Nothing configured, or already running: nothing to start
+	always := func(context.Context) bool { return true }
+	for _, cfg := range []ragconfig.EmbeddingServerConfig{{}, {Command: []string{"sh", "-c", "exit 3"}}} {
+		if srv, err := StartEmbeddingServer(context.Background(), cfg, always); srv != nil || err != nil {
+			t.Errorf("StartEmbeddingServer(%v) = %v, %v; want nil, nil", cfg.Command, srv, err)
+		}
+	}
+}
@@ -3,30 +3,78 @@ package vectordb
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
+
+	"go.mau.fi/mautrix-meta/pkg/metrics"
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+var (
+	embeddingDuration = metrics.Default.NewHistogram("rag_embedding_request_duration_seconds",
+		"Embedding provider requests, retries included, by outcome (ok or error).", metrics.DurationBuckets, "outcome")
+	embeddingTexts = metrics.Default.NewCounter("rag_embedding_texts_total", "Texts sent to the embedding provider.")
 )
 
-// EmbeddingClient generates embeddings via LMStudio's OpenAI-compatible API
+// EmbeddingClient generates embeddings through an EmbeddingProvider
+// (LMStudio's OpenAI-compatible API by default)
 type EmbeddingClient struct {
 	baseURL    string
 	model      string
 	httpClient *http.Client
 	dimension  int
+	provider   EmbeddingProvider
+	apiKey     string
+	maxBatch   int
+
+	useCurl      bool
+	timeout      time.Duration
+	batchTimeout time.Duration
+	maxRetries   int
+	retryWait    time.Duration
+
+	usageMu sync.Mutex
+	usage   EmbeddingUsage
+}
+
+// EmbeddingUsage is the token usage reported by the embeddings API
+type EmbeddingUsage struct {
+	Requests     int64
+	PromptTokens int64
+	TotalTokens  int64
 }
 
-// EmbeddingConfig holds configuration for the embedding client
+// EmbeddingConfig holds configuration for the embedding client. Zero values
+// take the defaults.
 type EmbeddingConfig struct {
 	BaseURL   string // LMStudio server URL (default: http://127.0.0.1:1234/v1)
 	Model     string // Embedding model name (default: text-embedding-qwen3-embedding-8b)
 	Dimension int    // Vector dimension (default: 4096 for qwen3)
+
+	Provider     EmbeddingProvider // Wire format (default: OpenAIProvider)
+	APIKey       string            // Sent as a bearer token when set
+	MaxBatchSize int               // Texts per request (default: the provider's limit)
+
+	// UseCurl shells out to curl instead of using net/http. Only for servers
+	// that crash on Go's client; needs curl on PATH.
+	UseCurl         bool
+	Timeout         time.Duration // Single-text request timeout (default: 30s)
+	BatchTimeout    time.Duration // Batch request timeout (default: 2m)
+	MaxRetries      int           // Attempts per request (default: 3)
+	RetryWait       time.Duration // Pause before retrying (default: 10s)
+	KeepAlive       bool          // Reuse connections (off by default: LMStudio crashes on reused connections)
+	MaxConnsPerHost int           // 0 = unlimited
 }
 
 // DefaultEmbeddingConfig returns sensible defaults.
@@ -34,12 +82,44 @@ type EmbeddingConfig struct {
 // using -drop-collection flag, as dimensions will differ between models.
 func DefaultEmbeddingConfig() EmbeddingConfig {
 	return EmbeddingConfig{
-		BaseURL:   "http://127.0.0.1:1234/v1",
-		Model:     "text-embedding-qwen3-embedding-8b",
-		Dimension: 4096,
+		BaseURL:      "http://127.0.0.1:1234/v1",
+		Model:        "text-embedding-qwen3-embedding-8b",
+		Dimension:    4096,
+		Timeout:      30 * time.Second,
+		BatchTimeout: 120 * time.Second,
+		MaxRetries:   3,
+		RetryWait:    10 * time.Second,
 	}
 }
 
+// EmbeddingConfigFrom converts the RAG config's embedding section,
+// resolving the provider and reading the API key from its environment variable
+func EmbeddingConfigFrom(cfg ragconfig.EmbeddingConfig) (EmbeddingConfig, error) {
+	provider, err := NewEmbeddingProvider(cfg.Provider)
+	if err != nil {
+		return EmbeddingConfig{}, err
+	}
+	apiKey := ""
+	if cfg.APIKeyEnv != "" {
+		apiKey = os.Getenv(cfg.APIKeyEnv)
+	}
+	return EmbeddingConfig{
+		BaseURL:         cfg.BaseURL,
+		Model:           cfg.Model,
+		Dimension:       cfg.Dimension,
+		Provider:        provider,
+		APIKey:          apiKey,
+		MaxBatchSize:    cfg.MaxBatchSize,
+		UseCurl:         cfg.Transport == ragconfig.EmbeddingTransportCurl,
+		Timeout:         time.Duration(cfg.TimeoutSeconds) * time.Second,
+		BatchTimeout:    time.Duration(cfg.BatchTimeoutSeconds) * time.Second,
+		MaxRetries:      cfg.MaxRetries,
+		RetryWait:       time.Duration(cfg.RetryWaitSeconds) * time.Second,
+		KeepAlive:       cfg.KeepAlive,
+		MaxConnsPerHost: cfg.MaxConnsPerHost,
+	}, nil
+}
+
 // NewEmbeddingClient creates a new embedding client
 func NewEmbeddingClient(cfg EmbeddingConfig) *EmbeddingClient {
 	defaults := DefaultEmbeddingConfig()
@@ -52,137 +132,79 @@ func NewEmbeddingClient(cfg EmbeddingConfig) *EmbeddingClient {
 	if cfg.Dimension == 0 {
 		cfg.Dimension = defaults.Dimension
 	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaults.Timeout
+	}
+	if cfg.BatchTimeout <= 0 {
+		cfg.BatchTimeout = defaults.BatchTimeout
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = defaults.MaxRetries
+	}
+	if cfg.RetryWait <= 0 {
+		cfg.RetryWait = defaults.RetryWait
+	}
+	if cfg.Provider == nil {
+		cfg.Provider = OpenAIProvider{}
+	}
+	if limit := cfg.Provider.MaxBatchSize(); cfg.MaxBatchSize <= 0 || (limit > 0 && cfg.MaxBatchSize > limit) {
+		cfg.MaxBatchSize = limit
+	}
 
 	return &EmbeddingClient{
-		baseURL:   cfg.BaseURL,
-		model:     cfg.Model,
-		dimension: cfg.Dimension,
+		baseURL:      strings.TrimRight(cfg.BaseURL, "/"),
+		model:        cfg.Model,
+		dimension:    cfg.Dimension,
+		provider:     cfg.Provider,
+		apiKey:       cfg.APIKey,
+		maxBatch:     cfg.MaxBatchSize,
+		useCurl:      cfg.UseCurl,
+		timeout:      cfg.Timeout,
+		batchTimeout: cfg.BatchTimeout,
+		maxRetries:   cfg.MaxRetries,
+		retryWait:    cfg.RetryWait,
+		// Per-request timeouts come from the context; this one only bounds
+		// IsAvailable and stray requests
 		httpClient: &http.Client{
-			Timeout: 120 * time.Second,
+			Timeout: max(cfg.Timeout, cfg.BatchTimeout),
 			Transport: &http.Transport{
-				DisableKeepAlives: true, // Fresh connection each request (fixes LMStudio crashes)
+				Proxy:               http.ProxyFromEnvironment,
+				DisableKeepAlives:   !cfg.KeepAlive, // Fresh connection each request by default (fixes LMStudio crashes)
+				MaxConnsPerHost:     cfg.MaxConnsPerHost,
+				MaxIdleConnsPerHost: max(cfg.MaxConnsPerHost, 2),
+				IdleConnTimeout:     90 * time.Second,
 			},
 		},
 	}
 }
 
-// embeddingRequest is the request body for the embeddings API (batch)
-type embeddingRequest struct {
-	Input []string `json:"input"`
-	Model string   `json:"model"`
-}
-
-// embeddingRequestSingle is for single text (avoids LMStudio batch code path bug)
-type embeddingRequestSingle struct {
-	Input string `json:"input"`
-	Model string `json:"model"`
-}
-
-// embeddingResponse is the response from the embeddings API
-type embeddingResponse struct {
-	Data []struct {
-		Embedding []float32 `json:"embedding"`
-		Index     int       `json:"index"`
-	} `json:"data"`
-	Model string `json:"model"`
-	Usage struct {
-		PromptTokens int `json:"prompt_tokens"`
-		TotalTokens  int `json:"total_tokens"`
-	} `json:"usage"`
-}
-
-// Embed generates an embedding for a single text
-// Uses curl subprocess because Go's http.Client causes LMStudio crashes
-// Includes retry logic to handle transient LMStudio crashes (model auto-reloads)
+// Embed generates an embedding for a single text.
+// Retries handle transient LMStudio crashes (the model auto-reloads).
 func (c *EmbeddingClient) Embed(ctx context.Context, text string) ([]float32, error) {
 	// Trim trailing whitespace - trailing newlines crash EmbeddingGemma model
 	text = strings.TrimSpace(text)
 
-	reqBody := embeddingRequestSingle{
-		Input: text,
-		Model: c.model,
-	}
-
-	jsonBody, err := json.Marshal(reqBody)
+	batch, err := c.request(ctx, []string{text}, c.timeout)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+		return nil, err
 	}
 
-	const maxRetries = 3
-	var lastErr error
-
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if attempt > 0 {
-			// Wait for LMStudio to reload the model (takes ~5-10s)
-			waitTime := 10 * time.Second
-			log.Warn().
-				Int("attempt", attempt+1).
-				Int("max_retries", maxRetries).
-				Dur("wait", waitTime).
-				Msg("Retrying embedding request after model reload")
-			time.Sleep(waitTime)
-		}
-
-		// Write JSON to temp file to avoid shell escaping issues
-		tmpFile, err := os.CreateTemp("", "embed-*.json")
-		if err != nil {
-			return nil, fmt.Errorf("failed to create temp file: %w", err)
-		}
-
-		if _, err := tmpFile.Write(jsonBody); err != nil {
-			tmpFile.Close()
-			os.Remove(tmpFile.Name())
-			return nil, fmt.Errorf("failed to write temp file: %w", err)
-		}
-		tmpFile.Close()
-
-		// Use curl subprocess with @file and timeout
-		cmd := exec.CommandContext(ctx, "curl", "-s", "-X", "POST",
-			"--max-time", "30", // 30s timeout - model crashes can hang
-			c.baseURL+"/embeddings",
-			"-H", "Content-Type: application/json",
-			"-d", "@"+tmpFile.Name())
-
-		output, err := cmd.Output()
-		os.Remove(tmpFile.Name())
-
-		if err != nil {
-			lastErr = fmt.Errorf("curl failed: %w", err)
-			continue
-		}
-
-		var embResp embeddingResponse
-		if err := json.Unmarshal(output, &embResp); err != nil {
-			lastErr = fmt.Errorf("failed to decode embedding response: %w", err)
-			continue
-		}
-
-		if len(embResp.Data) == 0 {
-			// Model crashed - LMStudio returns empty data, will auto-reload
-			lastErr = fmt.Errorf("model crashed, waiting for reload")
-			log.Warn().
-				Int("attempt", attempt+1).
-				Msg("Embedding model crashed, will retry")
-			continue
-		}
-
-		embedding := embResp.Data[0].Embedding
-		if c.dimension > 0 && len(embedding) != c.dimension {
-			return nil, fmt.Errorf("embedding dimension mismatch: expected %d, got %d", c.dimension, len(embedding))
-		}
+	embedding := batch.Embeddings[0]
+	if c.dimension > 0 && len(embedding) != c.dimension {
+		return nil, fmt.Errorf("embedding dimension mismatch: expected %d, got %d", c.dimension, len(embedding))
+	}
+	c.addUsage(batch)
 
+	if c.useCurl {
 		// Small delay between requests
 		time.Sleep(100 * time.Millisecond)
-
-		return embedding, nil
 	}
 
-	log.Error().Int("max_retries", maxRetries).Err(lastErr).Msg("Embedding request failed after retries")
-	return nil, fmt.Errorf("failed after %d retries: %w", maxRetries, lastErr)
+	return embedding, nil
 }
 
-// EmbedBatch generates embeddings for multiple texts
-// Uses curl subprocess with retry logic to handle LMStudio crashes
+// EmbedBatch generates embeddings for multiple texts, retrying like Embed.
+// Batches larger than the provider's limit are split into several requests.
 func (c *EmbeddingClient) EmbedBatch(ctx context.Context, texts []string) ([][]float32, error) {
 	if len(texts) == 0 {
 		return nil, nil
@@ -194,109 +216,228 @@ func (c *EmbeddingClient) EmbedBatch(ctx context.Context, texts []string) ([][]f
 		sanitized[i] = strings.TrimSpace(t)
 	}
 
-	reqBody := embeddingRequest{
-		Input: sanitized,
-		Model: c.model,
+	step := len(sanitized)
+	if c.maxBatch > 0 {
+		step = c.maxBatch
+	}
+	result := make([][]float32, 0, len(texts))
+	for start := 0; start < len(sanitized); start += step {
+		part := sanitized[start:min(start+step, len(sanitized))]
+		batch, err := c.request(ctx, part, c.batchTimeout)
+		if err != nil {
+			return nil, err
+		}
+		for i, emb := range batch.Embeddings {
+			if emb == nil {
+				return nil, fmt.Errorf("missing embedding for index %d", start+i)
+			}
+			if c.dimension > 0 && len(emb) != c.dimension {
+				return nil, fmt.Errorf("embedding dimension mismatch: expected %d, got %d", c.dimension, len(emb))
+			}
+		}
+		c.addUsage(batch)
+		result = append(result, batch.Embeddings...)
 	}
 
-	jsonBody, err := json.Marshal(reqBody)
+	return result, nil
+}
+
+// permanentError marks a failure that retrying won't fix (e.g. a 4xx)
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// request embeds texts in one provider request, with retries. The result
+// has one entry per text and at least one of them is set.
+func (c *EmbeddingClient) request(ctx context.Context, texts []string, timeout time.Duration) (_ EmbeddingBatch, err error) {
+	start := time.Now()
+	defer func() {
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		embeddingDuration.ObserveSince(start, outcome)
+		embeddingTexts.Add(float64(len(texts)))
+	}()
+
+	body, err := c.provider.EncodeRequest(c.model, texts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+		return EmbeddingBatch{}, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	const maxRetries = 3
 	var lastErr error
 
-	for attempt := 0; attempt < maxRetries; attempt++ {
+	for attempt := 0; attempt < c.maxRetries; attempt++ {
 		if attempt > 0 {
-			// Wait for LMStudio to reload the model (takes ~10-15s for 8B model)
-			waitTime := 15 * time.Second
+			// Wait for LMStudio to reload the model (takes ~5-15s)
 			log.Warn().
 				Int("attempt", attempt+1).
-				Int("max_retries", maxRetries).
-				Dur("wait", waitTime).
-				Msg("Retrying batch embedding request after model reload")
-			time.Sleep(waitTime)
-		}
-
-		// Write JSON to temp file to avoid shell escaping issues
-		tmpFile, err := os.CreateTemp("", "embed-batch-*.json")
-		if err != nil {
-			return nil, fmt.Errorf("failed to create temp file: %w", err)
+				Int("max_retries", c.maxRetries).
+				Int("batch_size", len(texts)).
+				Dur("wait", c.retryWait).
+				Err(lastErr).
+				Msg("Retrying embedding request")
+			select {
+			case <-ctx.Done():
+				return EmbeddingBatch{}, ctx.Err()
+			case <-time.After(c.retryWait):
+			}
 		}
 
-		if _, err := tmpFile.Write(jsonBody); err != nil {
-			tmpFile.Close()
-			os.Remove(tmpFile.Name())
-			return nil, fmt.Errorf("failed to write temp file: %w", err)
+		var output []byte
+		var err error
+		if c.useCurl {
+			output, err = c.postCurl(ctx, body, timeout)
+		} else {
+			output, err = c.postHTTP(ctx, body, timeout)
 		}
-		tmpFile.Close()
-
-		// Use curl subprocess with timeout (batch can take longer)
-		cmd := exec.CommandContext(ctx, "curl", "-s", "-X", "POST",
-			"--max-time", "120", // 2 minute timeout for batch
-			c.baseURL+"/embeddings",
-			"-H", "Content-Type: application/json",
-			"-d", "@"+tmpFile.Name())
-
-		output, err := cmd.Output()
-		os.Remove(tmpFile.Name())
-
 		if err != nil {
-			lastErr = fmt.Errorf("curl failed: %w", err)
-			log.Warn().
-				Int("attempt", attempt+1).
-				Err(err).
-				Msg("Batch embedding request failed")
+			if ctx.Err() != nil {
+				return EmbeddingBatch{}, ctx.Err()
+			}
+			var perm *permanentError
+			if errors.As(err, &perm) {
+				return EmbeddingBatch{}, perm.err
+			}
+			lastErr = err
 			continue
 		}
 
 		// Check for error response (model crashed)
 		if bytes.Contains(output, []byte("unloaded or crashed")) || bytes.Contains(output, []byte("\"error\"")) {
 			lastErr = fmt.Errorf("model crashed (error response)")
-			log.Warn().
-				Int("attempt", attempt+1).
-				Int("batch_size", len(texts)).
-				Msg("Embedding model crashed during batch request, will retry")
 			continue
 		}
 
-		var embResp embeddingResponse
-		if err := json.Unmarshal(output, &embResp); err != nil {
+		batch, err := c.provider.DecodeResponse(output, len(texts))
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return EmbeddingBatch{}, perm.err
+		} else if err != nil {
 			lastErr = fmt.Errorf("failed to decode embedding response: %w", err)
 			continue
 		}
 
-		if len(embResp.Data) == 0 {
+		if !slices.ContainsFunc(batch.Embeddings, func(e []float32) bool { return e != nil }) {
+			// Model crashed - LMStudio returns empty data, will auto-reload
 			lastErr = fmt.Errorf("empty response, model may have crashed")
-			log.Warn().
-				Int("attempt", attempt+1).
-				Msg("Empty embedding batch response, will retry")
 			continue
 		}
 
-		// Sort by index to ensure correct order
-		result := make([][]float32, len(texts))
-		for _, data := range embResp.Data {
-			if c.dimension > 0 && len(data.Embedding) != c.dimension {
-				return nil, fmt.Errorf("embedding dimension mismatch: expected %d, got %d", c.dimension, len(data.Embedding))
-			}
-			if data.Index < len(result) {
-				result[data.Index] = data.Embedding
-			}
+		return batch, nil
+	}
+
+	log.Error().Int("max_retries", c.maxRetries).Err(lastErr).Msg("Embedding request failed after retries")
+	return EmbeddingBatch{}, fmt.Errorf("%w: failed after %d retries: %w", ErrUnavailable, c.maxRetries, lastErr)
+}
+
+func (c *EmbeddingClient) postHTTP(ctx context.Context, body []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+c.provider.EmbedPath(), bytes.NewReader(body))
+	if err != nil {
+		return nil, &permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	output, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("embeddings API returned %d: %s", resp.StatusCode, truncateBody(output))
+		// Server errors and rate limits are transient; other client errors aren't
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout {
+			return nil, err
 		}
+		return nil, &permanentError{err}
+	}
+	return output, nil
+}
 
-		for i, emb := range result {
-			if emb == nil {
-				return nil, fmt.Errorf("missing embedding for index %d", i)
-			}
+// postCurl is the fallback transport (embedding.transport: curl)
+func (c *EmbeddingClient) postCurl(ctx context.Context, body []byte, timeout time.Duration) ([]byte, error) {
+	// Write JSON to temp file to avoid shell escaping issues
+	tmpFile, err := os.CreateTemp("", "embed-*.json")
+	if err != nil {
+		return nil, &permanentError{fmt.Errorf("failed to create temp file: %w", err)}
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(body); err != nil {
+		tmpFile.Close()
+		return nil, &permanentError{fmt.Errorf("failed to write temp file: %w", err)}
+	}
+	tmpFile.Close()
+
+	args := []string{"-s", "-X", "POST",
+		"--max-time", strconv.Itoa(max(int(timeout.Seconds()), 1)),
+		c.baseURL + c.provider.EmbedPath(),
+		"-H", "Content-Type: application/json",
+		"-d", "@" + tmpFile.Name()}
+	if c.apiKey != "" {
+		// Via a header file so the key doesn't show up in the process list
+		headerFile, err := os.CreateTemp("", "embed-headers-*")
+		if err != nil {
+			return nil, &permanentError{fmt.Errorf("failed to create temp file: %w", err)}
 		}
+		defer os.Remove(headerFile.Name())
+		_, err = fmt.Fprintf(headerFile, "Authorization: Bearer %s\n", c.apiKey)
+		headerFile.Close()
+		if err != nil {
+			return nil, &permanentError{fmt.Errorf("failed to write temp file: %w", err)}
+		}
+		args = append(args, "-H", "@"+headerFile.Name())
+	}
+	cmd := exec.CommandContext(ctx, "curl", args...)
+
+	output, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, &permanentError{fmt.Errorf("%w: curl transport selected but curl is not installed", ErrUnavailable)}
+	} else if err != nil {
+		return nil, fmt.Errorf("curl failed: %w", err)
+	}
+	return output, nil
+}
 
-		return result, nil
+func truncateBody(b []byte) string {
+	const maxLen = 200
+	s := strings.TrimSpace(string(b))
+	if len(s) > maxLen {
+		return s[:maxLen] + "..."
 	}
+	return s
+}
+
+func (c *EmbeddingClient) addUsage(batch EmbeddingBatch) {
+	c.usageMu.Lock()
+	defer c.usageMu.Unlock()
+	c.usage.Requests++
+	c.usage.PromptTokens += int64(batch.PromptTokens)
+	c.usage.TotalTokens += int64(batch.TotalTokens)
+}
+
+// Usage returns the cumulative token usage of successful requests
+func (c *EmbeddingClient) Usage() EmbeddingUsage {
+	c.usageMu.Lock()
+	defer c.usageMu.Unlock()
+	return c.usage
+}
 
-	log.Error().Int("max_retries", maxRetries).Err(lastErr).Msg("Batch embedding request failed after retries")
-	return nil, fmt.Errorf("failed after %d retries: %w", maxRetries, lastErr)
+// Model returns the embedding model name
+func (c *EmbeddingClient) Model() string {
+	return c.model
 }
 
 // Dimension returns the embedding dimension
@@ -306,10 +447,13 @@ func (c *EmbeddingClient) Dimension() int {
 
 // IsAvailable checks if the embedding service is available
 func (c *EmbeddingClient) IsAvailable(ctx context.Context) bool {
-	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/models", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+c.provider.HealthPath(), nil)
 	if err != nil {
 		return false
 	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
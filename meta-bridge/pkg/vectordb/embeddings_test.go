@@ -2,10 +2,15 @@ package vectordb
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os/exec"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestEmbeddingClient_DimensionMismatch(t *testing.T) {
@@ -34,3 +39,142 @@ func TestEmbeddingClient_DimensionMismatch(t *testing.T) {
 		t.Fatalf("expected dimension mismatch error")
 	}
 }
+
+func TestEmbeddingClient_RetriesTransientErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"data": [{"embedding": [0.1, 0.2], "index": 0}]}`)
+	}))
+	defer srv.Close()
+
+	c := NewEmbeddingClient(EmbeddingConfig{
+		BaseURL:   srv.URL,
+		Dimension: 2,
+		RetryWait: time.Millisecond,
+	})
+	emb, err := c.Embed(context.Background(), "hello")
+	if err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+	if len(emb) != 2 || calls.Load() != 2 {
+		t.Fatalf("expected success on second attempt, got %v after %d calls", emb, calls.Load())
+	}
+}
+
+func TestEmbeddingClient_DoesNotRetryClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "input too long", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	c := NewEmbeddingClient(EmbeddingConfig{
+		BaseURL:   srv.URL,
+		Dimension: 2,
+		RetryWait: time.Millisecond,
+	})
+	_, err := c.EmbedBatch(context.Background(), []string{"hello"})
+	if err == nil || errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected a non-retryable error, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected one attempt, got %d", calls.Load())
+	}
+}
+
+func TestEmbeddingClient_CurlTransport(t *testing.T) {
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("curl not installed")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"data": [{"embedding": [0.3], "index": 1}, {"embedding": [0.1], "index": 0}]}`)
+	}))
+	defer srv.Close()
+
+	c := NewEmbeddingClient(EmbeddingConfig{
+		BaseURL:   srv.URL,
+		Dimension: 1,
+		UseCurl:   true,
+	})
+	embs, err := c.EmbedBatch(context.Background(), []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("EmbedBatch: %v", err)
+	}
+	if embs[0][0] != 0.1 || embs[1][0] != 0.3 {
+		t.Fatalf("expected embeddings in input order, got %v", embs)
+	}
+}
+
+func TestEmbeddingClient_OllamaProviderSplitsBatches(t *testing.T) {
+	var sizes []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/embed" || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req ollamaEmbedRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		sizes = append(sizes, len(req.Input))
+		resp := ollamaEmbedResponse{PromptEvalCount: len(req.Input)}
+		for _, in := range req.Input {
+			resp.Embeddings = append(resp.Embeddings, []float32{float32(len(in))})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	c := NewEmbeddingClient(EmbeddingConfig{
+		BaseURL:      srv.URL,
+		Dimension:    1,
+		Provider:     OllamaProvider{},
+		APIKey:       "secret",
+		MaxBatchSize: 2,
+	})
+	embs, err := c.EmbedBatch(context.Background(), []string{"a", "bb", "ccc"})
+	if err != nil {
+		t.Fatalf("EmbedBatch: %v", err)
+	}
+	if len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 1 {
+		t.Fatalf("expected requests of 2 and 1 texts, got %v", sizes)
+	}
+	if len(embs) != 3 || embs[2][0] != 3 {
+		t.Fatalf("unexpected embeddings: %v", embs)
+	}
+	if u := c.Usage(); u.Requests != 2 || u.PromptTokens != 3 {
+		t.Fatalf("unexpected usage: %+v", u)
+	}
+}
+
+func TestLlamaCppProvider_DecodeResponse(t *testing.T) {
+	p := LlamaCppProvider{}
+	batch, err := p.DecodeResponse([]byte(`[{"index": 1, "embedding": [[0.5, 0.5]]}, {"index": 0, "embedding": [0.1, 0.2]}]`), 2)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if batch.Embeddings[0][1] != 0.2 || batch.Embeddings[1][0] != 0.5 {
+		t.Fatalf("unexpected embeddings: %v", batch.Embeddings)
+	}
+
+	if _, err := p.DecodeResponse([]byte(`[{"index": 0, "embedding": [[0.1], [0.2]]}]`), 1); err == nil {
+		t.Fatalf("expected error for unpooled token embeddings")
+	}
+}
+
+func TestNewEmbeddingProvider(t *testing.T) {
+	for name, want := range map[string]string{"": "openai", "Ollama": "ollama", "llamacpp": "llamacpp"} {
+		p, err := NewEmbeddingProvider(name)
+		if err != nil || p.Name() != want {
+			t.Errorf("NewEmbeddingProvider(%q) = %v, %v; want %s", name, p, err, want)
+		}
+	}
+	if _, err := NewEmbeddingProvider("cohere"); err == nil {
+		t.Errorf("expected error for unknown provider")
+	}
+}
@@ -0,0 +1,7 @@
+package vectordb
+
+import "errors"
+
+// ErrUnavailable is returned (wrapped) when the embedding service or Milvus
+// can't be reached; test with errors.Is
+var ErrUnavailable = errors.New("service unavailable")
@@ -0,0 +1,85 @@
+package vectordb
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/milvus-io/milvus-sdk-go/v2/client"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// MilvusClientConfig builds the SDK client config from the RAG config,
+// resolving the password and API key from their environment variables
+func MilvusClientConfig(cfg ragconfig.MilvusConfig) client.Config {
+	cc := client.Config{
+		Address:       cfg.Address,
+		DBName:        cfg.Database,
+		Username:      cfg.Username,
+		EnableTLSAuth: cfg.TLS,
+	}
+	if cfg.PasswordEnv != "" {
+		cc.Password = os.Getenv(cfg.PasswordEnv)
+	}
+	if cfg.APIKeyEnv != "" {
+		cc.APIKey = os.Getenv(cfg.APIKeyEnv)
+	}
+	return cc
+}
+
+// NewMilvusClient connects to Milvus using the RAG config. Connection failures
+// wrap ErrUnavailable.
+func NewMilvusClient(ctx context.Context, cfg ragconfig.MilvusConfig) (client.Client, error) {
+	c, err := client.NewClient(ctx, MilvusClientConfig(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return c, nil
+}
+
+// EnsureMilvusDatabase creates the configured database if it doesn't exist yet.
+// It's a no-op when no database (or the server default) is configured.
+func EnsureMilvusDatabase(ctx context.Context, cfg ragconfig.MilvusConfig) (created bool, err error) {
+	if cfg.Database == "" || cfg.Database == "default" {
+		return false, nil
+	}
+
+	// The database can't be selected before it exists, so connect to the default one
+	cc := MilvusClientConfig(cfg)
+	cc.DBName = ""
+	c, err := client.NewClient(ctx, cc)
+	if err != nil {
+		return false, fmt.Errorf("%w: connecting to Milvus: %w", ErrUnavailable, err)
+	}
+	defer c.Close()
+
+	dbs, err := c.ListDatabases(ctx)
+	if err != nil {
+		return false, fmt.Errorf("listing databases: %w", err)
+	}
+	for _, db := range dbs {
+		if db.Name == cfg.Database {
+			return false, nil
+		}
+	}
+	if err := c.CreateDatabase(ctx, cfg.Database); err != nil {
+		return false, fmt.Errorf("creating database %q: %w", cfg.Database, err)
+	}
+	return true, nil
+}
+
+// MilvusHasField reports whether the collection's schema has the named field,
+// for fields added after collections were first created
+func MilvusHasField(ctx context.Context, c client.Client, collection, field string) (bool, error) {
+	coll, err := c.DescribeCollection(ctx, collection)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range coll.Schema.Fields {
+		if f.Name == field {
+			return true, nil
+		}
+	}
+	return false, nil
+}
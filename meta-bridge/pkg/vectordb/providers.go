@@ -0,0 +1,209 @@
+package vectordb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.mau.fi/mautrix-meta/pkg/ragconfig"
+)
+
+// EmbeddingProvider speaks one embedding server's wire format. The client
+// handles transport, retries, batching and validation around it.
+type EmbeddingProvider interface {
+	// Name identifies the provider in logs and errors
+	Name() string
+	// EmbedPath is the embeddings endpoint, relative to the base URL
+	EmbedPath() string
+	// HealthPath is a cheap GET endpoint that returns 200 when the server is up
+	HealthPath() string
+	// MaxBatchSize is the most texts the server accepts per request (0 = no limit)
+	MaxBatchSize() int
+	EncodeRequest(model string, texts []string) ([]byte, error)
+	// DecodeResponse returns one embedding per input text, in input order.
+	// Entries the server didn't return are nil.
+	DecodeResponse(data []byte, n int) (EmbeddingBatch, error)
+}
+
+// EmbeddingBatch is a decoded embeddings response
+type EmbeddingBatch struct {
+	Embeddings   [][]float32
+	PromptTokens int
+	TotalTokens  int
+}
+
+// NewEmbeddingProvider returns the provider for an embedding.provider
+// config value ("" = OpenAI-compatible)
+func NewEmbeddingProvider(name string) (EmbeddingProvider, error) {
+	switch strings.ToLower(name) {
+	case "", ragconfig.EmbeddingProviderOpenAI:
+		return OpenAIProvider{}, nil
+	case ragconfig.EmbeddingProviderOllama:
+		return OllamaProvider{}, nil
+	case ragconfig.EmbeddingProviderLlamaCpp:
+		return LlamaCppProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown embedding provider %q (use %s, %s or %s)", name,
+			ragconfig.EmbeddingProviderOpenAI, ragconfig.EmbeddingProviderOllama, ragconfig.EmbeddingProviderLlamaCpp)
+	}
+}
+
+// OpenAIProvider speaks the OpenAI embeddings API, also served by LMStudio,
+// vLLM, Ollama's /v1 and llama.cpp's /v1. The base URL includes /v1.
+type OpenAIProvider struct{}
+
+func (OpenAIProvider) Name() string       { return ragconfig.EmbeddingProviderOpenAI }
+func (OpenAIProvider) EmbedPath() string  { return "/embeddings" }
+func (OpenAIProvider) HealthPath() string { return "/models" }
+
+// MaxBatchSize is OpenAI's per-request input limit
+func (OpenAIProvider) MaxBatchSize() int { return 2048 }
+
+// embeddingRequest is the request body for the embeddings API (batch)
+type embeddingRequest struct {
+	Input []string `json:"input"`
+	Model string   `json:"model"`
+}
+
+// embeddingRequestSingle is for single text (avoids LMStudio batch code path bug)
+type embeddingRequestSingle struct {
+	Input string `json:"input"`
+	Model string `json:"model"`
+}
+
+// embeddingResponse is the response from the embeddings API
+type embeddingResponse struct {
+	Data []struct {
+		Embedding []float32 `json:"embedding"`
+		Index     int       `json:"index"`
+	} `json:"data"`
+	Model string `json:"model"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+func (OpenAIProvider) EncodeRequest(model string, texts []string) ([]byte, error) {
+	if len(texts) == 1 {
+		return json.Marshal(embeddingRequestSingle{Input: texts[0], Model: model})
+	}
+	return json.Marshal(embeddingRequest{Input: texts, Model: model})
+}
+
+func (OpenAIProvider) DecodeResponse(data []byte, n int) (EmbeddingBatch, error) {
+	var resp embeddingResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return EmbeddingBatch{}, err
+	}
+	batch := EmbeddingBatch{
+		Embeddings:   make([][]float32, n),
+		PromptTokens: resp.Usage.PromptTokens,
+		TotalTokens:  resp.Usage.TotalTokens,
+	}
+	for _, d := range resp.Data {
+		if d.Index >= 0 && d.Index < n {
+			batch.Embeddings[d.Index] = d.Embedding
+		}
+	}
+	return batch, nil
+}
+
+// OllamaProvider speaks Ollama's native /api/embed. The base URL is the
+// server root (http://127.0.0.1:11434), without /v1.
+type OllamaProvider struct{}
+
+func (OllamaProvider) Name() string       { return ragconfig.EmbeddingProviderOllama }
+func (OllamaProvider) EmbedPath() string  { return "/api/embed" }
+func (OllamaProvider) HealthPath() string { return "/api/tags" }
+
+// MaxBatchSize has no server-side limit; large batches only hold the
+// request open longer than the timeout
+func (OllamaProvider) MaxBatchSize() int { return 256 }
+
+type ollamaEmbedRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type ollamaEmbedResponse struct {
+	Embeddings      [][]float32 `json:"embeddings"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+}
+
+func (OllamaProvider) EncodeRequest(model string, texts []string) ([]byte, error) {
+	return json.Marshal(ollamaEmbedRequest{Model: model, Input: texts})
+}
+
+func (OllamaProvider) DecodeResponse(data []byte, n int) (EmbeddingBatch, error) {
+	var resp ollamaEmbedResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return EmbeddingBatch{}, err
+	}
+	batch := EmbeddingBatch{
+		Embeddings:   make([][]float32, n),
+		PromptTokens: resp.PromptEvalCount,
+		TotalTokens:  resp.PromptEvalCount,
+	}
+	copy(batch.Embeddings, resp.Embeddings)
+	return batch, nil
+}
+
+// LlamaCppProvider speaks llama.cpp server's native /embedding. The base URL
+// is the server root; the server must run with --embedding and a pooling
+// type other than none.
+type LlamaCppProvider struct{}
+
+func (LlamaCppProvider) Name() string       { return ragconfig.EmbeddingProviderLlamaCpp }
+func (LlamaCppProvider) EmbedPath() string  { return "/embedding" }
+func (LlamaCppProvider) HealthPath() string { return "/health" }
+
+// MaxBatchSize keeps requests within a typical --parallel/--batch-size setup
+func (LlamaCppProvider) MaxBatchSize() int { return 32 }
+
+type llamaCppEmbedRequest struct {
+	Content []string `json:"content"`
+}
+
+type llamaCppEmbedding struct {
+	Index int `json:"index"`
+	// []float32 for pooled output; [][]float32 (one row) on newer servers
+	Embedding json.RawMessage `json:"embedding"`
+}
+
+func (LlamaCppProvider) EncodeRequest(_ string, texts []string) ([]byte, error) {
+	return json.Marshal(llamaCppEmbedRequest{Content: texts})
+}
+
+func (LlamaCppProvider) DecodeResponse(data []byte, n int) (EmbeddingBatch, error) {
+	var items []llamaCppEmbedding
+	if err := json.Unmarshal(data, &items); err != nil {
+		// Older servers answer a single input with a bare object
+		var single llamaCppEmbedding
+		if err2 := json.Unmarshal(data, &single); err2 != nil {
+			return EmbeddingBatch{}, err
+		}
+		items = []llamaCppEmbedding{single}
+	}
+
+	batch := EmbeddingBatch{Embeddings: make([][]float32, n)}
+	for _, item := range items {
+		if item.Index < 0 || item.Index >= n || len(item.Embedding) == 0 {
+			continue
+		}
+		var flat []float32
+		if err := json.Unmarshal(item.Embedding, &flat); err == nil {
+			batch.Embeddings[item.Index] = flat
+			continue
+		}
+		var rows [][]float32
+		if err := json.Unmarshal(item.Embedding, &rows); err != nil {
+			return EmbeddingBatch{}, err
+		}
+		if len(rows) != 1 {
+			return EmbeddingBatch{}, &permanentError{fmt.Errorf("llama.cpp returned %d token embeddings per input; start the server with a pooling type other than none", len(rows))}
+		}
+		batch.Embeddings[item.Index] = rows[0]
+	}
+	return batch, nil
+}
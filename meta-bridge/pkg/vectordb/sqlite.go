@@ -0,0 +1,150 @@
+package vectordb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// SQLiteVectorTable holds chunk embeddings for the sqlite vector backend.
+// Vectors are little-endian float32 BLOBs, the layout sqlite-vec reads. The
+// functions below take the table name, so vectors for another model can be
+// built next to it (see reembed).
+const SQLiteVectorTable = "chunk_vectors"
+
+// SQLiteVectorTableExists reports whether the vector table exists
+func SQLiteVectorTableExists(ctx context.Context, db *sql.DB, table string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("checking %s: %w", table, err)
+	}
+	return n > 0, nil
+}
+
+// EnsureSQLiteVectorTable creates the vector table if missing; created
+// reports whether it had to
+func EnsureSQLiteVectorTable(ctx context.Context, db *sql.DB, table string) (created bool, err error) {
+	if exists, err := SQLiteVectorTableExists(ctx, db, table); err != nil || exists {
+		return false, err
+	}
+	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+table+` (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		chunk_id TEXT NOT NULL UNIQUE,
+		embedding BLOB NOT NULL
+	)`)
+	if err != nil {
+		return false, fmt.Errorf("creating %s: %w", table, err)
+	}
+	return true, nil
+}
+
+// DropSQLiteVectorTable removes the vector table and everything in it
+func DropSQLiteVectorTable(ctx context.Context, db *sql.DB, table string) error {
+	_, err := db.ExecContext(ctx, `DROP TABLE IF EXISTS `+table)
+	return err
+}
+
+// EncodeVector packs v as little-endian float32
+func EncodeVector(v []float32) []byte {
+	buf := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+	}
+	return buf
+}
+
+// DecodeVector unpacks a BLOB written by EncodeVector
+func DecodeVector(b []byte) ([]float32, error) {
+	if len(b)%4 != 0 {
+		return nil, fmt.Errorf("vector blob length %d is not a multiple of 4", len(b))
+	}
+	v := make([]float32, len(b)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return v, nil
+}
+
+// UpsertSQLiteVectors stores embeddings (same order as chunkIDs) in one
+// transaction. Replacing a row gives it a new id, which searchers use to
+// notice changes.
+func UpsertSQLiteVectors(ctx context.Context, db *sql.DB, table string, chunkIDs []string, embeddings [][]float32) error {
+	if len(chunkIDs) != len(embeddings) {
+		return fmt.Errorf("got %d embeddings for %d chunks", len(embeddings), len(chunkIDs))
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR REPLACE INTO `+table+` (chunk_id, embedding) VALUES (?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, id := range chunkIDs {
+		if _, err := stmt.ExecContext(ctx, id, EncodeVector(embeddings[i])); err != nil {
+			return fmt.Errorf("storing %s: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteSQLiteVectors removes the given chunks' vectors and returns how many
+// existed
+func DeleteSQLiteVectors(ctx context.Context, db *sql.DB, table string, chunkIDs []string) (int, error) {
+	deleted := 0
+	for len(chunkIDs) > 0 {
+		// Stay well under SQLite's bound-parameter limit
+		n := min(len(chunkIDs), 500)
+		args := make([]any, n)
+		for i, id := range chunkIDs[:n] {
+			args[i] = id
+		}
+		res, err := db.ExecContext(ctx, `DELETE FROM `+table+` WHERE chunk_id IN (?`+strings.Repeat(", ?", n-1)+`)`, args...)
+		if err != nil {
+			return deleted, err
+		}
+		affected, _ := res.RowsAffected()
+		deleted += int(affected)
+		chunkIDs = chunkIDs[n:]
+	}
+	return deleted, nil
+}
+
+// SQLiteVectorIDs returns the chunk IDs that have a stored vector
+func SQLiteVectorIDs(ctx context.Context, db *sql.DB, table string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT chunk_id FROM `+table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// SQLiteVectorVersion identifies the table's contents cheaply. IDs are never
+// reused, so any write changes the row count or the highest ID.
+type SQLiteVectorVersion struct {
+	Rows  int64
+	MaxID int64
+}
+
+// GetSQLiteVectorVersion reads the current SQLiteVectorVersion
+func GetSQLiteVectorVersion(ctx context.Context, db *sql.DB, table string) (SQLiteVectorVersion, error) {
+	var v SQLiteVectorVersion
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(MAX(id), 0) FROM `+table).Scan(&v.Rows, &v.MaxID)
+	return v, err
+}
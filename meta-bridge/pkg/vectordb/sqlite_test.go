@@ -0,0 +1,22 @@
+package vectordb
+
+import "testing"
+
+func TestVectorBlobRoundTrip(t *testing.T) {
+	v := []float32{0, 1.5, -2.25, 3e-7}
+	got, err := DecodeVector(EncodeVector(v))
+	if err != nil {
+		t.Fatalf("DecodeVector: %v", err)
+	}
+	if len(got) != len(v) {
+		t.Fatalf("got %v, want %v", got, v)
+	}
+	for i := range v {
+		if got[i] != v[i] {
+			t.Fatalf("got %v, want %v", got, v)
+		}
+	}
+	if _, err := DecodeVector([]byte{1, 2, 3}); err == nil {
+		t.Fatal("expected an error for a truncated blob")
+	}
+}
@@ -1,40 +1,56 @@
 #!/usr/bin/env python3
-"""Polish embedding server using sdadas/mmlw-roberta-large"""
+"""Polish embedding server using sdadas/mmlw-roberta-large
+
+EMBED_MODEL=mmlw-e5-small serves sdadas/mmlw-e5-small instead (384 dims), the
+embedding model of the low-power profile in rag.yaml.
+"""
+import os
+
 from fastapi import FastAPI
 from pydantic import BaseModel
 from sentence_transformers import SentenceTransformer
 import uvicorn
 
+# Served name -> (Hugging Face model, prefix recommended for queries)
+MODELS = {
+    "mmlw-roberta-large": ("sdadas/mmlw-roberta-large", "zapytanie: "),
+    "mmlw-e5-small": ("sdadas/mmlw-e5-small", "query: "),
+}
+MODEL_NAME = os.environ.get("EMBED_MODEL", "mmlw-roberta-large")
+if MODEL_NAME not in MODELS:
+    raise SystemExit(f"Unknown EMBED_MODEL {MODEL_NAME!r} (use one of: {', '.join(MODELS)})")
+HF_MODEL, QUERY_PREFIX = MODELS[MODEL_NAME]
+
 app = FastAPI()
 model = None
 
 class EmbedRequest(BaseModel):
     input: str | list[str]
-    model: str = "mmlw-roberta-large"
+    model: str = MODEL_NAME
 
 @app.on_event("startup")
 def load_model():
     global model
-    print("Loading sdadas/mmlw-roberta-large...")
-    model = SentenceTransformer("sdadas/mmlw-roberta-large")
+    print(f"Loading {HF_MODEL}...")
+    model = SentenceTransformer(HF_MODEL)
     print("Model loaded!")
 
 @app.post("/v1/embeddings")
 def embed(req: EmbedRequest):
     texts = [req.input] if isinstance(req.input, str) else req.input
     # Add query prefix as recommended for this model
-    texts = [f"zapytanie: {t}" for t in texts]
+    texts = [f"{QUERY_PREFIX}{t}" for t in texts]
     embeddings = model.encode(texts).tolist()
     return {
         "object": "list",
         "data": [{"object": "embedding", "embedding": e, "index": i} for i, e in enumerate(embeddings)],
-        "model": "mmlw-roberta-large",
+        "model": MODEL_NAME,
         "usage": {"prompt_tokens": sum(len(t.split()) for t in texts), "total_tokens": sum(len(t.split()) for t in texts)}
     }
 
 @app.get("/v1/models")
 def models():
-    return {"data": [{"id": "mmlw-roberta-large", "object": "model"}]}
+    return {"data": [{"id": MODEL_NAME, "object": "model"}]}
 
 if __name__ == "__main__":
     uvicorn.run(app, host="127.0.0.1", port=1235)
@@ -21,7 +21,7 @@ const EMBEDDING_TIMEOUT_MS = 30_000;
 
 export async function getMilvusClient(): Promise<MilvusClient> {
 	if (!client) {
-		client = new MilvusClient({ address: milvusAddress });
+		client = new MilvusClient({ address: milvusAddress, database: milvusConfig.database });
 	}
 	return client;
 }
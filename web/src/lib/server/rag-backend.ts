@@ -6,6 +6,7 @@
  */
 
 import { RAG_SERVER_URL } from '$env/static/private';
+import { env } from '$env/dynamic/private';
 
 const baseUrl = RAG_SERVER_URL || 'http://127.0.0.1:8090';
 const REQUEST_TIMEOUT_MS = 30_000;
@@ -23,8 +24,14 @@ async function fetchWithTimeout(url: string, init?: RequestInit): Promise<Respon
 		}
 	}
 
+	// rag-server with keys in its auth section needs one of them
+	const headers = new Headers(init?.headers);
+	if (env.RAG_SERVER_API_KEY) {
+		headers.set('Authorization', `Bearer ${env.RAG_SERVER_API_KEY}`);
+	}
+
 	try {
-		return await fetch(url, { ...init, signal: controller.signal });
+		return await fetch(url, { ...init, headers, signal: controller.signal });
 	} catch (err) {
 		if ((err as any)?.name === 'AbortError') {
 			throw new Error(`Request timed out after ${Math.round(REQUEST_TIMEOUT_MS / 1000)}s`);
@@ -72,6 +79,7 @@ export interface SearchHit {
 	message_count: number;
 	session_idx: number;
 	chunk_idx: number;
+	replies?: { message_id: string; reply_to_message_id: string }[];
 
 	// Scoring
 	vector_rank: number | null;
@@ -85,6 +93,14 @@ export interface SearchHit {
 	context_after?: ContextChunk[];
 }
 
+export interface VectorParams {
+	ef: number;
+	fetch_multiplier: number;
+	fetch_limit: number;
+	collection_rows?: number;
+	auto_scaled: boolean;
+}
+
 export interface SearchResponse {
 	query: string;
 	mode: SearchMode;
@@ -92,6 +108,8 @@ export interface SearchResponse {
 	context: number;
 	rrf_k: number;
 	weights: Weights;
+	vector_skipped?: string;
+	vector?: VectorParams;
 	took_ms: number;
 	results: SearchHit[];
 }
@@ -111,6 +129,7 @@ export interface StatsResponse {
 		chunks_indexed: number;
 		fts_table: string;
 		fts_available: boolean;
+		fts_engine?: string;
 	};
 	config: {
 		hash: string;
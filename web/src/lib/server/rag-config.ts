@@ -10,11 +10,13 @@ import path from 'node:path';
 import YAML from 'yaml';
 
 export interface RagConfig {
+	profile: string;
 	database?: {
 		sqlite: string;
 	};
 	milvus: {
 		address: string;
+		database?: string;
 		chunkCollection: string;
 		legacyMessageCollection: string;
 		index: {
@@ -113,6 +115,44 @@ function asBoolean(value: unknown, name: string): boolean {
 	return value;
 }
 
+/**
+ * The low-power profile's values for the settings read here, keyed by path,
+ * with the standard default they replace. Like ragconfig's applyProfile, a
+ * value only changes while it's still the standard default; the embedding
+ * dimension only changes with the model.
+ */
+const LOW_POWER: Record<string, [standard: number | string, lowPower: number | string]> = {
+	'embedding.model': ['mmlw-roberta-large', 'mmlw-e5-small'],
+	'embedding.dimension': [1024, 384],
+	'embedding.batchSize': [32, 8],
+	'milvus.index.m': [16, 8],
+	'milvus.index.efConstruction': [256, 64],
+	'milvus.search.ef': [128, 48],
+	'milvus.search.fetchMultiplier': [3, 2]
+};
+
+function applyProfile(config: RagConfig): RagConfig {
+	if (config.profile === '' || config.profile === 'standard') return config;
+	if (config.profile !== 'low-power') {
+		throw new Error(`Invalid rag.yaml: unknown profile ${JSON.stringify(config.profile)}`);
+	}
+	const isStandard = (key: string, value: number | string) => LOW_POWER[key][0] === value;
+	const preset = (key: string, value: number) =>
+		isStandard(key, value) ? (LOW_POWER[key][1] as number) : value;
+
+	const { embedding, milvus } = config;
+	if (isStandard('embedding.model', embedding.model) && isStandard('embedding.dimension', embedding.dimension)) {
+		embedding.model = LOW_POWER['embedding.model'][1] as string;
+		embedding.dimension = LOW_POWER['embedding.dimension'][1] as number;
+	}
+	embedding.batchSize = preset('embedding.batchSize', embedding.batchSize);
+	milvus.index.m = preset('milvus.index.m', milvus.index.m);
+	milvus.index.efConstruction = preset('milvus.index.efConstruction', milvus.index.efConstruction);
+	milvus.search.ef = preset('milvus.search.ef', milvus.search.ef);
+	milvus.search.fetchMultiplier = preset('milvus.search.fetchMultiplier', milvus.search.fetchMultiplier);
+	return config;
+}
+
 function parseRagYaml(contents: string): RagConfig {
 	const root = asObject(YAML.parse(contents), 'root');
 
@@ -158,10 +198,12 @@ function parseRagYaml(contents: string): RagConfig {
 		throw new Error(`Invalid rag.yaml: expected hybrid.weights to have a positive sum`);
 	}
 
-	return {
+	return applyProfile({
+		profile: root.profile == null ? '' : asString(root.profile, 'profile'),
 		database,
 		milvus: {
 			address: asString(milvus.address, 'milvus.address'),
+			database: milvus.database ? asString(milvus.database, 'milvus.database') : undefined,
 			chunkCollection: asString(milvus.chunk_collection, 'milvus.chunk_collection'),
 			legacyMessageCollection: asString(
 				milvus.legacy_message_collection,
@@ -220,7 +262,7 @@ function parseRagYaml(contents: string): RagConfig {
 				table: bm25Table
 			}
 		}
-	};
+	});
 }
 
 export function getRagConfig(): RagConfig {